@@ -0,0 +1,143 @@
+/// Cross-check a transfer channel against its counterparty chain
+///
+/// Reads `bridge_report` from the IBC transfer contract, then asks the
+/// counterparty chain's REST endpoint for the other side of every line:
+/// the supply of the voucher backed by each escrow here, and the escrow
+/// backing each voucher minted here. Neither side may exceed the tokens
+/// backing it; a shortfall the other way is reported as in flight, since a
+/// packet may be committed on one chain and not yet received on the other.
+/// Exits non-zero when a discrepancy is found or a query fails:
+///
+///     cargo run --example bridge_report -- --rpc-url https://rpc.testnet.near.org \
+///         --contract-id transfer.cosmos.testnet --channel channel-0 \
+///         --counterparty-rest https://rest.sentry-01.theta-testnet.polypore.xyz
+
+use std::collections::HashMap;
+use std::process::exit;
+
+use base64::Engine;
+use cosmos_sdk_contract::modules::ibc::transfer::BridgeReport;
+use cosmos_sdk_contract::Balance;
+use serde_json::{json, Value};
+
+/// View call against a NEAR contract
+async fn view(client: &reqwest::Client, url: &str, contract_id: &str, method: &str, args: Value) -> anyhow::Result<Value> {
+    let request = json!({
+        "jsonrpc": "2.0",
+        "id": "bridge_report",
+        "method": "query",
+        "params": {
+            "request_type": "call_function",
+            "finality": "final",
+            "account_id": contract_id,
+            "method_name": method,
+            "args_base64": base64::engine::general_purpose::STANDARD.encode(args.to_string()),
+        }
+    });
+    let response: Value = client.post(url).json(&request).send().await?.json().await?;
+    if let Some(error) = response.get("error").or_else(|| response["result"].get("error")) {
+        anyhow::bail!("{} failed: {}", method, error);
+    }
+    let bytes: Vec<u8> = serde_json::from_value(response["result"]["result"].clone())?;
+    Ok(serde_json::from_slice(&bytes)?)
+}
+
+/// Counterparty chain queried through its Cosmos SDK REST API
+struct Counterparty {
+    client: reqwest::Client,
+    rest_url: String,
+}
+
+impl Counterparty {
+    async fn get(&self, path: &str) -> anyhow::Result<Value> {
+        let url = format!("{}{}", self.rest_url.trim_end_matches('/'), path);
+        let response = self.client.get(&url).send().await?;
+        if !response.status().is_success() {
+            anyhow::bail!("GET {} returned {}", url, response.status());
+        }
+        Ok(response.json().await?)
+    }
+
+    async fn supply_of(&self, denom: &str) -> anyhow::Result<Balance> {
+        let supply = self.get(&format!("/cosmos/bank/v1beta1/supply/by_denom?denom={}", denom)).await?;
+        parse_amount(&supply["amount"]["amount"])
+    }
+
+    async fn escrowed(&self, port_id: &str, channel_id: &str, denom: &str) -> anyhow::Result<Balance> {
+        let escrow = self.get(&format!("/ibc/apps/transfer/v1/channels/{}/ports/{}/escrow_address", channel_id, port_id)).await?;
+        let address = escrow["escrow_address"].as_str()
+            .ok_or_else(|| anyhow::anyhow!("no escrow address for {}/{}", port_id, channel_id))?;
+        let balance = self.get(&format!("/cosmos/bank/v1beta1/balances/{}/by_denom?denom={}", address, denom)).await?;
+        parse_amount(&balance["balance"]["amount"])
+    }
+}
+
+/// Amounts are decimal strings, a missing one is zero
+fn parse_amount(value: &Value) -> anyhow::Result<Balance> {
+    match value.as_str() {
+        Some(amount) => Ok(amount.parse()?),
+        None => Ok(0),
+    }
+}
+
+/// Compare what one side holds against what backs it on the other
+fn compare(what: &str, backed: Balance, backing: Balance, findings: &mut Vec<String>) {
+    if backed > backing {
+        findings.push(format!("{}: {} outstanding but only {} backing it", what, backed, backing));
+    } else if backed < backing {
+        println!("{}: {} in flight", what, backing - backed);
+    }
+}
+
+fn parse_args() -> HashMap<String, String> {
+    let args: Vec<String> = std::env::args().skip(1).collect();
+    args.chunks(2)
+        .filter_map(|pair| match pair {
+            [flag, value] if flag.starts_with("--") => Some((flag.trim_start_matches("--").to_string(), value.clone())),
+            _ => None,
+        })
+        .collect()
+}
+
+async fn run(args: HashMap<String, String>) -> anyhow::Result<Vec<String>> {
+    let arg = |name: &str| args.get(name).cloned().ok_or_else(|| anyhow::anyhow!(
+        "usage: bridge_report --rpc-url URL --contract-id ID --channel CHANNEL --counterparty-rest URL"
+    ));
+    let client = reqwest::Client::new();
+    let report: BridgeReport = serde_json::from_value(
+        view(&client, &arg("rpc-url")?, &arg("contract-id")?, "bridge_report", json!({ "channel_id": arg("channel")? })).await?,
+    )?;
+    println!("{}", serde_json::to_string_pretty(&report)?);
+
+    let counterparty_channel = report.counterparty_channel_id.clone()
+        .ok_or_else(|| anyhow::anyhow!("channel {} has no counterparty channel yet", report.channel_id))?;
+    let counterparty = Counterparty { client, rest_url: arg("counterparty-rest")? };
+    let mut findings = report.discrepancies.clone();
+
+    for escrow in &report.escrows {
+        let supply = counterparty.supply_of(&escrow.counterparty_denom).await?;
+        compare(&format!("{} vouchers ({})", escrow.denom, escrow.counterparty_denom), supply, escrow.escrowed, &mut findings);
+    }
+    for voucher in &report.vouchers {
+        let escrowed = counterparty.escrowed(&report.counterparty_port_id, &counterparty_channel, &voucher.counterparty_denom).await?;
+        compare(&format!("{} ({})", voucher.denom, voucher.trace_path), voucher.recorded_supply, escrowed, &mut findings);
+    }
+    Ok(findings)
+}
+
+#[tokio::main]
+async fn main() {
+    match run(parse_args()).await {
+        Ok(findings) if findings.is_empty() => println!("bridge reconciles"),
+        Ok(findings) => {
+            for finding in findings {
+                eprintln!("discrepancy: {}", finding);
+            }
+            exit(1);
+        }
+        Err(error) => {
+            eprintln!("bridge report failed: {}", error);
+            exit(2);
+        }
+    }
+}
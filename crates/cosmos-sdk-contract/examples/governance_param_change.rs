@@ -0,0 +1,85 @@
+/// Governance flow: submit a proposal, vote with stake, apply the parameter
+///
+/// Alice delegates to a validator, proposes doubling the voting period and
+/// both vote yes with the stake snapshotted when voting opened. Once the
+/// voting period ends the block logic tallies the votes and applies the new
+/// value. Run with:
+///
+///     cargo run --example governance_param_change
+
+use cosmos_sdk_contract::modules::bank::BankModule;
+use cosmos_sdk_contract::modules::block::BlockModule;
+use cosmos_sdk_contract::modules::gov::{GovernanceModule, ProposalStatus};
+use cosmos_sdk_contract::modules::staking::{bonded_pool_account, StakingModule};
+use near_sdk::test_utils::VMContextBuilder;
+use near_sdk::{testing_env, AccountId};
+
+fn at_height(height: u64) {
+    testing_env!(VMContextBuilder::new()
+        .current_account_id("cosmos.near".parse().unwrap())
+        .block_height(height)
+        .build());
+}
+
+fn main() {
+    at_height(10);
+    let alice: AccountId = "alice.near".parse().unwrap();
+    let validator: AccountId = "validator1.near".parse().unwrap();
+    let mut bank = BankModule::new();
+    let mut staking = StakingModule::new();
+    let mut gov = GovernanceModule::new();
+    let mut blocks = BlockModule::new("proxima-localnet".to_string());
+    blocks.process_blocks(1, &mut staking, &mut gov);
+
+    bank.mint(&bonded_pool_account(), 1_000);
+    staking.create_validator(
+        validator.to_string(),
+        vec![1; 32],
+        "Validator One".to_string(),
+        None,
+        None,
+        None,
+        None,
+        "0.1".to_string(),
+        "0.2".to_string(),
+        "0.01".to_string(),
+        1,
+        1_000,
+    ).expect("validator is created");
+    bank.mint(&alice, 500);
+    staking.delegate_from_bank(&mut bank, &alice, validator.to_string(), 500)
+        .expect("alice delegates");
+
+    // 1. Submit: voting_period 50 -> 100, voting ends at height 60
+    let voting_period = gov.get_parameter(&"voting_period".to_string());
+    let proposal_id = gov.submit_proposal(
+        &alice,
+        "Longer voting period".to_string(),
+        "Give validators more time to vote".to_string(),
+        "voting_period".to_string(),
+        "100".to_string(),
+        String::new(),
+        None,
+        10,
+    );
+    gov.snapshot_stake(proposal_id, &staking, 10);
+    println!("proposal {} submitted, voting_period is {}", proposal_id, voting_period);
+
+    // 2. Vote with 1500 bonded tokens
+    gov.vote(&alice, proposal_id, 1, String::new());
+    gov.vote(&validator, proposal_id, 1, String::new());
+    let tally = gov.tally(proposal_id);
+    assert_eq!((tally.yes, tally.no), (1_500, 0));
+    println!("tally: {} yes, {} no", tally.yes, tally.no);
+
+    // 3. Advance past the end of the voting period
+    at_height(59);
+    while blocks.process_blocks(50, &mut staking, &mut gov).remaining > 0 {}
+    assert_eq!(gov.get_proposal(proposal_id).unwrap().status, ProposalStatus::Active);
+
+    at_height(60);
+    blocks.process_blocks(1, &mut staking, &mut gov);
+    assert_eq!(gov.get_proposal(proposal_id).unwrap().status, ProposalStatus::Passed);
+    assert_eq!(gov.get_parameter(&"voting_period".to_string()), "100");
+    println!("proposal {} passed, voting_period is now 100", proposal_id);
+}
@@ -0,0 +1,96 @@
+/// IBC transfer round trip: unear out to a wasmd chain and back
+///
+/// Opens an ICS-20 channel, sends alice's unear to a wasmd account and
+/// receives it back to bob, checking escrow at every step. The NEAR side runs
+/// the real transfer and channel modules in process. The wasmd side is
+/// played by this program: it acknowledges the outgoing packet and builds
+/// the return packet the way wasmd's transfer module would, so the flow can
+/// be checked without a running chain. Against a live wasmd, start it and
+/// the relayer with `crates/ibc-relayer/scripts/local-testnet.sh` and let
+/// the relayer carry the packets instead.
+///
+///     cargo run --example ibc_transfer_roundtrip
+
+use cosmos_sdk_contract::modules::bank::BankModule;
+use cosmos_sdk_contract::modules::ibc::channel::{ChannelModule, Height, Order, Packet};
+use cosmos_sdk_contract::modules::ibc::transfer::{FungibleTokenPacketData, TransferModule};
+use near_sdk::test_utils::VMContextBuilder;
+use near_sdk::{testing_env, AccountId};
+
+const WASMD_CHANNEL: &str = "channel-7";
+const WASMD_RECEIVER: &str = "wasm1qnk2n4nlkpw9xfqntladh74w6ujtulwnmxnh3k";
+
+fn main() {
+    testing_env!(VMContextBuilder::new()
+        .current_account_id("cosmos.near".parse().unwrap())
+        .block_height(100)
+        .build());
+    let alice: AccountId = "alice.near".parse().unwrap();
+    let bob: AccountId = "bob.near".parse().unwrap();
+    let mut bank = BankModule::new();
+    let mut channels = ChannelModule::new();
+    let mut transfer = TransferModule::new();
+    bank.mint(&alice, 1_000);
+
+    // 1. Open transfer/channel-0 to wasmd's transfer/channel-7
+    let channel_id = channels.chan_open_init(
+        "transfer".to_string(),
+        Order::Unordered,
+        vec!["connection-0".to_string()],
+        "transfer".to_string(),
+        "ics20-1".to_string(),
+    );
+    channels.chan_open_ack(
+        "transfer".to_string(),
+        channel_id.clone(),
+        WASMD_CHANNEL.to_string(),
+        "ics20-1".to_string(),
+        vec![1],
+        1,
+    ).expect("channel opens");
+    println!("opened transfer/{} <-> transfer/{}", channel_id, WASMD_CHANNEL);
+
+    // 2. Send 400 unear to wasmd, escrowing it here
+    let sequence = transfer.send_transfer(
+        &mut channels,
+        &mut bank,
+        "transfer".to_string(),
+        channel_id.clone(),
+        "unear".to_string(),
+        400,
+        alice.to_string(),
+        WASMD_RECEIVER.to_string(),
+        Height { revision_number: 0, revision_height: 1_000 },
+        0,
+        None,
+    ).expect("transfer is sent");
+    assert_eq!(bank.get_balance(&alice), 600);
+    assert_eq!(transfer.get_escrowed_amount("transfer", &channel_id, "unear"), 400);
+    println!("sent 400 unear as packet {}, escrowed on {}", sequence, channel_id);
+
+    // 3. wasmd returns 150 of the vouchers to bob
+    let data = FungibleTokenPacketData::new(
+        format!("transfer/{}/unear", channel_id),
+        "150".to_string(),
+        WASMD_RECEIVER.to_string(),
+        bob.to_string(),
+        None,
+    );
+    let packet = Packet {
+        sequence: 1,
+        source_port: "transfer".to_string(),
+        source_channel: WASMD_CHANNEL.to_string(),
+        destination_port: "transfer".to_string(),
+        destination_channel: channel_id.clone(),
+        data: data.to_bytes().expect("packet data encodes"),
+        timeout_height: Height { revision_number: 0, revision_height: 1_000 },
+        timeout_timestamp: 0,
+    };
+    let ack = transfer.receive_transfer(&channels, &mut bank, &packet).expect("packet is received");
+    assert!(!String::from_utf8_lossy(&ack.data).contains("error"), "error acknowledgement");
+
+    // 4. The returned tokens come out of escrow, not from a mint
+    assert_eq!(bank.get_balance(&bob), 150);
+    assert_eq!(transfer.get_escrowed_amount("transfer", &channel_id, "unear"), 250);
+    println!("received 150 unear for bob, 250 still escrowed");
+}
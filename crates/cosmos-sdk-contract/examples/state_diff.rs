@@ -0,0 +1,105 @@
+/// List the bank keys that changed between two heights
+///
+/// Pages through `state_diff` of a deployed bank contract and prints one
+/// line per changed key with the last height it changed at and how many
+/// ledger entries touched it. Feed the keys to an indexer to refresh only
+/// what moved, or compare them against the expected transactions when a
+/// balance looks off. Exits with 1 when the ledger no longer reaches back
+/// to `--from`, so part of the range may be missing, and 2 on errors:
+///
+///     cargo run --example state_diff -- --rpc-url https://rpc.testnet.near.org \
+///         --contract-id bank.cosmos.testnet --from 1200 --to 1300
+
+use std::collections::{BTreeMap, HashMap};
+use std::process::exit;
+
+use base64::Engine;
+use cosmos_sdk_contract::modules::bank::{KeyChange, StateDiff};
+use serde_json::{json, Value};
+
+/// View call against a NEAR contract
+async fn view(client: &reqwest::Client, url: &str, contract_id: &str, method: &str, args: Value) -> anyhow::Result<Value> {
+    let request = json!({
+        "jsonrpc": "2.0",
+        "id": "state_diff",
+        "method": "query",
+        "params": {
+            "request_type": "call_function",
+            "finality": "final",
+            "account_id": contract_id,
+            "method_name": method,
+            "args_base64": base64::engine::general_purpose::STANDARD.encode(args.to_string()),
+        }
+    });
+    let response: Value = client.post(url).json(&request).send().await?.json().await?;
+    if let Some(error) = response.get("error").or_else(|| response["result"].get("error")) {
+        anyhow::bail!("{} failed: {}", method, error);
+    }
+    let bytes: Vec<u8> = serde_json::from_value(response["result"]["result"].clone())?;
+    Ok(serde_json::from_slice(&bytes)?)
+}
+
+/// Fold a page into the keys collected so far
+fn merge(keys: &mut BTreeMap<String, KeyChange>, page: Vec<KeyChange>) {
+    for change in page {
+        match keys.get_mut(&change.key) {
+            Some(seen) => {
+                seen.height = seen.height.max(change.height);
+                seen.changes += change.changes;
+            }
+            None => {
+                keys.insert(change.key.clone(), change);
+            }
+        }
+    }
+}
+
+fn parse_args() -> HashMap<String, String> {
+    let args: Vec<String> = std::env::args().skip(1).collect();
+    args.chunks(2)
+        .filter_map(|pair| match pair {
+            [flag, value] if flag.starts_with("--") => Some((flag.trim_start_matches("--").to_string(), value.clone())),
+            _ => None,
+        })
+        .collect()
+}
+
+async fn run(args: HashMap<String, String>) -> anyhow::Result<(Vec<KeyChange>, bool)> {
+    let arg = |name: &str| args.get(name).cloned().ok_or_else(|| anyhow::anyhow!(
+        "usage: state_diff --rpc-url URL --contract-id ID --from HEIGHT --to HEIGHT"
+    ));
+    let (url, contract_id) = (arg("rpc-url")?, arg("contract-id")?);
+    let (from_height, to_height): (u64, u64) = (arg("from")?.parse()?, arg("to")?.parse()?);
+    let client = reqwest::Client::new();
+
+    let mut keys = BTreeMap::new();
+    let mut from_id: Option<u64> = None;
+    loop {
+        let args = json!({ "from_height": from_height, "to_height": to_height, "from_id": from_id });
+        let page: StateDiff = serde_json::from_value(view(&client, &url, &contract_id, "state_diff", args).await?)?;
+        merge(&mut keys, page.keys);
+        if page.next_from_id.is_none() {
+            return Ok((keys.into_values().collect(), page.complete));
+        }
+        from_id = page.next_from_id;
+    }
+}
+
+#[tokio::main]
+async fn main() {
+    match run(parse_args()).await {
+        Ok((keys, complete)) => {
+            for change in &keys {
+                println!("{}\t{}\t{}", change.key, change.height, change.changes);
+            }
+            if !complete {
+                eprintln!("ledger was pruned past the start of the range, changes right after it may be missing");
+                exit(1);
+            }
+        }
+        Err(error) => {
+            eprintln!("state diff failed: {}", error);
+            exit(2);
+        }
+    }
+}
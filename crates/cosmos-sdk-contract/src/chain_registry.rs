@@ -0,0 +1,244 @@
+/// Chain Registry Metadata
+///
+/// Wallets such as Keplr and Leap configure themselves from the
+/// cosmos/chain-registry: a `chain.json` with the chain id, bech32 prefix,
+/// fee and staking tokens, an `assetlist.json` with denom units, and one
+/// `_IBC` file per connected chain. The `chain_metadata` view returns the
+/// three documents for this deployment, built from the router's chain id
+/// and version plus the `ChainRegistryInfo` the owner publishes.
+
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use schemars::JsonSchema;
+use serde::{Deserialize, Serialize};
+use serde_json::{json, Value};
+
+use crate::modules::bank::Metadata;
+
+pub const CHAIN_SCHEMA: &str = "../chain.schema.json";
+pub const ASSETLIST_SCHEMA: &str = "../assetlist.schema.json";
+pub const IBC_SCHEMA: &str = "../ibc_data.schema.json";
+
+/// Gas prices of a fee token, in base units per gas
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct FeeToken {
+    pub denom: String,
+    pub fixed_min_gas_price: f64,
+    pub low_gas_price: f64,
+    pub average_gas_price: f64,
+    pub high_gas_price: f64,
+}
+
+/// Channel of an IBC connection, seen from this chain
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct IbcChannelInfo {
+    pub channel_id: String,
+    pub port_id: String,
+    pub counterparty_channel_id: String,
+    pub counterparty_port_id: String,
+    /// `ordered` or `unordered`
+    pub ordering: String,
+    pub version: String,
+}
+
+/// Light client and connection to another chain
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct IbcClientInfo {
+    pub counterparty_chain_name: String,
+    pub client_id: String,
+    pub connection_id: String,
+    pub counterparty_client_id: String,
+    pub counterparty_connection_id: String,
+    #[serde(default)]
+    pub channels: Vec<IbcChannelInfo>,
+}
+
+/// Registry details the router cannot derive from its own state
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct ChainRegistryInfo {
+    /// Registry directory name, e.g. `nearcosmos`
+    pub chain_name: String,
+    pub pretty_name: String,
+    /// `mainnet`, `testnet` or `devnet`
+    pub network_type: String,
+    pub bech32_prefix: String,
+    #[serde(default)]
+    pub fee_tokens: Vec<FeeToken>,
+    /// Denom of the bonded token
+    pub staking_denom: String,
+    /// Denom metadata of the chain's assets, in the bank module's format
+    #[serde(default)]
+    pub assets: Vec<Metadata>,
+    #[serde(default)]
+    pub ibc: Vec<IbcClientInfo>,
+}
+
+impl Default for ChainRegistryInfo {
+    fn default() -> Self {
+        Self {
+            chain_name: String::new(),
+            pretty_name: String::new(),
+            network_type: "devnet".to_string(),
+            bech32_prefix: "near".to_string(),
+            fee_tokens: Vec::new(),
+            staking_denom: "stake".to_string(),
+            assets: Vec::new(),
+            ibc: Vec::new(),
+        }
+    }
+}
+
+impl ChainRegistryInfo {
+    pub fn validate(&self) -> Result<(), String> {
+        if self.chain_name.is_empty() || !self.chain_name.chars().all(|c| c.is_ascii_lowercase() || c.is_ascii_digit()) {
+            return Err(format!("Chain name {:?} must be lowercase alphanumeric", self.chain_name));
+        }
+        if !["mainnet", "testnet", "devnet"].contains(&self.network_type.as_str()) {
+            return Err(format!("Unknown network type {}", self.network_type));
+        }
+        if self.bech32_prefix.is_empty() || self.bech32_prefix.chars().any(|c| !c.is_ascii_lowercase()) {
+            return Err(format!("Bech32 prefix {:?} must be lowercase letters", self.bech32_prefix));
+        }
+        for token in &self.fee_tokens {
+            let prices = [token.fixed_min_gas_price, token.low_gas_price, token.average_gas_price, token.high_gas_price];
+            if token.denom.is_empty() || prices.iter().any(|price| !price.is_finite() || *price < 0.0) {
+                return Err(format!("Invalid fee token {:?}", token.denom));
+            }
+        }
+        for asset in &self.assets {
+            asset.validate()?;
+        }
+        for client in &self.ibc {
+            if client.client_id.is_empty() || client.connection_id.is_empty() {
+                return Err(format!("IBC client to {} needs a client and connection id", client.counterparty_chain_name));
+            }
+        }
+        Ok(())
+    }
+}
+
+/// Build the `chain.json`, `assetlist.json` and `_IBC` documents
+pub fn chain_metadata(info: &ChainRegistryInfo, chain_id: &str, version: &str) -> Value {
+    let chain_name = if info.chain_name.is_empty() { chain_id } else { info.chain_name.as_str() };
+
+    let chain = json!({
+        "$schema": CHAIN_SCHEMA,
+        "chain_name": chain_name,
+        "status": "live",
+        "network_type": info.network_type,
+        "pretty_name": info.pretty_name,
+        "chain_id": chain_id,
+        "bech32_prefix": info.bech32_prefix,
+        "slip44": 118,
+        "key_algos": ["secp256k1"],
+        "fees": { "fee_tokens": info.fee_tokens },
+        "staking": { "staking_tokens": [{ "denom": info.staking_denom }] },
+        "codebase": { "recommended_version": version },
+    });
+
+    let assets: Vec<Value> = info.assets.iter()
+        .map(|asset| json!({
+            "description": asset.description,
+            "denom_units": asset.denom_units,
+            "base": asset.base,
+            "name": asset.name,
+            "display": asset.display,
+            "symbol": asset.symbol,
+            "type_asset": if asset.base.starts_with("ibc/") { "ics20" } else { "sdk.coin" },
+        }))
+        .collect();
+
+    let ibc: Vec<Value> = info.ibc.iter()
+        .map(|client| json!({
+            "$schema": IBC_SCHEMA,
+            "chain_1": {
+                "chain_name": chain_name,
+                "client_id": client.client_id,
+                "connection_id": client.connection_id,
+            },
+            "chain_2": {
+                "chain_name": client.counterparty_chain_name,
+                "client_id": client.counterparty_client_id,
+                "connection_id": client.counterparty_connection_id,
+            },
+            "channels": client.channels.iter().map(|channel| json!({
+                "chain_1": { "channel_id": channel.channel_id, "port_id": channel.port_id },
+                "chain_2": { "channel_id": channel.counterparty_channel_id, "port_id": channel.counterparty_port_id },
+                "ordering": channel.ordering,
+                "version": channel.version,
+            })).collect::<Vec<_>>(),
+        }))
+        .collect();
+
+    json!({
+        "chain": chain,
+        "assetlist": {
+            "$schema": ASSETLIST_SCHEMA,
+            "chain_name": chain_name,
+            "assets": assets,
+        },
+        "ibc": ibc,
+        "contract_version": version,
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::modules::bank::DenomUnit;
+
+    fn info() -> ChainRegistryInfo {
+        ChainRegistryInfo {
+            chain_name: "nearcosmos".to_string(),
+            pretty_name: "NEAR Cosmos".to_string(),
+            fee_tokens: vec![FeeToken {
+                denom: "unear".to_string(),
+                fixed_min_gas_price: 0.0,
+                low_gas_price: 0.01,
+                average_gas_price: 0.025,
+                high_gas_price: 0.04,
+            }],
+            assets: vec![Metadata {
+                description: String::new(),
+                denom_units: vec![
+                    DenomUnit { denom: "unear".to_string(), exponent: 0, aliases: vec![] },
+                    DenomUnit { denom: "near".to_string(), exponent: 6, aliases: vec![] },
+                ],
+                base: "unear".to_string(),
+                display: "near".to_string(),
+                name: "NEAR".to_string(),
+                symbol: "NEAR".to_string(),
+            }],
+            ibc: vec![IbcClientInfo {
+                counterparty_chain_name: "cosmoshub".to_string(),
+                client_id: "07-tendermint-0".to_string(),
+                connection_id: "connection-0".to_string(),
+                counterparty_client_id: "07-tendermint-1".to_string(),
+                counterparty_connection_id: "connection-1".to_string(),
+                channels: vec![],
+            }],
+            ..ChainRegistryInfo::default()
+        }
+    }
+
+    #[test]
+    fn test_documents_follow_registry_layout() {
+        let metadata = chain_metadata(&info(), "near-localnet", "0.1.0");
+
+        assert_eq!(metadata["chain"]["chain_id"], "near-localnet");
+        assert_eq!(metadata["chain"]["bech32_prefix"], "near");
+        assert_eq!(metadata["chain"]["fees"]["fee_tokens"][0]["average_gas_price"], 0.025);
+        assert_eq!(metadata["chain"]["codebase"]["recommended_version"], "0.1.0");
+        assert_eq!(metadata["assetlist"]["assets"][0]["denom_units"][1]["exponent"], 6);
+        assert_eq!(metadata["ibc"][0]["chain_2"]["chain_name"], "cosmoshub");
+    }
+
+    #[test]
+    fn test_validation() {
+        assert!(info().validate().is_ok());
+        assert!(ChainRegistryInfo::default().validate().is_err());
+
+        let mut bad = info();
+        bad.bech32_prefix = "Near".to_string();
+        assert!(bad.validate().unwrap_err().contains("Bech32 prefix"));
+    }
+}
@@ -7,19 +7,47 @@
 /// - Supply management
 
 use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
-use near_sdk::{env, near_bindgen, AccountId, PanicOnDefault};
+use near_sdk::json_types::U128;
+use near_sdk::{
+    assert_one_yocto, env, ext_contract, near_bindgen, require, AccountId, Gas, NearToken, PanicOnDefault, Promise,
+    PromiseOrValue, PromiseResult,
+};
 use near_sdk::serde::{Deserialize, Serialize};
 use schemars::JsonSchema;
 
-use crate::modules::bank::BankModule;
+use crate::modules::bank::{
+    BankGenesis, BankModule, Coin, CoinLock, Coins, DisplayCoin, FtToken, LedgerPage, Metadata, ModuleAccount, MultiSend, NativeToken,
+    SendAuthorization, SendEntry, SetSendEnabled, StateDiff, StorageBalance, StorageBalanceBounds, SupplyProof, TransferRecord, FT_STORAGE_DEPOSIT,
+};
+use crate::modules::compliance::{ComplianceMode, ComplianceModule};
+use crate::modules::storage_usage::{StorageMeter, StorageUsageReport};
 use crate::Balance;
 
+/// Gas for the receiver's `ft_on_transfer`
+const GAS_FOR_FT_ON_TRANSFER: Gas = Gas::from_tgas(25);
+/// Gas for settling an `ft_transfer_call`
+const GAS_FOR_RESOLVE_TRANSFER: Gas = Gas::from_tgas(5);
+
+#[ext_contract(ext_ft_receiver)]
+pub trait FungibleTokenReceiver {
+    fn ft_on_transfer(&mut self, sender_id: AccountId, amount: U128, msg: String) -> PromiseOrValue<U128>;
+}
+
+#[ext_contract(ext_ft_resolver)]
+pub trait FungibleTokenResolver {
+    fn ft_resolve_transfer(&mut self, sender_id: AccountId, receiver_id: AccountId, amount: U128) -> U128;
+}
+
 /// Bank contract state
 #[near_bindgen]
 #[derive(BorshDeserialize, BorshSerialize, PanicOnDefault)]
 pub struct BankContract {
     /// The underlying bank module
     bank_module: BankModule,
+    /// Governance controlled send restrictions
+    compliance: ComplianceModule,
+    /// Bytes stored by bank and compliance
+    storage_meter: StorageMeter,
     /// Router contract that can call this module
     router_contract: Option<AccountId>,
     /// Contract owner for admin operations
@@ -43,6 +71,9 @@ pub struct TransferRequest {
     pub from: String,
     pub to: String,
     pub amount: Balance,
+    /// Payment reference recorded with the transfer
+    #[serde(default)]
+    pub memo: Option<String>,
 }
 
 /// Mint request data  
@@ -54,25 +85,60 @@ pub struct MintRequest {
 
 #[near_bindgen]
 impl BankContract {
+    /// `native_token` defaults to NEAR when not given
+    ///
+    /// Compliance rules are governed through the router, or by the owner
+    /// when there is none, until that authority hands them on.
     #[init]
-    pub fn new(owner: AccountId, router_contract: Option<AccountId>) -> Self {
+    pub fn new(owner: AccountId, router_contract: Option<AccountId>, native_token: Option<NativeToken>) -> Self {
+        let mut bank_module = BankModule::new();
+        if let Some(token) = native_token {
+            bank_module.init_native_token(&token).unwrap_or_else(|error| env::panic_str(&error));
+        }
+        let mut compliance = ComplianceModule::new();
+        let authority = router_contract.clone().unwrap_or_else(|| owner.clone());
+        compliance.set_authority(&env::current_account_id(), authority)
+            .unwrap_or_else(|error| env::panic_str(&error));
         Self {
-            bank_module: BankModule::new(),
+            bank_module,
+            compliance,
+            storage_meter: StorageMeter::new(b"su"),
             router_contract,
             owner,
         }
     }
 
+    /// Bank bootstrapped from `genesis`, such as the `export_state` of an
+    /// earlier deployment
+    #[init]
+    pub fn init(
+        owner: AccountId,
+        router_contract: Option<AccountId>,
+        native_token: Option<NativeToken>,
+        genesis: BankGenesis,
+    ) -> Self {
+        let mut contract = Self::new(owner, router_contract, native_token);
+        contract.storage_meter.track("bank", || contract.bank_module.init_genesis(&genesis))
+            .unwrap_or_else(|error| env::panic_str(&error));
+        contract
+    }
+
+    /// Bank state as a genesis for `init`, e.g. to migrate to a new deployment
+    pub fn export_state(&self) -> BankGenesis {
+        self.bank_module.export_genesis()
+    }
+
     // =============================================================================
     // Core Banking Functions
     // =============================================================================
 
-    /// Transfer tokens between accounts
+    /// Transfer tokens between accounts, optionally with a payment reference
     pub fn transfer(
         &mut self,
         from: AccountId,
         to: AccountId,
         amount: Balance,
+        memo: Option<String>,
     ) -> BankOperationResponse {
         self.assert_authorized_caller();
         
@@ -89,21 +155,18 @@ impl BankContract {
             };
         }
 
-        // Check sufficient balance
-        let from_balance = self.bank_module.get_balance(&from);
-        if from_balance < amount {
+        // Perform the transfer once compliance rules and balance allow it
+        let memo = memo.unwrap_or_default();
+        if let Err(error) = self.storage_meter.track("bank", || self.bank_module.send_with_memo(&self.compliance, &from, &to, amount, memo)) {
             return BankOperationResponse {
                 success: false,
                 amount: Some(amount),
                 from_account: Some(from.to_string()),
                 to_account: Some(to.to_string()),
                 events: vec![],
-                error: Some(format!("Insufficient balance: has {}, need {}", from_balance, amount)),
+                error: Some(error),
             };
         }
-
-        // Perform the transfer
-        self.bank_module.transfer(&from, &to, amount);
         
         env::log_str(&format!("Transferred {} from {} to {}", amount, from, to));
         
@@ -134,7 +197,7 @@ impl BankContract {
             };
         }
 
-        self.bank_module.mint(&to, amount);
+        self.storage_meter.track("bank", || self.bank_module.mint(&to, amount));
         
         env::log_str(&format!("Minted {} to {}", amount, to));
         
@@ -148,8 +211,9 @@ impl BankContract {
         }
     }
 
-    /// Burn tokens from an account
-    pub fn burn(&mut self, from: AccountId, amount: Balance) -> BankOperationResponse {
+    /// Burn tokens from an account, of the native denom unless `denom` is
+    /// given, and remove them from the supply
+    pub fn burn(&mut self, from: AccountId, amount: Balance, denom: Option<String>) -> BankOperationResponse {
         self.assert_authorized_caller();
         
         // Validate that the caller is either the account holder or authorized
@@ -165,8 +229,9 @@ impl BankContract {
             };
         }
 
-        // Check sufficient balance
-        let from_balance = self.bank_module.get_balance(&from);
+        // Check sufficient balance, locked coins cannot be burned
+        let denom = denom.unwrap_or_else(|| self.bank_module.native_denom().to_string());
+        let from_balance = self.bank_module.get_spendable_balance(&from, &denom);
         if from_balance < amount {
             return BankOperationResponse {
                 success: false,
@@ -178,9 +243,9 @@ impl BankContract {
             };
         }
 
-        self.bank_module.burn(&from, amount);
+        self.storage_meter.track("bank", || self.bank_module.burn_denom(&from, &denom, amount));
         
-        env::log_str(&format!("Burned {} from {}", amount, from));
+        env::log_str(&format!("Burned {} {} from {}", amount, denom, from));
         
         BankOperationResponse {
             success: true,
@@ -198,6 +263,153 @@ impl BankContract {
         self.bank_module.get_balance(&account)
     }
 
+    /// Balance of any denom, such as an IBC voucher
+    pub fn get_denom_balance(&self, account: AccountId, denom: String) -> Balance {
+        self.assert_authorized_caller();
+        self.bank_module.get_denom_balance(&account, &denom)
+    }
+
+    /// Every denom an account holds, sorted by denom
+    pub fn get_account_balances(&self, account: AccountId) -> Vec<Coin> {
+        self.assert_authorized_caller();
+        self.bank_module.get_all_balances(account).into_vec()
+    }
+
+    /// Balance an account can send, its balance less its locked coins
+    pub fn get_spendable_balance(&self, account: AccountId, denom: Option<String>) -> Balance {
+        self.assert_authorized_caller();
+        let denom = denom.unwrap_or_else(|| self.bank_module.native_denom().to_string());
+        self.bank_module.get_spendable_balance(&account, &denom)
+    }
+
+    /// Active coin locks of an account
+    pub fn get_locked_coins(&self, account: AccountId) -> Vec<CoinLock> {
+        self.assert_authorized_caller();
+        self.bank_module.get_locks(&account)
+    }
+
+    /// Lock coins of an account on behalf of the calling module (only owner
+    /// or router), until released or until `unlock_time` in nanoseconds
+    pub fn lock_coins(
+        &mut self,
+        account: AccountId,
+        amount: Balance,
+        denom: Option<String>,
+        unlock_time: Option<u64>,
+    ) -> BankOperationResponse {
+        self.assert_authorized_caller();
+        let module = env::predecessor_account_id().to_string();
+        let denom = denom.unwrap_or_else(|| self.bank_module.native_denom().to_string());
+        let result = self.storage_meter.track("bank", || {
+            self.bank_module.lock_coins(&account, &denom, amount, &module, unlock_time)
+        });
+        BankOperationResponse {
+            success: result.is_ok(),
+            amount: Some(amount),
+            from_account: Some(account.to_string()),
+            to_account: None,
+            events: if result.is_ok() { vec!["coins_locked".to_string()] } else { vec![] },
+            error: result.err(),
+        }
+    }
+
+    /// Release a lock created by the calling module
+    pub fn unlock_coins(&mut self, lock_id: u64) -> BankOperationResponse {
+        self.assert_authorized_caller();
+        let module = env::predecessor_account_id().to_string();
+        match self.storage_meter.track("bank", || self.bank_module.unlock_coins(lock_id, &module)) {
+            Ok(lock) => BankOperationResponse {
+                success: true,
+                amount: Some(lock.amount),
+                from_account: Some(lock.account.to_string()),
+                to_account: None,
+                events: vec!["coins_unlocked".to_string()],
+                error: None,
+            },
+            Err(error) => BankOperationResponse {
+                success: false,
+                amount: None,
+                from_account: None,
+                to_account: None,
+                events: vec![],
+                error: Some(error),
+            },
+        }
+    }
+
+    /// Let `grantee` send up to `spend_limit` of the caller's coins, to
+    /// the accounts of `allow_list` only if given, until `expiration` in
+    /// nanoseconds if given
+    ///
+    /// Requires one yoctoNEAR, so only a full access key of the granter
+    /// can sign it.
+    #[payable]
+    pub fn grant_send(
+        &mut self,
+        grantee: AccountId,
+        spend_limit: Vec<Coin>,
+        allow_list: Option<Vec<AccountId>>,
+        expiration: Option<u64>,
+    ) -> BankOperationResponse {
+        assert_one_yocto();
+        let granter = env::predecessor_account_id();
+        let result = Coins::new(spend_limit).and_then(|spend_limit| {
+            self.storage_meter.track("bank", || {
+                self.bank_module.grant_send(&granter, &grantee, spend_limit, allow_list.unwrap_or_default(), expiration)
+            })
+        });
+        BankOperationResponse {
+            success: result.is_ok(),
+            amount: None,
+            from_account: Some(granter.to_string()),
+            to_account: Some(grantee.to_string()),
+            events: if result.is_ok() { vec!["send_grant".to_string()] } else { vec![] },
+            error: result.err(),
+        }
+    }
+
+    /// Revoke the caller's send authorization to `grantee`
+    #[payable]
+    pub fn revoke_send(&mut self, grantee: AccountId) -> BankOperationResponse {
+        assert_one_yocto();
+        let granter = env::predecessor_account_id();
+        let result = self.storage_meter.track("bank", || self.bank_module.revoke_send(&granter, &grantee)).map(|_| ());
+        BankOperationResponse {
+            success: result.is_ok(),
+            amount: None,
+            from_account: Some(granter.to_string()),
+            to_account: Some(grantee.to_string()),
+            events: if result.is_ok() { vec!["send_revoke".to_string()] } else { vec![] },
+            error: result.err(),
+        }
+    }
+
+    /// Send coins of `granter` to `to` within the caller's send
+    /// authorization
+    #[payable]
+    pub fn transfer_from(&mut self, granter: AccountId, to: AccountId, coins: Vec<Coin>) -> BankOperationResponse {
+        assert_one_yocto();
+        let grantee = env::predecessor_account_id();
+        let result = Coins::new(coins).and_then(|coins| {
+            self.storage_meter.track("bank", || {
+                self.bank_module.transfer_from(&self.compliance, &grantee, &granter, &to, &coins)
+            })
+        });
+        BankOperationResponse {
+            success: result.is_ok(),
+            amount: None,
+            from_account: Some(granter.to_string()),
+            to_account: Some(to.to_string()),
+            events: if result.is_ok() { vec!["transfer_from".to_string()] } else { vec![] },
+            error: result.err(),
+        }
+    }
+
+    /// Unexpired send authorization of `granter` to `grantee`
+    pub fn get_send_authorization(&self, granter: AccountId, grantee: AccountId) -> Option<SendAuthorization> {
+        self.bank_module.get_send_authorization(&granter, &grantee)
+    }
+
     /// Get all account balances (for debugging/admin)
     pub fn get_all_balances(&self) -> Vec<(AccountId, Balance)> {
         self.assert_owner(); // Only owner can see all balances
@@ -207,13 +419,92 @@ impl BankContract {
     /// Get total supply
     pub fn get_total_supply(&self) -> Balance {
         self.assert_authorized_caller();
-        self.bank_module.get_total_supply("unear".to_string())
+        self.bank_module.get_total_supply(self.bank_module.native_denom().to_string())
+    }
+
+    /// Supply of a denom, the native one unless given
+    pub fn get_supply(&self, denom: Option<String>) -> Coin {
+        let denom = denom.unwrap_or_else(|| self.bank_module.native_denom().to_string());
+        Coin { amount: self.bank_module.supply_of(&denom), denom }
+    }
+
+    /// Supply of every denom in circulation, sorted by denom
+    pub fn get_all_supply(&self) -> Vec<Coin> {
+        self.bank_module.total_supply().into_vec()
+    }
+
+    /// Supply of a denom with a merkle proof under the bank store hash
+    pub fn get_supply_proof(&self, denom: String) -> SupplyProof {
+        self.bank_module.prove_supply(&denom)
+            .unwrap_or_else(|error| env::panic_str(&error))
+    }
+
+    /// Recent transfers of an account, newest first
+    pub fn get_account_activity(&self, account: AccountId, limit: Option<u32>) -> Vec<TransferRecord> {
+        self.bank_module.get_account_activity(&account, limit.unwrap_or(20) as usize)
+    }
+
+    /// Deposits an account received with the given memo
+    pub fn find_deposits_by_memo(&self, account: AccountId, memo: String) -> Vec<TransferRecord> {
+        self.bank_module.find_deposits_by_memo(&account, &memo)
+    }
+
+    /// Ledger entries from `from_id` on, for archiving or replaying the bank
+    pub fn export_ledger(&self, from_id: Option<u64>, limit: Option<u32>) -> LedgerPage {
+        self.bank_module.export_ledger(from_id, limit.unwrap_or(100))
+    }
+
+    /// Hex root over all balances and supplies, compared by the replay tool
+    pub fn get_state_root(&self) -> String {
+        self.bank_module.state_root()
+    }
+
+    /// Balance and supply keys changed after `from_height` up to `to_height`
+    pub fn state_diff(&self, from_height: u64, to_height: u64, from_id: Option<u64>) -> StateDiff {
+        self.bank_module.state_diff(from_height, to_height, from_id)
+            .unwrap_or_else(|e| env::panic_str(&e))
     }
 
     // =============================================================================
     // Batch Operations (for efficiency)
     // =============================================================================
 
+    /// Send coins from the inputs to the outputs, all of it or nothing
+    ///
+    /// Unlike `batch_transfer`, a failure leaves every balance untouched.
+    /// Each input must be the caller unless the router or owner calls.
+    pub fn multi_send(&mut self, inputs: Vec<SendEntry>, outputs: Vec<SendEntry>) -> BankOperationResponse {
+        self.assert_authorized_caller();
+        let caller = env::predecessor_account_id();
+        let send = MultiSend { inputs, outputs };
+        let failed = |error: String| BankOperationResponse {
+            success: false,
+            amount: None,
+            from_account: None,
+            to_account: None,
+            events: vec![],
+            error: Some(error),
+        };
+
+        if let Some(input) = send.inputs.iter().find(|input| input.address != caller) {
+            if !self.is_router_or_owner(&caller) {
+                return failed(format!("Unauthorized: caller cannot send from {}", input.address));
+            }
+        }
+        if let Err(error) = self.storage_meter.track("bank", || self.bank_module.multi_send(&self.compliance, &send)) {
+            return failed(error);
+        }
+
+        BankOperationResponse {
+            success: true,
+            amount: None,
+            from_account: None,
+            to_account: None,
+            events: vec!["multi_send".to_string()],
+            error: None,
+        }
+    }
+
     /// Process multiple transfers in a single transaction
     pub fn batch_transfer(&mut self, transfers: Vec<TransferRequest>) -> Vec<BankOperationResponse> {
         self.assert_authorized_caller();
@@ -224,7 +515,8 @@ impl BankContract {
             let response = self.transfer(
                 transfer.from.parse().unwrap_or(env::current_account_id()), 
                 transfer.to.parse().unwrap_or(env::current_account_id()), 
-                transfer.amount
+                transfer.amount,
+                transfer.memo,
             );
             responses.push(response);
         }
@@ -262,7 +554,8 @@ impl BankContract {
             self.transfer(
                 transfer.from.parse().unwrap_or(env::current_account_id()), 
                 transfer.to.parse().unwrap_or(env::current_account_id()), 
-                transfer.amount
+                transfer.amount,
+                transfer.memo,
             )
         } else {
             BankOperationResponse {
@@ -317,6 +610,290 @@ impl BankContract {
     }
 
     /// Get current router contract
+    // =============================================================================
+    // Denom Metadata Functions
+    // =============================================================================
+
+    /// Register or update the metadata of a denom (only owner)
+    pub fn set_denom_metadata(&mut self, metadata: Metadata) -> BankOperationResponse {
+        self.assert_owner();
+
+        match self.storage_meter.track("bank", || self.bank_module.set_denom_metadata(metadata)) {
+            Ok(()) => BankOperationResponse {
+                success: true,
+                amount: None,
+                from_account: None,
+                to_account: None,
+                events: vec!["set_denom_metadata".to_string()],
+                error: None,
+            },
+            Err(error) => BankOperationResponse {
+                success: false,
+                amount: None,
+                from_account: None,
+                to_account: None,
+                events: vec![],
+                error: Some(error),
+            },
+        }
+    }
+
+    /// Get the metadata of a base denom
+    pub fn get_denom_metadata(&self, base: String) -> Option<Metadata> {
+        self.bank_module.get_denom_metadata(base)
+    }
+
+    /// Get the metadata of every registered denom
+    pub fn get_all_denom_metadata(&self) -> Vec<Metadata> {
+        self.bank_module.get_all_denom_metadata()
+    }
+
+    /// Convert an amount of `denom` into its display unit
+    pub fn to_display(&self, amount: Balance, denom: String) -> DisplayCoin {
+        self.bank_module.to_display(amount, denom)
+            .unwrap_or_else(|error| env::panic_str(&error))
+    }
+
+    /// Convert a decimal amount of any denom unit into base units
+    pub fn to_base(&self, amount: String, denom: String) -> Balance {
+        self.bank_module.to_base(amount, denom)
+            .unwrap_or_else(|error| env::panic_str(&error))
+    }
+
+    /// Enable or disable sends of denoms (governance only)
+    pub fn set_send_enabled(&mut self, change: SetSendEnabled) -> BankOperationResponse {
+        let result = if env::predecessor_account_id() != self.compliance.authority() {
+            Err("Only the governance authority can change send enabled flags".to_string())
+        } else {
+            self.storage_meter.track("bank", || self.bank_module.set_send_enabled(&change))
+        };
+        Self::compliance_response(result, "send_enabled")
+    }
+
+    pub fn is_send_enabled(&self, denom: String) -> bool {
+        self.bank_module.is_send_enabled(&denom)
+    }
+
+    /// Default flag and the denoms that override it
+    pub fn get_send_enabled(&self) -> serde_json::Value {
+        serde_json::json!({
+            "default_send_enabled": self.bank_module.default_send_enabled(),
+            "send_enabled": self.bank_module.get_send_enabled(),
+        })
+    }
+
+    /// Escrow accounts of the modules; blocked ones cannot receive transfers
+    pub fn get_module_accounts(&self) -> Vec<ModuleAccount> {
+        self.bank_module.get_module_accounts()
+    }
+
+    // =============================================================================
+    // NEP-141 Fungible Token Facade
+    // =============================================================================
+
+    /// Expose a denom as the NEP-141 token `token_id` (only owner)
+    ///
+    /// Mapping this contract's own account changes the denom its NEP-141
+    /// methods serve; other token accounts forward through
+    /// `ft_transfer_forwarded`.
+    pub fn ft_register_token(&mut self, token_id: AccountId, denom: String) -> BankOperationResponse {
+        self.assert_owner();
+        let result = self.storage_meter.track("bank", || self.bank_module.register_ft_token(token_id, denom));
+        Self::compliance_response(result, "ft_token")
+    }
+
+    pub fn ft_tokens(&self) -> Vec<FtToken> {
+        self.bank_module.get_ft_tokens()
+    }
+
+    #[payable]
+    pub fn ft_transfer(&mut self, receiver_id: AccountId, amount: U128, memo: Option<String>) {
+        assert_one_yocto();
+        let denom = self.ft_denom();
+        self.ft_transfer_denom(&denom, &env::predecessor_account_id(), &receiver_id, amount.0, memo);
+    }
+
+    /// Transfer and call `ft_on_transfer` on the receiver, which returns the
+    /// amount it did not use to be refunded
+    #[payable]
+    pub fn ft_transfer_call(
+        &mut self,
+        receiver_id: AccountId,
+        amount: U128,
+        memo: Option<String>,
+        msg: String,
+    ) -> PromiseOrValue<U128> {
+        assert_one_yocto();
+        require!(
+            env::prepaid_gas() > GAS_FOR_FT_ON_TRANSFER.saturating_add(GAS_FOR_RESOLVE_TRANSFER),
+            "More gas is required"
+        );
+        let sender_id = env::predecessor_account_id();
+        let denom = self.ft_denom();
+        self.ft_transfer_denom(&denom, &sender_id, &receiver_id, amount.0, memo);
+
+        ext_ft_receiver::ext(receiver_id.clone())
+            .with_static_gas(GAS_FOR_FT_ON_TRANSFER)
+            .ft_on_transfer(sender_id.clone(), amount, msg)
+            .then(
+                ext_ft_resolver::ext(env::current_account_id())
+                    .with_static_gas(GAS_FOR_RESOLVE_TRANSFER)
+                    .ft_resolve_transfer(sender_id, receiver_id, amount),
+            )
+            .into()
+    }
+
+    /// Refund what the receiver of an `ft_transfer_call` did not use,
+    /// returning the amount it kept
+    #[private]
+    pub fn ft_resolve_transfer(&mut self, sender_id: AccountId, receiver_id: AccountId, amount: U128) -> U128 {
+        let unused = match env::promise_result(0) {
+            PromiseResult::Successful(value) => serde_json::from_slice::<U128>(&value).map_or(amount.0, |unused| unused.0),
+            _ => amount.0,
+        };
+        let denom = self.ft_denom();
+        let used = self.storage_meter.track("bank", || {
+            self.bank_module.ft_resolve_transfer(&denom, &sender_id, &receiver_id, amount.0, unused)
+        });
+        U128(used)
+    }
+
+    /// `ft_transfer` forwarded by the token account of a denom, which
+    /// vouches for `sender_id`
+    pub fn ft_transfer_forwarded(&mut self, sender_id: AccountId, receiver_id: AccountId, amount: U128, memo: Option<String>) {
+        let token_id = env::predecessor_account_id();
+        let denom = self.bank_module.ft_denom(&token_id)
+            .unwrap_or_else(|| env::panic_str(&format!("{} is not a registered token", token_id)));
+        self.ft_transfer_denom(&denom, &sender_id, &receiver_id, amount.0, memo);
+    }
+
+    pub fn ft_total_supply(&self) -> U128 {
+        U128(self.bank_module.supply_of(&self.ft_denom()))
+    }
+
+    pub fn ft_balance_of(&self, account_id: AccountId) -> U128 {
+        U128(self.bank_module.get_denom_balance(&account_id, &self.ft_denom()))
+    }
+
+    /// NEP-145 registration, refunding whatever exceeds the fixed deposit
+    ///
+    /// The deposit is fixed, so `registration_only` makes no difference.
+    #[payable]
+    pub fn storage_deposit(&mut self, account_id: Option<AccountId>, registration_only: Option<bool>) -> StorageBalance {
+        let _ = registration_only;
+        let deposit = env::attached_deposit().as_yoctonear();
+        let account_id = account_id.unwrap_or_else(env::predecessor_account_id);
+        let denom = self.ft_denom();
+
+        let refund = if self.bank_module.ft_is_registered(&denom, &account_id) {
+            deposit
+        } else {
+            require!(deposit >= FT_STORAGE_DEPOSIT, "The attached deposit is less than the minimum storage balance");
+            self.storage_meter.track("bank", || self.bank_module.ft_register_account(&denom, &account_id));
+            deposit - FT_STORAGE_DEPOSIT
+        };
+        if refund > 0 {
+            Promise::new(env::predecessor_account_id()).transfer(NearToken::from_yoctonear(refund));
+        }
+        self.storage_balance_of(account_id).expect("Account is registered")
+    }
+
+    /// Give up the registration and get the deposit back; `force` burns a
+    /// remaining balance
+    #[payable]
+    pub fn storage_unregister(&mut self, force: Option<bool>) -> bool {
+        assert_one_yocto();
+        let account_id = env::predecessor_account_id();
+        let denom = self.ft_denom();
+        let unregistered = self.storage_meter.track("bank", || {
+            self.bank_module.ft_unregister_account(&denom, &account_id, force.unwrap_or(false))
+        }).unwrap_or_else(|error| env::panic_str(&error));
+        if unregistered {
+            Promise::new(account_id).transfer(NearToken::from_yoctonear(FT_STORAGE_DEPOSIT));
+        }
+        unregistered
+    }
+
+    pub fn storage_balance_of(&self, account_id: AccountId) -> Option<StorageBalance> {
+        let denom = self.ft_denom();
+        if self.bank_module.ft_has_deposit(&denom, &account_id) {
+            Some(StorageBalance { total: U128(FT_STORAGE_DEPOSIT), available: U128(0) })
+        } else if self.bank_module.ft_is_registered(&denom, &account_id) {
+            Some(StorageBalance { total: U128(0), available: U128(0) })
+        } else {
+            None
+        }
+    }
+
+    pub fn storage_balance_bounds(&self) -> StorageBalanceBounds {
+        StorageBalanceBounds::fixed()
+    }
+
+    // =============================================================================
+    // Compliance Functions
+    // =============================================================================
+
+    /// Hand the compliance rules to another account (governance only)
+    pub fn set_compliance_authority(&mut self, authority: AccountId) -> BankOperationResponse {
+        let result = self.compliance.set_authority(&env::predecessor_account_id(), authority);
+        Self::compliance_response(result, "compliance_authority")
+    }
+
+    /// Switch compliance restrictions on or off (governance only)
+    pub fn set_compliance_mode(&mut self, mode: ComplianceMode) -> BankOperationResponse {
+        let result = self.storage_meter.track("compliance", || self.compliance.set_mode(&env::predecessor_account_id(), mode));
+        Self::compliance_response(result, "compliance_mode")
+    }
+
+    /// Block transfers to and from an address (governance only)
+    pub fn deny_address(&mut self, address: String) -> BankOperationResponse {
+        let result = self.storage_meter.track("compliance", || self.compliance.deny_address(&env::predecessor_account_id(), address));
+        Self::compliance_response(result, "compliance_deny")
+    }
+
+    pub fn undeny_address(&mut self, address: String) -> BankOperationResponse {
+        let result = self.storage_meter.track("compliance", || self.compliance.undeny_address(&env::predecessor_account_id(), address));
+        Self::compliance_response(result, "compliance_undeny")
+    }
+
+    /// Add an address to the allow list (governance only)
+    pub fn allow_address(&mut self, address: String) -> BankOperationResponse {
+        let result = self.storage_meter.track("compliance", || self.compliance.allow_address(&env::predecessor_account_id(), address));
+        Self::compliance_response(result, "compliance_allow")
+    }
+
+    pub fn disallow_address(&mut self, address: String) -> BankOperationResponse {
+        let result = self.storage_meter.track("compliance", || self.compliance.disallow_address(&env::predecessor_account_id(), address));
+        Self::compliance_response(result, "compliance_disallow")
+    }
+
+    /// Stop an account from sending (governance only)
+    pub fn freeze_account(&mut self, address: String, reason: String) -> BankOperationResponse {
+        let result = self.storage_meter.track("compliance", || self.compliance.freeze_account(&env::predecessor_account_id(), address, reason));
+        Self::compliance_response(result, "compliance_freeze")
+    }
+
+    pub fn unfreeze_account(&mut self, address: String) -> BankOperationResponse {
+        let result = self.storage_meter.track("compliance", || self.compliance.unfreeze_account(&env::predecessor_account_id(), address));
+        Self::compliance_response(result, "compliance_unfreeze")
+    }
+
+    /// Current compliance mode and lists
+    pub fn get_compliance(&self) -> serde_json::Value {
+        serde_json::json!({
+            "mode": self.compliance.mode(),
+            "authority": self.compliance.authority(),
+            "denied": self.compliance.get_denied(),
+            "allowed": self.compliance.get_allowed(),
+            "frozen": self.compliance.get_frozen(),
+        })
+    }
+
+    /// Bytes stored by each module and the NEAR they lock
+    pub fn storage_usage_by_module(&self) -> StorageUsageReport {
+        self.storage_meter.report()
+    }
+
     pub fn get_router_contract(&self) -> Option<AccountId> {
         self.router_contract.clone()
     }
@@ -338,14 +915,64 @@ impl BankContract {
                 "mint",
                 "burn",
                 "get_balance",
+                "get_denom_balance",
+                "get_account_balances",
+                "get_spendable_balance",
+                "get_locked_coins",
+                "lock_coins",
+                "unlock_coins",
+                "grant_send",
+                "revoke_send",
+                "transfer_from",
+                "get_send_authorization",
+                "export_state",
                 "get_all_balances",
                 "get_total_supply",
+                "get_supply",
+                "get_all_supply",
+                "get_supply_proof",
+                "get_account_activity",
+                "find_deposits_by_memo",
+                "export_ledger",
+                "get_state_root",
+                "state_diff",
+                "multi_send",
                 "batch_transfer",
                 "batch_mint",
                 "process_transfer",
                 "has_sufficient_balance",
                 "reserve_tokens",
-                "release_reserved_tokens"
+                "release_reserved_tokens",
+                "set_denom_metadata",
+                "get_denom_metadata",
+                "get_all_denom_metadata",
+                "to_display",
+                "to_base",
+                "set_send_enabled",
+                "is_send_enabled",
+                "get_send_enabled",
+                "get_module_accounts",
+                "ft_register_token",
+                "ft_tokens",
+                "ft_transfer",
+                "ft_transfer_call",
+                "ft_transfer_forwarded",
+                "ft_total_supply",
+                "ft_balance_of",
+                "storage_deposit",
+                "storage_unregister",
+                "storage_balance_of",
+                "storage_balance_bounds",
+                "set_compliance_authority",
+                "set_compliance_mode",
+                "deny_address",
+                "undeny_address",
+                "allow_address",
+                "disallow_address",
+                "freeze_account",
+                "unfreeze_account",
+                "get_compliance",
+                "storage_usage_by_module"
             ]
         })
     }
@@ -354,6 +981,29 @@ impl BankContract {
     // Helper Functions
     // =============================================================================
 
+    fn compliance_response(result: Result<(), String>, event: &str) -> BankOperationResponse {
+        BankOperationResponse {
+            success: result.is_ok(),
+            amount: None,
+            from_account: None,
+            to_account: None,
+            events: if result.is_ok() { vec![event.to_string()] } else { vec![] },
+            error: result.err(),
+        }
+    }
+
+    /// Denom served by this contract's NEP-141 methods
+    fn ft_denom(&self) -> String {
+        self.bank_module.ft_denom(&env::current_account_id())
+            .unwrap_or_else(|| self.bank_module.native_denom().to_string())
+    }
+
+    fn ft_transfer_denom(&mut self, denom: &str, sender_id: &AccountId, receiver_id: &AccountId, amount: Balance, memo: Option<String>) {
+        self.storage_meter.track("bank", || {
+            self.bank_module.ft_transfer(&self.compliance, denom, sender_id, receiver_id, amount, memo)
+        }).unwrap_or_else(|error| env::panic_str(&error));
+    }
+
     /// Check if caller is router or owner
     fn is_router_or_owner(&self, caller: &AccountId) -> bool {
         caller == &self.owner || 
@@ -408,7 +1058,7 @@ mod tests {
         let context = get_context(accounts(1));
         testing_env!(context);
         
-        let contract = BankContract::new(accounts(1), Some(accounts(2)));
+        let contract = BankContract::new(accounts(1), Some(accounts(2)), None);
         assert_eq!(contract.owner, accounts(1));
         assert_eq!(contract.router_contract, Some(accounts(2)));
     }
@@ -418,7 +1068,7 @@ mod tests {
         let context = get_context(accounts(1));
         testing_env!(context);
         
-        let mut contract = BankContract::new(accounts(1), None);
+        let mut contract = BankContract::new(accounts(1), None, None);
         
         let response = contract.mint(accounts(2), 1000);
         assert!(response.success);
@@ -433,13 +1083,13 @@ mod tests {
         let context = get_context(accounts(1));
         testing_env!(context);
         
-        let mut contract = BankContract::new(accounts(1), None);
+        let mut contract = BankContract::new(accounts(1), None, None);
         
         // First mint some tokens
         contract.mint(accounts(2), 1000);
         
         // Now transfer from accounts(2) to accounts(3)
-        let response = contract.transfer(accounts(2), accounts(3), 500);
+        let response = contract.transfer(accounts(2), accounts(3), 500, None);
         assert!(response.success);
         
         assert_eq!(contract.get_balance(accounts(2)), 500);
@@ -451,20 +1101,103 @@ mod tests {
         let context = get_context(accounts(1));
         testing_env!(context);
         
-        let mut contract = BankContract::new(accounts(1), None);
+        let mut contract = BankContract::new(accounts(1), None, None);
         
         // Try to transfer without any balance
-        let response = contract.transfer(accounts(2), accounts(3), 500);
+        let response = contract.transfer(accounts(2), accounts(3), 500, None);
         assert!(!response.success);
         assert!(response.error.is_some());
     }
 
+    #[test]
+    fn test_burn_reduces_supply() {
+        let context = get_context(accounts(1));
+        testing_env!(context);
+        
+        let mut contract = BankContract::new(accounts(1), None, None);
+        contract.mint(accounts(2), 1000);
+        
+        assert!(contract.burn(accounts(2), 300, None).success);
+        assert_eq!(contract.get_balance(accounts(2)), 700);
+        assert_eq!(contract.get_supply(None), Coin::new("unear", 700));
+        
+        // Other denoms are burnt from their own balance
+        let response = contract.burn(accounts(2), 1, Some("ibc/ATOM".to_string()));
+        assert!(response.error.unwrap().contains("has 0"));
+        assert_eq!(contract.get_all_supply(), vec![Coin::new("unear", 700)]);
+    }
+
+    #[test]
+    fn test_ft_facade() {
+        testing_env!(get_context(accounts(1)));
+        let mut contract = BankContract::new(accounts(1), None, None);
+        contract.mint(accounts(2), 1000);
+
+        testing_env!(VMContextBuilder::new()
+            .predecessor_account_id(accounts(3))
+            .attached_deposit(NearToken::from_yoctonear(FT_STORAGE_DEPOSIT))
+            .build());
+        assert!(contract.storage_balance_of(accounts(3)).is_none());
+        contract.storage_deposit(None, None);
+        assert_eq!(contract.storage_balance_of(accounts(3)).unwrap().total, U128(FT_STORAGE_DEPOSIT));
+
+        testing_env!(VMContextBuilder::new()
+            .predecessor_account_id(accounts(2))
+            .attached_deposit(NearToken::from_yoctonear(1))
+            .build());
+        contract.ft_transfer(accounts(3), U128(250), None);
+        assert_eq!(contract.ft_balance_of(accounts(3)), U128(250));
+        assert_eq!(contract.ft_balance_of(accounts(2)), U128(750));
+        assert_eq!(contract.ft_total_supply(), U128(1000));
+    }
+
+    #[test]
+    #[should_panic(expected = "is not registered")]
+    fn test_ft_transfer_to_unregistered_account() {
+        testing_env!(get_context(accounts(1)));
+        let mut contract = BankContract::new(accounts(1), None, None);
+        contract.mint(accounts(2), 1000);
+
+        testing_env!(VMContextBuilder::new()
+            .predecessor_account_id(accounts(2))
+            .attached_deposit(NearToken::from_yoctonear(1))
+            .build());
+        contract.ft_transfer(accounts(4), U128(1), None);
+    }
+
+    #[test]
+    fn test_state_moves_to_a_new_deployment() {
+        testing_env!(get_context(accounts(1)));
+        let mut contract = BankContract::new(accounts(1), None, None);
+        contract.mint(accounts(2), 1000);
+        contract.transfer(accounts(2), accounts(3), 250, None);
+
+        let genesis = contract.export_state();
+        let migrated = BankContract::init(accounts(1), None, None, genesis.clone());
+        assert_eq!(migrated.get_balance(accounts(3)), 250);
+        assert_eq!(migrated.get_total_supply(), 1000);
+        assert_eq!(migrated.export_state(), genesis);
+    }
+
+    #[test]
+    fn test_compliance_is_governed_by_the_router_or_owner() {
+        testing_env!(get_context(accounts(1)));
+        let mut contract = BankContract::new(accounts(1), None, None);
+        assert!(contract.set_compliance_mode(ComplianceMode::DenyList).success);
+
+        let mut contract = BankContract::new(accounts(1), Some(accounts(2)), None);
+        assert!(!contract.set_compliance_mode(ComplianceMode::DenyList).success);
+        testing_env!(get_context(accounts(2)));
+        assert!(contract.set_compliance_authority(accounts(3)).success);
+        assert!(!contract.set_compliance_mode(ComplianceMode::DenyList).success);
+    }
+
     #[test]
     fn test_health_check() {
         let context = get_context(accounts(1));
         testing_env!(context);
         
-        let contract = BankContract::new(accounts(1), None);
+        let contract = BankContract::new(accounts(1), None, None);
         assert!(contract.health_check());
     }
 }
\ No newline at end of file
@@ -7,7 +7,7 @@
 /// - Port binding and management
 
 use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
-use near_sdk::{env, near_bindgen, AccountId, PanicOnDefault};
+use near_sdk::{env, near_bindgen, AccountId, NearToken, PanicOnDefault, Promise};
 use near_sdk::json_types::Base64VecU8;
 use near_sdk::serde::{Deserialize, Serialize};
 use schemars::JsonSchema;
@@ -15,6 +15,7 @@ use base64::{Engine as _, engine::general_purpose};
 
 use crate::modules::ibc::channel::{ChannelModule, ChannelEnd, Packet, Acknowledgement};
 use crate::modules::ibc::channel::types::{Height};
+use crate::modules::keeper::{KeeperAction, KeeperModule};
 
 /// IBC Channel contract state
 #[near_bindgen]
@@ -26,6 +27,8 @@ pub struct IbcChannelContract {
     router_contract: Option<AccountId>,
     /// Contract owner for admin operations
     owner: AccountId,
+    /// Rewards for permissionless packet timeouts
+    keeper: KeeperModule,
 }
 
 /// Response from channel operations
@@ -93,6 +96,7 @@ impl IbcChannelContract {
             channel_module: ChannelModule::new(),
             router_contract,
             owner,
+            keeper: KeeperModule::new(),
         }
     }
 
@@ -406,28 +410,36 @@ impl IbcChannelContract {
     }
 
     /// Timeout a packet (when it expires)
+    ///
+    /// Callable by anyone: the channel module verifies the timeout, and the
+    /// caller earns a keeper reward for each packet timed out.
     pub fn timeout_packet(
         &mut self,
         packet_data: PacketData,
         proof_unreceived: Base64VecU8,
         proof_height: u64,
+        next_sequence_recv: u64,
     ) -> ChannelOperationResponse {
-        self.assert_authorized_caller();
-        
         let packet: Packet = packet_data.into();
         
         match self.channel_module.timeout_packet(
             packet.clone(),
             proof_unreceived.into(),
             proof_height,
-            0, // next_sequence_recv - should be passed as parameter
+            next_sequence_recv,
         ) {
             Ok(_) => {
+                let reward = self.keeper.reward(
+                    env::predecessor_account_id().as_str(),
+                    KeeperAction::PacketTimeout,
+                    env::block_height(),
+                );
                 env::log_str(&format!(
-                    "Packet timed out: {}/{} seq={}", 
+                    "Packet timed out: {}/{} seq={} reward={}", 
                     packet.source_port, 
                     packet.source_channel, 
-                    packet.sequence
+                    packet.sequence,
+                    reward
                 ));
                 ChannelOperationResponse {
                     success: true,
@@ -616,6 +628,8 @@ impl IbcChannelContract {
                 "receive_packet",
                 "acknowledge_packet",
                 "timeout_packet",
+                "fund_keeper",
+                "withdraw_keeper_rewards",
                 "get_channel",
                 "query_packet_commitment",
                 "query_packet_acknowledgment",
@@ -631,6 +645,27 @@ impl IbcChannelContract {
         })
     }
 
+    // =============================================================================
+    // Keeper Rewards
+    // =============================================================================
+
+    /// Add the attached deposit to the keeper reward fund
+    #[payable]
+    pub fn fund_keeper(&mut self) {
+        self.keeper.fund(env::attached_deposit().as_yoctonear());
+    }
+
+    pub fn get_keeper_earned(&self, keeper: AccountId) -> near_sdk::json_types::U128 {
+        self.keeper.get_earned(keeper.as_str()).into()
+    }
+
+    /// Pay out the caller's keeper rewards
+    pub fn withdraw_keeper_rewards(&mut self) -> Promise {
+        let keeper = env::predecessor_account_id();
+        let earned = self.keeper.withdraw(keeper.as_str()).unwrap_or_else(|e| env::panic_str(&e));
+        Promise::new(keeper).transfer(NearToken::from_yoctonear(earned))
+    }
+
     /// Assert that the caller is authorized (owner or router)
     fn assert_authorized_caller(&self) {
         let caller = env::predecessor_account_id();
@@ -12,9 +12,13 @@ use near_sdk::json_types::Base64VecU8;
 use near_sdk::serde::{Deserialize, Serialize};
 use schemars::JsonSchema;
 
-use crate::modules::ibc::transfer::{TransferModule, FungibleTokenPacketData, DenomTrace};
+use crate::modules::ibc::transfer::{
+    BridgeReport, TransferModule, FungibleTokenPacketAcknowledgement, FungibleTokenPacketData, DenomTrace,
+};
 use crate::modules::ibc::channel::{ChannelModule, Height, Packet};
-use crate::modules::bank::BankModule;
+use crate::modules::bank::{BankModule, Metadata};
+use crate::modules::storage_usage::{StorageMeter, StorageUsageReport};
+use crate::modules::wasm::WasmModule;
 use crate::Balance;
 
 /// IBC Transfer contract state
@@ -27,6 +31,10 @@ pub struct IbcTransferContract {
     channel_module: ChannelModule,
     /// Bank module for token operations
     bank_module: BankModule,
+    /// Wasm module that runs the contract hooks of transfer memos
+    wasm_module: WasmModule,
+    /// Bytes stored, booked to transfer for packet handling
+    storage_meter: StorageMeter,
     /// Router contract that can call this module
     router_contract: Option<AccountId>,
     /// Contract owner for admin operations
@@ -56,6 +64,9 @@ pub struct TransferRequest {
     pub timeout_height: Option<u64>,
     pub timeout_timestamp: Option<u64>,
     pub memo: Option<String>,
+    /// Local account refunded on timeout or a failed ack instead of the sender
+    #[serde(default)]
+    pub refund_address: Option<String>,
 }
 
 /// Voucher token information
@@ -75,6 +86,8 @@ impl IbcTransferContract {
             transfer_module: TransferModule::new(),
             channel_module: ChannelModule::new(),
             bank_module: BankModule::new(),
+            wasm_module: WasmModule::new(),
+            storage_meter: StorageMeter::new(b"su"),
             router_contract,
             owner,
         }
@@ -101,16 +114,29 @@ impl IbcTransferContract {
             };
         }
 
+        if let Some(refund_address) = &request.refund_address {
+            if let Err(e) = TransferModule::validate_refund_address(refund_address) {
+                return TransferOperationResponse {
+                    success: false,
+                    packet_data: None,
+                    voucher_denom: None,
+                    amount: Some(request.amount),
+                    events: vec![],
+                    error: Some(format!("{:?}", e)),
+                };
+            }
+        }
+
         let height = Height {
             revision_number: 0,
             revision_height: request.timeout_height.unwrap_or(0),
         };
         
-        match self.transfer_module.send_transfer(
+        match self.storage_meter.track("transfer", || self.transfer_module.send_transfer(
             &mut self.channel_module,
             &mut self.bank_module,
-            request.source_port,
-            request.source_channel,
+            request.source_port.clone(),
+            request.source_channel.clone(),
             request.token.clone(),
             request.amount,
             request.sender.to_string(),
@@ -118,7 +144,7 @@ impl IbcTransferContract {
             height,
             request.timeout_timestamp.unwrap_or(0),
             request.memo.clone(),
-        ) {
+        )) {
             Ok(packet_sequence) => {
                 env::log_str(&format!(
                     "Transfer initiated: {} {} from {} to destination (seq {})", 
@@ -127,6 +153,19 @@ impl IbcTransferContract {
                     request.sender,
                     packet_sequence
                 ));
+
+                let mut events = vec!["send_transfer".to_string()];
+                if let Some(refund_address) = &request.refund_address {
+                    // Validated above, storing it cannot fail
+                    let _ = self.storage_meter.track("transfer", || self.transfer_module.set_refund_address(
+                        &request.source_port,
+                        &request.source_channel,
+                        packet_sequence,
+                        &request.sender,
+                        refund_address,
+                    ));
+                    events.push("refund_address_set".to_string());
+                }
                 
                 // Create packet data for response
                 let packet_data = FungibleTokenPacketData {
@@ -142,7 +181,7 @@ impl IbcTransferContract {
                     packet_data: Some(serde_json::to_string(&packet_data).unwrap_or_default()),
                     voucher_denom: None,
                     amount: Some(request.amount),
-                    events: vec!["send_transfer".to_string()],
+                    events,
                     error: None,
                 }
             }
@@ -190,11 +229,19 @@ impl IbcTransferContract {
         };
         
         // Process the transfer
-        match self.transfer_module.receive_transfer(
+        let ack = self.storage_meter.track("transfer", || self.transfer_module.on_recv_packet(
             &self.channel_module,
             &mut self.bank_module,
             &packet,
-        ) {
+            &mut self.wasm_module,
+        ));
+        let received = if ack.data == FungibleTokenPacketAcknowledgement::success().to_bytes() {
+            Ok(ack)
+        } else {
+            Err(String::from_utf8_lossy(&ack.data).to_string())
+        };
+
+        match received {
             Ok(_ack) => {
                 // Decode transfer data to get details for logging
                 if let Ok(data) = serde_json::from_slice::<FungibleTokenPacketData>(&packet.data) {
@@ -225,21 +272,31 @@ impl IbcTransferContract {
                 }
             }
             Err(e) => {
-                env::log_str(&format!("Transfer receive failed: {:?}", e));
+                env::log_str(&format!("Transfer receive failed: {}", e));
                 TransferOperationResponse {
                     success: false,
                     packet_data: Some(serde_json::to_string(&packet_data).unwrap_or_default()),
                     voucher_denom: None,
                     amount: None,
                     events: vec![],
-                    error: Some(format!("{:?}", e)),
+                    error: Some(e),
                 }
             }
         }
     }
 
     /// Handle transfer acknowledgment (when transfer succeeds on destination)
-    pub fn acknowledge_transfer(&mut self, packet_data: Base64VecU8, ack: Base64VecU8) -> TransferOperationResponse {
+    ///
+    /// Pass the packet's source port, channel and sequence to refund a
+    /// failed transfer, to the refund address set when it was sent if any.
+    pub fn acknowledge_transfer(
+        &mut self,
+        packet_data: Base64VecU8,
+        ack: Base64VecU8,
+        source_port: Option<String>,
+        source_channel: Option<String>,
+        sequence: Option<u64>,
+    ) -> TransferOperationResponse {
         self.assert_authorized_caller();
         
         let transfer_data: Result<FungibleTokenPacketData, _> = serde_json::from_slice(&packet_data.0);
@@ -262,7 +319,7 @@ impl IbcTransferContract {
                     }
                 } else {
                     // Transfer failed, need to refund tokens
-                    match self.transfer_module.refund_tokens(data.clone()) {
+                    match self.refund(&data, source_port, source_channel, sequence, "ack_error") {
                         Ok(_) => {
                             env::log_str(&format!("Transfer failed, tokens refunded: {} {}", data.amount, data.denom));
                             TransferOperationResponse {
@@ -303,7 +360,13 @@ impl IbcTransferContract {
     }
 
     /// Handle transfer timeout (when transfer expires)
-    pub fn timeout_transfer(&mut self, packet_data: Base64VecU8) -> TransferOperationResponse {
+    pub fn timeout_transfer(
+        &mut self,
+        packet_data: Base64VecU8,
+        source_port: Option<String>,
+        source_channel: Option<String>,
+        sequence: Option<u64>,
+    ) -> TransferOperationResponse {
         self.assert_authorized_caller();
         
         let transfer_data: Result<FungibleTokenPacketData, _> = serde_json::from_slice(&packet_data.0);
@@ -311,7 +374,7 @@ impl IbcTransferContract {
         match transfer_data {
             Ok(data) => {
                 // Refund tokens to sender
-                match self.transfer_module.refund_tokens(data.clone()) {
+                match self.refund(&data, source_port, source_channel, sequence, "timeout") {
                     Ok(_) => {
                         env::log_str(&format!("Transfer timed out, tokens refunded: {} {}", data.amount, data.denom));
                         TransferOperationResponse {
@@ -350,6 +413,32 @@ impl IbcTransferContract {
         }
     }
 
+    /// Return the tokens of a failed packet
+    ///
+    /// Without the packet's source the tokens cannot be located, relayers
+    /// that predate refund addresses fall back to the logging refund.
+    fn refund(
+        &mut self,
+        data: &FungibleTokenPacketData,
+        source_port: Option<String>,
+        source_channel: Option<String>,
+        sequence: Option<u64>,
+        reason: &str,
+    ) -> Result<(), String> {
+        match (source_port, source_channel, sequence) {
+            (Some(port), Some(channel), Some(sequence)) => self.storage_meter
+                .track("transfer", || self.transfer_module.refund_packet(&mut self.bank_module, &port, &channel, sequence, data, reason))
+                .map(|_| ())
+                .map_err(|e| format!("{:?}", e)),
+            _ => self.storage_meter.track("transfer", || self.transfer_module.refund_tokens(data.clone())),
+        }
+    }
+
+    /// Refund address set for a packet still in flight
+    pub fn get_refund_address(&self, source_port: String, source_channel: String, sequence: u64) -> Option<String> {
+        self.transfer_module.get_refund_address(&source_port, &source_channel, sequence)
+    }
+
     // =============================================================================
     // Query Functions
     // =============================================================================
@@ -406,6 +495,28 @@ impl IbcTransferContract {
         }
     }
 
+    /// Escrow and voucher records of a channel reconciled against the bank
+    pub fn bridge_report(&self, channel_id: String) -> BridgeReport {
+        self.transfer_module.bridge_report(&self.channel_module, &self.bank_module, &channel_id)
+            .unwrap_or_else(|e| env::panic_str(&format!("No transfer channel {}: {:?}", channel_id, e)))
+    }
+
+    /// Counterparty metadata registered for a full trace path
+    pub fn get_counterparty_metadata(&self, trace_path: String) -> Option<Metadata> {
+        self.transfer_module.get_counterparty_metadata(&trace_path)
+    }
+
+    /// Register the metadata of a denom on the chain behind a channel
+    ///
+    /// Owner only, the owner being governance on a deployed chain. Returns the
+    /// voucher denom the metadata applies to.
+    pub fn set_counterparty_metadata(&mut self, port_id: String, channel_id: String, metadata: Metadata) -> String {
+        self.assert_owner();
+        self.storage_meter
+            .track("transfer", || self.transfer_module.set_counterparty_metadata(&mut self.bank_module, &port_id, &channel_id, metadata))
+            .unwrap_or_else(|e| env::panic_str(&e))
+    }
+
     // =============================================================================
     // Port Management
     // =============================================================================
@@ -436,6 +547,11 @@ impl IbcTransferContract {
         env::log_str(&format!("Updated router contract to: {}", new_router));
     }
 
+    /// Bytes stored by each module and the NEAR they lock
+    pub fn storage_usage_by_module(&self) -> StorageUsageReport {
+        self.storage_meter.report()
+    }
+
     /// Get current router contract
     pub fn get_router_contract(&self) -> Option<AccountId> {
         self.router_contract.clone()
@@ -465,8 +581,13 @@ impl IbcTransferContract {
                 "is_voucher_denom",
                 "get_original_denom",
                 "get_voucher_info",
+                "get_counterparty_metadata",
+                "set_counterparty_metadata",
+                "bridge_report",
+                "get_refund_address",
                 "bind_port",
-                "is_port_bound"
+                "is_port_bound",
+                "storage_usage_by_module"
             ]
         })
     }
@@ -12,6 +12,8 @@ use schemars::JsonSchema;
 use std::collections::HashMap;
 use base64::{Engine as _, engine::general_purpose};
 
+use crate::handler::input_limits::InputLimits;
+
 /// Configuration for module contracts
 #[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, JsonSchema)]
 pub struct ModuleConfig {
@@ -164,6 +166,10 @@ impl RouterContract {
     ) -> Promise {
         let module_config = self.get_module_config(&module_type)
             .expect(&format!("Module {} not registered", module_type));
+        // Reject bad arguments here rather than after the module spent gas on them
+        if let Err(error) = InputLimits::default().check(&method_name, &args.0) {
+            error.to_failure(&method_name).abort();
+        }
         
         env::log_str(&format!("Routing {} to module {}", method_name, module_config.contract_id));
         
@@ -13,7 +13,9 @@ use near_sdk::serde::{Deserialize, Serialize};
 use schemars::JsonSchema;
 use base64::{Engine as _, engine::general_purpose};
 
-use crate::modules::staking::{StakingModule, Validator, Delegation, UnbondingDelegation};
+use crate::modules::bank::NativeToken;
+use crate::modules::storage_usage::{StorageMeter, StorageUsageReport};
+use crate::modules::staking::{StakingModule, Validator, Delegation, UnbondingDelegation, DelegatorHistoryEntry, KeyRotation};
 use crate::Balance;
 
 /// x/staking contract state
@@ -22,6 +24,8 @@ use crate::Balance;
 pub struct StakingContract {
     /// The underlying staking module
     staking_module: StakingModule,
+    /// Bytes stored by the staking module
+    storage_meter: StorageMeter,
     /// Router contract that can call this module
     router_contract: Option<AccountId>,
     /// Contract owner for admin operations
@@ -63,6 +67,9 @@ pub struct DelegateRequest {
     pub delegator: String,
     pub validator_address: String,
     pub amount: Balance,
+    /// Denom of `amount`, defaults to the bond denom
+    #[serde(default)]
+    pub denom: Option<String>,
 }
 
 /// Undelegation request
@@ -71,6 +78,9 @@ pub struct UndelegateRequest {
     pub delegator: String,
     pub validator_address: String,
     pub amount: Balance,
+    /// Denom of `amount`, defaults to the bond denom
+    #[serde(default)]
+    pub denom: Option<String>,
 }
 
 /// Redelegation request
@@ -80,14 +90,24 @@ pub struct RedelegateRequest {
     pub validator_src_address: String,
     pub validator_dst_address: String,
     pub amount: Balance,
+    /// Denom of `amount`, defaults to the bond denom
+    #[serde(default)]
+    pub denom: Option<String>,
 }
 
 #[near_bindgen]
 impl StakingContract {
+    /// With a `native_token`, bonds are denominated in its base denom
     #[init]
-    pub fn new(owner: AccountId, router_contract: Option<AccountId>) -> Self {
+    pub fn new(owner: AccountId, router_contract: Option<AccountId>, native_token: Option<NativeToken>) -> Self {
+        let mut staking_module = StakingModule::new();
+        if let Some(token) = native_token {
+            token.validate().unwrap_or_else(|error| env::panic_str(&error));
+            staking_module.set_bond_denom(token.base_denom).unwrap_or_else(|error| env::panic_str(&error));
+        }
         Self {
-            staking_module: StakingModule::new(),
+            staking_module,
+            storage_meter: StorageMeter::new(b"su"),
             router_contract,
             owner,
         }
@@ -101,7 +121,7 @@ impl StakingContract {
     pub fn create_validator(&mut self, request: CreateValidatorRequest) -> StakingOperationResponse {
         self.assert_authorized_caller();
         
-        match self.staking_module.create_validator(
+        match self.storage_meter.track("staking", || self.staking_module.create_validator(
             request.validator_address.clone(),
             general_purpose::STANDARD.decode(&request.pubkey).unwrap_or_default(),
             request.moniker,
@@ -114,7 +134,7 @@ impl StakingContract {
             request.commission_max_change_rate,
             request.min_self_delegation,
             request.self_delegation,
-        ) {
+        )) {
             Ok(_) => {
                 env::log_str(&format!("Created validator: {}", request.validator_address));
                 StakingOperationResponse {
@@ -156,7 +176,7 @@ impl StakingContract {
     ) -> StakingOperationResponse {
         self.assert_authorized_caller();
         
-        match self.staking_module.edit_validator(
+        match self.storage_meter.track("staking", || self.staking_module.edit_validator(
             validator_address.clone(),
             moniker,
             identity,
@@ -165,7 +185,7 @@ impl StakingContract {
             details,
             commission_rate,
             min_self_delegation,
-        ) {
+        )) {
             Ok(_) => {
                 env::log_str(&format!("Updated validator: {}", validator_address));
                 StakingOperationResponse {
@@ -193,6 +213,36 @@ impl StakingContract {
         }
     }
 
+    /// Replace a validator's consensus key, `new_pubkey` is base64 encoded
+    pub fn rotate_validator_key(&mut self, validator_address: String, new_pubkey: String) -> StakingOperationResponse {
+        self.assert_authorized_caller();
+
+        let new_pubkey = general_purpose::STANDARD.decode(&new_pubkey).unwrap_or_default();
+        match self.storage_meter.track("staking", || self.staking_module.rotate_validator_key(validator_address.clone(), new_pubkey)) {
+            Ok(_) => StakingOperationResponse {
+                success: true,
+                validator_address: Some(validator_address),
+                delegator: None,
+                amount: None,
+                completion_time: None,
+                events: vec!["rotate_validator_key".to_string()],
+                error: None,
+            },
+            Err(e) => {
+                env::log_str(&format!("Validator key rotation failed: {:?}", e));
+                StakingOperationResponse {
+                    success: false,
+                    validator_address: Some(validator_address),
+                    delegator: None,
+                    amount: None,
+                    completion_time: None,
+                    events: vec![],
+                    error: Some(format!("{:?}", e)),
+                }
+            }
+        }
+    }
+
     // =============================================================================
     // Delegation Functions
     // =============================================================================
@@ -215,11 +265,13 @@ impl StakingContract {
             };
         }
 
-        match self.staking_module.delegate(
+        let denom = request.denom.clone().unwrap_or_else(|| self.staking_module.bond_denom());
+        match self.storage_meter.track("staking", || self.staking_module.delegate_coin(
             request.delegator.to_string(),
             request.validator_address.clone(),
+            &denom,
             request.amount,
-        ) {
+        )) {
             Ok(_) => {
                 env::log_str(&format!(
                     "Delegated {} from {} to validator {}", 
@@ -270,11 +322,13 @@ impl StakingContract {
             };
         }
 
-        match self.staking_module.undelegate(
+        let denom = request.denom.clone().unwrap_or_else(|| self.staking_module.bond_denom());
+        match self.storage_meter.track("staking", || self.staking_module.undelegate_coin(
             request.delegator.to_string(),
             request.validator_address.clone(),
+            &denom,
             request.amount,
-        ) {
+        )) {
             Ok(completion_time) => {
                 env::log_str(&format!(
                     "Started unbonding {} from {} to validator {}", 
@@ -325,12 +379,14 @@ impl StakingContract {
             };
         }
 
-        match self.staking_module.redelegate(
+        let denom = request.denom.clone().unwrap_or_else(|| self.staking_module.bond_denom());
+        match self.storage_meter.track("staking", || self.staking_module.redelegate_coin(
             request.delegator.to_string(),
             request.validator_src_address.clone(),
             request.validator_dst_address.clone(),
+            &denom,
             request.amount,
-        ) {
+        )) {
             Ok(completion_time) => {
                 env::log_str(&format!(
                     "Started redelegation {} from {} to {} by {}", 
@@ -374,6 +430,26 @@ impl StakingContract {
         self.staking_module.get_validator(validator_address)
     }
 
+    /// Consensus keys a validator replaced, oldest first
+    pub fn get_validator_key_rotations(&self, validator_address: String) -> Vec<KeyRotation> {
+        self.assert_authorized_caller();
+        self.staking_module.get_key_rotations(validator_address)
+    }
+
+    /// Base64 consensus key a validator signed with at `height`
+    pub fn get_validator_key_at_height(&self, validator_address: String, height: u64) -> Option<String> {
+        self.assert_authorized_caller();
+        self.staking_module.validator_key_at_height(validator_address, height)
+            .map(|pubkey| general_purpose::STANDARD.encode(pubkey))
+    }
+
+    /// Validator that holds or held a base64 consensus key
+    pub fn get_validator_by_consensus_key(&self, pubkey: String) -> Option<String> {
+        self.assert_authorized_caller();
+        let pubkey = general_purpose::STANDARD.decode(&pubkey).ok()?;
+        self.staking_module.validator_by_consensus_key(&pubkey)
+    }
+
     /// Get all validators
     pub fn get_all_validators(&self) -> Vec<Validator> {
         self.assert_authorized_caller();
@@ -420,6 +496,12 @@ impl StakingContract {
         self.staking_module.get_unbonding_delegations(delegator.to_string())
     }
 
+    /// Get a delegator's staking history between two heights (inclusive).
+    /// Open to any caller so exports can read it through a view call.
+    pub fn delegator_history(&self, delegator: AccountId, from_height: u64, to_height: u64) -> Vec<DelegatorHistoryEntry> {
+        self.staking_module.delegator_history(delegator.to_string(), from_height, to_height)
+    }
+
     /// Get staking pool information
     pub fn get_pool(&self) -> serde_json::Value {
         self.assert_authorized_caller();
@@ -440,7 +522,8 @@ impl StakingContract {
             "max_entries": params.max_entries,
             "historical_entries": params.historical_entries,
             "bond_denom": params.bond_denom,
-            "min_commission_rate": params.min_commission_rate
+            "min_commission_rate": params.min_commission_rate,
+            "min_delegation": params.min_delegation
         })
     }
 
@@ -470,10 +553,10 @@ impl StakingContract {
             };
         }
 
-        match self.staking_module.withdraw_delegator_reward(
+        match self.storage_meter.track("staking", || self.staking_module.withdraw_delegator_reward(
             delegator.to_string(), 
             validator_address.clone()
-        ) {
+        )) {
             Ok(amount) => {
                 env::log_str(&format!(
                     "Withdrew {} rewards for {} from validator {}", 
@@ -516,12 +599,12 @@ impl StakingContract {
     ) -> StakingOperationResponse {
         self.assert_owner();
         
-        match self.staking_module.slash_validator(
+        match self.storage_meter.track("staking", || self.staking_module.slash_validator(
             validator_address.clone(), 
             height, 
             power, 
             slash_fraction
-        ) {
+        )) {
             Ok(slashed_amount) => {
                 env::log_str(&format!(
                     "Slashed validator {} for {} tokens at height {}", 
@@ -596,6 +679,14 @@ impl StakingContract {
     // Admin and Configuration Functions
     // =============================================================================
 
+    /// Update the denom accepted for bonding
+    pub fn update_bond_denom(&mut self, denom: String) {
+        self.assert_owner();
+        if let Err(e) = self.storage_meter.track("staking", || self.staking_module.set_bond_denom(denom)) {
+            env::panic_str(&e);
+        }
+    }
+
     /// Update the router contract address
     pub fn update_router_contract(&mut self, new_router: AccountId) {
         self.assert_owner();
@@ -604,6 +695,11 @@ impl StakingContract {
     }
 
     /// Get current router contract
+    /// Bytes stored by each module and the NEAR they lock
+    pub fn storage_usage_by_module(&self) -> StorageUsageReport {
+        self.storage_meter.report()
+    }
+
     pub fn get_router_contract(&self) -> Option<AccountId> {
         self.router_contract.clone()
     }
@@ -623,10 +719,14 @@ impl StakingContract {
             "functions": [
                 "create_validator",
                 "edit_validator",
+                "rotate_validator_key",
                 "delegate",
                 "undelegate",
                 "redelegate",
                 "get_validator",
+                "get_validator_key_rotations",
+                "get_validator_key_at_height",
+                "get_validator_by_consensus_key",
                 "get_all_validators",
                 "get_bonded_validators",
                 "get_delegation",
@@ -639,7 +739,8 @@ impl StakingContract {
                 "withdraw_delegator_reward",
                 "slash_validator",
                 "process_staking_operation",
-                "validate_staking_operation"
+                "validate_staking_operation",
+                "storage_usage_by_module"
             ],
             "total_validators": self.staking_module.get_all_validators().len()
         })
@@ -703,7 +804,7 @@ mod tests {
         let context = get_context(accounts(1));
         testing_env!(context);
         
-        let contract = StakingContract::new(accounts(1), Some(accounts(2)));
+        let contract = StakingContract::new(accounts(1), Some(accounts(2)), None);
         assert_eq!(contract.owner, accounts(1));
         assert_eq!(contract.router_contract, Some(accounts(2)));
     }
@@ -713,7 +814,7 @@ mod tests {
         let context = get_context(accounts(1));
         testing_env!(context);
         
-        let contract = StakingContract::new(accounts(1), Some(accounts(2)));
+        let contract = StakingContract::new(accounts(1), Some(accounts(2)), None);
         
         // Owner should be authorized
         contract.assert_authorized_caller();
@@ -730,7 +831,7 @@ mod tests {
         let context = get_context(accounts(3)); // Unauthorized account
         testing_env!(context);
         
-        let contract = StakingContract::new(accounts(1), Some(accounts(2)));
+        let contract = StakingContract::new(accounts(1), Some(accounts(2)), None);
         contract.assert_authorized_caller();
     }
 
@@ -739,7 +840,7 @@ mod tests {
         let context = get_context(accounts(1));
         testing_env!(context);
         
-        let contract = StakingContract::new(accounts(1), None);
+        let contract = StakingContract::new(accounts(1), None, None);
         assert!(contract.health_check());
     }
 
@@ -748,7 +849,7 @@ mod tests {
         let context = get_context(accounts(1));
         testing_env!(context);
         
-        let contract = StakingContract::new(accounts(1), None);
+        let contract = StakingContract::new(accounts(1), None, None);
         
         // Test with non-existent validator
         let result = contract.validate_staking_operation("non-existent".to_string(), 1000);
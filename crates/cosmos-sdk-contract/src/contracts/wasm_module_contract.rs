@@ -14,7 +14,7 @@ use schemars::JsonSchema;
 use base64::{Engine as _, engine::general_purpose};
 
 use crate::modules::wasm::{
-    WasmModule, CodeID,
+    WasmModule, CodeID, CodeUpload,
     AccessConfig, CodeInfo, ContractInfo, Coin
 };
 
@@ -118,6 +118,72 @@ impl WasmModuleContract {
         }
     }
 
+    /// Start a chunked upload for code too large for a single call
+    pub fn begin_store_code(
+        &mut self,
+        expected_size: u64,
+        checksum: String,
+        source: Option<String>,
+        builder: Option<String>,
+        instantiate_permission: Option<AccessConfig>,
+    ) -> u64 {
+        self.assert_authorized_caller();
+        self.wasm_module.begin_store_code(
+            &env::predecessor_account_id(),
+            expected_size,
+            checksum,
+            source,
+            builder,
+            instantiate_permission,
+        ).unwrap_or_else(|e| env::panic_str(&e))
+    }
+
+    /// Append the next chunk of an upload, returning the bytes received so far
+    pub fn append_code_chunk(&mut self, upload_id: u64, index: u32, chunk: Base64VecU8) -> u64 {
+        self.assert_authorized_caller();
+        self.wasm_module.append_code_chunk(&env::predecessor_account_id(), upload_id, index, chunk.into())
+            .unwrap_or_else(|e| env::panic_str(&e))
+    }
+
+    /// Verify the checksum of a complete upload and store the code
+    pub fn finish_store_code(&mut self, upload_id: u64) -> WasmOperationResponse {
+        self.assert_authorized_caller();
+
+        match self.wasm_module.finish_store_code(&env::predecessor_account_id(), upload_id) {
+            Ok(code_id) => WasmOperationResponse {
+                success: true,
+                data: None,
+                code_id: Some(code_id),
+                contract_address: None,
+                events: vec!["code_stored".to_string()],
+                error: None,
+            },
+            Err(e) => WasmOperationResponse {
+                success: false,
+                data: None,
+                code_id: None,
+                contract_address: None,
+                events: vec![],
+                error: Some(e),
+            },
+        }
+    }
+
+    pub fn cancel_upload(&mut self, upload_id: u64) {
+        self.assert_authorized_caller();
+        self.wasm_module.cancel_upload(&env::predecessor_account_id(), upload_id)
+            .unwrap_or_else(|e| env::panic_str(&e))
+    }
+
+    /// Remove uploads abandoned for more than a day, callable by anyone
+    pub fn prune_abandoned_uploads(&mut self) -> u32 {
+        self.wasm_module.prune_abandoned_uploads(env::block_timestamp())
+    }
+
+    pub fn get_upload(&self, upload_id: u64) -> Option<CodeUpload> {
+        self.wasm_module.get_upload(upload_id)
+    }
+
     /// Instantiate a contract from stored code
     pub fn instantiate(&mut self, request: InstantiateRequest) -> WasmOperationResponse {
         self.assert_authorized_caller();
@@ -318,6 +384,12 @@ impl WasmModuleContract {
             "description": "x/wasm Module for smart contract management",
             "functions": [
                 "store_code",
+                "begin_store_code",
+                "append_code_chunk",
+                "finish_store_code",
+                "cancel_upload",
+                "prune_abandoned_uploads",
+                "get_upload",
                 "instantiate",
                 "execute",
                 "query",
@@ -1,3 +1,4 @@
+use super::secp256r1::{verify_secp256r1, SECP256R1_PUBKEY_TYPE_URL};
 use crate::types::cosmos_tx::{CosmosTx, SignDoc, SignerInfo, SignMode};
 use near_sdk::borsh::{BorshDeserialize, BorshSerialize};
 use near_sdk::serde::{Deserialize, Serialize};
@@ -56,6 +57,8 @@ pub enum CosmosPublicKey {
         threshold: u32,
         public_keys: Vec<CosmosPublicKey>,
     },
+    /// secp256r1 (P-256) passkey public key (33 bytes compressed)
+    Secp256r1(Vec<u8>),
 }
 
 impl CosmosPublicKey {
@@ -81,11 +84,23 @@ impl CosmosPublicKey {
         Ok(CosmosPublicKey::Ed25519(bytes))
     }
 
+    /// Create a secp256r1 public key
+    pub fn secp256r1(bytes: Vec<u8>) -> Result<Self, SignatureError> {
+        if bytes.len() != 33 {
+            return Err(SignatureError::InvalidPublicKeyLength {
+                expected: 33,
+                actual: bytes.len(),
+            });
+        }
+        Ok(CosmosPublicKey::Secp256r1(bytes))
+    }
+
     /// Get the raw bytes of the public key
     pub fn bytes(&self) -> &[u8] {
         match self {
             CosmosPublicKey::Secp256k1(bytes) => bytes,
             CosmosPublicKey::Ed25519(bytes) => bytes,
+            CosmosPublicKey::Secp256r1(bytes) => bytes,
             CosmosPublicKey::MultiSig { .. } => &[], // Multi-sig doesn't have single key bytes
         }
     }
@@ -106,7 +121,10 @@ impl CosmosPublicKey {
     }
 
     /// Compute the address hash (ripemd160(sha256(pubkey)))
-    fn address_hash(&self) -> Result<[u8; 20], SignatureError> {
+    ///
+    /// secp256r1 keys use the 32 byte hash of the key type and key instead,
+    /// as in the Cosmos SDK.
+    fn address_hash(&self) -> Result<Vec<u8>, SignatureError> {
         use sha2::{Digest, Sha256};
         use ripemd::{Ripemd160};
 
@@ -114,12 +132,19 @@ impl CosmosPublicKey {
             CosmosPublicKey::Secp256k1(bytes) => {
                 let sha256_hash = Sha256::digest(bytes);
                 let ripemd_hash = Ripemd160::digest(sha256_hash);
-                Ok(ripemd_hash.into())
+                Ok(ripemd_hash.to_vec())
             }
             CosmosPublicKey::Ed25519(bytes) => {
                 let sha256_hash = Sha256::digest(bytes);
                 let ripemd_hash = Ripemd160::digest(sha256_hash);
-                Ok(ripemd_hash.into())
+                Ok(ripemd_hash.to_vec())
+            }
+            CosmosPublicKey::Secp256r1(bytes) => {
+                let type_hash = Sha256::digest(&SECP256R1_PUBKEY_TYPE_URL.as_bytes()[1..]);
+                let mut hasher = Sha256::new();
+                hasher.update(type_hash);
+                hasher.update(bytes);
+                Ok(hasher.finalize().to_vec())
             }
             CosmosPublicKey::MultiSig { .. } => {
                 Err(SignatureError::InvalidPublicKey("Cannot compute address for multi-sig key directly".to_string()))
@@ -212,8 +237,16 @@ impl CosmosSignatureVerifier {
         &self,
         signature: &[u8],
         message_hash: &[u8],
-        _pub_key_any: &crate::types::cosmos_tx::Any,
+        pub_key_any: &crate::types::cosmos_tx::Any,
     ) -> Result<CosmosPublicKey, SignatureError> {
+        // P-256 keys cannot be recovered from a signature
+        if pub_key_any.type_url == SECP256R1_PUBKEY_TYPE_URL {
+            let public_key = CosmosPublicKey::secp256r1(pub_key_any.value.clone())?;
+            if !verify_secp256r1(signature, message_hash, &pub_key_any.value)? {
+                return Err(SignatureError::VerificationFailed("Invalid secp256r1 signature".to_string()));
+            }
+            return Ok(public_key);
+        }
         // TODO: Decode the public key from Any type and verify
         // For now, we'll implement public key recovery approach
         self.recover_public_key(signature, message_hash)
@@ -359,14 +392,29 @@ impl SignatureBuilder {
         public_key: &CosmosPublicKey,
     ) -> Result<bool, SignatureError> {
         let message_hash = self.get_message_hash(tx, account_number)?;
-        
+        self.verify_hash(signature, &message_hash, public_key)
+    }
+
+    /// Verify a signature over arbitrary bytes, hashed like signing bytes
+    pub fn verify_message(
+        &self,
+        signature: &[u8],
+        message: &[u8],
+        public_key: &CosmosPublicKey,
+    ) -> Result<bool, SignatureError> {
+        let message_hash = self.verifier.hash_message(message)?;
+        self.verify_hash(signature, &message_hash, public_key)
+    }
+
+    fn verify_hash(&self, signature: &[u8], message_hash: &[u8], public_key: &CosmosPublicKey) -> Result<bool, SignatureError> {
         match public_key {
             CosmosPublicKey::Secp256k1(pub_key_bytes) => {
-                self.verify_secp256k1_signature(signature, &message_hash, pub_key_bytes)
+                self.verify_secp256k1_signature(signature, message_hash, pub_key_bytes)
             }
             CosmosPublicKey::Ed25519(pub_key_bytes) => {
-                self.verify_ed25519_signature(signature, &message_hash, pub_key_bytes)
+                self.verify_ed25519_signature(signature, message_hash, pub_key_bytes)
             }
+            CosmosPublicKey::Secp256r1(pub_key_bytes) => verify_secp256r1(signature, message_hash, pub_key_bytes),
             CosmosPublicKey::MultiSig { .. } => {
                 Err(SignatureError::UnsupportedSignMode("Direct multi-sig verification not supported".to_string()))
             }
@@ -458,6 +506,31 @@ mod tests {
         // Test invalid lengths
         assert!(CosmosPublicKey::secp256k1(vec![0u8; 32]).is_err());
         assert!(CosmosPublicKey::ed25519(vec![0u8; 31]).is_err());
+        assert!(CosmosPublicKey::secp256r1(vec![0u8; 65]).is_err());
+    }
+
+    #[test]
+    fn test_secp256r1_address_is_32_bytes() {
+        let passkey = CosmosPublicKey::secp256r1(vec![0x02; 33]).unwrap();
+        let secp256k1 = CosmosPublicKey::secp256k1(vec![0x02; 33]).unwrap();
+        assert_eq!(passkey.address_hash().unwrap().len(), 32);
+        assert_ne!(passkey.to_cosmos_address("cosmos").unwrap(), secp256k1.to_cosmos_address("cosmos").unwrap());
+    }
+
+    #[test]
+    fn test_secp256r1_signer_is_not_recovered() {
+        let verifier = CosmosSignatureVerifier::new("test-chain".to_string());
+        let signer_info = SignerInfo {
+            public_key: Some(Any::new(SECP256R1_PUBKEY_TYPE_URL, vec![0x02; 33])),
+            mode_info: ModeInfo {
+                mode: SignMode::Direct,
+                multi: None,
+            },
+            sequence: 1,
+        };
+        let sign_doc = verifier.create_sign_doc(&create_test_transaction(), 42).unwrap();
+        // A secp256k1 recovery signature is never taken for a passkey's
+        assert!(verifier.verify_single_signature(&[0u8; 65], &sign_doc, &signer_info).is_err());
     }
 
     #[test]
@@ -1,3 +1,5 @@
 pub mod cosmos_signatures;
+pub mod secp256r1;
 
-pub use cosmos_signatures::*;
\ No newline at end of file
+pub use cosmos_signatures::*;
+pub use secp256r1::{verify_secp256r1, WebAuthnSignature, SECP256R1_PUBKEY_TYPE_URL};
\ No newline at end of file
@@ -0,0 +1,211 @@
+/// secp256r1 (P-256) Signatures
+///
+/// Passkeys sign with P-256, so accepting those keys lets a phone's secure
+/// enclave control an account without a seed phrase. Two signature forms
+/// are accepted for a `CosmosPublicKey::Secp256r1` key:
+///
+/// - raw: the 64 byte `r || s` ECDSA signature over the SHA-256 of the sign
+///   bytes, with `s` in the lower half of the order as in the Cosmos SDK
+/// - WebAuthn: a JSON `WebAuthnSignature` from a passkey assertion whose
+///   challenge is the base64url encoded SHA-256 of the sign bytes
+///
+/// The P-256 arithmetic adds noticeably to the contract size, so it is only
+/// compiled with the `secp256r1` cargo feature. Without it keys can still be
+/// stored and addressed, but every signature is rejected.
+
+use near_sdk::serde::{Deserialize, Serialize};
+
+use super::SignatureError;
+
+/// Type URL of a secp256r1 public key in `SignerInfo`
+pub const SECP256R1_PUBKEY_TYPE_URL: &str = "/cosmos.crypto.secp256r1.PubKey";
+
+/// Client data type of a WebAuthn assertion
+const WEBAUTHN_GET: &str = "webauthn.get";
+/// User presence bit of the authenticator data flags
+const FLAG_USER_PRESENT: u8 = 0x01;
+
+/// Passkey assertion, as returned by `navigator.credentials.get`
+#[derive(Clone, Debug, PartialEq, Serialize, Deserialize)]
+pub struct WebAuthnSignature {
+    pub authenticator_data: Vec<u8>,
+    pub client_data_json: String,
+    /// DER or 64 byte `r || s` encoded ECDSA signature
+    pub signature: Vec<u8>,
+}
+
+#[derive(Deserialize)]
+struct ClientData {
+    #[serde(rename = "type")]
+    kind: String,
+    challenge: String,
+}
+
+impl WebAuthnSignature {
+    /// Bytes the authenticator signed, after checking they answer the
+    /// challenge `message_hash`
+    ///
+    /// The relying party origin is not checked: a chain has no origin, the
+    /// challenge already binds the assertion to one sign document.
+    pub fn signed_bytes(&self, message_hash: &[u8]) -> Result<Vec<u8>, SignatureError> {
+        use base64::Engine;
+        use sha2::{Digest, Sha256};
+
+        let client_data: ClientData = serde_json::from_str(&self.client_data_json)
+            .map_err(|e| SignatureError::InvalidSignature(format!("Invalid WebAuthn client data: {}", e)))?;
+        if client_data.kind != WEBAUTHN_GET {
+            return Err(SignatureError::InvalidSignature(format!("WebAuthn client data type {} is not {}", client_data.kind, WEBAUTHN_GET)));
+        }
+        if client_data.challenge != base64::engine::general_purpose::URL_SAFE_NO_PAD.encode(message_hash) {
+            return Err(SignatureError::VerificationFailed("WebAuthn challenge does not match the sign bytes".to_string()));
+        }
+        // 32 byte RP ID hash, flags, 4 byte signature counter
+        if self.authenticator_data.len() < 37 {
+            return Err(SignatureError::InvalidSignature("WebAuthn authenticator data is too short".to_string()));
+        }
+        if self.authenticator_data[32] & FLAG_USER_PRESENT == 0 {
+            return Err(SignatureError::VerificationFailed("WebAuthn assertion was made without user presence".to_string()));
+        }
+
+        let mut signed = self.authenticator_data.clone();
+        signed.extend_from_slice(&Sha256::digest(self.client_data_json.as_bytes()));
+        Ok(signed)
+    }
+}
+
+/// Verify a raw or WebAuthn signature against a compressed P-256 key
+#[cfg(feature = "secp256r1")]
+pub fn verify_secp256r1(signature: &[u8], message_hash: &[u8], public_key: &[u8]) -> Result<bool, SignatureError> {
+    use p256::ecdsa::signature::hazmat::PrehashVerifier;
+    use p256::ecdsa::signature::Verifier;
+    use p256::ecdsa::{Signature, VerifyingKey};
+
+    let verifying_key = VerifyingKey::from_sec1_bytes(public_key)
+        .map_err(|e| SignatureError::InvalidPublicKey(e.to_string()))?;
+
+    if signature.len() == 64 {
+        let signature = Signature::from_slice(signature)
+            .map_err(|e| SignatureError::InvalidSignature(e.to_string()))?;
+        // A high `s` would give a second valid signature for the same bytes
+        if signature.normalize_s().is_some() {
+            return Ok(false);
+        }
+        return Ok(verifying_key.verify_prehash(message_hash, &signature).is_ok());
+    }
+
+    let assertion: WebAuthnSignature = serde_json::from_slice(signature)
+        .map_err(|e| SignatureError::InvalidSignature(format!("Neither a raw nor a WebAuthn signature: {}", e)))?;
+    let signed = assertion.signed_bytes(message_hash)?;
+    let signature = match assertion.signature.len() {
+        64 => Signature::from_slice(&assertion.signature),
+        _ => Signature::from_der(&assertion.signature),
+    }
+    .map_err(|e| SignatureError::InvalidSignature(e.to_string()))?;
+    // Authenticators do not normalize `s`
+    let signature = signature.normalize_s().unwrap_or(signature);
+    Ok(verifying_key.verify(&signed, &signature).is_ok())
+}
+
+/// Without the `secp256r1` feature no P-256 signature is accepted
+#[cfg(not(feature = "secp256r1"))]
+pub fn verify_secp256r1(_signature: &[u8], _message_hash: &[u8], _public_key: &[u8]) -> Result<bool, SignatureError> {
+    Err(SignatureError::UnsupportedSignMode(
+        "secp256r1 signatures require a build with the secp256r1 feature".to_string(),
+    ))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use base64::Engine;
+    use sha2::{Digest, Sha256};
+
+    fn client_data(kind: &str, message_hash: &[u8]) -> String {
+        format!(
+            r#"{{"type":"{}","challenge":"{}","origin":"https://wallet.example"}}"#,
+            kind,
+            base64::engine::general_purpose::URL_SAFE_NO_PAD.encode(message_hash)
+        )
+    }
+
+    fn authenticator_data(flags: u8) -> Vec<u8> {
+        let mut data = vec![0xaa; 32];
+        data.push(flags);
+        data.extend_from_slice(&7u32.to_be_bytes());
+        data
+    }
+
+    #[test]
+    fn test_webauthn_challenge_checks() {
+        let hash = Sha256::digest(b"sign bytes").to_vec();
+        let assertion = |kind: &str, flags: u8| WebAuthnSignature {
+            authenticator_data: authenticator_data(flags),
+            client_data_json: client_data(kind, &hash),
+            signature: vec![],
+        };
+
+        let signed = assertion(WEBAUTHN_GET, 0x05).signed_bytes(&hash).unwrap();
+        assert_eq!(signed.len(), 37 + 32);
+        assert!(assertion("webauthn.create", 0x05).signed_bytes(&hash).is_err());
+        assert!(assertion(WEBAUTHN_GET, 0x04).signed_bytes(&hash).is_err());
+        assert!(matches!(
+            assertion(WEBAUTHN_GET, 0x05).signed_bytes(&Sha256::digest(b"other")),
+            Err(SignatureError::VerificationFailed(_))
+        ));
+    }
+
+    #[cfg(not(feature = "secp256r1"))]
+    #[test]
+    fn test_rejected_without_feature() {
+        assert!(matches!(
+            verify_secp256r1(&[0; 64], &[0; 32], &[2; 33]),
+            Err(SignatureError::UnsupportedSignMode(_))
+        ));
+    }
+
+    #[cfg(feature = "secp256r1")]
+    mod p256_signatures {
+        use super::*;
+        use p256::ecdsa::signature::hazmat::PrehashSigner;
+        use p256::ecdsa::signature::Signer;
+        use p256::ecdsa::{Signature, SigningKey};
+
+        fn signing_key() -> (SigningKey, Vec<u8>) {
+            let key = SigningKey::from_slice(&[7; 32]).unwrap();
+            let public_key = key.verifying_key().to_encoded_point(true).as_bytes().to_vec();
+            (key, public_key)
+        }
+
+        #[test]
+        fn test_raw_signature() {
+            let (key, public_key) = signing_key();
+            let hash = Sha256::digest(b"sign bytes").to_vec();
+            let signature: Signature = key.sign_prehash(&hash).unwrap();
+            let low = signature.normalize_s().unwrap_or(signature);
+            assert!(verify_secp256r1(&low.to_bytes(), &hash, &public_key).unwrap());
+            assert!(!verify_secp256r1(&low.to_bytes(), &Sha256::digest(b"other"), &public_key).unwrap());
+
+            // The malleated high-s twin is refused
+            let (r, s) = low.split_scalars();
+            let high = Signature::from_scalars(r, -*s).unwrap();
+            assert!(!verify_secp256r1(&high.to_bytes(), &hash, &public_key).unwrap());
+        }
+
+        #[test]
+        fn test_webauthn_signature() {
+            let (key, public_key) = signing_key();
+            let hash = Sha256::digest(b"sign bytes").to_vec();
+            let mut assertion = WebAuthnSignature {
+                authenticator_data: authenticator_data(0x05),
+                client_data_json: client_data(WEBAUTHN_GET, &hash),
+                signature: vec![],
+            };
+            let signature: Signature = key.sign(&assertion.signed_bytes(&hash).unwrap());
+            assertion.signature = signature.to_der().as_bytes().to_vec();
+
+            let encoded = serde_json::to_vec(&assertion).unwrap();
+            assert!(verify_secp256r1(&encoded, &hash, &public_key).unwrap());
+            assert!(verify_secp256r1(&encoded, &Sha256::digest(b"other"), &public_key).is_err());
+        }
+    }
+}
@@ -0,0 +1,197 @@
+/// Appchain Instance Factory
+///
+/// The router can spin up further isolated Cosmos-style chains from the same
+/// codebase. Each instance is a NEAR sub-account of the factory holding its
+/// own copy of the router code, initialized from an `InstanceGenesis` that
+/// sets its chain ID, owner, native token and module registrations.
+///
+/// The same genesis format carries state across a coordinated fork: once
+/// governance halts the chain, `export_genesis` returns its registrations
+/// with a hash that the redeployed instance logs again at init, so operators
+/// can check that nothing changed in transit.
+
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::{AccountId, Gas, NearToken};
+use schemars::JsonSchema;
+use serde::{Deserialize, Serialize};
+
+use crate::modules::bank::NativeToken;
+
+/// Raw storage key of the router code deployed to new instances
+pub const INSTANCE_CODE_KEY: &[u8] = b"factory_code";
+
+/// Deposit required to cover an instance's account and code storage
+pub const MIN_INSTANCE_DEPOSIT: NearToken = NearToken::from_near(5);
+
+/// Gas attached to the instance's init call
+pub const INSTANCE_INIT_GAS: Gas = Gas::from_tgas(30);
+
+/// Gas attached to the factory callback
+pub const INSTANCE_CALLBACK_GAS: Gas = Gas::from_tgas(10);
+
+/// Longest instance name accepted as a sub-account prefix
+pub const MAX_INSTANCE_NAME_LEN: usize = 32;
+
+/// Module registered in an instance at genesis
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct GenesisModule {
+    pub module_type: String,
+    pub contract_id: String,
+    pub version: String,
+}
+
+/// Initial state of a new appchain instance
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct InstanceGenesis {
+    pub chain_id: String,
+    pub owner: String,
+    #[serde(default)]
+    pub modules: Vec<GenesisModule>,
+    /// Native token, NEAR when omitted. Also passed to the instance's bank
+    /// and staking contracts when they are deployed.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub native_token: Option<NativeToken>,
+}
+
+/// Genesis exported by a halted chain
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct ExportedGenesis {
+    /// Halt height the state was exported at
+    pub height: u64,
+    pub genesis: InstanceGenesis,
+    /// Hex encoded SHA-256 of the genesis, see `genesis_hash`
+    pub genesis_hash: String,
+}
+
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Copy, Debug, PartialEq, JsonSchema)]
+#[serde(rename_all = "snake_case")]
+pub enum InstanceStatus {
+    /// Creation promise still in flight
+    Pending,
+    Active,
+    /// Account creation, deployment or init failed
+    Failed,
+}
+
+/// Appchain instance created by this factory
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct InstanceInfo {
+    pub account_id: String,
+    pub chain_id: String,
+    pub owner: String,
+    /// Block timestamp of creation in nanoseconds
+    pub created_at: u64,
+    pub status: InstanceStatus,
+}
+
+/// Sub-account of the factory hosting the instance called `name`
+pub fn instance_account_id(name: &str, factory: &AccountId) -> Result<AccountId, String> {
+    if name.is_empty() || name.len() > MAX_INSTANCE_NAME_LEN {
+        return Err(format!("Instance name must be 1 to {} characters", MAX_INSTANCE_NAME_LEN));
+    }
+    if !name.chars().all(|c| c.is_ascii_lowercase() || c.is_ascii_digit() || c == '-' || c == '_') {
+        return Err(format!("Invalid instance name {}: use lowercase letters, digits, - and _", name));
+    }
+
+    format!("{}.{}", name, factory)
+        .parse()
+        .map_err(|_| format!("Invalid instance account for {}", name))
+}
+
+/// Check an instance genesis before any promise is created
+pub fn validate_genesis(genesis: &InstanceGenesis) -> Result<(), String> {
+    if genesis.chain_id.trim().is_empty() {
+        return Err("Genesis chain_id cannot be empty".to_string());
+    }
+    genesis.owner.parse::<AccountId>()
+        .map_err(|_| format!("Invalid genesis owner {}", genesis.owner))?;
+
+    let mut module_types = Vec::new();
+    for module in &genesis.modules {
+        module.contract_id.parse::<AccountId>()
+            .map_err(|_| format!("Invalid contract_id {} for module {}", module.contract_id, module.module_type))?;
+        if module_types.contains(&&module.module_type) {
+            return Err(format!("Module {} registered twice in genesis", module.module_type));
+        }
+        module_types.push(&module.module_type);
+    }
+    if let Some(token) = &genesis.native_token {
+        token.validate().map_err(|e| format!("Invalid genesis native token: {}", e))?;
+    }
+    Ok(())
+}
+
+/// Hash of a genesis, independent of the order of its modules
+pub fn genesis_hash(genesis: &InstanceGenesis) -> String {
+    let mut canonical = genesis.clone();
+    canonical.modules.sort_by(|a, b| a.module_type.cmp(&b.module_type));
+    let json = serde_json::to_vec(&canonical).unwrap_or_default();
+    hex::encode(near_sdk::env::sha256(&json))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn genesis() -> InstanceGenesis {
+        InstanceGenesis {
+            chain_id: "appchain-1".to_string(),
+            owner: "alice.near".to_string(),
+            modules: vec![GenesisModule {
+                module_type: "wasm".to_string(),
+                contract_id: "wasm.appchain.near".to_string(),
+                version: "1.0.0".to_string(),
+            }],
+            native_token: None,
+        }
+    }
+
+    #[test]
+    fn test_instance_account_id() {
+        let factory: AccountId = "router.near".parse().unwrap();
+        assert_eq!(instance_account_id("dex-chain", &factory).unwrap().as_str(), "dex-chain.router.near");
+        assert!(instance_account_id("", &factory).is_err());
+        assert!(instance_account_id("Dex", &factory).is_err());
+        assert!(instance_account_id("a.b", &factory).is_err());
+        assert!(instance_account_id(&"a".repeat(MAX_INSTANCE_NAME_LEN + 1), &factory).is_err());
+    }
+
+    #[test]
+    fn test_validate_genesis() {
+        assert!(validate_genesis(&genesis()).is_ok());
+
+        let mut invalid = genesis();
+        invalid.chain_id = " ".to_string();
+        assert!(validate_genesis(&invalid).is_err());
+
+        let mut invalid = genesis();
+        invalid.modules.push(invalid.modules[0].clone());
+        assert!(validate_genesis(&invalid).is_err());
+
+        let mut invalid = genesis();
+        invalid.owner = "Not An Account".to_string();
+        assert!(validate_genesis(&invalid).is_err());
+
+        let mut invalid = genesis();
+        invalid.native_token = Some(NativeToken { exponent: 0, ..NativeToken::default() });
+        assert!(validate_genesis(&invalid).is_err());
+    }
+
+    #[test]
+    fn test_genesis_hash() {
+        let mut reordered = genesis();
+        reordered.modules.insert(0, GenesisModule {
+            module_type: "bank".to_string(),
+            contract_id: "bank.appchain.near".to_string(),
+            version: "1.0.0".to_string(),
+        });
+        let mut expected = genesis();
+        expected.modules.push(reordered.modules[0].clone());
+        assert_eq!(genesis_hash(&reordered), genesis_hash(&expected));
+        assert_eq!(genesis_hash(&genesis()).len(), 64);
+
+        let mut changed = genesis();
+        changed.chain_id = "appchain-2".to_string();
+        assert_ne!(genesis_hash(&changed), genesis_hash(&genesis()));
+    }
+}
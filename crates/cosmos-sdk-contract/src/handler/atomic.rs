@@ -0,0 +1,438 @@
+/// Atomic Calls
+///
+/// Lets a whitelisted NEAR contract run a sequence of module messages as one
+/// unit of work, so a DeFi contract can, say, undelegate and send in a single
+/// step that either happens completely or not at all. An atomic call spans
+/// three receipts on this contract:
+///
+/// 1. `atomic_call` checks the caller and its messages and schedules the
+///    other two.
+/// 2. `atomic_execute` routes the messages in order and panics on the first
+///    failure. NEAR discards every state change of a receipt that panics, so
+///    this receipt is the sub-transaction: it commits whole or rolls back.
+/// 3. `on_atomic_call` reads the outcome of the second receipt and hands an
+///    `AtomicCallResult` to the caller's callback method, if it named one.
+///
+/// The messages act for the caller only: every signer field of a message
+/// must name the calling contract.
+///
+/// A host contract implementing `CosmosMessageHandler` exposes the three
+/// entrypoints by delegating to `AtomicCalls::begin` and `schedule`,
+/// `execute_atomic`, and `resolve_atomic_call`; the last two must be
+/// `#[private]`. The router does so for the NEAR deposited with it.
+
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::collections::UnorderedSet;
+use near_sdk::json_types::Base64VecU8;
+use near_sdk::serde::{Deserialize, Serialize};
+use near_sdk::serde_json::{self, json, Value};
+use near_sdk::{env, AccountId, Gas, NearToken, Promise, PromiseResult};
+
+use super::failure::FailureEvent;
+use super::msg_router::{route_cosmos_message, CosmosMessageHandler, HandleResponse};
+use super::tx_handler::{ABCICode, ABCIEvent, ABCIMessageLog, TxResponse};
+use crate::modules::ibc::transfer::hooks::SIGNER_FIELDS;
+use crate::types::Authority;
+
+/// Most messages one atomic call may carry
+pub const MAX_ATOMIC_MESSAGES: usize = 16;
+/// Gas for the receipt that executes the messages
+pub const ATOMIC_EXECUTE_GAS: Gas = Gas::from_tgas(150);
+/// Gas for resolving the outcome, including the callback it schedules
+pub const ATOMIC_RESOLVE_GAS: Gas = Gas::from_tgas(30);
+/// Gas attached to the caller's callback
+pub const ATOMIC_CALLBACK_GAS: Gas = Gas::from_tgas(15);
+
+/// One module message of an atomic call
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq)]
+pub struct AtomicMsg {
+    pub type_url: String,
+    /// JSON encoded message
+    pub value: Base64VecU8,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq)]
+pub struct AtomicCallRequest {
+    pub messages: Vec<AtomicMsg>,
+    /// Method of the caller that receives the `AtomicCallResult`
+    #[serde(default)]
+    pub callback: Option<String>,
+}
+
+/// Arguments of `atomic_execute`
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq)]
+pub struct AtomicExecution {
+    pub call_id: u64,
+    pub caller: AccountId,
+    pub messages: Vec<AtomicMsg>,
+}
+
+/// Outcome handed to the caller
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq)]
+pub struct AtomicCallResult {
+    pub call_id: u64,
+    /// Whether the messages were applied; when false nothing was
+    pub committed: bool,
+    /// Response of every message, empty when rolled back
+    pub responses: Vec<HandleResponse>,
+}
+
+impl AtomicCallResult {
+    /// Transaction response the call is indexed under at `height`
+    pub fn to_tx_response(&self, height: u64) -> TxResponse {
+        let logs: Vec<ABCIMessageLog> = self.responses.iter()
+            .enumerate()
+            .map(|(index, response)| ABCIMessageLog {
+                msg_index: index as u32,
+                log: response.log.clone(),
+                events: response.events.iter()
+                    .map(|event| ABCIEvent::new(
+                        &event.r#type,
+                        event.attributes.iter().map(|attr| (attr.key.as_str(), attr.value.as_str())).collect(),
+                    ))
+                    .collect(),
+            })
+            .collect();
+
+        TxResponse {
+            height: height.to_string(),
+            txhash: atomic_call_hash(self.call_id),
+            code: if self.committed { ABCICode::OK } else { ABCICode::INTERNAL_ERROR },
+            data: String::new(),
+            raw_log: if self.committed { String::new() } else { "Atomic call rolled back".to_string() },
+            events: logs.iter().flat_map(|log| log.events.clone()).collect(),
+            logs,
+            info: String::new(),
+            gas_wanted: "0".to_string(),
+            gas_used: "0".to_string(),
+            tx: None,
+            // The block time is kept on the header
+            timestamp: String::new(),
+            codespace: String::new(),
+        }
+    }
+}
+
+/// Hash an atomic call is indexed under, derived from its id
+pub fn atomic_call_hash(call_id: u64) -> String {
+    let preimage = format!("{}/atomic_call/{}", env::current_account_id(), call_id);
+    hex::encode_upper(env::sha256(preimage.as_bytes()))
+}
+
+/// First message of an atomic call that failed
+#[derive(Clone, Debug, PartialEq)]
+pub struct AtomicFailure {
+    pub call_id: u64,
+    pub index: usize,
+    pub response: HandleResponse,
+}
+
+impl AtomicFailure {
+    /// Abort the executing receipt, rolling back the messages before `index`
+    pub fn abort(&self, type_url: &str) -> ! {
+        FailureEvent::new(
+            type_url,
+            self.response.code,
+            format!("Atomic call {} rolled back at message {}: {}", self.call_id, self.index, self.response.log),
+        )
+        .abort()
+    }
+}
+
+/// Contracts allowed to make atomic calls
+#[derive(BorshDeserialize, BorshSerialize)]
+pub struct AtomicCalls {
+    /// Governance account; defaults to this contract
+    authority: Authority,
+    callers: UnorderedSet<AccountId>,
+    next_id: u64,
+}
+
+impl AtomicCalls {
+    pub fn new() -> Self {
+        Self {
+            authority: Authority::default(),
+            callers: UnorderedSet::new(b"atomic_callers".to_vec()),
+            next_id: 1,
+        }
+    }
+
+    /// Account that governance acts through
+    pub fn authority(&self) -> AccountId {
+        self.authority.account()
+    }
+
+    pub fn set_authority(&mut self, sender: &AccountId, new_authority: AccountId) -> Result<(), String> {
+        self.authority.transfer(sender, new_authority)
+    }
+
+    fn assert_authority(&self, sender: &AccountId) -> Result<(), String> {
+        self.authority.check(sender, "Only the governance authority can change atomic callers")
+    }
+
+    pub fn allow_caller(&mut self, sender: &AccountId, caller: AccountId) -> Result<(), String> {
+        self.assert_authority(sender)?;
+        env::log_str(&format!("EVENT: atomic_caller_allowed caller={} by={}", caller, sender));
+        self.callers.insert(&caller);
+        Ok(())
+    }
+
+    pub fn remove_caller(&mut self, sender: &AccountId, caller: &AccountId) -> Result<(), String> {
+        self.assert_authority(sender)?;
+        if !self.callers.remove(caller) {
+            return Err(format!("{} is not an atomic caller", caller));
+        }
+        env::log_str(&format!("EVENT: atomic_caller_removed caller={} by={}", caller, sender));
+        Ok(())
+    }
+
+    pub fn is_allowed(&self, caller: &AccountId) -> bool {
+        self.callers.contains(caller)
+    }
+
+    pub fn get_callers(&self) -> Vec<AccountId> {
+        self.callers.to_vec()
+    }
+
+    /// Check a request from `caller` and assign it a call id
+    pub fn begin(&mut self, caller: &AccountId, request: &AtomicCallRequest) -> Result<AtomicExecution, String> {
+        if !self.is_allowed(caller) {
+            return Err(format!("{} may not make atomic calls", caller));
+        }
+        if request.messages.is_empty() || request.messages.len() > MAX_ATOMIC_MESSAGES {
+            return Err(format!("Atomic calls carry 1 to {} messages", MAX_ATOMIC_MESSAGES));
+        }
+        if request.callback.as_deref() == Some("") {
+            return Err("Callback method cannot be empty".to_string());
+        }
+        for (index, msg) in request.messages.iter().enumerate() {
+            validate_signer(&msg.value.0, caller).map_err(|e| format!("Message {}: {}", index, e))?;
+        }
+
+        let call_id = self.next_id;
+        self.next_id += 1;
+        env::log_str(&format!(
+            "EVENT: atomic_call_started call_id={} caller={} messages={}",
+            call_id, caller, request.messages.len()
+        ));
+        Ok(AtomicExecution { call_id, caller: caller.clone(), messages: request.messages.clone() })
+    }
+
+    /// Execute on this contract, then resolve on this contract
+    pub fn schedule(execution: &AtomicExecution, callback: Option<String>) -> Promise {
+        let this = env::current_account_id();
+        let execute_args = json!({ "execution": execution });
+        let resolve_args = json!({
+            "call_id": execution.call_id,
+            "caller": execution.caller,
+            "callback": callback,
+        });
+        Promise::new(this.clone())
+            .function_call("atomic_execute".to_string(), execute_args.to_string().into_bytes(), NearToken::from_yoctonear(0), ATOMIC_EXECUTE_GAS)
+            .then(Promise::new(this).function_call(
+                "on_atomic_call".to_string(),
+                resolve_args.to_string().into_bytes(),
+                NearToken::from_yoctonear(0),
+                ATOMIC_RESOLVE_GAS,
+            ))
+    }
+}
+
+/// Ensure every signer field of a message names `caller`
+fn validate_signer(value: &[u8], caller: &AccountId) -> Result<(), String> {
+    let msg: Value = serde_json::from_slice(value).map_err(|e| format!("not a JSON message: {}", e))?;
+
+    // Multi-send names its signers per input
+    let mut signers: Vec<(&str, &Value)> = SIGNER_FIELDS.iter()
+        .filter_map(|field| msg.get(*field).map(|signer| (*field, signer)))
+        .collect();
+    if let Some(inputs) = msg.get("inputs").and_then(Value::as_array) {
+        signers.extend(inputs.iter().map(|input| ("inputs.address", input.get("address").unwrap_or(&Value::Null))));
+    }
+
+    if signers.is_empty() {
+        return Err("message has no signer".to_string());
+    }
+    for (field, signer) in signers {
+        if signer.as_str() != Some(caller.as_str()) {
+            return Err(format!("{} must be the caller {}", field, caller));
+        }
+    }
+    Ok(())
+}
+
+/// Route the messages of an atomic call, stopping at the first failure
+///
+/// Messages before a failure have already changed state; the caller must
+/// abort the receipt with `AtomicFailure::abort` to roll them back.
+pub fn execute_atomic<T: CosmosMessageHandler>(handler: &mut T, execution: &AtomicExecution) -> Result<Vec<HandleResponse>, AtomicFailure> {
+    let mut responses = Vec::with_capacity(execution.messages.len());
+    for (index, msg) in execution.messages.iter().enumerate() {
+        let response = route_cosmos_message(handler, msg.type_url.clone(), msg.value.clone());
+        if response.code != ABCICode::OK {
+            return Err(AtomicFailure { call_id: execution.call_id, index, response });
+        }
+        responses.push(response);
+    }
+    env::log_str(&format!(
+        "EVENT: atomic_call_executed call_id={} caller={} messages={}",
+        execution.call_id, execution.caller, responses.len()
+    ));
+    Ok(responses)
+}
+
+/// Turn the outcome of `atomic_execute` into the caller's result, scheduling
+/// its callback
+pub fn resolve_atomic_call(call_id: u64, caller: &AccountId, callback: Option<String>, outcome: PromiseResult) -> AtomicCallResult {
+    let result = match outcome {
+        PromiseResult::Successful(bytes) => AtomicCallResult {
+            call_id,
+            committed: true,
+            responses: serde_json::from_slice(&bytes).unwrap_or_default(),
+        },
+        PromiseResult::Failed => AtomicCallResult { call_id, committed: false, responses: vec![] },
+    };
+    env::log_str(&format!(
+        "EVENT: atomic_call_{} call_id={} caller={}",
+        if result.committed { "committed" } else { "rolled_back" },
+        call_id,
+        caller
+    ));
+
+    if let Some(method) = callback {
+        let args = json!({ "result": result }).to_string().into_bytes();
+        Promise::new(caller.clone()).function_call(method, args, NearToken::from_yoctonear(0), ATOMIC_CALLBACK_GAS);
+    }
+    result
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::handler::msg_router::{success_result, ContractError, HandleResult, MessageResult};
+    use crate::types::cosmos_messages::*;
+    use near_sdk::test_utils::{get_logs, VMContextBuilder};
+    use near_sdk::testing_env;
+
+    /// Applies sends to a ledger and refuses every burn
+    #[derive(Default)]
+    struct Ledger {
+        sent: Vec<(String, String)>,
+    }
+
+    fn unsupported() -> MessageResult<HandleResult> {
+        Err(ContractError::Custom("unsupported".to_string()))
+    }
+
+    impl CosmosMessageHandler for Ledger {
+        fn handle_msg_send(&mut self, msg: MsgSend) -> MessageResult<HandleResult> {
+            self.sent.push((msg.from_address, msg.to_address));
+            Ok(success_result("sent", vec![]))
+        }
+        fn handle_msg_multi_send(&mut self, _msg: MsgMultiSend) -> MessageResult<HandleResult> { unsupported() }
+        fn handle_msg_burn(&mut self, _msg: MsgBurn) -> MessageResult<HandleResult> { Err(ContractError::InsufficientFunds) }
+        fn handle_msg_delegate(&mut self, _msg: MsgDelegate) -> MessageResult<HandleResult> { unsupported() }
+        fn handle_msg_undelegate(&mut self, _msg: MsgUndelegate) -> MessageResult<HandleResult> { unsupported() }
+        fn handle_msg_begin_redelegate(&mut self, _msg: MsgBeginRedelegate) -> MessageResult<HandleResult> { unsupported() }
+        fn handle_msg_create_validator(&mut self, _msg: MsgCreateValidator) -> MessageResult<HandleResult> { unsupported() }
+        fn handle_msg_edit_validator(&mut self, _msg: MsgEditValidator) -> MessageResult<HandleResult> { unsupported() }
+        fn handle_msg_submit_proposal(&mut self, _msg: MsgSubmitProposal) -> MessageResult<HandleResult> { unsupported() }
+        fn handle_msg_vote(&mut self, _msg: MsgVote) -> MessageResult<HandleResult> { unsupported() }
+        fn handle_msg_vote_weighted(&mut self, _msg: MsgVoteWeighted) -> MessageResult<HandleResult> { unsupported() }
+        fn handle_msg_deposit(&mut self, _msg: MsgDeposit) -> MessageResult<HandleResult> { unsupported() }
+        fn handle_msg_transfer(&mut self, _msg: MsgTransfer) -> MessageResult<HandleResult> { unsupported() }
+        fn handle_msg_channel_open_init(&mut self, _msg: MsgChannelOpenInit) -> MessageResult<HandleResult> { unsupported() }
+        fn handle_msg_channel_open_try(&mut self, _msg: MsgChannelOpenTry) -> MessageResult<HandleResult> { unsupported() }
+        fn handle_msg_recv_packet(&mut self, _msg: MsgRecvPacket) -> MessageResult<HandleResult> { unsupported() }
+        fn handle_msg_acknowledgement(&mut self, _msg: MsgAcknowledgement) -> MessageResult<HandleResult> { unsupported() }
+        fn handle_msg_timeout(&mut self, _msg: MsgTimeout) -> MessageResult<HandleResult> { unsupported() }
+    }
+
+    fn account(name: &str) -> AccountId {
+        name.parse().unwrap()
+    }
+
+    fn msg(type_url: &str, value: Value) -> AtomicMsg {
+        AtomicMsg { type_url: type_url.to_string(), value: Base64VecU8(value.to_string().into_bytes()) }
+    }
+
+    fn send(from: &str, to: &str) -> AtomicMsg {
+        msg(type_urls::MSG_SEND, json!({
+            "from_address": from,
+            "to_address": to,
+            "amount": [{ "denom": "near", "amount": "5" }],
+        }))
+    }
+
+    fn burn(from: &str) -> AtomicMsg {
+        msg(type_urls::MSG_BURN, json!({ "from_address": from, "amount": [{ "denom": "near", "amount": "5" }] }))
+    }
+
+    fn setup() -> AtomicCalls {
+        testing_env!(VMContextBuilder::new().current_account_id(account("sdk.near")).build());
+        let mut calls = AtomicCalls::new();
+        calls.allow_caller(&account("sdk.near"), account("dex.near")).unwrap();
+        calls
+    }
+
+    #[test]
+    fn test_requests_are_checked() {
+        let mut calls = setup();
+        let request = |messages| AtomicCallRequest { messages, callback: None };
+
+        assert!(calls.begin(&account("mallory.near"), &request(vec![send("mallory.near", "bob.near")])).is_err());
+        assert!(calls.begin(&account("dex.near"), &request(vec![])).is_err());
+        // A caller cannot act for anyone else
+        let error = calls.begin(&account("dex.near"), &request(vec![send("alice.near", "dex.near")])).unwrap_err();
+        assert_eq!(error, "Message 0: from_address must be the caller dex.near");
+        let multi_send = msg(type_urls::MSG_MULTI_SEND, json!({
+            "inputs": [{ "address": "dex.near", "coins": [] }, { "address": "alice.near", "coins": [] }],
+            "outputs": [],
+        }));
+        assert!(calls.begin(&account("dex.near"), &request(vec![multi_send])).is_err());
+
+        let execution = calls.begin(&account("dex.near"), &request(vec![send("dex.near", "bob.near")])).unwrap();
+        assert_eq!((execution.call_id, execution.messages.len()), (1, 1));
+        assert_eq!(calls.begin(&account("dex.near"), &request(vec![burn("dex.near")])).unwrap().call_id, 2);
+
+        assert!(calls.remove_caller(&account("dex.near"), &account("dex.near")).is_err());
+        calls.remove_caller(&account("sdk.near"), &account("dex.near")).unwrap();
+        assert!(calls.get_callers().is_empty());
+    }
+
+    #[test]
+    fn test_execution_stops_at_first_failure() {
+        let mut calls = setup();
+        let mut ledger = Ledger::default();
+        let request = AtomicCallRequest {
+            messages: vec![send("dex.near", "bob.near"), send("dex.near", "carol.near")],
+            callback: None,
+        };
+        let execution = calls.begin(&account("dex.near"), &request).unwrap();
+        assert_eq!(execute_atomic(&mut ledger, &execution).unwrap().len(), 2);
+
+        let request = AtomicCallRequest {
+            messages: vec![send("dex.near", "bob.near"), burn("dex.near"), send("dex.near", "carol.near")],
+            callback: None,
+        };
+        let execution = calls.begin(&account("dex.near"), &request).unwrap();
+        let failure = execute_atomic(&mut ledger, &execution).unwrap_err();
+        assert_eq!((failure.call_id, failure.index), (2, 1));
+        assert_ne!(failure.response.code, ABCICode::OK);
+        // The third message never ran
+        assert_eq!(ledger.sent.len(), 3);
+    }
+
+    #[test]
+    fn test_outcome_is_reported() {
+        setup();
+        let responses = vec![HandleResponse { code: 0, data: vec![], log: "sent".to_string(), events: vec![] }];
+        let outcome = PromiseResult::Successful(serde_json::to_vec(&responses).unwrap());
+        let result = resolve_atomic_call(4, &account("dex.near"), Some("on_result".to_string()), outcome);
+        assert_eq!(result, AtomicCallResult { call_id: 4, committed: true, responses });
+
+        let result = resolve_atomic_call(5, &account("dex.near"), None, PromiseResult::Failed);
+        assert!(!result.committed && result.responses.is_empty());
+        assert!(get_logs().iter().any(|log| log == "EVENT: atomic_call_rolled_back call_id=5 caller=dex.near"));
+    }
+}
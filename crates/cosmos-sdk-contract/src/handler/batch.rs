@@ -0,0 +1,254 @@
+/// Transaction Bundles
+///
+/// A relayer may bundle transactions from several signers into one NEAR
+/// call. Executing them in whatever order the relayer chose would let it
+/// slip its own transaction in ahead of a user's, so the handler orders the
+/// bundle itself under a configured `BatchOrdering`. Whatever the policy,
+/// each signer's transactions run in sequence order, and a bundle whose
+/// sequences skip or repeat a number for any signer is rejected before
+/// anything executes.
+
+use std::cmp::Ordering;
+use std::collections::BTreeMap;
+
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::serde::{Deserialize, Serialize};
+use schemars::JsonSchema;
+
+use crate::handler::tx_handler::{CosmosTransactionHandler, TxProcessingError, TxResponse};
+use crate::types::cosmos_tx::CosmosTx;
+
+/// Most transactions a single bundle may carry
+pub const MAX_BUNDLE_TXS: usize = 64;
+
+/// Execution order of a bundle across signers
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Copy, Debug, PartialEq, Eq, Default, JsonSchema)]
+pub enum BatchOrdering {
+    /// Relayer's order across signers
+    #[default]
+    Submitted,
+    /// Signer by signer, ordered by signer key, so the relayer's order has
+    /// no effect
+    BySigner,
+    /// Highest fee per unit of gas first, ties broken by signer key
+    FeePriority,
+}
+
+/// Result of one bundled transaction
+#[derive(Clone, Debug, PartialEq, Serialize, Deserialize)]
+pub struct BundledTxResult {
+    /// Position of the transaction in the submitted bundle
+    pub index: u32,
+    /// Hex public key of the first signer, or the fee payer without one
+    pub signer: String,
+    pub sequence: u64,
+    pub response: TxResponse,
+}
+
+/// Key the bundle groups a transaction's signer under
+fn signer_key(tx: &CosmosTx) -> Option<String> {
+    let signer = tx.auth_info.signer_infos.first()?;
+    match &signer.public_key {
+        Some(key) => Some(hex::encode(&key.value)),
+        None => Some(tx.auth_info.fee.payer.clone()).filter(|payer| !payer.is_empty()),
+    }
+}
+
+/// Fee summed over denoms, bundles normally pay in a single one
+fn fee_amount(tx: &CosmosTx) -> u128 {
+    tx.auth_info.fee.amount.iter()
+        .filter_map(|coin| coin.amount.parse::<u128>().ok())
+        .fold(0u128, |total, amount| total.saturating_add(amount))
+}
+
+/// Compare fee per gas without dividing: a/x > b/y iff a*y > b*x
+fn compare_fee_per_gas(a: &CosmosTx, b: &CosmosTx) -> Ordering {
+    let a_weighted = fee_amount(a).saturating_mul(b.auth_info.fee.gas_limit.max(1) as u128);
+    let b_weighted = fee_amount(b).saturating_mul(a.auth_info.fee.gas_limit.max(1) as u128);
+    a_weighted.cmp(&b_weighted)
+}
+
+/// Execution order of a bundle as indices into `txs`
+///
+/// The policy decides which signer runs in each slot; a signer's slots are
+/// then filled with its transactions in sequence order.
+pub fn order_bundle(txs: &[CosmosTx], ordering: BatchOrdering) -> Result<Vec<usize>, TxProcessingError> {
+    if txs.len() > MAX_BUNDLE_TXS {
+        return Err(TxProcessingError::InvalidState(
+            format!("Bundle carries {} transactions, at most {} allowed", txs.len(), MAX_BUNDLE_TXS)
+        ));
+    }
+
+    let mut signers = Vec::with_capacity(txs.len());
+    let mut by_signer: BTreeMap<String, Vec<usize>> = BTreeMap::new();
+    for (index, tx) in txs.iter().enumerate() {
+        let signer = signer_key(tx).ok_or_else(|| TxProcessingError::InvalidState(
+            format!("Bundled transaction {} names no signer", index)
+        ))?;
+        by_signer.entry(signer.clone()).or_default().push(index);
+        signers.push(signer);
+    }
+
+    // Each signer's sequences must run on without gaps or repeats
+    for (signer, indices) in by_signer.iter_mut() {
+        indices.sort_by_key(|index| txs[*index].auth_info.signer_infos[0].sequence);
+        for pair in indices.windows(2) {
+            let previous = txs[pair[0]].auth_info.signer_infos[0].sequence;
+            let next = txs[pair[1]].auth_info.signer_infos[0].sequence;
+            if next != previous + 1 {
+                return Err(TxProcessingError::InvalidState(format!(
+                    "Bundle sequences for signer {} jump from {} to {}", signer, previous, next
+                )));
+            }
+        }
+    }
+
+    let mut slots: Vec<usize> = (0..txs.len()).collect();
+    match ordering {
+        BatchOrdering::Submitted => {}
+        BatchOrdering::BySigner => slots.sort_by(|a, b| signers[*a].cmp(&signers[*b])),
+        BatchOrdering::FeePriority => slots.sort_by(|a, b| {
+            compare_fee_per_gas(&txs[*b], &txs[*a]).then_with(|| signers[*a].cmp(&signers[*b]))
+        }),
+    }
+
+    let mut next_of_signer: BTreeMap<&str, usize> = BTreeMap::new();
+    Ok(slots.into_iter()
+        .map(|slot| {
+            let signer = signers[slot].as_str();
+            let position = next_of_signer.entry(signer).or_insert(0);
+            *position += 1;
+            by_signer[signer][*position - 1]
+        })
+        .collect())
+}
+
+impl CosmosTransactionHandler {
+    /// Execute a relayer bundle through the contract's message router
+    ///
+    /// The whole bundle is rejected if it cannot be ordered. Otherwise each
+    /// transaction gets a result in execution order; once one of a signer's
+    /// transactions fails, its later ones are skipped since their sequences
+    /// can no longer match.
+    pub fn process_transaction_batch<T>(
+        &mut self,
+        raw_txs: Vec<Vec<u8>>,
+        contract: &mut T,
+    ) -> Result<Vec<BundledTxResult>, TxProcessingError>
+    where
+        T: crate::handler::CosmosMessageHandler,
+    {
+        self.execute_bundle(raw_txs, |handler, raw_tx| handler.process_transaction(raw_tx, contract))
+    }
+
+    /// Execute a bundle without a contract, as `process_cosmos_transaction`
+    pub fn process_cosmos_transaction_batch(
+        &mut self,
+        raw_txs: Vec<Vec<u8>>,
+    ) -> Result<Vec<BundledTxResult>, TxProcessingError> {
+        self.execute_bundle(raw_txs, |handler, raw_tx| handler.process_cosmos_transaction(raw_tx))
+    }
+
+    fn execute_bundle<F>(&mut self, raw_txs: Vec<Vec<u8>>, mut execute: F) -> Result<Vec<BundledTxResult>, TxProcessingError>
+    where
+        F: FnMut(&mut Self, Vec<u8>) -> Result<TxResponse, TxProcessingError>,
+    {
+        let txs = raw_txs.iter()
+            .map(|raw_tx| self.tx_decoder.decode_cosmos_tx(raw_tx.clone()))
+            .collect::<Result<Vec<CosmosTx>, _>>()?;
+        let order = order_bundle(&txs, self.batch_ordering())?;
+
+        let mut failed_signers: Vec<String> = Vec::new();
+        let mut results = Vec::with_capacity(order.len());
+        for index in order {
+            let tx = &txs[index];
+            let signer = signer_key(tx).unwrap_or_default();
+            let response = if failed_signers.contains(&signer) {
+                TxResponse::error(
+                    TxProcessingError::InvalidState("Skipped after an earlier transaction of the signer failed".to_string()),
+                    Some(tx.hash()),
+                )
+            } else {
+                execute(self, raw_txs[index].clone())
+                    .unwrap_or_else(|error| TxResponse::error(error, Some(tx.hash())))
+            };
+            if !response.is_success() && !failed_signers.contains(&signer) {
+                failed_signers.push(signer.clone());
+            }
+            results.push(BundledTxResult {
+                index: index as u32,
+                signer,
+                sequence: tx.auth_info.signer_infos[0].sequence,
+                response,
+            });
+        }
+        Ok(results)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::handler::tx_handler::TxProcessingConfig;
+    use crate::types::cosmos_tx::{Any, AuthInfo, Coin, Fee, ModeInfo, SignMode, SignerInfo, TxBody};
+
+    fn bundled_tx(signer: u8, sequence: u64, fee: &str) -> CosmosTx {
+        let body = TxBody::new(vec![Any::new("/cosmos.bank.v1beta1.MsgSend", vec![signer])]);
+        let signer_info = SignerInfo {
+            public_key: Some(Any::new("/cosmos.crypto.secp256k1.PubKey", vec![signer; 33])),
+            mode_info: ModeInfo { mode: SignMode::Direct, multi: None },
+            sequence,
+        };
+        let auth_info = AuthInfo::new(vec![signer_info], Fee::new(vec![Coin::new("unear", fee)], 200_000));
+        CosmosTx::new(body, auth_info, vec![vec![0u8; 65]])
+    }
+
+    #[test]
+    fn test_order_keeps_signer_sequences() {
+        // Relayer put signer 1's sequence 4 ahead of its sequence 3
+        let txs = vec![
+            bundled_tx(1, 4, "1000000"),
+            bundled_tx(2, 0, "1000000"),
+            bundled_tx(1, 3, "1000000"),
+        ];
+        assert_eq!(order_bundle(&txs, BatchOrdering::Submitted).unwrap(), vec![2, 1, 0]);
+        assert_eq!(order_bundle(&txs, BatchOrdering::BySigner).unwrap(), vec![2, 0, 1]);
+    }
+
+    #[test]
+    fn test_fee_priority_is_independent_of_submission() {
+        let txs = vec![
+            bundled_tx(1, 0, "1000"),
+            bundled_tx(2, 0, "5000"),
+            bundled_tx(3, 0, "5000"),
+        ];
+        let reversed: Vec<CosmosTx> = txs.iter().rev().cloned().collect();
+        assert_eq!(order_bundle(&txs, BatchOrdering::FeePriority).unwrap(), vec![1, 2, 0]);
+        assert_eq!(order_bundle(&reversed, BatchOrdering::FeePriority).unwrap(), vec![1, 0, 2]);
+    }
+
+    #[test]
+    fn test_bundle_sequence_gaps_rejected() {
+        let gap = vec![bundled_tx(1, 0, "1000"), bundled_tx(1, 2, "1000")];
+        let repeat = vec![bundled_tx(1, 0, "1000"), bundled_tx(1, 0, "1000")];
+        assert!(matches!(order_bundle(&gap, BatchOrdering::Submitted), Err(TxProcessingError::InvalidState(_))));
+        assert!(matches!(order_bundle(&repeat, BatchOrdering::BySigner), Err(TxProcessingError::InvalidState(_))));
+    }
+
+    #[test]
+    fn test_process_bundle() {
+        let mut handler = CosmosTransactionHandler::new(TxProcessingConfig {
+            verify_signatures: false,
+            ..TxProcessingConfig::default()
+        });
+        handler.set_batch_ordering(BatchOrdering::BySigner);
+        let raw_txs = vec![
+            serde_json::to_vec(&bundled_tx(2, 0, "1000000")).unwrap(),
+            serde_json::to_vec(&bundled_tx(1, 0, "1000000")).unwrap(),
+        ];
+
+        let results = handler.process_cosmos_transaction_batch(raw_txs).unwrap();
+        assert_eq!(results.iter().map(|result| result.index).collect::<Vec<_>>(), vec![1, 0]);
+        assert!(results.iter().all(|result| result.response.is_success()));
+    }
+}
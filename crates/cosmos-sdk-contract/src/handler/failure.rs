@@ -0,0 +1,184 @@
+/// Failure Events
+///
+/// A rejected call on NEAR only leaves a panic string such as
+/// `Smart contract panicked: Insufficient funds`, which front-ends end up
+/// pattern matching. Before rejecting a message the contract logs a NEP-297
+/// `tx_failed` event instead, carrying the message type, the ABCI code and
+/// codespace a Cosmos client expects, and the field that was rejected:
+///
+/// `EVENT_JSON:{"standard":"cosmos_sdk","version":"1.0.0","event":"tx_failed","data":[{"msg_type":"/cosmos.bank.v1beta1.MsgSend","code":5,"codespace":"sdk","field":"amount","message":"Insufficient funds"}]}`
+///
+/// Logs of a receipt that panics are still returned with its outcome, so
+/// the event is visible even though the call aborted.
+
+use near_sdk::env;
+use near_sdk::serde::{Deserialize, Serialize};
+use near_sdk::serde_json::json;
+use schemars::JsonSchema;
+
+use crate::handler::{ABCICode, ContractError, TxProcessingError};
+use crate::types::cosmos_tx::TxValidationError;
+
+pub const FAILURE_EVENT_STANDARD: &str = "cosmos_sdk";
+pub const FAILURE_EVENT_VERSION: &str = "1.0.0";
+pub const FAILURE_EVENT: &str = "tx_failed";
+
+/// Why a message was rejected
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct FailureEvent {
+    /// Type URL of the rejected message, or the entrypoint name
+    pub msg_type: String,
+    /// ABCI code, see `ABCICode`
+    pub code: u32,
+    pub codespace: String,
+    /// Offending field of the message, when one can be named
+    pub field: Option<String>,
+    pub message: String,
+}
+
+impl FailureEvent {
+    pub fn new(msg_type: &str, code: u32, message: impl Into<String>) -> Self {
+        Self {
+            msg_type: msg_type.to_string(),
+            code,
+            codespace: "sdk".to_string(),
+            field: None,
+            message: message.into(),
+        }
+    }
+
+    pub fn with_field(mut self, field: &str) -> Self {
+        self.field = Some(field.to_string());
+        self
+    }
+
+    pub fn with_codespace(mut self, codespace: &str) -> Self {
+        self.codespace = codespace.to_string();
+        self
+    }
+
+    /// Failure of a message handler
+    pub fn from_contract_error(msg_type: &str, error: &ContractError) -> Self {
+        let event = Self::new(msg_type, error.code(), error.to_string());
+        match error.field() {
+            Some(field) => event.with_field(field),
+            None => event,
+        }
+    }
+
+    /// Failure of a whole Cosmos transaction
+    pub fn from_tx_error(msg_type: &str, error: &TxProcessingError) -> Self {
+        let event = Self::new(msg_type, ABCICode::from_error(error), error.to_string());
+        let field = match error {
+            TxProcessingError::MessageProcessingError(error) => {
+                return Self::from_contract_error(msg_type, error).with_codespace("app");
+            }
+            TxProcessingError::MessageExecution(_) => return event.with_codespace("app"),
+            TxProcessingError::SignatureError(_) => Some("signatures"),
+            TxProcessingError::ValidationError(error) => match error {
+                TxValidationError::SignatureMismatch { .. } => Some("signatures"),
+                TxValidationError::EmptyTypeUrl => Some("type_url"),
+                TxValidationError::InvalidGasLimit => Some("gas_limit"),
+                TxValidationError::EmptyDenomination => Some("denom"),
+                TxValidationError::InvalidAmount(_) => Some("amount"),
+                TxValidationError::SerializationError(_) => None,
+            },
+            TxProcessingError::FeeError(_) => Some("fee"),
+            TxProcessingError::GasLimitExceeded { .. } => Some("gas_limit"),
+            TxProcessingError::SequenceMismatch { .. } => Some("sequence"),
+            _ => None,
+        };
+        match field {
+            Some(field) => event.with_field(field),
+            None => event,
+        }
+    }
+
+    /// Log the event as NEP-297 JSON
+    pub fn emit(&self) {
+        let event = json!({
+            "standard": FAILURE_EVENT_STANDARD,
+            "version": FAILURE_EVENT_VERSION,
+            "event": FAILURE_EVENT,
+            "data": [self],
+        });
+        env::log_str(&format!("EVENT_JSON:{}", event));
+    }
+
+    /// Emit the event, then abort the call with its message
+    pub fn abort(&self) -> ! {
+        self.emit();
+        env::panic_str(&format!("{} (code {}): {}", self.msg_type, self.code, self.message))
+    }
+}
+
+impl ContractError {
+    /// ABCI code reported for the error
+    pub fn code(&self) -> u32 {
+        match self {
+            ContractError::UnknownMessageType(_) => ABCICode::UNKNOWN_REQUEST,
+            ContractError::InvalidMessageFormat(_) => ABCICode::INVALID_REQUEST,
+            ContractError::InvalidField { .. } => ABCICode::INVALID_REQUEST,
+            ContractError::DecodeError(_) => ABCICode::TX_DECODE_ERROR,
+            ContractError::InsufficientFunds => ABCICode::INSUFFICIENT_FUNDS,
+            ContractError::Unauthorized => ABCICode::UNAUTHORIZED,
+            ContractError::InvalidAddress => ABCICode::INVALID_ADDRESS,
+            ContractError::Custom(_) => ABCICode::INTERNAL_ERROR,
+        }
+    }
+
+    /// Message field the error is about
+    pub fn field(&self) -> Option<&str> {
+        match self {
+            ContractError::UnknownMessageType(_) => Some("type_url"),
+            ContractError::InvalidField { field, .. } => Some(field),
+            ContractError::InsufficientFunds => Some("amount"),
+            _ => None,
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use near_sdk::test_utils::get_logs;
+
+    #[test]
+    fn test_event_carries_code_and_field() {
+        let error = ContractError::InvalidField {
+            field: "to_address".to_string(),
+            reason: "not bech32".to_string(),
+        };
+        FailureEvent::from_contract_error("/cosmos.bank.v1beta1.MsgSend", &error).emit();
+
+        let log = get_logs().pop().unwrap();
+        let json: near_sdk::serde_json::Value = near_sdk::serde_json::from_str(
+            log.strip_prefix("EVENT_JSON:").unwrap()
+        ).unwrap();
+        assert_eq!(json["standard"], FAILURE_EVENT_STANDARD);
+        assert_eq!(json["event"], FAILURE_EVENT);
+        assert_eq!(json["data"][0]["msg_type"], "/cosmos.bank.v1beta1.MsgSend");
+        assert_eq!(json["data"][0]["code"], ABCICode::INVALID_REQUEST);
+        assert_eq!(json["data"][0]["field"], "to_address");
+        assert_eq!(json["data"][0]["message"], "Invalid to_address: not bech32");
+    }
+
+    #[test]
+    fn test_tx_errors_name_their_field() {
+        let error = TxProcessingError::SequenceMismatch { expected: 4, actual: 3 };
+        let event = FailureEvent::from_tx_error("tx", &error);
+        assert_eq!(event.code, ABCICode::INVALID_SEQUENCE);
+        assert_eq!(event.field.as_deref(), Some("sequence"));
+
+        let error = TxProcessingError::MessageProcessingError(ContractError::InsufficientFunds);
+        let event = FailureEvent::from_tx_error("/cosmos.bank.v1beta1.MsgSend", &error);
+        assert_eq!((event.code, event.codespace.as_str()), (ABCICode::INSUFFICIENT_FUNDS, "app"));
+        assert_eq!(event.field.as_deref(), Some("amount"));
+    }
+
+    #[test]
+    #[should_panic(expected = "/cosmos.staking.v1beta1.MsgDelegate (code 4): Unauthorized")]
+    fn test_abort_panics_with_code() {
+        FailureEvent::from_contract_error("/cosmos.staking.v1beta1.MsgDelegate", &ContractError::Unauthorized).abort();
+    }
+}
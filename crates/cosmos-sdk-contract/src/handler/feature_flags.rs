@@ -0,0 +1,158 @@
+/// Module Feature Flags
+///
+/// Lets governance or the admin switch off every mutating message of a
+/// module, e.g. governance during a state migration or IBC while a client is
+/// frozen. The Msg router checks the flag before decoding a message, so a
+/// disabled module never sees it. Queries are not affected.
+
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::collections::UnorderedMap;
+use near_sdk::serde::{Deserialize, Serialize};
+use near_sdk::{env, AccountId};
+
+use crate::types::Authority;
+
+/// Modules that can be disabled
+pub const MODULES: [&str; 4] = ["bank", "staking", "gov", "ibc"];
+
+/// Record of why and by whom a module was disabled
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq)]
+pub struct DisabledModule {
+    pub module: String,
+    pub reason: String,
+    pub disabled_by: String,
+    pub height: u64,
+}
+
+/// Module that handles messages of the given type URL
+pub fn module_for_type_url(type_url: &str) -> Option<&'static str> {
+    if type_url.starts_with("/ibc.") {
+        return Some("ibc");
+    }
+    let module = type_url.strip_prefix("/cosmos.")?.split('.').next()?;
+    MODULES.iter().copied().find(|known| *known == module)
+}
+
+#[derive(BorshDeserialize, BorshSerialize)]
+pub struct FeatureFlags {
+    admin: AccountId,
+    /// Governance account; defaults to this contract
+    authority: Authority,
+    disabled: UnorderedMap<String, DisabledModule>,
+}
+
+impl FeatureFlags {
+    pub fn new(admin: AccountId) -> Self {
+        Self {
+            admin,
+            authority: Authority::default(),
+            disabled: UnorderedMap::new(b"feature_flags".to_vec()),
+        }
+    }
+
+    /// Account that governance acts through
+    pub fn authority(&self) -> AccountId {
+        self.authority.account()
+    }
+
+    pub fn set_authority(&mut self, sender: &AccountId, new_authority: AccountId) -> Result<(), String> {
+        self.authority.transfer(sender, new_authority)
+    }
+
+    fn assert_can_toggle(&self, sender: &AccountId) -> Result<(), String> {
+        if sender != &self.admin && sender != &self.authority() {
+            return Err("Only the admin or governance can change feature flags".to_string());
+        }
+        Ok(())
+    }
+
+    pub fn disable_module(&mut self, sender: &AccountId, module: &str, reason: String) -> Result<(), String> {
+        self.assert_can_toggle(sender)?;
+        if !MODULES.contains(&module) {
+            return Err(format!("Unknown module {}", module));
+        }
+
+        self.disabled.insert(&module.to_string(), &DisabledModule {
+            module: module.to_string(),
+            reason: reason.clone(),
+            disabled_by: sender.to_string(),
+            height: env::block_height(),
+        });
+        env::log_str(&format!("EVENT: module_disabled module={} by={} reason={}", module, sender, reason));
+        Ok(())
+    }
+
+    /// Disable a module from contract logic rather than an account, e.g.
+    /// when the block watchdog finds a broken invariant. Only the admin or
+    /// governance can enable it again. A module that is already disabled
+    /// keeps its original reason.
+    pub fn trip(&mut self, module: &str, tripped_by: &str, reason: String) {
+        if !self.is_enabled(module) {
+            return;
+        }
+        self.disabled.insert(&module.to_string(), &DisabledModule {
+            module: module.to_string(),
+            reason: reason.clone(),
+            disabled_by: tripped_by.to_string(),
+            height: env::block_height(),
+        });
+        env::log_str(&format!("EVENT: module_disabled module={} by={} reason={}", module, tripped_by, reason));
+    }
+
+    pub fn enable_module(&mut self, sender: &AccountId, module: &str) -> Result<(), String> {
+        self.assert_can_toggle(sender)?;
+        if self.disabled.remove(&module.to_string()).is_none() {
+            return Err(format!("Module {} is not disabled", module));
+        }
+
+        env::log_str(&format!("EVENT: module_enabled module={} by={}", module, sender));
+        Ok(())
+    }
+
+    pub fn is_enabled(&self, module: &str) -> bool {
+        self.disabled.get(&module.to_string()).is_none()
+    }
+
+    pub fn disabled_modules(&self) -> Vec<DisabledModule> {
+        self.disabled.values().collect()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::types::cosmos_messages::type_urls;
+
+    fn account(name: &str) -> AccountId {
+        name.parse().unwrap()
+    }
+
+    #[test]
+    fn test_module_for_type_url() {
+        assert_eq!(module_for_type_url(type_urls::MSG_SEND), Some("bank"));
+        assert_eq!(module_for_type_url(type_urls::MSG_DELEGATE), Some("staking"));
+        assert_eq!(module_for_type_url(type_urls::MSG_VOTE), Some("gov"));
+        assert_eq!(module_for_type_url(type_urls::MSG_TRANSFER), Some("ibc"));
+        assert_eq!(module_for_type_url(type_urls::MSG_TIMEOUT), Some("ibc"));
+        assert_eq!(module_for_type_url("/cosmos.unknown.v1.Msg"), None);
+    }
+
+    #[test]
+    fn test_disable_and_enable() {
+        let admin = account("admin.near");
+        let mut flags = FeatureFlags::new(admin.clone());
+
+        assert!(flags.disable_module(&account("mallory.near"), "gov", "migration".to_string()).is_err());
+        assert!(flags.disable_module(&admin, "nft", "unknown".to_string()).is_err());
+
+        flags.disable_module(&admin, "gov", "migration".to_string()).unwrap();
+        assert!(!flags.is_enabled("gov"));
+        assert!(flags.is_enabled("bank"));
+        assert_eq!(flags.disabled_modules()[0].reason, "migration");
+
+        // Governance can lift the flag as well
+        flags.enable_module(&flags.authority(), "gov").unwrap();
+        assert!(flags.is_enabled("gov"));
+        assert!(flags.enable_module(&admin, "gov").is_err());
+    }
+}
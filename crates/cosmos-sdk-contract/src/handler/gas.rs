@@ -0,0 +1,164 @@
+/// Gas Schedule
+///
+/// Gas costs are kept in a versioned table instead of constants in the
+/// transaction handler. Governance stores the table as the `gas_schedule`
+/// parameter; a new table must carry a higher version than the active one,
+/// so every node switches to the same costs at the height the proposal
+/// executes and replaying a block always uses the table it was charged with.
+
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::serde::{Deserialize, Serialize};
+use schemars::JsonSchema;
+
+use crate::handler::tx_handler::TxProcessingError;
+
+/// Governance parameter holding the JSON encoded schedule
+pub const GAS_SCHEDULE_PARAM: &str = "gas_schedule";
+
+/// Cost of each metered operation
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct GasSchedule {
+    pub version: u32,
+    /// Charged once per transaction
+    pub tx_base: u64,
+    pub per_message: u64,
+    pub per_event: u64,
+    /// Per byte of message response data
+    pub per_data_byte: u64,
+    pub read_flat: u64,
+    pub read_per_byte: u64,
+    pub write_flat: u64,
+    pub write_per_byte: u64,
+    /// Per signature checked
+    pub signature_verify: u64,
+    pub hash_per_byte: u64,
+}
+
+impl Default for GasSchedule {
+    fn default() -> Self {
+        Self {
+            version: 1,
+            tx_base: 21_000,
+            per_message: 5_000,
+            per_event: 500,
+            per_data_byte: 10,
+            read_flat: 1_000,
+            read_per_byte: 3,
+            write_flat: 2_000,
+            write_per_byte: 30,
+            signature_verify: 1_000,
+            hash_per_byte: 1,
+        }
+    }
+}
+
+impl GasSchedule {
+    pub fn from_json(json: &str) -> Result<Self, String> {
+        serde_json::from_str(json).map_err(|e| format!("Invalid gas schedule: {}", e))
+    }
+
+    pub fn to_json(&self) -> String {
+        serde_json::to_string(self).expect("Gas schedule serializes")
+    }
+
+    /// Check that `self` may replace `active`
+    pub fn validate_upgrade(&self, active: &GasSchedule) -> Result<(), String> {
+        if self.version <= active.version {
+            return Err(format!(
+                "Gas schedule version {} must be greater than the active version {}",
+                self.version, active.version
+            ));
+        }
+        if self.tx_base == 0 {
+            return Err("Gas schedule tx_base must be positive".to_string());
+        }
+        Ok(())
+    }
+}
+
+/// Tracks gas consumed by a transaction against its limit
+#[derive(Clone, Debug)]
+pub struct GasMeter {
+    limit: u64,
+    consumed: u64,
+    schedule: GasSchedule,
+}
+
+impl GasMeter {
+    pub fn new(limit: u64, schedule: GasSchedule) -> Self {
+        Self { limit, consumed: 0, schedule }
+    }
+
+    pub fn schedule(&self) -> &GasSchedule {
+        &self.schedule
+    }
+
+    pub fn consumed(&self) -> u64 {
+        self.consumed
+    }
+
+    pub fn limit(&self) -> u64 {
+        self.limit
+    }
+
+    pub fn remaining(&self) -> u64 {
+        self.limit.saturating_sub(self.consumed)
+    }
+
+    /// Charge `amount`; past the limit the meter stays at the limit
+    pub fn consume(&mut self, amount: u64) -> Result<(), TxProcessingError> {
+        let used = self.consumed.saturating_add(amount);
+        if used > self.limit {
+            self.consumed = self.limit;
+            return Err(TxProcessingError::GasLimitExceeded { limit: self.limit, used });
+        }
+        self.consumed = used;
+        Ok(())
+    }
+
+    pub fn consume_read(&mut self, bytes: usize) -> Result<(), TxProcessingError> {
+        self.consume(self.schedule.read_flat.saturating_add(self.schedule.read_per_byte.saturating_mul(bytes as u64)))
+    }
+
+    pub fn consume_write(&mut self, bytes: usize) -> Result<(), TxProcessingError> {
+        self.consume(self.schedule.write_flat.saturating_add(self.schedule.write_per_byte.saturating_mul(bytes as u64)))
+    }
+
+    pub fn consume_signature_verify(&mut self) -> Result<(), TxProcessingError> {
+        self.consume(self.schedule.signature_verify)
+    }
+
+    pub fn consume_hash(&mut self, bytes: usize) -> Result<(), TxProcessingError> {
+        self.consume(self.schedule.hash_per_byte.saturating_mul(bytes as u64))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_meter_charges_schedule_costs() {
+        let schedule = GasSchedule { read_flat: 10, read_per_byte: 2, ..GasSchedule::default() };
+        let mut meter = GasMeter::new(100, schedule);
+
+        meter.consume_read(5).unwrap();
+        assert_eq!(meter.consumed(), 20);
+        assert_eq!(meter.remaining(), 80);
+
+        let result = meter.consume_read(50);
+        assert_eq!(result, Err(TxProcessingError::GasLimitExceeded { limit: 100, used: 130 }));
+        assert_eq!(meter.consumed(), 100);
+    }
+
+    #[test]
+    fn test_upgrade_requires_higher_version() {
+        let active = GasSchedule::default();
+        let same = GasSchedule { write_per_byte: 50, ..GasSchedule::default() };
+        assert!(same.validate_upgrade(&active).is_err());
+
+        let next = GasSchedule { version: 2, ..same };
+        assert!(next.validate_upgrade(&active).is_ok());
+        assert_eq!(GasSchedule::from_json(&next.to_json()), Ok(next));
+    }
+}
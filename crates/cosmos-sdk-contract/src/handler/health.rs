@@ -0,0 +1,115 @@
+/// Module Health
+///
+/// Readiness summary for monitoring dashboards and the relayer's pre-flight
+/// checks: which modules are initialized and enabled, whether a migration is
+/// waiting to be applied, which IBC clients can no longer be updated, and the
+/// last block the chain processed. The report is healthy when every module
+/// is initialized and running and no client is frozen.
+
+use near_sdk::serde::{Deserialize, Serialize};
+use schemars::JsonSchema;
+
+use crate::handler::feature_flags::{FeatureFlags, MODULES};
+use crate::modules::block::BlockModule;
+use crate::modules::gov::{default_parameters, GovernanceModule};
+use crate::modules::ibc::client::tendermint::TendermintLightClientModule;
+
+/// Status of a single module
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct ModuleHealth {
+    pub module: String,
+    pub initialized: bool,
+    /// Disabled through a feature flag
+    pub paused: bool,
+    /// IBC clients whose trust period expired, only reported for `ibc`
+    #[serde(default)]
+    pub frozen_clients: Vec<String>,
+}
+
+impl ModuleHealth {
+    pub fn is_healthy(&self) -> bool {
+        self.initialized && !self.paused && self.frozen_clients.is_empty()
+    }
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct HealthReport {
+    pub healthy: bool,
+    pub modules: Vec<ModuleHealth>,
+    /// Upgrades approved by governance but not applied yet, and parameters
+    /// the state is missing a value for
+    pub pending_migrations: Vec<String>,
+    /// Height of the last committed block, 0 before the first one
+    pub last_height: u64,
+    /// Time of the last committed block in nanoseconds
+    pub last_time: u64,
+}
+
+impl HealthReport {
+    /// Build the report from module state; `initialized` lists the modules
+    /// set up at genesis or registered since
+    pub fn collect(
+        initialized: &[String],
+        flags: &FeatureFlags,
+        gov: &GovernanceModule,
+        clients: &TendermintLightClientModule,
+        blocks: &BlockModule,
+    ) -> Self {
+        let modules: Vec<ModuleHealth> = MODULES.iter()
+            .map(|module| ModuleHealth {
+                module: module.to_string(),
+                initialized: initialized.iter().any(|name| name == module),
+                paused: !flags.is_enabled(module),
+                frozen_clients: if *module == "ibc" { clients.expired_clients() } else { Vec::new() },
+            })
+            .collect();
+        let pending_migrations: Vec<String> = gov.get_pending_upgrade()
+            .into_iter()
+            .map(|plan| plan.name)
+            .chain(gov.missing_parameters(&default_parameters()).into_iter().map(|key| format!("param {}", key)))
+            .collect();
+        let (last_height, last_time) = blocks.latest_block()
+            .map_or((0, 0), |header| (header.height, header.time));
+
+        Self {
+            healthy: modules.iter().all(ModuleHealth::is_healthy) && pending_migrations.is_empty(),
+            modules,
+            pending_migrations,
+            last_height,
+            last_time,
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use near_sdk::test_utils::VMContextBuilder;
+    use near_sdk::{env, testing_env, AccountId};
+
+    #[test]
+    fn test_report_flags_paused_and_missing_modules() {
+        testing_env!(VMContextBuilder::new().block_height(12).block_timestamp(5_000).build());
+        let admin: AccountId = "admin.near".parse().unwrap();
+        let mut flags = FeatureFlags::new(admin.clone());
+        let gov = GovernanceModule::new();
+        let clients = TendermintLightClientModule::new();
+        let mut blocks = BlockModule::new("proxima-testnet".to_string());
+        let all: Vec<String> = MODULES.iter().map(|module| module.to_string()).collect();
+
+        let report = HealthReport::collect(&all, &flags, &gov, &clients, &blocks);
+        assert!(report.healthy);
+        assert_eq!(report.last_height, 0);
+
+        blocks.commit_block(&[], &[]).unwrap();
+        flags.disable_module(&admin, "ibc", "client migration".to_string()).unwrap();
+        let report = HealthReport::collect(&all[..3], &flags, &gov, &clients, &blocks);
+        assert!(!report.healthy);
+        assert_eq!((report.last_height, report.last_time), (env::block_height(), env::block_timestamp()));
+
+        let ibc = report.modules.iter().find(|module| module.module == "ibc").unwrap();
+        assert!(ibc.paused);
+        assert!(!ibc.initialized);
+        assert!(report.modules.iter().filter(|module| module.module != "ibc").all(ModuleHealth::is_healthy));
+    }
+}
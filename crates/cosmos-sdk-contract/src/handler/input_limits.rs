@@ -0,0 +1,252 @@
+/// Input Limits
+///
+/// A message is decoded straight into its typed struct, so an oversized
+/// payload or a list of a million coins is only noticed once decoding or the
+/// handler has burnt through the call's gas, and the caller gets a bare gas
+/// exhaustion instead of a reason. `InputLimits::check` runs before any typed
+/// decoding: it bounds the raw size per entrypoint, requires UTF-8, then
+/// walks the generic JSON tree and bounds nesting, string lengths and list
+/// lengths. Each violation is an `InputError` naming the offending field.
+///
+/// Governance sets the limits through the `input_limits` parameter.
+/// Entrypoints that legitimately carry large inputs, such as IBC packets
+/// with their proofs, get their own size and list limits.
+
+use near_sdk::serde::{Deserialize, Serialize};
+use near_sdk::serde_json::{self, Value};
+use schemars::JsonSchema;
+
+use crate::handler::failure::FailureEvent;
+use crate::handler::ABCICode;
+use crate::types::cosmos_messages::type_urls;
+
+/// Governance parameter holding the JSON encoded limits
+pub const INPUT_LIMITS_PARAM: &str = "input_limits";
+
+/// Limits replacing the defaults for one entrypoint
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct EntrypointLimit {
+    /// Message type URL or contract method name
+    pub entrypoint: String,
+    pub max_bytes: u32,
+    /// List length limit for this entrypoint, the default when unset
+    #[serde(default)]
+    pub max_list_len: Option<u32>,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct InputLimits {
+    /// Raw size of an input
+    pub max_bytes: u32,
+    /// Nesting of JSON objects and arrays
+    pub max_depth: u32,
+    /// Bytes in a single JSON string
+    pub max_string_len: u32,
+    /// Elements in a single JSON array
+    pub max_list_len: u32,
+    #[serde(default)]
+    pub entrypoints: Vec<EntrypointLimit>,
+}
+
+impl Default for InputLimits {
+    fn default() -> Self {
+        // Proofs are byte arrays, one JSON number per byte
+        let packet = |entrypoint: &str| EntrypointLimit {
+            entrypoint: entrypoint.to_string(),
+            max_bytes: 512 * 1024,
+            max_list_len: Some(128 * 1024),
+        };
+        Self {
+            max_bytes: 64 * 1024,
+            max_depth: 32,
+            max_string_len: 16 * 1024,
+            max_list_len: 256,
+            entrypoints: vec![
+                packet(type_urls::MSG_RECV_PACKET),
+                packet(type_urls::MSG_ACKNOWLEDGEMENT),
+                packet(type_urls::MSG_TIMEOUT),
+            ],
+        }
+    }
+}
+
+/// Why an input was rejected before decoding
+#[derive(Clone, Debug, PartialEq)]
+pub enum InputError {
+    TooLarge { size: usize, max: u32 },
+    InvalidUtf8 { offset: usize },
+    Malformed(String),
+    TooDeep { field: String, max: u32 },
+    StringTooLong { field: String, len: usize, max: u32 },
+    ListTooLong { field: String, len: usize, max: u32 },
+}
+
+impl std::fmt::Display for InputError {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            InputError::TooLarge { size, max } => write!(f, "Input of {} bytes exceeds the limit of {} bytes", size, max),
+            InputError::InvalidUtf8 { offset } => write!(f, "Input is not valid UTF-8 at byte {}", offset),
+            InputError::Malformed(error) => write!(f, "Input is not valid JSON: {}", error),
+            InputError::TooDeep { field, max } => write!(f, "{} is nested deeper than {} levels", field, max),
+            InputError::StringTooLong { field, len, max } => write!(f, "{} is {} bytes long, at most {} allowed", field, len, max),
+            InputError::ListTooLong { field, len, max } => write!(f, "{} has {} elements, at most {} allowed", field, len, max),
+        }
+    }
+}
+
+impl std::error::Error for InputError {}
+
+impl InputError {
+    /// ABCI code reported for the error
+    pub fn code(&self) -> u32 {
+        match self {
+            InputError::TooLarge { .. } => ABCICode::TX_TOO_LARGE,
+            InputError::InvalidUtf8 { .. } | InputError::Malformed(_) => ABCICode::TX_DECODE_ERROR,
+            _ => ABCICode::INVALID_REQUEST,
+        }
+    }
+
+    /// Path of the offending field, e.g. `outputs[3].coins`
+    pub fn field(&self) -> Option<&str> {
+        match self {
+            InputError::TooDeep { field, .. }
+            | InputError::StringTooLong { field, .. }
+            | InputError::ListTooLong { field, .. } => Some(field),
+            _ => None,
+        }
+    }
+
+    pub fn to_failure(&self, entrypoint: &str) -> FailureEvent {
+        let event = FailureEvent::new(entrypoint, self.code(), self.to_string());
+        match self.field() {
+            Some(field) => event.with_field(field),
+            None => event,
+        }
+    }
+}
+
+impl InputLimits {
+    pub fn from_json(json: &str) -> Result<Self, String> {
+        serde_json::from_str(json).map_err(|e| format!("Invalid input limits: {}", e))
+    }
+
+    pub fn to_json(&self) -> String {
+        serde_json::to_string(self).expect("Input limits serialize")
+    }
+
+    pub fn validate(&self) -> Result<(), String> {
+        if self.max_bytes == 0 || self.max_depth == 0 || self.max_string_len == 0 || self.max_list_len == 0 {
+            return Err("Input limits must all be positive".to_string());
+        }
+        for (index, entry) in self.entrypoints.iter().enumerate() {
+            if entry.entrypoint.is_empty() {
+                return Err("Input limit entrypoint cannot be empty".to_string());
+            }
+            if entry.max_bytes == 0 || entry.max_list_len == Some(0) {
+                return Err(format!("Input limits of {} must be positive", entry.entrypoint));
+            }
+            if self.entrypoints[..index].iter().any(|other| other.entrypoint == entry.entrypoint) {
+                return Err(format!("Input limits of {} are listed more than once", entry.entrypoint));
+            }
+        }
+        Ok(())
+    }
+
+    /// Size and list limits that apply to `entrypoint`
+    pub fn limits_for(&self, entrypoint: &str) -> (u32, u32) {
+        match self.entrypoints.iter().find(|entry| entry.entrypoint == entrypoint) {
+            Some(entry) => (entry.max_bytes, entry.max_list_len.unwrap_or(self.max_list_len)),
+            None => (self.max_bytes, self.max_list_len),
+        }
+    }
+
+    /// Check raw JSON input for `entrypoint` before it is decoded
+    pub fn check(&self, entrypoint: &str, input: &[u8]) -> Result<(), InputError> {
+        let (max_bytes, max_list_len) = self.limits_for(entrypoint);
+        if input.len() > max_bytes as usize {
+            return Err(InputError::TooLarge { size: input.len(), max: max_bytes });
+        }
+        let text = std::str::from_utf8(input).map_err(|e| InputError::InvalidUtf8 { offset: e.valid_up_to() })?;
+        let value: Value = serde_json::from_str(text).map_err(|e| InputError::Malformed(e.to_string()))?;
+        self.check_value(&value, "msg", 0, max_list_len)
+    }
+
+    fn check_value(&self, value: &Value, field: &str, depth: u32, max_list_len: u32) -> Result<(), InputError> {
+        match value {
+            Value::String(text) if text.len() > self.max_string_len as usize => Err(InputError::StringTooLong {
+                field: field.to_string(),
+                len: text.len(),
+                max: self.max_string_len,
+            }),
+            Value::Array(_) | Value::Object(_) if depth >= self.max_depth => Err(InputError::TooDeep {
+                field: field.to_string(),
+                max: self.max_depth,
+            }),
+            Value::Array(items) => {
+                if items.len() > max_list_len as usize {
+                    return Err(InputError::ListTooLong { field: field.to_string(), len: items.len(), max: max_list_len });
+                }
+                items.iter().enumerate().try_for_each(|(index, item)| {
+                    self.check_value(item, &format!("{}[{}]", field, index), depth + 1, max_list_len)
+                })
+            }
+            Value::Object(fields) => fields.iter().try_for_each(|(key, item)| {
+                if key.len() > self.max_string_len as usize {
+                    return Err(InputError::StringTooLong { field: field.to_string(), len: key.len(), max: self.max_string_len });
+                }
+                let path = if depth == 0 { key.clone() } else { format!("{}.{}", field, key) };
+                self.check_value(item, &path, depth + 1, max_list_len)
+            }),
+            _ => Ok(()),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_size_and_encoding() {
+        let limits = InputLimits { max_bytes: 64, ..InputLimits::default() };
+        assert!(limits.check(type_urls::MSG_SEND, br#"{"from_address":"alice.near"}"#).is_ok());
+
+        let large = format!(r#"{{"memo":"{}"}}"#, "x".repeat(100));
+        let error = limits.check(type_urls::MSG_SEND, large.as_bytes()).unwrap_err();
+        assert_eq!(error, InputError::TooLarge { size: 111, max: 64 });
+        assert_eq!(error.code(), ABCICode::TX_TOO_LARGE);
+        // Packets have their own, larger limit
+        assert!(limits.check(type_urls::MSG_RECV_PACKET, large.as_bytes()).is_ok());
+
+        assert_eq!(limits.check(type_urls::MSG_SEND, b"{\"a\":\"\xff\"}"), Err(InputError::InvalidUtf8 { offset: 6 }));
+        assert!(matches!(limits.check(type_urls::MSG_SEND, b"{\"a\":"), Err(InputError::Malformed(_))));
+    }
+
+    #[test]
+    fn test_field_constraints() {
+        let limits = InputLimits { max_string_len: 8, max_list_len: 2, ..InputLimits::default() };
+
+        let error = limits.check("send", br#"{"outputs":[{"coins":[1,2,3]}]}"#).unwrap_err();
+        assert_eq!(error.field(), Some("outputs[0].coins"));
+        assert_eq!(error.to_string(), "outputs[0].coins has 3 elements, at most 2 allowed");
+
+        let error = limits.check("send", br#"{"memo":"much too long"}"#).unwrap_err();
+        assert_eq!(error, InputError::StringTooLong { field: "memo".to_string(), len: 13, max: 8 });
+        assert_eq!(error.to_failure("send").field.as_deref(), Some("memo"));
+
+        let shallow = InputLimits { max_depth: 3, ..InputLimits::default() };
+        assert!(matches!(shallow.check("send", br#"{"a":{"b":{"c":[]}}}"#), Err(InputError::TooDeep { .. })));
+        assert!(shallow.check("send", br#"{"a":{"b":[]}}"#).is_ok());
+    }
+
+    #[test]
+    fn test_limits_validation() {
+        assert!(InputLimits::default().validate().is_ok());
+        assert!(InputLimits { max_list_len: 0, ..InputLimits::default() }.validate().is_err());
+
+        let mut limits = InputLimits::default();
+        limits.entrypoints.push(limits.entrypoints[0].clone());
+        assert!(limits.validate().is_err());
+        assert_eq!(InputLimits::from_json(&InputLimits::default().to_json()), Ok(InputLimits::default()));
+    }
+}
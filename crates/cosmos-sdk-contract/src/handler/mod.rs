@@ -1,7 +1,29 @@
+pub mod atomic;
+pub mod batch;
+pub mod failure;
+pub mod feature_flags;
+pub mod gas;
+pub mod health;
+pub mod input_limits;
 pub mod msg_router;
+pub mod query_cache;
+pub mod rate_limit;
+pub mod telemetry;
+pub mod timelock;
 pub mod tx_decoder;
 pub mod tx_handler;
 
+pub use atomic::{atomic_call_hash, execute_atomic, resolve_atomic_call, AtomicCallRequest, AtomicCallResult, AtomicCalls, AtomicExecution, AtomicMsg, MAX_ATOMIC_MESSAGES};
+pub use batch::{order_bundle, BatchOrdering, BundledTxResult, MAX_BUNDLE_TXS};
+pub use failure::FailureEvent;
+pub use feature_flags::{FeatureFlags, DisabledModule};
+pub use gas::{GasMeter, GasSchedule, GAS_SCHEDULE_PARAM};
+pub use health::{HealthReport, ModuleHealth};
+pub use input_limits::{EntrypointLimit, InputError, InputLimits, INPUT_LIMITS_PARAM};
 pub use msg_router::*;
+pub use query_cache::QueryCache;
+pub use rate_limit::{RateLimitConfig, RateLimiter, RATE_LIMIT_PARAM};
+pub use telemetry::{Metrics, NoopTelemetry, TelemetryHooks};
+pub use timelock::{AdminOperation, QueuedOperation, Timelock};
 pub use tx_decoder::*;
 pub use tx_handler::*;
\ No newline at end of file
@@ -1,8 +1,16 @@
 use near_sdk::borsh::{BorshDeserialize, BorshSerialize};
 use near_sdk::serde::{Deserialize, Serialize};
 use near_sdk::json_types::Base64VecU8;
+use near_sdk::env;
 
+use crate::types::codec::{Codec, JsonCodec};
 use crate::types::cosmos_messages::*;
+use super::failure::FailureEvent;
+use super::feature_flags::module_for_type_url;
+use super::input_limits::InputLimits;
+use super::rate_limit::RateLimiter;
+use super::telemetry::{measure, TelemetryHooks};
+use super::tx_handler::ABCICode;
 
 // ============================================================================
 // RESPONSE TYPES
@@ -56,6 +64,8 @@ pub enum ContractError {
     UnknownMessageType(String),
     /// Invalid message format
     InvalidMessageFormat(String),
+    /// A message field failed validation
+    InvalidField { field: String, reason: String },
     /// Message decoding error
     DecodeError(String),
     /// Insufficient funds
@@ -73,6 +83,7 @@ impl std::fmt::Display for ContractError {
         match self {
             ContractError::UnknownMessageType(msg_type) => write!(f, "Unknown message type: {}", msg_type),
             ContractError::InvalidMessageFormat(msg) => write!(f, "Invalid message format: {}", msg),
+            ContractError::InvalidField { field, reason } => write!(f, "Invalid {}: {}", field, reason),
             ContractError::DecodeError(msg) => write!(f, "Decode error: {}", msg),
             ContractError::InsufficientFunds => write!(f, "Insufficient funds"),
             ContractError::Unauthorized => write!(f, "Unauthorized"),
@@ -91,16 +102,19 @@ pub type MessageResult<T> = Result<T, ContractError>;
 // DECODE FUNCTIONS
 // ============================================================================
 
+/// Decode message data with the given codec
+pub fn decode_with<T, C: Codec<T>>(codec: &C, data: &[u8]) -> MessageResult<T> {
+    codec.decode(data).map_err(ContractError::DecodeError)
+}
+
 /// Decode protobuf-compatible message data
 /// Initially supports JSON format, can be extended to support actual protobuf
 pub fn decode_protobuf_compatible<T>(data: Vec<u8>) -> MessageResult<T>
 where
-    T: for<'de> Deserialize<'de>,
+    T: for<'de> Deserialize<'de> + Serialize,
 {
     // For now, we support JSON encoding which is protobuf-compatible
-    // In the future, this can be extended to support actual protobuf binary format
-    serde_json::from_slice(&data)
-        .map_err(|e| ContractError::DecodeError(format!("JSON decode error: {}", e)))
+    decode_with(&JsonCodec, &data)
 }
 
 /// Encode response data to bytes
@@ -144,6 +158,31 @@ pub trait CosmosMessageHandler {
     fn handle_msg_recv_packet(&mut self, msg: MsgRecvPacket) -> MessageResult<HandleResult>;
     fn handle_msg_acknowledgement(&mut self, msg: MsgAcknowledgement) -> MessageResult<HandleResult>;
     fn handle_msg_timeout(&mut self, msg: MsgTimeout) -> MessageResult<HandleResult>;
+
+    /// Whether a module currently accepts messages, see `FeatureFlags`
+    fn is_module_enabled(&self, _module: &str) -> bool {
+        true
+    }
+
+    /// Whether the chain reached its governance halt height
+    fn is_halted(&self) -> bool {
+        false
+    }
+
+    /// Limits a message is checked against before it is decoded
+    fn input_limits(&self) -> InputLimits {
+        InputLimits::default()
+    }
+
+    /// Limiter counting the calls of the predecessor account, none by default
+    fn rate_limiter(&mut self) -> Option<&mut RateLimiter> {
+        None
+    }
+
+    /// Hooks told about every routed message, none by default
+    fn telemetry(&mut self) -> Option<&mut dyn TelemetryHooks> {
+        None
+    }
 }
 
 // ============================================================================
@@ -156,17 +195,48 @@ pub fn route_cosmos_message<T>(
     msg_type: String,
     msg_data: Base64VecU8,
 ) -> HandleResponse
+where
+    T: CosmosMessageHandler,
+{
+    let (response, gas_used) = measure(|| dispatch_message(handler, msg_type.clone(), msg_data));
+    if let Some(telemetry) = handler.telemetry() {
+        telemetry.on_msg_executed(&msg_type, response.code == 0, gas_used);
+    }
+    response
+}
+
+fn dispatch_message<T>(
+    handler: &mut T,
+    msg_type: String,
+    msg_data: Base64VecU8,
+) -> HandleResponse
 where
     T: CosmosMessageHandler,
 {
     // Validate message type
     if !is_valid_type_url(&msg_type) {
-        return HandleResponse {
-            code: 1,
-            data: vec![],
-            log: format!("Invalid message type: {}", msg_type),
-            events: vec![],
-        };
+        let failure = FailureEvent::new(&msg_type, ABCICode::UNKNOWN_REQUEST, format!("Invalid message type: {}", msg_type));
+        return rejected(failure.with_field("type_url"));
+    }
+
+    if handler.is_halted() {
+        return rejected(FailureEvent::new(&msg_type, ABCICode::INVALID_REQUEST, "Chain is halted"));
+    }
+
+    if let Some(module) = module_for_type_url(&msg_type) {
+        if !handler.is_module_enabled(module) {
+            return rejected(FailureEvent::new(&msg_type, ABCICode::UNAUTHORIZED, format!("Module {} is disabled", module)));
+        }
+    }
+
+    if let Some(limiter) = handler.rate_limiter() {
+        if let Err(message) = limiter.check(&env::predecessor_account_id(), env::block_height()) {
+            return rejected(FailureEvent::new(&msg_type, ABCICode::INVALID_REQUEST, message));
+        }
+    }
+
+    if let Err(error) = handler.input_limits().check(&msg_type, &msg_data.0) {
+        return rejected(error.to_failure(&msg_type));
     }
 
     let msg_bytes = msg_data.0;
@@ -264,12 +334,18 @@ where
             log: handle_result.log,
             events: handle_result.events,
         },
-        Err(error) => HandleResponse {
-            code: 1,
-            data: vec![],
-            log: error.to_string(),
-            events: vec![],
-        },
+        Err(error) => rejected(FailureEvent::from_contract_error(&msg_type, &error)),
+    }
+}
+
+/// Emit the failure event and build the error response for it
+fn rejected(failure: FailureEvent) -> HandleResponse {
+    failure.emit();
+    HandleResponse {
+        code: 1,
+        data: vec![],
+        log: failure.message,
+        events: vec![],
     }
 }
 
@@ -356,11 +432,15 @@ mod tests {
     // Mock handler for testing
     struct MockHandler {
         call_count: u32,
+        disabled_modules: Vec<String>,
+        halted: bool,
+        metrics: crate::handler::Metrics,
+        rate_limiter: Option<RateLimiter>,
     }
 
     impl MockHandler {
         fn new() -> Self {
-            Self { call_count: 0 }
+            Self { call_count: 0, disabled_modules: vec![], halted: false, metrics: Default::default(), rate_limiter: None }
         }
     }
 
@@ -497,6 +577,22 @@ mod tests {
             self.call_count += 1;
             Ok(success_result("packet timeout", vec![]))
         }
+
+        fn is_module_enabled(&self, module: &str) -> bool {
+            !self.disabled_modules.iter().any(|disabled| disabled == module)
+        }
+
+        fn is_halted(&self) -> bool {
+            self.halted
+        }
+
+        fn rate_limiter(&mut self) -> Option<&mut RateLimiter> {
+            self.rate_limiter.as_mut()
+        }
+
+        fn telemetry(&mut self) -> Option<&mut dyn TelemetryHooks> {
+            Some(&mut self.metrics)
+        }
     }
 
     #[test]
@@ -528,6 +624,7 @@ mod tests {
             from_address: "cosmos1sender".to_string(),
             to_address: "cosmos1receiver".to_string(),
             amount: vec![Coin::new("uatom", "1000000")],
+            memo: String::new(),
         };
         
         let msg_bytes = serde_json::to_vec(&msg).unwrap();
@@ -593,6 +690,7 @@ mod tests {
             proposal_id: 42,
             voter: "cosmos1voter".to_string(),
             option: VoteOption::Yes,
+            metadata: String::new(),
         };
         
         let msg_bytes = serde_json::to_vec(&msg).unwrap();
@@ -609,6 +707,119 @@ mod tests {
         assert_eq!(handler.call_count, 1);
     }
 
+    #[test]
+    fn test_disabled_module_rejects_messages() {
+        let mut handler = MockHandler::new();
+        handler.disabled_modules.push("gov".to_string());
+
+        let msg = MsgVote {
+            proposal_id: 1,
+            voter: "cosmos1voter".to_string(),
+            option: VoteOption::Yes,
+            metadata: String::new(),
+        };
+        let response = route_cosmos_message(
+            &mut handler,
+            type_urls::MSG_VOTE.to_string(),
+            Base64VecU8(serde_json::to_vec(&msg).unwrap()),
+        );
+
+        assert_eq!(response.code, 1);
+        assert_eq!(response.log, "Module gov is disabled");
+        assert_eq!(handler.call_count, 0);
+    }
+
+    #[test]
+    fn test_halted_chain_rejects_messages() {
+        let mut handler = MockHandler::new();
+        handler.halted = true;
+
+        let msg = MsgSend {
+            from_address: "cosmos1sender".to_string(),
+            to_address: "cosmos1receiver".to_string(),
+            amount: vec![Coin::new("uatom", "1000")],
+            memo: String::new(),
+        };
+        let response = route_cosmos_message(
+            &mut handler,
+            type_urls::MSG_SEND.to_string(),
+            Base64VecU8(serde_json::to_vec(&msg).unwrap()),
+        );
+
+        assert_eq!(response.code, 1);
+        assert_eq!(response.log, "Chain is halted");
+        assert_eq!(handler.call_count, 0);
+
+        let failure = near_sdk::test_utils::get_logs().pop().unwrap();
+        assert!(failure.starts_with("EVENT_JSON:"));
+        assert!(failure.contains(r#""msg_type":"/cosmos.bank.v1beta1.MsgSend""#));
+    }
+
+    #[test]
+    fn test_rate_limited_account_is_rejected() {
+        use crate::handler::RateLimitConfig;
+
+        let mut handler = MockHandler::new();
+        handler.rate_limiter = Some(RateLimiter::new(b"rl", RateLimitConfig { max_calls: 1, window_blocks: 10 }));
+        let msg = MsgSend {
+            from_address: "cosmos1sender".to_string(),
+            to_address: "cosmos1receiver".to_string(),
+            amount: vec![Coin::new("uatom", "1000")],
+            memo: String::new(),
+        };
+        let msg_bytes = serde_json::to_vec(&msg).unwrap();
+
+        let first = route_cosmos_message(&mut handler, type_urls::MSG_SEND.to_string(), Base64VecU8(msg_bytes.clone()));
+        let second = route_cosmos_message(&mut handler, type_urls::MSG_SEND.to_string(), Base64VecU8(msg_bytes));
+
+        assert_eq!(first.code, 0);
+        assert_eq!(second.code, 1);
+        assert!(second.log.starts_with("Rate limit exceeded"), "{}", second.log);
+        assert_eq!(handler.call_count, 1);
+    }
+
+    #[test]
+    fn test_oversized_input_is_rejected_before_decoding() {
+        let mut handler = MockHandler::new();
+        let msg = MsgSend {
+            from_address: "cosmos1sender".to_string(),
+            to_address: "cosmos1receiver".to_string(),
+            amount: vec![Coin::new("uatom", "1000")],
+            memo: "x".repeat(20_000),
+        };
+        let response = route_cosmos_message(
+            &mut handler,
+            type_urls::MSG_SEND.to_string(),
+            Base64VecU8(serde_json::to_vec(&msg).unwrap()),
+        );
+
+        assert_eq!(response.code, 1);
+        assert_eq!(response.log, "memo is 20000 bytes long, at most 16384 allowed");
+        assert_eq!(handler.call_count, 0);
+        let failure = near_sdk::test_utils::get_logs().pop().unwrap();
+        assert!(failure.contains(r#""field":"memo""#), "{}", failure);
+
+        let response = route_cosmos_message(&mut handler, type_urls::MSG_SEND.to_string(), Base64VecU8(vec![b'['; 70_000]));
+        assert_eq!(response.log, "Input of 70000 bytes exceeds the limit of 65536 bytes");
+    }
+
+    #[test]
+    fn test_routed_messages_reach_telemetry() {
+        let mut handler = MockHandler::new();
+        let msg = MsgSend {
+            from_address: "cosmos1sender".to_string(),
+            to_address: "cosmos1receiver".to_string(),
+            amount: vec![Coin::new("uatom", "1000")],
+            memo: String::new(),
+        };
+        let msg_bytes = serde_json::to_vec(&msg).unwrap();
+        route_cosmos_message(&mut handler, type_urls::MSG_SEND.to_string(), Base64VecU8(msg_bytes));
+        route_cosmos_message(&mut handler, type_urls::MSG_SEND.to_string(), Base64VecU8(b"invalid".to_vec()));
+
+        let send = &handler.metrics.messages[type_urls::MSG_SEND];
+        assert_eq!((send.count, send.failures), (2, 1));
+    }
+
     #[test]
     fn test_validate_cosmos_address() {
         // Valid addresses
@@ -0,0 +1,150 @@
+/// Query Result Cache
+///
+/// Aggregate queries such as total bonded stake or a proposal's running
+/// tally walk whole collections, and the same one is often asked for several
+/// times within a block. Results are cached under the query and the height
+/// they were computed at; an entry from an earlier height is treated as a
+/// miss, so nothing has to be cleared when a block ends.
+///
+/// NEAR views cannot write state, so entries are filled by state-changing
+/// calls (block processing, votes) through `get_or_compute` and views read
+/// them with `get`, computing the result themselves on a miss.
+
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::collections::UnorderedMap;
+use serde::de::DeserializeOwned;
+use serde::Serialize;
+
+use crate::modules::gov::{GovernanceModule, TallyResult};
+use crate::modules::staking::StakingModule;
+use crate::types::codec::{Codec, JsonCodec};
+
+#[derive(BorshDeserialize, BorshSerialize, Clone, Debug)]
+struct CachedResult {
+    height: u64,
+    /// JSON encoded result
+    value: Vec<u8>,
+}
+
+#[derive(BorshDeserialize, BorshSerialize)]
+pub struct QueryCache {
+    entries: UnorderedMap<String, CachedResult>,
+    hits: u64,
+    misses: u64,
+}
+
+impl QueryCache {
+    pub fn new() -> Self {
+        Self {
+            entries: UnorderedMap::new(b"query_cache".to_vec()),
+            hits: 0,
+            misses: 0,
+        }
+    }
+
+    /// Result of `query` computed at `height`, if cached
+    pub fn get<T: Serialize + DeserializeOwned>(&self, query: &str, height: u64) -> Option<T> {
+        self.entries.get(&query.to_string())
+            .filter(|cached| cached.height == height)
+            .and_then(|cached| JsonCodec.decode(&cached.value).ok())
+    }
+
+    /// Cached result of `query` at `height`, computing and storing it on a miss
+    pub fn get_or_compute<T, F>(&mut self, query: &str, height: u64, compute: F) -> T
+    where
+        T: Serialize + DeserializeOwned,
+        F: FnOnce() -> T,
+    {
+        if let Some(value) = self.get(query, height) {
+            self.hits += 1;
+            return value;
+        }
+
+        self.misses += 1;
+        let value = compute();
+        if let Ok(encoded) = JsonCodec.encode(&value) {
+            self.entries.insert(&query.to_string(), &CachedResult { height, value: encoded });
+        }
+        value
+    }
+
+    /// Drop a result before the height changes, after a write it depends on
+    pub fn invalidate(&mut self, query: &str) {
+        self.entries.remove(&query.to_string());
+    }
+
+    /// Cache hits and misses since deployment
+    pub fn stats(&self) -> (u64, u64) {
+        (self.hits, self.misses)
+    }
+}
+
+pub const TOTAL_BONDED_QUERY: &str = "staking/total_bonded";
+
+/// Query key of a proposal's tally
+pub fn tally_query(proposal_id: u64) -> String {
+    format!("gov/tally/{}", proposal_id)
+}
+
+/// Sum of the tokens of all bonded validators at `height`
+pub fn total_bonded(cache: &mut QueryCache, staking: &StakingModule, height: u64) -> u128 {
+    cache.get_or_compute(TOTAL_BONDED_QUERY, height, || {
+        staking.get_bonded_validators().iter().map(|validator| validator.tokens).sum()
+    })
+}
+
+/// Running tally of a proposal at `height`
+pub fn tally_preview(cache: &mut QueryCache, gov: &GovernanceModule, proposal_id: u64, height: u64) -> TallyResult {
+    cache.get_or_compute(&tally_query(proposal_id), height, || gov.tally(proposal_id))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use near_sdk::AccountId;
+
+    #[test]
+    fn test_results_are_reused_within_a_height() {
+        let mut cache = QueryCache::new();
+        let mut computed = 0;
+
+        for _ in 0..3 {
+            let value: u64 = cache.get_or_compute("answer", 10, || {
+                computed += 1;
+                42
+            });
+            assert_eq!(value, 42);
+        }
+        assert_eq!(computed, 1);
+        assert_eq!(cache.stats(), (2, 1));
+
+        // A new height recomputes
+        assert_eq!(cache.get::<u64>("answer", 11), None);
+        assert_eq!(cache.get_or_compute("answer", 11, || 43u64), 43);
+        assert_eq!(cache.get::<u64>("answer", 11), Some(43));
+    }
+
+    #[test]
+    fn test_tally_preview_invalidated_by_vote() {
+        let mut cache = QueryCache::new();
+        let mut gov = GovernanceModule::new();
+        let alice: AccountId = "alice.near".parse().unwrap();
+        let proposal_id = gov.submit_proposal(
+            &alice,
+            "Title".to_string(),
+            "Description".to_string(),
+            "reward_rate".to_string(),
+            "6".to_string(),
+            String::new(),
+            None,
+            10,
+        );
+
+        assert_eq!(tally_preview(&mut cache, &gov, proposal_id, 12).yes, 0);
+        gov.vote(&alice, proposal_id, 1, String::new());
+        assert_eq!(tally_preview(&mut cache, &gov, proposal_id, 12).yes, 0);
+
+        cache.invalidate(&tally_query(proposal_id));
+        assert!(tally_preview(&mut cache, &gov, proposal_id, 12).yes > 0);
+    }
+}
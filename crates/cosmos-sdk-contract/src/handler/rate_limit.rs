@@ -0,0 +1,161 @@
+/// Rate Limiting
+///
+/// Every message an account sends costs the keepers that process blocks
+/// gas and adds entries to the event index, so a single account could make
+/// running the chain expensive by flooding it with cheap messages. The
+/// router counts the mutating calls of each NEAR account in windows of
+/// `window_blocks` blocks and rejects calls beyond `max_calls` until the
+/// next window starts. Governance sets both through the `rate_limit`
+/// parameter; `max_calls` of zero turns the limit off.
+
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::collections::LookupMap;
+use near_sdk::serde::{Deserialize, Serialize};
+use near_sdk::AccountId;
+use schemars::JsonSchema;
+
+/// Governance parameter holding the JSON encoded limit
+pub const RATE_LIMIT_PARAM: &str = "rate_limit";
+
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct RateLimitConfig {
+    /// Calls allowed per account and window, 0 for no limit
+    pub max_calls: u32,
+    pub window_blocks: u64,
+}
+
+impl Default for RateLimitConfig {
+    fn default() -> Self {
+        Self { max_calls: 100, window_blocks: 10 }
+    }
+}
+
+impl RateLimitConfig {
+    pub fn from_json(json: &str) -> Result<Self, String> {
+        serde_json::from_str(json).map_err(|e| format!("Invalid rate limit: {}", e))
+    }
+
+    pub fn to_json(&self) -> String {
+        serde_json::to_string(self).expect("Rate limit serializes")
+    }
+
+    pub fn validate(&self) -> Result<(), String> {
+        if self.window_blocks == 0 {
+            return Err("Rate limit window_blocks must be positive".to_string());
+        }
+        Ok(())
+    }
+
+    pub fn is_enabled(&self) -> bool {
+        self.max_calls > 0
+    }
+
+    /// First height of the window `height` falls in
+    fn window_start(&self, height: u64) -> u64 {
+        height - height % self.window_blocks
+    }
+}
+
+/// Calls an account made in its current window
+#[derive(BorshDeserialize, BorshSerialize, Clone, Debug, PartialEq)]
+struct AccountWindow {
+    start: u64,
+    calls: u32,
+}
+
+#[derive(BorshDeserialize, BorshSerialize)]
+pub struct RateLimiter {
+    config: RateLimitConfig,
+    windows: LookupMap<AccountId, AccountWindow>,
+}
+
+impl RateLimiter {
+    pub fn new(prefix: &[u8], config: RateLimitConfig) -> Self {
+        Self {
+            config,
+            windows: LookupMap::new(prefix.to_vec()),
+        }
+    }
+
+    pub fn config(&self) -> &RateLimitConfig {
+        &self.config
+    }
+
+    /// Switch to the limit governance activated, counts of the current
+    /// window carry over
+    pub fn set_config(&mut self, config: RateLimitConfig) {
+        self.config = config;
+    }
+
+    /// Count a call of `account` at `height`, rejecting it once the
+    /// account used up its window
+    pub fn check(&mut self, account: &AccountId, height: u64) -> Result<(), String> {
+        if !self.config.is_enabled() {
+            return Ok(());
+        }
+        let start = self.config.window_start(height);
+        let mut window = self.windows.get(account)
+            .filter(|window| window.start == start)
+            .unwrap_or(AccountWindow { start, calls: 0 });
+        if window.calls >= self.config.max_calls {
+            return Err(format!(
+                "Rate limit exceeded: {} calls per {} blocks, next window starts at height {}",
+                self.config.max_calls,
+                self.config.window_blocks,
+                start + self.config.window_blocks
+            ));
+        }
+        window.calls += 1;
+        self.windows.insert(account, &window);
+        Ok(())
+    }
+
+    /// Calls `account` has left at `height`, `None` without a limit
+    pub fn remaining(&self, account: &AccountId, height: u64) -> Option<u32> {
+        if !self.config.is_enabled() {
+            return None;
+        }
+        let start = self.config.window_start(height);
+        let used = self.windows.get(account)
+            .filter(|window| window.start == start)
+            .map_or(0, |window| window.calls);
+        Some(self.config.max_calls.saturating_sub(used))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use near_sdk::test_utils::VMContextBuilder;
+    use near_sdk::testing_env;
+
+    #[test]
+    fn test_calls_are_limited_per_window() {
+        testing_env!(VMContextBuilder::new().build());
+        let mut limiter = RateLimiter::new(b"rl", RateLimitConfig { max_calls: 2, window_blocks: 10 });
+        let alice: AccountId = "alice.near".parse().unwrap();
+        let bob: AccountId = "bob.near".parse().unwrap();
+
+        assert!(limiter.check(&alice, 21).is_ok());
+        assert!(limiter.check(&alice, 25).is_ok());
+        let error = limiter.check(&alice, 29).unwrap_err();
+        assert!(error.contains("next window starts at height 30"), "{}", error);
+        assert_eq!(limiter.remaining(&alice, 29), Some(0));
+
+        // Other accounts and the next window are unaffected
+        assert!(limiter.check(&bob, 29).is_ok());
+        assert_eq!(limiter.remaining(&alice, 30), Some(2));
+        assert!(limiter.check(&alice, 30).is_ok());
+
+        limiter.set_config(RateLimitConfig { max_calls: 0, window_blocks: 10 });
+        assert!(limiter.check(&alice, 30).is_ok());
+        assert_eq!(limiter.remaining(&alice, 30), None);
+    }
+
+    #[test]
+    fn test_config_validation() {
+        assert!(RateLimitConfig::default().validate().is_ok());
+        assert!(RateLimitConfig { max_calls: 5, window_blocks: 0 }.validate().is_err());
+        assert_eq!(RateLimitConfig::from_json(&RateLimitConfig::default().to_json()), Ok(RateLimitConfig::default()));
+    }
+}
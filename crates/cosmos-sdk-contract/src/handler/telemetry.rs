@@ -0,0 +1,143 @@
+/// Telemetry Hooks
+///
+/// The router, the storage meter and block processing call a
+/// `TelemetryHooks` implementation at three points: after a message ran,
+/// after a tracked call changed a module's storage, and after a module's end
+/// block logic. Modules themselves stay free of counters. `NoopTelemetry`
+/// ignores everything and is what the plain entry points use; `Metrics`
+/// aggregates counts and gas per message type and per module, for a
+/// contract that wants to expose them through a view.
+///
+/// Gas is NEAR gas burnt as reported by `env::used_gas()`; there is no clock
+/// to time calls with inside the contract.
+
+use std::collections::BTreeMap;
+
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::env;
+use near_sdk::serde::{Deserialize, Serialize};
+use schemars::JsonSchema;
+
+/// Instrumentation points, every hook defaults to doing nothing
+pub trait TelemetryHooks {
+    /// A routed message finished
+    fn on_msg_executed(&mut self, _msg_type: &str, _success: bool, _gas_used: u64) {}
+
+    /// A tracked call changed the storage of `module`
+    fn on_store_write(&mut self, _module: &str, _bytes_added: u64, _bytes_freed: u64) {}
+
+    /// End block logic of `module` ran for `height`
+    fn on_end_blocker(&mut self, _module: &str, _height: u64, _gas_used: u64) {}
+}
+
+/// Hooks that record nothing
+pub struct NoopTelemetry;
+
+impl TelemetryHooks for NoopTelemetry {}
+
+/// Run `f` and return its result with the gas it burnt
+pub fn measure<T>(f: impl FnOnce() -> T) -> (T, u64) {
+    let before = env::used_gas().as_gas();
+    let result = f();
+    (result, env::used_gas().as_gas().saturating_sub(before))
+}
+
+/// Calls of one kind of operation
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, Default, PartialEq, JsonSchema)]
+pub struct OperationStats {
+    pub count: u64,
+    pub failures: u64,
+    pub gas_total: u64,
+    pub gas_max: u64,
+}
+
+impl OperationStats {
+    fn record(&mut self, success: bool, gas_used: u64) {
+        self.count += 1;
+        if !success {
+            self.failures += 1;
+        }
+        self.gas_total = self.gas_total.saturating_add(gas_used);
+        self.gas_max = self.gas_max.max(gas_used);
+    }
+
+    pub fn average_gas(&self) -> u64 {
+        self.gas_total.checked_div(self.count).unwrap_or(0)
+    }
+}
+
+/// Storage changes booked to one module
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, Default, PartialEq, JsonSchema)]
+pub struct StoreWriteStats {
+    pub writes: u64,
+    pub bytes_added: u64,
+    pub bytes_freed: u64,
+}
+
+/// Hooks that aggregate what they are told
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, Default, PartialEq, JsonSchema)]
+pub struct Metrics {
+    /// By message type URL
+    pub messages: BTreeMap<String, OperationStats>,
+    /// By module
+    pub store_writes: BTreeMap<String, StoreWriteStats>,
+    /// By module
+    pub end_blockers: BTreeMap<String, OperationStats>,
+    /// Last height an end blocker ran for
+    pub last_height: u64,
+}
+
+impl Metrics {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Start over, e.g. after the numbers have been scraped
+    pub fn reset(&mut self) {
+        *self = Self::default();
+    }
+}
+
+impl TelemetryHooks for Metrics {
+    fn on_msg_executed(&mut self, msg_type: &str, success: bool, gas_used: u64) {
+        self.messages.entry(msg_type.to_string()).or_default().record(success, gas_used);
+    }
+
+    fn on_store_write(&mut self, module: &str, bytes_added: u64, bytes_freed: u64) {
+        let stats = self.store_writes.entry(module.to_string()).or_default();
+        stats.writes += 1;
+        stats.bytes_added = stats.bytes_added.saturating_add(bytes_added);
+        stats.bytes_freed = stats.bytes_freed.saturating_add(bytes_freed);
+    }
+
+    fn on_end_blocker(&mut self, module: &str, height: u64, gas_used: u64) {
+        self.end_blockers.entry(module.to_string()).or_default().record(true, gas_used);
+        self.last_height = self.last_height.max(height);
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_metrics_aggregate() {
+        let mut metrics = Metrics::new();
+        metrics.on_msg_executed("/cosmos.bank.v1beta1.MsgSend", true, 100);
+        metrics.on_msg_executed("/cosmos.bank.v1beta1.MsgSend", false, 300);
+        metrics.on_store_write("bank", 64, 0);
+        metrics.on_store_write("bank", 0, 16);
+        metrics.on_end_blocker("gov", 7, 50);
+
+        let send = &metrics.messages["/cosmos.bank.v1beta1.MsgSend"];
+        assert_eq!((send.count, send.failures, send.gas_max), (2, 1, 300));
+        assert_eq!(send.average_gas(), 200);
+        assert_eq!(metrics.store_writes["bank"], StoreWriteStats { writes: 2, bytes_added: 64, bytes_freed: 16 });
+        assert_eq!(metrics.end_blockers["gov"].count, 1);
+        assert_eq!(metrics.last_height, 7);
+
+        metrics.reset();
+        assert_eq!(metrics, Metrics::default());
+        assert_eq!(OperationStats::default().average_gas(), 0);
+    }
+}
@@ -0,0 +1,302 @@
+/// Timelocked Admin Operations
+///
+/// Owner powers that bypass governance (pausing a module, approving a code
+/// migration, overriding a parameter) go through a queue instead of taking
+/// effect immediately. An operation needs approvals from `threshold` of the
+/// admins and only becomes executable once `delay_ns` has passed since it
+/// was queued, which gives token holders time to notice it and governance
+/// time to cancel it.
+///
+/// The router queues its own owner operations here too (ownership, module
+/// registrations and instances) and applies them itself through `ready` and
+/// `complete`.
+
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::collections::UnorderedMap;
+use near_sdk::serde::{Deserialize, Serialize};
+use near_sdk::{env, AccountId};
+use schemars::JsonSchema;
+
+use crate::factory::InstanceGenesis;
+use crate::handler::feature_flags::FeatureFlags;
+use crate::modules::gov::{GovernanceModule, UpgradePlan};
+use crate::types::{time, Authority};
+
+/// Default delay before a queued operation can run, two days
+pub const DEFAULT_TIMELOCK_DELAY_NS: u64 = time::days_to_nanos(2);
+
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+#[serde(rename_all = "snake_case")]
+pub enum AdminOperation {
+    Pause { module: String, reason: String },
+    Unpause { module: String },
+    /// Approve a code upgrade without a proposal
+    Migrate { plan: UpgradePlan },
+    OverrideParam { key: String, value: String },
+    /// Hand the router to another owner
+    TransferOwnership { new_owner: String },
+    RegisterModule { module_type: String, contract_id: String, version: String },
+    /// Router code for new instances; the code is submitted on execution
+    /// and must hash to `code_hash`
+    SetInstanceCode { code_hash: String },
+    /// Create an appchain instance; the deposit is attached on execution
+    CreateInstance { name: String, genesis: InstanceGenesis },
+}
+
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct QueuedOperation {
+    pub id: u64,
+    pub operation: AdminOperation,
+    pub approvals: Vec<String>,
+    pub queued_at: u64,
+    /// Earliest block timestamp the operation can execute at
+    pub eta: u64,
+}
+
+#[derive(BorshDeserialize, BorshSerialize)]
+pub struct Timelock {
+    admins: Vec<AccountId>,
+    threshold: u32,
+    delay_ns: u64,
+    /// Governance account; defaults to this contract
+    authority: Authority,
+    queue: UnorderedMap<u64, QueuedOperation>,
+    next_id: u64,
+}
+
+impl Timelock {
+    pub fn new(admins: Vec<AccountId>, threshold: u32) -> Self {
+        assert!(
+            threshold > 0 && threshold as usize <= admins.len(),
+            "Timelock threshold must be between 1 and the number of admins"
+        );
+        Self {
+            admins,
+            threshold,
+            delay_ns: DEFAULT_TIMELOCK_DELAY_NS,
+            authority: Authority::default(),
+            queue: UnorderedMap::new(b"timelock_queue".to_vec()),
+            next_id: 1,
+        }
+    }
+
+    /// Account that governance acts through
+    pub fn authority(&self) -> AccountId {
+        self.authority.account()
+    }
+
+    pub fn set_authority(&mut self, sender: &AccountId, new_authority: AccountId) -> Result<(), String> {
+        self.authority.transfer(sender, new_authority)
+    }
+
+    fn assert_authority(&self, sender: &AccountId) -> Result<(), String> {
+        self.authority.check(sender, "Only the governance authority can do this")
+    }
+
+    fn assert_admin(&self, sender: &AccountId) -> Result<(), String> {
+        if !self.admins.contains(sender) {
+            return Err(format!("{} is not a timelock admin", sender));
+        }
+        Ok(())
+    }
+
+    /// Hand an admin seat to another account, e.g. when ownership moves
+    pub(crate) fn replace_admin(&mut self, old: &AccountId, new: AccountId) {
+        self.admins.retain(|admin| admin != old);
+        if !self.admins.contains(&new) {
+            self.admins.push(new);
+        }
+    }
+
+    pub fn delay_ns(&self) -> u64 {
+        self.delay_ns
+    }
+
+    /// Change the delay; only affects operations queued afterwards
+    pub fn set_delay(&mut self, sender: &AccountId, delay_ns: u64) -> Result<(), String> {
+        self.assert_authority(sender)?;
+        self.delay_ns = delay_ns;
+        env::log_str(&format!("EVENT: timelock_delay delay_ns={} by={}", delay_ns, sender));
+        Ok(())
+    }
+
+    /// Queue an operation, counting as the sender's approval
+    pub fn queue(&mut self, sender: &AccountId, operation: AdminOperation) -> Result<u64, String> {
+        self.assert_admin(sender)?;
+
+        let id = self.next_id;
+        self.next_id += 1;
+        let now = env::block_timestamp();
+        self.queue.insert(&id, &QueuedOperation {
+            id,
+            operation,
+            approvals: vec![sender.to_string()],
+            queued_at: now,
+            eta: now + self.delay_ns,
+        });
+        env::log_str(&format!("EVENT: timelock_queued id={} by={} eta={}", id, sender, now + self.delay_ns));
+        Ok(id)
+    }
+
+    pub fn approve(&mut self, sender: &AccountId, id: u64) -> Result<u32, String> {
+        self.assert_admin(sender)?;
+        let mut queued = self.queue.get(&id).ok_or_else(|| format!("Operation {} is not queued", id))?;
+        if queued.approvals.contains(&sender.to_string()) {
+            return Err(format!("{} already approved operation {}", sender, id));
+        }
+
+        queued.approvals.push(sender.to_string());
+        self.queue.insert(&id, &queued);
+        env::log_str(&format!("EVENT: timelock_approved id={} by={}", id, sender));
+        Ok(queued.approvals.len() as u32)
+    }
+
+    /// Drop a queued operation; governance's veto
+    pub fn cancel(&mut self, sender: &AccountId, id: u64) -> Result<(), String> {
+        self.assert_authority(sender)?;
+        self.queue.remove(&id).ok_or_else(|| format!("Operation {} is not queued", id))?;
+        env::log_str(&format!("EVENT: timelock_cancelled id={} by={}", id, sender));
+        Ok(())
+    }
+
+    /// Run an operation that has enough approvals and whose delay passed
+    pub fn execute(
+        &mut self,
+        sender: &AccountId,
+        id: u64,
+        flags: &mut FeatureFlags,
+        gov: &mut GovernanceModule,
+    ) -> Result<AdminOperation, String> {
+        let queued = self.ready(sender, id)?;
+
+        // Once the delay passed the timelock acts with governance's authority
+        match &queued.operation {
+            AdminOperation::Pause { module, reason } => flags.disable_module(&flags.authority(), module, reason.clone())?,
+            AdminOperation::Unpause { module } => flags.enable_module(&flags.authority(), module)?,
+            AdminOperation::Migrate { plan } => gov.approve_upgrade(plan.clone())?,
+            AdminOperation::OverrideParam { key, value } => gov.override_parameter(key, value)?,
+            _ => return Err(format!("Operation {} is applied by the router", id)),
+        }
+
+        self.complete(sender, id);
+        Ok(queued.operation)
+    }
+
+    /// An operation that has enough approvals and whose delay passed
+    ///
+    /// For callers applying the operation themselves, who call `complete`
+    /// once it is applied.
+    pub fn ready(&self, sender: &AccountId, id: u64) -> Result<QueuedOperation, String> {
+        self.assert_admin(sender)?;
+        let queued = self.queue.get(&id).ok_or_else(|| format!("Operation {} is not queued", id))?;
+        if (queued.approvals.len() as u32) < self.threshold {
+            return Err(format!(
+                "Operation {} has {} of {} approvals",
+                id, queued.approvals.len(), self.threshold
+            ));
+        }
+        if env::block_timestamp() < queued.eta {
+            return Err(format!("Operation {} is locked until {}", id, queued.eta));
+        }
+        Ok(queued)
+    }
+
+    /// Remove an applied operation from the queue
+    pub fn complete(&mut self, sender: &AccountId, id: u64) {
+        self.queue.remove(&id);
+        env::log_str(&format!("EVENT: timelock_executed id={} by={}", id, sender));
+    }
+
+    /// Queued operations in queue order
+    pub fn get_queue(&self) -> Vec<QueuedOperation> {
+        let mut queued = self.queue.values().collect::<Vec<_>>();
+        queued.sort_by_key(|operation| operation.id);
+        queued
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use near_sdk::test_utils::VMContextBuilder;
+    use near_sdk::testing_env;
+
+    fn account(name: &str) -> AccountId {
+        name.parse().unwrap()
+    }
+
+    fn at_time(timestamp: u64) {
+        testing_env!(VMContextBuilder::new().block_timestamp(timestamp).build());
+    }
+
+    #[test]
+    fn test_operation_needs_approvals_and_delay() {
+        at_time(1_000);
+        let mut timelock = Timelock::new(vec![account("alice.near"), account("bob.near")], 2);
+        let mut flags = FeatureFlags::new(account("alice.near"));
+        let mut gov = GovernanceModule::new();
+
+        let id = timelock.queue(&account("alice.near"), AdminOperation::Pause {
+            module: "ibc".to_string(),
+            reason: "client migration".to_string(),
+        }).unwrap();
+        assert!(timelock.queue(&account("mallory.near"), AdminOperation::Unpause { module: "ibc".to_string() }).is_err());
+        assert!(timelock.execute(&account("alice.near"), id, &mut flags, &mut gov).is_err());
+
+        assert_eq!(timelock.approve(&account("bob.near"), id), Ok(2));
+        assert!(timelock.execute(&account("alice.near"), id, &mut flags, &mut gov).unwrap_err().contains("locked"));
+
+        at_time(1_000 + DEFAULT_TIMELOCK_DELAY_NS);
+        timelock.execute(&account("bob.near"), id, &mut flags, &mut gov).unwrap();
+        assert!(!flags.is_enabled("ibc"));
+        assert!(timelock.get_queue().is_empty());
+    }
+
+    #[test]
+    fn test_governance_cancels_and_params_are_validated() {
+        at_time(0);
+        let mut timelock = Timelock::new(vec![account("alice.near")], 1);
+        timelock.set_delay(&env::current_account_id(), 0).unwrap();
+        let mut flags = FeatureFlags::new(account("alice.near"));
+        let mut gov = GovernanceModule::new();
+
+        let override_param = |key: &str, value: &str| AdminOperation::OverrideParam {
+            key: key.to_string(),
+            value: value.to_string(),
+        };
+        let cancelled = timelock.queue(&account("alice.near"), override_param("reward_rate", "50")).unwrap();
+        let invalid = timelock.queue(&account("alice.near"), override_param("voting_period", "0")).unwrap();
+        let valid = timelock.queue(&account("alice.near"), override_param("reward_rate", "8")).unwrap();
+        assert_eq!(timelock.get_queue().len(), 3);
+
+        assert!(timelock.cancel(&account("alice.near"), cancelled).is_err());
+        timelock.cancel(&env::current_account_id(), cancelled).unwrap();
+
+        assert!(timelock.execute(&account("alice.near"), invalid, &mut flags, &mut gov).is_err());
+        timelock.execute(&account("alice.near"), valid, &mut flags, &mut gov).unwrap();
+        assert_eq!(gov.get_parameter(&"reward_rate".to_string()), "8");
+        assert_eq!(timelock.get_queue().iter().map(|queued| queued.id).collect::<Vec<_>>(), vec![invalid]);
+    }
+
+    #[test]
+    fn test_router_operations_are_applied_by_the_caller() {
+        at_time(0);
+        let mut timelock = Timelock::new(vec![account("alice.near")], 1);
+        timelock.set_delay(&env::current_account_id(), 0).unwrap();
+        let mut flags = FeatureFlags::new(account("alice.near"));
+        let mut gov = GovernanceModule::new();
+
+        let transfer = AdminOperation::TransferOwnership { new_owner: "bob.near".to_string() };
+        let id = timelock.queue(&account("alice.near"), transfer.clone()).unwrap();
+        let error = timelock.execute(&account("alice.near"), id, &mut flags, &mut gov).unwrap_err();
+        assert!(error.contains("applied by the router"));
+
+        assert_eq!(timelock.ready(&account("alice.near"), id).unwrap().operation, transfer);
+        timelock.complete(&account("alice.near"), id);
+        assert!(timelock.get_queue().is_empty());
+
+        timelock.replace_admin(&account("alice.near"), account("bob.near"));
+        assert!(timelock.queue(&account("alice.near"), transfer.clone()).is_err());
+        assert!(timelock.queue(&account("bob.near"), transfer).is_ok());
+    }
+}
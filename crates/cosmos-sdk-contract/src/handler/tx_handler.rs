@@ -1,7 +1,7 @@
 use crate::types::cosmos_tx::{CosmosTx, TxValidationError, SignDoc};
-use crate::handler::{TxDecoder, TxDecodingError, HandleResult, ContractError};
+use crate::handler::{TxDecoder, TxDecodingError, HandleResult, ContractError, GasMeter, GasSchedule, BatchOrdering};
 use crate::crypto::{CosmosSignatureVerifier, SignatureError, CosmosPublicKey};
-use crate::modules::auth::{AccountManager, AccountError, AccountConfig, FeeProcessor, FeeError, FeeConfig};
+use crate::modules::auth::{AccountManager, AccountError, AccountConfig, FeeProcessor, FeeError, FeeConfig, FeePolicy, SessionGrant, SessionKey};
 use near_sdk::serde::{Deserialize, Serialize};
 use near_sdk::borsh::{BorshDeserialize, BorshSerialize};
 use near_sdk::AccountId;
@@ -362,6 +362,10 @@ pub struct CosmosTransactionHandler {
     account_manager: AccountManager,
     /// Fee processor for Cosmos fee adaptation to NEAR gas
     fee_processor: FeeProcessor,
+    /// Gas costs charged per operation
+    gas_schedule: GasSchedule,
+    /// Order in which bundled transactions execute
+    batch_ordering: BatchOrdering,
 }
 
 impl CosmosTransactionHandler {
@@ -379,6 +383,8 @@ impl CosmosTransactionHandler {
             config,
             account_manager: AccountManager::new(account_config),
             fee_processor: FeeProcessor::new(FeeConfig::default()),
+            gas_schedule: GasSchedule::default(),
+            batch_ordering: BatchOrdering::default(),
         }
     }
     
@@ -394,6 +400,8 @@ impl CosmosTransactionHandler {
             config,
             account_manager: AccountManager::new(account_config),
             fee_processor: FeeProcessor::new(fee_config),
+            gas_schedule: GasSchedule::default(),
+            batch_ordering: BatchOrdering::default(),
         }
     }
 
@@ -420,8 +428,9 @@ impl CosmosTransactionHandler {
             self.check_account_sequences(&tx, &recovered_keys)?;
         }
 
-        // 5. Process transaction fees
-        let payer = if let (Some(_key), Some(address)) = (recovered_keys.get(0), self.account_manager.derive_addresses(&recovered_keys)?.get(0)) {
+        // 5. Process transaction fees, a session key's granter pays for it
+        let (signers, sessions) = self.authorize_session_signers(&tx, &recovered_keys)?;
+        let payer = if let Some(address) = signers.first() {
             address.clone()
         } else {
             // Fallback to first signer address if available
@@ -434,8 +443,12 @@ impl CosmosTransactionHandler {
         // 6. Process messages using the contract's message router
         let message_responses = self.process_transaction_messages_with_contract(&tx, contract)?;
 
-        // 7. Update account sequences after successful message processing
+        // 7. Update account sequences and session grants after successful
+        // message processing
         self.update_account_sequences(&tx, &recovered_keys)?;
+        for session in &sessions {
+            self.account_manager.commit_session(session);
+        }
 
         // 8. Create transaction response
         Ok(self.create_transaction_response(&tx, message_responses))
@@ -462,7 +475,8 @@ impl CosmosTransactionHandler {
         }
 
         // 5. Process fee payment (get payer address from first signer)
-        let payer = if let (Some(_key), Some(address)) = (recovered_keys.get(0), self.account_manager.derive_addresses(&recovered_keys)?.get(0)) {
+        let (signers, sessions) = self.authorize_session_signers(&tx, &recovered_keys)?;
+        let payer = if let Some(address) = signers.first() {
             address.clone()
         } else {
             // Fallback to a placeholder for tests
@@ -473,8 +487,12 @@ impl CosmosTransactionHandler {
         // 6. Process messages sequentially
         let message_responses = self.process_transaction_messages(&tx)?;
 
-        // 7. Update account sequences after successful message processing
+        // 7. Update account sequences and session grants after successful
+        // message processing
         self.update_account_sequences(&tx, &recovered_keys)?;
+        for session in &sessions {
+            self.account_manager.commit_session(session);
+        }
 
         // 8. Create transaction response
         Ok(self.create_transaction_response(&tx, message_responses))
@@ -577,6 +595,27 @@ impl CosmosTransactionHandler {
         Ok(())
     }
 
+    /// Accounts the signers act for, and the session keys to charge
+    ///
+    /// A signer holding a session key acts for the account that granted it;
+    /// the transaction is rejected if its messages do not fit the grant. The
+    /// returned charges are committed only once the messages succeeded.
+    fn authorize_session_signers(&self, tx: &CosmosTx, keys: &[CosmosPublicKey]) -> Result<(Vec<String>, Vec<SessionKey>), TxProcessingError> {
+        let now = near_sdk::env::block_timestamp();
+        let mut signers = Vec::with_capacity(keys.len());
+        let mut sessions = Vec::new();
+        for address in self.account_manager.derive_addresses(keys)? {
+            match self.account_manager.authorize_session_messages(&address, &tx.body.messages, now)? {
+                Some(session) => {
+                    signers.push(session.granter.clone());
+                    sessions.push(session);
+                }
+                None => signers.push(address),
+            }
+        }
+        Ok((signers, sessions))
+    }
+
     /// Process fee payment using the integrated fee processor
     pub fn process_transaction_fees(&mut self, tx: &CosmosTx, payer: &str) -> Result<u128, TxProcessingError> {
         // Use the fee processor to handle Cosmos → NEAR fee conversion
@@ -586,10 +625,12 @@ impl CosmosTransactionHandler {
             Some(tx.auth_info.fee.granter.as_str())
         };
         
-        let total_fee_yocto = self.fee_processor.process_transaction_fees(
+        let msg_types: Vec<&str> = tx.body.messages.iter().map(|msg| msg.type_url.as_str()).collect();
+        let total_fee_yocto = self.fee_processor.process_message_fees(
             &tx.auth_info.fee,
             payer,
             granter,
+            &msg_types,
         )?;
 
         Ok(total_fee_yocto)
@@ -701,23 +742,36 @@ impl CosmosTransactionHandler {
 
     /// Estimate actual gas usage based on transaction complexity and message results
     fn estimate_gas_usage(&self, tx: &CosmosTx, message_responses: &[HandleResult]) -> u64 {
-        let base_gas = 21000u64; // Base transaction cost
-        let per_message_gas = 5000u64; // Cost per message
-        let per_event_gas = 500u64; // Cost per event
-        let per_byte_gas = 10u64; // Cost per byte of data
-        
-        let message_gas = tx.body.messages.len() as u64 * per_message_gas;
-        let event_gas = message_responses.iter()
-            .map(|r| r.events.len() as u64 * per_event_gas)
-            .sum::<u64>();
-        let data_gas = message_responses.iter()
-            .map(|r| r.data.len() as u64 * per_byte_gas)
-            .sum::<u64>();
-        
-        let estimated_gas = base_gas + message_gas + event_gas + data_gas;
-        
-        // Cap at the gas limit specified in the transaction
-        std::cmp::min(estimated_gas, tx.auth_info.fee.gas_limit)
+        let schedule = &self.gas_schedule;
+        let event_count = message_responses.iter().map(|r| r.events.len() as u64).sum::<u64>();
+        let data_bytes = message_responses.iter().map(|r| r.data.len() as u64).sum::<u64>();
+
+        // The meter caps consumption at the gas limit of the transaction
+        let mut meter = GasMeter::new(tx.auth_info.fee.gas_limit, schedule.clone());
+        let _ = meter.consume(schedule.tx_base)
+            .and_then(|_| meter.consume(tx.body.messages.len() as u64 * schedule.per_message))
+            .and_then(|_| meter.consume(event_count * schedule.per_event))
+            .and_then(|_| meter.consume(data_bytes * schedule.per_data_byte))
+            .and_then(|_| meter.consume(tx.signatures.len() as u64 * schedule.signature_verify));
+        meter.consumed()
+    }
+
+    pub fn gas_schedule(&self) -> &GasSchedule {
+        &self.gas_schedule
+    }
+
+    /// Switch to the schedule governance activated
+    pub fn set_gas_schedule(&mut self, schedule: GasSchedule) {
+        self.gas_schedule = schedule;
+    }
+
+    pub fn batch_ordering(&self) -> BatchOrdering {
+        self.batch_ordering
+    }
+
+    /// Order used for bundles from here on
+    pub fn set_batch_ordering(&mut self, ordering: BatchOrdering) {
+        self.batch_ordering = ordering;
     }
 
     /// Create transaction response
@@ -856,6 +910,64 @@ impl CosmosTransactionHandler {
         self.account_manager.get_account_count()
     }
     
+    /// Bind a NEAR recovery account, authorized by a signature of the
+    /// account's current key
+    pub fn set_recovery_account(&mut self, address: &str, recovery_account: AccountId, signature: &[u8]) -> Result<(), AccountError> {
+        self.account_manager.set_recovery_account(&self.config.chain_id, address, recovery_account, signature)
+    }
+
+    /// Rotate the key of an account from its bound NEAR recovery account
+    pub fn recover_account(&mut self, caller: &AccountId, address: &str, new_public_key: CosmosPublicKey) -> Result<crate::modules::auth::CosmosAccount, AccountError> {
+        self.account_manager.recover_account(caller, address, new_public_key)
+    }
+    
+    /// Register a session key for an account, authorized by its current key
+    pub fn grant_session_key(&mut self, address: &str, session_key: CosmosPublicKey, grant: SessionGrant, signature: &[u8]) -> Result<String, AccountError> {
+        self.account_manager.grant_session_key(&self.config.chain_id, address, session_key, grant, signature)
+    }
+
+    /// Limit a NEAR function-call access key of the caller
+    pub fn grant_near_session_key(&mut self, owner: &AccountId, access_key: near_sdk::PublicKey, grant: SessionGrant) -> Result<String, AccountError> {
+        self.account_manager.grant_near_session_key(owner, access_key, grant)
+    }
+
+    pub fn revoke_session_key(&mut self, address: &str, id: &str, signature: &[u8]) -> Result<(), AccountError> {
+        self.account_manager.revoke_session_key(&self.config.chain_id, address, id, signature)
+    }
+
+    pub fn revoke_near_session_key(&mut self, owner: &AccountId, access_key: &near_sdk::PublicKey) -> Result<(), AccountError> {
+        self.account_manager.revoke_near_session_key(owner, access_key)
+    }
+
+    /// Check a NEAR call against the grant of the access key that signed it
+    ///
+    /// Contract methods moving funds for the caller pass
+    /// `env::predecessor_account_id()` and `env::signer_account_pk()`.
+    pub fn authorize_near_session(&mut self, owner: &AccountId, signer_key: &near_sdk::PublicKey, msg_type: &str, spend: &[(String, u128)]) -> Result<(), AccountError> {
+        self.account_manager.authorize_near_session(owner, signer_key, msg_type, spend)
+    }
+
+    pub fn session_keys_of(&self, granter: &str) -> Vec<SessionKey> {
+        self.account_manager.session_keys_of(granter)
+    }
+
+    /// Authenticate a query signed by the key of the account it reads
+    pub fn authenticate_query(&self, signed: &crate::modules::auth::SignedQuery, query: &str, params: &serde_json::Value) -> Result<String, AccountError> {
+        self.account_manager.verify_signed_query(signed, query, params, &self.config.chain_id)
+    }
+
+    /// Interchain account transactions of the signer pending on `connection_id`
+    pub fn pending_ica_txs(
+        &self,
+        signed: &crate::modules::auth::SignedQuery,
+        ica: &crate::modules::ibc::ica::IcaControllerModule,
+        connection_id: &str,
+    ) -> Result<Vec<crate::modules::ibc::ica::PendingIcaTx>, AccountError> {
+        let params = serde_json::json!({ "connection_id": connection_id });
+        let owner = self.authenticate_query(signed, "pending_ica_txs", &params)?;
+        Ok(ica.pending_txs(&owner).into_iter().filter(|tx| tx.connection_id == connection_id).collect())
+    }
+
     /// List accounts for admin purposes
     pub fn list_accounts(&self, limit: Option<usize>) -> Vec<crate::modules::auth::CosmosAccount> {
         self.account_manager.list_accounts(limit)
@@ -881,6 +993,21 @@ impl CosmosTransactionHandler {
         self.fee_processor.calculate_minimum_fee(gas_limit)
     }
 
+    /// Minimum fee for a transaction carrying messages of `msg_types`
+    pub fn calculate_minimum_fee_for_messages(&self, gas_limit: u64, msg_types: &[String]) -> crate::types::cosmos_tx::Fee {
+        self.fee_processor.calculate_minimum_fee_for_messages(gas_limit, msg_types)
+    }
+
+    /// Per message type fee adjustments in effect
+    pub fn fee_policy(&self) -> &FeePolicy {
+        self.fee_processor.fee_policy()
+    }
+
+    /// Switch to the fee policy governance activated
+    pub fn set_fee_policy(&mut self, policy: FeePolicy) {
+        self.fee_processor.set_fee_policy(policy);
+    }
+
     /// Estimate transaction cost in specific denomination
     pub fn estimate_tx_cost(&self, gas_limit: u64, denom: &str) -> Result<crate::types::cosmos_tx::Coin, FeeError> {
         self.fee_processor.estimate_tx_cost(gas_limit, denom)
@@ -1056,6 +1183,23 @@ mod tests {
         assert!(result.is_ok());
     }
 
+    #[test]
+    fn test_fee_policy_surcharge() {
+        let mut handler = CosmosTransactionHandler::new(TxProcessingConfig::default());
+        let tx = create_test_transaction();
+        handler.set_fee_policy(FeePolicy {
+            rules: vec![crate::modules::auth::MessageFeeRule {
+                msg_type: "/cosmos.bank.v1beta1.MsgSend".to_string(),
+                multiplier_bps: 10_000,
+                surcharge: 2_000_000_000_000_000_000_000,
+            }],
+        });
+
+        let result = handler.process_transaction_fees(&tx, "test_payer");
+        assert!(matches!(&result, Err(TxProcessingError::FeeError(msg)) if msg.starts_with("Insufficient fee")), "{:?}", result);
+        assert_eq!(handler.fee_policy().rules.len(), 1);
+    }
+
     #[test]
     fn test_transaction_simulation() {
         let config = TxProcessingConfig::default();
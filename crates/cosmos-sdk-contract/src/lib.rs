@@ -1,7 +1,10 @@
 // Modular Router Contract - Clean implementation without symbol conflicts
-use near_sdk::borsh::{BorshDeserialize, BorshSerialize};
-use near_sdk::{env, near_bindgen, AccountId, PanicOnDefault, Promise, ext_contract};
-use near_sdk::json_types::Base64VecU8;
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::{
+    assert_one_yocto, env, near_bindgen, require, AccountId, Gas, PanicOnDefault, Promise, PromiseOrValue, PromiseResult,
+    ext_contract,
+};
+use near_sdk::json_types::{Base64VecU8, U128};
 use std::collections::HashMap;
 use serde::{Deserialize, Serialize};
 use schemars::JsonSchema;
@@ -14,6 +17,34 @@ pub mod types;
 pub mod handler;
 pub mod crypto;
 pub mod contracts;
+pub mod schema;
+pub mod factory;
+pub mod math;
+pub mod chain_registry;
+
+use chain_registry::ChainRegistryInfo;
+use modules::auth::{AccountConfig, AccountManager, SessionGrant, SessionKey};
+use modules::auth::session::message_spend;
+use modules::bank::{
+    BankModule, Coins, NativeToken, SendRestriction, StorageBalance, StorageBalanceBounds, SupplyOfResponse,
+    FT_STORAGE_DEPOSIT, NATIVE_DENOM,
+};
+use modules::bank::supply::BANK_STORE;
+use modules::block::{BlockHeader, BlockModule, BlockResults, QueryEnvelope};
+use modules::keeper::{KeeperAction, KeeperModule};
+use modules::cosmwasm::types::{Querier, QueryRequest, Response as CosmWasmResponse};
+use modules::cosmwasm::{process_cosmwasm_response_with_router, ModuleQuerier};
+use modules::gov::{GovernanceModule, UpgradePlan, UPGRADE_CALLBACK_GAS};
+use modules::staking::StakingHooks;
+use factory::{ExportedGenesis, GenesisModule, InstanceGenesis, InstanceInfo, InstanceStatus};
+use handler::timelock::{AdminOperation, QueuedOperation, Timelock};
+use handler::tx_handler::TxResponse;
+use handler::{
+    create_event, execute_atomic, resolve_atomic_call, success_result, AtomicCallRequest, AtomicCallResult, AtomicCalls,
+    AtomicExecution, AtomicMsg, ContractError, CosmosMessageHandler, HandleResponse, HandleResult, MessageResult,
+};
+use types::cosmos_messages::*;
+use types::cosmos_tx::Any;
 
 // Cross-contract interface for WasmModule
 #[ext_contract(ext_wasm_module)]
@@ -97,7 +128,7 @@ pub struct Coin {
     pub amount: String,
 }
 
-#[derive(Serialize, Deserialize, Clone, Debug)]
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
 pub struct CodeInfo {
     pub code_id: u64,
     pub creator: String,
@@ -106,7 +137,7 @@ pub struct CodeInfo {
     pub builder: String,
 }
 
-#[derive(Serialize, Deserialize, Clone, Debug)]
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
 pub struct ContractInfo {
     pub address: String,
     pub code_id: u64,
@@ -130,6 +161,23 @@ trait ExtSelf {
     fn wasm_store_code_callback(&self) -> u64;
     fn wasm_instantiate_callback(&self) -> String;
     fn wasm_execute_callback(&self) -> serde_json::Value;
+    fn on_instance_created(&mut self, name: String, payer: AccountId, deposit: U128) -> bool;
+    fn on_upgrade_applied(&mut self, plan: UpgradePlan) -> bool;
+}
+
+/// Gas for the receiver's `ft_on_transfer`
+const GAS_FOR_FT_ON_TRANSFER: Gas = Gas::from_tgas(25);
+/// Gas for settling an `ft_transfer_call`
+const GAS_FOR_RESOLVE_TRANSFER: Gas = Gas::from_tgas(5);
+
+#[ext_contract(ext_ft_receiver)]
+pub trait FungibleTokenReceiver {
+    fn ft_on_transfer(&mut self, sender_id: AccountId, amount: U128, msg: String) -> PromiseOrValue<U128>;
+}
+
+#[ext_contract(ext_ft_resolver)]
+pub trait FungibleTokenResolver {
+    fn ft_resolve_transfer(&mut self, sender_id: AccountId, receiver_id: AccountId, amount: U128) -> U128;
 }
 
 // Router Contract Implementation
@@ -144,6 +192,39 @@ pub struct ModularCosmosRouter {
     registered_modules: HashMap<String, String>,
     /// Module versions (module_type -> version)
     module_versions: HashMap<String, String>,
+    /// Appchain instances created by this router (name -> info)
+    instances: HashMap<String, InstanceInfo>,
+    /// Height from which only `export_genesis` is available
+    halt_height: Option<u64>,
+    /// Details published through `chain_metadata`
+    chain_registry: ChainRegistryInfo,
+    /// Native token set at genesis
+    native_token: NativeToken,
+    /// NEAR deposited with the router as `unear`, moved by atomic calls
+    bank: BankModule,
+    /// Contracts allowed to make atomic calls, managed by the owner
+    atomic_calls: AtomicCalls,
+    /// Session grants limiting NEAR access keys of callers
+    accounts: AccountManager,
+    /// Holds the code upgrade passed by governance until its code is
+    /// submitted
+    governance: GovernanceModule,
+    /// Owner operations waiting out the delay set by governance
+    timelock: Timelock,
+    /// Headers of processed blocks, which query proofs lead to
+    blocks: BlockModule,
+    /// Rewards for the accounts that process blocks and prune them
+    keeper: KeeperModule,
+}
+
+/// Router state as laid out before instances, halts, deposits and upgrades
+/// were added; `migrate` converts it
+#[derive(BorshDeserialize, BorshSerialize)]
+struct RouterStateV1 {
+    owner: AccountId,
+    chain_id: String,
+    registered_modules: HashMap<String, String>,
+    module_versions: HashMap<String, String>,
 }
 
 #[near_bindgen]
@@ -151,23 +232,123 @@ impl ModularCosmosRouter {
     #[init]
     pub fn new() -> Self {
         let owner = env::current_account_id();
+        let chain_id = "near-localnet".to_string();
         Self {
+            atomic_calls: Self::atomic_calls_of(&owner),
+            timelock: Timelock::new(vec![owner.clone()], 1),
             owner,
-            chain_id: "near-localnet".to_string(),
+            blocks: BlockModule::new(chain_id.clone()),
+            keeper: KeeperModule::new(),
+            chain_id,
             registered_modules: HashMap::new(),
             module_versions: HashMap::new(),
+            instances: HashMap::new(),
+            halt_height: None,
+            chain_registry: ChainRegistryInfo::default(),
+            native_token: NativeToken::default(),
+            bank: BankModule::new(),
+            accounts: AccountManager::new(AccountConfig::default()),
+            governance: GovernanceModule::with_prefix(b"gov_"),
         }
     }
 
-    /// Register a module
-    pub fn register_module(&mut self, module_type: String, contract_id: String, version: String) -> bool {
-        // Only owner can register modules
-        assert_eq!(env::predecessor_account_id(), self.owner, "Only owner can register modules");
-        
-        self.registered_modules.insert(module_type.clone(), contract_id.clone());
-        self.module_versions.insert(module_type.clone(), version.clone());
-        env::log_str(&format!("Registered module: {} -> {} (v{})", module_type, contract_id, version));
-        true
+    /// Initialize an appchain instance created by a factory router
+    #[init]
+    pub fn new_instance(genesis: InstanceGenesis) -> Self {
+        factory::validate_genesis(&genesis).unwrap_or_else(|e| env::panic_str(&e));
+        env::log_str(&format!("Genesis hash: {}", factory::genesis_hash(&genesis)));
+
+        let native_token = genesis.native_token.unwrap_or_default();
+        let chain_registry = ChainRegistryInfo {
+            staking_denom: native_token.base_denom.clone(),
+            assets: vec![native_token.to_metadata()],
+            ..ChainRegistryInfo::default()
+        };
+
+        let mut registered_modules = HashMap::new();
+        let mut module_versions = HashMap::new();
+        for module in genesis.modules {
+            registered_modules.insert(module.module_type.clone(), module.contract_id);
+            module_versions.insert(module.module_type, module.version);
+        }
+
+        let owner: AccountId = genesis.owner.parse().unwrap_or_else(|_| env::panic_str("Invalid genesis owner"));
+        Self {
+            atomic_calls: Self::atomic_calls_of(&owner),
+            timelock: Timelock::new(vec![owner.clone()], 1),
+            owner,
+            blocks: BlockModule::new(genesis.chain_id.clone()),
+            keeper: KeeperModule::new(),
+            chain_id: genesis.chain_id,
+            registered_modules,
+            module_versions,
+            instances: HashMap::new(),
+            halt_height: None,
+            chain_registry,
+            native_token,
+            bank: BankModule::new(),
+            accounts: AccountManager::new(AccountConfig::default()),
+            governance: GovernanceModule::with_prefix(b"gov_"),
+        }
+    }
+
+    /// Keep the state of the previous code after an upgrade
+    ///
+    /// Called by `apply_upgrade` right after the new code is deployed. State
+    /// in the current layout is kept as it is; state of the first layout is
+    /// converted, with the fields added since then starting empty. A release
+    /// that changes the layout again adds its predecessor here.
+    #[private]
+    #[init(ignore_state)]
+    pub fn migrate() -> Self {
+        let state = env::storage_read(b"STATE").unwrap_or_else(|| env::panic_str("No state to migrate"));
+        if let Ok(current) = Self::try_from_slice(&state) {
+            return current;
+        }
+        let old = RouterStateV1::try_from_slice(&state)
+            .unwrap_or_else(|_| env::panic_str("Unknown router state layout"));
+        env::log_str("EVENT: state_migrated from=v1");
+        Self {
+            atomic_calls: Self::atomic_calls_of(&old.owner),
+            timelock: Timelock::new(vec![old.owner.clone()], 1),
+            owner: old.owner,
+            blocks: BlockModule::new(old.chain_id.clone()),
+            keeper: KeeperModule::new(),
+            chain_id: old.chain_id,
+            registered_modules: old.registered_modules,
+            module_versions: old.module_versions,
+            instances: HashMap::new(),
+            halt_height: None,
+            chain_registry: ChainRegistryInfo::default(),
+            native_token: NativeToken::default(),
+            bank: BankModule::new(),
+            accounts: AccountManager::new(AccountConfig::default()),
+            governance: GovernanceModule::with_prefix(b"gov_"),
+        }
+    }
+
+    /// The bank with the hooks of the other modules registered
+    ///
+    /// Hooks are not stored with the bank, so they are registered again on
+    /// the first use after the contract state is loaded.
+    fn bank_mut(&mut self) -> &mut BankModule {
+        if !self.bank.has_hooks() {
+            let staking_denom = self.chain_registry.staking_denom.clone();
+            self.bank.register_hooks(Box::new(StakingHooks::new(staking_denom)));
+        }
+        &mut self.bank
+    }
+
+    fn atomic_calls_of(owner: &AccountId) -> AtomicCalls {
+        let mut atomic_calls = AtomicCalls::new();
+        atomic_calls.set_authority(&env::current_account_id(), owner.clone())
+            .unwrap_or_else(|e| env::panic_str(&e));
+        atomic_calls
+    }
+
+    /// Queue registering a module, returning the timelock operation id
+    pub fn register_module(&mut self, module_type: String, contract_id: String, version: String) -> u64 {
+        self.queue_admin_operation(AdminOperation::RegisterModule { module_type, contract_id, version })
     }
 
     /// Get all registered modules with detailed info
@@ -224,6 +405,48 @@ impl ModularCosmosRouter {
         })
     }
 
+    /// Get the chain-registry `chain.json`, `assetlist.json` and `_IBC` documents
+    pub fn chain_metadata(&self) -> serde_json::Value {
+        chain_registry::chain_metadata(&self.chain_registry, &self.chain_id, env!("CARGO_PKG_VERSION"))
+    }
+
+    /// Native token denoms and decimals fixed at genesis
+    pub fn get_native_token(&self) -> NativeToken {
+        self.native_token.clone()
+    }
+
+    /// Publish the registry details wallets configure themselves from
+    pub fn set_chain_registry_info(&mut self, info: ChainRegistryInfo) {
+        self.assert_not_halted();
+        assert_eq!(env::predecessor_account_id(), self.owner, "Only owner can set chain registry info");
+        info.validate().unwrap_or_else(|e| env::panic_str(&e));
+        self.chain_registry = info;
+        env::log_str(&format!("EVENT: chain_registry_updated chain_name={}", self.chain_registry.chain_name));
+    }
+
+    /// Get JSON Schemas of every entrypoint's arguments and return value
+    pub fn contract_metadata(&self) -> serde_json::Value {
+        let entrypoints: serde_json::Map<String, serde_json::Value> = schema::entrypoint_schemas()
+            .into_iter()
+            .map(|entrypoint| {
+                let name = entrypoint.name.clone();
+                (name, serde_json::to_value(entrypoint).unwrap_or_default())
+            })
+            .collect();
+
+        serde_json::json!({
+            "name": "Modular Cosmos SDK Router",
+            "version": env!("CARGO_PKG_VERSION"),
+            "schema_version": schema::SCHEMA_VERSION,
+            "entrypoints": entrypoints
+        })
+    }
+
+    /// Get the manifest of read-only view methods and state-changing calls
+    pub fn views_manifest(&self) -> schema::ViewManifest {
+        schema::view_manifest()
+    }
+
     /// Test function
     pub fn test_function(&self) -> String {
         format!("Modular Router is working! Registered modules: {}", self.registered_modules.len())
@@ -234,14 +457,9 @@ impl ModularCosmosRouter {
         self.owner.clone()
     }
 
-    /// Transfer ownership
-    pub fn transfer_ownership(&mut self, new_owner: AccountId) {
-        assert_eq!(env::predecessor_account_id(), self.owner, "Only owner can transfer ownership");
-        
-        let old_owner = self.owner.clone();
-        self.owner = new_owner.clone();
-        
-        env::log_str(&format!("Ownership transferred: {} -> {}", old_owner, new_owner));
+    /// Queue an ownership transfer, returning the timelock operation id
+    pub fn transfer_ownership(&mut self, new_owner: AccountId) -> u64 {
+        self.queue_admin_operation(AdminOperation::TransferOwnership { new_owner: new_owner.to_string() })
     }
 
     /// Get contract statistics
@@ -254,6 +472,700 @@ impl ModularCosmosRouter {
         })
     }
 
+    // Chain halt methods
+
+    /// Halt all state-changing entrypoints from `height` on, for a
+    /// coordinated fork or redeployment
+    pub fn schedule_halt(&mut self, height: u64) {
+        self.assert_not_halted();
+        self.assert_halt_authority();
+        assert!(height > env::block_height(), "Halt height must be in the future");
+
+        self.halt_height = Some(height);
+        env::log_str(&format!("EVENT: halt_scheduled height={}", height));
+    }
+
+    /// Cancel a scheduled halt before it is reached
+    pub fn cancel_halt(&mut self) {
+        self.assert_not_halted();
+        self.assert_halt_authority();
+        let height = self.halt_height.take().unwrap_or_else(|| env::panic_str("No halt scheduled"));
+        env::log_str(&format!("EVENT: halt_cancelled height={}", height));
+    }
+
+    /// Get the scheduled halt height
+    pub fn get_halt_height(&self) -> Option<u64> {
+        self.halt_height
+    }
+
+    /// Export the router state as an instance genesis once halted
+    pub fn export_genesis(&self) -> ExportedGenesis {
+        let height = self.halt_height
+            .filter(|height| env::block_height() >= *height)
+            .unwrap_or_else(|| env::panic_str("Genesis can only be exported once the chain is halted"));
+
+        let mut modules: Vec<GenesisModule> = self.registered_modules.iter()
+            .map(|(module_type, contract_id)| GenesisModule {
+                module_type: module_type.clone(),
+                contract_id: contract_id.clone(),
+                version: self.get_module_version(module_type.clone()),
+            })
+            .collect();
+        modules.sort_by(|a, b| a.module_type.cmp(&b.module_type));
+
+        let genesis = InstanceGenesis {
+            chain_id: self.chain_id.clone(),
+            owner: self.owner.to_string(),
+            modules,
+            native_token: Some(self.native_token.clone()).filter(|token| *token != NativeToken::default()),
+        };
+        ExportedGenesis {
+            height,
+            genesis_hash: factory::genesis_hash(&genesis),
+            genesis,
+        }
+    }
+
+    // Upgrade methods
+
+    /// Record a code upgrade passed by the governance module
+    pub fn approve_upgrade(&mut self, plan: UpgradePlan) {
+        self.assert_not_halted();
+        let caller = env::predecessor_account_id();
+        let is_gov = self.registered_modules.get("gov").map_or(false, |gov| gov == caller.as_str());
+        assert!(is_gov, "Only governance can approve upgrades");
+        let name = plan.name.clone();
+        let code_hash = plan.code_hash.clone();
+        self.governance.approve_upgrade(plan).unwrap_or_else(|e| env::panic_str(&e));
+        env::log_str(&format!("EVENT: upgrade_approved name={} code_hash={}", name, code_hash));
+    }
+
+    /// Get the upgrade waiting for its code
+    pub fn get_pending_upgrade(&self) -> Option<UpgradePlan> {
+        self.governance.get_pending_upgrade()
+    }
+
+    /// Deploy the code of the approved upgrade and migrate the state
+    ///
+    /// Anyone may submit the code; it must hash to the approved value. If the
+    /// deployment or the migration fails, `on_upgrade_applied` puts the
+    /// upgrade back so the code can be submitted again.
+    pub fn apply_upgrade(&mut self, code: Base64VecU8) -> Promise {
+        self.assert_not_halted();
+        let plan = self.governance.get_pending_upgrade()
+            .unwrap_or_else(|| env::panic_str("No upgrade approved by governance"));
+        self.governance.apply_upgrade(code.into())
+            .unwrap_or_else(|e| env::panic_str(&e))
+            .then(
+                ext_self::ext(env::current_account_id())
+                    .with_static_gas(UPGRADE_CALLBACK_GAS)
+                    .on_upgrade_applied(plan),
+            )
+    }
+
+    /// Restore the pending upgrade if its deployment failed
+    #[private]
+    pub fn on_upgrade_applied(&mut self, plan: UpgradePlan) -> bool {
+        let applied = matches!(env::promise_result(0), PromiseResult::Successful(_));
+        if !applied {
+            self.governance.restore_upgrade(plan);
+        }
+        applied
+    }
+
+    // Timelocked owner methods
+
+    /// Queue an owner operation, returning its id
+    ///
+    /// It runs through `execute_admin_operation` once it has the approvals
+    /// of the timelock admins and the delay set by governance has passed.
+    /// `Migrate` approves a code upgrade without a proposal.
+    pub fn queue_admin_operation(&mut self, operation: AdminOperation) -> u64 {
+        self.assert_not_halted();
+        match &operation {
+            AdminOperation::Pause { .. } | AdminOperation::Unpause { .. } => {
+                env::panic_str("The router has no module flags to pause; schedule a halt instead")
+            }
+            AdminOperation::Migrate { plan } => plan.validate().unwrap_or_else(|e| env::panic_str(&e)),
+            AdminOperation::TransferOwnership { new_owner } => {
+                new_owner.parse::<AccountId>().unwrap_or_else(|_| env::panic_str("Invalid new owner"));
+            }
+            AdminOperation::CreateInstance { name, genesis } => {
+                factory::instance_account_id(name, &env::current_account_id()).unwrap_or_else(|e| env::panic_str(&e));
+                factory::validate_genesis(genesis).unwrap_or_else(|e| env::panic_str(&e));
+            }
+            AdminOperation::OverrideParam { .. } | AdminOperation::RegisterModule { .. } | AdminOperation::SetInstanceCode { .. } => {}
+        }
+        self.timelock.queue(&env::predecessor_account_id(), operation)
+            .unwrap_or_else(|e| env::panic_str(&e))
+    }
+
+    /// Approve a queued owner operation, returning its approval count
+    pub fn approve_admin_operation(&mut self, id: u64) -> u32 {
+        self.assert_not_halted();
+        self.timelock.approve(&env::predecessor_account_id(), id)
+            .unwrap_or_else(|e| env::panic_str(&e))
+    }
+
+    /// Apply a queued owner operation whose delay passed
+    ///
+    /// `SetInstanceCode` takes the instance code in `code`, which must hash
+    /// to the queued value; `CreateInstance` takes the instance deposit.
+    #[payable]
+    pub fn execute_admin_operation(&mut self, id: u64, code: Option<Base64VecU8>) -> PromiseOrValue<bool> {
+        self.assert_not_halted();
+        let caller = env::predecessor_account_id();
+        let queued = self.timelock.ready(&caller, id).unwrap_or_else(|e| env::panic_str(&e));
+        if !matches!(queued.operation, AdminOperation::CreateInstance { .. }) {
+            require!(env::attached_deposit().is_zero(), "Only instance creation takes a deposit");
+        }
+
+        let result = match queued.operation {
+            AdminOperation::TransferOwnership { new_owner } => {
+                let new_owner: AccountId = new_owner.parse().unwrap_or_else(|_| env::panic_str("Invalid new owner"));
+                let old_owner = std::mem::replace(&mut self.owner, new_owner.clone());
+                self.atomic_calls.set_authority(&old_owner, new_owner.clone())
+                    .unwrap_or_else(|e| env::panic_str(&e));
+                self.timelock.replace_admin(&old_owner, new_owner.clone());
+                env::log_str(&format!("Ownership transferred: {} -> {}", old_owner, new_owner));
+                PromiseOrValue::Value(true)
+            }
+            AdminOperation::RegisterModule { module_type, contract_id, version } => {
+                self.registered_modules.insert(module_type.clone(), contract_id.clone());
+                self.module_versions.insert(module_type.clone(), version.clone());
+                env::log_str(&format!("Registered module: {} -> {} (v{})", module_type, contract_id, version));
+                PromiseOrValue::Value(true)
+            }
+            AdminOperation::SetInstanceCode { code_hash } => {
+                let code = code.unwrap_or_else(|| env::panic_str("Submit the instance code with the operation"));
+                let hash = modules::gov::code_hash(&code.0);
+                if hash != code_hash.to_lowercase() {
+                    env::panic_str(&format!("Code hash {} does not match queued hash {}", hash, code_hash));
+                }
+                env::storage_write(factory::INSTANCE_CODE_KEY, &code.0);
+                env::log_str(&format!("Instance code set: {} bytes", code.0.len()));
+                PromiseOrValue::Value(true)
+            }
+            AdminOperation::CreateInstance { name, genesis } => {
+                PromiseOrValue::Promise(self.create_instance_promise(name, genesis))
+            }
+            AdminOperation::Migrate { plan } => {
+                self.governance.approve_upgrade(plan).unwrap_or_else(|e| env::panic_str(&e));
+                PromiseOrValue::Value(true)
+            }
+            AdminOperation::OverrideParam { key, value } => {
+                self.governance.override_parameter(&key, &value).unwrap_or_else(|e| env::panic_str(&e));
+                PromiseOrValue::Value(true)
+            }
+            AdminOperation::Pause { .. } | AdminOperation::Unpause { .. } => {
+                env::panic_str("The router has no module flags to pause")
+            }
+        };
+        self.timelock.complete(&caller, id);
+        result
+    }
+
+    /// Drop a queued owner operation; governance's veto
+    pub fn cancel_admin_operation(&mut self, id: u64) {
+        self.assert_timelock_governance();
+        self.timelock.cancel(&self.timelock.authority(), id)
+            .unwrap_or_else(|e| env::panic_str(&e));
+    }
+
+    /// Set how long owner operations wait; applies to operations queued
+    /// afterwards
+    pub fn set_admin_delay(&mut self, delay_ns: u64) {
+        self.assert_timelock_governance();
+        self.timelock.set_delay(&self.timelock.authority(), delay_ns)
+            .unwrap_or_else(|e| env::panic_str(&e));
+    }
+
+    /// Owner operations waiting in the timelock
+    pub fn get_admin_operations(&self) -> Vec<QueuedOperation> {
+        self.timelock.get_queue()
+    }
+
+    pub fn get_admin_delay(&self) -> u64 {
+        self.timelock.delay_ns()
+    }
+
+    /// Move deposits for the NEP-141 facade
+    ///
+    /// Deposits carry no send restrictions; atomic calls move them freely
+    /// too.
+    fn ft_transfer_deposit(&mut self, sender_id: &AccountId, receiver_id: &AccountId, amount: Balance, memo: Option<String>) {
+        self.bank_mut().ft_transfer(&NoRestriction, NATIVE_DENOM, sender_id, receiver_id, amount, memo)
+            .unwrap_or_else(|e| env::panic_str(&e));
+    }
+
+    fn assert_not_halted(&self) {
+        if let Some(height) = self.halt_height.filter(|height| env::block_height() >= *height) {
+            env::panic_str(&format!("Chain halted at height {}; only export_genesis and withdraw are available", height));
+        }
+    }
+
+    /// The registered governance module controls the timelock; until one is
+    /// registered, the router account itself does
+    fn assert_timelock_governance(&self) {
+        assert!(self.is_governance(&env::predecessor_account_id()), "Only governance can change the timelock");
+    }
+
+    /// Whether `caller` is the registered governance module, or the router
+    /// account while none is registered
+    fn is_governance(&self, caller: &AccountId) -> bool {
+        match self.registered_modules.get("gov") {
+            Some(gov) => gov == caller.as_str(),
+            None => caller == &env::current_account_id(),
+        }
+    }
+
+    /// The owner or the registered governance module may schedule halts
+    fn assert_halt_authority(&self) {
+        let caller = env::predecessor_account_id();
+        let is_gov = self.registered_modules.get("gov").map_or(false, |gov| gov == caller.as_str());
+        assert!(caller == self.owner || is_gov, "Only owner or governance can schedule a halt");
+    }
+
+    // Instance factory methods
+
+    /// Queue setting the router code deployed to new instances
+    ///
+    /// The code itself is submitted to `execute_admin_operation` and must
+    /// hash to `code_hash`, the hex encoded SHA-256 of the code.
+    pub fn set_instance_code(&mut self, code_hash: String) -> u64 {
+        self.queue_admin_operation(AdminOperation::SetInstanceCode { code_hash })
+    }
+
+    /// Queue creating an appchain instance as a sub-account running its own
+    /// router; the deposit is attached to `execute_admin_operation`
+    pub fn create_instance(&mut self, name: String, genesis: InstanceGenesis) -> u64 {
+        self.queue_admin_operation(AdminOperation::CreateInstance { name, genesis })
+    }
+
+    fn create_instance_promise(&mut self, name: String, genesis: InstanceGenesis) -> Promise {
+        assert!(
+            env::attached_deposit() >= factory::MIN_INSTANCE_DEPOSIT,
+            "Attach at least {} to create an instance", factory::MIN_INSTANCE_DEPOSIT
+        );
+        if self.instances.get(&name).map_or(false, |info| info.status != InstanceStatus::Failed) {
+            env::panic_str("Instance already exists");
+        }
+        factory::validate_genesis(&genesis).unwrap_or_else(|e| env::panic_str(&e));
+
+        let account_id = factory::instance_account_id(&name, &env::current_account_id())
+            .unwrap_or_else(|e| env::panic_str(&e));
+        let code = env::storage_read(factory::INSTANCE_CODE_KEY)
+            .unwrap_or_else(|| env::panic_str("Instance code not set"));
+        let init_args = serde_json::to_vec(&serde_json::json!({ "genesis": genesis }))
+            .unwrap_or_else(|_| env::panic_str("Failed to encode genesis"));
+
+        self.instances.insert(name.clone(), InstanceInfo {
+            account_id: account_id.to_string(),
+            chain_id: genesis.chain_id.clone(),
+            owner: genesis.owner.clone(),
+            created_at: env::block_timestamp(),
+            status: InstanceStatus::Pending,
+        });
+        env::log_str(&format!("Creating instance {} at {} (chain {})", name, account_id, genesis.chain_id));
+
+        Promise::new(account_id)
+            .create_account()
+            .transfer(env::attached_deposit())
+            .deploy_contract(code)
+            .function_call(
+                "new_instance".to_string(),
+                init_args,
+                near_sdk::NearToken::from_yoctonear(0),
+                factory::INSTANCE_INIT_GAS,
+            )
+            .then(
+                ext_self::ext(env::current_account_id())
+                    .with_static_gas(factory::INSTANCE_CALLBACK_GAS)
+                    .on_instance_created(name, env::predecessor_account_id(), U128(env::attached_deposit().as_yoctonear())),
+            )
+    }
+
+    /// Record the outcome of an instance creation
+    ///
+    /// A failed creation rolls back the whole batch and NEAR returns the
+    /// deposit to the router, which passes it on to `payer`.
+    #[private]
+    pub fn on_instance_created(&mut self, name: String, payer: AccountId, deposit: U128) -> bool {
+        let created = matches!(env::promise_result(0), near_sdk::PromiseResult::Successful(_));
+        if let Some(info) = self.instances.get_mut(&name) {
+            info.status = if created { InstanceStatus::Active } else { InstanceStatus::Failed };
+        }
+        if created {
+            env::log_str(&format!("Instance {} created", name));
+        } else {
+            env::log_str(&format!("Instance {} creation failed, refunding {} to {}", name, deposit.0, payer));
+            Promise::new(payer).transfer(near_sdk::NearToken::from_yoctonear(deposit.0));
+        }
+        created
+    }
+
+    /// Get an appchain instance by name
+    pub fn get_instance(&self, name: String) -> Option<InstanceInfo> {
+        self.instances.get(&name).cloned()
+    }
+
+    /// Get all appchain instances (name -> info)
+    pub fn get_instances(&self) -> HashMap<String, InstanceInfo> {
+        self.instances.clone()
+    }
+
+    // Atomic call methods
+
+    /// Deposit the attached NEAR as `unear` for atomic calls to spend
+    #[payable]
+    pub fn deposit(&mut self) -> U128 {
+        self.assert_not_halted();
+        let account = env::predecessor_account_id();
+        let amount = env::attached_deposit().as_yoctonear();
+        assert!(amount > 0, "Attach the NEAR to deposit");
+        self.bank_mut().mint_with_reason(&account, NATIVE_DENOM, amount, "router", "deposit");
+        U128(self.bank.get_denom_balance(&account, NATIVE_DENOM))
+    }
+
+    /// Withdraw deposited `unear` as NEAR
+    ///
+    /// Not limited by session grants, the funds only go back to the caller.
+    /// Stays open after a halt: `export_genesis` does not carry bank
+    /// balances, so deposits would otherwise be stranded in the old router.
+    pub fn withdraw(&mut self, amount: U128) -> Promise {
+        let account = env::predecessor_account_id();
+        if self.bank.get_spendable_balance(&account, NATIVE_DENOM) < amount.0 {
+            env::panic_str("Insufficient deposit");
+        }
+        self.bank_mut().burn_with_reason(&account, NATIVE_DENOM, amount.0, "router", "withdraw");
+        Promise::new(account).transfer(near_sdk::NearToken::from_yoctonear(amount.0))
+    }
+
+    /// Get the deposited balance of an account
+    pub fn get_deposit(&self, account_id: AccountId) -> U128 {
+        U128(self.bank.get_denom_balance(&account_id, NATIVE_DENOM))
+    }
+
+    // NEP-141 facade over the deposits, so NEAR wallets and DEXes can show
+    // and move deposited `unear` like any other token
+
+    #[payable]
+    pub fn ft_transfer(&mut self, receiver_id: AccountId, amount: U128, memo: Option<String>) {
+        assert_one_yocto();
+        self.assert_not_halted();
+        self.ft_transfer_deposit(&env::predecessor_account_id(), &receiver_id, amount.0, memo);
+    }
+
+    /// Transfer and call `ft_on_transfer` on the receiver, which returns the
+    /// amount it did not use to be refunded
+    #[payable]
+    pub fn ft_transfer_call(
+        &mut self,
+        receiver_id: AccountId,
+        amount: U128,
+        memo: Option<String>,
+        msg: String,
+    ) -> PromiseOrValue<U128> {
+        assert_one_yocto();
+        self.assert_not_halted();
+        require!(
+            env::prepaid_gas() > GAS_FOR_FT_ON_TRANSFER.saturating_add(GAS_FOR_RESOLVE_TRANSFER),
+            "More gas is required"
+        );
+        let sender_id = env::predecessor_account_id();
+        self.ft_transfer_deposit(&sender_id, &receiver_id, amount.0, memo);
+
+        ext_ft_receiver::ext(receiver_id.clone())
+            .with_static_gas(GAS_FOR_FT_ON_TRANSFER)
+            .ft_on_transfer(sender_id.clone(), amount, msg)
+            .then(
+                ext_ft_resolver::ext(env::current_account_id())
+                    .with_static_gas(GAS_FOR_RESOLVE_TRANSFER)
+                    .ft_resolve_transfer(sender_id, receiver_id, amount),
+            )
+            .into()
+    }
+
+    /// Refund what the receiver of an `ft_transfer_call` did not use,
+    /// returning the amount it kept
+    ///
+    /// Runs after a halt too, so a transfer in flight is still settled.
+    #[private]
+    pub fn ft_resolve_transfer(&mut self, sender_id: AccountId, receiver_id: AccountId, amount: U128) -> U128 {
+        let unused = match env::promise_result(0) {
+            PromiseResult::Successful(value) => serde_json::from_slice::<U128>(&value).map_or(amount.0, |unused| unused.0),
+            _ => amount.0,
+        };
+        U128(self.bank_mut().ft_resolve_transfer(NATIVE_DENOM, &sender_id, &receiver_id, amount.0, unused))
+    }
+
+    /// Supply of a denom, with the height it was read at and, when `prove`
+    /// is set, an ICS-23 proof up to the latest committed app hash
+    pub fn supply_of(&self, denom: String, prove: Option<bool>) -> QueryEnvelope<SupplyOfResponse> {
+        self.bank.query_supply_of(&denom, &self.blocks, prove.unwrap_or(false))
+            .unwrap_or_else(|e| env::panic_str(&e))
+    }
+
+    pub fn ft_total_supply(&self) -> U128 {
+        U128(self.bank.supply_of(NATIVE_DENOM))
+    }
+
+    pub fn ft_balance_of(&self, account_id: AccountId) -> U128 {
+        U128(self.bank.get_denom_balance(&account_id, NATIVE_DENOM))
+    }
+
+    /// NEP-145 registration, refunding whatever exceeds the fixed deposit
+    ///
+    /// The deposit is fixed, so `registration_only` makes no difference.
+    #[payable]
+    pub fn storage_deposit(&mut self, account_id: Option<AccountId>, registration_only: Option<bool>) -> StorageBalance {
+        let _ = registration_only;
+        self.assert_not_halted();
+        let deposit = env::attached_deposit().as_yoctonear();
+        let account_id = account_id.unwrap_or_else(env::predecessor_account_id);
+
+        let refund = if self.bank.ft_is_registered(NATIVE_DENOM, &account_id) {
+            deposit
+        } else {
+            require!(deposit >= FT_STORAGE_DEPOSIT, "The attached deposit is less than the minimum storage balance");
+            self.bank.ft_register_account(NATIVE_DENOM, &account_id);
+            deposit - FT_STORAGE_DEPOSIT
+        };
+        if refund > 0 {
+            Promise::new(env::predecessor_account_id()).transfer(near_sdk::NearToken::from_yoctonear(refund));
+        }
+        self.storage_balance_of(account_id).expect("Account is registered")
+    }
+
+    /// Give up the registration and get the deposit back; `force` burns a
+    /// remaining deposit
+    #[payable]
+    pub fn storage_unregister(&mut self, force: Option<bool>) -> bool {
+        assert_one_yocto();
+        self.assert_not_halted();
+        let account_id = env::predecessor_account_id();
+        let unregistered = self.bank_mut().ft_unregister_account(NATIVE_DENOM, &account_id, force.unwrap_or(false))
+            .unwrap_or_else(|e| env::panic_str(&e));
+        if unregistered {
+            Promise::new(account_id).transfer(near_sdk::NearToken::from_yoctonear(FT_STORAGE_DEPOSIT));
+        }
+        unregistered
+    }
+
+    pub fn storage_balance_of(&self, account_id: AccountId) -> Option<StorageBalance> {
+        if self.bank.ft_has_deposit(NATIVE_DENOM, &account_id) {
+            Some(StorageBalance { total: U128(FT_STORAGE_DEPOSIT), available: U128(0) })
+        } else if self.bank.ft_is_registered(NATIVE_DENOM, &account_id) {
+            Some(StorageBalance { total: U128(0), available: U128(0) })
+        } else {
+            None
+        }
+    }
+
+    pub fn storage_balance_bounds(&self) -> StorageBalanceBounds {
+        StorageBalanceBounds::fixed()
+    }
+
+    /// Allow a contract to make atomic calls
+    pub fn allow_atomic_caller(&mut self, caller: AccountId) {
+        self.assert_not_halted();
+        self.atomic_calls.allow_caller(&env::predecessor_account_id(), caller)
+            .unwrap_or_else(|e| env::panic_str(&e));
+    }
+
+    pub fn remove_atomic_caller(&mut self, caller: AccountId) {
+        self.assert_not_halted();
+        self.atomic_calls.remove_caller(&env::predecessor_account_id(), &caller)
+            .unwrap_or_else(|e| env::panic_str(&e));
+    }
+
+    /// Get the contracts allowed to make atomic calls
+    pub fn get_atomic_callers(&self) -> Vec<AccountId> {
+        self.atomic_calls.get_callers()
+    }
+
+    /// Run `messages` for the calling contract as one unit of work
+    ///
+    /// The messages execute in a receipt of their own that commits whole or
+    /// rolls back; `callback`, if given, is called on the caller with the
+    /// `AtomicCallResult`.
+    pub fn atomic_call(&mut self, messages: Vec<AtomicMsg>, callback: Option<String>) -> Promise {
+        self.assert_not_halted();
+        let request = AtomicCallRequest { messages, callback };
+        let execution = self.atomic_calls.begin(&env::predecessor_account_id(), &request)
+            .unwrap_or_else(|e| env::panic_str(&e));
+        AtomicCalls::schedule(&execution, request.callback)
+    }
+
+    /// Execute the messages of an atomic call, panicking on the first
+    /// failure so none of them take effect
+    ///
+    /// A call signed with an access key the caller granted a session to is
+    /// charged to that grant, together with the messages.
+    #[private]
+    pub fn atomic_execute(&mut self, execution: AtomicExecution) -> Vec<HandleResponse> {
+        let signer_key = env::signer_account_pk();
+        for msg in &execution.messages {
+            let (_, spend) = message_spend(&Any::new(&msg.type_url, msg.value.0.clone()))
+                .unwrap_or_else(|e| env::panic_str(&e.to_string()));
+            self.accounts.authorize_near_session(&execution.caller, &signer_key, &msg.type_url, &spend)
+                .unwrap_or_else(|e| env::panic_str(&e.to_string()));
+        }
+        match execute_atomic(self, &execution) {
+            Ok(responses) => responses,
+            Err(failure) => failure.abort(&execution.messages[failure.index].type_url),
+        }
+    }
+
+    /// Report the outcome of an atomic call to its caller
+    #[private]
+    pub fn on_atomic_call(&mut self, call_id: u64, caller: AccountId, callback: Option<String>) -> AtomicCallResult {
+        let result = resolve_atomic_call(call_id, &caller, callback, env::promise_result(0));
+        let height = self.next_tx_height();
+        self.record_tx(height, result.to_tx_response(height));
+        result
+    }
+
+    // Blocks
+
+    /// Commit a header for the current NEAR block
+    ///
+    /// Open to anyone; keepers call it once per block and earn the
+    /// `process_block` reward. The app hash commits the bank supply. The
+    /// router holds no validator set, so the validators hash is that of an
+    /// empty set. A block whose transactions are still missing a header is
+    /// committed first.
+    pub fn process_block(&mut self) -> BlockHeader {
+        self.assert_not_halted();
+        self.commit_pending_block();
+        let header = self.blocks.commit_block(&self.store_hashes(), &[])
+            .unwrap_or_else(|e| env::panic_str(&e));
+        env::log_str(&format!("EVENT: block_processed height={} app_hash={}", header.height, header.app_hash));
+        self.keeper.reward(env::predecessor_account_id().as_str(), KeeperAction::ProcessBlock, header.height);
+        header
+    }
+
+    /// Drop headers beyond the retention that blocks left over, returning
+    /// how many headers and transaction hashes were dropped
+    ///
+    /// Open to anyone; a call that drops something earns the `prune` reward.
+    pub fn prune_blocks(&mut self) -> u64 {
+        self.assert_not_halted();
+        let pruned = self.blocks.prune();
+        if pruned > 0 {
+            self.keeper.reward(env::predecessor_account_id().as_str(), KeeperAction::Prune, env::block_height());
+        }
+        pruned
+    }
+
+    /// Set how many block headers are kept, governance only
+    ///
+    /// Lowering it prunes one batch right away and leaves the rest to
+    /// `prune_blocks` and the next blocks.
+    pub fn set_block_retention(&mut self, retention: u64) {
+        assert!(self.is_governance(&env::predecessor_account_id()), "Only governance can set the block retention");
+        self.blocks.set_retention(retention).unwrap_or_else(|e| env::panic_str(&e));
+    }
+
+    pub fn get_block_retention(&self) -> u64 {
+        self.blocks.retention()
+    }
+
+    // Keeper rewards
+
+    /// Add the attached deposit to the keeper reward fund
+    #[payable]
+    pub fn fund_keeper(&mut self) {
+        self.assert_not_halted();
+        self.keeper.fund(env::attached_deposit().as_yoctonear());
+    }
+
+    pub fn get_keeper_earned(&self, keeper: AccountId) -> U128 {
+        U128(self.keeper.get_earned(keeper.as_str()))
+    }
+
+    pub fn get_keeper_fund(&self) -> U128 {
+        U128(self.keeper.fund_balance())
+    }
+
+    /// Pay out the caller's keeper rewards
+    ///
+    /// Stays open after a halt, like `withdraw`.
+    pub fn withdraw_keeper_rewards(&mut self) -> Promise {
+        let keeper = env::predecessor_account_id();
+        let earned = self.keeper.withdraw(keeper.as_str()).unwrap_or_else(|e| env::panic_str(&e));
+        Promise::new(keeper).transfer(near_sdk::NearToken::from_yoctonear(earned))
+    }
+
+    pub fn block(&self, height: u64) -> Option<BlockHeader> {
+        self.blocks.block(height)
+    }
+
+    pub fn latest_block(&self) -> Option<BlockHeader> {
+        self.blocks.latest_block()
+    }
+
+    /// Transactions of a block, including atomic calls
+    pub fn block_results(&self, height: u64) -> Option<BlockResults> {
+        self.blocks.block_results(height)
+    }
+
+    /// Store hashes the app hash of a block commits
+    fn store_hashes(&self) -> Vec<(String, Vec<u8>)> {
+        vec![(BANK_STORE.to_string(), self.bank.store_hash())]
+    }
+
+    fn commit_pending_block(&mut self) {
+        let store_hashes = self.store_hashes();
+        let committed = self.blocks.commit_pending_block(&store_hashes, &[])
+            .unwrap_or_else(|e| env::panic_str(&e));
+        if let Some(header) = committed {
+            env::log_str(&format!("EVENT: block_processed height={} app_hash={}", header.height, header.app_hash));
+        }
+    }
+
+    /// Height of the block the next transaction is indexed in: the current
+    /// one, or the next if `process_block` already committed it
+    ///
+    /// Commits an earlier block still missing its header first.
+    fn next_tx_height(&mut self) -> u64 {
+        self.commit_pending_block();
+        env::block_height().max(self.blocks.latest_height() + 1)
+    }
+
+    /// Index a transaction; failing to index it leaves the transaction as
+    /// it is
+    fn record_tx(&mut self, height: u64, response: TxResponse) {
+        if let Err(e) = self.blocks.record_tx_response(height, &response) {
+            env::log_str(&format!("Block: transaction {} not indexed: {}", response.txhash, e));
+        }
+    }
+
+    /// Limit what an access key of the caller may do through the router
+    ///
+    /// Takes 1 yoctoNEAR, which only a full access key can attach, so a
+    /// limited key cannot change its own grant.
+    #[payable]
+    pub fn grant_session_key(&mut self, access_key: near_sdk::PublicKey, grant: SessionGrant) -> String {
+        assert_one_yocto();
+        self.assert_not_halted();
+        self.accounts.grant_near_session_key(&env::predecessor_account_id(), access_key, grant)
+            .unwrap_or_else(|e| env::panic_str(&e.to_string()))
+    }
+
+    /// Revoke the grant of an access key, which is refused from then on
+    #[payable]
+    pub fn revoke_session_key(&mut self, access_key: near_sdk::PublicKey) {
+        assert_one_yocto();
+        self.accounts.revoke_near_session_key(&env::predecessor_account_id(), &access_key)
+            .unwrap_or_else(|e| env::panic_str(&e.to_string()));
+    }
+
+    /// Get the session keys granted by an account
+    pub fn get_session_keys(&self, account_id: AccountId) -> Vec<SessionKey> {
+        self.accounts.session_keys_of(account_id.as_str())
+    }
+
     // CosmWasm routing methods
 
     /// Store WASM code via the wasm module
@@ -265,6 +1177,7 @@ impl ModularCosmosRouter {
         builder: Option<String>,
         instantiate_permission: Option<AccessConfig>,
     ) -> Promise {
+        self.assert_not_halted();
         let wasm_contract = self.registered_modules.get("wasm")
             .expect("Wasm module not registered")
             .parse::<AccountId>()
@@ -294,6 +1207,7 @@ impl ModularCosmosRouter {
         label: String,
         admin: Option<String>,
     ) -> Promise {
+        self.assert_not_halted();
         let wasm_contract = self.registered_modules.get("wasm")
             .expect("Wasm module not registered")
             .parse::<AccountId>()
@@ -322,6 +1236,7 @@ impl ModularCosmosRouter {
         msg: String,
         funds: Option<Vec<Coin>>,
     ) -> Promise {
+        self.assert_not_halted();
         let wasm_contract = self.registered_modules.get("wasm")
             .expect("Wasm module not registered")
             .parse::<AccountId>()
@@ -337,7 +1252,37 @@ impl ModularCosmosRouter {
             )
     }
 
+    /// Apply the response of a contract execution the relayer ran
+    ///
+    /// The wasm module forwards the response once it recorded the result.
+    /// Bank messages move the funds the contract holds in the router's bank,
+    /// with the contract as signer; they all apply or the call fails with
+    /// none applied. Returns the response data in base64.
+    pub fn wasm_apply_response(&mut self, contract_addr: String, response: CosmWasmResponse) -> String {
+        self.assert_not_halted();
+        let caller = env::predecessor_account_id();
+        let is_wasm = self.registered_modules.get("wasm").map_or(false, |wasm| wasm == caller.as_str());
+        assert!(is_wasm, "Only the wasm module can apply contract responses");
+        process_cosmwasm_response_with_router(response, &contract_addr, self)
+            .unwrap_or_else(|e| env::panic_str(&e))
+    }
+
+    /// Answer a module query of a contract, for the relayer running it
+    ///
+    /// Returns the JSON response in base64. Staking and oracle queries fail,
+    /// those modules do not live in the router.
+    pub fn wasm_query_modules(&self, request: QueryRequest) -> String {
+        ModuleQuerier::new(&self.bank)
+            .with_gov(&self.governance)
+            .query_module(&request)
+            .map(|response| response.to_base64())
+            .unwrap_or_else(|e| env::panic_str(&e.to_string()))
+    }
+
     /// Get code info from the wasm module
+    ///
+    /// Like the other wasm queries this schedules a call to the wasm module,
+    /// which a view call cannot, so it has to be sent as a transaction.
     pub fn wasm_code_info(&self, code_id: u64) -> Promise {
         self.wasm_get_code_info(code_id)
     }
@@ -375,6 +1320,718 @@ impl ModularCosmosRouter {
     }
 }
 
+// Messages of atomic calls run against the router's deposits; the other
+// modules live in their own contracts and cannot join a unit of work
+impl CosmosMessageHandler for ModularCosmosRouter {
+    fn handle_msg_send(&mut self, msg: MsgSend) -> MessageResult<HandleResult> {
+        let from = parse_account(&msg.from_address)?;
+        let to = parse_account(&msg.to_address)?;
+        let coins = to_bank_coins(&msg.amount)?;
+        self.bank_mut().transfer_coins(&from, &to, &coins).map_err(|_| ContractError::InsufficientFunds)?;
+
+        let amount = coins.to_string();
+        Ok(success_result(
+            &format!("Sent {} from {} to {}", amount, from, to),
+            vec![create_event("transfer", vec![("sender", from.as_str()), ("recipient", to.as_str()), ("amount", &amount)])],
+        ))
+    }
+
+    fn handle_msg_multi_send(&mut self, _msg: MsgMultiSend) -> MessageResult<HandleResult> {
+        not_on_router("Multi-send")
+    }
+
+    fn handle_msg_burn(&mut self, msg: MsgBurn) -> MessageResult<HandleResult> {
+        let from = parse_account(&msg.from_address)?;
+        let coins = to_bank_coins(&msg.amount)?;
+        if coins.iter().any(|coin| self.bank.get_spendable_balance(&from, &coin.denom) < coin.amount) {
+            return Err(ContractError::InsufficientFunds);
+        }
+        for coin in coins.iter() {
+            self.bank_mut().burn_with_reason(&from, &coin.denom, coin.amount, "router", "burn");
+        }
+
+        let amount = coins.to_string();
+        Ok(success_result(
+            &format!("Burned {} from {}", amount, from),
+            vec![create_event("burn", vec![("burner", from.as_str()), ("amount", &amount)])],
+        ))
+    }
+
+    fn handle_msg_delegate(&mut self, _msg: MsgDelegate) -> MessageResult<HandleResult> { not_on_router("Staking") }
+    fn handle_msg_undelegate(&mut self, _msg: MsgUndelegate) -> MessageResult<HandleResult> { not_on_router("Staking") }
+    fn handle_msg_begin_redelegate(&mut self, _msg: MsgBeginRedelegate) -> MessageResult<HandleResult> { not_on_router("Staking") }
+    fn handle_msg_create_validator(&mut self, _msg: MsgCreateValidator) -> MessageResult<HandleResult> { not_on_router("Staking") }
+    fn handle_msg_edit_validator(&mut self, _msg: MsgEditValidator) -> MessageResult<HandleResult> { not_on_router("Staking") }
+    fn handle_msg_submit_proposal(&mut self, _msg: MsgSubmitProposal) -> MessageResult<HandleResult> { not_on_router("Governance") }
+    fn handle_msg_vote(&mut self, _msg: MsgVote) -> MessageResult<HandleResult> { not_on_router("Governance") }
+    fn handle_msg_vote_weighted(&mut self, _msg: MsgVoteWeighted) -> MessageResult<HandleResult> { not_on_router("Governance") }
+    fn handle_msg_deposit(&mut self, _msg: MsgDeposit) -> MessageResult<HandleResult> { not_on_router("Governance") }
+    fn handle_msg_transfer(&mut self, _msg: MsgTransfer) -> MessageResult<HandleResult> { not_on_router("IBC") }
+    fn handle_msg_channel_open_init(&mut self, _msg: MsgChannelOpenInit) -> MessageResult<HandleResult> { not_on_router("IBC") }
+    fn handle_msg_channel_open_try(&mut self, _msg: MsgChannelOpenTry) -> MessageResult<HandleResult> { not_on_router("IBC") }
+    fn handle_msg_recv_packet(&mut self, _msg: MsgRecvPacket) -> MessageResult<HandleResult> { not_on_router("IBC") }
+    fn handle_msg_acknowledgement(&mut self, _msg: MsgAcknowledgement) -> MessageResult<HandleResult> { not_on_router("IBC") }
+    fn handle_msg_timeout(&mut self, _msg: MsgTimeout) -> MessageResult<HandleResult> { not_on_router("IBC") }
+}
+
+/// Restriction of deposit sends, which has nothing to check
+struct NoRestriction;
+
+impl SendRestriction for NoRestriction {
+    fn check_send(&self, _from: &AccountId, _to: &AccountId, _amount: Balance) -> Result<(), String> {
+        Ok(())
+    }
+}
+
+fn not_on_router(kind: &str) -> MessageResult<HandleResult> {
+    Err(ContractError::Custom(format!("{} messages are not available in atomic calls", kind)))
+}
+
+fn parse_account(address: &str) -> MessageResult<AccountId> {
+    address.parse().map_err(|_| ContractError::InvalidAddress)
+}
+
+fn to_bank_coins(coins: &[types::cosmos_messages::Coin]) -> MessageResult<Coins> {
+    let coins = coins.iter()
+        .map(|coin| {
+            let amount = coin.amount.parse().map_err(|_| ContractError::InvalidField {
+                field: "amount".to_string(),
+                reason: format!("{} is not an amount", coin.amount),
+            })?;
+            Ok(modules::bank::Coin::new(coin.denom.clone(), amount))
+        })
+        .collect::<MessageResult<Vec<_>>>()?;
+    let coins = Coins::new(coins).map_err(ContractError::Custom)?;
+    if coins.is_empty() {
+        return Err(ContractError::Custom("Empty amount".to_string()));
+    }
+    Ok(coins)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use near_sdk::serde_json::json;
+    use near_sdk::test_utils::{get_logs, VMContextBuilder};
+    use near_sdk::{testing_env, NearToken, PromiseResult};
+    use crate::modules::cosmwasm::types::{BankMsg, Binary, Coin as WasmCoin, CosmosMsg, ReplyOn, SubMsg, Uint128};
+
+    fn account(name: &str) -> AccountId {
+        name.parse().unwrap()
+    }
+
+    fn call_from(predecessor: &str, deposit: u128) {
+        testing_env!(VMContextBuilder::new()
+            .current_account_id(account("router.near"))
+            .predecessor_account_id(account(predecessor))
+            .attached_deposit(NearToken::from_yoctonear(deposit))
+            .build());
+    }
+
+    fn access_key() -> near_sdk::PublicKey {
+        "ed25519:6E8sCci9badyRkXb3JoRpBj5p8C6Tw41ELDZoiihKEtp".parse().unwrap()
+    }
+
+    /// The atomic call receipt of a call `dex.near` signed with `access_key`
+    fn execute_signed_by_dex() {
+        testing_env!(VMContextBuilder::new()
+            .current_account_id(account("router.near"))
+            .predecessor_account_id(account("router.near"))
+            .signer_account_id(account("dex.near"))
+            .signer_account_pk(access_key())
+            .build());
+    }
+
+    fn setup_session(remaining: u128) -> ModularCosmosRouter {
+        let mut router = setup();
+        call_from("dex.near", 1);
+        router.grant_session_key(access_key(), SessionGrant {
+            allowed_messages: vec![type_urls::MSG_SEND.to_string()],
+            spend_limits: vec![modules::auth::SpendLimit { denom: NATIVE_DENOM.to_string(), per_message: 40, remaining }],
+            expires_at: u64::MAX,
+        });
+        router
+    }
+
+    fn send(from: &str, to: &str, amount: u128) -> AtomicMsg {
+        let value = json!({
+            "from_address": from,
+            "to_address": to,
+            "amount": [{ "denom": NATIVE_DENOM, "amount": amount.to_string() }],
+        });
+        AtomicMsg { type_url: type_urls::MSG_SEND.to_string(), value: Base64VecU8(value.to_string().into_bytes()) }
+    }
+
+    /// Register `gov.near` as the governance module with the delay lifted
+    fn register_gov(router: &mut ModularCosmosRouter) {
+        call_from("router.near", 0);
+        router.set_admin_delay(0);
+        let id = router.register_module("gov".to_string(), "gov.near".to_string(), "1.0.0".to_string());
+        router.execute_admin_operation(id, None);
+    }
+
+    fn setup() -> ModularCosmosRouter {
+        call_from("router.near", 0);
+        let mut router = ModularCosmosRouter::new();
+        router.allow_atomic_caller(account("dex.near"));
+        call_from("dex.near", 100);
+        router.deposit();
+        router
+    }
+
+    #[test]
+    fn test_atomic_call_commits_messages() {
+        let mut router = setup();
+        router.atomic_call(vec![send("dex.near", "bob.near", 30), send("dex.near", "carol.near", 20)], None);
+        assert!(get_logs().iter().any(|log| log == "EVENT: atomic_call_started call_id=1 caller=dex.near messages=2"));
+
+        // The scheduled receipt on the router itself
+        call_from("router.near", 0);
+        let execution = AtomicExecution {
+            call_id: 1,
+            caller: account("dex.near"),
+            messages: vec![send("dex.near", "bob.near", 30), send("dex.near", "carol.near", 20)],
+        };
+        assert_eq!(router.atomic_execute(execution).len(), 2);
+        assert_eq!(router.get_deposit(account("dex.near")), U128(50));
+        assert_eq!(router.get_deposit(account("bob.near")), U128(30));
+    }
+
+    #[test]
+    fn test_ft_facade_moves_deposits() {
+        let mut router = setup();
+        assert!(router.storage_balance_of(account("bob.near")).is_none());
+        call_from("bob.near", FT_STORAGE_DEPOSIT + 5);
+        router.storage_deposit(None, None);
+        assert_eq!(router.storage_balance_of(account("bob.near")).unwrap().total, U128(FT_STORAGE_DEPOSIT));
+
+        call_from("dex.near", 1);
+        router.ft_transfer(account("bob.near"), U128(30), None);
+        assert_eq!(router.ft_balance_of(account("bob.near")), U128(30));
+        assert_eq!(router.get_deposit(account("dex.near")), U128(70));
+        assert_eq!(router.ft_total_supply(), U128(100));
+    }
+
+    #[test]
+    #[should_panic(expected = "is not registered")]
+    fn test_ft_transfer_to_unregistered_account() {
+        let mut router = setup();
+        call_from("dex.near", 1);
+        router.ft_transfer(account("bob.near"), U128(30), None);
+    }
+
+    #[test]
+    fn test_ft_transfer_call_refunds_unused() {
+        let mut router = setup();
+        call_from("bob.near", FT_STORAGE_DEPOSIT);
+        router.storage_deposit(None, None);
+        call_from("dex.near", 1);
+        router.ft_transfer(account("bob.near"), U128(30), None);
+
+        testing_env!(
+            VMContextBuilder::new()
+                .current_account_id(account("router.near"))
+                .predecessor_account_id(account("router.near"))
+                .build(),
+            near_sdk::test_vm_config(),
+            near_sdk::RuntimeFeesConfig::test(),
+            Default::default(),
+            vec![PromiseResult::Successful(b"\"10\"".to_vec())]
+        );
+        assert_eq!(router.ft_resolve_transfer(account("dex.near"), account("bob.near"), U128(30)), U128(20));
+        assert_eq!(router.get_deposit(account("dex.near")), U128(80));
+    }
+
+    #[test]
+    fn test_withdraw_after_halt() {
+        let mut router = setup();
+        call_from("router.near", 0);
+        router.schedule_halt(10);
+
+        testing_env!(VMContextBuilder::new()
+            .current_account_id(account("router.near"))
+            .predecessor_account_id(account("dex.near"))
+            .block_height(10)
+            .build());
+        router.withdraw(U128(40));
+        assert_eq!(router.get_deposit(account("dex.near")), U128(60));
+    }
+
+    #[test]
+    #[should_panic(expected = "Chain halted at height 10")]
+    fn test_deposit_refused_after_halt() {
+        let mut router = setup();
+        call_from("router.near", 0);
+        router.schedule_halt(10);
+
+        testing_env!(VMContextBuilder::new()
+            .current_account_id(account("router.near"))
+            .predecessor_account_id(account("dex.near"))
+            .attached_deposit(NearToken::from_yoctonear(10))
+            .block_height(10)
+            .build());
+        router.deposit();
+    }
+
+    #[test]
+    #[should_panic(expected = "Atomic call 1 rolled back at message 1")]
+    fn test_atomic_execute_aborts_on_failure() {
+        let mut router = setup();
+        call_from("router.near", 0);
+        router.atomic_execute(AtomicExecution {
+            call_id: 1,
+            caller: account("dex.near"),
+            messages: vec![send("dex.near", "bob.near", 30), send("dex.near", "bob.near", 80)],
+        });
+    }
+
+    #[test]
+    fn test_atomic_execute_charges_the_session_key() {
+        let mut router = setup_session(60);
+        execute_signed_by_dex();
+        router.atomic_execute(AtomicExecution {
+            call_id: 1,
+            caller: account("dex.near"),
+            messages: vec![send("dex.near", "bob.near", 30), send("dex.near", "carol.near", 20)],
+        });
+        assert_eq!(router.get_deposit(account("bob.near")), U128(30));
+        assert_eq!(router.get_session_keys(account("dex.near"))[0].grant.spend_limits[0].remaining, 10);
+    }
+
+    #[test]
+    #[should_panic(expected = "over the remaining allowance")]
+    fn test_atomic_execute_rejects_calls_over_the_session_grant() {
+        let mut router = setup_session(40);
+        execute_signed_by_dex();
+        router.atomic_execute(AtomicExecution {
+            call_id: 1,
+            caller: account("dex.near"),
+            messages: vec![send("dex.near", "bob.near", 30), send("dex.near", "carol.near", 20)],
+        });
+    }
+
+    #[test]
+    #[should_panic(expected = "was revoked or expired")]
+    fn test_revoked_session_key_is_refused() {
+        let mut router = setup_session(60);
+        call_from("dex.near", 1);
+        router.revoke_session_key(access_key());
+        execute_signed_by_dex();
+        router.atomic_execute(AtomicExecution {
+            call_id: 1,
+            caller: account("dex.near"),
+            messages: vec![send("dex.near", "bob.near", 10)],
+        });
+    }
+
+    #[test]
+    #[should_panic(expected = "only holds stake, not unear")]
+    fn test_loaded_bank_runs_staking_hooks() {
+        let mut router = setup();
+        call_from("router.near", 0);
+        router.atomic_execute(AtomicExecution {
+            call_id: 1,
+            caller: account("dex.near"),
+            messages: vec![send("dex.near", &modules::staking::bonded_pool_account().to_string(), 10)],
+        });
+    }
+
+    #[test]
+    fn test_contract_messages_run_in_emitted_order() {
+        use modules::cosmwasm::types::{BankMsg, Binary, Coin, CosmosMsg, Empty, ReplyOn, Response, SubMsg, Uint128, WasmMsg};
+
+        let mut router = setup();
+        let execute = SubMsg {
+            id: 1,
+            msg: CosmosMsg::Wasm(WasmMsg::Execute {
+                contract_addr: "other.near".to_string(),
+                msg: Binary::from(b"{}".to_vec()),
+                funds: vec![],
+            }),
+            gas_limit: None,
+            reply_on: ReplyOn::Never,
+        };
+        let send = SubMsg {
+            id: 2,
+            msg: CosmosMsg::Bank(BankMsg::Send {
+                to_address: "bob.near".to_string(),
+                amount: vec![Coin { denom: NATIVE_DENOM.to_string(), amount: Uint128::new(10) }],
+            }),
+            gas_limit: None,
+            reply_on: ReplyOn::Never,
+        };
+        let response = Response::<Empty>::new().add_message(execute).add_message(send);
+        process_cosmwasm_response_with_router(response, "dex.near", &mut router).unwrap();
+
+        let logs = get_logs();
+        let position = |prefix: &str| logs.iter().position(|log| log.starts_with(prefix)).unwrap();
+        assert!(position("WASM_EXECUTE[") < position("WASM_DISPATCH:"));
+        assert_eq!(router.get_deposit(account("bob.near")), U128(10));
+    }
+
+    fn register_wasm(router: &mut ModularCosmosRouter) {
+        call_from("router.near", 0);
+        router.set_admin_delay(0);
+        let id = router.register_module("wasm".to_string(), "wasm.near".to_string(), "1.0.0".to_string());
+        router.execute_admin_operation(id, None);
+    }
+
+    fn contract_send(to: &str, amount: u128) -> SubMsg {
+        SubMsg {
+            id: 0,
+            msg: CosmosMsg::Bank(BankMsg::Send {
+                to_address: to.to_string(),
+                amount: vec![WasmCoin { denom: NATIVE_DENOM.to_string(), amount: Uint128::new(amount) }],
+            }),
+            gas_limit: None,
+            reply_on: ReplyOn::Never,
+        }
+    }
+
+    #[test]
+    fn test_wasm_module_applies_contract_responses() {
+        let mut router = setup();
+        register_wasm(&mut router);
+
+        call_from("wasm.near", 0);
+        let response = CosmWasmResponse::new().add_message(contract_send("bob.near", 30)).set_data(b"ok".to_vec());
+        assert_eq!(router.wasm_apply_response("dex.near".to_string(), response), "b2s=");
+        assert_eq!(router.get_deposit(account("bob.near")), U128(30));
+
+        let request = serde_json::from_value(json!({"bank": {"balance": {"address": "bob.near", "denom": NATIVE_DENOM}}})).unwrap();
+        let encoded = router.wasm_query_modules(request);
+        let balance: serde_json::Value = serde_json::from_slice(Binary::from_base64(&encoded).unwrap().as_slice()).unwrap();
+        assert_eq!(balance["amount"]["amount"], json!(30));
+    }
+
+    #[test]
+    #[should_panic(expected = "Sub-message 0 from dex.near failed")]
+    fn test_failing_contract_message_rolls_back_the_response() {
+        let mut router = setup();
+        register_wasm(&mut router);
+
+        // The first send applied, so the second failing aborts the receipt
+        call_from("wasm.near", 0);
+        let response = CosmWasmResponse::new().add_message(contract_send("bob.near", 30)).add_message(contract_send("carol.near", 100));
+        router.wasm_apply_response("dex.near".to_string(), response);
+    }
+
+    #[test]
+    #[should_panic(expected = "Only the wasm module can apply contract responses")]
+    fn test_only_the_wasm_module_applies_responses() {
+        let mut router = setup();
+        register_wasm(&mut router);
+        call_from("dex.near", 0);
+        router.wasm_apply_response("dex.near".to_string(), CosmWasmResponse::new().add_message(contract_send("dex.near", 1)));
+    }
+
+    #[test]
+    #[should_panic(expected = "may not make atomic calls")]
+    fn test_atomic_call_requires_an_allowed_caller() {
+        let mut router = setup();
+        call_from("mallory.near", 0);
+        router.atomic_call(vec![send("mallory.near", "bob.near", 1)], None);
+    }
+
+    #[test]
+    fn test_upgrade_deploys_approved_code() {
+        let code = b"\0asm router v2".to_vec();
+        let plan = UpgradePlan { name: "v2".to_string(), code_hash: modules::gov::code_hash(&code) };
+
+        call_from("router.near", 0);
+        let mut router = ModularCosmosRouter::new();
+        register_gov(&mut router);
+        call_from("gov.near", 0);
+        router.approve_upgrade(plan.clone());
+        assert_eq!(router.get_pending_upgrade(), Some(plan));
+
+        call_from("anyone.near", 0);
+        router.apply_upgrade(Base64VecU8(code));
+        assert_eq!(router.get_pending_upgrade(), None);
+        assert!(get_logs().iter().any(|log| log == "Governance: Deploying upgrade v2 (14 bytes)"));
+    }
+
+    #[test]
+    fn test_failed_upgrade_is_pending_again() {
+        let code = b"\0asm router v2".to_vec();
+        let plan = UpgradePlan { name: "v2".to_string(), code_hash: modules::gov::code_hash(&code) };
+
+        call_from("router.near", 0);
+        let mut router = ModularCosmosRouter::new();
+        register_gov(&mut router);
+        call_from("gov.near", 0);
+        router.approve_upgrade(plan.clone());
+        call_from("anyone.near", 0);
+        router.apply_upgrade(Base64VecU8(code));
+
+        testing_env!(
+            VMContextBuilder::new()
+                .current_account_id(account("router.near"))
+                .predecessor_account_id(account("router.near"))
+                .build(),
+            near_sdk::test_vm_config(),
+            near_sdk::RuntimeFeesConfig::test(),
+            Default::default(),
+            vec![PromiseResult::Failed]
+        );
+        assert!(!router.on_upgrade_applied(plan.clone()));
+        assert_eq!(router.get_pending_upgrade(), Some(plan));
+    }
+
+    #[test]
+    fn test_supply_query_returns_a_proven_envelope() {
+        let mut router = setup();
+        testing_env!(VMContextBuilder::new()
+            .current_account_id(account("router.near"))
+            .block_height(12)
+            .build());
+        let unproven = router.supply_of(NATIVE_DENOM.to_string(), None);
+        assert_eq!((unproven.height, unproven.value.amount, unproven.proof), (12, 100, None));
+
+        router.process_block();
+        let envelope = router.supply_of(NATIVE_DENOM.to_string(), Some(true));
+        assert_eq!(envelope.height, 12);
+        assert!(envelope.value.verify(envelope.proof.as_ref().unwrap()));
+    }
+
+    #[test]
+    fn test_migrate_converts_the_first_state_layout() {
+        call_from("router.near", 0);
+        let mut registered_modules = HashMap::new();
+        registered_modules.insert("bank".to_string(), "bank.near".to_string());
+        let old = RouterStateV1 {
+            owner: account("owner.near"),
+            chain_id: "cosmos-1".to_string(),
+            registered_modules,
+            module_versions: HashMap::new(),
+        };
+        env::storage_write(b"STATE", &borsh::to_vec(&old).unwrap());
+
+        let router = ModularCosmosRouter::migrate();
+        assert_eq!(router.get_owner(), account("owner.near"));
+        assert!(router.is_module_registered("bank".to_string()));
+        assert_eq!(router.get_pending_upgrade(), None);
+
+        // State already in the current layout is kept
+        env::state_write(&router);
+        assert_eq!(ModularCosmosRouter::migrate().get_owner(), account("owner.near"));
+    }
+
+    #[test]
+    #[should_panic(expected = "does not match approved hash")]
+    fn test_upgrade_rejects_other_code() {
+        call_from("router.near", 0);
+        let mut router = ModularCosmosRouter::new();
+        register_gov(&mut router);
+        call_from("gov.near", 0);
+        router.approve_upgrade(UpgradePlan { name: "v2".to_string(), code_hash: modules::gov::code_hash(b"approved") });
+        router.apply_upgrade(Base64VecU8(b"other".to_vec()));
+    }
+
+    #[test]
+    #[should_panic(expected = "Only governance can approve upgrades")]
+    fn test_only_governance_approves_upgrades() {
+        call_from("router.near", 0);
+        let mut router = ModularCosmosRouter::new();
+        router.approve_upgrade(UpgradePlan { name: "v2".to_string(), code_hash: modules::gov::code_hash(b"code") });
+    }
+
+    fn call_at(predecessor: &str, timestamp: u64) {
+        testing_env!(VMContextBuilder::new()
+            .current_account_id(account("router.near"))
+            .predecessor_account_id(account(predecessor))
+            .block_timestamp(timestamp)
+            .build());
+    }
+
+    #[test]
+    fn test_owner_operations_wait_out_the_timelock() {
+        use handler::timelock::DEFAULT_TIMELOCK_DELAY_NS;
+
+        call_at("router.near", 0);
+        let mut router = ModularCosmosRouter::new();
+        let id = router.transfer_ownership(account("alice.near"));
+        assert_eq!(router.get_admin_operations()[0].eta, DEFAULT_TIMELOCK_DELAY_NS);
+        assert_eq!(router.get_owner(), account("router.near"));
+
+        call_at("router.near", DEFAULT_TIMELOCK_DELAY_NS);
+        router.execute_admin_operation(id, None);
+        assert_eq!(router.get_owner(), account("alice.near"));
+        assert!(router.get_admin_operations().is_empty());
+
+        // The new owner holds the admin seat
+        call_at("alice.near", DEFAULT_TIMELOCK_DELAY_NS);
+        let id = router.register_module("bank".to_string(), "bank.near".to_string(), "1.0.0".to_string());
+        call_at("alice.near", 2 * DEFAULT_TIMELOCK_DELAY_NS);
+        router.execute_admin_operation(id, None);
+        assert!(router.is_module_registered("bank".to_string()));
+    }
+
+    #[test]
+    #[should_panic(expected = "is locked until")]
+    fn test_owner_operation_cannot_run_before_its_delay() {
+        call_at("router.near", 0);
+        let mut router = ModularCosmosRouter::new();
+        let id = router.register_module("bank".to_string(), "bank.near".to_string(), "1.0.0".to_string());
+        router.execute_admin_operation(id, None);
+    }
+
+    #[test]
+    fn test_timelocked_migrate_and_instance_code() {
+        call_from("router.near", 0);
+        let mut router = ModularCosmosRouter::new();
+        register_gov(&mut router);
+
+        let plan = UpgradePlan { name: "v2".to_string(), code_hash: modules::gov::code_hash(b"\0asm v2") };
+        let id = router.queue_admin_operation(AdminOperation::Migrate { plan: plan.clone() });
+        router.execute_admin_operation(id, None);
+        assert_eq!(router.get_pending_upgrade(), Some(plan));
+
+        let code = b"\0asm instance".to_vec();
+        let id = router.set_instance_code(modules::gov::code_hash(&code));
+        router.execute_admin_operation(id, Some(Base64VecU8(code.clone())));
+        assert_eq!(env::storage_read(factory::INSTANCE_CODE_KEY), Some(code));
+    }
+
+    #[test]
+    #[should_panic(expected = "Only governance can change the timelock")]
+    fn test_owner_cannot_lift_the_delay_once_governance_is_registered() {
+        call_from("router.near", 0);
+        let mut router = ModularCosmosRouter::new();
+        register_gov(&mut router);
+        router.set_admin_delay(0);
+    }
+
+    #[test]
+    fn test_failed_instance_creation_refunds_the_deposit() {
+        call_from("router.near", 0);
+        let mut router = ModularCosmosRouter::new();
+        router.instances.insert("app".to_string(), InstanceInfo {
+            account_id: "app.router.near".to_string(),
+            chain_id: "app-1".to_string(),
+            owner: "owner.near".to_string(),
+            created_at: 0,
+            status: InstanceStatus::Pending,
+        });
+
+        testing_env!(
+            VMContextBuilder::new()
+                .current_account_id(account("router.near"))
+                .predecessor_account_id(account("router.near"))
+                .build(),
+            near_sdk::test_vm_config(),
+            near_sdk::RuntimeFeesConfig::test(),
+            Default::default(),
+            vec![PromiseResult::Failed]
+        );
+        let deposit = factory::MIN_INSTANCE_DEPOSIT.as_yoctonear();
+        assert!(!router.on_instance_created("app".to_string(), account("router.near"), U128(deposit)));
+        assert_eq!(router.get_instance("app".to_string()).unwrap().status, InstanceStatus::Failed);
+        assert_eq!(get_logs(), vec![format!("Instance app creation failed, refunding {} to router.near", deposit)]);
+    }
+
+    #[test]
+    fn test_on_atomic_call_reports_a_rollback() {
+        let mut router = setup();
+        testing_env!(
+            VMContextBuilder::new()
+                .current_account_id(account("router.near"))
+                .predecessor_account_id(account("router.near"))
+                .build(),
+            near_sdk::test_vm_config(),
+            near_sdk::RuntimeFeesConfig::test(),
+            Default::default(),
+            vec![PromiseResult::Failed]
+        );
+        let result = router.on_atomic_call(1, account("dex.near"), Some("on_result".to_string()));
+        assert_eq!(result, AtomicCallResult { call_id: 1, committed: false, responses: vec![] });
+        assert_eq!(router.get_deposit(account("dex.near")), U128(100));
+    }
+
+    #[test]
+    fn test_process_block_indexes_atomic_calls() {
+        let mut router = setup();
+        testing_env!(
+            VMContextBuilder::new()
+                .current_account_id(account("router.near"))
+                .predecessor_account_id(account("router.near"))
+                .block_height(20)
+                .build(),
+            near_sdk::test_vm_config(),
+            near_sdk::RuntimeFeesConfig::test(),
+            Default::default(),
+            vec![PromiseResult::Failed]
+        );
+        router.on_atomic_call(1, account("dex.near"), None);
+
+        // The call's block is committed before the block the chain moved on to
+        testing_env!(VMContextBuilder::new()
+            .current_account_id(account("router.near"))
+            .block_height(23)
+            .build());
+        let header = router.process_block();
+        assert_eq!(header.height, 23);
+        assert_eq!(router.block(20).unwrap().hash, header.last_block_hash);
+        assert_eq!(router.latest_block(), Some(header));
+
+        let results = router.block_results(20).unwrap();
+        assert_eq!(results.txs[0].hash, handler::atomic_call_hash(1));
+        assert_eq!(results.txs[0].code, handler::tx_handler::ABCICode::INTERNAL_ERROR);
+        assert!(router.block_results(23).unwrap().txs.is_empty());
+    }
+
+    #[test]
+    #[should_panic(expected = "Block height 23 must be greater than latest height 23")]
+    fn test_process_block_once_per_block() {
+        let mut router = setup();
+        testing_env!(VMContextBuilder::new()
+            .current_account_id(account("router.near"))
+            .block_height(23)
+            .build());
+        router.process_block();
+        router.process_block();
+    }
+
+    #[test]
+    fn test_keepers_earn_for_processing_blocks() {
+        let mut router = setup();
+        call_from("funder.near", 10_000);
+        router.fund_keeper();
+
+        testing_env!(VMContextBuilder::new()
+            .current_account_id(account("router.near"))
+            .predecessor_account_id(account("keeper.near"))
+            .block_height(23)
+            .build());
+        router.process_block();
+        assert_eq!(router.get_keeper_earned(account("keeper.near")), U128(1_000));
+        assert_eq!(router.get_keeper_fund(), U128(9_000));
+
+        // Nothing is left to prune, so the call earns nothing
+        assert_eq!(router.prune_blocks(), 0);
+        assert_eq!(router.get_keeper_earned(account("keeper.near")), U128(1_000));
+
+        router.withdraw_keeper_rewards();
+        assert_eq!(router.get_keeper_earned(account("keeper.near")), U128(0));
+    }
+
+    #[test]
+    fn test_block_retention_is_set_by_governance() {
+        let mut router = setup();
+        call_from("router.near", 0);
+        router.set_block_retention(10);
+        assert_eq!(router.get_block_retention(), 10);
+    }
+
+    #[test]
+    #[should_panic(expected = "Only governance can set the block retention")]
+    fn test_block_retention_rejects_others() {
+        let mut router = setup();
+        call_from("alice.near", 0);
+        router.set_block_retention(10);
+    }
+}
+
 // For testing
 // #[cfg(test)]
 // mod lib_tests; // Temporarily disabled due to refactoring
\ No newline at end of file
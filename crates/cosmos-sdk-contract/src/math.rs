@@ -0,0 +1,118 @@
+/// Amount Arithmetic
+///
+/// Amounts are `u128`, wide enough for any supply of an 18-decimal denom
+/// bridged over IBC. Products of two such amounts are not: a stake of 10^12
+/// tokens times a share ratio of the same size is 10^60 base units, far
+/// past `u128::MAX`, even though the quotient that follows fits again.
+/// `mul_div` computes `value * numerator / denominator` through a 256-bit
+/// intermediate, so pro-rata splits such as delegation tokens, slashes and
+/// rewards neither overflow nor lose precision to an early division.
+///
+/// Sums and differences of amounts go through `safe_add` and `safe_sub`,
+/// which panic naming the amount instead of wrapping: release builds do
+/// not check `+` and `-`, and a mint near `u128::MAX` would otherwise
+/// leave a balance of a few tokens.
+
+use crate::Balance;
+
+/// Full 256-bit product of `a` and `b` as (high, low) halves
+fn widening_mul(a: u128, b: u128) -> (u128, u128) {
+    const LOW: u128 = u64::MAX as u128;
+    let (a_hi, a_lo) = (a >> 64, a & LOW);
+    let (b_hi, b_lo) = (b >> 64, b & LOW);
+
+    let low = a_lo * b_lo;
+    let (middle, middle_carry) = (a_lo * b_hi).overflowing_add(a_hi * b_lo);
+    let (low, low_carry) = low.overflowing_add(middle << 64);
+    let high = a_hi * b_hi + (middle >> 64) + ((middle_carry as u128) << 64) + low_carry as u128;
+    (high, low)
+}
+
+/// `value * numerator / denominator` rounded down, `None` when the
+/// denominator is zero or the quotient does not fit in a `u128`
+pub fn mul_div(value: Balance, numerator: Balance, denominator: Balance) -> Option<Balance> {
+    if denominator == 0 {
+        return None;
+    }
+    let (high, low) = widening_mul(value, numerator);
+    if high == 0 {
+        return Some(low / denominator);
+    }
+    if high >= denominator {
+        return None;
+    }
+
+    // Long division of the 256-bit product, one bit of the low half at a time
+    let (mut remainder, mut quotient) = (high, 0u128);
+    for bit in (0..128).rev() {
+        let carry = remainder >> 127;
+        remainder = (remainder << 1) | ((low >> bit) & 1);
+        if carry == 1 || remainder >= denominator {
+            remainder = remainder.wrapping_sub(denominator);
+            quotient |= 1 << bit;
+        }
+    }
+    Some(quotient)
+}
+
+/// `mul_div` for callers whose quotient cannot exceed `value`, such as a
+/// share of a total, panicking with `what` if the inputs break that
+pub fn mul_div_floor(value: Balance, numerator: Balance, denominator: Balance, what: &str) -> Balance {
+    mul_div(value, numerator, denominator)
+        .unwrap_or_else(|| near_sdk::env::panic_str(&format!("{} overflows: {} * {} / {}", what, value, numerator, denominator)))
+}
+
+/// `a + b`, panicking with `what` if the sum does not fit in a `u128`
+pub fn safe_add(a: Balance, b: Balance, what: &str) -> Balance {
+    a.checked_add(b)
+        .unwrap_or_else(|| near_sdk::env::panic_str(&format!("{} overflows: {} + {}", what, a, b)))
+}
+
+/// `a - b`, panicking with `what` if `b` exceeds `a`
+pub fn safe_sub(a: Balance, b: Balance, what: &str) -> Balance {
+    a.checked_sub(b)
+        .unwrap_or_else(|| near_sdk::env::panic_str(&format!("{} underflows: {} - {}", what, a, b)))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_mul_div_matches_narrow_arithmetic() {
+        assert_eq!(mul_div(10, 3, 4), Some(7));
+        assert_eq!(mul_div(0, 5, 1), Some(0));
+        assert_eq!(mul_div(u128::MAX, 1, 1), Some(u128::MAX));
+        assert_eq!(mul_div(1, 1, 0), None);
+    }
+
+    #[test]
+    fn test_mul_div_with_wide_products() {
+        // 10^12 tokens of 18 decimals, split pro rata over an equal total
+        let stake = 10u128.pow(30);
+        assert!(stake.checked_mul(stake).is_none());
+        assert_eq!(mul_div(stake, stake, stake), Some(stake));
+        assert_eq!(mul_div(stake, 2 * stake, 3 * stake), Some(2 * stake / 3));
+        assert_eq!(mul_div(u128::MAX, u128::MAX, u128::MAX), Some(u128::MAX));
+        assert_eq!(mul_div(u128::MAX, 3, 2), None);
+        assert_eq!(mul_div(u128::MAX, u128::MAX - 1, u128::MAX), Some(u128::MAX - 1));
+    }
+
+    #[test]
+    fn test_safe_add_and_sub() {
+        assert_eq!(safe_add(u128::MAX - 1, 1, "Balance"), u128::MAX);
+        assert_eq!(safe_sub(5, 5, "Balance"), 0);
+    }
+
+    #[test]
+    #[should_panic(expected = "Balance of alice.near overflows")]
+    fn test_safe_add_overflow() {
+        safe_add(u128::MAX, 1, "Balance of alice.near");
+    }
+
+    #[test]
+    #[should_panic(expected = "Bonded pool underflows: 4 - 5")]
+    fn test_safe_sub_underflow() {
+        safe_sub(4, 5, "Bonded pool");
+    }
+}
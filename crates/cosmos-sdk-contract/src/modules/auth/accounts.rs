@@ -1,8 +1,9 @@
 use crate::crypto::CosmosPublicKey;
+use super::session::SessionKey;
 use near_sdk::borsh::{BorshDeserialize, BorshSerialize};
 use near_sdk::serde::{Deserialize, Serialize};
 use near_sdk::AccountId;
-use near_sdk::collections::{LookupMap, Vector};
+use near_sdk::collections::{LookupMap, LookupSet, Vector};
 use std::collections::HashMap;
 
 /// Account management errors
@@ -20,6 +21,10 @@ pub enum AccountError {
     InvalidPublicKey(String),
     /// Address derivation failed
     AddressDerivationFailed(String),
+    /// Caller may not act on the account
+    Unauthorized(String),
+    /// Session key may not do what was asked
+    SessionRejected(String),
 }
 
 impl std::fmt::Display for AccountError {
@@ -33,6 +38,8 @@ impl std::fmt::Display for AccountError {
             AccountError::AccountExists(addr) => write!(f, "Account already exists: {}", addr),
             AccountError::InvalidPublicKey(msg) => write!(f, "Invalid public key: {}", msg),
             AccountError::AddressDerivationFailed(msg) => write!(f, "Address derivation failed: {}", msg),
+            AccountError::Unauthorized(msg) => write!(f, "Unauthorized: {}", msg),
+            AccountError::SessionRejected(msg) => write!(f, "Session key rejected: {}", msg),
         }
     }
 }
@@ -103,11 +110,21 @@ impl CosmosAccount {
 #[derive(BorshSerialize, BorshDeserialize)]
 pub struct AccountManager {
     /// Map from address to account info
-    accounts: LookupMap<String, CosmosAccount>,
+    pub(super) accounts: LookupMap<String, CosmosAccount>,
     /// Map from NEAR account ID to Cosmos address
     near_to_cosmos: LookupMap<AccountId, String>,
     /// Vector of account addresses for listing (since LookupMap doesn't support iteration)
     account_addresses: Vector<String>,
+    /// NEAR account allowed to recover each Cosmos address
+    pub(super) recovery_accounts: LookupMap<String, AccountId>,
+    /// Account address of each recovered key, by the key's derived address
+    pub(super) key_aliases: LookupMap<String, String>,
+    /// Session keys by id, see `session.rs`
+    pub(super) session_keys: LookupMap<String, SessionKey>,
+    /// Session key ids of each granting account
+    pub(super) session_ids: LookupMap<String, Vec<String>>,
+    /// NEAR session keys that were revoked or expired and stay rejected
+    pub(super) closed_near_sessions: LookupSet<String>,
     /// Next account number to assign
     next_account_number: u64,
     /// Configuration
@@ -142,6 +159,11 @@ impl AccountManager {
             accounts: LookupMap::new(b"a"),
             near_to_cosmos: LookupMap::new(b"n"),
             account_addresses: Vector::new(b"d"),
+            recovery_accounts: LookupMap::new(b"auth_recovery"),
+            key_aliases: LookupMap::new(b"auth_key_aliases"),
+            session_keys: LookupMap::new(b"auth_session_keys"),
+            session_ids: LookupMap::new(b"auth_session_ids"),
+            closed_near_sessions: LookupSet::new(b"auth_session_closed"),
             next_account_number: 1, // Start at 1 per Cosmos convention
             config,
         }
@@ -167,8 +189,8 @@ impl AccountManager {
         let address = public_key.to_cosmos_address(&self.config.address_prefix)
             .map_err(|e| AccountError::AddressDerivationFailed(e.to_string()))?;
 
-        // Check if account already exists
-        if self.accounts.get(&address).is_some() {
+        // Check if account already exists, also as a recovered key
+        if self.accounts.get(&address).is_some() || self.key_aliases.get(&address).is_some() {
             return Err(AccountError::AccountExists(address));
         }
 
@@ -251,8 +273,7 @@ impl AccountManager {
 
     /// Get or create account (if auto-creation is enabled)
     pub fn get_or_create_account(&mut self, public_key: CosmosPublicKey) -> Result<CosmosAccount, AccountError> {
-        let address = public_key.to_cosmos_address(&self.config.address_prefix)
-            .map_err(|e| AccountError::AddressDerivationFailed(e.to_string()))?;
+        let address = self.resolve_address(&public_key)?;
 
         if let Some(account) = self.accounts.get(&address) {
             Ok(account)
@@ -332,9 +353,7 @@ impl AccountManager {
         let mut addresses = Vec::new();
 
         for public_key in public_keys {
-            let address = public_key.to_cosmos_address(&self.config.address_prefix)
-                .map_err(|e| AccountError::AddressDerivationFailed(e.to_string()))?;
-            addresses.push(address);
+            addresses.push(self.resolve_address(public_key)?);
         }
 
         Ok(addresses)
@@ -0,0 +1,197 @@
+/// Fee Abstraction
+///
+/// Users who only hold bridged assets have no native denomination to pay
+/// fees with. Further denominations can be whitelisted for fees, each priced
+/// either at a fixed rate or by an oracle feeder that pushes prices. A fee
+/// paid in such a denomination is valued in yoctoNEAR at the current price
+/// and credited to the fee collector under `NATIVE_FEE_DENOM`; the coins
+/// themselves are set aside in `converted_fees` until the treasury swaps
+/// them.
+
+use near_sdk::borsh::{BorshDeserialize, BorshSerialize};
+use near_sdk::env;
+use near_sdk::serde::{Deserialize, Serialize};
+
+use super::fees::{FeeError, FeeProcessor};
+use crate::types::cosmos_tx::Coin;
+use crate::Balance;
+
+/// Denomination converted fees are credited in
+pub const NATIVE_FEE_DENOM: &str = "near";
+
+/// How a whitelisted fee denomination is priced, in yoctoNEAR per unit
+#[derive(Clone, Debug, PartialEq, BorshSerialize, BorshDeserialize, Serialize, Deserialize)]
+pub enum PriceSource {
+    Fixed { rate: Balance },
+    /// Prices pushed by `feeder`, unusable once older than `max_age_ns`
+    Oracle { feeder: String, max_age_ns: u64 },
+}
+
+#[derive(Clone, Debug, PartialEq, BorshSerialize, BorshDeserialize, Serialize, Deserialize)]
+pub struct OraclePrice {
+    pub rate: Balance,
+    /// Block timestamp of the update
+    pub updated_at: u64,
+}
+
+impl FeeProcessor {
+    /// Accept `denom` for fees, priced by `source`
+    pub fn whitelist_fee_denom(&mut self, denom: String, source: PriceSource) -> Result<(), FeeError> {
+        if self.get_config().denom_conversions.contains_key(&denom) {
+            return Err(FeeError::InvalidDenom(format!("{} is a native fee denomination", denom)));
+        }
+        if source == (PriceSource::Fixed { rate: 0 }) {
+            return Err(FeeError::InvalidAmount("Fixed rate must be positive".to_string()));
+        }
+
+        env::log_str(&format!("EVENT: fee_denom_whitelisted denom={} source={:?}", denom, source));
+        self.fee_denoms.insert(denom, source);
+        Ok(())
+    }
+
+    pub fn remove_fee_denom(&mut self, denom: &str) -> Result<(), FeeError> {
+        self.fee_denoms.remove(denom)
+            .ok_or_else(|| FeeError::InvalidDenom(denom.to_string()))?;
+        self.oracle_prices.remove(denom);
+        Ok(())
+    }
+
+    pub fn get_fee_denoms(&self) -> Vec<(String, PriceSource)> {
+        let mut denoms: Vec<(String, PriceSource)> = self.fee_denoms.iter()
+            .map(|(denom, source)| (denom.clone(), source.clone()))
+            .collect();
+        denoms.sort_by(|a, b| a.0.cmp(&b.0));
+        denoms
+    }
+
+    /// Record a price from the denomination's oracle feeder
+    pub fn submit_price(&mut self, feeder: &str, denom: &str, rate: Balance) -> Result<(), FeeError> {
+        match self.fee_denoms.get(denom) {
+            Some(PriceSource::Oracle { feeder: expected, .. }) if expected == feeder => {}
+            Some(PriceSource::Oracle { .. }) => {
+                return Err(FeeError::InvalidDenom(format!("{} is not the price feeder of {}", feeder, denom)));
+            }
+            _ => return Err(FeeError::InvalidDenom(format!("{} is not priced by an oracle", denom))),
+        }
+        if rate == 0 {
+            return Err(FeeError::InvalidAmount("Price must be positive".to_string()));
+        }
+
+        self.oracle_prices.insert(denom.to_string(), OraclePrice {
+            rate,
+            updated_at: env::block_timestamp(),
+        });
+        Ok(())
+    }
+
+    /// Current rate of a whitelisted fee denomination
+    pub fn fee_denom_rate(&self, denom: &str) -> Result<Balance, FeeError> {
+        match self.fee_denoms.get(denom) {
+            Some(PriceSource::Fixed { rate }) => Ok(*rate),
+            Some(PriceSource::Oracle { max_age_ns, .. }) => self.oracle_prices.get(denom)
+                .filter(|price| env::block_timestamp().saturating_sub(price.updated_at) <= *max_age_ns)
+                .map(|price| price.rate)
+                .ok_or_else(|| FeeError::PriceUnavailable(denom.to_string())),
+            None => Err(FeeError::InvalidDenom(denom.to_string())),
+        }
+    }
+
+    /// Credit a fee coin worth `amount_yocto` to the fee collector
+    pub(super) fn credit_fee_collector(&mut self, coin: &Coin, amount_yocto: Balance) -> Result<(), FeeError> {
+        if !self.fee_denoms.contains_key(&coin.denom) {
+            *self.accumulated_fees.entry(coin.denom.clone()).or_insert(0) += amount_yocto;
+            return Ok(());
+        }
+
+        let amount: Balance = coin.amount.parse()
+            .map_err(|_| FeeError::InvalidAmount(coin.amount.clone()))?;
+        *self.converted_fees.entry(coin.denom.clone()).or_insert(0) += amount;
+        *self.accumulated_fees.entry(NATIVE_FEE_DENOM.to_string()).or_insert(0) += amount_yocto;
+        env::log_str(&format!(
+            "EVENT: fee_converted denom={} amount={} yocto={}",
+            coin.denom, amount, amount_yocto
+        ));
+        Ok(())
+    }
+
+    pub fn get_converted_fees(&self) -> &std::collections::HashMap<String, Balance> {
+        &self.converted_fees
+    }
+
+    /// Hand the set-aside fee coins over for swapping
+    pub fn take_converted_fees(&mut self) -> std::collections::HashMap<String, Balance> {
+        std::mem::take(&mut self.converted_fees)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::modules::auth::FeeConfig;
+    use crate::types::cosmos_tx::Fee;
+    use near_sdk::test_utils::VMContextBuilder;
+    use near_sdk::testing_env;
+
+    const ATOM_RATE: Balance = 2_000_000_000_000_000;
+
+    fn fee(coin: Coin) -> Fee {
+        Fee {
+            amount: vec![coin],
+            gas_limit: 100_000_000,
+            payer: String::new(),
+            granter: String::new(),
+        }
+    }
+
+    #[test]
+    fn test_fixed_rate_fee_is_credited_in_native_denom() {
+        let mut processor = FeeProcessor::new(FeeConfig::default());
+        let atom_fee = fee(Coin::new("ibc/ATOM", "10"));
+        assert!(matches!(
+            processor.process_transaction_fees(&atom_fee, "alice", None),
+            Err(FeeError::InvalidDenom(_))
+        ));
+
+        processor.whitelist_fee_denom("ibc/ATOM".to_string(), PriceSource::Fixed { rate: ATOM_RATE }).unwrap();
+        let paid = processor.process_transaction_fees(&atom_fee, "alice", None).unwrap();
+
+        assert_eq!(paid, 10 * ATOM_RATE);
+        assert_eq!(processor.get_accumulated_fees().get(NATIVE_FEE_DENOM), Some(&(10 * ATOM_RATE)));
+        assert!(processor.get_accumulated_fees().get("ibc/ATOM").is_none());
+        assert_eq!(processor.take_converted_fees().get("ibc/ATOM"), Some(&10));
+        assert!(processor.get_converted_fees().is_empty());
+
+        // Too little once valued in yoctoNEAR
+        let dust = fee(Coin::new("ibc/ATOM", "1"));
+        assert!(matches!(
+            processor.process_transaction_fees(&dust, "alice", None),
+            Err(FeeError::InsufficientFee { .. })
+        ));
+    }
+
+    #[test]
+    fn test_oracle_prices_expire() {
+        testing_env!(VMContextBuilder::new().block_timestamp(1_000).build());
+        let mut processor = FeeProcessor::new(FeeConfig::default());
+        processor.whitelist_fee_denom("ibc/OSMO".to_string(), PriceSource::Oracle {
+            feeder: "oracle.near".to_string(),
+            max_age_ns: 500,
+        }).unwrap();
+
+        assert!(matches!(processor.fee_denom_rate("ibc/OSMO"), Err(FeeError::PriceUnavailable(_))));
+        assert!(processor.submit_price("mallory.near", "ibc/OSMO", ATOM_RATE).is_err());
+        processor.submit_price("oracle.near", "ibc/OSMO", ATOM_RATE).unwrap();
+        assert_eq!(processor.estimate_tx_cost(100_000_000, "ibc/OSMO").unwrap().amount, "5");
+
+        testing_env!(VMContextBuilder::new().block_timestamp(1_501).build());
+        assert!(matches!(processor.fee_denom_rate("ibc/OSMO"), Err(FeeError::PriceUnavailable(_))));
+    }
+
+    #[test]
+    fn test_native_denoms_cannot_be_whitelisted() {
+        let mut processor = FeeProcessor::new(FeeConfig::default());
+        assert!(processor.whitelist_fee_denom("unear".to_string(), PriceSource::Fixed { rate: 1 }).is_err());
+        assert!(processor.whitelist_fee_denom("ibc/ATOM".to_string(), PriceSource::Fixed { rate: 0 }).is_err());
+        assert!(processor.remove_fee_denom("ibc/ATOM").is_err());
+    }
+}
@@ -0,0 +1,151 @@
+/// Fee Policy
+///
+/// The minimum fee of a transaction is its gas limit times the minimum gas
+/// price. Governance can adjust that per message type through the
+/// `fee_policy` parameter: a multiplier scales the share of the gas fee a
+/// message accounts for, and a flat surcharge is added for every message of
+/// the type. Storing code can cost more than its gas suggests, while a vote
+/// can be made free. Message types without a rule pay the plain gas fee.
+
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::serde::{Deserialize, Serialize};
+use schemars::JsonSchema;
+
+use crate::Balance;
+
+/// Governance parameter holding the JSON encoded policy
+pub const FEE_POLICY_PARAM: &str = "fee_policy";
+
+/// Multiplier that leaves the fee unchanged
+pub const FEE_MULTIPLIER_UNIT_BPS: u32 = 10_000;
+
+/// Highest multiplier a rule may set, 100x
+pub const MAX_FEE_MULTIPLIER_BPS: u32 = 100 * FEE_MULTIPLIER_UNIT_BPS;
+
+/// Adjustment applied to every message of one type
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct MessageFeeRule {
+    /// Type URL the rule applies to, e.g. `/cosmwasm.wasm.v1.MsgStoreCode`
+    pub msg_type: String,
+    /// Scales the message's share of the gas fee, 0 makes it free
+    #[serde(default = "default_multiplier")]
+    pub multiplier_bps: u32,
+    /// Flat yoctoNEAR added per message
+    #[serde(default)]
+    pub surcharge: Balance,
+}
+
+fn default_multiplier() -> u32 {
+    FEE_MULTIPLIER_UNIT_BPS
+}
+
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, Default, PartialEq, JsonSchema)]
+pub struct FeePolicy {
+    pub rules: Vec<MessageFeeRule>,
+}
+
+impl FeePolicy {
+    pub fn from_json(json: &str) -> Result<Self, String> {
+        serde_json::from_str(json).map_err(|e| format!("Invalid fee policy: {}", e))
+    }
+
+    pub fn to_json(&self) -> String {
+        serde_json::to_string(self).expect("Fee policy serializes")
+    }
+
+    pub fn validate(&self) -> Result<(), String> {
+        for (index, rule) in self.rules.iter().enumerate() {
+            if !rule.msg_type.starts_with('/') {
+                return Err(format!("Fee policy message type {} must be a type URL", rule.msg_type));
+            }
+            if rule.multiplier_bps > MAX_FEE_MULTIPLIER_BPS {
+                return Err(format!(
+                    "Fee policy multiplier {} for {} exceeds the maximum {}",
+                    rule.multiplier_bps, rule.msg_type, MAX_FEE_MULTIPLIER_BPS
+                ));
+            }
+            if self.rules[..index].iter().any(|other| other.msg_type == rule.msg_type) {
+                return Err(format!("Fee policy has more than one rule for {}", rule.msg_type));
+            }
+        }
+        Ok(())
+    }
+
+    pub fn rule_for(&self, msg_type: &str) -> Option<&MessageFeeRule> {
+        self.rules.iter().find(|rule| rule.msg_type == msg_type)
+    }
+
+    /// Minimum fee in yoctoNEAR for messages of `msg_types` sharing `gas_fee`
+    ///
+    /// Each message accounts for an equal share of the gas fee, scaled by
+    /// the multiplier of its type and rounded up. A transaction without
+    /// messages pays the gas fee as is.
+    pub fn required_fee<S: AsRef<str>>(&self, gas_fee: Balance, msg_types: &[S]) -> Balance {
+        if msg_types.is_empty() {
+            return gas_fee;
+        }
+        let (weight, surcharge) = msg_types.iter().fold((0u128, 0u128), |(weight, surcharge), msg_type| {
+            match self.rule_for(msg_type.as_ref()) {
+                Some(rule) => (weight + rule.multiplier_bps as u128, surcharge.saturating_add(rule.surcharge)),
+                None => (weight + FEE_MULTIPLIER_UNIT_BPS as u128, surcharge),
+            }
+        });
+        let denominator = msg_types.len() as u128 * FEE_MULTIPLIER_UNIT_BPS as u128;
+        let scaled = gas_fee.saturating_mul(weight).saturating_add(denominator - 1) / denominator;
+        scaled.saturating_add(surcharge)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const STORE_CODE: &str = "/cosmwasm.wasm.v1.MsgStoreCode";
+    const VOTE: &str = "/cosmos.gov.v1beta1.MsgVote";
+    const SEND: &str = "/cosmos.bank.v1beta1.MsgSend";
+
+    fn policy() -> FeePolicy {
+        FeePolicy {
+            rules: vec![
+                MessageFeeRule { msg_type: STORE_CODE.to_string(), multiplier_bps: 30_000, surcharge: 500 },
+                MessageFeeRule { msg_type: VOTE.to_string(), multiplier_bps: 0, surcharge: 0 },
+            ],
+        }
+    }
+
+    #[test]
+    fn test_required_fee() {
+        let policy = policy();
+        assert_eq!(policy.required_fee(1_000, &[SEND]), 1_000);
+        assert_eq!(policy.required_fee(1_000, &[VOTE]), 0);
+        assert_eq!(policy.required_fee(1_000, &[STORE_CODE]), 3_500);
+        // Half the gas fee at 3x, half at 1x
+        assert_eq!(policy.required_fee(1_000, &[STORE_CODE, SEND]), 2_500);
+        assert_eq!(policy.required_fee::<&str>(1_000, &[]), 1_000);
+        assert_eq!(FeePolicy::default().required_fee(1_000, &[VOTE]), 1_000);
+    }
+
+    #[test]
+    fn test_validate() {
+        assert!(policy().validate().is_ok());
+        assert_eq!(FeePolicy::from_json(&policy().to_json()), Ok(policy()));
+
+        let rule = FeePolicy::from_json(r#"{"rules":[{"msg_type":"/cosmos.bank.v1beta1.MsgSend","surcharge":7}]}"#)
+            .unwrap()
+            .rules[0]
+            .clone();
+        assert_eq!(rule.multiplier_bps, FEE_MULTIPLIER_UNIT_BPS);
+
+        let mut duplicate = policy();
+        duplicate.rules.push(duplicate.rules[1].clone());
+        assert!(duplicate.validate().is_err());
+
+        let mut steep = policy();
+        steep.rules[0].multiplier_bps = MAX_FEE_MULTIPLIER_BPS + 1;
+        assert!(steep.validate().is_err());
+
+        let mut bare = policy();
+        bare.rules[0].msg_type = "MsgStoreCode".to_string();
+        assert!(bare.validate().is_err());
+    }
+}
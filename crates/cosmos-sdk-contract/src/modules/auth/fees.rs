@@ -2,6 +2,9 @@ use crate::types::cosmos_tx::{Fee, Coin};
 use near_sdk::borsh::{BorshDeserialize, BorshSerialize};
 use near_sdk::serde::{Deserialize, Serialize};
 use near_sdk::{env, Gas};
+
+use super::fee_abstraction::{OraclePrice, PriceSource};
+use super::fee_policy::FeePolicy;
 type Balance = u128;
 use std::collections::HashMap;
 
@@ -24,6 +27,8 @@ pub enum FeeError {
     InvalidAmount(String),
     /// Gas limit exceeded
     GasLimitExceeded { limit: u64, requested: u64 },
+    /// No current price for a whitelisted fee denomination
+    PriceUnavailable(String),
 }
 
 impl std::fmt::Display for FeeError {
@@ -47,6 +52,7 @@ impl std::fmt::Display for FeeError {
             FeeError::GasLimitExceeded { limit, requested } => {
                 write!(f, "Gas limit exceeded: limit {}, requested {}", limit, requested)
             }
+            FeeError::PriceUnavailable(denom) => write!(f, "No current price for fee denomination {}", denom),
         }
     }
 }
@@ -68,6 +74,13 @@ pub struct FeeConfig {
     pub enable_fee_grants: bool,
     /// Maximum fee grant allowance
     pub max_fee_grant: Balance,
+    /// Denom minimum fees are quoted in
+    #[serde(default = "default_native_denom")]
+    pub native_denom: String,
+}
+
+fn default_native_denom() -> String {
+    "unear".to_string()
 }
 
 impl Default for FeeConfig {
@@ -84,7 +97,21 @@ impl Default for FeeConfig {
             denom_conversions,
             enable_fee_grants: true,
             max_fee_grant: 10_000_000_000_000_000_000_000_000, // 10 NEAR max grant
+            native_denom: default_native_denom(),
+        }
+    }
+}
+
+impl FeeConfig {
+    /// Defaults with fees quoted in the genesis native denom, converted at
+    /// the rate the default config gives `unear`
+    pub fn for_native_denom(denom: &str) -> Self {
+        let mut config = Self::default();
+        if let Some(rate) = config.denom_conversions.remove("unear") {
+            config.denom_conversions.insert(denom.to_string(), rate);
         }
+        config.native_denom = denom.to_string();
+        config
     }
 }
 
@@ -109,7 +136,15 @@ pub struct FeeProcessor {
     /// Fee grants storage (granter -> grantee -> grant)
     fee_grants: HashMap<String, HashMap<String, FeeGrant>>,
     /// Accumulated fees per denomination
-    accumulated_fees: HashMap<String, Balance>,
+    pub(super) accumulated_fees: HashMap<String, Balance>,
+    /// Non-native denominations accepted for fees (denom -> price source)
+    pub(super) fee_denoms: HashMap<String, PriceSource>,
+    /// Latest oracle price per fee denomination
+    pub(super) oracle_prices: HashMap<String, OraclePrice>,
+    /// Non-native fee coins awaiting a swap into the native denomination
+    pub(super) converted_fees: HashMap<String, Balance>,
+    /// Per message type adjustments set by governance
+    fee_policy: FeePolicy,
 }
 
 impl FeeProcessor {
@@ -119,6 +154,10 @@ impl FeeProcessor {
             config,
             fee_grants: HashMap::new(),
             accumulated_fees: HashMap::new(),
+            fee_denoms: HashMap::new(),
+            oracle_prices: HashMap::new(),
+            converted_fees: HashMap::new(),
+            fee_policy: FeePolicy::default(),
         }
     }
 
@@ -128,17 +167,29 @@ impl FeeProcessor {
         fee: &Fee,
         payer: &str,
         granter: Option<&str>,
+    ) -> Result<Balance, FeeError> {
+        self.process_message_fees(fee, payer, granter, &[] as &[&str])
+    }
+
+    /// Process the fees of a transaction carrying messages of `msg_types`,
+    /// with the required fee adjusted by the fee policy
+    pub fn process_message_fees<S: AsRef<str>>(
+        &mut self,
+        fee: &Fee,
+        payer: &str,
+        granter: Option<&str>,
+        msg_types: &[S],
     ) -> Result<Balance, FeeError> {
         // Calculate total fee in yoctoNEAR
         let total_fee_yocto = self.calculate_fee_in_yocto(&fee.amount)?;
         
-        // Calculate required gas fee
-        let gas_fee = self.calculate_gas_fee(fee.gas_limit)?;
+        // Calculate required fee
+        let required_fee = self.required_fee(fee.gas_limit, msg_types)?;
         
-        // Ensure total fee covers gas cost
-        if total_fee_yocto < gas_fee {
+        // Ensure total fee covers the requirement
+        if total_fee_yocto < required_fee {
             return Err(FeeError::InsufficientFee {
-                required: gas_fee.to_string(),
+                required: required_fee.to_string(),
                 provided: total_fee_yocto.to_string(),
             });
         }
@@ -161,7 +212,7 @@ impl FeeProcessor {
         // Track accumulated fees
         for coin in &fee.amount {
             let amount_yocto = self.convert_to_yocto(&coin)?;
-            *self.accumulated_fees.entry(coin.denom.clone()).or_insert(0) += amount_yocto;
+            self.credit_fee_collector(coin, amount_yocto)?;
         }
 
         Ok(total_fee_yocto)
@@ -169,15 +220,21 @@ impl FeeProcessor {
 
     /// Calculate minimum required fee for a transaction
     pub fn calculate_minimum_fee(&self, gas_limit: u64) -> Fee {
+        self.calculate_minimum_fee_for_messages(gas_limit, &[] as &[&str])
+    }
+
+    /// Minimum fee for a transaction carrying messages of `msg_types`
+    pub fn calculate_minimum_fee_for_messages<S: AsRef<str>>(&self, gas_limit: u64, msg_types: &[S]) -> Fee {
         let gas_fee_yocto = gas_limit.saturating_mul(self.config.min_gas_price as u64) as u128;
+        let gas_fee_yocto = self.fee_policy.required_fee(gas_fee_yocto, msg_types);
         
         // Convert from yoctoNEAR to target denomination using ceiling division
-        let conversion_rate = *self.config.denom_conversions.get("unear").unwrap_or(&1_000_000_000_000_000);
-        let amount = (gas_fee_yocto + conversion_rate - 1) / conversion_rate; // Ceiling division
+        let conversion_rate = *self.config.denom_conversions.get(&self.config.native_denom).unwrap_or(&1_000_000_000_000_000);
+        let amount = gas_fee_yocto.saturating_add(conversion_rate - 1) / conversion_rate; // Ceiling division
         
         Fee {
             amount: vec![Coin {
-                denom: "unear".to_string(),
+                denom: self.config.native_denom.clone(),
                 amount: amount.to_string(),
             }],
             gas_limit,
@@ -203,6 +260,11 @@ impl FeeProcessor {
             .ok_or(FeeError::CalculationOverflow)
     }
 
+    /// Gas fee in yoctoNEAR adjusted by the fee policy for `msg_types`
+    pub fn required_fee<S: AsRef<str>>(&self, gas_limit: u64, msg_types: &[S]) -> Result<Balance, FeeError> {
+        Ok(self.fee_policy.required_fee(self.calculate_gas_fee(gas_limit)?, msg_types))
+    }
+
     /// Convert fee amounts to yoctoNEAR
     pub fn calculate_fee_in_yocto(&self, coins: &[Coin]) -> Result<Balance, FeeError> {
         let mut total = 0u128;
@@ -216,19 +278,25 @@ impl FeeProcessor {
         Ok(total)
     }
 
+    /// Yoctonear per unit of a native or whitelisted fee denomination
+    fn conversion_rate(&self, denom: &str) -> Result<Balance, FeeError> {
+        match self.config.denom_conversions.get(denom) {
+            Some(rate) => Ok(*rate),
+            None => self.fee_denom_rate(denom),
+        }
+    }
+
     /// Convert a single coin to yoctoNEAR
     fn convert_to_yocto(&self, coin: &Coin) -> Result<Balance, FeeError> {
         // Get conversion rate
-        let rate = self.config.denom_conversions
-            .get(&coin.denom)
-            .ok_or_else(|| FeeError::InvalidDenom(coin.denom.clone()))?;
+        let rate = self.conversion_rate(&coin.denom)?;
 
         // Parse amount
         let amount: u128 = coin.amount.parse()
             .map_err(|_| FeeError::InvalidAmount(coin.amount.clone()))?;
 
         // Calculate yoctoNEAR amount
-        amount.checked_mul(*rate)
+        amount.checked_mul(rate)
             .ok_or(FeeError::CalculationOverflow)
     }
 
@@ -365,6 +433,16 @@ impl FeeProcessor {
         &self.config
     }
 
+    /// Active fee policy
+    pub fn fee_policy(&self) -> &FeePolicy {
+        &self.fee_policy
+    }
+
+    /// Switch to the policy governance activated
+    pub fn set_fee_policy(&mut self, policy: FeePolicy) {
+        self.fee_policy = policy;
+    }
+
     /// Add or update denomination conversion rate
     pub fn set_denom_conversion(&mut self, denom: String, rate: Balance) {
         self.config.denom_conversions.insert(denom, rate);
@@ -375,9 +453,7 @@ impl FeeProcessor {
         let gas_fee_yocto = self.calculate_gas_fee(gas_limit)?;
         
         // Get conversion rate
-        let rate = self.config.denom_conversions
-            .get(denom)
-            .ok_or_else(|| FeeError::InvalidDenom(denom.to_string()))?;
+        let rate = self.conversion_rate(denom)?;
 
         // Convert from yoctoNEAR to target denomination
         // Use ceiling division to avoid losing precision
@@ -494,6 +570,11 @@ mod tests {
         assert_eq!(fee.gas_limit, 100_000_000);
         assert_eq!(fee.amount.len(), 1);
         assert_eq!(fee.amount[0].denom, "unear");
+
+        let custom = FeeProcessor::new(FeeConfig::for_native_denom("uproxima"));
+        let custom_fee = custom.calculate_minimum_fee(100_000_000);
+        assert_eq!(custom_fee.amount[0].denom, "uproxima");
+        assert_eq!(custom_fee.amount[0].amount, fee.amount[0].amount);
     }
 
     #[test]
@@ -548,6 +629,39 @@ mod tests {
         assert_eq!(accumulated.get("unear"), Some(&1_000_000_000_000_000_000_000));
     }
 
+    #[test]
+    fn test_fee_policy_adjusts_required_fee() {
+        use crate::modules::auth::fee_policy::{FeePolicy, MessageFeeRule};
+
+        let mut processor = create_test_fee_processor();
+        processor.set_fee_policy(FeePolicy {
+            rules: vec![
+                MessageFeeRule { msg_type: "/cosmwasm.wasm.v1.MsgStoreCode".to_string(), multiplier_bps: 30_000, surcharge: 0 },
+                MessageFeeRule { msg_type: "/cosmos.gov.v1beta1.MsgVote".to_string(), multiplier_bps: 0, surcharge: 0 },
+            ],
+        });
+
+        // The plain gas fee is 10 unear
+        let fee = Fee {
+            amount: vec![Coin::new("unear", "10")],
+            gas_limit: 100_000_000,
+            payer: String::new(),
+            granter: String::new(),
+        };
+        assert!(processor.process_message_fees(&fee, "alice", None, &["/cosmos.bank.v1beta1.MsgSend"]).is_ok());
+        assert!(matches!(
+            processor.process_message_fees(&fee, "alice", None, &["/cosmwasm.wasm.v1.MsgStoreCode"]),
+            Err(FeeError::InsufficientFee { .. })
+        ));
+        assert_eq!(
+            processor.calculate_minimum_fee_for_messages(100_000_000, &["/cosmwasm.wasm.v1.MsgStoreCode"]).amount[0].amount,
+            "30"
+        );
+
+        let free = Fee { amount: vec![], ..fee };
+        assert_eq!(processor.process_message_fees(&free, "alice", None, &["/cosmos.gov.v1beta1.MsgVote"]), Ok(0));
+    }
+
     #[test]
     fn test_insufficient_fee() {
         let mut processor = create_test_fee_processor();
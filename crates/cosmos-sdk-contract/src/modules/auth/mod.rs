@@ -1,5 +1,14 @@
 pub mod accounts;
+pub mod fee_abstraction;
+pub mod fee_policy;
 pub mod fees;
+pub mod recovery;
+pub mod session;
+pub mod signed_query;
 
 pub use accounts::*;
-pub use fees::*;
\ No newline at end of file
+pub use fee_abstraction::{OraclePrice, PriceSource, NATIVE_FEE_DENOM};
+pub use fee_policy::{FeePolicy, MessageFeeRule, FEE_POLICY_PARAM};
+pub use fees::*;
+pub use session::{SessionGrant, SessionKey, SessionKeyKind, SpendLimit, MAX_SESSION_KEYS};
+pub use signed_query::{SignedQuery, SIGNED_QUERY_WINDOW_NS};
\ No newline at end of file
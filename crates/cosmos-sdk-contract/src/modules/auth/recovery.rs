@@ -0,0 +1,235 @@
+/// Account Recovery
+///
+/// A Cosmos account is controlled by a single secp256k1 key, so losing the
+/// key used to mean losing the account. Here the key holder can bind a NEAR
+/// account as a recovery account. If the key is lost, a call signed by that
+/// NEAR account installs a new public key and resets the sequence, the same
+/// way a NEAR full access key can add a fresh key to an account.
+///
+/// Binding and clearing the recovery account are authorized by a signature
+/// of the account key over the address, the recovery account and the
+/// account sequence, see `key_action_sign_bytes`. The sequence is bumped on
+/// success, so an observed authorization cannot be replayed.
+///
+/// The address stays the same after recovery. The new key's own derived
+/// address is recorded as an alias, so transactions signed with it resolve
+/// to the recovered account, while the old key is rejected from then on.
+
+use near_sdk::serde_json::json;
+use near_sdk::{env, AccountId};
+
+use super::accounts::{AccountError, AccountManager, CosmosAccount};
+use crate::crypto::{CosmosPublicKey, SignatureBuilder};
+
+/// Bytes the account key signs to authorize `action` on `address`
+///
+/// The chain id keeps the authorization from being used on another chain
+/// that knows the same key, and the sequence from being used twice.
+pub fn key_action_sign_bytes(chain_id: &str, address: &str, action: &str, params: &str, sequence: u64) -> Vec<u8> {
+    json!({
+        "action": action,
+        "address": address,
+        "chain_id": chain_id,
+        "params": params,
+        "sequence": sequence.to_string(),
+    })
+    .to_string()
+    .into_bytes()
+}
+
+impl AccountManager {
+    /// Address of the account controlled by a public key
+    ///
+    /// Fails for a key that was replaced through recovery.
+    pub fn resolve_address(&self, public_key: &CosmosPublicKey) -> Result<String, AccountError> {
+        let derived = public_key.to_cosmos_address(&self.get_config().address_prefix)
+            .map_err(|e| AccountError::AddressDerivationFailed(e.to_string()))?;
+        let address = self.key_aliases.get(&derived).unwrap_or(derived);
+
+        if let Some(current) = self.get_account(&address).and_then(|account| account.public_key) {
+            if &current != public_key {
+                return Err(AccountError::InvalidPublicKey(format!("key of {} was rotated", address)));
+            }
+        }
+        Ok(address)
+    }
+
+    /// Bind a NEAR account that can recover `address`
+    ///
+    /// `signature` is the account key's signature of the `set_recovery_account`
+    /// action with the recovery account as its params.
+    pub fn set_recovery_account(
+        &mut self,
+        chain_id: &str,
+        address: &str,
+        recovery_account: AccountId,
+        signature: &[u8],
+    ) -> Result<(), AccountError> {
+        self.authorize_key_action(chain_id, address, "set_recovery_account", recovery_account.as_str(), signature)?;
+        self.recovery_accounts.insert(&address.to_string(), &recovery_account);
+        env::log_str(&format!("EVENT: recovery_bound address={} recovery_account={}", address, recovery_account));
+        Ok(())
+    }
+
+    pub fn clear_recovery_account(&mut self, chain_id: &str, address: &str, signature: &[u8]) -> Result<(), AccountError> {
+        if self.get_recovery_account(address).is_none() {
+            return Err(AccountError::AccountNotFound(format!("no recovery account for {}", address)));
+        }
+        self.authorize_key_action(chain_id, address, "clear_recovery_account", "", signature)?;
+        self.recovery_accounts.remove(&address.to_string());
+        env::log_str(&format!("EVENT: recovery_unbound address={}", address));
+        Ok(())
+    }
+
+    pub fn get_recovery_account(&self, address: &str) -> Option<AccountId> {
+        self.recovery_accounts.get(&address.to_string())
+    }
+
+    /// Install a new key on `address` from its bound NEAR account
+    ///
+    /// The sequence restarts at 0; transactions signed with the old key
+    /// cannot be replayed because the old key no longer verifies.
+    pub fn recover_account(
+        &mut self,
+        caller: &AccountId,
+        address: &str,
+        new_public_key: CosmosPublicKey,
+    ) -> Result<CosmosAccount, AccountError> {
+        let mut account = self.get_account(address)
+            .ok_or_else(|| AccountError::AccountNotFound(address.to_string()))?;
+        if self.get_recovery_account(address).as_ref() != Some(caller) {
+            return Err(AccountError::Unauthorized(format!("{} cannot recover {}", caller, address)));
+        }
+
+        let derived = new_public_key.to_cosmos_address(&self.get_config().address_prefix)
+            .map_err(|e| AccountError::AddressDerivationFailed(e.to_string()))?;
+        if derived != address {
+            let alias = self.key_aliases.get(&derived);
+            if self.get_account(&derived).is_some() || alias.map_or(false, |alias| alias != address) {
+                return Err(AccountError::AccountExists(derived));
+            }
+        }
+
+        // Drop the alias of the key being replaced
+        if let Some(old_key) = &account.public_key {
+            if let Ok(old_derived) = old_key.to_cosmos_address(&self.get_config().address_prefix) {
+                if old_derived != address {
+                    self.key_aliases.remove(&old_derived);
+                }
+            }
+        }
+        if derived != address {
+            self.key_aliases.insert(&derived, &address.to_string());
+        }
+
+        account.set_public_key(new_public_key);
+        account.sequence = 0;
+        self.accounts.insert(&address.to_string(), &account);
+
+        env::log_str(&format!("EVENT: account_recovered address={} by={} key_address={}", address, caller, derived));
+        Ok(account)
+    }
+
+    /// Check the account key's signature of `action` and bump the sequence
+    pub(super) fn authorize_key_action(
+        &mut self,
+        chain_id: &str,
+        address: &str,
+        action: &str,
+        params: &str,
+        signature: &[u8],
+    ) -> Result<(), AccountError> {
+        let account = self.get_account(address)
+            .ok_or_else(|| AccountError::AccountNotFound(address.to_string()))?;
+        let public_key = account.public_key
+            .ok_or_else(|| AccountError::InvalidPublicKey(format!("{} has no registered key", address)))?;
+
+        let sign_bytes = key_action_sign_bytes(chain_id, address, action, params, account.sequence);
+        let valid = SignatureBuilder::new(chain_id.to_string())
+            .verify_message(signature, &sign_bytes, &public_key)
+            .map_err(|e| AccountError::Unauthorized(e.to_string()))?;
+        if !valid {
+            return Err(AccountError::Unauthorized(format!("signature does not authorize {} on {}", action, address)));
+        }
+        self.increment_sequence(address)?;
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::modules::auth::AccountConfig;
+    use k256::ecdsa::signature::Signer;
+    use k256::ecdsa::{Signature, SigningKey};
+    use sha2::{Digest, Sha256};
+
+    const CHAIN_ID: &str = "near-localnet";
+
+    fn key(seed: u8) -> CosmosPublicKey {
+        let mut bytes = vec![0x02];
+        bytes.extend(std::iter::repeat(seed).take(32));
+        CosmosPublicKey::secp256k1(bytes).unwrap()
+    }
+
+    fn signing_key(seed: u8) -> (SigningKey, CosmosPublicKey) {
+        let key = SigningKey::from_slice(&[seed; 32]).unwrap();
+        let public_key = key.verifying_key().to_encoded_point(true).as_bytes().to_vec();
+        (key, CosmosPublicKey::secp256k1(public_key).unwrap())
+    }
+
+    fn sign(key: &SigningKey, address: &str, action: &str, params: &str, sequence: u64) -> Vec<u8> {
+        let hash = Sha256::digest(key_action_sign_bytes(CHAIN_ID, address, action, params, sequence));
+        let signature: Signature = key.sign(&hash);
+        let mut bytes = signature.to_bytes().to_vec();
+        bytes.push(0);
+        bytes
+    }
+
+    #[test]
+    fn test_binding_needs_the_account_signature() {
+        let mut manager = AccountManager::new(AccountConfig::default());
+        let (owner, owner_key) = signing_key(7);
+        let (mallory, _) = signing_key(8);
+        let address = manager.create_account(owner_key).unwrap().address;
+        let recovery = "mallory.near";
+
+        // Knowing the public key is not enough, nor is another key's signature
+        let forged = sign(&mallory, &address, "set_recovery_account", recovery, 0);
+        assert!(manager.set_recovery_account(CHAIN_ID, &address, recovery.parse().unwrap(), &forged).is_err());
+
+        let signature = sign(&owner, &address, "set_recovery_account", recovery, 0);
+        manager.set_recovery_account(CHAIN_ID, &address, recovery.parse().unwrap(), &signature).unwrap();
+        assert_eq!(manager.get_account(&address).unwrap().sequence, 1);
+
+        // The same signature cannot be replayed once the sequence moved on
+        manager.clear_recovery_account(CHAIN_ID, &address, &sign(&owner, &address, "clear_recovery_account", "", 1)).unwrap();
+        assert!(manager.set_recovery_account(CHAIN_ID, &address, recovery.parse().unwrap(), &signature).is_err());
+        assert_eq!(manager.get_recovery_account(&address), None);
+    }
+
+    #[test]
+    fn test_recover_account_with_near_account() {
+        let mut manager = AccountManager::new(AccountConfig::default());
+        let ((old_signer, old_key), new_key) = (signing_key(1), key(2));
+        let address = manager.create_account(old_key.clone()).unwrap().address;
+        manager.increment_sequence(&address).unwrap();
+
+        let recovery: AccountId = "alice.near".parse().unwrap();
+        let signature = sign(&old_signer, &address, "set_recovery_account", recovery.as_str(), 1);
+        manager.set_recovery_account(CHAIN_ID, &address, recovery.clone(), &signature).unwrap();
+
+        let mallory: AccountId = "mallory.near".parse().unwrap();
+        assert!(manager.recover_account(&mallory, &address, new_key.clone()).is_err());
+
+        let account = manager.recover_account(&recovery, &address, new_key.clone()).unwrap();
+        assert_eq!(account.sequence, 0);
+        assert_eq!(account.public_key, Some(new_key.clone()));
+
+        // The new key signs for the same account and the old one is retired
+        assert_eq!(manager.resolve_address(&new_key).unwrap(), address);
+        assert_eq!(manager.get_or_create_account(new_key.clone()).unwrap().account_number, account.account_number);
+        assert!(manager.resolve_address(&old_key).is_err());
+        assert!(manager.create_account(new_key).is_err());
+    }
+}
@@ -0,0 +1,488 @@
+/// Session Keys
+///
+/// Games and dApps want to submit a user's small, routine messages without
+/// a wallet prompt each time and without holding the user's key. A session
+/// key is a second key the account holder registers with a grant: the
+/// message types it may sign, how much of each denom it may move per
+/// message and in total, and when it expires.
+///
+/// Two kinds of key can hold a grant. A Cosmos public key signs transactions
+/// like any account key. Its derived address keeps its own sequence, and the
+/// transaction handler checks the messages against the grant, treats the
+/// granting account as their signer and charges the grant once the messages
+/// have succeeded. A NEAR function-call access key
+/// already limits which contract it may call; registering it here adds the
+/// message and spending limits, which a contract checks with
+/// `authorize_near_session` against `env::signer_account_pk()`. A NEAR key
+/// whose grant was revoked or ran out stays rejected rather than falling
+/// back to the unlimited access of a key that never had a grant.
+///
+/// Granting and revoking a Cosmos session key is authorized by a signature
+/// of the account key, see `key_action_sign_bytes`.
+
+use near_sdk::borsh::{BorshDeserialize, BorshSerialize};
+use near_sdk::serde::{Deserialize, Serialize};
+use near_sdk::serde_json::json;
+use near_sdk::{env, AccountId, PublicKey};
+
+use super::accounts::{AccountError, AccountManager};
+use crate::crypto::CosmosPublicKey;
+use crate::types::cosmos_messages::{type_urls, Coin, MsgBurn, MsgDelegate, MsgDeposit, MsgMultiSend, MsgSend, MsgTransfer};
+use crate::types::cosmos_tx::Any;
+
+/// Session keys an account may hold at once, expired ones included
+pub const MAX_SESSION_KEYS: usize = 16;
+
+/// Allowance of a session key in one denom
+#[derive(Clone, Debug, PartialEq, BorshSerialize, BorshDeserialize, Serialize, Deserialize)]
+pub struct SpendLimit {
+    pub denom: String,
+    /// Most a single message may move
+    pub per_message: u128,
+    /// What the key may still move in total
+    pub remaining: u128,
+}
+
+/// What a session key may do
+#[derive(Clone, Debug, PartialEq, BorshSerialize, BorshDeserialize, Serialize, Deserialize)]
+pub struct SessionGrant {
+    /// Type URLs of the messages the key may sign
+    pub allowed_messages: Vec<String>,
+    /// Denoms without a limit cannot be moved at all
+    pub spend_limits: Vec<SpendLimit>,
+    /// Timestamp in nanoseconds from which the key is rejected
+    pub expires_at: u64,
+}
+
+#[derive(Clone, Debug, PartialEq, BorshSerialize, BorshDeserialize, Serialize, Deserialize)]
+pub enum SessionKeyKind {
+    Cosmos(CosmosPublicKey),
+    NearAccessKey(PublicKey),
+}
+
+#[derive(Clone, Debug, PartialEq, BorshSerialize, BorshDeserialize, Serialize, Deserialize)]
+pub struct SessionKey {
+    /// Derived address of a Cosmos key, `near:<account>:<key>` for a NEAR key
+    pub id: String,
+    /// Cosmos address or NEAR account the key acts for
+    pub granter: String,
+    pub key: SessionKeyKind,
+    pub grant: SessionGrant,
+}
+
+impl SessionKey {
+    /// Charge one message against the grant
+    fn charge(&mut self, msg_type: &str, spend: &[(String, u128)], now: u64) -> Result<(), AccountError> {
+        if now >= self.grant.expires_at {
+            return Err(AccountError::SessionRejected(format!("session key {} expired", self.id)));
+        }
+        if !self.grant.allowed_messages.iter().any(|allowed| allowed == msg_type) {
+            return Err(AccountError::SessionRejected(format!("{} may not sign {}", self.id, msg_type)));
+        }
+        for (denom, amount) in spend {
+            let limit = self.grant.spend_limits.iter_mut()
+                .find(|limit| &limit.denom == denom)
+                .ok_or_else(|| AccountError::SessionRejected(format!("{} may not move {}", self.id, denom)))?;
+            if *amount > limit.per_message {
+                return Err(AccountError::SessionRejected(format!(
+                    "{}{} is over the per-message limit of {}{}", amount, denom, limit.per_message, denom
+                )));
+            }
+            if *amount > limit.remaining {
+                return Err(AccountError::SessionRejected(format!(
+                    "{}{} is over the remaining allowance of {}{}", amount, denom, limit.remaining, denom
+                )));
+            }
+            limit.remaining -= amount;
+        }
+        Ok(())
+    }
+}
+
+fn near_session_id(owner: &AccountId, access_key: &PublicKey) -> String {
+    format!("near:{}:{}", owner, String::from(access_key))
+}
+
+/// Params the account key signs to grant `grant` to the session key `id`
+pub fn session_grant_params(id: &str, grant: &SessionGrant) -> String {
+    json!({ "grant": grant, "session_key": id }).to_string()
+}
+
+fn parse_coins(coins: &[Coin]) -> Result<Vec<(String, u128)>, AccountError> {
+    coins.iter()
+        .map(|coin| coin.amount.parse::<u128>()
+            .map(|amount| (coin.denom.clone(), amount))
+            .map_err(|_| AccountError::SessionRejected(format!("invalid amount {}", coin.amount))))
+        .collect()
+}
+
+/// Account a message debits and the coins it moves out of it
+///
+/// Messages that move no funds give no account and no coins.
+pub fn message_spend(msg: &Any) -> Result<(Option<String>, Vec<(String, u128)>), AccountError> {
+    fn decode<T: serde::de::DeserializeOwned>(msg: &Any) -> Result<T, AccountError> {
+        serde_json::from_slice(&msg.value)
+            .map_err(|e| AccountError::SessionRejected(format!("cannot decode {}: {}", msg.type_url, e)))
+    }
+
+    match msg.type_url.as_str() {
+        type_urls::MSG_SEND => {
+            let send: MsgSend = decode(msg)?;
+            Ok((Some(send.from_address), parse_coins(&send.amount)?))
+        }
+        type_urls::MSG_MULTI_SEND => {
+            let multi: MsgMultiSend = decode(msg)?;
+            let mut inputs = multi.inputs.iter();
+            let source = inputs.next().map(|input| input.address.clone());
+            if inputs.any(|input| Some(&input.address) != source.as_ref()) {
+                return Err(AccountError::SessionRejected("multi-send from several accounts".to_string()));
+            }
+            let coins: Vec<Coin> = multi.inputs.into_iter().flat_map(|input| input.coins).collect();
+            Ok((source, parse_coins(&coins)?))
+        }
+        type_urls::MSG_BURN => {
+            let burn: MsgBurn = decode(msg)?;
+            Ok((Some(burn.from_address), parse_coins(&burn.amount)?))
+        }
+        type_urls::MSG_DELEGATE => {
+            let delegate: MsgDelegate = decode(msg)?;
+            Ok((Some(delegate.delegator_address), parse_coins(&[delegate.amount])?))
+        }
+        type_urls::MSG_DEPOSIT => {
+            let deposit: MsgDeposit = decode(msg)?;
+            Ok((Some(deposit.depositor), parse_coins(&deposit.amount)?))
+        }
+        type_urls::MSG_TRANSFER => {
+            let transfer: MsgTransfer = decode(msg)?;
+            Ok((Some(transfer.sender), parse_coins(&[transfer.token])?))
+        }
+        _ => Ok((None, Vec::new())),
+    }
+}
+
+impl AccountManager {
+    /// Register a Cosmos key that may sign limited messages for `address`
+    ///
+    /// `signature` is the account key's signature of the `grant_session_key`
+    /// action, see `session_grant_params`. Returns the session key's derived
+    /// address.
+    pub fn grant_session_key(
+        &mut self,
+        chain_id: &str,
+        address: &str,
+        session_key: CosmosPublicKey,
+        grant: SessionGrant,
+        signature: &[u8],
+    ) -> Result<String, AccountError> {
+        let id = session_key.to_cosmos_address(&self.get_config().address_prefix)
+            .map_err(|e| AccountError::AddressDerivationFailed(e.to_string()))?;
+        // A used session key has an account of its own for its sequence
+        let renewal = self.session_keys.get(&id).is_some();
+        if !renewal && (self.get_account(&id).is_some() || self.key_aliases.get(&id).is_some()) {
+            return Err(AccountError::AccountExists(id));
+        }
+        self.authorize_key_action(chain_id, address, "grant_session_key", &session_grant_params(&id, &grant), signature)?;
+        self.insert_session(SessionKey {
+            id: id.clone(),
+            granter: address.to_string(),
+            key: SessionKeyKind::Cosmos(session_key),
+            grant,
+        })?;
+        Ok(id)
+    }
+
+    /// Limit what a NEAR function-call access key of `owner` may do
+    ///
+    /// `owner` must be the caller and sign with a full access key, so a
+    /// limited key cannot widen its own grant.
+    pub fn grant_near_session_key(
+        &mut self,
+        owner: &AccountId,
+        access_key: PublicKey,
+        grant: SessionGrant,
+    ) -> Result<String, AccountError> {
+        let id = near_session_id(owner, &access_key);
+        self.insert_session(SessionKey {
+            id: id.clone(),
+            granter: owner.to_string(),
+            key: SessionKeyKind::NearAccessKey(access_key),
+            grant,
+        })?;
+        self.closed_near_sessions.remove(&id);
+        Ok(id)
+    }
+
+    fn insert_session(&mut self, session: SessionKey) -> Result<(), AccountError> {
+        if session.grant.expires_at <= env::block_timestamp() {
+            return Err(AccountError::SessionRejected("grant expires in the past".to_string()));
+        }
+        if session.grant.allowed_messages.is_empty() {
+            return Err(AccountError::SessionRejected("grant allows no messages".to_string()));
+        }
+        if self.session_keys.get(&session.id).map_or(false, |existing| existing.granter != session.granter) {
+            return Err(AccountError::AccountExists(session.id));
+        }
+
+        // Expired keys make room for new ones
+        let now = env::block_timestamp();
+        let mut ids = self.session_ids.get(&session.granter).unwrap_or_default();
+        ids.retain(|id| match self.session_keys.get(id) {
+            Some(existing) if existing.grant.expires_at > now => true,
+            existing => {
+                self.close_session(id, existing.as_ref());
+                false
+            }
+        });
+        if !ids.contains(&session.id) {
+            if ids.len() >= MAX_SESSION_KEYS {
+                return Err(AccountError::SessionRejected(format!(
+                    "{} already holds {} session keys", session.granter, MAX_SESSION_KEYS
+                )));
+            }
+            ids.push(session.id.clone());
+        }
+        self.session_ids.insert(&session.granter, &ids);
+        self.session_keys.insert(&session.id, &session);
+
+        env::log_str(&format!(
+            "EVENT: session_key_granted granter={} key={} messages={} expires_at={}",
+            session.granter, session.id, session.grant.allowed_messages.join(","), session.grant.expires_at
+        ));
+        Ok(())
+    }
+
+    /// Revoke a session key of `address`, authorized by the account key's
+    /// signature of the `revoke_session_key` action with the key id as params
+    pub fn revoke_session_key(&mut self, chain_id: &str, address: &str, id: &str, signature: &[u8]) -> Result<(), AccountError> {
+        self.authorize_key_action(chain_id, address, "revoke_session_key", id, signature)?;
+        self.remove_session(address, id)
+    }
+
+    pub fn revoke_near_session_key(&mut self, owner: &AccountId, access_key: &PublicKey) -> Result<(), AccountError> {
+        self.remove_session(owner.as_str(), &near_session_id(owner, access_key))
+    }
+
+    fn remove_session(&mut self, granter: &str, id: &str) -> Result<(), AccountError> {
+        match self.session_keys.get(&id.to_string()) {
+            Some(session) if session.granter == granter => {}
+            _ => return Err(AccountError::AccountNotFound(format!("no session key {} for {}", id, granter))),
+        }
+        let session = self.session_keys.get(&id.to_string());
+        self.close_session(id, session.as_ref());
+        let mut ids = self.session_ids.get(&granter.to_string()).unwrap_or_default();
+        ids.retain(|existing| existing != id);
+        self.session_ids.insert(&granter.to_string(), &ids);
+        env::log_str(&format!("EVENT: session_key_revoked granter={} key={}", granter, id));
+        Ok(())
+    }
+
+    /// Drop a session key, leaving a NEAR key rejected from then on
+    fn close_session(&mut self, id: &str, session: Option<&SessionKey>) {
+        self.session_keys.remove(&id.to_string());
+        if let Some(SessionKey { key: SessionKeyKind::NearAccessKey(_), .. }) = session {
+            self.closed_near_sessions.insert(&id.to_string());
+        }
+    }
+
+    pub fn get_session_key(&self, id: &str) -> Option<SessionKey> {
+        self.session_keys.get(&id.to_string())
+    }
+
+    pub fn session_keys_of(&self, granter: &str) -> Vec<SessionKey> {
+        self.session_ids.get(&granter.to_string())
+            .unwrap_or_default()
+            .iter()
+            .filter_map(|id| self.session_keys.get(id))
+            .collect()
+    }
+
+    /// Check a transaction signed by the key at `key_address` against its
+    /// grant
+    ///
+    /// Returns the session key charged with the messages when the address is
+    /// a session key, or `None` for an ordinary account. Nothing is stored;
+    /// the caller saves the charge with `commit_session` once the messages
+    /// have succeeded.
+    pub fn authorize_session_messages(
+        &self,
+        key_address: &str,
+        messages: &[Any],
+        now: u64,
+    ) -> Result<Option<SessionKey>, AccountError> {
+        let mut session = match self.session_keys.get(&key_address.to_string()) {
+            Some(session) => session,
+            None => return Ok(None),
+        };
+        for msg in messages {
+            let (source, spend) = message_spend(msg)?;
+            if source.map_or(false, |source| source != session.granter) {
+                return Err(AccountError::SessionRejected(format!(
+                    "{} moves funds of another account than {}", msg.type_url, session.granter
+                )));
+            }
+            session.charge(&msg.type_url, &spend, now)?;
+        }
+        Ok(Some(session))
+    }
+
+    /// Store the charge of an authorized session key
+    pub fn commit_session(&mut self, session: &SessionKey) {
+        self.session_keys.insert(&session.id, session);
+    }
+
+    /// Charge a call made with a NEAR access key of `owner` to its grant
+    ///
+    /// Keys that never had a grant, full access keys among them, are not
+    /// limited. Keys whose grant was revoked or expired are refused.
+    pub fn authorize_near_session(
+        &mut self,
+        owner: &AccountId,
+        signer_key: &PublicKey,
+        msg_type: &str,
+        spend: &[(String, u128)],
+    ) -> Result<(), AccountError> {
+        let id = near_session_id(owner, signer_key);
+        if self.closed_near_sessions.contains(&id) {
+            return Err(AccountError::SessionRejected(format!("session key {} was revoked or expired", id)));
+        }
+        if let Some(mut session) = self.session_keys.get(&id) {
+            session.charge(msg_type, spend, env::block_timestamp())?;
+            self.session_keys.insert(&id, &session);
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::modules::auth::recovery::key_action_sign_bytes;
+    use crate::modules::auth::AccountConfig;
+    use k256::ecdsa::signature::Signer;
+    use k256::ecdsa::{Signature, SigningKey};
+    use near_sdk::test_utils::VMContextBuilder;
+    use near_sdk::testing_env;
+    use sha2::{Digest, Sha256};
+
+    const CHAIN_ID: &str = "near-localnet";
+
+    fn key(seed: u8) -> CosmosPublicKey {
+        let mut bytes = vec![0x02];
+        bytes.extend(std::iter::repeat(seed).take(32));
+        CosmosPublicKey::secp256k1(bytes).unwrap()
+    }
+
+    fn owner() -> (SigningKey, CosmosPublicKey) {
+        let key = SigningKey::from_slice(&[7; 32]).unwrap();
+        let public_key = key.verifying_key().to_encoded_point(true).as_bytes().to_vec();
+        (key, CosmosPublicKey::secp256k1(public_key).unwrap())
+    }
+
+    fn sign(key: &SigningKey, address: &str, action: &str, params: &str, sequence: u64) -> Vec<u8> {
+        let hash = Sha256::digest(key_action_sign_bytes(CHAIN_ID, address, action, params, sequence));
+        let signature: Signature = key.sign(&hash);
+        let mut bytes = signature.to_bytes().to_vec();
+        bytes.push(0);
+        bytes
+    }
+
+    fn grant() -> SessionGrant {
+        SessionGrant {
+            allowed_messages: vec![type_urls::MSG_SEND.to_string()],
+            spend_limits: vec![SpendLimit { denom: "unear".to_string(), per_message: 100, remaining: 150 }],
+            expires_at: 1_000,
+        }
+    }
+
+    fn send(from: &str, amount: u128) -> Any {
+        let msg = MsgSend {
+            from_address: from.to_string(),
+            to_address: "near1game".to_string(),
+            amount: vec![Coin { denom: "unear".to_string(), amount: amount.to_string() }],
+            memo: String::new(),
+        };
+        Any::new(type_urls::MSG_SEND, serde_json::to_vec(&msg).unwrap())
+    }
+
+    #[test]
+    fn test_cosmos_session_key_limits() {
+        testing_env!(VMContextBuilder::new().block_timestamp(10).build());
+        let mut manager = AccountManager::new(AccountConfig::default());
+        let (owner, owner_key) = owner();
+        let address = manager.create_account(owner_key).unwrap().address;
+        let session_id = key(3).to_cosmos_address(&manager.get_config().address_prefix).unwrap();
+        let params = session_grant_params(&session_id, &grant());
+
+        // Only a signature of the account key grants, and only once
+        let forged = sign(&SigningKey::from_slice(&[8; 32]).unwrap(), &address, "grant_session_key", &params, 0);
+        assert!(manager.grant_session_key(CHAIN_ID, &address, key(3), grant(), &forged).is_err());
+        let signature = sign(&owner, &address, "grant_session_key", &params, 0);
+        let session = manager.grant_session_key(CHAIN_ID, &address, key(3), grant(), &signature).unwrap();
+        assert!(manager.grant_session_key(CHAIN_ID, &address, key(3), grant(), &signature).is_err());
+        assert_eq!(manager.session_keys_of(&address).len(), 1);
+
+        assert_eq!(manager.authorize_session_messages(&address, &[send(&address, 10)], 10).unwrap(), None);
+        let charged = manager.authorize_session_messages(&session, &[send(&address, 80)], 10).unwrap().unwrap();
+        assert_eq!(charged.granter, address);
+        // Nothing is charged until the messages succeeded
+        assert_eq!(manager.get_session_key(&session).unwrap().grant.spend_limits[0].remaining, 150);
+        manager.commit_session(&charged);
+
+        // Over the per-message limit, over the remaining allowance, someone
+        // else's funds and a message type outside the grant all fail
+        assert!(manager.authorize_session_messages(&session, &[send(&address, 101)], 10).is_err());
+        assert!(manager.authorize_session_messages(&session, &[send(&address, 50), send(&address, 50)], 10).is_err());
+        assert!(manager.authorize_session_messages(&session, &[send("near1other", 10)], 10).is_err());
+        let vote = Any::new(type_urls::MSG_VOTE, b"{}".to_vec());
+        assert!(manager.authorize_session_messages(&session, &[vote], 10).is_err());
+
+        // A failed transaction charged nothing
+        assert_eq!(manager.get_session_key(&session).unwrap().grant.spend_limits[0].remaining, 70);
+        assert!(manager.authorize_session_messages(&session, &[send(&address, 70)], 1_000).is_err());
+
+        let signature = sign(&owner, &address, "revoke_session_key", &session, 1);
+        manager.revoke_session_key(CHAIN_ID, &address, &session, &signature).unwrap();
+        assert_eq!(manager.authorize_session_messages(&session, &[send(&address, 1)], 10).unwrap(), None);
+    }
+
+    #[test]
+    fn test_near_access_key_session() {
+        testing_env!(VMContextBuilder::new().block_timestamp(10).build());
+        let mut manager = AccountManager::new(AccountConfig::default());
+        let owner: AccountId = "alice.near".parse().unwrap();
+        let access_key: PublicKey = "ed25519:6E8sCci9badyRkXb3JoRpBj5p8C6Tw41ELDZoiihKEtp".parse().unwrap();
+        let other_key: PublicKey = "ed25519:DcA2MzgpJbrUATQLLceocVckhhAqrkingax4oJ9kZ847".parse().unwrap();
+        manager.grant_near_session_key(&owner, access_key.clone(), grant()).unwrap();
+
+        let spend = vec![("unear".to_string(), 100)];
+        manager.authorize_near_session(&owner, &access_key, type_urls::MSG_SEND, &spend).unwrap();
+        assert!(manager.authorize_near_session(&owner, &access_key, type_urls::MSG_SEND, &spend).is_err());
+        assert!(manager.authorize_near_session(&owner, &access_key, type_urls::MSG_DELEGATE, &[]).is_err());
+        manager.authorize_near_session(&owner, &other_key, type_urls::MSG_SEND, &spend).unwrap();
+
+        manager.revoke_near_session_key(&owner, &access_key).unwrap();
+        assert!(manager.session_keys_of(owner.as_str()).is_empty());
+
+        // A revoked key is refused instead of becoming unlimited
+        assert!(manager.authorize_near_session(&owner, &access_key, type_urls::MSG_SEND, &[]).is_err());
+        manager.grant_near_session_key(&owner, access_key.clone(), grant()).unwrap();
+        manager.authorize_near_session(&owner, &access_key, type_urls::MSG_SEND, &[]).unwrap();
+    }
+
+    #[test]
+    fn test_expired_near_key_stays_rejected() {
+        testing_env!(VMContextBuilder::new().block_timestamp(10).build());
+        let mut manager = AccountManager::new(AccountConfig::default());
+        let owner: AccountId = "alice.near".parse().unwrap();
+        let access_key: PublicKey = "ed25519:6E8sCci9badyRkXb3JoRpBj5p8C6Tw41ELDZoiihKEtp".parse().unwrap();
+        let other_key: PublicKey = "ed25519:DcA2MzgpJbrUATQLLceocVckhhAqrkingax4oJ9kZ847".parse().unwrap();
+        manager.grant_near_session_key(&owner, access_key.clone(), grant()).unwrap();
+
+        // A new grant prunes the expired one without lifting its limits
+        testing_env!(VMContextBuilder::new().block_timestamp(1_000).build());
+        manager.grant_near_session_key(&owner, other_key, SessionGrant { expires_at: 2_000, ..grant() }).unwrap();
+        assert!(manager.get_session_key(&near_session_id(&owner, &access_key)).is_none());
+        let error = manager.authorize_near_session(&owner, &access_key, type_urls::MSG_SEND, &[]).unwrap_err();
+        assert!(error.to_string().contains("revoked or expired"));
+    }
+}
@@ -0,0 +1,179 @@
+/// Signed Queries
+///
+/// Most state is public, but some views only make sense for the account
+/// they describe, such as the interchain account transactions and their
+/// memos still waiting on an address. Those views take a `SignedQuery`: the
+/// caller signs the query name, its parameters and a nonce with the
+/// account's key, and the view checks the signature against the public key
+/// registered on the account, and the signed parameters against the ones it
+/// serves, before returning anything.
+///
+/// A view call cannot write state, so used nonces cannot be remembered.
+/// The nonce is instead a timestamp in nanoseconds and is only accepted
+/// within `SIGNED_QUERY_WINDOW_NS` of the block time, which bounds how long
+/// an observed query can be replayed.
+///
+/// This only limits what the contract's views return. Contract storage is
+/// not encrypted and anyone can read it directly through the NEAR RPC
+/// `view_state` call, so signed queries keep data out of the public query
+/// API but must not be relied on to keep it secret.
+
+use near_sdk::env;
+use near_sdk::serde::{Deserialize, Serialize};
+use near_sdk::serde_json::json;
+
+use super::accounts::{AccountError, AccountManager};
+use crate::crypto::SignatureBuilder;
+
+/// How far a query nonce may be from the block time: 5 minutes
+pub const SIGNED_QUERY_WINDOW_NS: u64 = 300_000_000_000;
+
+#[derive(Clone, Debug, PartialEq, Serialize, Deserialize)]
+pub struct SignedQuery {
+    /// Account the query reads data of
+    pub address: String,
+    /// Name of the view, e.g. `pending_ica_executions`
+    pub query: String,
+    /// Parameters of the view as JSON
+    pub params: String,
+    /// Signing time in nanoseconds
+    pub nonce: u64,
+    /// Signature over `sign_bytes`
+    pub signature: Vec<u8>,
+}
+
+impl SignedQuery {
+    /// Bytes the account key signs
+    ///
+    /// The chain id is included so a query signed for one chain is not
+    /// accepted by another that knows the same key.
+    pub fn sign_bytes(&self, chain_id: &str) -> Vec<u8> {
+        json!({
+            "address": self.address,
+            "chain_id": chain_id,
+            "nonce": self.nonce.to_string(),
+            "params": self.params,
+            "query": self.query,
+        })
+        .to_string()
+        .into_bytes()
+    }
+}
+
+impl AccountManager {
+    /// Check a signed query for `query` served with `params`, returning the
+    /// authenticated address
+    ///
+    /// Parameters are compared as JSON values, so key order and whitespace
+    /// in the signed string do not matter.
+    pub fn verify_signed_query(
+        &self,
+        signed: &SignedQuery,
+        query: &str,
+        params: &serde_json::Value,
+        chain_id: &str,
+    ) -> Result<String, AccountError> {
+        if signed.query != query {
+            return Err(AccountError::Unauthorized(format!("signature is for query {}", signed.query)));
+        }
+        if serde_json::from_str::<serde_json::Value>(&signed.params).ok().as_ref() != Some(params) {
+            return Err(AccountError::Unauthorized(format!(
+                "signature covers parameters {}, not {}",
+                signed.params, params
+            )));
+        }
+        let now = env::block_timestamp();
+        if now.abs_diff(signed.nonce) > SIGNED_QUERY_WINDOW_NS {
+            return Err(AccountError::Unauthorized(format!(
+                "query nonce {} is outside the accepted window of block time {}",
+                signed.nonce, now
+            )));
+        }
+
+        let public_key = self.get_account(&signed.address)
+            .ok_or_else(|| AccountError::AccountNotFound(signed.address.clone()))?
+            .public_key
+            .ok_or_else(|| AccountError::InvalidPublicKey(format!("{} has no registered key", signed.address)))?;
+
+        let valid = SignatureBuilder::new(chain_id.to_string())
+            .verify_message(&signed.signature, &signed.sign_bytes(chain_id), &public_key)
+            .map_err(|e| AccountError::Unauthorized(e.to_string()))?;
+        if !valid {
+            return Err(AccountError::Unauthorized(format!("invalid query signature for {}", signed.address)));
+        }
+        Ok(signed.address.clone())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::crypto::CosmosPublicKey;
+    use crate::modules::auth::AccountConfig;
+    use k256::ecdsa::signature::Signer;
+    use k256::ecdsa::{Signature, SigningKey};
+    use near_sdk::test_utils::VMContextBuilder;
+    use near_sdk::testing_env;
+    use sha2::{Digest, Sha256};
+
+    const CHAIN_ID: &str = "near-localnet";
+    const QUERY: &str = "pending_ica_txs";
+    const NOW: u64 = 1_000_000_000_000;
+
+    fn sign(key: &SigningKey, query: &mut SignedQuery) {
+        let hash = Sha256::digest(query.sign_bytes(CHAIN_ID));
+        let signature: Signature = key.sign(&hash);
+        query.signature = signature.to_bytes().to_vec();
+        query.signature.push(0);
+    }
+
+    fn setup() -> (AccountManager, SigningKey, SignedQuery) {
+        testing_env!(VMContextBuilder::new().block_timestamp(NOW).build());
+        let key = SigningKey::from_slice(&[7; 32]).unwrap();
+        let public_key = key.verifying_key().to_encoded_point(true).as_bytes().to_vec();
+
+        let mut manager = AccountManager::new(AccountConfig::default());
+        let address = manager.create_account(CosmosPublicKey::secp256k1(public_key).unwrap()).unwrap().address;
+        let mut query = SignedQuery {
+            address,
+            query: QUERY.to_string(),
+            params: r#"{"connection_id": "connection-0"}"#.to_string(),
+            nonce: NOW,
+            signature: Vec::new(),
+        };
+        sign(&key, &mut query);
+        (manager, key, query)
+    }
+
+    #[test]
+    fn test_valid_signature_authenticates() {
+        let (manager, _, query) = setup();
+        let params = json!({ "connection_id": "connection-0" });
+        assert_eq!(manager.verify_signed_query(&query, QUERY, &params, CHAIN_ID), Ok(query.address.clone()));
+
+        let other_chain = manager.verify_signed_query(&query, QUERY, &params, "other-chain");
+        assert!(matches!(other_chain, Err(AccountError::Unauthorized(_))));
+        let other_query = manager.verify_signed_query(&query, "account_memos", &params, CHAIN_ID);
+        assert!(matches!(other_query, Err(AccountError::Unauthorized(_))));
+    }
+
+    #[test]
+    fn test_tampered_or_stale_query_is_rejected() {
+        let (manager, key, mut query) = setup();
+        let params = json!({ "connection_id": "connection-0" });
+
+        let mut tampered = query.clone();
+        tampered.params = r#"{"connection_id": "connection-1"}"#.to_string();
+        let served = json!({ "connection_id": "connection-1" });
+        assert!(manager.verify_signed_query(&tampered, QUERY, &served, CHAIN_ID).is_err());
+
+        // A valid signature does not authorize serving other parameters
+        let error = manager.verify_signed_query(&query, QUERY, &served, CHAIN_ID).unwrap_err();
+        assert!(error.to_string().contains("signature covers parameters"));
+
+        query.nonce = NOW - SIGNED_QUERY_WINDOW_NS - 1;
+        sign(&key, &mut query);
+        let error = manager.verify_signed_query(&query, QUERY, &params, CHAIN_ID).unwrap_err();
+        assert!(error.to_string().contains("outside the accepted window"));
+    }
+}
@@ -0,0 +1,141 @@
+/// Transfer Memos and Account Activity
+///
+/// A send can carry a short memo such as an exchange's deposit reference.
+/// The memo is emitted in the transfer event and stored with the transfer in
+/// the activity index of both accounts, so an exchange can match incoming
+/// deposits to its customers from chain state alone. Each account keeps its
+/// most recent `MAX_ACTIVITY_PER_ACCOUNT` transfers.
+
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::serde::{Deserialize, Serialize};
+use near_sdk::{env, AccountId};
+use schemars::JsonSchema;
+
+use super::{BankModule, Coin, SendRestriction};
+use crate::Balance;
+
+/// Longest memo accepted on a transfer, in bytes
+pub const MAX_MEMO_LEN: usize = 256;
+
+/// Transfers kept per account, oldest are dropped first
+pub const MAX_ACTIVITY_PER_ACCOUNT: usize = 100;
+
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct TransferRecord {
+    pub height: u64,
+    pub timestamp: u64,
+    pub from: String,
+    pub to: String,
+    pub amount: Balance,
+    pub memo: String,
+}
+
+pub fn validate_memo(memo: &str) -> Result<(), String> {
+    if memo.len() > MAX_MEMO_LEN {
+        return Err(format!("Memo is {} bytes, the limit is {}", memo.len(), MAX_MEMO_LEN));
+    }
+    Ok(())
+}
+
+impl BankModule {
+    /// Send with a memo recorded in the event and both accounts' activity
+    pub fn send_with_memo(
+        &mut self,
+        restriction: &dyn SendRestriction,
+        sender: &AccountId,
+        receiver: &AccountId,
+        amount: Balance,
+        memo: String,
+    ) -> Result<(), String> {
+        validate_memo(&memo)?;
+        self.check_receiver(receiver)?;
+        self.check_send_enabled(self.native_denom())?;
+        restriction.check_send(sender, receiver, amount)?;
+        let denom = self.native_denom().to_string();
+        self.check_spendable(sender, &denom, amount)?;
+        self.before_send(sender, receiver, &Coin::new(denom.as_str(), amount))?;
+        self.move_denom(sender, receiver, &denom, amount, "bank", "transfer");
+
+        let record = TransferRecord {
+            height: env::block_height(),
+            timestamp: env::block_timestamp(),
+            from: sender.to_string(),
+            to: receiver.to_string(),
+            amount,
+            memo,
+        };
+        self.record_activity(sender, &record);
+        if receiver != sender {
+            self.record_activity(receiver, &record);
+        }
+
+        env::log_str(&format!(
+            "EVENT: transfer sender={} recipient={} amount={} memo={}",
+            sender, receiver, amount, record.memo
+        ));
+        Ok(())
+    }
+
+    fn record_activity(&mut self, account: &AccountId, record: &TransferRecord) {
+        let mut activity = self.activity.get(account).unwrap_or_default();
+        activity.push(record.clone());
+        if activity.len() > MAX_ACTIVITY_PER_ACCOUNT {
+            activity.remove(0);
+        }
+        self.activity.insert(account, &activity);
+    }
+
+    /// Recent transfers of `account`, newest first
+    pub fn get_account_activity(&self, account: &AccountId, limit: usize) -> Vec<TransferRecord> {
+        self.activity.get(account)
+            .unwrap_or_default()
+            .into_iter()
+            .rev()
+            .take(limit)
+            .collect()
+    }
+
+    /// Transfers received by `account` with the given memo, newest first
+    pub fn find_deposits_by_memo(&self, account: &AccountId, memo: &str) -> Vec<TransferRecord> {
+        self.get_account_activity(account, MAX_ACTIVITY_PER_ACCOUNT)
+            .into_iter()
+            .filter(|record| record.to == account.as_str() && record.memo == memo)
+            .collect()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    struct NoRestriction;
+
+    impl SendRestriction for NoRestriction {
+        fn check_send(&self, _from: &AccountId, _to: &AccountId, _amount: Balance) -> Result<(), String> {
+            Ok(())
+        }
+    }
+
+    #[test]
+    fn test_deposits_are_found_by_memo() {
+        let alice: AccountId = "alice.near".parse().unwrap();
+        let exchange: AccountId = "exchange.near".parse().unwrap();
+        let mut bank = BankModule::new();
+        bank.mint(&alice, 1_000);
+
+        bank.send_with_memo(&NoRestriction, &alice, &exchange, 100, "customer-42".to_string()).unwrap();
+        bank.send_with_memo(&NoRestriction, &alice, &exchange, 50, "customer-7".to_string()).unwrap();
+        bank.send(&NoRestriction, &alice, &exchange, 10).unwrap();
+
+        let deposits = bank.find_deposits_by_memo(&exchange, "customer-42");
+        assert_eq!(deposits.len(), 1);
+        assert_eq!((deposits[0].from.as_str(), deposits[0].amount), ("alice.near", 100));
+
+        let activity = bank.get_account_activity(&alice, 2);
+        assert_eq!(activity.iter().map(|record| record.amount).collect::<Vec<_>>(), vec![10, 50]);
+
+        let too_long = "x".repeat(MAX_MEMO_LEN + 1);
+        assert!(bank.send_with_memo(&NoRestriction, &alice, &exchange, 1, too_long).is_err());
+        assert_eq!(bank.get_balance(&alice), 840);
+    }
+}
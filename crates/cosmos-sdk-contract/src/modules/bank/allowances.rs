@@ -0,0 +1,212 @@
+/// Send Allowances
+///
+/// An account can let another account spend its coins up to a limit, as
+/// `SendAuthorization` of `x/authz` does, so a DEX or escrow contract can
+/// pull the funds of a trade instead of waiting for the owner to push them.
+/// A grant holds the coins the grantee may still send, decreased by every
+/// `transfer_from`, and is dropped once used up. It may restrict the
+/// receivers and lapse at a block timestamp. Each pull is checked like a
+/// send by the granter itself: blocked receivers, send enabled flags, the
+/// send restriction, locked coins and `before_send` hooks all apply.
+///
+/// A new grant to the same grantee replaces the previous one.
+
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::serde::{Deserialize, Serialize};
+use near_sdk::{env, AccountId};
+use schemars::JsonSchema;
+
+use super::{BankModule, Coins, SendRestriction};
+
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct SendAuthorization {
+    pub granter: AccountId,
+    pub grantee: AccountId,
+    /// Coins the grantee may still send
+    pub spend_limit: Coins,
+    /// Receivers the grantee may send to, any when empty
+    pub allow_list: Vec<AccountId>,
+    /// Block timestamp in nanoseconds the grant lapses at
+    pub expiration: Option<u64>,
+}
+
+impl SendAuthorization {
+    pub fn is_expired(&self, now: u64) -> bool {
+        self.expiration.map_or(false, |expiration| now >= expiration)
+    }
+}
+
+impl BankModule {
+    /// Let `grantee` send up to `spend_limit` of the coins of `granter`
+    pub fn grant_send(
+        &mut self,
+        granter: &AccountId,
+        grantee: &AccountId,
+        spend_limit: Coins,
+        allow_list: Vec<AccountId>,
+        expiration: Option<u64>,
+    ) -> Result<(), String> {
+        if granter == grantee {
+            return Err("Granter and grantee should be different".to_string());
+        }
+        if spend_limit.is_empty() {
+            return Err("Spend limit cannot be empty".to_string());
+        }
+        if expiration.map_or(false, |expiration| expiration <= env::block_timestamp()) {
+            return Err("Expiration must be in the future".to_string());
+        }
+        for (index, receiver) in allow_list.iter().enumerate() {
+            if allow_list[..index].contains(receiver) {
+                return Err(format!("Receiver {} is allowed more than once", receiver));
+            }
+        }
+
+        let grant = SendAuthorization {
+            granter: granter.clone(),
+            grantee: grantee.clone(),
+            spend_limit,
+            allow_list,
+            expiration,
+        };
+        self.send_authorizations.insert(&(granter.clone(), grantee.clone()), &grant);
+        env::log_str(&format!(
+            "EVENT: send_grant granter={} grantee={} spend_limit={} expiration={}",
+            granter, grantee, grant.spend_limit, expiration.map_or("none".to_string(), |time| time.to_string())
+        ));
+        Ok(())
+    }
+
+    /// Drop the grant of `granter` to `grantee`
+    pub fn revoke_send(&mut self, granter: &AccountId, grantee: &AccountId) -> Result<SendAuthorization, String> {
+        let grant = self.send_authorizations.remove(&(granter.clone(), grantee.clone()))
+            .ok_or_else(|| format!("{} has no send authorization from {}", grantee, granter))?;
+        env::log_str(&format!("EVENT: send_revoke granter={} grantee={}", granter, grantee));
+        Ok(grant)
+    }
+
+    /// Unexpired grant of `granter` to `grantee`
+    pub fn get_send_authorization(&self, granter: &AccountId, grantee: &AccountId) -> Option<SendAuthorization> {
+        self.send_authorizations.get(&(granter.clone(), grantee.clone()))
+            .filter(|grant| !grant.is_expired(env::block_timestamp()))
+    }
+
+    /// Send `coins` of `granter` to `receiver` on behalf of `grantee`, all
+    /// of them or nothing, spending the grant
+    pub fn transfer_from(
+        &mut self,
+        restriction: &dyn SendRestriction,
+        grantee: &AccountId,
+        granter: &AccountId,
+        receiver: &AccountId,
+        coins: &Coins,
+    ) -> Result<(), String> {
+        if coins.is_empty() {
+            return Err("Transfer sends no coins".to_string());
+        }
+        let mut grant = self.get_send_authorization(granter, grantee)
+            .ok_or_else(|| format!("{} has no send authorization from {}", grantee, granter))?;
+        if !grant.allow_list.is_empty() && !grant.allow_list.contains(receiver) {
+            return Err(format!("{} is not an allowed receiver", receiver));
+        }
+        if !grant.spend_limit.is_all_gte(coins) {
+            return Err(format!("{} exceeds the spend limit of {}", coins, grant.spend_limit));
+        }
+
+        self.check_receiver(receiver)?;
+        for coin in coins.iter() {
+            self.check_send_enabled(&coin.denom)?;
+            restriction.check_send(granter, receiver, coin.amount)?;
+            self.check_spendable(granter, &coin.denom, coin.amount)?;
+        }
+        for coin in coins.iter() {
+            self.before_send(granter, receiver, coin)?;
+        }
+        for coin in coins.iter() {
+            grant.spend_limit.sub(coin)?;
+            self.move_denom(granter, receiver, &coin.denom, coin.amount, "bank", "transfer_from");
+        }
+
+        let key = (granter.clone(), grantee.clone());
+        if grant.spend_limit.is_empty() {
+            self.send_authorizations.remove(&key);
+        } else {
+            self.send_authorizations.insert(&key, &grant);
+        }
+        env::log_str(&format!(
+            "EVENT: transfer_from granter={} grantee={} receiver={} amount={}",
+            granter, grantee, receiver, coins
+        ));
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::modules::bank::Coin;
+    use crate::Balance;
+    use near_sdk::test_utils::VMContextBuilder;
+    use near_sdk::testing_env;
+
+    struct AllowAll;
+
+    impl SendRestriction for AllowAll {
+        fn check_send(&self, _from: &AccountId, _to: &AccountId, _amount: Balance) -> Result<(), String> {
+            Ok(())
+        }
+    }
+
+    fn account(name: &str) -> AccountId {
+        name.parse().unwrap()
+    }
+
+    fn coins(amount: Balance) -> Coins {
+        Coins::new(vec![Coin::new("unear", amount)]).unwrap()
+    }
+
+    fn at_time(timestamp: u64) {
+        testing_env!(VMContextBuilder::new().block_timestamp(timestamp).build());
+    }
+
+    #[test]
+    fn test_grantee_spends_up_to_the_limit() {
+        at_time(100);
+        let mut bank = BankModule::new();
+        let (alice, dex, bob) = (account("alice.near"), account("dex.near"), account("bob.near"));
+        bank.mint(&alice, 100);
+        assert!(bank.transfer_from(&AllowAll, &dex, &alice, &bob, &coins(10)).is_err());
+
+        bank.grant_send(&alice, &dex, coins(50), vec![], None).unwrap();
+        bank.transfer_from(&AllowAll, &dex, &alice, &bob, &coins(30)).unwrap();
+        assert_eq!(bank.get_balance(&bob), 30);
+        assert_eq!(bank.get_send_authorization(&alice, &dex).unwrap().spend_limit, coins(20));
+        assert!(bank.transfer_from(&AllowAll, &dex, &alice, &bob, &coins(21)).unwrap_err().contains("spend limit"));
+
+        // A used up grant is gone
+        bank.transfer_from(&AllowAll, &dex, &alice, &dex, &coins(20)).unwrap();
+        assert!(bank.get_send_authorization(&alice, &dex).is_none());
+        assert_eq!(bank.get_balance(&alice), 50);
+    }
+
+    #[test]
+    fn test_grant_restrictions() {
+        at_time(100);
+        let mut bank = BankModule::new();
+        let (alice, escrow, bob) = (account("alice.near"), account("escrow.near"), account("bob.near"));
+        bank.mint(&alice, 100);
+        bank.lock_coins(&alice, "unear", 80, "vesting", None).unwrap();
+        bank.grant_send(&alice, &escrow, coins(50), vec![bob.clone()], Some(200)).unwrap();
+
+        assert!(bank.transfer_from(&AllowAll, &escrow, &alice, &account("carol.near"), &coins(10)).unwrap_err().contains("allowed receiver"));
+        assert!(bank.transfer_from(&AllowAll, &escrow, &alice, &bob, &coins(30)).unwrap_err().contains("spendable"));
+        bank.transfer_from(&AllowAll, &escrow, &alice, &bob, &coins(20)).unwrap();
+
+        at_time(200);
+        assert!(bank.transfer_from(&AllowAll, &escrow, &alice, &bob, &coins(1)).is_err());
+        assert!(bank.grant_send(&alice, &escrow, coins(5), vec![], Some(150)).is_err());
+        assert!(bank.grant_send(&alice, &alice, coins(5), vec![], None).is_err());
+        bank.grant_send(&alice, &escrow, coins(5), vec![], None).unwrap();
+        assert_eq!(bank.revoke_send(&alice, &escrow).unwrap().spend_limit, coins(5));
+        assert!(bank.revoke_send(&alice, &escrow).is_err());
+    }
+}
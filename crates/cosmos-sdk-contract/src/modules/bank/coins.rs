@@ -0,0 +1,216 @@
+/// Coins
+///
+/// Balances are kept per account and denom, the way `x/bank` keys them, so
+/// an account can hold the native token next to IBC vouchers and bridged
+/// CW20 denoms. `Coin` is one amount of one denom. `Coins` is a set of them
+/// in the canonical form the Cosmos SDK uses: sorted by denom, each denom at
+/// most once and no zero amounts, so two equal sets always compare equal.
+
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::serde::{Deserialize, Serialize};
+use schemars::JsonSchema;
+
+use crate::Balance;
+
+/// Longest denom accepted, as in the Cosmos SDK
+pub const MAX_DENOM_LEN: usize = 128;
+
+/// Check a denom against the Cosmos SDK rule `[a-zA-Z][a-zA-Z0-9/:._-]{2,127}`
+pub fn validate_denom(denom: &str) -> Result<(), String> {
+    if denom.len() < 3 || denom.len() > MAX_DENOM_LEN {
+        return Err(format!("Denom {} must be between 3 and {} characters", denom, MAX_DENOM_LEN));
+    }
+    if !denom.starts_with(|c: char| c.is_ascii_alphabetic()) {
+        return Err(format!("Denom {} must start with a letter", denom));
+    }
+    if let Some(c) = denom.chars().find(|c| !c.is_ascii_alphanumeric() && !"/:._-".contains(*c)) {
+        return Err(format!("Denom {} contains invalid character {:?}", denom, c));
+    }
+    Ok(())
+}
+
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, Eq, JsonSchema)]
+pub struct Coin {
+    pub denom: String,
+    pub amount: Balance,
+}
+
+impl Coin {
+    pub fn new(denom: impl Into<String>, amount: Balance) -> Self {
+        Self { denom: denom.into(), amount }
+    }
+
+    pub fn validate(&self) -> Result<(), String> {
+        validate_denom(&self.denom)
+    }
+}
+
+impl std::fmt::Display for Coin {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "{}{}", self.amount, self.denom)
+    }
+}
+
+/// Sorted set of positive coins with distinct denoms
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, Default, PartialEq, Eq, JsonSchema)]
+#[serde(try_from = "Vec<Coin>", into = "Vec<Coin>")]
+pub struct Coins(Vec<Coin>);
+
+impl Coins {
+    /// Canonical set of `coins`, dropping zero amounts
+    ///
+    /// Fails on an invalid denom or a denom listed twice, rather than
+    /// silently merging amounts a caller may have listed by mistake.
+    pub fn new(coins: Vec<Coin>) -> Result<Self, String> {
+        let mut coins: Vec<Coin> = coins.into_iter().filter(|coin| coin.amount > 0).collect();
+        coins.sort_by(|a, b| a.denom.cmp(&b.denom));
+        for (index, coin) in coins.iter().enumerate() {
+            coin.validate()?;
+            if index > 0 && coins[index - 1].denom == coin.denom {
+                return Err(format!("Denom {} is listed more than once", coin.denom));
+            }
+        }
+        Ok(Self(coins))
+    }
+
+    /// Coins already in canonical form, as read back from storage
+    pub(super) fn from_sorted(coins: Vec<Coin>) -> Self {
+        Self(coins)
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.0.is_empty()
+    }
+
+    pub fn len(&self) -> usize {
+        self.0.len()
+    }
+
+    pub fn iter(&self) -> impl Iterator<Item = &Coin> {
+        self.0.iter()
+    }
+
+    pub fn denoms(&self) -> Vec<String> {
+        self.0.iter().map(|coin| coin.denom.clone()).collect()
+    }
+
+    /// Amount of `denom`, zero when absent
+    pub fn amount_of(&self, denom: &str) -> Balance {
+        self.0.binary_search_by(|coin| coin.denom.as_str().cmp(denom))
+            .map_or(0, |index| self.0[index].amount)
+    }
+
+    /// Add `coin`, merging it with an existing amount of its denom
+    pub fn add(&mut self, coin: Coin) -> Result<(), String> {
+        coin.validate()?;
+        if coin.amount == 0 {
+            return Ok(());
+        }
+        match self.0.binary_search_by(|existing| existing.denom.cmp(&coin.denom)) {
+            Ok(index) => {
+                let existing = &mut self.0[index];
+                existing.amount = existing.amount.checked_add(coin.amount)
+                    .ok_or_else(|| format!("Amount of {} overflows", coin.denom))?;
+            }
+            Err(index) => self.0.insert(index, coin),
+        }
+        Ok(())
+    }
+
+    /// Take `coin` out of the set, dropping its denom once it reaches zero
+    pub fn sub(&mut self, coin: &Coin) -> Result<(), String> {
+        if coin.amount == 0 {
+            return Ok(());
+        }
+        let index = self.0.binary_search_by(|existing| existing.denom.cmp(&coin.denom))
+            .map_err(|_| format!("No {} to take {} from", coin.denom, coin))?;
+        let existing = &mut self.0[index];
+        existing.amount = existing.amount.checked_sub(coin.amount)
+            .ok_or_else(|| format!("Cannot take {} from {}", coin, existing))?;
+        if existing.amount == 0 {
+            self.0.remove(index);
+        }
+        Ok(())
+    }
+
+    /// Whether every coin of `other` is covered by this set
+    pub fn is_all_gte(&self, other: &Coins) -> bool {
+        other.iter().all(|coin| self.amount_of(&coin.denom) >= coin.amount)
+    }
+
+    pub fn into_vec(self) -> Vec<Coin> {
+        self.0
+    }
+}
+
+impl TryFrom<Vec<Coin>> for Coins {
+    type Error = String;
+
+    fn try_from(coins: Vec<Coin>) -> Result<Self, Self::Error> {
+        Self::new(coins)
+    }
+}
+
+impl From<Coins> for Vec<Coin> {
+    fn from(coins: Coins) -> Self {
+        coins.0
+    }
+}
+
+impl std::fmt::Display for Coins {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let coins: Vec<String> = self.0.iter().map(|coin| coin.to_string()).collect();
+        write!(f, "{}", coins.join(","))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_coins_are_canonical() {
+        let coins = Coins::new(vec![Coin::new("uosmo", 5), Coin::new("ibc/ABC", 7), Coin::new("unear", 0)]).unwrap();
+        assert_eq!(coins.denoms(), vec!["ibc/ABC".to_string(), "uosmo".to_string()]);
+        assert_eq!(coins.amount_of("uosmo"), 5);
+        assert_eq!(coins.amount_of("unear"), 0);
+        assert_eq!(coins.to_string(), "7ibc/ABC,5uosmo");
+
+        assert!(Coins::new(vec![Coin::new("unear", 1), Coin::new("unear", 2)]).is_err());
+        assert!(Coins::new(vec![Coin::new("1near", 1)]).is_err());
+        assert!(serde_json::from_str::<Coins>(r#"[{"denom":"unear","amount":1},{"denom":"unear","amount":1}]"#).is_err());
+    }
+
+    #[test]
+    fn test_add_merges_denoms() {
+        let mut coins = Coins::default();
+        coins.add(Coin::new("unear", 10)).unwrap();
+        coins.add(Coin::new("ibc/ABC", 3)).unwrap();
+        coins.add(Coin::new("unear", 5)).unwrap();
+        assert_eq!(coins.into_vec(), vec![Coin::new("ibc/ABC", 3), Coin::new("unear", 15)]);
+
+        let mut full = Coins::new(vec![Coin::new("unear", Balance::MAX)]).unwrap();
+        assert!(full.add(Coin::new("unear", 1)).is_err());
+    }
+
+    #[test]
+    fn test_sub_drops_emptied_denoms() {
+        let mut coins = Coins::new(vec![Coin::new("unear", 10), Coin::new("ibc/ABC", 3)]).unwrap();
+        coins.sub(&Coin::new("unear", 4)).unwrap();
+        coins.sub(&Coin::new("ibc/ABC", 3)).unwrap();
+        assert_eq!(coins.to_string(), "6unear");
+        assert!(coins.sub(&Coin::new("unear", 7)).is_err());
+        assert!(coins.sub(&Coin::new("uosmo", 1)).is_err());
+        assert_eq!(coins.amount_of("unear"), 6);
+    }
+
+    #[test]
+    fn test_denom_validation() {
+        assert!(validate_denom("unear").is_ok());
+        assert!(validate_denom("ibc/27394FB092D2ECCD56123C74F36E4C1F926001CEADA9CA97EA622B25F41E5EB2").is_ok());
+        assert!(validate_denom("cw20:token.near").is_ok());
+        assert!(validate_denom("ab").is_err());
+        assert!(validate_denom("u near").is_err());
+        assert!(validate_denom(&"u".repeat(MAX_DENOM_LEN + 1)).is_err());
+    }
+}
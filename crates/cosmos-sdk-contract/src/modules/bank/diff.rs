@@ -0,0 +1,187 @@
+/// State Diffs
+///
+/// The balance ledger doubles as the bank's changelog: every entry names the
+/// balances and the supply it touched and the height it was committed at.
+/// `state_diff` turns the entries between two heights into the set of store
+/// keys that changed, in the `balance/<account>/<denom>` and `supply/<denom>`
+/// form the state root commits to. That answers "what moved between these blocks"
+/// when a balance looks wrong, and lets an indexer fetch only the keys that
+/// changed since its last sync instead of re-exporting everything.
+///
+/// Diffs only reach back as far as the journal does. When entries after
+/// `from_height` were already pruned the diff is marked incomplete and the
+/// indexer has to fall back to a full export.
+
+use std::collections::BTreeMap;
+
+use near_sdk::serde::{Deserialize, Serialize};
+use schemars::JsonSchema;
+
+use super::supply::supply_key;
+use super::{BankModule, LedgerEntry};
+
+/// Ledger entries a single `state_diff` call reads at most
+pub const MAX_STATE_DIFF_ENTRIES: u64 = 1_000;
+
+/// A store key changed within the diff range
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct KeyChange {
+    pub key: String,
+    /// Last height in the range the key changed at
+    pub height: u64,
+    /// Ledger entries in the range that touched the key
+    pub changes: u32,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct StateDiff {
+    /// Exclusive, the state the diff applies on top of
+    pub from_height: u64,
+    /// Inclusive
+    pub to_height: u64,
+    /// Sorted by key
+    pub keys: Vec<KeyChange>,
+    /// Pass as `from_id` to continue a range that did not fit in one call
+    pub next_from_id: Option<u64>,
+    /// False when entries right after `from_height` were already pruned
+    pub complete: bool,
+}
+
+/// Store key of an account's balance of `denom`, as committed by
+/// `state_root`; account ids never contain `/`, so the key is unambiguous
+pub fn balance_key(account: &str, denom: &str) -> String {
+    format!("balance/{}/{}", account, denom)
+}
+
+/// Keys an entry wrote: the balances it debited and credited, and the
+/// supply when it minted or burnt
+fn entry_keys(entry: &LedgerEntry) -> Vec<String> {
+    let mut keys: Vec<String> = [&entry.debit, &entry.credit].into_iter()
+        .flatten()
+        .map(|account| balance_key(account, &entry.denom))
+        .collect();
+    if entry.debit.is_none() || entry.credit.is_none() {
+        keys.push(String::from_utf8_lossy(&supply_key(&entry.denom)).into_owned());
+    }
+    keys
+}
+
+impl BankModule {
+    /// First journal id committed after `height`
+    fn first_ledger_id_after(&self, height: u64) -> u64 {
+        // Heights never decrease along the journal
+        let (mut low, mut high) = (self.ledger_first_id, self.ledger_next_id);
+        while low < high {
+            let mid = low + (high - low) / 2;
+            match self.ledger.get(&mid) {
+                Some(entry) if entry.height <= height => low = mid + 1,
+                _ => high = mid,
+            }
+        }
+        low
+    }
+
+    /// Keys changed by blocks after `from_height` up to and including
+    /// `to_height`
+    ///
+    /// `from_id` continues a previous call that returned `next_from_id`.
+    pub fn state_diff(&self, from_height: u64, to_height: u64, from_id: Option<u64>) -> Result<StateDiff, String> {
+        if from_height >= to_height {
+            return Err(format!("Diff range is empty: from height {} is not below to height {}", from_height, to_height));
+        }
+
+        let start = from_id.unwrap_or_else(|| self.first_ledger_id_after(from_height)).max(self.ledger_first_id);
+        // Pruned entries are no younger than the oldest one retained
+        let complete = self.ledger_first_id == 0
+            || self.ledger.get(&self.ledger_first_id).map_or(false, |oldest| oldest.height <= from_height);
+
+        let mut keys: BTreeMap<String, KeyChange> = BTreeMap::new();
+        let end = start.saturating_add(MAX_STATE_DIFF_ENTRIES).min(self.ledger_next_id);
+        let mut next_from_id = None;
+        for id in start..end {
+            let Some(entry) = self.ledger.get(&id) else { continue };
+            if entry.height > to_height {
+                break;
+            }
+            for key in entry_keys(&entry) {
+                let change = keys.entry(key.clone()).or_insert(KeyChange { key, height: entry.height, changes: 0 });
+                change.height = entry.height;
+                change.changes += 1;
+            }
+            if id + 1 == end && end < self.ledger_next_id {
+                next_from_id = Some(end);
+            }
+        }
+
+        Ok(StateDiff {
+            from_height,
+            to_height,
+            keys: keys.into_values().collect(),
+            next_from_id,
+            complete,
+        })
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use near_sdk::test_utils::VMContextBuilder;
+    use near_sdk::{testing_env, AccountId};
+
+    fn at_height(height: u64) {
+        testing_env!(VMContextBuilder::new().block_height(height).build());
+    }
+
+    fn account(name: &str) -> AccountId {
+        name.parse().unwrap()
+    }
+
+    #[test]
+    fn test_diff_between_heights() {
+        let (alice, bob, carol) = (account("alice.near"), account("bob.near"), account("carol.near"));
+        let mut bank = BankModule::new();
+        at_height(10);
+        bank.mint(&alice, 100);
+        at_height(20);
+        bank.transfer(&alice, &bob, 10);
+        bank.transfer(&alice, &bob, 5);
+        at_height(30);
+        bank.transfer(&bob, &carol, 1);
+
+        let diff = bank.state_diff(10, 20, None).unwrap();
+        assert!(diff.complete);
+        assert_eq!(diff.next_from_id, None);
+        assert_eq!(diff.keys, vec![
+            KeyChange { key: "balance/alice.near/unear".to_string(), height: 20, changes: 2 },
+            KeyChange { key: "balance/bob.near/unear".to_string(), height: 20, changes: 2 },
+        ]);
+
+        let keys: Vec<String> = bank.state_diff(0, 30, None).unwrap().keys.into_iter().map(|change| change.key).collect();
+        assert_eq!(keys, vec!["balance/alice.near/unear", "balance/bob.near/unear", "balance/carol.near/unear", "supply/unear"]);
+        assert!(bank.state_diff(30, 40, None).unwrap().keys.is_empty());
+        assert!(bank.state_diff(20, 20, None).is_err());
+
+        // Entries after height 10 are gone once the journal is pruned past them
+        bank.prune_ledger(2);
+        assert!(!bank.state_diff(10, 30, None).unwrap().complete);
+        assert!(bank.state_diff(20, 30, None).unwrap().complete);
+    }
+
+    #[test]
+    fn test_diff_pages_long_ranges() {
+        let (alice, bob) = (account("alice.near"), account("bob.near"));
+        let mut bank = BankModule::new();
+        at_height(5);
+        bank.mint(&alice, 10_000);
+        for _ in 0..MAX_STATE_DIFF_ENTRIES + 10 {
+            bank.transfer(&alice, &bob, 1);
+        }
+
+        let first = bank.state_diff(0, 5, None).unwrap();
+        assert_eq!(first.next_from_id, Some(MAX_STATE_DIFF_ENTRIES));
+        let rest = bank.state_diff(0, 5, first.next_from_id).unwrap();
+        assert_eq!(rest.next_from_id, None);
+        assert_eq!(rest.keys[0].changes, 11);
+    }
+}
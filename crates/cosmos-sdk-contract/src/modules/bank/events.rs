@@ -0,0 +1,125 @@
+/// Balance Events
+///
+/// Every transfer, mint and burn is logged as a NEP-297 event, so indexers
+/// and the relayer can follow balances from receipts instead of parsing
+/// free text:
+///
+/// `EVENT_JSON:{"standard":"cosmos_sdk","version":"1.0.0","event":"transfer","data":[{"ledger_id":7,"sender":"alice.near","receiver":"bob.near","denom":"unear","amount":"250","module":"bank","reason":"transfer"}]}`
+///
+/// Mints have no sender and burns no receiver. Amounts are decimal strings,
+/// since a `u128` does not fit a JSON number. `ledger_id` is the ledger
+/// entry of the change, see `audit_ledger`.
+
+use near_sdk::env;
+use near_sdk::serde::{Deserialize, Serialize};
+use near_sdk::serde_json::json;
+use near_sdk::AccountId;
+use schemars::JsonSchema;
+
+use crate::Balance;
+
+pub const BANK_EVENT_STANDARD: &str = "cosmos_sdk";
+pub const BANK_EVENT_VERSION: &str = "1.0.0";
+
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct BalanceEvent {
+    pub ledger_id: u64,
+    pub sender: Option<AccountId>,
+    pub receiver: Option<AccountId>,
+    pub denom: String,
+    pub amount: String,
+    /// Module and reason the change was booked under
+    pub module: String,
+    pub reason: String,
+}
+
+impl BalanceEvent {
+    pub fn new(
+        ledger_id: u64,
+        sender: Option<&AccountId>,
+        receiver: Option<&AccountId>,
+        denom: &str,
+        amount: Balance,
+        module: &str,
+        reason: &str,
+    ) -> Self {
+        Self {
+            ledger_id,
+            sender: sender.cloned(),
+            receiver: receiver.cloned(),
+            denom: denom.to_string(),
+            amount: amount.to_string(),
+            module: module.to_string(),
+            reason: reason.to_string(),
+        }
+    }
+
+    /// `transfer`, `mint` or `burn`
+    pub fn event(&self) -> &'static str {
+        match (&self.sender, &self.receiver) {
+            (Some(_), Some(_)) => "transfer",
+            (None, _) => "mint",
+            (Some(_), None) => "burn",
+        }
+    }
+
+    /// Log the event as NEP-297 JSON
+    pub fn emit(&self) {
+        let event = json!({
+            "standard": BANK_EVENT_STANDARD,
+            "version": BANK_EVENT_VERSION,
+            "event": self.event(),
+            "data": [self],
+        });
+        env::log_str(&format!("EVENT_JSON:{}", event));
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::modules::bank::BankModule;
+    use near_sdk::serde_json::Value;
+    use near_sdk::test_utils::{get_logs, VMContextBuilder};
+    use near_sdk::testing_env;
+
+    fn events() -> Vec<Value> {
+        get_logs().iter()
+            .filter_map(|log| log.strip_prefix("EVENT_JSON:"))
+            .map(|event| serde_json::from_str(event).unwrap())
+            .collect()
+    }
+
+    #[test]
+    fn test_every_mutation_is_an_event() {
+        testing_env!(VMContextBuilder::new().build());
+        let mut bank = BankModule::new();
+        let (alice, bob): (AccountId, AccountId) = ("alice.near".parse().unwrap(), "bob.near".parse().unwrap());
+        bank.mint_denom(&alice, "ibc/ATOM", 1_000);
+        bank.transfer_denom(&alice, &bob, "ibc/ATOM", 250);
+        bank.burn_denom(&bob, "ibc/ATOM", 50);
+
+        let events = events();
+        let names: Vec<&str> = events.iter().map(|event| event["event"].as_str().unwrap()).collect();
+        assert_eq!(names, vec!["mint", "transfer", "burn"]);
+        assert!(events.iter().all(|event| event["standard"] == BANK_EVENT_STANDARD));
+
+        let transfer = &events[1]["data"][0];
+        assert_eq!(transfer["sender"], "alice.near");
+        assert_eq!(transfer["receiver"], "bob.near");
+        assert_eq!(transfer["denom"], "ibc/ATOM");
+        assert_eq!(transfer["amount"], "250");
+        assert_eq!(transfer["ledger_id"], 1);
+        assert!(events[0]["data"][0]["sender"].is_null());
+        assert!(events[2]["data"][0]["receiver"].is_null());
+    }
+
+    #[test]
+    fn test_amounts_beyond_json_numbers() {
+        let alice: AccountId = "alice.near".parse().unwrap();
+        let event = BalanceEvent::new(0, None, Some(&alice), "unear", u128::MAX, "bank", "mint");
+        assert_eq!(event.event(), "mint");
+        let json = serde_json::to_value(&event).unwrap();
+        assert_eq!(json["amount"], u128::MAX.to_string());
+    }
+}
@@ -0,0 +1,312 @@
+/// Bank Genesis
+///
+/// The bank's state in the shape of the `x/bank` genesis: params, balances
+/// by address, the total supply and denom metadata. The state `x/bank`
+/// keeps elsewhere follows: active coin locks, unexpired send
+/// authorizations, the NEP-141 token mapping and paid registrations.
+/// `export_genesis` writes
+/// it from a running bank and `init_genesis` loads it into an empty one, so
+/// a chain snapshot can bootstrap a new deployment or move the bank to a
+/// fresh contract. Genesis balances are minted, which books them in the
+/// ledger and the balance events under the `genesis` reason, the same start
+/// that `replay_ledger` assumes.
+///
+/// As in `x/bank`, an empty supply is computed from the balances, a given
+/// one must match them. Locks keep their ids, since the modules that
+/// created them release them by id.
+
+use near_sdk::serde::{Deserialize, Serialize};
+use near_sdk::{env, AccountId};
+use schemars::JsonSchema;
+use std::collections::BTreeMap;
+
+use super::{
+    validate_denom, BankModule, Coin, CoinLock, Coins, FtRegistration, FtToken, Metadata, SendAuthorization, SendEnabled,
+    SetSendEnabled, MAX_LOCKS_PER_ACCOUNT,
+};
+
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct BankParams {
+    /// Send enabled flags of denoms that do not follow the default
+    #[serde(default)]
+    pub send_enabled: Vec<SendEnabled>,
+    pub default_send_enabled: bool,
+}
+
+impl Default for BankParams {
+    fn default() -> Self {
+        Self { send_enabled: Vec::new(), default_send_enabled: true }
+    }
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct GenesisBalance {
+    pub address: AccountId,
+    pub coins: Coins,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, Default, PartialEq, JsonSchema)]
+pub struct BankGenesis {
+    #[serde(default)]
+    pub params: BankParams,
+    /// Balances sorted by address
+    #[serde(default)]
+    pub balances: Vec<GenesisBalance>,
+    /// Total supply, computed from the balances when empty
+    #[serde(default)]
+    pub supply: Coins,
+    #[serde(default)]
+    pub denom_metadata: Vec<Metadata>,
+    /// Active coin locks sorted by id
+    #[serde(default)]
+    pub locks: Vec<CoinLock>,
+    /// Unexpired send authorizations sorted by granter and grantee
+    #[serde(default)]
+    pub send_authorizations: Vec<SendAuthorization>,
+    #[serde(default)]
+    pub ft_tokens: Vec<FtToken>,
+    /// Paid NEP-145 registrations sorted by denom and account
+    #[serde(default)]
+    pub ft_registrations: Vec<FtRegistration>,
+}
+
+impl BankGenesis {
+    pub fn validate(&self) -> Result<(), String> {
+        self.params_change().validate()?;
+
+        let mut total = Coins::default();
+        for (index, balance) in self.balances.iter().enumerate() {
+            if balance.coins.is_empty() {
+                return Err(format!("Genesis balance of {} holds no coins", balance.address));
+            }
+            if self.balances[..index].iter().any(|other| other.address == balance.address) {
+                return Err(format!("Genesis balance of {} is listed more than once", balance.address));
+            }
+            for coin in balance.coins.iter() {
+                total.add(coin.clone())?;
+            }
+        }
+        if !self.supply.is_empty() && self.supply != total {
+            return Err(format!("Genesis supply {} does not match the balances {}", self.supply, total));
+        }
+
+        for (index, metadata) in self.denom_metadata.iter().enumerate() {
+            metadata.validate()?;
+            if self.denom_metadata[..index].iter().any(|other| other.base == metadata.base) {
+                return Err(format!("Metadata of {} is listed more than once", metadata.base));
+            }
+        }
+
+        for (index, lock) in self.locks.iter().enumerate() {
+            if lock.amount == 0 || lock.module.is_empty() {
+                return Err(format!("Lock {} needs an amount and a module", lock.id));
+            }
+            validate_denom(&lock.denom)?;
+            if self.locks[..index].iter().any(|other| other.id == lock.id) {
+                return Err(format!("Lock {} is listed more than once", lock.id));
+            }
+            if self.locks.iter().filter(|other| other.account == lock.account).count() > MAX_LOCKS_PER_ACCOUNT {
+                return Err(format!("{} holds more than {} locks", lock.account, MAX_LOCKS_PER_ACCOUNT));
+            }
+        }
+
+        for (index, grant) in self.send_authorizations.iter().enumerate() {
+            if grant.granter == grant.grantee || grant.spend_limit.is_empty() {
+                return Err(format!("Send authorization of {} to {} is invalid", grant.granter, grant.grantee));
+            }
+            if self.send_authorizations[..index].iter()
+                .any(|other| other.granter == grant.granter && other.grantee == grant.grantee)
+            {
+                return Err(format!("Send authorization of {} to {} is listed more than once", grant.granter, grant.grantee));
+            }
+        }
+
+        for (index, token) in self.ft_tokens.iter().enumerate() {
+            validate_denom(&token.denom)?;
+            if self.ft_tokens[..index].iter().any(|other| other.token_id == token.token_id || other.denom == token.denom) {
+                return Err(format!("Token {} or denom {} is mapped more than once", token.token_id, token.denom));
+            }
+        }
+        for (index, registration) in self.ft_registrations.iter().enumerate() {
+            validate_denom(&registration.denom)?;
+            if self.ft_registrations[..index].contains(registration) {
+                return Err(format!("Registration of {} with {} is listed more than once", registration.account, registration.denom));
+            }
+        }
+        Ok(())
+    }
+
+    fn params_change(&self) -> SetSendEnabled {
+        SetSendEnabled {
+            send_enabled: self.params.send_enabled.clone(),
+            use_default_for: Vec::new(),
+            default_send_enabled: Some(self.params.default_send_enabled),
+        }
+    }
+}
+
+impl BankModule {
+    /// Load `genesis` into a bank that holds no tokens yet
+    pub fn init_genesis(&mut self, genesis: &BankGenesis) -> Result<(), String> {
+        genesis.validate()?;
+        if !self.supply.is_empty() {
+            return Err("Genesis can only be loaded before any tokens exist".to_string());
+        }
+
+        self.set_send_enabled(&genesis.params_change())?;
+        for metadata in &genesis.denom_metadata {
+            self.set_denom_metadata(metadata.clone())?;
+        }
+        for balance in &genesis.balances {
+            for coin in balance.coins.iter() {
+                self.mint_with_reason(&balance.address, &coin.denom, coin.amount, "bank", "genesis");
+            }
+        }
+
+        for lock in &genesis.locks {
+            self.locks.insert(&lock.id, lock);
+            let mut ids = self.account_locks.get(&lock.account).unwrap_or_default();
+            ids.push(lock.id);
+            self.account_locks.insert(&lock.account, &ids);
+            self.next_lock_id = self.next_lock_id.max(lock.id + 1);
+        }
+        for grant in &genesis.send_authorizations {
+            self.send_authorizations.insert(&(grant.granter.clone(), grant.grantee.clone()), grant);
+        }
+        for token in &genesis.ft_tokens {
+            self.register_ft_token(token.token_id.clone(), token.denom.clone())?;
+        }
+        for registration in &genesis.ft_registrations {
+            self.ft_registrations.insert(&(registration.denom.clone(), registration.account.clone()));
+        }
+
+        env::log_str(&format!(
+            "EVENT: bank_genesis balances={} supply={} denom_metadata={} locks={} send_authorizations={} ft_registrations={}",
+            genesis.balances.len(),
+            self.total_supply(),
+            genesis.denom_metadata.len(),
+            genesis.locks.len(),
+            genesis.send_authorizations.len(),
+            genesis.ft_registrations.len()
+        ));
+        Ok(())
+    }
+
+    /// Current state as a genesis that `init_genesis` loads back
+    pub fn export_genesis(&self) -> BankGenesis {
+        let mut balances: BTreeMap<AccountId, Vec<Coin>> = BTreeMap::new();
+        for ((account, denom), amount) in self.balances.iter() {
+            balances.entry(account).or_default().push(Coin::new(denom, amount));
+        }
+        let balances = balances.into_iter()
+            .map(|(address, coins)| GenesisBalance {
+                coins: Coins::new(coins).unwrap_or_else(|error| env::panic_str(&error)),
+                address,
+            })
+            .collect();
+
+        let now = env::block_timestamp();
+        let mut locks: Vec<CoinLock> = self.locks.values().filter(|lock| lock.is_active(now)).collect();
+        locks.sort_by_key(|lock| lock.id);
+        let mut send_authorizations: Vec<SendAuthorization> = self.send_authorizations.values()
+            .filter(|grant| !grant.is_expired(now))
+            .collect();
+        send_authorizations.sort_by(|a, b| (&a.granter, &a.grantee).cmp(&(&b.granter, &b.grantee)));
+        let mut ft_tokens = self.get_ft_tokens();
+        ft_tokens.sort_by(|a, b| a.token_id.cmp(&b.token_id));
+        let mut ft_registrations: Vec<FtRegistration> = self.ft_registrations.iter()
+            .map(|(denom, account)| FtRegistration { denom, account })
+            .collect();
+        ft_registrations.sort_by(|a, b| (&a.denom, &a.account).cmp(&(&b.denom, &b.account)));
+
+        BankGenesis {
+            params: BankParams {
+                send_enabled: self.get_send_enabled(),
+                default_send_enabled: self.default_send_enabled,
+            },
+            balances,
+            supply: self.total_supply(),
+            denom_metadata: self.get_all_denom_metadata(),
+            locks,
+            send_authorizations,
+            ft_tokens,
+            ft_registrations,
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use near_sdk::test_utils::VMContextBuilder;
+    use near_sdk::testing_env;
+
+    fn account(name: &str) -> AccountId {
+        name.parse().unwrap()
+    }
+
+    fn coins(list: &[(&str, u128)]) -> Coins {
+        Coins::new(list.iter().map(|(denom, amount)| Coin::new(*denom, *amount)).collect()).unwrap()
+    }
+
+    #[test]
+    fn test_export_loads_into_a_new_bank() {
+        testing_env!(VMContextBuilder::new().build());
+        let mut bank = BankModule::new();
+        let (alice, bob) = (account("alice.near"), account("bob.near"));
+        bank.mint(&alice, 100);
+        bank.mint_denom(&bob, "ibc/ATOM", 7);
+        bank.transfer(&alice, &bob, 40);
+        bank.set_send_enabled(&SetSendEnabled {
+            send_enabled: vec![SendEnabled { denom: "ibc/ATOM".to_string(), enabled: false }],
+            ..Default::default()
+        }).unwrap();
+        bank.lock_coins(&alice, "unear", 5, "vesting", None).unwrap();
+        let escrow = bank.lock_coins(&bob, "unear", 20, "escrow", None).unwrap();
+        bank.grant_send(&alice, &bob, coins(&[("unear", 10)]), vec![], None).unwrap();
+        bank.register_ft_token(account("atom.near"), "ibc/ATOM".to_string()).unwrap();
+        bank.ft_register_account("ibc/ATOM", &alice);
+
+        let genesis = bank.export_genesis();
+        assert_eq!(genesis.balances.iter().map(|balance| balance.address.clone()).collect::<Vec<_>>(), vec![alice.clone(), bob.clone()]);
+        assert_eq!(genesis.balances[1].coins, coins(&[("ibc/ATOM", 7), ("unear", 40)]));
+        assert_eq!(genesis.supply, coins(&[("ibc/ATOM", 7), ("unear", 100)]));
+        assert_eq!(genesis.locks.iter().map(|lock| lock.id).collect::<Vec<_>>(), vec![0, escrow]);
+        assert_eq!(genesis.send_authorizations.len(), 1);
+        assert_eq!(genesis.ft_registrations, vec![FtRegistration { denom: "ibc/ATOM".to_string(), account: alice.clone() }]);
+
+        let mut migrated = BankModule::with_prefix(b"next");
+        migrated.init_genesis(&genesis).unwrap();
+        assert_eq!(migrated.export_genesis(), genesis);
+        assert!(!migrated.is_send_enabled("ibc/ATOM"));
+        assert_eq!(migrated.get_spendable_balance(&bob, "unear"), 20);
+        migrated.unlock_coins(escrow, "escrow").unwrap();
+        assert_eq!(migrated.get_send_authorization(&alice, &bob), bank.get_send_authorization(&alice, &bob));
+        assert!(migrated.ft_has_deposit("ibc/ATOM", &alice));
+        assert_eq!(migrated.lock_coins(&alice, "unear", 1, "vesting", None).unwrap(), escrow + 1);
+        assert!(migrated.init_genesis(&genesis).unwrap_err().contains("before any tokens"));
+    }
+
+    #[test]
+    fn test_genesis_validation() {
+        let alice = account("alice.near");
+        let mut genesis = BankGenesis {
+            balances: vec![GenesisBalance { address: alice.clone(), coins: coins(&[("unear", 10)]) }],
+            ..Default::default()
+        };
+        assert!(genesis.validate().is_ok());
+
+        genesis.supply = coins(&[("unear", 11)]);
+        assert!(genesis.validate().unwrap_err().contains("does not match"));
+        genesis.supply = coins(&[("unear", 10)]);
+        assert!(genesis.validate().is_ok());
+
+        genesis.balances.push(GenesisBalance { address: alice.clone(), coins: coins(&[("ibc/ATOM", 1)]) });
+        assert!(genesis.validate().unwrap_err().contains("more than once"));
+        genesis.balances.pop();
+
+        let registration = FtRegistration { denom: "unear".to_string(), account: alice };
+        genesis.ft_registrations = vec![registration.clone(), registration];
+        assert!(genesis.validate().unwrap_err().contains("more than once"));
+    }
+}
@@ -0,0 +1,177 @@
+/// Bank Hooks
+///
+/// Modules that follow balances, such as staking tracking bonded accounts or
+/// distribution settling rewards on a balance change, register `BankHooks`
+/// with the bank instead of polling its storage, as with the hooks of the
+/// Cosmos SDK keepers. `before_send` runs before any balance moves and can
+/// refuse the send; the other hooks run once the change is booked.
+///
+/// Hooks are wiring, not state: they are skipped when the bank is stored and
+/// registered again each time the contract loads it.
+
+use near_sdk::AccountId;
+
+use super::{BankModule, Coin};
+
+/// Called around every send, mint and burn of the bank
+///
+/// Every method defaults to a no-op so a module implements only the ones it
+/// needs.
+pub trait BankHooks {
+    /// Refuse a send by returning an error; nothing has moved yet
+    fn before_send(&mut self, _from: &AccountId, _to: &AccountId, _coin: &Coin) -> Result<(), String> {
+        Ok(())
+    }
+
+    fn after_send(&mut self, _from: &AccountId, _to: &AccountId, _coin: &Coin) {}
+
+    fn after_mint(&mut self, _to: &AccountId, _coin: &Coin) {}
+
+    fn after_burn(&mut self, _from: &AccountId, _coin: &Coin) {}
+}
+
+impl BankModule {
+    /// Register `hooks`, run after those registered before them
+    pub fn register_hooks(&mut self, hooks: Box<dyn BankHooks>) {
+        self.hooks.push(hooks);
+    }
+
+    /// Whether any hooks were registered since the bank was loaded
+    pub fn has_hooks(&self) -> bool {
+        !self.hooks.is_empty()
+    }
+
+    /// Ask every hook whether the send may go ahead, stopping at the first
+    /// refusal
+    pub(super) fn before_send(&mut self, from: &AccountId, to: &AccountId, coin: &Coin) -> Result<(), String> {
+        for hooks in self.hooks.iter_mut() {
+            hooks.before_send(from, to, coin)?;
+        }
+        Ok(())
+    }
+
+    pub(super) fn after_send(&mut self, from: &AccountId, to: &AccountId, coin: &Coin) {
+        for hooks in self.hooks.iter_mut() {
+            hooks.after_send(from, to, coin);
+        }
+    }
+
+    pub(super) fn after_mint(&mut self, to: &AccountId, coin: &Coin) {
+        for hooks in self.hooks.iter_mut() {
+            hooks.after_mint(to, coin);
+        }
+    }
+
+    pub(super) fn after_burn(&mut self, from: &AccountId, coin: &Coin) {
+        for hooks in self.hooks.iter_mut() {
+            hooks.after_burn(from, coin);
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::modules::bank::{Coins, MultiSend, SendEntry, SendRestriction};
+    use crate::Balance;
+    use near_sdk::test_utils::VMContextBuilder;
+    use near_sdk::testing_env;
+    use std::cell::RefCell;
+    use std::rc::Rc;
+
+    /// Records every call and refuses sends to `frozen.near`
+    struct RecordingHooks {
+        calls: Rc<RefCell<Vec<String>>>,
+    }
+
+    impl BankHooks for RecordingHooks {
+        fn before_send(&mut self, from: &AccountId, to: &AccountId, coin: &Coin) -> Result<(), String> {
+            if to.as_str() == "frozen.near" {
+                return Err(format!("{} is frozen", to));
+            }
+            self.calls.borrow_mut().push(format!("before_send {} {} {}", from, to, coin));
+            Ok(())
+        }
+
+        fn after_send(&mut self, from: &AccountId, to: &AccountId, coin: &Coin) {
+            self.calls.borrow_mut().push(format!("after_send {} {} {}", from, to, coin));
+        }
+
+        fn after_mint(&mut self, to: &AccountId, coin: &Coin) {
+            self.calls.borrow_mut().push(format!("after_mint {} {}", to, coin));
+        }
+
+        fn after_burn(&mut self, from: &AccountId, coin: &Coin) {
+            self.calls.borrow_mut().push(format!("after_burn {} {}", from, coin));
+        }
+    }
+
+    struct AllowAll;
+
+    impl SendRestriction for AllowAll {
+        fn check_send(&self, _from: &AccountId, _to: &AccountId, _amount: Balance) -> Result<(), String> {
+            Ok(())
+        }
+    }
+
+    fn account(name: &str) -> AccountId {
+        name.parse().unwrap()
+    }
+
+    fn setup() -> (BankModule, Rc<RefCell<Vec<String>>>) {
+        testing_env!(VMContextBuilder::new().build());
+        let calls = Rc::new(RefCell::new(Vec::new()));
+        let mut bank = BankModule::new();
+        bank.register_hooks(Box::new(RecordingHooks { calls: calls.clone() }));
+        (bank, calls)
+    }
+
+    #[test]
+    fn test_hooks_see_every_balance_change() {
+        let (mut bank, calls) = setup();
+        bank.mint(&account("alice.near"), 100);
+        bank.transfer_denom(&account("alice.near"), &account("bob.near"), "unear", 30);
+        bank.burn(&account("bob.near"), 10);
+
+        assert_eq!(
+            *calls.borrow(),
+            vec![
+                "after_mint alice.near 100unear",
+                "before_send alice.near bob.near 30unear",
+                "after_send alice.near bob.near 30unear",
+                "after_burn bob.near 10unear",
+            ]
+        );
+    }
+
+    #[test]
+    fn test_before_send_refuses_sends() {
+        let (mut bank, calls) = setup();
+        bank.mint(&account("alice.near"), 100);
+        calls.borrow_mut().clear();
+
+        let err = bank.send(&AllowAll, &account("alice.near"), &account("frozen.near"), 10).unwrap_err();
+        assert_eq!(err, "frozen.near is frozen");
+
+        let entry = |address: &str, amount: Balance| SendEntry {
+            address: account(address),
+            coins: Coins::new(vec![Coin::new("unear", amount)]).unwrap(),
+        };
+        let send = MultiSend {
+            inputs: vec![entry("alice.near", 20)],
+            outputs: vec![entry("bob.near", 10), entry("frozen.near", 10)],
+        };
+        assert!(bank.multi_send(&AllowAll, &send).is_err());
+
+        assert_eq!(bank.get_balance(&account("alice.near")), 100);
+        assert!(calls.borrow().iter().all(|call| !call.starts_with("after_send")));
+    }
+
+    #[test]
+    #[should_panic(expected = "frozen.near is frozen")]
+    fn test_refused_transfer_panics() {
+        let (mut bank, _) = setup();
+        bank.mint(&account("alice.near"), 100);
+        bank.transfer(&account("alice.near"), &account("frozen.near"), 10);
+    }
+}
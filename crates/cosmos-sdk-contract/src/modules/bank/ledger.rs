@@ -0,0 +1,210 @@
+/// Balance Ledger
+///
+/// Every balance mutation is journaled as a double-entry record, booked the
+/// way a bank books customer deposits: the debited account loses the
+/// amount and the credited account gains it. Mints have no debit side and
+/// burns no credit side, since those tokens enter or leave the supply. Each
+/// entry names the module and reason behind it, so fund flows can be traced
+/// from chain state with `audit_ledger`.
+///
+/// The journal keeps the most recent `MAX_LEDGER_ENTRIES`; older entries are
+/// pruned as new ones arrive, or earlier with `prune_ledger` once they have
+/// been archived off chain.
+
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::serde::{Deserialize, Serialize};
+use near_sdk::{env, AccountId};
+use schemars::JsonSchema;
+
+use super::BankModule;
+use crate::Balance;
+
+/// Entries kept in the journal
+pub const MAX_LEDGER_ENTRIES: u64 = 100_000;
+
+/// Entries indexed per account, oldest are dropped first
+pub const MAX_LEDGER_ENTRIES_PER_ACCOUNT: usize = 1_000;
+
+/// Largest page returned by `audit_ledger`
+pub const MAX_AUDIT_PAGE: u32 = 100;
+
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct LedgerEntry {
+    pub id: u64,
+    pub height: u64,
+    pub timestamp: u64,
+    /// Account whose balance decreased, `None` for mints
+    pub debit: Option<String>,
+    /// Account whose balance increased, `None` for burns
+    pub credit: Option<String>,
+    pub amount: Balance,
+    pub denom: String,
+    /// Module that moved the funds, e.g. `staking`
+    pub module: String,
+    pub reason: String,
+}
+
+/// Page of an account's ledger entries, oldest first
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct LedgerPage {
+    pub entries: Vec<LedgerEntry>,
+    /// Pass as `from_id` to get the next page
+    pub next_from_id: Option<u64>,
+}
+
+impl BankModule {
+    pub(super) fn record_ledger(
+        &mut self,
+        debit: Option<&AccountId>,
+        credit: Option<&AccountId>,
+        amount: Balance,
+        denom: &str,
+        module: &str,
+        reason: &str,
+    ) -> u64 {
+        let id = self.ledger_next_id;
+        self.ledger_next_id += 1;
+        self.ledger.insert(&id, &LedgerEntry {
+            id,
+            height: env::block_height(),
+            timestamp: env::block_timestamp(),
+            debit: debit.map(|account| account.to_string()),
+            credit: credit.map(|account| account.to_string()),
+            amount,
+            denom: denom.to_string(),
+            module: module.to_string(),
+            reason: reason.to_string(),
+        });
+
+        for account in [debit, credit].into_iter().flatten() {
+            let mut ids = self.ledger_accounts.get(account).unwrap_or_default();
+            if ids.last() != Some(&id) {
+                ids.push(id);
+            }
+            if ids.len() > MAX_LEDGER_ENTRIES_PER_ACCOUNT {
+                ids.remove(0);
+            }
+            self.ledger_accounts.insert(account, &ids);
+        }
+
+        if self.ledger_next_id - self.ledger_first_id > MAX_LEDGER_ENTRIES {
+            self.prune_ledger(self.ledger_next_id - MAX_LEDGER_ENTRIES);
+        }
+        id
+    }
+
+    /// Drop journal entries with ids below `before_id`, returning how many
+    ///
+    /// Account indexes are not rewritten; audits skip the pruned ids.
+    pub fn prune_ledger(&mut self, before_id: u64) -> u64 {
+        let before_id = before_id.min(self.ledger_next_id);
+        let pruned = before_id.saturating_sub(self.ledger_first_id);
+        while self.ledger_first_id < before_id {
+            self.ledger.remove(&self.ledger_first_id);
+            self.ledger_first_id += 1;
+        }
+        pruned
+    }
+
+    pub fn ledger_entry(&self, id: u64) -> Option<LedgerEntry> {
+        self.ledger.get(&id)
+    }
+
+    /// Oldest entry id still in the journal
+    pub fn ledger_first_id(&self) -> u64 {
+        self.ledger_first_id
+    }
+
+    /// All entries from `from_id` on, in id order
+    ///
+    /// Pages through the whole journal, e.g. to archive it or replay it.
+    pub fn export_ledger(&self, from_id: Option<u64>, limit: u32) -> LedgerPage {
+        let limit = limit.clamp(1, MAX_AUDIT_PAGE) as u64;
+        let from_id = from_id.unwrap_or(0).max(self.ledger_first_id);
+        let to_id = from_id.saturating_add(limit).min(self.ledger_next_id);
+        LedgerPage {
+            entries: (from_id..to_id).filter_map(|id| self.ledger.get(&id)).collect(),
+            next_from_id: Some(to_id).filter(|id| *id < self.ledger_next_id),
+        }
+    }
+
+    /// Entries debiting or crediting `account` from `from_id` on
+    pub fn audit_ledger(&self, account: &AccountId, from_id: Option<u64>, limit: u32) -> LedgerPage {
+        let limit = limit.clamp(1, MAX_AUDIT_PAGE) as usize;
+        let from_id = from_id.unwrap_or(0).max(self.ledger_first_id);
+        let ids: Vec<u64> = self.ledger_accounts.get(account)
+            .unwrap_or_default()
+            .into_iter()
+            .filter(|id| *id >= from_id)
+            .collect();
+
+        let entries: Vec<LedgerEntry> = ids.iter()
+            .take(limit)
+            .filter_map(|id| self.ledger.get(id))
+            .collect();
+        LedgerPage {
+            next_from_id: ids.get(limit).copied(),
+            entries,
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use near_sdk::test_utils::VMContextBuilder;
+    use near_sdk::testing_env;
+
+    fn account(name: &str) -> AccountId {
+        name.parse().unwrap()
+    }
+
+    #[test]
+    fn test_mutations_are_journaled() {
+        testing_env!(VMContextBuilder::new().block_height(7).build());
+        let (alice, bob) = (account("alice.near"), account("bob.near"));
+        let mut bank = BankModule::new();
+
+        bank.mint(&alice, 100);
+        bank.transfer_with_reason(&alice, &bob, 40, "staking", "delegate");
+        bank.burn(&bob, 10);
+
+        let page = bank.audit_ledger(&bob, None, 10);
+        assert_eq!(page.next_from_id, None);
+        assert_eq!(page.entries.len(), 2);
+        let delegate = &page.entries[0];
+        assert_eq!(delegate.debit.as_deref(), Some("alice.near"));
+        assert_eq!(delegate.credit.as_deref(), Some("bob.near"));
+        assert_eq!((delegate.amount, delegate.height), (40, 7));
+        assert_eq!((delegate.module.as_str(), delegate.reason.as_str()), ("staking", "delegate"));
+        assert_eq!(page.entries[1].credit, None);
+        assert_eq!(page.entries[1].reason, "burn");
+
+        let minted = bank.ledger_entry(0).unwrap();
+        assert_eq!((minted.debit, minted.credit.as_deref()), (None, Some("alice.near")));
+    }
+
+    #[test]
+    fn test_audit_pagination() {
+        let (alice, bob) = (account("alice.near"), account("bob.near"));
+        let mut bank = BankModule::new();
+        bank.mint(&alice, 100);
+        for _ in 0..5 {
+            bank.transfer(&alice, &bob, 1);
+        }
+
+        let first = bank.audit_ledger(&alice, None, 4);
+        assert_eq!(first.entries.len(), 4);
+        assert_eq!(first.next_from_id, Some(4));
+
+        let second = bank.audit_ledger(&alice, first.next_from_id, 4);
+        assert_eq!(second.entries.iter().map(|entry| entry.id).collect::<Vec<_>>(), vec![4, 5]);
+        assert_eq!(second.next_from_id, None);
+
+        assert_eq!(bank.prune_ledger(3), 3);
+        assert!(bank.ledger_entry(2).is_none());
+        let pruned = bank.audit_ledger(&alice, None, 10);
+        assert_eq!(pruned.entries.first().map(|entry| entry.id), Some(3));
+        assert_eq!(pruned.entries.len(), 3);
+    }
+}
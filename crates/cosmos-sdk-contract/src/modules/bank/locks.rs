@@ -0,0 +1,216 @@
+/// Locked Coins
+///
+/// Vesting schedules and escrows of other modules keep coins in the owner's
+/// balance but must stop the owner from spending them. Each lock holds an
+/// amount of one denom of one account for the module that created it,
+/// either until that module unlocks it or until its unlock time passes.
+/// The spendable balance is the balance less every active lock, and user
+/// sends can only spend that much. Modules still move locked coins through
+/// the bank's internal transfers, e.g. to delegate vesting coins.
+
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::serde::{Deserialize, Serialize};
+use near_sdk::{env, AccountId};
+use schemars::JsonSchema;
+
+use super::BankModule;
+use crate::Balance;
+
+/// Locks one account may hold at a time
+pub const MAX_LOCKS_PER_ACCOUNT: usize = 32;
+
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct CoinLock {
+    pub id: u64,
+    pub account: AccountId,
+    pub denom: String,
+    pub amount: Balance,
+    /// Module that created the lock and may release it
+    pub module: String,
+    /// Block timestamp in nanoseconds the lock lapses at, `None` until released
+    pub unlock_time: Option<u64>,
+}
+
+impl CoinLock {
+    pub fn is_active(&self, now: u64) -> bool {
+        self.unlock_time.map_or(true, |unlock_time| now < unlock_time)
+    }
+}
+
+impl BankModule {
+    /// Lock `amount` of `denom` held by `account` for `module`, returning
+    /// the lock id
+    pub fn lock_coins(
+        &mut self,
+        account: &AccountId,
+        denom: &str,
+        amount: Balance,
+        module: &str,
+        unlock_time: Option<u64>,
+    ) -> Result<u64, String> {
+        if amount == 0 {
+            return Err("Cannot lock a zero amount".to_string());
+        }
+        let spendable = self.get_spendable_balance(account, denom);
+        if spendable < amount {
+            return Err(format!("Cannot lock {}{} of {}: only {}{} is spendable", amount, denom, account, spendable, denom));
+        }
+        let mut ids = self.active_lock_ids(account);
+        if ids.len() >= MAX_LOCKS_PER_ACCOUNT {
+            return Err(format!("{} already holds {} locks", account, MAX_LOCKS_PER_ACCOUNT));
+        }
+
+        let id = self.next_lock_id;
+        self.next_lock_id += 1;
+        let lock = CoinLock {
+            id,
+            account: account.clone(),
+            denom: denom.to_string(),
+            amount,
+            module: module.to_string(),
+            unlock_time,
+        };
+        self.locks.insert(&id, &lock);
+        ids.push(id);
+        self.account_locks.insert(account, &ids);
+
+        env::log_str(&format!(
+            "EVENT: coins_locked id={} account={} amount={}{} module={} unlock_time={}",
+            id, account, amount, denom, module, unlock_time.map_or("none".to_string(), |time| time.to_string())
+        ));
+        Ok(id)
+    }
+
+    /// Release lock `id`, only the module that created it can
+    pub fn unlock_coins(&mut self, id: u64, module: &str) -> Result<CoinLock, String> {
+        let lock = self.locks.get(&id).ok_or_else(|| format!("Lock {} not found", id))?;
+        if lock.module != module {
+            return Err(format!("Lock {} belongs to module {}", id, lock.module));
+        }
+        self.locks.remove(&id);
+        let ids: Vec<u64> = self.active_lock_ids(&lock.account).into_iter().filter(|other| *other != id).collect();
+        if ids.is_empty() {
+            self.account_locks.remove(&lock.account);
+        } else {
+            self.account_locks.insert(&lock.account, &ids);
+        }
+
+        env::log_str(&format!(
+            "EVENT: coins_unlocked id={} account={} amount={}{} module={}",
+            id, lock.account, lock.amount, lock.denom, module
+        ));
+        Ok(lock)
+    }
+
+    /// Active locks of `account`
+    pub fn get_locks(&self, account: &AccountId) -> Vec<CoinLock> {
+        let now = env::block_timestamp();
+        self.account_locks.get(account).unwrap_or_default()
+            .into_iter()
+            .filter_map(|id| self.locks.get(&id))
+            .filter(|lock| lock.is_active(now))
+            .collect()
+    }
+
+    pub fn get_locked_balance(&self, account: &AccountId, denom: &str) -> Balance {
+        self.get_locks(account).iter()
+            .filter(|lock| lock.denom == denom)
+            .map(|lock| lock.amount)
+            .sum()
+    }
+
+    /// Balance of `denom` that `account` can send, its balance less its locks
+    ///
+    /// Locks can exceed the balance once a module moved locked coins away,
+    /// the spendable balance is then zero.
+    pub fn get_spendable_balance(&self, account: &AccountId, denom: &str) -> Balance {
+        self.get_denom_balance(account, denom).saturating_sub(self.get_locked_balance(account, denom))
+    }
+
+    /// Refuse a user send of more than the spendable balance
+    pub(super) fn check_spendable(&self, account: &AccountId, denom: &str, amount: Balance) -> Result<(), String> {
+        let spendable = self.get_spendable_balance(account, denom);
+        if spendable < amount {
+            return Err(format!(
+                "Insufficient balance: {} has {}{} spendable of {}{}, need {}{}",
+                account, spendable, denom, self.get_denom_balance(account, denom), denom, amount, denom
+            ));
+        }
+        Ok(())
+    }
+
+    /// Lock ids of `account`, dropping locks whose unlock time has passed
+    fn active_lock_ids(&mut self, account: &AccountId) -> Vec<u64> {
+        let now = env::block_timestamp();
+        let mut ids = self.account_locks.get(account).unwrap_or_default();
+        ids.retain(|id| match self.locks.get(id) {
+            Some(lock) if lock.is_active(now) => true,
+            Some(_) => {
+                self.locks.remove(id);
+                false
+            }
+            None => false,
+        });
+        ids
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::modules::bank::SendRestriction;
+    use near_sdk::test_utils::VMContextBuilder;
+    use near_sdk::testing_env;
+
+    struct NoRestriction;
+
+    impl SendRestriction for NoRestriction {
+        fn check_send(&self, _from: &AccountId, _to: &AccountId, _amount: Balance) -> Result<(), String> {
+            Ok(())
+        }
+    }
+
+    fn at_time(timestamp: u64) {
+        testing_env!(VMContextBuilder::new().block_timestamp(timestamp).build());
+    }
+
+    fn account(name: &str) -> AccountId {
+        name.parse().unwrap()
+    }
+
+    #[test]
+    fn test_locked_coins_cannot_be_sent() {
+        at_time(100);
+        let mut bank = BankModule::new();
+        let (alice, bob) = (account("alice.near"), account("bob.near"));
+        bank.mint(&alice, 100);
+        let escrow = bank.lock_coins(&alice, "unear", 60, "staking", None).unwrap();
+        bank.lock_coins(&alice, "unear", 30, "vesting", Some(200)).unwrap();
+        assert_eq!(bank.get_spendable_balance(&alice, "unear"), 10);
+        assert!(bank.lock_coins(&alice, "unear", 11, "vesting", None).is_err());
+
+        assert!(bank.send(&NoRestriction, &alice, &bob, 11).unwrap_err().contains("spendable"));
+        bank.send(&NoRestriction, &alice, &bob, 10).unwrap();
+
+        // The vesting lock lapses, the escrow only when staking releases it
+        at_time(200);
+        assert_eq!(bank.get_spendable_balance(&alice, "unear"), 30);
+        assert!(bank.unlock_coins(escrow, "vesting").is_err());
+        bank.unlock_coins(escrow, "staking").unwrap();
+        assert_eq!(bank.get_spendable_balance(&alice, "unear"), 90);
+        assert!(bank.get_locks(&alice).is_empty());
+    }
+
+    #[test]
+    fn test_modules_move_locked_coins() {
+        at_time(100);
+        let mut bank = BankModule::new();
+        let alice = account("alice.near");
+        bank.mint(&alice, 100);
+        bank.lock_coins(&alice, "unear", 100, "vesting", None).unwrap();
+
+        bank.transfer_with_reason(&alice, &account("pool.near"), 40, "staking", "delegate");
+        assert_eq!(bank.get_locked_balance(&alice, "unear"), 100);
+        assert_eq!(bank.get_spendable_balance(&alice, "unear"), 0);
+    }
+}
@@ -0,0 +1,251 @@
+/// Denomination Metadata
+///
+/// Mirrors `cosmos.bank.v1beta1.Metadata`. A denom is stored in its base unit
+/// (exponent 0) and may declare larger units, one of which is the display
+/// unit shown to users. Converting between units shifts the decimal point by
+/// the difference of their exponents, so clients never hardcode decimals.
+
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::serde::{Deserialize, Serialize};
+use schemars::JsonSchema;
+
+use crate::Balance;
+
+/// Largest exponent a unit may declare, `10^38` still fits a u128
+pub const MAX_EXPONENT: u32 = 38;
+
+/// A unit of a denomination
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct DenomUnit {
+    pub denom: String,
+    /// Power of 10 to convert one of this unit into base units
+    pub exponent: u32,
+    #[serde(default)]
+    pub aliases: Vec<String>,
+}
+
+/// Metadata describing a denomination and its units
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct Metadata {
+    #[serde(default)]
+    pub description: String,
+    /// Units ordered by ascending exponent, starting with the base unit
+    pub denom_units: Vec<DenomUnit>,
+    pub base: String,
+    pub display: String,
+    #[serde(default)]
+    pub name: String,
+    #[serde(default)]
+    pub symbol: String,
+}
+
+/// Amount expressed in a display unit
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct DisplayCoin {
+    pub denom: String,
+    /// Decimal amount without trailing zeros, e.g. "1.5"
+    pub amount: String,
+}
+
+impl Metadata {
+    /// Check the unit layout the same way the Cosmos SDK does
+    pub fn validate(&self) -> Result<(), String> {
+        if self.base.is_empty() {
+            return Err("Metadata base denom cannot be empty".to_string());
+        }
+        let first = self.denom_units.first()
+            .ok_or("Metadata must declare at least the base unit")?;
+        if first.denom != self.base || first.exponent != 0 {
+            return Err(format!("First denom unit must be the base denom {} with exponent 0", self.base));
+        }
+
+        let mut seen = Vec::new();
+        let mut previous_exponent = None;
+        for unit in &self.denom_units {
+            if unit.exponent > MAX_EXPONENT {
+                return Err(format!("Exponent of {} exceeds {}", unit.denom, MAX_EXPONENT));
+            }
+            if let Some(previous) = previous_exponent {
+                if unit.exponent <= previous {
+                    return Err("Denom units must be sorted by strictly ascending exponent".to_string());
+                }
+            }
+            previous_exponent = Some(unit.exponent);
+
+            for name in std::iter::once(&unit.denom).chain(unit.aliases.iter()) {
+                if name.is_empty() {
+                    return Err("Denom unit names cannot be empty".to_string());
+                }
+                if seen.contains(name) {
+                    return Err(format!("Duplicate denom unit name {}", name));
+                }
+                seen.push(name.clone());
+            }
+        }
+
+        if self.unit(&self.display).is_none() {
+            return Err(format!("Display denom {} is not one of the denom units", self.display));
+        }
+        Ok(())
+    }
+
+    /// Find a unit by its denom or one of its aliases
+    pub fn unit(&self, denom: &str) -> Option<&DenomUnit> {
+        self.denom_units.iter()
+            .find(|unit| unit.denom == denom || unit.aliases.iter().any(|alias| alias == denom))
+    }
+
+    pub fn display_unit(&self) -> &DenomUnit {
+        self.unit(&self.display).expect("validated metadata has a display unit")
+    }
+}
+
+/// Native token of a deployment, fixed at genesis
+///
+/// Defaults to NEAR: base `unear`, display `near`, 24 decimals.
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct NativeToken {
+    pub base_denom: String,
+    pub display_denom: String,
+    /// Decimals of the display denom
+    pub exponent: u32,
+    #[serde(default)]
+    pub name: String,
+    #[serde(default)]
+    pub symbol: String,
+}
+
+impl Default for NativeToken {
+    fn default() -> Self {
+        Self {
+            base_denom: super::NATIVE_DENOM.to_string(),
+            display_denom: "near".to_string(),
+            exponent: 24,
+            name: "NEAR".to_string(),
+            symbol: "NEAR".to_string(),
+        }
+    }
+}
+
+impl NativeToken {
+    pub fn validate(&self) -> Result<(), String> {
+        if self.exponent == 0 && self.display_denom != self.base_denom {
+            return Err("Display denom needs a non-zero exponent".to_string());
+        }
+        self.to_metadata().validate()
+    }
+
+    /// Bank metadata with the base unit and, if different, the display unit
+    pub fn to_metadata(&self) -> Metadata {
+        let mut denom_units = vec![DenomUnit { denom: self.base_denom.clone(), exponent: 0, aliases: vec![] }];
+        if self.display_denom != self.base_denom {
+            denom_units.push(DenomUnit { denom: self.display_denom.clone(), exponent: self.exponent, aliases: vec![] });
+        }
+        Metadata {
+            description: format!("Native {} token", self.symbol),
+            denom_units,
+            base: self.base_denom.clone(),
+            display: self.display_denom.clone(),
+            name: self.name.clone(),
+            symbol: self.symbol.clone(),
+        }
+    }
+}
+
+/// Format a base amount as a decimal with `exponent` fractional digits
+pub fn format_decimal(amount: Balance, exponent: u32) -> String {
+    if exponent == 0 {
+        return amount.to_string();
+    }
+    let scale = 10u128.pow(exponent);
+    let whole = amount / scale;
+    let fraction = amount % scale;
+    if fraction == 0 {
+        return whole.to_string();
+    }
+    let fraction = format!("{:0width$}", fraction, width = exponent as usize);
+    format!("{}.{}", whole, fraction.trim_end_matches('0'))
+}
+
+/// Parse a decimal amount into base units, rejecting lost precision
+pub fn parse_decimal(amount: &str, exponent: u32) -> Result<Balance, String> {
+    let (whole, fraction) = match amount.split_once('.') {
+        Some((whole, fraction)) => (whole, fraction),
+        None => (amount, ""),
+    };
+    let digits_only = |part: &str| part.chars().all(|c| c.is_ascii_digit());
+    if whole.is_empty() || !digits_only(whole) || !digits_only(fraction) {
+        return Err(format!("Invalid decimal amount: {}", amount));
+    }
+
+    let fraction = fraction.trim_end_matches('0');
+    if fraction.len() > exponent as usize {
+        return Err(format!("Amount {} has more than {} decimal places", amount, exponent));
+    }
+
+    let scale = 10u128.pow(exponent);
+    let whole: Balance = whole.parse()
+        .map_err(|_| format!("Invalid decimal amount: {}", amount))?;
+    let fraction_value: Balance = if fraction.is_empty() {
+        0
+    } else {
+        fraction.parse::<Balance>().map_err(|_| format!("Invalid decimal amount: {}", amount))?
+            * 10u128.pow(exponent - fraction.len() as u32)
+    };
+
+    whole.checked_mul(scale)
+        .and_then(|value| value.checked_add(fraction_value))
+        .ok_or_else(|| format!("Amount {} overflows", amount))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn atom() -> Metadata {
+        Metadata {
+            description: "The native staking token".to_string(),
+            denom_units: vec![
+                DenomUnit { denom: "uatom".to_string(), exponent: 0, aliases: vec!["microatom".to_string()] },
+                DenomUnit { denom: "matom".to_string(), exponent: 3, aliases: vec![] },
+                DenomUnit { denom: "atom".to_string(), exponent: 6, aliases: vec![] },
+            ],
+            base: "uatom".to_string(),
+            display: "atom".to_string(),
+            name: "Cosmos Hub Atom".to_string(),
+            symbol: "ATOM".to_string(),
+        }
+    }
+
+    #[test]
+    fn test_validate() {
+        assert!(atom().validate().is_ok());
+
+        let mut metadata = atom();
+        metadata.denom_units.swap(1, 2);
+        assert!(metadata.validate().is_err());
+
+        let mut metadata = atom();
+        metadata.display = "katom".to_string();
+        assert!(metadata.validate().is_err());
+
+        let mut metadata = atom();
+        metadata.denom_units[2].aliases.push("matom".to_string());
+        assert!(metadata.validate().is_err());
+    }
+
+    #[test]
+    fn test_decimal_round_trip() {
+        assert_eq!(format_decimal(1_500_000, 6), "1.5");
+        assert_eq!(format_decimal(1_000_000, 6), "1");
+        assert_eq!(format_decimal(42, 6), "0.000042");
+        assert_eq!(format_decimal(42, 0), "42");
+
+        assert_eq!(parse_decimal("1.5", 6), Ok(1_500_000));
+        assert_eq!(parse_decimal("0.000042", 6), Ok(42));
+        assert_eq!(parse_decimal("2.50", 1), Ok(25));
+        assert!(parse_decimal("0.0000001", 6).is_err());
+        assert!(parse_decimal("1,5", 6).is_err());
+        assert!(parse_decimal(".5", 6).is_err());
+    }
+}
@@ -1,47 +1,272 @@
 use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
-use near_sdk::collections::UnorderedMap;
+use near_sdk::collections::{LookupMap, UnorderedMap, UnorderedSet};
 use near_sdk::{env, AccountId};
 use crate::Balance;
+use crate::math::{safe_add, safe_sub};
+
+pub mod activity;
+pub mod allowances;
+pub mod coins;
+pub mod diff;
+pub mod events;
+pub mod genesis;
+pub mod hooks;
+pub mod ledger;
+pub mod locks;
+pub mod metadata;
+pub mod module_accounts;
+pub mod multi_send;
+pub mod nep141;
+pub mod replay;
+pub mod send_enabled;
+pub mod supply;
+
+pub use activity::{TransferRecord, MAX_MEMO_LEN};
+pub use allowances::SendAuthorization;
+pub use coins::{validate_denom, Coin, Coins};
+pub use diff::{KeyChange, StateDiff, MAX_STATE_DIFF_ENTRIES};
+pub use events::{BalanceEvent, BANK_EVENT_STANDARD, BANK_EVENT_VERSION};
+pub use genesis::{BankGenesis, BankParams, GenesisBalance};
+pub use hooks::BankHooks;
+pub use ledger::{LedgerEntry, LedgerPage, MAX_AUDIT_PAGE};
+pub use locks::{CoinLock, MAX_LOCKS_PER_ACCOUNT};
+pub use metadata::{DenomUnit, DisplayCoin, Metadata, NativeToken};
+pub use module_accounts::{module_address, ModuleAccount, FEE_COLLECTOR_NAME, GOV_MODULE_NAME};
+pub use multi_send::{MultiSend, SendEntry, MAX_MULTI_SEND_ENTRIES};
+pub use nep141::{FtRegistration, FtToken, StorageBalance, StorageBalanceBounds, FT_STORAGE_DEPOSIT};
+pub use replay::{replay_ledger, ReplayReport};
+pub use send_enabled::{SendEnabled, SetSendEnabled, BANK_PROPOSAL_ROUTE, SET_SEND_ENABLED};
+pub use supply::{SupplyOfResponse, SupplyProof};
+
+/// Default denom of the native token held in bank balances
+pub const NATIVE_DENOM: &str = "unear";
+
+/// Check run before a send moves any funds, as in the Cosmos SDK bank keeper
+pub trait SendRestriction {
+    fn check_send(&self, from: &AccountId, to: &AccountId, amount: Balance) -> Result<(), String>;
+}
 
 #[derive(BorshDeserialize, BorshSerialize)]
 pub struct BankModule {
-    balances: UnorderedMap<AccountId, Balance>,
+    /// Balance by account and denom
+    balances: UnorderedMap<(AccountId, String), Balance>,
+    /// Denoms each account holds a balance of, sorted
+    account_denoms: LookupMap<AccountId, Vec<String>>,
+    denom_metadata: UnorderedMap<String, Metadata>,
+    /// Total supply by denom
+    supply: UnorderedMap<String, Balance>,
+    /// Recent transfers by account, oldest first
+    activity: LookupMap<AccountId, Vec<TransferRecord>>,
+    /// Journal of balance mutations by entry id
+    ledger: LookupMap<u64, LedgerEntry>,
+    /// Oldest entry still in the journal
+    ledger_first_id: u64,
+    ledger_next_id: u64,
+    /// Ledger entry ids by account, oldest first
+    ledger_accounts: LookupMap<AccountId, Vec<u64>>,
+    /// Denom of the native token, `NATIVE_DENOM` unless set at genesis
+    native_denom: String,
+    /// Escrow accounts of other modules, registered at construction
+    module_accounts: Vec<ModuleAccount>,
+    /// Send enabled flag of denoms that do not follow the default
+    send_enabled: UnorderedMap<String, bool>,
+    default_send_enabled: bool,
+    /// Denom exposed by each NEP-141 token account
+    ft_tokens: UnorderedMap<AccountId, String>,
+    /// Accounts that paid the NEP-145 deposit, by denom
+    ft_registrations: UnorderedSet<(String, AccountId)>,
+    /// Coin locks by id
+    locks: UnorderedMap<u64, CoinLock>,
+    /// Lock ids held by each account
+    account_locks: LookupMap<AccountId, Vec<u64>>,
+    next_lock_id: u64,
+    /// Send authorizations by granter and grantee
+    send_authorizations: UnorderedMap<(AccountId, AccountId), SendAuthorization>,
+    /// Hooks registered by other modules, in registration order
+    #[borsh(skip)]
+    hooks: Vec<Box<dyn BankHooks>>,
 }
 
 impl BankModule {
     pub fn new() -> Self {
+        Self::with_prefix(b"")
+    }
+
+    /// Bank whose collections live under `prefix`, so a second bank can
+    /// share storage with the first, e.g. when replaying its ledger
+    pub fn with_prefix(prefix: &[u8]) -> Self {
+        let key = |name: &[u8]| [prefix, name].concat();
         Self {
-            balances: UnorderedMap::new(b"b".to_vec()),
+            balances: UnorderedMap::new(key(b"b")),
+            account_denoms: LookupMap::new(key(b"ad")),
+            denom_metadata: UnorderedMap::new(key(b"m")),
+            supply: UnorderedMap::new(key(b"s")),
+            activity: LookupMap::new(key(b"ac")),
+            ledger: LookupMap::new(key(b"lg")),
+            ledger_first_id: 0,
+            ledger_next_id: 0,
+            ledger_accounts: LookupMap::new(key(b"la")),
+            native_denom: NATIVE_DENOM.to_string(),
+            module_accounts: module_accounts::default_module_accounts(),
+            send_enabled: UnorderedMap::new(key(b"se")),
+            default_send_enabled: true,
+            ft_tokens: UnorderedMap::new(key(b"ft")),
+            ft_registrations: UnorderedSet::new(key(b"fr")),
+            locks: UnorderedMap::new(key(b"lk")),
+            account_locks: LookupMap::new(key(b"al")),
+            next_lock_id: 0,
+            send_authorizations: UnorderedMap::new(key(b"sa")),
+            hooks: Vec::new(),
         }
     }
 
     pub fn transfer(&mut self, sender: &AccountId, receiver: &AccountId, amount: Balance) {
-        let sender_balance = self.get_balance(sender);
-        assert!(sender_balance >= amount, "Insufficient balance");
+        self.transfer_with_reason(sender, receiver, amount, "bank", "transfer");
+    }
 
-        // Update sender balance
-        if sender_balance == amount {
-            self.balances.remove(sender);
-        } else {
-            self.balances.insert(sender, &(sender_balance - amount));
+    /// Transfer `amount` of `denom`
+    pub fn transfer_denom(&mut self, sender: &AccountId, receiver: &AccountId, denom: &str, amount: Balance) {
+        self.transfer_denom_with_reason(sender, receiver, denom, amount, "bank", "transfer");
+    }
+
+    /// Transfer `amount` of `denom`, refusing instead of panicking when the
+    /// sender cannot spend it or a `before_send` hook objects
+    pub fn try_transfer_denom(&mut self, sender: &AccountId, receiver: &AccountId, denom: &str, amount: Balance) -> Result<(), String> {
+        self.check_spendable(sender, denom, amount)?;
+        self.before_send(sender, receiver, &Coin::new(denom, amount))?;
+        self.move_denom(sender, receiver, denom, amount, "bank", "transfer");
+        Ok(())
+    }
+
+    /// Transfer every coin of `coins`, nothing moves unless the sender can
+    /// spend all of them
+    pub fn transfer_coins(&mut self, sender: &AccountId, receiver: &AccountId, coins: &Coins) -> Result<(), String> {
+        for coin in coins.iter() {
+            self.check_spendable(sender, &coin.denom, coin.amount)?;
+        }
+        for coin in coins.iter() {
+            self.transfer_denom(sender, receiver, &coin.denom, coin.amount);
         }
+        Ok(())
+    }
 
-        // Update receiver balance
-        let receiver_balance = self.get_balance(receiver);
-        self.balances.insert(receiver, &(receiver_balance + amount));
+    /// Transfer of the native token recorded in the ledger under `module`
+    /// and `reason`
+    pub fn transfer_with_reason(
+        &mut self,
+        sender: &AccountId,
+        receiver: &AccountId,
+        amount: Balance,
+        module: &str,
+        reason: &str,
+    ) {
+        let denom = self.native_denom.clone();
+        self.transfer_denom_with_reason(sender, receiver, &denom, amount, module, reason);
+    }
 
-        env::log_str(&format!("Bank: Transferred {} from {} to {}", amount, sender, receiver));
+    /// Transfer of `denom` recorded in the ledger under `module` and `reason`
+    pub fn transfer_denom_with_reason(
+        &mut self,
+        sender: &AccountId,
+        receiver: &AccountId,
+        denom: &str,
+        amount: Balance,
+        module: &str,
+        reason: &str,
+    ) {
+        if let Err(err) = self.before_send(sender, receiver, &Coin::new(denom, amount)) {
+            env::panic_str(&err);
+        }
+        self.move_denom(sender, receiver, denom, amount, module, reason);
+    }
+
+    /// Book a transfer whose `before_send` hooks have already passed
+    fn move_denom(
+        &mut self,
+        sender: &AccountId,
+        receiver: &AccountId,
+        denom: &str,
+        amount: Balance,
+        module: &str,
+        reason: &str,
+    ) {
+        let sender_balance = self.get_denom_balance(sender, denom);
+        self.set_balance(sender, denom, safe_sub(sender_balance, amount, "Sender balance"));
+
+        let receiver_balance = self.get_denom_balance(receiver, denom);
+        self.set_balance(receiver, denom, safe_add(receiver_balance, amount, "Receiver balance"));
+        let ledger_id = self.record_ledger(Some(sender), Some(receiver), amount, denom, module, reason);
+        self.after_send(sender, receiver, &Coin::new(denom, amount));
+
+        BalanceEvent::new(ledger_id, Some(sender), Some(receiver), denom, amount, module, reason).emit();
+    }
+
+    /// Transfer after the restriction has approved the send
+    pub fn send(
+        &mut self,
+        restriction: &dyn SendRestriction,
+        sender: &AccountId,
+        receiver: &AccountId,
+        amount: Balance,
+    ) -> Result<(), String> {
+        self.send_with_memo(restriction, sender, receiver, amount, String::new())
     }
 
     pub fn mint(&mut self, receiver: &AccountId, amount: Balance) {
-        let current_balance = self.get_balance(receiver);
-        self.balances.insert(receiver, &(current_balance + amount));
-        
-        env::log_str(&format!("Bank: Minted {} to {}", amount, receiver));
+        let denom = self.native_denom.clone();
+        self.mint_denom(receiver, &denom, amount);
+    }
+
+    /// Mint and count the tokens towards the supply of `denom`
+    pub fn mint_denom(&mut self, receiver: &AccountId, denom: &str, amount: Balance) {
+        self.mint_with_reason(receiver, denom, amount, "bank", "mint");
+    }
+
+    /// Mint recorded in the ledger under `module` and `reason`
+    pub fn mint_with_reason(&mut self, receiver: &AccountId, denom: &str, amount: Balance, module: &str, reason: &str) {
+        let current_balance = self.get_denom_balance(receiver, denom);
+        self.set_balance(receiver, denom, safe_add(current_balance, amount, "Receiver balance"));
+        self.increase_supply(denom, amount);
+        let ledger_id = self.record_ledger(None, Some(receiver), amount, denom, module, reason);
+        self.after_mint(receiver, &Coin::new(denom, amount));
+
+        BalanceEvent::new(ledger_id, None, Some(receiver), denom, amount, module, reason).emit();
     }
 
+    /// Balance of the native token
     pub fn get_balance(&self, account: &AccountId) -> Balance {
-        self.balances.get(account).unwrap_or(0)
+        self.get_denom_balance(account, &self.native_denom)
+    }
+
+    pub fn get_denom_balance(&self, account: &AccountId, denom: &str) -> Balance {
+        self.balances.get(&(account.clone(), denom.to_string())).unwrap_or(0)
+    }
+
+    /// Write a balance, dropping the entry and its index once it is zero
+    fn set_balance(&mut self, account: &AccountId, denom: &str, amount: Balance) {
+        let key = (account.clone(), denom.to_string());
+        let mut denoms = self.account_denoms.get(account).unwrap_or_default();
+        let position = denoms.binary_search_by(|held| held.as_str().cmp(denom));
+        match (amount, position) {
+            (0, Ok(index)) => {
+                self.balances.remove(&key);
+                denoms.remove(index);
+            }
+            (0, Err(_)) => return,
+            (_, Ok(_)) => {
+                self.balances.insert(&key, &amount);
+                return;
+            }
+            (_, Err(index)) => {
+                self.balances.insert(&key, &amount);
+                denoms.insert(index, denom.to_string());
+            }
+        }
+        if denoms.is_empty() {
+            self.account_denoms.remove(account);
+        } else {
+            self.account_denoms.insert(account, &denoms);
+        }
     }
 
     pub fn has_balance(&self, account: &AccountId, amount: Balance) -> bool {
@@ -49,30 +274,231 @@ impl BankModule {
     }
 
     pub fn burn(&mut self, account: &AccountId, amount: Balance) {
-        let current_balance = self.get_balance(account);
-        assert!(current_balance >= amount, "Insufficient balance to burn");
-        
-        if current_balance == amount {
-            self.balances.remove(account);
-        } else {
-            self.balances.insert(account, &(current_balance - amount));
+        let denom = self.native_denom.clone();
+        self.burn_denom(account, &denom, amount);
+    }
+
+    /// Burn and remove the tokens from the supply of `denom`
+    pub fn burn_denom(&mut self, account: &AccountId, denom: &str, amount: Balance) {
+        self.burn_with_reason(account, denom, amount, "bank", "burn");
+    }
+
+    /// Burn recorded in the ledger under `module` and `reason`
+    pub fn burn_with_reason(&mut self, account: &AccountId, denom: &str, amount: Balance, module: &str, reason: &str) {
+        let current_balance = self.get_denom_balance(account, denom);
+        self.set_balance(account, denom, safe_sub(current_balance, amount, "Burned balance"));
+        self.decrease_supply(denom, amount);
+        let ledger_id = self.record_ledger(Some(account), None, amount, denom, module, reason);
+        self.after_burn(account, &Coin::new(denom, amount));
+
+        BalanceEvent::new(ledger_id, Some(account), None, denom, amount, module, reason).emit();
+    }
+
+    /// Every balance of `account`, sorted by denom
+    pub fn get_all_balances(&self, account: AccountId) -> Coins {
+        let coins = self.account_denoms.get(&account).unwrap_or_default()
+            .into_iter()
+            .map(|denom| Coin { amount: self.get_denom_balance(&account, &denom), denom })
+            .collect();
+        Coins::from_sorted(coins)
+    }
+
+    pub fn native_denom(&self) -> &str {
+        &self.native_denom
+    }
+
+    /// Set the native token from genesis, before anything is minted
+    ///
+    /// Registers the token's metadata so display conversions work from the
+    /// first block.
+    pub fn init_native_token(&mut self, token: &NativeToken) -> Result<(), String> {
+        token.validate()?;
+        if !self.supply.is_empty() {
+            return Err("Native token can only be set before any tokens exist".to_string());
+        }
+        self.set_denom_metadata(token.to_metadata())?;
+        self.native_denom = token.base_denom.clone();
+        env::log_str(&format!("EVENT: native_token base={} display={} exponent={}", token.base_denom, token.display_denom, token.exponent));
+        Ok(())
+    }
+
+    pub fn get_total_supply(&self, denom: String) -> Balance {
+        self.supply_of(&denom)
+    }
+
+    pub fn set_denom_metadata(&mut self, metadata: Metadata) -> Result<(), String> {
+        metadata.validate()?;
+
+        // A unit name may only belong to one denom
+        for existing in self.denom_metadata.values().filter(|existing| existing.base != metadata.base) {
+            for unit in &metadata.denom_units {
+                if existing.unit(&unit.denom).is_some() || unit.aliases.iter().any(|alias| existing.unit(alias).is_some()) {
+                    return Err(format!("Denom unit {} is already used by {}", unit.denom, existing.base));
+                }
+            }
+        }
+
+        self.denom_metadata.insert(&metadata.base, &metadata);
+        env::log_str(&format!("Bank: Set denom metadata for {}", metadata.base));
+        Ok(())
+    }
+
+    pub fn get_denom_metadata(&self, base: String) -> Option<Metadata> {
+        self.denom_metadata.get(&base)
+    }
+
+    pub fn get_all_denom_metadata(&self) -> Vec<Metadata> {
+        self.denom_metadata.values().collect()
+    }
+
+    /// Metadata declaring `denom` as its base, one of its units or an alias
+    fn metadata_for_unit(&self, denom: &str) -> Result<Metadata, String> {
+        if let Some(metadata) = self.denom_metadata.get(&denom.to_string()) {
+            return Ok(metadata);
         }
-        
-        env::log_str(&format!("Bank: Burned {} from {}", amount, account));
+        self.denom_metadata.values()
+            .find(|metadata| metadata.unit(denom).is_some())
+            .ok_or_else(|| format!("No denom metadata for {}", denom))
     }
 
-    pub fn get_all_balances(&self, account: AccountId) -> Vec<(String, Balance)> {
-        // Return the single balance entry for the account
-        let balance = self.get_balance(&account);
-        if balance > 0 {
-            vec![("unear".to_string(), balance)]
+    /// Convert a whole amount of `denom` into the display unit of its denom
+    pub fn to_display(&self, amount: Balance, denom: String) -> Result<DisplayCoin, String> {
+        let metadata = self.metadata_for_unit(&denom)?;
+        let unit_exponent = metadata.unit(&denom).map(|unit| unit.exponent).unwrap_or(0);
+        let display = metadata.display_unit();
+
+        let amount = if unit_exponent >= display.exponent {
+            amount.checked_mul(10u128.pow(unit_exponent - display.exponent))
+                .ok_or_else(|| format!("Amount {} {} overflows", amount, denom))?
+                .to_string()
         } else {
-            Vec::new()
+            metadata::format_decimal(amount, display.exponent - unit_exponent)
+        };
+
+        Ok(DisplayCoin {
+            denom: display.denom.clone(),
+            amount,
+        })
+    }
+
+    /// Convert a decimal amount of any unit of a denom into base units
+    pub fn to_base(&self, amount: String, denom: String) -> Result<Balance, String> {
+        let metadata = self.metadata_for_unit(&denom)?;
+        let exponent = metadata.unit(&denom).map(|unit| unit.exponent).unwrap_or(0);
+        metadata::parse_decimal(&amount, exponent)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn near_metadata() -> Metadata {
+        Metadata {
+            description: "Native NEAR token".to_string(),
+            denom_units: vec![
+                DenomUnit { denom: "unear".to_string(), exponent: 0, aliases: vec![] },
+                DenomUnit { denom: "near".to_string(), exponent: 24, aliases: vec!["NEAR".to_string()] },
+            ],
+            base: "unear".to_string(),
+            display: "near".to_string(),
+            name: "NEAR".to_string(),
+            symbol: "NEAR".to_string(),
         }
     }
 
-    pub fn get_total_supply(&self, _denom: String) -> Balance {
-        // For now, return 0 - in a full implementation, we'd track total supply
-        0
+    #[test]
+    fn test_native_token_from_genesis() {
+        let mut bank = BankModule::new();
+        let token = NativeToken {
+            base_denom: "uproxima".to_string(),
+            display_denom: "proxima".to_string(),
+            exponent: 6,
+            name: "Proxima".to_string(),
+            symbol: "PRX".to_string(),
+        };
+        bank.init_native_token(&token).unwrap();
+        let alice: AccountId = "alice.near".parse().unwrap();
+        bank.mint(&alice, 2_500_000);
+
+        assert_eq!(bank.native_denom(), "uproxima");
+        assert_eq!(bank.supply_of("uproxima"), 2_500_000);
+        assert_eq!(bank.get_all_balances(alice).denoms(), vec!["uproxima".to_string()]);
+        assert_eq!(bank.to_display(2_500_000, "uproxima".to_string()).unwrap().amount, "2.5");
+        assert!(bank.init_native_token(&NativeToken::default()).is_err());
     }
-}
\ No newline at end of file
+
+    #[test]
+    fn test_balances_per_denom() {
+        let mut bank = BankModule::new();
+        let alice: AccountId = "alice.near".parse().unwrap();
+        let bob: AccountId = "bob.near".parse().unwrap();
+        bank.mint(&alice, 100);
+        bank.mint_denom(&alice, "ibc/ATOM", 50);
+        bank.mint_denom(&alice, "cw20:token.near", 7);
+
+        bank.transfer_denom(&alice, &bob, "ibc/ATOM", 20);
+        assert_eq!(bank.get_balance(&alice), 100);
+        assert_eq!(bank.get_denom_balance(&alice, "ibc/ATOM"), 30);
+        assert_eq!(bank.get_denom_balance(&bob, "ibc/ATOM"), 20);
+        assert_eq!(bank.get_balance(&bob), 0);
+        assert_eq!(
+            bank.get_all_balances(alice.clone()).into_vec(),
+            vec![Coin::new("cw20:token.near", 7), Coin::new("ibc/ATOM", 30), Coin::new("unear", 100)]
+        );
+
+        // Nothing moves unless every coin is covered
+        let coins = Coins::new(vec![Coin::new("unear", 10), Coin::new("ibc/ATOM", 31)]).unwrap();
+        assert!(bank.transfer_coins(&alice, &bob, &coins).is_err());
+        assert_eq!(bank.get_balance(&alice), 100);
+        let coins = Coins::new(vec![Coin::new("unear", 10), Coin::new("ibc/ATOM", 30)]).unwrap();
+        bank.transfer_coins(&alice, &bob, &coins).unwrap();
+        assert_eq!(bank.get_all_balances(bob.clone()).to_string(), "50ibc/ATOM,10unear");
+
+        // Emptied denoms drop out of the account's balances
+        bank.burn_denom(&alice, "cw20:token.near", 7);
+        assert_eq!(bank.get_all_balances(alice).denoms(), vec!["unear".to_string()]);
+        assert_eq!(bank.supply_of("cw20:token.near"), 0);
+    }
+
+    #[test]
+    #[should_panic(expected = "Receiver balance overflows")]
+    fn test_mint_past_max_does_not_wrap() {
+        let mut bank = BankModule::new();
+        let alice: AccountId = "alice.near".parse().unwrap();
+        bank.mint(&alice, Balance::MAX - 1);
+        bank.mint(&alice, 2);
+    }
+
+    #[test]
+    fn test_display_conversions() {
+        let mut bank = BankModule::new();
+        bank.set_denom_metadata(near_metadata()).unwrap();
+
+        let display = bank.to_display(1_500_000_000_000_000_000_000_000, "unear".to_string()).unwrap();
+        assert_eq!(display, DisplayCoin { denom: "near".to_string(), amount: "1.5".to_string() });
+        assert_eq!(bank.to_display(3, "NEAR".to_string()).unwrap().amount, "3");
+
+        assert_eq!(bank.to_base("0.25".to_string(), "near".to_string()), Ok(250_000_000_000_000_000_000_000));
+        assert_eq!(bank.to_base("7".to_string(), "unear".to_string()), Ok(7));
+        assert!(bank.to_base("0.5".to_string(), "unear".to_string()).is_err());
+        assert!(bank.to_display(1, "uatom".to_string()).is_err());
+    }
+
+    #[test]
+    fn test_unit_names_are_unique_across_denoms() {
+        let mut bank = BankModule::new();
+        bank.set_denom_metadata(near_metadata()).unwrap();
+
+        let mut wrapped = near_metadata();
+        wrapped.base = "wnear".to_string();
+        wrapped.denom_units[0].denom = "wnear".to_string();
+        assert!(bank.set_denom_metadata(wrapped).is_err());
+
+        // Updating the same denom is allowed
+        let mut updated = near_metadata();
+        updated.description = "Updated".to_string();
+        assert!(bank.set_denom_metadata(updated).is_ok());
+        assert_eq!(bank.get_denom_metadata("unear".to_string()).unwrap().description, "Updated");
+    }
+}
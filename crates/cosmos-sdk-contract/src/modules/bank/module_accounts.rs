@@ -0,0 +1,143 @@
+/// Module Accounts
+///
+/// Modules hold escrowed tokens in accounts of their own: the staking pools
+/// back bonded and unbonding stake, the fee collector gathers fees before
+/// they are distributed and governance holds proposal deposits. Each module
+/// keeps totals that must match the balance of its account, so a user who
+/// sends tokens straight into one breaks that accounting. As with the
+/// blocked addresses of the Cosmos SDK bank keeper, user sends to a blocked
+/// module account are refused, while modules keep moving tokens in and out
+/// through the bank's internal transfers.
+
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::serde::{Deserialize, Serialize};
+use near_sdk::{env, AccountId};
+use schemars::JsonSchema;
+
+use super::BankModule;
+use crate::modules::liquid_staking::liquid_staking_account;
+use crate::modules::staking::pools::{
+    bonded_pool_account, not_bonded_pool_account, BONDED_POOL_NAME, NOT_BONDED_POOL_NAME,
+};
+
+pub const FEE_COLLECTOR_NAME: &str = "fee_collector";
+pub const GOV_MODULE_NAME: &str = "gov";
+pub const LIQUID_STAKING_NAME: &str = "liquid_staking";
+
+/// Address of the module account `name`, a sub-account of this contract
+pub fn module_address(name: &str) -> AccountId {
+    format!("{}.{}", name, env::current_account_id())
+        .parse()
+        .unwrap_or_else(|_| env::panic_str(&format!("Invalid module account name {}", name)))
+}
+
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct ModuleAccount {
+    pub name: String,
+    pub address: AccountId,
+    /// Whether user sends to the account are refused
+    pub blocked: bool,
+}
+
+/// Module accounts every bank starts with, all blocked
+pub fn default_module_accounts() -> Vec<ModuleAccount> {
+    let blocked = |name: &str, address: AccountId| ModuleAccount { name: name.to_string(), address, blocked: true };
+    vec![
+        blocked(FEE_COLLECTOR_NAME, module_address(FEE_COLLECTOR_NAME)),
+        blocked(BONDED_POOL_NAME, bonded_pool_account()),
+        blocked(NOT_BONDED_POOL_NAME, not_bonded_pool_account()),
+        blocked(GOV_MODULE_NAME, module_address(GOV_MODULE_NAME)),
+        blocked(LIQUID_STAKING_NAME, liquid_staking_account()),
+    ]
+}
+
+impl BankModule {
+    /// Register the account of module `name`, returning its address
+    pub fn register_module_account(&mut self, name: &str, blocked: bool) -> Result<AccountId, String> {
+        if self.module_account(name).is_some() {
+            return Err(format!("Module account {} is already registered", name));
+        }
+        let address = module_address(name);
+        self.module_accounts.push(ModuleAccount { name: name.to_string(), address: address.clone(), blocked });
+        env::log_str(&format!("EVENT: module_account name={} address={} blocked={}", name, address, blocked));
+        Ok(address)
+    }
+
+    /// Address of the module account `name`
+    pub fn module_account(&self, name: &str) -> Option<AccountId> {
+        self.module_accounts.iter().find(|account| account.name == name).map(|account| account.address.clone())
+    }
+
+    pub fn get_module_accounts(&self) -> Vec<ModuleAccount> {
+        self.module_accounts.clone()
+    }
+
+    /// Whether user sends to `address` are refused
+    pub fn is_blocked(&self, address: &AccountId) -> bool {
+        self.module_accounts.iter().any(|account| account.blocked && &account.address == address)
+    }
+
+    /// Refuse a user send into a blocked module account
+    pub(super) fn check_receiver(&self, receiver: &AccountId) -> Result<(), String> {
+        if self.is_blocked(receiver) {
+            return Err(format!("{} is a module account and cannot receive transfers", receiver));
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::modules::bank::{Coin, Coins, MultiSend, SendEntry, SendRestriction};
+    use crate::Balance;
+    use near_sdk::test_utils::VMContextBuilder;
+    use near_sdk::testing_env;
+
+    struct AllowAll;
+
+    impl SendRestriction for AllowAll {
+        fn check_send(&self, _from: &AccountId, _to: &AccountId, _amount: Balance) -> Result<(), String> {
+            Ok(())
+        }
+    }
+
+    fn account(name: &str) -> AccountId {
+        name.parse().unwrap()
+    }
+
+    #[test]
+    fn test_user_sends_to_module_accounts_are_refused() {
+        testing_env!(VMContextBuilder::new().current_account_id(account("cosmos.testnet")).build());
+        let mut bank = BankModule::new();
+        let alice = account("alice.testnet");
+        bank.mint(&alice, 100);
+
+        let pool = bonded_pool_account();
+        assert_eq!(pool.as_str(), "bonded_tokens_pool.cosmos.testnet");
+        assert!(bank.send(&AllowAll, &alice, &pool, 10).unwrap_err().contains("module account"));
+        let fee_collector = bank.module_account(FEE_COLLECTOR_NAME).unwrap();
+        let send = MultiSend {
+            inputs: vec![SendEntry { address: alice.clone(), coins: Coins::new(vec![Coin::new("unear", 10)]).unwrap() }],
+            outputs: vec![SendEntry { address: fee_collector, coins: Coins::new(vec![Coin::new("unear", 10)]).unwrap() }],
+        };
+        assert!(bank.multi_send(&AllowAll, &send).is_err());
+        assert_eq!(bank.get_balance(&alice), 100);
+
+        // Modules still move tokens into their own accounts
+        bank.transfer_with_reason(&alice, &pool, 10, "staking", "delegate");
+        assert_eq!(bank.get_balance(&pool), 10);
+    }
+
+    #[test]
+    fn test_register_module_account() {
+        testing_env!(VMContextBuilder::new().current_account_id(account("cosmos.testnet")).build());
+        let mut bank = BankModule::new();
+        let distribution = bank.register_module_account("distribution", false).unwrap();
+        assert_eq!(distribution.as_str(), "distribution.cosmos.testnet");
+        assert!(!bank.is_blocked(&distribution));
+        assert!(bank.register_module_account("distribution", true).is_err());
+        assert!(bank.register_module_account(GOV_MODULE_NAME, true).is_err());
+        assert_eq!(bank.get_module_accounts().len(), default_module_accounts().len() + 1);
+    }
+}
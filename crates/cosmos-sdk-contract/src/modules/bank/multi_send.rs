@@ -0,0 +1,258 @@
+/// Multi-Send
+///
+/// `MsgMultiSend` moves coins from one or more inputs to any number of
+/// outputs in a single call, so a payroll-style payout does not need a
+/// transaction per receiver. The send is all-or-nothing: the inputs must add
+/// up to the outputs denom by denom, every input must hold what it gives
+/// and every pair must pass the send restriction and the `before_send`
+/// hooks before the first balance moves.
+///
+/// The ledger stays double-entry: coins are matched from inputs to outputs
+/// in order, denom by denom, and each match is booked as one transfer with
+/// the reason `multi_send`.
+
+use near_sdk::serde::{Deserialize, Serialize};
+use near_sdk::{env, AccountId};
+use schemars::JsonSchema;
+
+use super::{BankModule, Coin, Coins, SendRestriction};
+use crate::types::cosmos_messages::{self, MsgMultiSend};
+use crate::Balance;
+
+/// Inputs plus outputs a single multi-send may list
+pub const MAX_MULTI_SEND_ENTRIES: usize = 256;
+
+/// Account giving or receiving coins in a multi-send
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct SendEntry {
+    pub address: AccountId,
+    pub coins: Coins,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct MultiSend {
+    pub inputs: Vec<SendEntry>,
+    pub outputs: Vec<SendEntry>,
+}
+
+fn entry_from_msg(address: &str, coins: &[cosmos_messages::Coin]) -> Result<SendEntry, String> {
+    let address = address.parse().map_err(|_| format!("Invalid address {}", address))?;
+    let coins = coins.iter()
+        .map(|coin| {
+            let amount = coin.amount.parse::<Balance>()
+                .map_err(|_| format!("Invalid amount {} of {}", coin.amount, coin.denom))?;
+            Ok(Coin::new(coin.denom.clone(), amount))
+        })
+        .collect::<Result<Vec<Coin>, String>>()?;
+    Ok(SendEntry { address, coins: Coins::new(coins)? })
+}
+
+impl MultiSend {
+    pub fn from_msg(msg: &MsgMultiSend) -> Result<Self, String> {
+        Ok(Self {
+            inputs: msg.inputs.iter().map(|input| entry_from_msg(&input.address, &input.coins)).collect::<Result<_, _>>()?,
+            outputs: msg.outputs.iter().map(|output| entry_from_msg(&output.address, &output.coins)).collect::<Result<_, _>>()?,
+        })
+    }
+
+    /// Check the shape of the send, independent of any balance
+    pub fn validate(&self) -> Result<(), String> {
+        if self.inputs.is_empty() || self.outputs.is_empty() {
+            return Err("Multi-send needs at least one input and one output".to_string());
+        }
+        if self.inputs.len() + self.outputs.len() > MAX_MULTI_SEND_ENTRIES {
+            return Err(format!("Multi-send lists more than {} inputs and outputs", MAX_MULTI_SEND_ENTRIES));
+        }
+        for (index, input) in self.inputs.iter().enumerate() {
+            if input.coins.is_empty() {
+                return Err(format!("Input {} sends no coins", input.address));
+            }
+            if self.inputs[..index].iter().any(|other| other.address == input.address) {
+                return Err(format!("Input {} is listed more than once", input.address));
+            }
+        }
+        if let Some(output) = self.outputs.iter().find(|output| output.coins.is_empty()) {
+            return Err(format!("Output {} receives no coins", output.address));
+        }
+
+        let (total_in, total_out) = (Self::total(&self.inputs)?, Self::total(&self.outputs)?);
+        if total_in != total_out {
+            return Err(format!("Inputs {} do not match outputs {}", total_in, total_out));
+        }
+        Ok(())
+    }
+
+    fn total(entries: &[SendEntry]) -> Result<Coins, String> {
+        let mut total = Coins::default();
+        for coin in entries.iter().flat_map(|entry| entry.coins.iter()) {
+            total.add(coin.clone())?;
+        }
+        Ok(total)
+    }
+
+    /// Transfers that carry out the send: for each denom, inputs and
+    /// outputs are matched in the order they are listed
+    fn transfers(&self) -> Result<Vec<(AccountId, AccountId, Coin)>, String> {
+        let mut transfers = Vec::new();
+        for denom in Self::total(&self.inputs)?.denoms() {
+            let remaining = |entries: &[SendEntry]| -> Vec<(AccountId, Balance)> {
+                entries.iter()
+                    .map(|entry| (entry.address.clone(), entry.coins.amount_of(&denom)))
+                    .filter(|(_, amount)| *amount > 0)
+                    .collect()
+            };
+            let (mut inputs, mut outputs) = (remaining(&self.inputs), remaining(&self.outputs));
+            let (mut i, mut o) = (0, 0);
+            while i < inputs.len() && o < outputs.len() {
+                let amount = inputs[i].1.min(outputs[o].1);
+                transfers.push((inputs[i].0.clone(), outputs[o].0.clone(), Coin::new(denom.clone(), amount)));
+                inputs[i].1 -= amount;
+                outputs[o].1 -= amount;
+                if inputs[i].1 == 0 {
+                    i += 1;
+                }
+                if outputs[o].1 == 0 {
+                    o += 1;
+                }
+            }
+        }
+        Ok(transfers)
+    }
+}
+
+impl BankModule {
+    /// Send coins from every input to every output, or nothing at all
+    pub fn multi_send(&mut self, restriction: &dyn SendRestriction, send: &MultiSend) -> Result<(), String> {
+        send.validate()?;
+        for output in &send.outputs {
+            self.check_receiver(&output.address)?;
+        }
+        for denom in MultiSend::total(&send.inputs)?.denoms() {
+            self.check_send_enabled(&denom)?;
+        }
+        for input in &send.inputs {
+            for coin in input.coins.iter() {
+                self.check_spendable(&input.address, &coin.denom, coin.amount)?;
+            }
+        }
+
+        let transfers = send.transfers()?;
+        for (from, to, coin) in &transfers {
+            restriction.check_send(from, to, coin.amount)?;
+            self.before_send(from, to, coin)?;
+        }
+        for (from, to, coin) in &transfers {
+            self.move_denom(from, to, &coin.denom, coin.amount, "bank", "multi_send");
+        }
+
+        env::log_str(&format!(
+            "EVENT: multi_send inputs={} outputs={} transfers={} amount={}",
+            send.inputs.len(),
+            send.outputs.len(),
+            transfers.len(),
+            MultiSend::total(&send.inputs)?
+        ));
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::types::cosmos_messages::{Input, Output};
+    use near_sdk::test_utils::VMContextBuilder;
+    use near_sdk::testing_env;
+
+    /// Refuses sends to `blocked.near`
+    struct BlockList;
+
+    impl SendRestriction for BlockList {
+        fn check_send(&self, _from: &AccountId, to: &AccountId, _amount: Balance) -> Result<(), String> {
+            if to.as_str() == "blocked.near" {
+                return Err("Receiver is blocked".to_string());
+            }
+            Ok(())
+        }
+    }
+
+    fn account(name: &str) -> AccountId {
+        name.parse().unwrap()
+    }
+
+    fn entry(address: &str, coins: &[(&str, Balance)]) -> SendEntry {
+        let coins = coins.iter().map(|(denom, amount)| Coin::new(*denom, *amount)).collect();
+        SendEntry { address: account(address), coins: Coins::new(coins).unwrap() }
+    }
+
+    #[test]
+    fn test_payout_to_many_receivers() {
+        testing_env!(VMContextBuilder::new().build());
+        let mut bank = BankModule::new();
+        bank.mint(&account("payroll.near"), 1_000);
+        bank.mint(&account("treasury.near"), 50);
+        bank.mint_denom(&account("payroll.near"), "ibc/USDC", 300);
+
+        let send = MultiSend {
+            inputs: vec![
+                entry("payroll.near", &[("unear", 250), ("ibc/USDC", 300)]),
+                entry("treasury.near", &[("unear", 50)]),
+            ],
+            outputs: vec![
+                entry("alice.near", &[("unear", 200), ("ibc/USDC", 100)]),
+                entry("bob.near", &[("unear", 100), ("ibc/USDC", 200)]),
+            ],
+        };
+        bank.multi_send(&BlockList, &send).unwrap();
+
+        assert_eq!(bank.get_balance(&account("payroll.near")), 750);
+        assert_eq!(bank.get_balance(&account("treasury.near")), 0);
+        assert_eq!(bank.get_all_balances(account("alice.near")).to_string(), "100ibc/USDC,200unear");
+        assert_eq!(bank.get_all_balances(account("bob.near")).to_string(), "200ibc/USDC,100unear");
+        // payroll pays alice both denoms and bob USDC and 50 unear, treasury
+        // pays the rest of bob's unear
+        let entries = bank.export_ledger(None, 10).entries;
+        assert_eq!(entries.iter().filter(|entry| entry.reason == "multi_send").count(), 5);
+    }
+
+    #[test]
+    fn test_nothing_moves_on_failure() {
+        testing_env!(VMContextBuilder::new().build());
+        let mut bank = BankModule::new();
+        bank.mint(&account("payroll.near"), 100);
+        let outputs = |receiver: &str| vec![entry("alice.near", &[("unear", 60)]), entry(receiver, &[("unear", 40)])];
+
+        let blocked = MultiSend { inputs: vec![entry("payroll.near", &[("unear", 100)])], outputs: outputs("blocked.near") };
+        assert!(bank.multi_send(&BlockList, &blocked).unwrap_err().contains("blocked"));
+
+        let unbalanced = MultiSend { inputs: vec![entry("payroll.near", &[("unear", 90)])], outputs: outputs("bob.near") };
+        assert!(bank.multi_send(&BlockList, &unbalanced).unwrap_err().contains("do not match"));
+
+        let short = MultiSend { inputs: vec![entry("payroll.near", &[("unear", 100)])], outputs: outputs("bob.near") };
+        bank.burn(&account("payroll.near"), 1);
+        assert!(bank.multi_send(&BlockList, &short).unwrap_err().contains("Insufficient"));
+
+        assert_eq!(bank.get_balance(&account("payroll.near")), 99);
+        assert_eq!(bank.get_balance(&account("alice.near")), 0);
+    }
+
+    #[test]
+    fn test_from_msg() {
+        let msg = MsgMultiSend {
+            inputs: vec![Input {
+                address: "payroll.near".to_string(),
+                coins: vec![cosmos_messages::Coin { denom: "unear".to_string(), amount: "10".to_string() }],
+            }],
+            outputs: vec![Output {
+                address: "alice.near".to_string(),
+                coins: vec![cosmos_messages::Coin { denom: "unear".to_string(), amount: "10".to_string() }],
+            }],
+        };
+        let send = MultiSend::from_msg(&msg).unwrap();
+        assert!(send.validate().is_ok());
+        assert_eq!(send.outputs[0], entry("alice.near", &[("unear", 10)]));
+
+        let mut invalid = msg.clone();
+        invalid.inputs[0].coins[0].amount = "ten".to_string();
+        assert!(MultiSend::from_msg(&invalid).is_err());
+    }
+}
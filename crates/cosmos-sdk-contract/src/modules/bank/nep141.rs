@@ -0,0 +1,284 @@
+/// NEP-141 Facade
+///
+/// Exposes bank denoms through the NEAR fungible token standard so NEAR
+/// wallets and DEXes can show and move them like any other token. NEP-141
+/// has one token per contract account, so each exposed denom is mapped to a
+/// token account id; the bank contract serves the denom of its own account,
+/// the native one unless mapped otherwise. Balances stay in the bank: a
+/// facade transfer is a bank send with the same restrictions, and is logged
+/// as an `ft_transfer` NEP-297 event besides the bank's own logs.
+///
+/// NEP-145 storage registration is kept per denom. An account holding a
+/// balance of the denom counts as registered, since the bank already stores
+/// its entry.
+
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::json_types::U128;
+use near_sdk::serde::{Deserialize, Serialize};
+use near_sdk::serde_json::{json, Value};
+use near_sdk::{env, AccountId};
+use schemars::JsonSchema;
+
+use super::{validate_denom, BankModule, Coin, SendRestriction};
+use crate::Balance;
+
+/// Deposit for registering an account with a token, as NEP-145 requires
+pub const FT_STORAGE_DEPOSIT: Balance = 1_250_000_000_000_000_000_000;
+
+/// Denom exposed as a NEP-141 token
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct FtToken {
+    pub token_id: AccountId,
+    pub denom: String,
+}
+
+/// Paid registration of an account with the token of a denom
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct FtRegistration {
+    pub denom: String,
+    pub account: AccountId,
+}
+
+/// NEP-145 storage balance of an account
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct StorageBalance {
+    pub total: U128,
+    pub available: U128,
+}
+
+/// NEP-145 storage balance bounds
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct StorageBalanceBounds {
+    pub min: U128,
+    pub max: Option<U128>,
+}
+
+impl StorageBalanceBounds {
+    /// Registration costs a fixed deposit, nothing more can be stored
+    pub fn fixed() -> Self {
+        Self { min: U128(FT_STORAGE_DEPOSIT), max: Some(U128(FT_STORAGE_DEPOSIT)) }
+    }
+}
+
+/// Log a NEP-297 event for the nep141 standard
+pub fn emit_ft_event(event: &str, data: Value) {
+    let event = json!({
+        "standard": "nep141",
+        "version": "1.0.0",
+        "event": event,
+        "data": [data],
+    });
+    env::log_str(&format!("EVENT_JSON:{}", event));
+}
+
+fn transfer_event_data(from: &AccountId, to: &AccountId, amount: Balance, memo: Option<&str>) -> Value {
+    let mut data = json!({
+        "old_owner_id": from,
+        "new_owner_id": to,
+        "amount": amount.to_string(),
+    });
+    if let Some(memo) = memo {
+        data["memo"] = json!(memo);
+    }
+    data
+}
+
+impl BankModule {
+    /// Expose `denom` as the NEP-141 token `token_id`
+    pub fn register_ft_token(&mut self, token_id: AccountId, denom: String) -> Result<(), String> {
+        validate_denom(&denom)?;
+        if let Some(existing) = self.ft_tokens.get(&token_id) {
+            return Err(format!("Token {} already exposes {}", token_id, existing));
+        }
+        if let Some(existing) = self.ft_token(&denom) {
+            return Err(format!("Denom {} is already exposed as {}", denom, existing));
+        }
+        self.ft_tokens.insert(&token_id, &denom);
+        env::log_str(&format!("EVENT: ft_token token_id={} denom={}", token_id, denom));
+        Ok(())
+    }
+
+    /// Denom behind the token `token_id`
+    pub fn ft_denom(&self, token_id: &AccountId) -> Option<String> {
+        self.ft_tokens.get(token_id)
+    }
+
+    /// Token that exposes `denom`
+    pub fn ft_token(&self, denom: &str) -> Option<AccountId> {
+        self.ft_tokens.iter().find(|(_, mapped)| mapped == denom).map(|(token_id, _)| token_id)
+    }
+
+    pub fn get_ft_tokens(&self) -> Vec<FtToken> {
+        self.ft_tokens.iter().map(|(token_id, denom)| FtToken { token_id, denom }).collect()
+    }
+
+    /// Whether `account` paid for registration with the token of `denom`
+    pub fn ft_has_deposit(&self, denom: &str, account: &AccountId) -> bool {
+        self.ft_registrations.contains(&(denom.to_string(), account.clone()))
+    }
+
+    /// Whether `account` can receive the token of `denom`
+    pub fn ft_is_registered(&self, denom: &str, account: &AccountId) -> bool {
+        self.ft_has_deposit(denom, account) || self.get_denom_balance(account, denom) > 0
+    }
+
+    /// Record a paid registration, false if the account was registered
+    pub fn ft_register_account(&mut self, denom: &str, account: &AccountId) -> bool {
+        if self.ft_is_registered(denom, account) {
+            return false;
+        }
+        self.ft_registrations.insert(&(denom.to_string(), account.clone()))
+    }
+
+    /// Drop a paid registration, returning whether there was one whose
+    /// deposit is now due back
+    ///
+    /// With `force` the account's balance is burned, as NEP-145 specifies;
+    /// without it a positive balance is an error.
+    pub fn ft_unregister_account(&mut self, denom: &str, account: &AccountId, force: bool) -> Result<bool, String> {
+        if !self.ft_has_deposit(denom, account) {
+            return Ok(false);
+        }
+        let balance = self.get_denom_balance(account, denom);
+        if balance > 0 {
+            if !force {
+                return Err("Can't unregister the account with the positive balance without force".to_string());
+            }
+            self.burn_with_reason(account, denom, balance, "nep141", "ft_unregister");
+            emit_ft_event("ft_burn", json!({ "owner_id": account, "amount": balance.to_string() }));
+        }
+        self.ft_registrations.remove(&(denom.to_string(), account.clone()));
+        Ok(true)
+    }
+
+    /// NEP-141 `ft_transfer` of `denom`, checked like any user send
+    pub fn ft_transfer(
+        &mut self,
+        restriction: &dyn SendRestriction,
+        denom: &str,
+        sender: &AccountId,
+        receiver: &AccountId,
+        amount: Balance,
+        memo: Option<String>,
+    ) -> Result<(), String> {
+        if amount == 0 {
+            return Err("The amount should be a positive number".to_string());
+        }
+        if sender == receiver {
+            return Err("Sender and receiver should be different".to_string());
+        }
+        if !self.ft_is_registered(denom, receiver) {
+            return Err(format!("The account {} is not registered", receiver));
+        }
+        self.check_receiver(receiver)?;
+        self.check_send_enabled(denom)?;
+        restriction.check_send(sender, receiver, amount)?;
+        self.check_spendable(sender, denom, amount)?;
+        self.before_send(sender, receiver, &Coin::new(denom, amount))?;
+        self.move_denom(sender, receiver, denom, amount, "nep141", "ft_transfer");
+        emit_ft_event("ft_transfer", transfer_event_data(sender, receiver, amount, memo.as_deref()));
+        Ok(())
+    }
+
+    /// Settle an `ft_transfer_call` once the receiver reported `unused`,
+    /// returning the amount it kept
+    ///
+    /// The refund is capped by what the receiver still holds, it may have
+    /// moved the tokens on already.
+    pub fn ft_resolve_transfer(
+        &mut self,
+        denom: &str,
+        sender: &AccountId,
+        receiver: &AccountId,
+        amount: Balance,
+        unused: Balance,
+    ) -> Balance {
+        let refund = unused.min(amount).min(self.get_denom_balance(receiver, denom));
+        if refund > 0 {
+            self.move_denom(receiver, sender, denom, refund, "nep141", "ft_refund");
+            emit_ft_event("ft_transfer", transfer_event_data(receiver, sender, refund, Some("refund")));
+        }
+        amount - refund
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use near_sdk::test_utils::{get_logs, VMContextBuilder};
+    use near_sdk::testing_env;
+
+    struct NoRestriction;
+
+    impl SendRestriction for NoRestriction {
+        fn check_send(&self, _from: &AccountId, _to: &AccountId, _amount: Balance) -> Result<(), String> {
+            Ok(())
+        }
+    }
+
+    fn account(name: &str) -> AccountId {
+        name.parse().unwrap()
+    }
+
+    fn setup() -> BankModule {
+        testing_env!(VMContextBuilder::new().build());
+        let mut bank = BankModule::new();
+        bank.register_ft_token(account("usdc.bank.near"), "ibc/USDC".to_string()).unwrap();
+        bank.mint_denom(&account("alice.near"), "ibc/USDC", 100);
+        bank
+    }
+
+    #[test]
+    fn test_transfer_needs_registration() {
+        let mut bank = setup();
+        let (alice, bob) = (account("alice.near"), account("bob.near"));
+        assert!(bank.ft_transfer(&NoRestriction, "ibc/USDC", &alice, &bob, 10, None).unwrap_err().contains("not registered"));
+
+        assert!(bank.ft_register_account("ibc/USDC", &bob));
+        assert!(!bank.ft_register_account("ibc/USDC", &bob));
+        bank.ft_transfer(&NoRestriction, "ibc/USDC", &alice, &bob, 10, Some("invoice 7".to_string())).unwrap();
+        assert_eq!(bank.get_denom_balance(&bob, "ibc/USDC"), 10);
+
+        let event = get_logs().into_iter().rev().find(|log| log.starts_with("EVENT_JSON:")).unwrap();
+        let event: Value = serde_json::from_str(event.strip_prefix("EVENT_JSON:").unwrap()).unwrap();
+        assert_eq!(event["standard"], "nep141");
+        assert_eq!(event["data"][0]["amount"], "10");
+        assert_eq!(event["data"][0]["memo"], "invoice 7");
+
+        // Holding a balance counts as registration
+        bank.ft_transfer(&NoRestriction, "ibc/USDC", &bob, &alice, 5, None).unwrap();
+        assert!(bank.ft_transfer(&NoRestriction, "ibc/USDC", &alice, &bob, 1_000, None).is_err());
+    }
+
+    #[test]
+    fn test_resolve_refunds_unused_tokens() {
+        let mut bank = setup();
+        let (alice, dex) = (account("alice.near"), account("dex.near"));
+        bank.ft_register_account("ibc/USDC", &dex);
+        bank.ft_transfer(&NoRestriction, "ibc/USDC", &alice, &dex, 40, None).unwrap();
+
+        assert_eq!(bank.ft_resolve_transfer("ibc/USDC", &alice, &dex, 40, 15), 25);
+        assert_eq!(bank.get_denom_balance(&alice, "ibc/USDC"), 75);
+        // The receiver spent more than it reported as used
+        bank.transfer_denom(&dex, &account("carol.near"), "ibc/USDC", 20);
+        assert_eq!(bank.ft_resolve_transfer("ibc/USDC", &alice, &dex, 40, 40), 35);
+        assert_eq!(bank.get_denom_balance(&dex, "ibc/USDC"), 0);
+    }
+
+    #[test]
+    fn test_token_mapping_and_unregistration() {
+        let mut bank = setup();
+        assert_eq!(bank.ft_denom(&account("usdc.bank.near")), Some("ibc/USDC".to_string()));
+        assert_eq!(bank.ft_token("ibc/USDC"), Some(account("usdc.bank.near")));
+        assert!(bank.register_ft_token(account("usdc2.bank.near"), "ibc/USDC".to_string()).is_err());
+        assert!(bank.register_ft_token(account("usdc.bank.near"), "ibc/ATOM".to_string()).is_err());
+
+        let bob = account("bob.near");
+        bank.ft_register_account("ibc/USDC", &bob);
+        bank.ft_transfer(&NoRestriction, "ibc/USDC", &account("alice.near"), &bob, 10, None).unwrap();
+        assert!(bank.ft_unregister_account("ibc/USDC", &bob, false).is_err());
+        assert_eq!(bank.ft_unregister_account("ibc/USDC", &bob, true), Ok(true));
+        assert_eq!(bank.supply_of("ibc/USDC"), 90);
+        assert_eq!(bank.ft_unregister_account("ibc/USDC", &bob, true), Ok(false));
+    }
+}
@@ -0,0 +1,197 @@
+/// Ledger Replay
+///
+/// The balance ledger journals every mutation, so the bank's state can be
+/// rebuilt from it: start from the genesis balances, apply each entry in id
+/// order to a fresh `BankModule` and compare the `state_root` of the result
+/// with the one the live contract reports. A mismatch means the contract
+/// wrote balances the ledger does not account for, through storage
+/// corruption or logic that does not run the same way twice.
+///
+/// The `replay` example drives this against a deployed bank contract.
+
+use near_sdk::serde::{Deserialize, Serialize};
+use near_sdk::AccountId;
+use schemars::JsonSchema;
+
+use super::diff::balance_key;
+use super::{BankModule, LedgerEntry};
+use crate::modules::block::merkle_root;
+use crate::Balance;
+
+/// Storage prefix of the replayed bank, kept apart from the live one
+pub const REPLAY_PREFIX: &[u8] = b"replay/";
+
+/// Outcome of replaying a ledger against an expected state root
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct ReplayReport {
+    pub replayed: u64,
+    pub last_id: Option<u64>,
+    /// Hex encoded state root of the replayed bank
+    pub state_root: String,
+    pub expected_state_root: String,
+    pub matches: bool,
+}
+
+impl BankModule {
+    /// Commitment to every balance and supply entry
+    ///
+    /// Unlike `store_hash`, which only covers the supply, this root changes
+    /// with any balance, so two banks with the same root hold the same state.
+    pub fn state_root(&self) -> String {
+        let mut leaves: Vec<(Vec<u8>, Balance)> = self.balances.iter()
+            .map(|((account, denom), amount)| (balance_key(account.as_str(), &denom).into_bytes(), amount))
+            .chain(self.supply.iter().map(|(denom, amount)| ([b"supply/".as_slice(), denom.as_bytes()].concat(), amount)))
+            .collect();
+        leaves.sort();
+
+        let leaves: Vec<Vec<u8>> = leaves.into_iter()
+            .map(|(key, amount)| [key, amount.to_be_bytes().to_vec()].concat())
+            .collect();
+        hex::encode(merkle_root(&leaves))
+    }
+
+    /// Apply one journaled mutation
+    fn apply_ledger_entry(&mut self, entry: &LedgerEntry) -> Result<(), String> {
+        let parse = |account: &str| -> Result<AccountId, String> {
+            account.parse().map_err(|_| format!("Entry {} names invalid account {}", entry.id, account))
+        };
+        match (&entry.debit, &entry.credit) {
+            (None, Some(credit)) => {
+                self.mint_with_reason(&parse(credit)?, &entry.denom, entry.amount, &entry.module, &entry.reason);
+            }
+            (Some(debit), credit) => {
+                let debit = parse(debit)?;
+                let held = self.get_denom_balance(&debit, &entry.denom);
+                if held < entry.amount {
+                    return Err(format!(
+                        "Entry {} debits {} from {} which holds {}",
+                        entry.id, entry.amount, debit, held
+                    ));
+                }
+                match credit {
+                    Some(credit) => self.transfer_denom_with_reason(
+                        &debit,
+                        &parse(credit)?,
+                        &entry.denom,
+                        entry.amount,
+                        &entry.module,
+                        &entry.reason,
+                    ),
+                    None => self.burn_with_reason(&debit, &entry.denom, entry.amount, &entry.module, &entry.reason),
+                }
+            }
+            (None, None) => return Err(format!("Entry {} has neither a debit nor a credit", entry.id)),
+        }
+        Ok(())
+    }
+}
+
+/// Rebuild a bank from genesis balances and the ledger that followed
+///
+/// Entries must be contiguous and in id order; a gap means part of the
+/// journal is missing and the result could not be trusted. The replayed
+/// bank lives under `REPLAY_PREFIX` and journals its own ledger there.
+pub fn replay_ledger(genesis_balances: &[(String, Balance)], entries: &[LedgerEntry]) -> Result<BankModule, String> {
+    let mut bank = BankModule::with_prefix(REPLAY_PREFIX);
+    // Start from empty even if an earlier replay ran in the same storage
+    let accounts: Vec<AccountId> = bank.balances.keys().map(|(account, _)| account).collect();
+    for account in &accounts {
+        bank.account_denoms.remove(account);
+    }
+    bank.balances.clear();
+    bank.supply.clear();
+    for (account, amount) in genesis_balances {
+        let account: AccountId = account.parse().map_err(|_| format!("Invalid genesis account {}", account))?;
+        let denom = bank.native_denom().to_string();
+        bank.mint_with_reason(&account, &denom, *amount, "bank", "genesis");
+    }
+
+    let mut expected_id = entries.first().map(|entry| entry.id);
+    for entry in entries {
+        if Some(entry.id) != expected_id {
+            return Err(format!("Ledger gap: expected entry {:?}, found {}", expected_id, entry.id));
+        }
+        bank.apply_ledger_entry(entry)?;
+        expected_id = Some(entry.id + 1);
+    }
+    Ok(bank)
+}
+
+/// Replay and compare the result with the live contract's state root
+pub fn replay_and_compare(
+    genesis_balances: &[(String, Balance)],
+    entries: &[LedgerEntry],
+    expected_state_root: &str,
+) -> Result<ReplayReport, String> {
+    let bank = replay_ledger(genesis_balances, entries)?;
+    let state_root = bank.state_root();
+    Ok(ReplayReport {
+        replayed: entries.len() as u64,
+        last_id: entries.last().map(|entry| entry.id),
+        matches: state_root == expected_state_root,
+        state_root,
+        expected_state_root: expected_state_root.to_string(),
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use near_sdk::test_utils::VMContextBuilder;
+    use near_sdk::testing_env;
+
+    fn account(name: &str) -> AccountId {
+        name.parse().unwrap()
+    }
+
+    fn export(bank: &BankModule) -> Vec<LedgerEntry> {
+        let mut entries = Vec::new();
+        let mut from_id = None;
+        loop {
+            let page = bank.export_ledger(from_id, 2);
+            entries.extend(page.entries);
+            match page.next_from_id {
+                Some(next) => from_id = Some(next),
+                None => return entries,
+            }
+        }
+    }
+
+    #[test]
+    fn test_replay_reproduces_state_root() {
+        testing_env!(VMContextBuilder::new().build());
+        let mut live = BankModule::new();
+        live.mint(&account("alice.near"), 100);
+        live.transfer_with_reason(&account("alice.near"), &account("bob.near"), 40, "staking", "delegate");
+        live.burn(&account("bob.near"), 10);
+        live.mint_denom(&account("carol.near"), "ibc/ABC", 5);
+        let entries = export(&live);
+        let live_root = live.state_root();
+
+        let report = replay_and_compare(&[], &entries, &live_root).unwrap();
+        assert_eq!(report.replayed, 4);
+        assert_eq!(report.last_id, Some(3));
+        assert!(report.matches);
+    }
+
+    #[test]
+    fn test_replay_detects_divergence() {
+        testing_env!(VMContextBuilder::new().build());
+        let mut live = BankModule::new();
+        live.mint(&account("alice.near"), 100);
+        live.transfer(&account("alice.near"), &account("bob.near"), 40);
+        let entries = export(&live);
+        let live_root = live.state_root();
+        assert!(replay_and_compare(&[], &entries, &live_root).unwrap().matches);
+
+        let mut tampered = entries.clone();
+        tampered[1].amount = 41;
+        assert!(!replay_and_compare(&[], &tampered, &live_root).unwrap().matches);
+
+        tampered[1].amount = 400;
+        assert!(replay_ledger(&[], &tampered).unwrap_err().contains("debits 400"));
+
+        let gap = vec![entries[0].clone(), LedgerEntry { id: 5, ..entries[1].clone() }];
+        assert!(replay_ledger(&[], &gap).unwrap_err().contains("Ledger gap"));
+    }
+}
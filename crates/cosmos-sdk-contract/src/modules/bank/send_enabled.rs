@@ -0,0 +1,224 @@
+/// Send Enabled Flags
+///
+/// Governance can stop user sends of a single denom, e.g. to freeze a
+/// bridged denom whose source chain was compromised, without halting the
+/// contract. As in `x/bank`, each denom may carry its own flag and denoms
+/// without one follow `default_send_enabled`. Transfers and multi-sends
+/// check the flag of every denom they move; mints, burns and the internal
+/// transfers of other modules are not affected.
+///
+/// Flags change through the `SetSendEnabled` content of the `bank`
+/// governance route.
+
+use near_sdk::env;
+use near_sdk::serde::{Deserialize, Serialize};
+use schemars::JsonSchema;
+
+use super::{validate_denom, BankModule};
+use crate::modules::gov::{ProposalContent, ProposalHandler};
+
+/// Governance route of bank proposals
+pub const BANK_PROPOSAL_ROUTE: &str = "bank";
+/// Proposal type whose content is a JSON `SetSendEnabled`
+pub const SET_SEND_ENABLED: &str = "SetSendEnabled";
+
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct SendEnabled {
+    pub denom: String,
+    pub enabled: bool,
+}
+
+/// Change to the send enabled flags, as `MsgSetSendEnabled`
+#[derive(Serialize, Deserialize, Clone, Debug, Default, PartialEq, JsonSchema)]
+pub struct SetSendEnabled {
+    /// Flags to set, overriding the default for their denoms
+    #[serde(default)]
+    pub send_enabled: Vec<SendEnabled>,
+    /// Denoms whose flag is dropped, so they follow the default again
+    #[serde(default)]
+    pub use_default_for: Vec<String>,
+    /// New default for denoms without a flag
+    #[serde(default)]
+    pub default_send_enabled: Option<bool>,
+}
+
+impl SetSendEnabled {
+    pub fn from_content(content: &ProposalContent) -> Result<Self, String> {
+        if content.proposal_type != SET_SEND_ENABLED {
+            return Err(format!("Unknown bank proposal type {}", content.proposal_type));
+        }
+        serde_json::from_str(&content.value).map_err(|e| format!("Invalid send enabled change: {}", e))
+    }
+
+    pub fn validate(&self) -> Result<(), String> {
+        let denoms: Vec<&String> = self.send_enabled.iter().map(|flag| &flag.denom).chain(&self.use_default_for).collect();
+        if denoms.is_empty() && self.default_send_enabled.is_none() {
+            return Err("Send enabled change changes nothing".to_string());
+        }
+        for (index, denom) in denoms.iter().enumerate() {
+            validate_denom(denom)?;
+            if denoms[..index].contains(denom) {
+                return Err(format!("Denom {} is listed more than once", denom));
+            }
+        }
+        Ok(())
+    }
+}
+
+impl BankModule {
+    /// Whether user sends of `denom` are allowed
+    pub fn is_send_enabled(&self, denom: &str) -> bool {
+        self.send_enabled.get(&denom.to_string()).unwrap_or(self.default_send_enabled)
+    }
+
+    pub fn default_send_enabled(&self) -> bool {
+        self.default_send_enabled
+    }
+
+    /// Denoms with a flag of their own, in insertion order
+    pub fn get_send_enabled(&self) -> Vec<SendEnabled> {
+        self.send_enabled.iter().map(|(denom, enabled)| SendEnabled { denom, enabled }).collect()
+    }
+
+    pub fn set_send_enabled(&mut self, change: &SetSendEnabled) -> Result<(), String> {
+        change.validate()?;
+        if let Some(enabled) = change.default_send_enabled {
+            self.default_send_enabled = enabled;
+            env::log_str(&format!("EVENT: send_enabled denom=* enabled={}", enabled));
+        }
+        for flag in &change.send_enabled {
+            self.send_enabled.insert(&flag.denom, &flag.enabled);
+            env::log_str(&format!("EVENT: send_enabled denom={} enabled={}", flag.denom, flag.enabled));
+        }
+        for denom in &change.use_default_for {
+            self.send_enabled.remove(denom);
+            env::log_str(&format!("EVENT: send_enabled denom={} enabled=default", denom));
+        }
+        Ok(())
+    }
+
+    /// Refuse a user send of a disabled denom
+    pub(super) fn check_send_enabled(&self, denom: &str) -> Result<(), String> {
+        if !self.is_send_enabled(denom) {
+            return Err(format!("Sends of {} are disabled", denom));
+        }
+        Ok(())
+    }
+}
+
+impl ProposalHandler for BankModule {
+    fn validate_content(&self, content: &ProposalContent) -> Result<(), String> {
+        SetSendEnabled::from_content(content)?.validate()
+    }
+
+    fn execute_content(&mut self, _proposal_id: u64, content: &ProposalContent) -> Result<(), String> {
+        self.set_send_enabled(&SetSendEnabled::from_content(content)?)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::modules::bank::{Coin, Coins, MultiSend, SendEntry, SendRestriction};
+    use crate::modules::gov::{GovernanceModule, ProposalRouter};
+    use crate::Balance;
+    use near_sdk::test_utils::VMContextBuilder;
+    use near_sdk::{testing_env, AccountId};
+
+    struct AllowAll;
+
+    impl SendRestriction for AllowAll {
+        fn check_send(&self, _from: &AccountId, _to: &AccountId, _amount: Balance) -> Result<(), String> {
+            Ok(())
+        }
+    }
+
+    fn account(name: &str) -> AccountId {
+        name.parse().unwrap()
+    }
+
+    fn freeze(denom: &str) -> SetSendEnabled {
+        SetSendEnabled {
+            send_enabled: vec![SendEnabled { denom: denom.to_string(), enabled: false }],
+            ..Default::default()
+        }
+    }
+
+    #[test]
+    fn test_frozen_denom_cannot_be_sent() {
+        testing_env!(VMContextBuilder::new().build());
+        let mut bank = BankModule::new();
+        let (alice, bob) = (account("alice.near"), account("bob.near"));
+        bank.mint(&alice, 100);
+        bank.mint_denom(&alice, "ibc/USDC", 100);
+        bank.set_send_enabled(&freeze("ibc/USDC")).unwrap();
+
+        let coins = |denom: &str| Coins::new(vec![Coin::new(denom, 10)]).unwrap();
+        let send = |denom: &str| MultiSend {
+            inputs: vec![SendEntry { address: alice.clone(), coins: coins(denom) }],
+            outputs: vec![SendEntry { address: bob.clone(), coins: coins(denom) }],
+        };
+        assert_eq!(bank.multi_send(&AllowAll, &send("ibc/USDC")).unwrap_err(), "Sends of ibc/USDC are disabled");
+        bank.multi_send(&AllowAll, &send("unear")).unwrap();
+        bank.send(&AllowAll, &alice, &bob, 10).unwrap();
+
+        // Disabling by default leaves denoms with their own flag alone
+        bank.set_send_enabled(&SetSendEnabled {
+            send_enabled: vec![SendEnabled { denom: "ibc/USDC".to_string(), enabled: true }],
+            default_send_enabled: Some(false),
+            ..Default::default()
+        }).unwrap();
+        assert!(bank.send(&AllowAll, &alice, &bob, 10).is_err());
+        bank.multi_send(&AllowAll, &send("ibc/USDC")).unwrap();
+
+        // Mints and module transfers are not user sends
+        bank.mint(&alice, 5);
+        bank.transfer_with_reason(&alice, &bob, 5, "staking", "delegate");
+        assert_eq!(bank.get_balance(&bob), 25);
+    }
+
+    #[test]
+    fn test_change_through_governance() {
+        testing_env!(VMContextBuilder::new().build());
+        let mut bank = BankModule::new();
+        let mut gov = GovernanceModule::new();
+        let content = ProposalContent {
+            route: BANK_PROPOSAL_ROUTE.to_string(),
+            proposal_type: SET_SEND_ENABLED.to_string(),
+            value: serde_json::to_string(&freeze("ibc/USDC")).unwrap(),
+        };
+        let proposal_id = {
+            let mut router = ProposalRouter::new();
+            router.add_route(BANK_PROPOSAL_ROUTE, &mut bank).unwrap();
+            gov.submit_content_proposal(
+                &account("alice.near"),
+                "Freeze USDC".to_string(),
+                "The USDC bridge was compromised".to_string(),
+                content,
+                &mut router,
+                String::new(),
+                None,
+                10,
+            )
+        };
+        gov.vote(&account("alice.near"), proposal_id, 1, String::new());
+        gov.vote(&account("bob.near"), proposal_id, 1, String::new());
+        gov.end_block(100);
+        assert!(bank.is_send_enabled("ibc/USDC"));
+
+        let mut router = ProposalRouter::new();
+        router.add_route(BANK_PROPOSAL_ROUTE, &mut bank).unwrap();
+        assert!(gov.execute_approved_content(&mut router)[0].1.is_ok());
+        assert!(!bank.is_send_enabled("ibc/USDC"));
+        assert!(bank.is_send_enabled("unear"));
+    }
+
+    #[test]
+    fn test_change_validation() {
+        assert!(SetSendEnabled::default().validate().is_err());
+        assert!(freeze("u near").validate().is_err());
+        let mut twice = freeze("ibc/USDC");
+        twice.use_default_for.push("ibc/USDC".to_string());
+        assert!(twice.validate().is_err());
+    }
+}
@@ -0,0 +1,203 @@
+/// Total Supply Commitments
+///
+/// The bank commits to the total supply of every denom with a simple merkle
+/// tree over `supply/<denom> || amount` leaves, amounts as 16 byte big
+/// endian integers. The root is the bank's store hash in the block app hash,
+/// so a bridge that follows this chain's headers can check the circulating
+/// supply of a voucher denom with two proofs: supply entry to bank store
+/// hash, then bank store hash to app hash.
+
+use near_sdk::env;
+use near_sdk::serde::{Deserialize, Serialize};
+use schemars::JsonSchema;
+
+use super::{BankModule, Coin, Coins};
+use crate::modules::block::{
+    merkle_existence_proof, merkle_root, verify_merkle_existence, BlockModule, QueryEnvelope, QueryProof,
+};
+use crate::modules::ibc::client::tendermint::ics23::CommitmentProof;
+use crate::Balance;
+
+/// Name of the bank store in the app hash
+pub const BANK_STORE: &str = "bank";
+
+/// Store key of a denom's supply
+pub fn supply_key(denom: &str) -> Vec<u8> {
+    [b"supply/".as_slice(), denom.as_bytes()].concat()
+}
+
+/// Proof of a denom's supply under the bank store hash
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct SupplyProof {
+    pub denom: String,
+    pub amount: Balance,
+    /// Hex encoded bank store hash the proof leads to
+    pub store_hash: String,
+    pub proof: CommitmentProof,
+}
+
+impl SupplyProof {
+    pub fn verify(&self) -> bool {
+        let value_matches = self.proof.proof.as_ref()
+            .map_or(false, |exist| exist.value == self.amount.to_be_bytes());
+        value_matches && verify_merkle_existence(&self.proof, &supply_key(&self.denom), &self.store_hash)
+    }
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct SupplyOfResponse {
+    pub denom: String,
+    pub amount: Balance,
+}
+
+impl SupplyOfResponse {
+    /// Check that the envelope proof commits this supply in the bank store
+    pub fn verify(&self, proof: &QueryProof) -> bool {
+        proof.store == BANK_STORE && proof.verify(&supply_key(&self.denom), &self.amount.to_be_bytes())
+    }
+}
+
+impl BankModule {
+    pub fn supply_of(&self, denom: &str) -> Balance {
+        self.supply.get(&denom.to_string()).unwrap_or(0)
+    }
+
+    /// Supply of every denom in circulation
+    pub fn total_supply(&self) -> Coins {
+        let mut coins: Vec<Coin> = self.supply.iter().map(|(denom, amount)| Coin { denom, amount }).collect();
+        coins.sort_by(|a, b| a.denom.cmp(&b.denom));
+        Coins::from_sorted(coins)
+    }
+
+    pub(super) fn increase_supply(&mut self, denom: &str, amount: Balance) {
+        let supply = self.supply_of(denom);
+        let supply = supply.checked_add(amount)
+            .unwrap_or_else(|| env::panic_str(&format!("Supply of {} overflows", denom)));
+        self.supply.insert(&denom.to_string(), &supply);
+    }
+
+    /// Burnt tokens always came out of a balance, so the supply covers them
+    pub(super) fn decrease_supply(&mut self, denom: &str, amount: Balance) {
+        let supply = self.supply_of(denom).checked_sub(amount)
+            .unwrap_or_else(|| env::panic_str(&format!("Burning {} exceeds the supply of {}", amount, denom)));
+        if supply == 0 {
+            self.supply.remove(&denom.to_string());
+        } else {
+            self.supply.insert(&denom.to_string(), &supply);
+        }
+    }
+
+    /// Supply entries as `(key, amount)` sorted by key, as committed
+    fn supply_entries(&self) -> Vec<(Vec<u8>, Vec<u8>)> {
+        let mut entries: Vec<(Vec<u8>, Vec<u8>)> = self.supply.iter()
+            .map(|(denom, amount)| (supply_key(&denom), amount.to_be_bytes().to_vec()))
+            .collect();
+        entries.sort();
+        entries
+    }
+
+    /// Commitment the bank reports as its store hash
+    pub fn store_hash(&self) -> Vec<u8> {
+        let leaves: Vec<Vec<u8>> = self.supply_entries()
+            .into_iter()
+            .map(|(key, value)| [key, value].concat())
+            .collect();
+        merkle_root(&leaves)
+    }
+
+    /// Proof of the current supply of `denom` under `store_hash`
+    pub fn prove_supply(&self, denom: &str) -> Result<SupplyProof, String> {
+        let entries = self.supply_entries();
+        let index = entries.iter()
+            .position(|(key, _)| key == &supply_key(denom))
+            .ok_or_else(|| format!("No supply of {}", denom))?;
+
+        Ok(SupplyProof {
+            denom: denom.to_string(),
+            amount: self.supply_of(denom),
+            store_hash: hex::encode(self.store_hash()),
+            proof: merkle_existence_proof(&entries, index),
+        })
+    }
+
+    /// Supply of `denom` with, when `prove` is set, a proof up to the latest
+    /// committed app hash
+    ///
+    /// Fails with `prove` if the supply changed since the last commit, since
+    /// the current state could not be proven against any header yet.
+    pub fn query_supply_of(
+        &self,
+        denom: &str,
+        blocks: &BlockModule,
+        prove: bool,
+    ) -> Result<QueryEnvelope<SupplyOfResponse>, String> {
+        let response = SupplyOfResponse {
+            denom: denom.to_string(),
+            amount: self.supply_of(denom),
+        };
+        blocks.query_envelope(BANK_STORE, &supply_key(denom), response, prove, || self.supply_entries())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use near_sdk::test_utils::VMContextBuilder;
+    use near_sdk::{testing_env, AccountId};
+
+    #[test]
+    fn test_burn_reduces_supply() {
+        testing_env!(VMContextBuilder::new().build());
+        let alice: AccountId = "alice.near".parse().unwrap();
+        let mut bank = BankModule::new();
+        bank.mint(&alice, 1_000);
+
+        // Locked coins cannot be burned
+        bank.lock_coins(&alice, "unear", 200, "vesting", None).unwrap();
+        assert!(bank.check_spendable(&alice, "unear", 900).unwrap_err().contains("800unear spendable"));
+        bank.check_spendable(&alice, "unear", 300).unwrap();
+        bank.burn_denom(&alice, "unear", 300);
+        assert_eq!(bank.supply_of("unear"), 700);
+
+        // Other denoms are burnt from their own balance
+        assert!(bank.check_spendable(&alice, "ibc/ATOM", 1).unwrap_err().contains("has 0ibc/ATOM"));
+        assert_eq!(bank.total_supply().into_vec(), vec![Coin::new("unear", 700)]);
+    }
+
+    #[test]
+    fn test_supply_proof_links_to_app_hash() {
+        testing_env!(VMContextBuilder::new().block_height(20).build());
+        let alice: AccountId = "alice.near".parse().unwrap();
+
+        let mut bank = BankModule::new();
+        bank.mint(&alice, 1_000);
+        bank.mint_denom(&alice, "ibc/ATOM", 500);
+        bank.mint_denom(&alice, "ibc/OSMO", 70);
+        bank.burn_denom(&alice, "ibc/ATOM", 100);
+        assert_eq!(bank.get_total_supply("ibc/ATOM".to_string()), 400);
+        assert_eq!(bank.total_supply().to_string(), "400ibc/ATOM,70ibc/OSMO,1000unear");
+        bank.burn_denom(&alice, "ibc/OSMO", 70);
+        assert_eq!(bank.total_supply().denoms(), vec!["ibc/ATOM".to_string(), "unear".to_string()]);
+
+        let mut blocks = BlockModule::new("proxima-testnet".to_string());
+        blocks.commit_block(&[
+            (BANK_STORE.to_string(), bank.store_hash()),
+            ("staking".to_string(), vec![7u8; 32]),
+        ], &[]).unwrap();
+
+        let envelope = bank.query_supply_of("ibc/ATOM", &blocks, true).unwrap();
+        assert_eq!(envelope.height, 20);
+        assert_eq!(envelope.value.amount, 400);
+        assert!(envelope.value.verify(envelope.proof.as_ref().unwrap()));
+
+        let mut forged = envelope.value.clone();
+        forged.amount = 4_000;
+        assert!(!forged.verify(envelope.proof.as_ref().unwrap()));
+        assert!(bank.prove_supply("ibc/ATOM").unwrap().verify());
+
+        // State past the last commit cannot be proven
+        bank.mint_denom(&alice, "ibc/ATOM", 1);
+        assert!(bank.query_supply_of("ibc/ATOM", &blocks, true).unwrap_err().contains("changed since height 20"));
+        assert_eq!(bank.query_supply_of("ibc/ATOM", &blocks, false).unwrap().value.amount, 401);
+    }
+}
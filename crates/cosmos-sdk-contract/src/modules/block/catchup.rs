@@ -0,0 +1,189 @@
+/// Missed Block Catch-Up
+///
+/// Block processing is driven by outside calls, so NEAR can produce many
+/// blocks between two of them. Every logical height still has to run its
+/// begin and end block logic, otherwise voting periods and unbonding
+/// timelines that are counted in heights would slip. `process_blocks` walks
+/// the missed heights in order, at most `MAX_BLOCKS_PER_CALL` per call so a
+/// long gap cannot exhaust the gas of a single transaction, and keeps a
+/// cursor so the next call continues where this one stopped.
+
+use near_sdk::env;
+use near_sdk::serde::{Deserialize, Serialize};
+use schemars::JsonSchema;
+
+use super::BlockModule;
+use crate::handler::telemetry::{measure, NoopTelemetry, TelemetryHooks};
+use crate::modules::gov::GovernanceModule;
+use crate::modules::staking::StakingModule;
+
+/// Heights processed by a single call at most
+pub const MAX_BLOCKS_PER_CALL: u64 = 50;
+
+/// Outcome of a `process_blocks` call
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct CatchUpProgress {
+    /// First height processed, 0 if there was nothing to do
+    pub from_height: u64,
+    /// Last height processed, the new cursor
+    pub to_height: u64,
+    pub processed: u64,
+    /// Heights still behind the current NEAR block
+    pub remaining: u64,
+}
+
+impl BlockModule {
+    /// Last logical height whose block logic ran
+    pub fn processed_height(&self) -> u64 {
+        self.processed_height
+    }
+
+    /// Heights up to `current_height` that have not been processed yet
+    pub fn pending_heights(&self, current_height: u64) -> u64 {
+        if self.processed_height == 0 {
+            // Nothing to catch up before the first processed block
+            return current_height.min(1);
+        }
+        current_height.saturating_sub(self.processed_height)
+    }
+
+    /// Run begin and end block logic for up to `n` missed heights, oldest
+    /// first, up to the current NEAR block
+    pub fn process_blocks(
+        &mut self,
+        n: u64,
+        staking: &mut StakingModule,
+        gov: &mut GovernanceModule,
+    ) -> CatchUpProgress {
+        self.process_blocks_until(n, staking, gov, &mut NoopTelemetry, |_, _| true)
+    }
+
+    /// `process_blocks`, reporting each module's end block to `telemetry`
+    pub fn process_blocks_with_telemetry(
+        &mut self,
+        n: u64,
+        staking: &mut StakingModule,
+        gov: &mut GovernanceModule,
+        telemetry: &mut dyn TelemetryHooks,
+    ) -> CatchUpProgress {
+        self.process_blocks_until(n, staking, gov, telemetry, |_, _| true)
+    }
+
+    /// `process_blocks`, asking `after_block` whether to go on after each
+    /// height; a height it rejects still counts as processed
+    pub(super) fn process_blocks_until(
+        &mut self,
+        n: u64,
+        staking: &mut StakingModule,
+        gov: &mut GovernanceModule,
+        telemetry: &mut dyn TelemetryHooks,
+        mut after_block: impl FnMut(u64, &StakingModule) -> bool,
+    ) -> CatchUpProgress {
+        let current_height = env::block_height();
+        let pending = self.pending_heights(current_height);
+        let count = n.min(MAX_BLOCKS_PER_CALL).min(pending);
+        if count == 0 {
+            return CatchUpProgress {
+                from_height: 0,
+                to_height: self.processed_height,
+                processed: 0,
+                remaining: pending,
+            };
+        }
+
+        let from_height = current_height - pending + 1;
+        let mut to_height = from_height;
+        for height in from_height..from_height + count {
+            staking.begin_block(height);
+            let (_, gov_gas) = measure(|| gov.end_block(height));
+            telemetry.on_end_blocker("gov", height, gov_gas);
+            let (_, staking_gas) = measure(|| staking.end_block(height));
+            telemetry.on_end_blocker("staking", height, staking_gas);
+            to_height = height;
+            if !after_block(height, staking) {
+                break;
+            }
+        }
+        self.processed_height = to_height;
+
+        let processed = to_height - from_height + 1;
+        let remaining = pending - processed;
+        env::log_str(&format!(
+            "EVENT: process_blocks from={} to={} remaining={}",
+            from_height, to_height, remaining
+        ));
+        CatchUpProgress { from_height, to_height, processed, remaining }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::modules::gov::ProposalStatus;
+    use near_sdk::test_utils::VMContextBuilder;
+    use near_sdk::{testing_env, AccountId};
+
+    fn at_height(height: u64) {
+        testing_env!(VMContextBuilder::new().block_height(height).build());
+    }
+
+    #[test]
+    fn test_catch_up_is_bounded_and_resumes() {
+        let mut blocks = BlockModule::new("proxima-testnet".to_string());
+        let mut staking = StakingModule::new();
+        let mut gov = GovernanceModule::new();
+        let alice: AccountId = "alice.near".parse().unwrap();
+
+        at_height(10);
+        assert_eq!(blocks.process_blocks(5, &mut staking, &mut gov).to_height, 10);
+
+        // Voting ends at height 110
+        let proposal_id = gov.submit_proposal(
+            &alice,
+            "Raise rewards".to_string(),
+            "Raise the reward rate".to_string(),
+            "reward_rate".to_string(),
+            "6".to_string(),
+            String::new(),
+            None,
+            60,
+        );
+        gov.vote(&alice, proposal_id, 1, String::new());
+        gov.vote(&"bob.near".parse().unwrap(), proposal_id, 1, String::new());
+
+        at_height(200);
+        let progress = blocks.process_blocks(1_000, &mut staking, &mut gov);
+        assert_eq!(progress, CatchUpProgress {
+            from_height: 11,
+            to_height: 10 + MAX_BLOCKS_PER_CALL,
+            processed: MAX_BLOCKS_PER_CALL,
+            remaining: 190 - MAX_BLOCKS_PER_CALL,
+        });
+        assert_eq!(gov.get_proposal(proposal_id).unwrap().status, ProposalStatus::Active);
+
+        let progress = blocks.process_blocks(MAX_BLOCKS_PER_CALL, &mut staking, &mut gov);
+        assert_eq!((progress.from_height, progress.to_height), (61, 110));
+        assert_eq!(gov.get_proposal(proposal_id).unwrap().status, ProposalStatus::Passed);
+
+        while blocks.process_blocks(MAX_BLOCKS_PER_CALL, &mut staking, &mut gov).remaining > 0 {}
+        assert_eq!(blocks.processed_height(), 200);
+        assert_eq!(blocks.process_blocks(1, &mut staking, &mut gov).processed, 0);
+    }
+
+    #[test]
+    fn test_end_blockers_reach_telemetry() {
+        let mut blocks = BlockModule::new("proxima-testnet".to_string());
+        let mut staking = StakingModule::new();
+        let mut gov = GovernanceModule::new();
+        let mut metrics = crate::handler::Metrics::new();
+
+        at_height(1);
+        blocks.process_blocks(1, &mut staking, &mut gov);
+        at_height(4);
+        blocks.process_blocks_with_telemetry(10, &mut staking, &mut gov, &mut metrics);
+
+        assert_eq!(metrics.end_blockers["gov"].count, 3);
+        assert_eq!(metrics.end_blockers["staking"].count, 3);
+        assert_eq!(metrics.last_height, 4);
+    }
+}
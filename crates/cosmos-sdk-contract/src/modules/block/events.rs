@@ -0,0 +1,159 @@
+/// Event Queries for Relayers
+///
+/// A relayer has to learn about `send_packet` and `write_acknowledgement`
+/// events to know what to relay. Instead of following every NEAR receipt
+/// through an indexer it can poll `events_by_height` over the event
+/// summaries kept in block results. Only committed blocks are scanned, so
+/// polling from `to_height + 1` of the previous response never misses or
+/// repeats an event as long as the relayer keeps up with the retention
+/// window.
+
+use near_sdk::serde::{Deserialize, Serialize};
+use schemars::JsonSchema;
+
+use super::{BlockModule, EventSummary};
+
+/// Heights scanned by a single query at most
+pub const MAX_EVENT_QUERY_RANGE: u64 = 100;
+
+/// Event types a packet relayer polls for
+pub const RELAYER_PACKET_EVENTS: &[&str] = &["send_packet", "write_acknowledgement"];
+
+/// Event with its position in the chain
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct IndexedEvent {
+    pub height: u64,
+    pub tx_hash: String,
+    /// Position of the transaction in its block
+    pub tx_index: u32,
+    /// Position of the event in its transaction
+    pub event_index: u32,
+    pub event: EventSummary,
+}
+
+/// Events found in a range of committed blocks
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct EventsResponse {
+    pub from_height: u64,
+    /// Last height scanned, where the next poll continues from
+    pub to_height: u64,
+    pub events: Vec<IndexedEvent>,
+}
+
+impl BlockModule {
+    /// Events of committed blocks `from..=to` whose type is in
+    /// `type_filter`, all events when the filter is empty
+    ///
+    /// The range is cut at the latest committed block and at
+    /// `MAX_EVENT_QUERY_RANGE` heights. Heights that were already pruned are
+    /// an error so the relayer notices it fell behind.
+    pub fn events_by_height(&self, from: u64, to: u64, type_filter: &[String]) -> Result<EventsResponse, String> {
+        if from == 0 || from > to {
+            return Err(format!("Invalid height range {} to {}", from, to));
+        }
+        if self.earliest_height > 0 && from < self.earliest_height {
+            return Err(format!("Height {} was pruned, earliest height is {}", from, self.earliest_height));
+        }
+
+        let to = to
+            .min(self.latest_height)
+            .min(from.saturating_add(MAX_EVENT_QUERY_RANGE - 1));
+        let mut events = Vec::new();
+        for height in from..=to {
+            let results = match self.results.get(&height) {
+                Some(results) => results,
+                None => continue,
+            };
+            for (tx_index, tx) in results.txs.into_iter().enumerate() {
+                for (event_index, event) in tx.events.into_iter().enumerate() {
+                    if !type_filter.is_empty() && !type_filter.contains(&event.event_type) {
+                        continue;
+                    }
+                    events.push(IndexedEvent {
+                        height,
+                        tx_hash: tx.hash.clone(),
+                        tx_index: tx_index as u32,
+                        event_index: event_index as u32,
+                        event,
+                    });
+                }
+            }
+        }
+
+        Ok(EventsResponse {
+            from_height: from,
+            // Nothing committed in range yet, poll the same height again
+            to_height: to.max(from - 1),
+            events,
+        })
+    }
+
+    /// Packet events a relayer has to act on in `from..=to`
+    pub fn packet_events(&self, from: u64, to: u64) -> Result<EventsResponse, String> {
+        let filter: Vec<String> = RELAYER_PACKET_EVENTS.iter().map(|event| event.to_string()).collect();
+        self.events_by_height(from, to, &filter)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::modules::block::TxResult;
+
+    fn tx(hash: &str, event_types: &[&str]) -> TxResult {
+        TxResult {
+            hash: hash.to_string(),
+            code: 0,
+            gas_used: 0,
+            events: event_types.iter()
+                .map(|event_type| EventSummary::new(event_type, vec![("packet_sequence".to_string(), "1".to_string())]))
+                .collect(),
+        }
+    }
+
+    #[test]
+    fn test_events_by_height() {
+        let mut module = BlockModule::new("proxima-testnet".to_string());
+        module.record_tx(10, tx("a", &["message", "send_packet"])).unwrap();
+        module.record_tx(10, tx("b", &["transfer"])).unwrap();
+        module.record_block(10, 1_000, "aa".to_string(), "bb".to_string()).unwrap();
+        module.record_tx(12, tx("c", &["write_acknowledgement"])).unwrap();
+        module.record_block(12, 2_000, "aa".to_string(), "bb".to_string()).unwrap();
+        // Results of a block that is not committed yet stay hidden
+        module.record_tx(13, tx("d", &["send_packet"])).unwrap();
+
+        let all = module.events_by_height(10, 20, &[]).unwrap();
+        assert_eq!(all.to_height, 12);
+        assert_eq!(all.events.len(), 4);
+
+        let packets = module.packet_events(10, 20).unwrap();
+        let positions: Vec<(u64, &str, u32, u32)> = packets.events.iter()
+            .map(|event| (event.height, event.tx_hash.as_str(), event.tx_index, event.event_index))
+            .collect();
+        assert_eq!(positions, vec![(10, "a", 0, 1), (12, "c", 0, 0)]);
+
+        // Caught up: the next poll returns nothing and keeps the cursor
+        let next = module.packet_events(13, 20).unwrap();
+        assert!(next.events.is_empty());
+        assert_eq!(next.to_height, 12);
+
+        assert!(module.events_by_height(0, 5, &[]).is_err());
+        assert!(module.events_by_height(12, 10, &[]).is_err());
+    }
+
+    #[test]
+    fn test_events_by_height_is_bounded() {
+        let mut module = BlockModule::new("proxima-testnet".to_string());
+        module.set_retention(50).unwrap();
+        module.record_block(1, 1, "aa".to_string(), "bb".to_string()).unwrap();
+        module.record_block(300, 2, "aa".to_string(), "bb".to_string()).unwrap();
+
+        assert!(module.events_by_height(1, 300, &[]).is_err());
+        let response = module.events_by_height(251, 300, &[]).unwrap();
+        assert_eq!(response.to_height, 300);
+
+        module.set_retention(1_000).unwrap();
+        module.record_block(400, 3, "aa".to_string(), "bb".to_string()).unwrap();
+        assert_eq!(module.events_by_height(260, 400, &[]).unwrap().to_height, 359);
+    }
+}
@@ -0,0 +1,113 @@
+/// Simple Merkle tree hashing as used by Tendermint (RFC 6962)
+/// 
+/// Leaves are hashed as `sha256(0x00 || leaf)` and inner nodes as
+/// `sha256(0x01 || left || right)`, splitting at the largest power of two
+/// below the number of items.
+
+use sha2::{Digest, Sha256};
+
+const LEAF_PREFIX: u8 = 0;
+const INNER_PREFIX: u8 = 1;
+
+fn leaf_hash(leaf: &[u8]) -> Vec<u8> {
+    let mut hasher = Sha256::new();
+    hasher.update([LEAF_PREFIX]);
+    hasher.update(leaf);
+    hasher.finalize().to_vec()
+}
+
+fn inner_hash(left: &[u8], right: &[u8]) -> Vec<u8> {
+    let mut hasher = Sha256::new();
+    hasher.update([INNER_PREFIX]);
+    hasher.update(left);
+    hasher.update(right);
+    hasher.finalize().to_vec()
+}
+
+fn split_point(length: usize) -> usize {
+    let mut split = 1;
+    while split * 2 < length {
+        split *= 2;
+    }
+    split
+}
+
+/// Merkle root of a list of items, `sha256("")` for an empty list
+pub fn merkle_root(items: &[Vec<u8>]) -> Vec<u8> {
+    match items.len() {
+        0 => Sha256::digest(b"").to_vec(),
+        1 => leaf_hash(&items[0]),
+        length => {
+            let split = split_point(length);
+            inner_hash(&merkle_root(&items[..split]), &merkle_root(&items[split..]))
+        }
+    }
+}
+
+/// Inner nodes on the path from a leaf to the root, leaf side first
+/// 
+/// Each step is the `(prefix, suffix)` to wrap around the child hash before
+/// hashing: `sha256(prefix || child || suffix)`.
+pub fn merkle_path(items: &[Vec<u8>], index: usize) -> Vec<(Vec<u8>, Vec<u8>)> {
+    if items.len() <= 1 {
+        return vec![];
+    }
+    let split = split_point(items.len());
+    if index < split {
+        let mut path = merkle_path(&items[..split], index);
+        path.push((vec![INNER_PREFIX], merkle_root(&items[split..])));
+        path
+    } else {
+        let mut path = merkle_path(&items[split..], index - split);
+        path.push(([vec![INNER_PREFIX], merkle_root(&items[..split])].concat(), vec![]));
+        path
+    }
+}
+
+/// Root computed from a leaf and its path
+pub fn root_from_path(leaf: &[u8], path: &[(Vec<u8>, Vec<u8>)]) -> Vec<u8> {
+    path.iter().fold(leaf_hash(leaf), |hash, (prefix, suffix)| {
+        Sha256::digest([prefix.as_slice(), &hash, suffix.as_slice()].concat()).to_vec()
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_merkle_path() {
+        let items: Vec<Vec<u8>> = (0..5u8).map(|i| vec![i]).collect();
+        let root = merkle_root(&items);
+        for (index, item) in items.iter().enumerate() {
+            assert_eq!(root_from_path(item, &merkle_path(&items, index)), root);
+        }
+        assert_ne!(root_from_path(&items[1], &merkle_path(&items, 0)), root);
+    }
+
+    #[test]
+    fn test_empty_and_single_leaf() {
+        assert_eq!(
+            hex::encode(merkle_root(&[])),
+            "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+        );
+        assert_eq!(merkle_root(&[b"a".to_vec()]), leaf_hash(b"a"));
+    }
+
+    #[test]
+    fn test_unbalanced_tree() {
+        let items = vec![b"a".to_vec(), b"b".to_vec(), b"c".to_vec()];
+        let expected = inner_hash(
+            &inner_hash(&leaf_hash(b"a"), &leaf_hash(b"b")),
+            &leaf_hash(b"c"),
+        );
+        assert_eq!(merkle_root(&items), expected);
+    }
+
+    #[test]
+    fn test_order_matters() {
+        let forward = merkle_root(&[b"a".to_vec(), b"b".to_vec()]);
+        let backward = merkle_root(&[b"b".to_vec(), b"a".to_vec()]);
+        assert_ne!(forward, backward);
+    }
+}
@@ -0,0 +1,764 @@
+/// Block Module
+/// 
+/// NEAR has no Cosmos-style block headers, so this module keeps a
+/// lightweight header for every processed block. Cosmos tooling and the
+/// relayer can then use the familiar `block(height)` / `latest_block`
+/// queries against the contract.
+/// 
+/// Executed transactions and a bounded summary of their events are kept per
+/// block as well, so `block_results(height)` and `events_by_height` can serve
+/// recent history without an external indexer. Results are pruned together with their headers.
+
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::collections::LookupMap;
+use near_sdk::env;
+use near_sdk::serde::{Deserialize, Serialize};
+use schemars::JsonSchema;
+
+pub mod catchup;
+pub mod events;
+pub mod merkle;
+pub mod query;
+pub mod watchdog;
+
+pub use catchup::{CatchUpProgress, MAX_BLOCKS_PER_CALL};
+pub use events::{EventsResponse, IndexedEvent, MAX_EVENT_QUERY_RANGE, RELAYER_PACKET_EVENTS};
+pub use merkle::merkle_root;
+pub use query::{merkle_existence_proof, verify_merkle_existence, QueryEnvelope, QueryProof};
+pub use watchdog::{check_invariants, InvariantViolation, WatchdogProgress};
+
+use crate::handler::tx_handler::{ABCIEvent, TxResponse};
+use crate::modules::staking::{Validator, ValidatorStatus};
+use crate::types::time::BlockTime;
+
+/// Default number of headers kept before the oldest are pruned
+pub const DEFAULT_HEADER_RETENTION: u64 = 10_000;
+/// Headers pruned per call at most, the rest is left to later blocks
+pub const MAX_PRUNED_PER_CALL: u64 = 20;
+/// Heights averaged over by `observed_block_time` by default
+pub const BLOCK_TIME_WINDOW: u64 = 100;
+/// Transactions indexed per block, later ones are only counted
+pub const MAX_TXS_PER_BLOCK: usize = 500;
+/// Transaction hashes unindexed per call at most when results are pruned
+pub const MAX_TX_HASHES_PRUNED_PER_CALL: usize = 2 * MAX_TXS_PER_BLOCK;
+/// Events summarized per transaction
+pub const MAX_EVENTS_PER_TX: usize = 32;
+/// Attribute values longer than this are cut off in summaries
+pub const MAX_ATTRIBUTE_VALUE_LEN: usize = 128;
+
+/// Header of a processed block
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct BlockHeader {
+    pub chain_id: String,
+    pub height: u64,
+    /// Block time in nanoseconds since the Unix epoch
+    pub time: u64,
+    /// Hash of the previous header, empty for the first block
+    pub last_block_hash: String,
+    /// Root over the module store commitments after the block
+    pub app_hash: String,
+    /// Root over the bonded validator set
+    pub validators_hash: String,
+    /// Hash of this header
+    pub hash: String,
+}
+
+impl BlockHeader {
+    fn compute_hash(&self) -> String {
+        let fields = vec![
+            self.chain_id.as_bytes().to_vec(),
+            self.height.to_be_bytes().to_vec(),
+            self.time.to_be_bytes().to_vec(),
+            self.last_block_hash.as_bytes().to_vec(),
+            self.app_hash.as_bytes().to_vec(),
+            self.validators_hash.as_bytes().to_vec(),
+        ];
+        hex::encode(merkle_root(&fields))
+    }
+}
+
+/// Compact form of an emitted event
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct EventSummary {
+    pub event_type: String,
+    pub attributes: Vec<(String, String)>,
+}
+
+impl EventSummary {
+    pub fn new(event_type: &str, attributes: Vec<(String, String)>) -> Self {
+        Self {
+            event_type: event_type.to_string(),
+            attributes: attributes
+                .into_iter()
+                .map(|(key, value)| (key, truncate(value, MAX_ATTRIBUTE_VALUE_LEN)))
+                .collect(),
+        }
+    }
+
+    /// Summarize an ABCI event, skipping attributes that are not UTF-8
+    pub fn from_abci_event(event: &ABCIEvent) -> Self {
+        let attributes = event.attributes
+            .iter()
+            .filter_map(|attribute| Some((attribute.decode_key().ok()?, attribute.decode_value().ok()?)))
+            .collect();
+        Self::new(&event.r#type, attributes)
+    }
+}
+
+fn truncate(mut value: String, max_len: usize) -> String {
+    if value.len() > max_len {
+        let mut end = max_len;
+        while !value.is_char_boundary(end) {
+            end -= 1;
+        }
+        value.truncate(end);
+    }
+    value
+}
+
+/// Outcome of one transaction in a block
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct TxResult {
+    pub hash: String,
+    pub code: u32,
+    pub gas_used: u64,
+    pub events: Vec<EventSummary>,
+}
+
+/// Transactions executed in a block
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct BlockResults {
+    pub height: u64,
+    pub txs: Vec<TxResult>,
+    /// Total transactions in the block, including ones beyond the index bound
+    pub total_txs: u64,
+}
+
+/// App hash over per-module store commitments
+/// 
+/// Commitments are sorted by module name so the result does not depend on
+/// the order modules report in.
+pub fn compute_app_hash(store_hashes: &[(String, Vec<u8>)]) -> String {
+    let mut store_hashes = store_hashes.to_vec();
+    store_hashes.sort_by(|a, b| a.0.cmp(&b.0));
+
+    let leaves: Vec<Vec<u8>> = store_hashes
+        .into_iter()
+        .map(|(name, hash)| [name.into_bytes(), hash].concat())
+        .collect();
+    hex::encode(merkle_root(&leaves))
+}
+
+/// Hash of the bonded, unjailed validator set
+/// 
+/// Validators are ordered by voting power, highest first, then by address.
+pub fn compute_validators_hash(validators: &[Validator]) -> String {
+    let mut active: Vec<&Validator> = validators
+        .iter()
+        .filter(|validator| validator.status == ValidatorStatus::Bonded && !validator.jailed)
+        .collect();
+    active.sort_by(|a, b| b.tokens.cmp(&a.tokens).then_with(|| a.address.cmp(&b.address)));
+
+    let leaves: Vec<Vec<u8>> = active
+        .into_iter()
+        .map(|validator| [validator.consensus_pubkey.clone(), validator.tokens.to_be_bytes().to_vec()].concat())
+        .collect();
+    hex::encode(merkle_root(&leaves))
+}
+
+#[derive(BorshDeserialize, BorshSerialize)]
+pub struct BlockModule {
+    chain_id: String,
+    headers: LookupMap<u64, BlockHeader>,
+    results: LookupMap<u64, BlockResults>,
+    /// Height by transaction hash
+    tx_heights: LookupMap<String, u64>,
+    /// Module store hashes behind each committed app hash, sorted by name
+    store_hashes: LookupMap<u64, Vec<(String, Vec<u8>)>>,
+    /// Recorded heights by record sequence, oldest first
+    recorded_heights: LookupMap<u64, u64>,
+    /// Sequence of the oldest header that is still stored
+    first_record: u64,
+    /// Sequence the next recorded header gets
+    next_record: u64,
+    earliest_height: u64,
+    latest_height: u64,
+    retention: u64,
+    /// Cursor of `process_blocks`
+    processed_height: u64,
+    /// Height and time of the block transactions were recorded for whose
+    /// header is not committed yet
+    pending_block: Option<(u64, u64)>,
+}
+
+impl BlockModule {
+    pub fn new(chain_id: String) -> Self {
+        Self {
+            chain_id,
+            headers: LookupMap::new(b"block_headers".to_vec()),
+            results: LookupMap::new(b"block_results".to_vec()),
+            tx_heights: LookupMap::new(b"block_tx_heights".to_vec()),
+            store_hashes: LookupMap::new(b"block_store_hashes".to_vec()),
+            recorded_heights: LookupMap::new(b"block_recorded_heights".to_vec()),
+            first_record: 0,
+            next_record: 0,
+            earliest_height: 0,
+            latest_height: 0,
+            retention: DEFAULT_HEADER_RETENTION,
+            processed_height: 0,
+            pending_block: None,
+        }
+    }
+
+    /// Record the header of a processed block
+    /// 
+    /// Heights must strictly increase and may skip, but not past a block
+    /// with recorded transactions. Once more than the retention of headers
+    /// is stored the oldest are pruned, at most `MAX_PRUNED_PER_CALL` per
+    /// block.
+    pub fn record_block(
+        &mut self,
+        height: u64,
+        time: u64,
+        app_hash: String,
+        validators_hash: String,
+    ) -> Result<BlockHeader, String> {
+        if height == 0 || height <= self.latest_height {
+            return Err(format!(
+                "Block height {} must be greater than latest height {}",
+                height, self.latest_height
+            ));
+        }
+        if let Some((pending, _)) = self.pending_block.filter(|(pending, _)| *pending < height) {
+            return Err(format!("Block {} has uncommitted transactions, commit it first", pending));
+        }
+
+        let last_block_hash = self.latest_block()
+            .map(|header| header.hash)
+            .unwrap_or_default();
+
+        let mut header = BlockHeader {
+            chain_id: self.chain_id.clone(),
+            height,
+            time,
+            last_block_hash,
+            app_hash,
+            validators_hash,
+            hash: String::new(),
+        };
+        header.hash = header.compute_hash();
+
+        self.headers.insert(&height, &header);
+        self.recorded_heights.insert(&self.next_record, &height);
+        self.next_record += 1;
+        if self.earliest_height == 0 {
+            self.earliest_height = height;
+        }
+        self.latest_height = height;
+        self.pending_block = None;
+        self.prune();
+
+        env::log_str(&format!("Block: recorded header {} at height {}", header.hash, height));
+        Ok(header)
+    }
+
+    /// Record the current NEAR block from module commitments and validators
+    pub fn commit_block(
+        &mut self,
+        store_hashes: &[(String, Vec<u8>)],
+        validators: &[Validator],
+    ) -> Result<BlockHeader, String> {
+        self.commit_block_at(env::block_height(), env::block_timestamp(), store_hashes, validators)
+    }
+
+    /// Record the earlier block transactions were recorded for, if its
+    /// header is still missing
+    ///
+    /// The commitments are taken now, so they include what changed since
+    /// that block outside of recorded transactions.
+    pub fn commit_pending_block(
+        &mut self,
+        store_hashes: &[(String, Vec<u8>)],
+        validators: &[Validator],
+    ) -> Result<Option<BlockHeader>, String> {
+        match self.pending_block.filter(|(height, _)| *height < env::block_height()) {
+            Some((height, time)) => self.commit_block_at(height, time, store_hashes, validators).map(Some),
+            None => Ok(None),
+        }
+    }
+
+    fn commit_block_at(
+        &mut self,
+        height: u64,
+        time: u64,
+        store_hashes: &[(String, Vec<u8>)],
+        validators: &[Validator],
+    ) -> Result<BlockHeader, String> {
+        let header = self.record_block(
+            height,
+            time,
+            compute_app_hash(store_hashes),
+            compute_validators_hash(validators),
+        )?;
+
+        // Kept so queries can prove a store against this app hash
+        let mut sorted = store_hashes.to_vec();
+        sorted.sort_by(|a, b| a.0.cmp(&b.0));
+        self.store_hashes.insert(&header.height, &sorted);
+        Ok(header)
+    }
+
+    /// Index a transaction executed in the block being processed
+    /// 
+    /// Results can only be added to blocks whose header has not been
+    /// recorded yet, and only to one such block at a time.
+    pub fn record_tx(&mut self, height: u64, mut result: TxResult) -> Result<(), String> {
+        if height <= self.latest_height {
+            return Err(format!("Block {} is already committed", height));
+        }
+        if let Some((pending, _)) = self.pending_block.filter(|(pending, _)| *pending != height) {
+            return Err(format!("Block {} has uncommitted transactions, commit it first", pending));
+        }
+        if self.tx_heights.get(&result.hash).is_some() {
+            return Err(format!("Transaction {} already indexed", result.hash));
+        }
+
+        let mut results = self.results.get(&height).unwrap_or(BlockResults {
+            height,
+            txs: vec![],
+            total_txs: 0,
+        });
+        results.total_txs += 1;
+
+        if results.txs.len() < MAX_TXS_PER_BLOCK {
+            result.events.truncate(MAX_EVENTS_PER_TX);
+            self.tx_heights.insert(&result.hash, &height);
+            results.txs.push(result);
+        }
+
+        self.results.insert(&height, &results);
+        if self.pending_block.is_none() {
+            self.pending_block = Some((height, env::block_timestamp()));
+        }
+        Ok(())
+    }
+
+    /// Height of the block transactions were recorded for whose header is
+    /// not committed yet
+    pub fn pending_height(&self) -> Option<u64> {
+        self.pending_block.map(|(height, _)| height)
+    }
+
+    /// Index a processed transaction response
+    pub fn record_tx_response(&mut self, height: u64, response: &TxResponse) -> Result<(), String> {
+        self.record_tx(height, TxResult {
+            hash: response.txhash.clone(),
+            code: response.code,
+            gas_used: response.gas_used.parse().unwrap_or(0),
+            events: response.events.iter().map(EventSummary::from_abci_event).collect(),
+        })
+    }
+
+    /// Number of headers stored
+    pub fn stored_headers(&self) -> u64 {
+        self.next_record - self.first_record
+    }
+
+    /// Drop the oldest recorded headers beyond the retention
+    /// 
+    /// Only heights that were recorded are visited, so a gap in heights
+    /// costs nothing. Headers and transaction hashes left over by the
+    /// bounds are pruned with the next blocks or the next call. A block whose
+    /// results are pruned part way keeps its header and the remaining
+    /// transactions. Returns the number of headers and transaction hashes
+    /// dropped.
+    pub fn prune(&mut self) -> u64 {
+        let mut pruned = 0;
+        let mut unindexed = 0;
+        'blocks: while self.stored_headers() > self.retention && pruned < MAX_PRUNED_PER_CALL {
+            let height = self.recorded_heights.get(&self.first_record)
+                .unwrap_or_else(|| env::panic_str("Recorded height is missing"));
+            if let Some(mut results) = self.results.get(&height) {
+                while let Some(tx) = results.txs.pop() {
+                    if unindexed == MAX_TX_HASHES_PRUNED_PER_CALL {
+                        results.txs.push(tx);
+                        self.results.insert(&height, &results);
+                        break 'blocks;
+                    }
+                    self.tx_heights.remove(&tx.hash);
+                    unindexed += 1;
+                }
+                self.results.remove(&height);
+            }
+            self.headers.remove(&height);
+            self.store_hashes.remove(&height);
+            self.recorded_heights.remove(&self.first_record);
+            self.first_record += 1;
+            pruned += 1;
+        }
+        if let Some(height) = self.recorded_heights.get(&self.first_record) {
+            self.earliest_height = height;
+        }
+        pruned + unindexed as u64
+    }
+
+    pub fn retention(&self) -> u64 {
+        self.retention
+    }
+
+    pub fn set_retention(&mut self, retention: u64) -> Result<(), String> {
+        if retention == 0 {
+            return Err("Header retention must be positive".to_string());
+        }
+        self.retention = retention;
+        if self.latest_height > 0 {
+            self.prune();
+        }
+        Ok(())
+    }
+
+    // Queries
+
+    /// Header at a height, if it was recorded and not yet pruned
+    pub fn block(&self, height: u64) -> Option<BlockHeader> {
+        self.headers.get(&height)
+    }
+
+    pub fn latest_block(&self) -> Option<BlockHeader> {
+        if self.latest_height == 0 {
+            return None;
+        }
+        self.headers.get(&self.latest_height)
+    }
+
+    /// Transactions and event summaries of a block
+    pub fn block_results(&self, height: u64) -> Option<BlockResults> {
+        self.results.get(&height).or_else(|| {
+            // Committed blocks without transactions still have results
+            self.headers.get(&height).map(|_| BlockResults {
+                height,
+                txs: vec![],
+                total_txs: 0,
+            })
+        })
+    }
+
+    /// Height of the block that included a transaction
+    pub fn tx_height(&self, hash: &str) -> Option<u64> {
+        self.tx_heights.get(&hash.to_string())
+    }
+
+    pub fn latest_height(&self) -> u64 {
+        self.latest_height
+    }
+
+    pub fn earliest_height(&self) -> u64 {
+        self.earliest_height
+    }
+
+    /// Average block time over the last `window` recorded heights
+    ///
+    /// Falls back to the default when fewer than two headers are retained.
+    pub fn observed_block_time(&self, window: u64) -> BlockTime {
+        let from_height = self.latest_height.saturating_sub(window).max(self.earliest_height);
+        match (self.headers.get(&from_height), self.latest_block()) {
+            (Some(from), Some(to)) => BlockTime::from_observation(from.height, from.time, to.height, to.time),
+            _ => BlockTime::default(),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::modules::staking::{Commission, CommissionRates, ValidatorDescription};
+    use near_sdk::test_utils::VMContextBuilder;
+    use near_sdk::testing_env;
+
+    fn validator(address: &str, tokens: u128, status: ValidatorStatus) -> Validator {
+        Validator {
+            address: address.to_string(),
+            operator_address: address.to_string(),
+            consensus_pubkey: address.as_bytes().to_vec(),
+            jailed: false,
+            status,
+            tokens,
+            delegator_shares: tokens.to_string(),
+            description: ValidatorDescription {
+                moniker: address.to_string(),
+                identity: String::new(),
+                website: String::new(),
+                security_contact: String::new(),
+                details: String::new(),
+            },
+            unbonding_height: 0,
+            unbonding_time: 0,
+            commission: Commission {
+                commission_rates: CommissionRates {
+                    rate: "0.1".to_string(),
+                    max_rate: "0.2".to_string(),
+                    max_change_rate: "0.01".to_string(),
+                },
+                update_time: 0,
+            },
+            min_self_delegation: 1,
+        }
+    }
+
+    #[test]
+    fn test_record_and_query_blocks() {
+        let mut module = BlockModule::new("proxima-testnet".to_string());
+        assert!(module.latest_block().is_none());
+        assert_eq!(module.observed_block_time(BLOCK_TIME_WINDOW), BlockTime::default());
+
+        let first = module.record_block(10, 1_000, "aa".to_string(), "bb".to_string()).unwrap();
+        assert_eq!(first.last_block_hash, "");
+        assert_eq!(first.hash.len(), 64);
+
+        let second = module.record_block(11, 2_000, "cc".to_string(), "bb".to_string()).unwrap();
+        assert_eq!(second.last_block_hash, first.hash);
+        assert_eq!(module.latest_block(), Some(second));
+        assert_eq!(module.block(10), Some(first));
+        assert!(module.block(12).is_none());
+        assert_eq!(module.observed_block_time(BLOCK_TIME_WINDOW), BlockTime::new(1_000));
+
+        assert!(module.record_block(11, 3_000, "dd".to_string(), "bb".to_string()).is_err());
+    }
+
+    #[test]
+    fn test_pruning_skips_height_gaps() {
+        let mut module = BlockModule::new("proxima-testnet".to_string());
+        module.set_retention(2).unwrap();
+
+        module.record_block(1, 1_000, String::new(), String::new()).unwrap();
+        module.record_block(2, 2_000, String::new(), String::new()).unwrap();
+        // Far more heights than a call could walk through one by one
+        module.record_block(u64::MAX / 2, 3_000, String::new(), String::new()).unwrap();
+
+        assert!(module.block(1).is_none());
+        assert!(module.block(2).is_some());
+        assert_eq!(module.stored_headers(), 2);
+        assert_eq!(module.earliest_height(), 2);
+        assert_eq!(module.latest_height(), u64::MAX / 2);
+    }
+
+    #[test]
+    fn test_pruning_is_bounded_per_call() {
+        let mut module = BlockModule::new("proxima-testnet".to_string());
+        let count = MAX_PRUNED_PER_CALL * 2 + 5;
+        for height in 1..=count {
+            module.record_block(height * 10, height * 1_000, String::new(), String::new()).unwrap();
+        }
+
+        module.set_retention(1).unwrap();
+        assert_eq!(module.stored_headers(), count - MAX_PRUNED_PER_CALL);
+        assert_eq!(module.earliest_height(), (MAX_PRUNED_PER_CALL + 1) * 10);
+
+        // Later blocks catch up on the rest
+        let mut height = count * 10;
+        while module.stored_headers() > 1 {
+            height += 10;
+            module.record_block(height, height * 100, String::new(), String::new()).unwrap();
+        }
+        assert_eq!(module.earliest_height(), height);
+        assert!(module.block(height - 10).is_none());
+    }
+
+    #[test]
+    fn test_headers_are_pruned() {
+        let mut module = BlockModule::new("proxima-testnet".to_string());
+        module.set_retention(2).unwrap();
+
+        for height in 1..=4 {
+            module.record_block(height, height * 1_000, String::new(), String::new()).unwrap();
+        }
+
+        assert!(module.block(2).is_none());
+        assert!(module.block(3).is_some());
+        assert_eq!(module.earliest_height(), 3);
+        assert_eq!(module.latest_height(), 4);
+    }
+
+    fn tx_result(hash: &str, events: usize) -> TxResult {
+        TxResult {
+            hash: hash.to_string(),
+            code: 0,
+            gas_used: 100,
+            events: (0..events)
+                .map(|i| EventSummary::new("transfer", vec![("amount".to_string(), i.to_string())]))
+                .collect(),
+        }
+    }
+
+    #[test]
+    fn test_block_results() {
+        let mut module = BlockModule::new("proxima-testnet".to_string());
+        module.record_tx(5, tx_result("AA", 1)).unwrap();
+        module.record_tx(5, tx_result("BB", 100)).unwrap();
+        assert!(module.record_tx(5, tx_result("AA", 1)).is_err());
+        module.record_block(5, 1_000, String::new(), String::new()).unwrap();
+        module.record_block(6, 2_000, String::new(), String::new()).unwrap();
+
+        let results = module.block_results(5).unwrap();
+        assert_eq!(results.total_txs, 2);
+        assert_eq!(results.txs[0].hash, "AA");
+        assert_eq!(results.txs[1].events.len(), MAX_EVENTS_PER_TX);
+        assert_eq!(module.tx_height("BB"), Some(5));
+
+        assert_eq!(module.block_results(6).unwrap().txs.len(), 0);
+        assert!(module.block_results(7).is_none());
+        assert!(module.record_tx(6, tx_result("CC", 0)).is_err());
+    }
+
+    #[test]
+    fn test_pending_block_is_committed_before_later_ones() {
+        testing_env!(VMContextBuilder::new().block_height(5).block_timestamp(5_000).build());
+        let mut module = BlockModule::new("proxima-testnet".to_string());
+        module.record_tx(5, tx_result("AA", 1)).unwrap();
+        assert_eq!(module.pending_height(), Some(5));
+        assert!(module.record_tx(6, tx_result("BB", 1)).unwrap_err().contains("Block 5 has uncommitted"));
+        // Not behind the current block yet
+        assert_eq!(module.commit_pending_block(&[], &[]).unwrap(), None);
+
+        testing_env!(VMContextBuilder::new().block_height(8).block_timestamp(8_000).build());
+        assert!(module.commit_block(&[], &[]).unwrap_err().contains("Block 5 has uncommitted"));
+        let header = module.commit_pending_block(&[], &[]).unwrap().unwrap();
+        assert_eq!((header.height, header.time), (5, 5_000));
+        assert_eq!(module.block_results(5).unwrap().txs.len(), 1);
+        assert_eq!(module.pending_height(), None);
+        assert_eq!(module.commit_block(&[], &[]).unwrap().height, 8);
+    }
+
+    #[test]
+    fn test_block_results_are_bounded_and_pruned() {
+        let mut module = BlockModule::new("proxima-testnet".to_string());
+        module.set_retention(1).unwrap();
+
+        for i in 0..MAX_TXS_PER_BLOCK + 3 {
+            module.record_tx(1, tx_result(&format!("TX{}", i), 0)).unwrap();
+        }
+        module.record_block(1, 1_000, String::new(), String::new()).unwrap();
+
+        let results = module.block_results(1).unwrap();
+        assert_eq!(results.txs.len(), MAX_TXS_PER_BLOCK);
+        assert_eq!(results.total_txs as usize, MAX_TXS_PER_BLOCK + 3);
+        assert!(module.tx_height(&format!("TX{}", MAX_TXS_PER_BLOCK)).is_none());
+
+        module.record_block(2, 2_000, String::new(), String::new()).unwrap();
+        assert!(module.block_results(1).is_none());
+        assert!(module.tx_height("TX0").is_none());
+    }
+
+    #[test]
+    fn test_pruned_tx_hashes_are_bounded_per_call() {
+        let mut module = BlockModule::new("proxima-testnet".to_string());
+        for height in 1..=4 {
+            for i in 0..MAX_TXS_PER_BLOCK {
+                module.record_tx(height, tx_result(&format!("TX{}-{}", height, i), 0)).unwrap();
+            }
+            module.record_block(height, height * 1_000, String::new(), String::new()).unwrap();
+        }
+
+        // Blocks 1 and 2 use up the bound, block 3 waits for the next call
+        module.set_retention(1).unwrap();
+        assert_eq!(module.earliest_height(), 3);
+        assert!(module.tx_height("TX2-0").is_none());
+        assert_eq!(module.tx_height("TX3-0"), Some(3));
+        assert_eq!(module.block_results(3).unwrap().txs.len(), MAX_TXS_PER_BLOCK);
+
+        // A keeper call catches up without waiting for a block
+        assert_eq!(module.prune(), MAX_TXS_PER_BLOCK as u64 + 1);
+        assert_eq!(module.earliest_height(), 4);
+        assert_eq!(module.prune(), 0);
+
+        module.record_block(5, 5_000, String::new(), String::new()).unwrap();
+        assert_eq!(module.earliest_height(), 5);
+        assert!(module.block_results(3).is_none());
+        assert!(module.tx_height("TX4-0").is_none());
+    }
+
+    #[test]
+    fn test_event_summary_from_abci_event() {
+        let long_value = "x".repeat(MAX_ATTRIBUTE_VALUE_LEN + 10);
+        let event = ABCIEvent::new("transfer", vec![("recipient", "bob.near"), ("memo", &long_value)]);
+
+        let summary = EventSummary::from_abci_event(&event);
+        assert_eq!(summary.event_type, "transfer");
+        assert_eq!(summary.attributes[0], ("recipient".to_string(), "bob.near".to_string()));
+        assert_eq!(summary.attributes[1].1.len(), MAX_ATTRIBUTE_VALUE_LEN);
+    }
+
+    #[test]
+    fn test_app_hash_is_order_independent() {
+        let bank = ("bank".to_string(), vec![1u8; 32]);
+        let staking = ("staking".to_string(), vec![2u8; 32]);
+
+        assert_eq!(
+            compute_app_hash(&[bank.clone(), staking.clone()]),
+            compute_app_hash(&[staking, bank.clone()])
+        );
+        assert_ne!(compute_app_hash(&[bank.clone()]), compute_app_hash(&[]));
+    }
+
+    #[test]
+    fn test_query_envelope_proves_value() {
+        testing_env!(VMContextBuilder::new().block_height(7).build());
+        let mut module = BlockModule::new("proxima-testnet".to_string());
+        let gov_entries = vec![
+            (b"params/quorum".to_vec(), b"334".to_vec()),
+            (b"params/voting_period".to_vec(), b"42".to_vec()),
+            (b"proposals/1".to_vec(), b"passed".to_vec()),
+        ];
+        let gov_hash = merkle_root(&gov_entries.iter().map(|(k, v)| [k.clone(), v.clone()].concat()).collect::<Vec<_>>());
+        let store_hashes = vec![
+            ("staking".to_string(), vec![2u8; 32]),
+            ("bank".to_string(), vec![1u8; 32]),
+            ("gov".to_string(), gov_hash),
+        ];
+        let header = module.commit_block(&store_hashes, &[]).unwrap();
+
+        let (app_hash, _) = module.prove_store(7, "bank").unwrap();
+        assert_eq!(app_hash, header.app_hash);
+        assert!(module.prove_store(7, "ibc").is_err());
+
+        let key = b"params/voting_period";
+        let envelope = module.query_envelope("gov", key, 42u64, true, || gov_entries.clone()).unwrap();
+        assert_eq!(envelope.height, 7);
+        let proof = envelope.proof.unwrap();
+        assert!(proof.verify(key, b"42"));
+        // The proof covers the value, not just the store
+        assert!(!proof.verify(key, b"43"));
+        assert!(!proof.verify(b"params/quorum", b"42"));
+
+        let mut tampered = proof.clone();
+        tampered.app_hash = compute_app_hash(&store_hashes[..2]);
+        assert!(!tampered.verify(key, b"42"));
+
+        // Entries changed since the commit no longer match the store hash
+        let mut changed = gov_entries.clone();
+        changed[1].1 = b"43".to_vec();
+        assert!(module.query_envelope("gov", key, 43u64, true, || changed).unwrap_err().contains("changed since height 7"));
+        assert!(module.query_envelope("gov", b"params/missing", 0u64, true, || gov_entries.clone()).is_err());
+        assert!(module.query_envelope("gov", key, 42u64, false, Vec::new).unwrap().proof.is_none());
+    }
+
+    #[test]
+    fn test_validators_hash_ignores_inactive_validators() {
+        let bonded = vec![
+            validator("val1", 100, ValidatorStatus::Bonded),
+            validator("val2", 200, ValidatorStatus::Bonded),
+        ];
+        let mut with_inactive = bonded.clone();
+        with_inactive.push(validator("val3", 300, ValidatorStatus::Unbonded));
+
+        let mut jailed = validator("val4", 400, ValidatorStatus::Bonded);
+        jailed.jailed = true;
+        with_inactive.push(jailed);
+
+        assert_eq!(compute_validators_hash(&bonded), compute_validators_hash(&with_inactive));
+
+        let mut reordered = bonded.clone();
+        reordered.reverse();
+        assert_eq!(compute_validators_hash(&bonded), compute_validators_hash(&reordered));
+    }
+}
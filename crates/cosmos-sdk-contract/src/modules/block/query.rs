@@ -0,0 +1,198 @@
+/// Query Response Envelopes
+///
+/// Matches ABCI query semantics: every response carries the height its state
+/// was read at and, when the caller asks with `prove = true`, an ICS-23
+/// existence proof. Like a Cosmos multistore proof it has two steps: the
+/// queried key and value are a leaf of the module's store hash, and that
+/// store hash is a leaf of the `app_hash` in the latest committed header, so
+/// a light client holding that header can check the response without
+/// trusting the RPC node.
+
+use near_sdk::env;
+use near_sdk::serde::{Deserialize, Serialize};
+use schemars::JsonSchema;
+
+use super::merkle::{merkle_path, merkle_root, root_from_path};
+use super::BlockModule;
+use crate::modules::ibc::client::tendermint::ics23::{
+    CommitmentProof, ExistenceProof, HashOp, InnerOp, LeafOp, LengthOp,
+};
+
+/// Proof that a queried value is committed in a block's app hash
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct QueryProof {
+    /// Height of the header whose app hash the proof leads to
+    pub height: u64,
+    pub app_hash: String,
+    pub store: String,
+    /// Proof of the queried key and its stored value under the store hash
+    pub value_proof: CommitmentProof,
+    /// Proof of the store hash under the app hash
+    pub store_proof: CommitmentProof,
+}
+
+/// Query response with the height it was read at and an optional proof
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct QueryEnvelope<T> {
+    pub height: u64,
+    pub value: T,
+    pub proof: Option<QueryProof>,
+}
+
+/// Leaf format of simple merkle leaves: `sha256(0x00 || key || value)`
+fn merkle_leaf_op() -> LeafOp {
+    LeafOp {
+        hash: HashOp::Sha256,
+        prehash_key: HashOp::NoHash,
+        prehash_value: HashOp::NoHash,
+        length: LengthOp::NoPrefix,
+        prefix: vec![0],
+    }
+}
+
+fn entry_leaves(entries: &[(Vec<u8>, Vec<u8>)]) -> Vec<Vec<u8>> {
+    entries.iter()
+        .map(|(key, value)| [key.as_slice(), value.as_slice()].concat())
+        .collect()
+}
+
+/// ICS-23 existence proof of `entries[index]` in the simple merkle tree
+/// over `key || value` of the entries
+pub fn merkle_existence_proof(entries: &[(Vec<u8>, Vec<u8>)], index: usize) -> CommitmentProof {
+    let path = merkle_path(&entry_leaves(entries), index)
+        .into_iter()
+        .map(|(prefix, suffix)| InnerOp { hash: HashOp::Sha256, prefix, suffix })
+        .collect();
+
+    CommitmentProof {
+        proof: Some(ExistenceProof {
+            key: entries[index].0.clone(),
+            value: entries[index].1.clone(),
+            leaf: merkle_leaf_op(),
+            path,
+        }),
+        non_exist: None,
+        batch: None,
+        compressed: None,
+        range: None,
+        multistore: None,
+    }
+}
+
+/// Check that a proof from `merkle_existence_proof` proves `key` under the
+/// hex encoded `root`
+pub fn verify_merkle_existence(proof: &CommitmentProof, key: &[u8], root: &str) -> bool {
+    let exist = match &proof.proof {
+        Some(exist) => exist,
+        None => return false,
+    };
+    if exist.key != key || exist.leaf != merkle_leaf_op() {
+        return false;
+    }
+
+    let leaf = [exist.key.as_slice(), exist.value.as_slice()].concat();
+    let path: Vec<(Vec<u8>, Vec<u8>)> = exist.path.iter()
+        .map(|op| (op.prefix.clone(), op.suffix.clone()))
+        .collect();
+    hex::encode(root_from_path(&leaf, &path)) == root
+}
+
+impl QueryProof {
+    /// Hex encoded store hash the store proof commits to the app hash
+    pub fn store_hash(&self) -> Option<String> {
+        self.store_proof.proof.as_ref().map(|exist| hex::encode(&exist.value))
+    }
+
+    /// Check that `key` holds the stored `value` under the app hash
+    pub fn verify(&self, key: &[u8], value: &[u8]) -> bool {
+        let store_hash = match self.store_hash() {
+            Some(store_hash) => store_hash,
+            None => return false,
+        };
+        let value_matches = self.value_proof.proof.as_ref().map_or(false, |exist| exist.value == value);
+
+        value_matches
+            && verify_merkle_existence(&self.value_proof, key, &store_hash)
+            && verify_merkle_existence(&self.store_proof, self.store.as_bytes(), &self.app_hash)
+    }
+}
+
+impl BlockModule {
+    /// App hash committed at `height` and the ICS-23 proof of a store hash
+    /// in it
+    pub fn prove_store(&self, height: u64, store: &str) -> Result<(String, CommitmentProof), String> {
+        let header = self.block(height)
+            .ok_or_else(|| format!("No header at height {}", height))?;
+        let store_hashes = self.store_hashes.get(&height)
+            .ok_or_else(|| format!("Store hashes of height {} are not available", height))?;
+
+        let index = store_hashes.iter()
+            .position(|(name, _)| name == store)
+            .ok_or_else(|| format!("Store {} is not committed at height {}", store, height))?;
+
+        let entries: Vec<(Vec<u8>, Vec<u8>)> = store_hashes.into_iter()
+            .map(|(name, hash)| (name.into_bytes(), hash))
+            .collect();
+
+        Ok((header.app_hash, merkle_existence_proof(&entries, index)))
+    }
+
+    /// Proof of `key` in a store up to the latest committed app hash
+    ///
+    /// `entries` are the store's current `(key, value)` leaves in the order
+    /// its store hash commits them. Fails if they no longer hash to the
+    /// committed store hash: state changed since the last commit cannot be
+    /// proven against any header yet. Absent keys cannot be proven either.
+    pub fn prove_value(&self, store: &str, entries: &[(Vec<u8>, Vec<u8>)], key: &[u8]) -> Result<QueryProof, String> {
+        let height = self.latest_height();
+        let (app_hash, store_proof) = self.prove_store(height, store)?;
+
+        let committed = store_proof.proof.as_ref().map(|exist| exist.value.clone());
+        if committed != Some(merkle_root(&entry_leaves(entries))) {
+            return Err(format!(
+                "Store {} changed since height {}, query again after the next commit",
+                store, height
+            ));
+        }
+        let index = entries.iter()
+            .position(|(entry_key, _)| entry_key.as_slice() == key)
+            .ok_or_else(|| format!("Key {} is not in store {}", String::from_utf8_lossy(key), store))?;
+
+        Ok(QueryProof {
+            height,
+            app_hash,
+            store: store.to_string(),
+            value_proof: merkle_existence_proof(entries, index),
+            store_proof,
+        })
+    }
+
+    /// Wrap a query result read from `key` of `store`
+    ///
+    /// With `prove` the proof is taken against the latest committed header,
+    /// which is then also the reported height. `entries` gives the store's
+    /// leaves as for `prove_value` and is only read when a proof is asked for.
+    pub fn query_envelope<T>(
+        &self,
+        store: &str,
+        key: &[u8],
+        value: T,
+        prove: bool,
+        entries: impl FnOnce() -> Vec<(Vec<u8>, Vec<u8>)>,
+    ) -> Result<QueryEnvelope<T>, String> {
+        if !prove {
+            return Ok(QueryEnvelope {
+                height: env::block_height(),
+                value,
+                proof: None,
+            });
+        }
+
+        let proof = self.prove_value(store, &entries(), key)?;
+        Ok(QueryEnvelope {
+            height: proof.height,
+            value,
+            proof: Some(proof),
+        })
+    }
+}
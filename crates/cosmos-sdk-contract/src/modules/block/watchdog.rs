@@ -0,0 +1,177 @@
+/// Block Watchdog
+///
+/// A bug that breaks supply or staking accounting gets worse with every
+/// block built on top of it. The watchdog runs a few cheap invariants after
+/// each height `process_blocks_with_watchdog` processes. On the first
+/// violation it emits a critical event, trips the feature flag of the
+/// module at fault so no further messages reach it, and ends the call at
+/// that height. Until the state is repaired, every later call stops after
+/// a single height again.
+
+use near_sdk::env;
+use near_sdk::serde::{Deserialize, Serialize};
+use schemars::JsonSchema;
+
+use super::{BlockModule, CatchUpProgress};
+use crate::handler::feature_flags::FeatureFlags;
+use crate::handler::telemetry::NoopTelemetry;
+use crate::modules::bank::BankModule;
+use crate::modules::gov::GovernanceModule;
+use crate::modules::staking::StakingModule;
+
+/// Name recorded as the account that disabled a module
+pub const WATCHDOG: &str = "watchdog";
+
+/// Invariant that failed at a height
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct InvariantViolation {
+    /// Module whose feature flag is tripped
+    pub module: String,
+    /// Route of the invariant, e.g. `staking/bonded-total`
+    pub invariant: String,
+    pub height: u64,
+    pub detail: String,
+}
+
+/// Outcome of a `process_blocks_with_watchdog` call
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct WatchdogProgress {
+    pub progress: CatchUpProgress,
+    /// Violations found after the last processed height, empty if none
+    pub violations: Vec<InvariantViolation>,
+}
+
+/// Run the watchdog's invariants, returning the failed ones
+///
+/// Each check is bounded by the validator count at worst, so it is cheap
+/// enough to run after every block.
+pub fn check_invariants(bank: &BankModule, staking: &StakingModule, height: u64) -> Vec<InvariantViolation> {
+    let violation = |module: &str, invariant: &str, detail: String| InvariantViolation {
+        module: module.to_string(),
+        invariant: invariant.to_string(),
+        height,
+        detail,
+    };
+    let mut violations = Vec::new();
+
+    let bond_denom = staking.bond_denom();
+    let (bonded, not_bonded) = staking.pool_balances(bank);
+    let pooled = bonded.saturating_add(not_bonded);
+    let supply = bank.supply_of(&bond_denom);
+    if pooled > supply {
+        violations.push(violation("bank", "bank/total-supply", format!(
+            "Staking pools hold {} {} but the supply is {}", pooled, bond_denom, supply
+        )));
+    }
+
+    if let Err(detail) = staking.check_pool_invariant(bank) {
+        violations.push(violation("staking", "staking/module-accounts", detail));
+    }
+
+    let pool = staking.get_pool();
+    let validator_tokens: u128 = staking.get_all_validators().iter().map(|validator| validator.tokens).sum();
+    if validator_tokens != pool.bonded_tokens {
+        violations.push(violation("staking", "staking/bonded-total", format!(
+            "Validators hold {} tokens but the bonded pool tracks {}", validator_tokens, pool.bonded_tokens
+        )));
+    }
+    violations
+}
+
+impl BlockModule {
+    /// `process_blocks` with the invariants checked after every height
+    pub fn process_blocks_with_watchdog(
+        &mut self,
+        n: u64,
+        bank: &BankModule,
+        staking: &mut StakingModule,
+        gov: &mut GovernanceModule,
+        flags: &mut FeatureFlags,
+    ) -> WatchdogProgress {
+        let mut violations = Vec::new();
+        let progress = self.process_blocks_until(n, staking, gov, &mut NoopTelemetry, |height, staking| {
+            violations = check_invariants(bank, staking, height);
+            violations.is_empty()
+        });
+
+        for violation in &violations {
+            env::log_str(&format!(
+                "EVENT: invariant_broken severity=critical module={} invariant={} height={} detail={}",
+                violation.module, violation.invariant, violation.height, violation.detail
+            ));
+            flags.trip(&violation.module, WATCHDOG, format!("{}: {}", violation.invariant, violation.detail));
+        }
+        WatchdogProgress { progress, violations }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::modules::staking::bonded_pool_account;
+    use near_sdk::test_utils::VMContextBuilder;
+    use near_sdk::{testing_env, AccountId};
+
+    fn at_height(height: u64) {
+        testing_env!(VMContextBuilder::new().block_height(height).build());
+    }
+
+    fn setup() -> (BlockModule, BankModule, StakingModule, GovernanceModule, FeatureFlags) {
+        let mut bank = BankModule::new();
+        let mut staking = StakingModule::new();
+        bank.mint_denom(&bonded_pool_account(), "stake", 1_000);
+        staking.create_validator(
+            "validator1".to_string(),
+            vec![1; 32],
+            "Validator One".to_string(),
+            None,
+            None,
+            None,
+            None,
+            "0.1".to_string(),
+            "0.2".to_string(),
+            "0.01".to_string(),
+            1,
+            1_000,
+        ).unwrap();
+        let flags = FeatureFlags::new("admin.near".parse().unwrap());
+        (BlockModule::new("proxima-testnet".to_string()), bank, staking, GovernanceModule::new(), flags)
+    }
+
+    #[test]
+    fn test_healthy_blocks_pass() {
+        at_height(1);
+        let (mut blocks, bank, mut staking, mut gov, mut flags) = setup();
+        assert!(check_invariants(&bank, &staking, 1).is_empty());
+
+        at_height(5);
+        let result = blocks.process_blocks_with_watchdog(10, &bank, &mut staking, &mut gov, &mut flags);
+        assert!(result.violations.is_empty());
+        assert_eq!(result.progress.to_height, 5);
+        assert!(flags.disabled_modules().is_empty());
+    }
+
+    #[test]
+    fn test_violation_trips_module_and_halts() {
+        at_height(1);
+        let (mut blocks, mut bank, mut staking, mut gov, mut flags) = setup();
+        blocks.process_blocks(1, &mut staking, &mut gov);
+
+        // Tokens leave the bonded pool without going through staking
+        let thief: AccountId = "thief.near".parse().unwrap();
+        bank.transfer_denom(&bonded_pool_account(), &thief, "stake", 100);
+
+        at_height(20);
+        let result = blocks.process_blocks_with_watchdog(10, &bank, &mut staking, &mut gov, &mut flags);
+        assert_eq!(result.progress.processed, 1);
+        assert_eq!(result.progress.remaining, 18);
+        assert_eq!(result.violations[0].invariant, "staking/module-accounts");
+        assert!(!flags.is_enabled("staking"));
+        assert_eq!(flags.disabled_modules()[0].disabled_by, WATCHDOG);
+
+        // Every further call stops at the next height until state is repaired
+        let result = blocks.process_blocks_with_watchdog(10, &bank, &mut staking, &mut gov, &mut flags);
+        assert_eq!(result.progress.processed, 1);
+        assert!(!result.violations.is_empty());
+    }
+}
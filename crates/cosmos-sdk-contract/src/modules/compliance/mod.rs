@@ -0,0 +1,256 @@
+/// Compliance Hooks
+///
+/// Opt-in restrictions on bank sends, controlled by governance. In deny list
+/// mode transfers touching a listed address are blocked; in allow list mode
+/// only listed addresses may send and receive. Frozen accounts cannot send in
+/// either mode. The module plugs into the bank as a `SendRestriction`, and
+/// every list change and every blocked transfer is logged as an event so the
+/// rules can be audited from the chain history.
+
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::collections::UnorderedSet;
+use near_sdk::serde::{Deserialize, Serialize};
+use near_sdk::{env, AccountId};
+use schemars::JsonSchema;
+
+use crate::modules::bank::SendRestriction;
+use crate::types::Authority;
+use crate::Balance;
+
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Copy, Debug, PartialEq, JsonSchema)]
+#[serde(rename_all = "snake_case")]
+pub enum ComplianceMode {
+    /// No restrictions apply, the default
+    Disabled,
+    /// Block transfers to or from denied addresses
+    DenyList,
+    /// Only allow transfers between allowed addresses
+    AllowList,
+}
+
+impl ComplianceMode {
+    fn as_str(&self) -> &'static str {
+        match self {
+            ComplianceMode::Disabled => "disabled",
+            ComplianceMode::DenyList => "deny_list",
+            ComplianceMode::AllowList => "allow_list",
+        }
+    }
+}
+
+#[derive(BorshDeserialize, BorshSerialize)]
+pub struct ComplianceModule {
+    /// Governance account; defaults to this contract
+    authority: Authority,
+    mode: ComplianceMode,
+    denied: UnorderedSet<String>,
+    allowed: UnorderedSet<String>,
+    frozen: UnorderedSet<String>,
+}
+
+impl ComplianceModule {
+    pub fn new() -> Self {
+        Self {
+            authority: Authority::default(),
+            mode: ComplianceMode::Disabled,
+            denied: UnorderedSet::new(b"compliance_denied".to_vec()),
+            allowed: UnorderedSet::new(b"compliance_allowed".to_vec()),
+            frozen: UnorderedSet::new(b"compliance_frozen".to_vec()),
+        }
+    }
+
+    /// Account that governance acts through
+    pub fn authority(&self) -> AccountId {
+        self.authority.account()
+    }
+
+    pub fn set_authority(&mut self, sender: &AccountId, new_authority: AccountId) -> Result<(), String> {
+        self.authority.transfer(sender, new_authority)
+    }
+
+    fn assert_authority(&self, sender: &AccountId) -> Result<(), String> {
+        self.authority.check(sender, "Only the governance authority can change compliance rules")
+    }
+
+    pub fn mode(&self) -> ComplianceMode {
+        self.mode
+    }
+
+    pub fn set_mode(&mut self, sender: &AccountId, mode: ComplianceMode) -> Result<(), String> {
+        self.assert_authority(sender)?;
+        self.mode = mode;
+        env::log_str(&format!("EVENT: compliance_mode mode={} by={}", mode.as_str(), sender));
+        Ok(())
+    }
+
+    pub fn deny_address(&mut self, sender: &AccountId, address: String) -> Result<(), String> {
+        self.assert_authority(sender)?;
+        if !self.denied.insert(&address) {
+            return Err(format!("Address {} is already denied", address));
+        }
+        env::log_str(&format!("EVENT: compliance_deny address={} by={}", address, sender));
+        Ok(())
+    }
+
+    pub fn undeny_address(&mut self, sender: &AccountId, address: String) -> Result<(), String> {
+        self.assert_authority(sender)?;
+        if !self.denied.remove(&address) {
+            return Err(format!("Address {} is not denied", address));
+        }
+        env::log_str(&format!("EVENT: compliance_undeny address={} by={}", address, sender));
+        Ok(())
+    }
+
+    pub fn allow_address(&mut self, sender: &AccountId, address: String) -> Result<(), String> {
+        self.assert_authority(sender)?;
+        if !self.allowed.insert(&address) {
+            return Err(format!("Address {} is already allowed", address));
+        }
+        env::log_str(&format!("EVENT: compliance_allow address={} by={}", address, sender));
+        Ok(())
+    }
+
+    pub fn disallow_address(&mut self, sender: &AccountId, address: String) -> Result<(), String> {
+        self.assert_authority(sender)?;
+        if !self.allowed.remove(&address) {
+            return Err(format!("Address {} is not allowed", address));
+        }
+        env::log_str(&format!("EVENT: compliance_disallow address={} by={}", address, sender));
+        Ok(())
+    }
+
+    pub fn freeze_account(&mut self, sender: &AccountId, address: String, reason: String) -> Result<(), String> {
+        self.assert_authority(sender)?;
+        if !self.frozen.insert(&address) {
+            return Err(format!("Account {} is already frozen", address));
+        }
+        env::log_str(&format!("EVENT: compliance_freeze address={} by={} reason={}", address, sender, reason));
+        Ok(())
+    }
+
+    pub fn unfreeze_account(&mut self, sender: &AccountId, address: String) -> Result<(), String> {
+        self.assert_authority(sender)?;
+        if !self.frozen.remove(&address) {
+            return Err(format!("Account {} is not frozen", address));
+        }
+        env::log_str(&format!("EVENT: compliance_unfreeze address={} by={}", address, sender));
+        Ok(())
+    }
+
+    pub fn is_denied(&self, address: &str) -> bool {
+        self.denied.contains(&address.to_string())
+    }
+
+    pub fn is_allowed(&self, address: &str) -> bool {
+        self.allowed.contains(&address.to_string())
+    }
+
+    pub fn is_frozen(&self, address: &str) -> bool {
+        self.frozen.contains(&address.to_string())
+    }
+
+    pub fn get_denied(&self) -> Vec<String> {
+        self.denied.to_vec()
+    }
+
+    pub fn get_allowed(&self) -> Vec<String> {
+        self.allowed.to_vec()
+    }
+
+    pub fn get_frozen(&self) -> Vec<String> {
+        self.frozen.to_vec()
+    }
+
+    /// Reason a transfer is blocked, if any
+    fn violation(&self, from: &str, to: &str) -> Option<String> {
+        if self.mode == ComplianceMode::Disabled {
+            return None;
+        }
+        if self.is_frozen(from) {
+            return Some(format!("account {} is frozen", from));
+        }
+
+        match self.mode {
+            ComplianceMode::DenyList => [from, to].into_iter()
+                .find(|address| self.is_denied(address))
+                .map(|address| format!("address {} is denied", address)),
+            ComplianceMode::AllowList => [from, to].into_iter()
+                .find(|address| !self.is_allowed(address))
+                .map(|address| format!("address {} is not allowed", address)),
+            ComplianceMode::Disabled => None,
+        }
+    }
+}
+
+impl SendRestriction for ComplianceModule {
+    fn check_send(&self, from: &AccountId, to: &AccountId, amount: Balance) -> Result<(), String> {
+        match self.violation(from.as_str(), to.as_str()) {
+            Some(reason) => {
+                env::log_str(&format!(
+                    "EVENT: compliance_blocked from={} to={} amount={} reason={}",
+                    from, to, amount, reason
+                ));
+                Err(format!("Transfer blocked by compliance: {}", reason))
+            }
+            None => Ok(()),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::modules::bank::BankModule;
+
+    fn account(name: &str) -> AccountId {
+        name.parse().unwrap()
+    }
+
+    #[test]
+    fn test_deny_list_and_freeze() {
+        let mut compliance = ComplianceModule::new();
+        let gov = compliance.authority();
+        let (alice, bob, mallory) = (account("alice.near"), account("bob.near"), account("mallory.near"));
+
+        let mut bank = BankModule::new();
+        bank.mint(&alice, 100);
+        bank.mint(&mallory, 100);
+
+        assert!(compliance.deny_address(&alice, mallory.to_string()).is_err());
+        compliance.deny_address(&gov, mallory.to_string()).unwrap();
+
+        // Lists have no effect until governance opts in
+        bank.send(&compliance, &mallory, &bob, 10).unwrap();
+
+        compliance.set_mode(&gov, ComplianceMode::DenyList).unwrap();
+        assert!(bank.send(&compliance, &mallory, &bob, 10).is_err());
+        assert!(bank.send(&compliance, &alice, &mallory, 10).is_err());
+        bank.send(&compliance, &alice, &bob, 10).unwrap();
+
+        compliance.freeze_account(&gov, alice.to_string(), "court order".to_string()).unwrap();
+        assert!(bank.send(&compliance, &alice, &bob, 10).unwrap_err().contains("frozen"));
+        bank.send(&compliance, &bob, &alice, 5).unwrap();
+
+        compliance.unfreeze_account(&gov, alice.to_string()).unwrap();
+        bank.send(&compliance, &alice, &bob, 10).unwrap();
+        assert_eq!(bank.get_balance(&bob), 25);
+    }
+
+    #[test]
+    fn test_allow_list() {
+        let mut compliance = ComplianceModule::new();
+        let gov = compliance.authority();
+        let (alice, bob) = (account("alice.near"), account("bob.near"));
+
+        let mut bank = BankModule::new();
+        bank.mint(&alice, 100);
+
+        compliance.set_mode(&gov, ComplianceMode::AllowList).unwrap();
+        compliance.allow_address(&gov, alice.to_string()).unwrap();
+        assert!(bank.send(&compliance, &alice, &bob, 10).unwrap_err().contains("not allowed"));
+
+        compliance.allow_address(&gov, bob.to_string()).unwrap();
+        bank.send(&compliance, &alice, &bob, 10).unwrap();
+        assert_eq!(compliance.get_allowed().len(), 2);
+    }
+}
@@ -3,7 +3,7 @@ use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
 use near_sdk::serde::{Deserialize, Serialize};
 
 use crate::modules::cosmwasm::{
-    storage::CosmWasmStorage,
+    storage::{CosmWasmStorage, ReadOnlyStore},
     api::CosmWasmApi,
     deps::{CosmWasmDeps, CosmWasmDepsMut},
     env::{get_cosmwasm_env, get_message_info},
@@ -119,12 +119,15 @@ impl CosmWasmContractWrapper {
     }
     
     /// Query the wrapped CosmWasm contract (read-only)
+    /// 
+    /// The query only sees the storage through a `ReadOnlyStore`, so a write
+    /// panics instead of being lost when this runs as a view call.
     pub fn query(&self, msg: WrapperQueryMsg) -> WrapperResponse {
         if !self.initialized {
             return WrapperResponse::error("Contract not initialized");
         }
         
-        match self.call_query(msg.contract_msg) {
+        match self.call_query(ReadOnlyStore::new(&self.storage), msg.contract_msg) {
             Ok(data) => WrapperResponse::success(Some(data)),
             Err(e) => WrapperResponse::error(&e),
         }
@@ -262,9 +265,9 @@ impl CosmWasmContractWrapper {
     }
     
     /// Call the CosmWasm contract's query function
-    fn call_query(&self, msg_json: String) -> Result<String, String> {
+    fn call_query(&self, storage: ReadOnlyStore, msg_json: String) -> Result<String, String> {
         // Create dependencies (read-only)
-        let deps = CosmWasmDeps::new(&self.storage, &self.api);
+        let deps = CosmWasmDeps::new(storage, &self.api);
         let _env = get_cosmwasm_env();
         
         env::log_str(&format!("COSMWASM_QUERY: {}", msg_json));
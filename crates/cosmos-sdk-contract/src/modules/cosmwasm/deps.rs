@@ -1,29 +1,49 @@
-use crate::modules::cosmwasm::types::{Deps, DepsMut, Storage, Api, QuerierWrapper, Querier, Coin, StdResult, StdError};
-use crate::modules::cosmwasm::storage::CosmWasmStorage;
+use crate::modules::cosmwasm::types::{
+    Deps, DepsMut, Storage, Api, QuerierWrapper, Querier, Coin, StdResult, StdError, Uint128, Binary,
+    QueryRequest, BankQuery, StakingQuery, GovQuery, OracleQuery, BalanceResponse, AllBalanceResponse,
+    BondedDenomResponse, ValidatorInfo, AllValidatorsResponse, ValidatorResponse, FullDelegation,
+    DelegationResponse, AllDelegationsResponse, ProposalResponse, VotingPowerResponse, PriceResponse, to_binary,
+};
+use crate::modules::cosmwasm::storage::{CosmWasmStorage, ReadOnlyStore};
 use crate::modules::cosmwasm::api::CosmWasmApi;
+use crate::modules::bank::BankModule;
+use crate::modules::staking::{StakingModule, Validator, Delegation};
+use crate::modules::gov::GovernanceModule;
+use crate::modules::ibc::oracle::OracleModule;
+
+/// Querier used when no module state is wired in
+static DEFAULT_QUERIER: CosmWasmQuerier = CosmWasmQuerier;
 
 /// Implementation of CosmWasm Deps for immutable access
+/// 
+/// Storage is the `ReadOnlyStore` the query entrypoint opened, so query
+/// handlers can never write, even through a cast back to a mutable store.
 pub struct CosmWasmDeps<'a> {
-    storage: &'a CosmWasmStorage,
+    storage: ReadOnlyStore<'a>,
     api: &'a CosmWasmApi,
-    querier: CosmWasmQuerier,
+    querier: &'a dyn Querier,
 }
 
 impl<'a> CosmWasmDeps<'a> {
-    pub fn new(storage: &'a CosmWasmStorage, api: &'a CosmWasmApi) -> Self {
+    pub fn new(storage: ReadOnlyStore<'a>, api: &'a CosmWasmApi) -> Self {
+        Self::with_querier(storage, api, &DEFAULT_QUERIER)
+    }
+    
+    /// Create deps whose querier answers from module state
+    pub fn with_querier(storage: ReadOnlyStore<'a>, api: &'a CosmWasmApi, querier: &'a dyn Querier) -> Self {
         Self {
             storage,
             api,
-            querier: CosmWasmQuerier::new(),
+            querier,
         }
     }
     
     /// Convert to standard Deps type that CosmWasm contracts expect
     pub fn as_deps(&self) -> Deps<'_> {
         Deps {
-            storage: self.storage as &dyn Storage,
+            storage: &self.storage as &dyn Storage,
             api: self.api as &dyn Api,
-            querier: QuerierWrapper::new(&self.querier as &dyn Querier),
+            querier: QuerierWrapper::new(self.querier),
         }
     }
 }
@@ -32,15 +52,20 @@ impl<'a> CosmWasmDeps<'a> {
 pub struct CosmWasmDepsMut<'a> {
     storage: &'a mut CosmWasmStorage,
     api: &'a CosmWasmApi,
-    querier: CosmWasmQuerier,
+    querier: &'a dyn Querier,
 }
 
 impl<'a> CosmWasmDepsMut<'a> {
     pub fn new(storage: &'a mut CosmWasmStorage, api: &'a CosmWasmApi) -> Self {
+        Self::with_querier(storage, api, &DEFAULT_QUERIER)
+    }
+    
+    /// Create mutable deps whose querier answers from module state
+    pub fn with_querier(storage: &'a mut CosmWasmStorage, api: &'a CosmWasmApi, querier: &'a dyn Querier) -> Self {
         Self {
             storage,
             api,
-            querier: CosmWasmQuerier::new(),
+            querier,
         }
     }
     
@@ -49,7 +74,7 @@ impl<'a> CosmWasmDepsMut<'a> {
         DepsMut {
             storage: self.storage as &mut dyn Storage,
             api: self.api as &dyn Api,
-            querier: QuerierWrapper::new(&self.querier as &dyn Querier),
+            querier: QuerierWrapper::new(self.querier),
         }
     }
     
@@ -58,7 +83,7 @@ impl<'a> CosmWasmDepsMut<'a> {
         Deps {
             storage: self.storage as &dyn Storage,
             api: self.api as &dyn Api,
-            querier: QuerierWrapper::new(&self.querier as &dyn Querier),
+            querier: QuerierWrapper::new(self.querier),
         }
     }
 }
@@ -83,8 +108,6 @@ impl Querier for CosmWasmQuerier {
         // 2. Query the Bank module for the balance
         // 3. Convert the result to Coin format
         
-        use crate::modules::cosmwasm::types::Uint128;
-        
         // Special handling for NEAR native token
         if denom == "near" {
             // Would query NEAR balance
@@ -135,6 +158,194 @@ impl CosmWasmQuerier {
     }
 }
 
+/// Querier that answers contract queries from the bank, staking, gov and
+/// oracle modules
+///
+/// Staking, gov and the oracle are optional so contracts hosted next to only a bank
+/// module can still query balances; queries against a missing module fail.
+pub struct ModuleQuerier<'a> {
+    bank: &'a BankModule,
+    staking: Option<&'a StakingModule>,
+    gov: Option<&'a GovernanceModule>,
+    oracle: Option<&'a OracleModule>,
+}
+
+impl<'a> ModuleQuerier<'a> {
+    pub fn new(bank: &'a BankModule) -> Self {
+        Self {
+            bank,
+            staking: None,
+            gov: None,
+            oracle: None,
+        }
+    }
+    
+    pub fn with_staking(mut self, staking: &'a StakingModule) -> Self {
+        self.staking = Some(staking);
+        self
+    }
+    
+    pub fn with_gov(mut self, gov: &'a GovernanceModule) -> Self {
+        self.gov = Some(gov);
+        self
+    }
+    
+    pub fn with_oracle(mut self, oracle: &'a OracleModule) -> Self {
+        self.oracle = Some(oracle);
+        self
+    }
+    
+    fn staking(&self) -> StdResult<&'a StakingModule> {
+        self.staking.ok_or_else(|| StdError::generic_err("Staking module not available"))
+    }
+    
+    fn bonded_denom(&self) -> StdResult<String> {
+        Ok(self.staking()?.get_params().bond_denom)
+    }
+    
+    fn to_validator_info(validator: Validator) -> ValidatorInfo {
+        ValidatorInfo {
+            address: validator.address,
+            commission: validator.commission.commission_rates.rate,
+            max_commission: validator.commission.commission_rates.max_rate,
+            max_change_rate: validator.commission.commission_rates.max_change_rate,
+        }
+    }
+    
+    /// Delegation with its shares valued at the validator's tokens per share
+    fn to_full_delegation(&self, delegation: Delegation) -> StdResult<FullDelegation> {
+        delegation.shares.parse::<u128>()
+            .map_err(|e| StdError::parse_err("u128", e.to_string()))?;
+        let amount = self.staking()?.delegation_tokens(&delegation);
+        Ok(FullDelegation {
+            delegator: delegation.delegator_address,
+            validator: delegation.validator_address,
+            amount: Coin {
+                denom: self.bonded_denom()?,
+                amount: Uint128::new(amount),
+            },
+        })
+    }
+    
+    fn query_bank(&self, query: &BankQuery) -> StdResult<Binary> {
+        match query {
+            BankQuery::Balance { address, denom } => {
+                to_binary(&BalanceResponse { amount: self.query_balance(address.clone(), denom.clone())? })
+            }
+            BankQuery::AllBalances { address } => {
+                let account = address.parse()
+                    .map_err(|_| StdError::generic_err(format!("Invalid address: {}", address)))?;
+                let amount = self.bank.get_all_balances(account)
+                    .into_vec()
+                    .into_iter()
+                    .map(|coin| Coin { denom: coin.denom, amount: Uint128::new(coin.amount) })
+                    .collect();
+                to_binary(&AllBalanceResponse { amount })
+            }
+        }
+    }
+    
+    fn query_staking(&self, query: &StakingQuery) -> StdResult<Binary> {
+        let staking = self.staking()?;
+        match query {
+            StakingQuery::BondedDenom {} => to_binary(&BondedDenomResponse { denom: self.bonded_denom()? }),
+            StakingQuery::AllValidators {} => to_binary(&AllValidatorsResponse {
+                validators: staking.get_bonded_validators()
+                    .into_iter()
+                    .map(Self::to_validator_info)
+                    .collect(),
+            }),
+            StakingQuery::Validator { address } => to_binary(&ValidatorResponse {
+                validator: staking.get_validator(address.clone()).map(Self::to_validator_info),
+            }),
+            StakingQuery::Delegation { delegator, validator } => {
+                let delegation = match staking.get_delegation(delegator.clone(), validator.clone()) {
+                    Some(delegation) => Some(self.to_full_delegation(delegation)?),
+                    None => None,
+                };
+                to_binary(&DelegationResponse { delegation })
+            }
+            StakingQuery::AllDelegations { delegator } => {
+                let delegations = staking.get_delegations(delegator.clone())
+                    .into_iter()
+                    .map(|delegation| self.to_full_delegation(delegation))
+                    .collect::<StdResult<Vec<_>>>()?;
+                to_binary(&AllDelegationsResponse { delegations })
+            }
+            StakingQuery::VotingPower { delegator, epoch } => {
+                let (epoch, height, power) = staking.voting_power_at(delegator, *epoch)
+                    .ok_or_else(|| StdError::not_found("voting power snapshot"))?;
+                to_binary(&VotingPowerResponse { epoch, height, power: Uint128::new(power) })
+            }
+            StakingQuery::TotalVotingPower { epoch } => {
+                let snapshot = staking.get_voting_power_snapshot(*epoch)
+                    .ok_or_else(|| StdError::not_found("voting power snapshot"))?;
+                to_binary(&VotingPowerResponse {
+                    epoch: snapshot.epoch,
+                    height: snapshot.height,
+                    power: Uint128::new(snapshot.total_power),
+                })
+            }
+        }
+    }
+    
+    fn query_gov(&self, query: &GovQuery) -> StdResult<Binary> {
+        let gov = self.gov.ok_or_else(|| StdError::generic_err("Gov module not available"))?;
+        match query {
+            GovQuery::Proposal { proposal_id } => {
+                let proposal = gov.get_proposal(*proposal_id)
+                    .ok_or_else(|| StdError::not_found("proposal"))?;
+                to_binary(&ProposalResponse {
+                    id: proposal.id,
+                    title: proposal.title,
+                    status: format!("{:?}", proposal.status),
+                    yes_votes: proposal.yes_votes,
+                    no_votes: proposal.no_votes,
+                    end_height: proposal.end_height,
+                })
+            }
+        }
+    }
+    
+    fn query_oracle(&self, query: &OracleQuery) -> StdResult<Binary> {
+        let oracle = self.oracle.ok_or_else(|| StdError::generic_err("Oracle module not available"))?;
+        match query {
+            OracleQuery::Price { denom } => {
+                let price = oracle.price(denom).map_err(StdError::generic_err)?;
+                to_binary(&PriceResponse {
+                    denom: price.denom,
+                    price: Uint128::new(price.price),
+                    timestamp: price.timestamp,
+                    sources: price.sources,
+                })
+            }
+        }
+    }
+}
+
+impl<'a> Querier for ModuleQuerier<'a> {
+    fn query_balance(&self, address: String, denom: String) -> StdResult<Coin> {
+        let account = address.parse()
+            .map_err(|_| StdError::generic_err(format!("Invalid address: {}", address)))?;
+        
+        let amount = self.bank.get_denom_balance(&account, &denom);
+        
+        Ok(Coin {
+            denom,
+            amount: Uint128::new(amount),
+        })
+    }
+    
+    fn query_module(&self, request: &QueryRequest) -> StdResult<Binary> {
+        match request {
+            QueryRequest::Bank(query) => self.query_bank(query),
+            QueryRequest::Staking(query) => self.query_staking(query),
+            QueryRequest::Gov(query) => self.query_gov(query),
+            QueryRequest::Oracle(query) => self.query_oracle(query),
+        }
+    }
+}
+
 /// Helper structures for extended queries
 #[derive(Default)]
 pub struct StakingInfo {
@@ -160,6 +371,7 @@ pub struct IbcChannelInfo {
 #[cfg(test)]
 mod tests {
     use super::*;
+    use crate::modules::staking::{ValidatorStatus, ValidatorDescription, Commission, CommissionRates};
     use near_sdk::test_utils::VMContextBuilder;
     use near_sdk::testing_env;
     
@@ -178,7 +390,7 @@ mod tests {
         let api = CosmWasmApi::new();
         
         // Test immutable deps
-        let deps = CosmWasmDeps::new(&storage, &api);
+        let deps = CosmWasmDeps::new(ReadOnlyStore::new(&storage), &api);
         let std_deps = deps.as_deps();
         
         // Verify we can access storage through deps
@@ -217,4 +429,153 @@ mod tests {
         let balances = querier.query_all_balances("alice.near".to_string()).unwrap();
         assert_eq!(balances.len(), 0);
     }
+    
+    #[test]
+    fn test_module_querier_bank() {
+        setup_context();
+        
+        let mut bank = BankModule::new();
+        bank.mint(&"alice.near".parse().unwrap(), 750);
+        
+        let querier = ModuleQuerier::new(&bank);
+        let storage = CosmWasmStorage::new();
+        let api = CosmWasmApi::new();
+        let deps = CosmWasmDeps::with_querier(ReadOnlyStore::new(&storage), &api, &querier);
+        let std_deps = deps.as_deps();
+        
+        let balance = std_deps.querier.query_balance("alice.near", "unear").unwrap();
+        assert_eq!(balance.amount.u128(), 750);
+        
+        let balances = std_deps.querier.query_all_balances("alice.near").unwrap();
+        assert_eq!(balances.len(), 1);
+        assert_eq!(balances[0].denom, "unear");
+        
+        // Staking queries fail without a staking module
+        assert!(std_deps.querier.query_delegation("alice.near", "validator1").is_err());
+    }
+    
+    #[test]
+    fn test_module_querier_staking_and_gov() {
+        setup_context();
+        
+        let bank = BankModule::new();
+        let mut staking = StakingModule::new();
+        let gov = GovernanceModule::new();
+        
+        let querier = ModuleQuerier::new(&bank).with_staking(&staking).with_gov(&gov);
+        let storage = CosmWasmStorage::new();
+        let api = CosmWasmApi::new();
+        
+        {
+            let deps = CosmWasmDeps::with_querier(ReadOnlyStore::new(&storage), &api, &querier);
+            let std_deps = deps.as_deps();
+            
+            let denom: BondedDenomResponse = std_deps.querier
+                .query(&QueryRequest::Staking(StakingQuery::BondedDenom {}))
+                .unwrap();
+            assert_eq!(denom.denom, "stake");
+            
+            assert_eq!(std_deps.querier.query_delegation("alice.near", "validator1").unwrap(), None);
+            
+            let proposal: StdResult<ProposalResponse> = std_deps.querier
+                .query(&QueryRequest::Gov(GovQuery::Proposal { proposal_id: 1 }));
+            assert!(matches!(proposal, Err(StdError::NotFound { .. })));
+        }
+        
+        staking.add_validator(Validator {
+            address: "validator1".to_string(),
+            operator_address: "validator1".to_string(),
+            consensus_pubkey: vec![],
+            jailed: false,
+            status: ValidatorStatus::Bonded,
+            tokens: 0,
+            delegator_shares: "0".to_string(),
+            description: ValidatorDescription {
+                moniker: "v1".to_string(),
+                identity: String::new(),
+                website: String::new(),
+                security_contact: String::new(),
+                details: String::new(),
+            },
+            unbonding_height: 0,
+            unbonding_time: 0,
+            commission: Commission {
+                commission_rates: CommissionRates {
+                    rate: "0.1".to_string(),
+                    max_rate: "0.2".to_string(),
+                    max_change_rate: "0.01".to_string(),
+                },
+                update_time: 0,
+            },
+            min_self_delegation: 0,
+        }).unwrap();
+        staking.delegate_coin("vault.near".to_string(), "validator1".to_string(), "stake", 1000).unwrap();
+        
+        let querier = ModuleQuerier::new(&bank).with_staking(&staking);
+        let delegation = QuerierWrapper::new(&querier)
+            .query_delegation("vault.near", "validator1")
+            .unwrap()
+            .unwrap();
+        assert_eq!(delegation.amount.amount.u128(), 1000);
+        assert_eq!(delegation.amount.denom, "stake");
+        assert!(QuerierWrapper::new(&querier).query_voting_power("vault.near", None).is_err());
+        
+        staking.snapshot_voting_power(250);
+        let querier = ModuleQuerier::new(&bank).with_staking(&staking);
+        let power = QuerierWrapper::new(&querier).query_voting_power("vault.near", None).unwrap();
+        assert_eq!(power, VotingPowerResponse { epoch: 2, height: 250, power: Uint128::new(1000) });
+        let total: VotingPowerResponse = QuerierWrapper::new(&querier)
+            .query(&QueryRequest::Staking(StakingQuery::TotalVotingPower { epoch: Some(2) }))
+            .unwrap();
+        assert_eq!(total.power.u128(), 1000);
+        
+        // Shares keep their count through a slash, the queried amount does not
+        staking.slash_validator("validator1".to_string(), 0, 0, "0.1".to_string()).unwrap();
+        let querier = ModuleQuerier::new(&bank).with_staking(&staking);
+        let delegation = QuerierWrapper::new(&querier)
+            .query_delegation("vault.near", "validator1")
+            .unwrap()
+            .unwrap();
+        assert_eq!(delegation.amount.amount.u128(), 900);
+    }
+    
+    #[test]
+    fn test_module_querier_oracle() {
+        use crate::modules::ibc::channel::{Height, Packet};
+        use crate::modules::ibc::oracle::{MedianPrice, OracleHooks, PricePacketData, PriceReport, ORACLE_PORT};
+        
+        struct NoHooks;
+        impl OracleHooks for NoHooks {
+            fn after_price_updated(&mut self, _price: &MedianPrice) {}
+        }
+        
+        setup_context();
+        let bank = BankModule::new();
+        let mut oracle = OracleModule::new();
+        let querier = ModuleQuerier::new(&bank);
+        assert!(QuerierWrapper::new(&querier).query_price("ibc/ATOM").is_err());
+        
+        let gov = oracle.authority();
+        oracle.set_channel(&gov, "channel-0".to_string()).unwrap();
+        let data = PricePacketData {
+            reports: vec![PriceReport { denom: "ibc/ATOM".to_string(), source: "a".to_string(), price: 42 }],
+            timestamp: 0,
+        };
+        let packet = Packet::new(
+            1,
+            ORACLE_PORT.to_string(),
+            "channel-3".to_string(),
+            ORACLE_PORT.to_string(),
+            "channel-0".to_string(),
+            serde_json::to_vec(&data).unwrap(),
+            Height::new(0, 0),
+            0,
+        );
+        assert!(oracle.on_recv_price_packet(&packet, &mut NoHooks).is_success());
+        
+        let querier = ModuleQuerier::new(&bank).with_oracle(&oracle);
+        let price = QuerierWrapper::new(&querier).query_price("ibc/ATOM").unwrap();
+        assert_eq!(price, PriceResponse { denom: "ibc/ATOM".to_string(), price: Uint128::new(42), timestamp: 0, sources: 1 });
+        assert!(QuerierWrapper::new(&querier).query_price("ibc/OSMO").is_err());
+    }
 }
\ No newline at end of file
@@ -0,0 +1,260 @@
+/// Cross-module message dispatch for CosmWasm contracts
+///
+/// Translates the bank, staking and gov variants of `CosmosMsg` into their
+/// Cosmos SDK equivalents and routes them through the Msg router. The calling
+/// contract is always used as the signer, so a contract can only move its own
+/// funds, stake its own tokens and cast its own votes.
+
+use near_sdk::env;
+use near_sdk::json_types::Base64VecU8;
+
+use crate::handler::{route_cosmos_message, CosmosMessageHandler, HandleResponse};
+use crate::modules::cosmwasm::response::ReplyHandler;
+use crate::modules::cosmwasm::types::{
+    BankMsg, Coin, CosmosMsg, GovMsg, StakingMsg, SubMsg, VoteOption,
+};
+use crate::types::cosmos_messages::{
+    self as sdk, type_urls, MsgBeginRedelegate, MsgBurn, MsgDelegate, MsgSend, MsgUndelegate,
+    MsgVote,
+};
+
+/// Convert a CosmWasm coin into a Cosmos SDK message coin
+fn to_sdk_coin(coin: &Coin) -> sdk::Coin {
+    sdk::Coin::new(coin.denom.clone(), coin.amount.u128().to_string())
+}
+
+fn to_sdk_vote_option(vote: VoteOption) -> sdk::VoteOption {
+    match vote {
+        VoteOption::Yes => sdk::VoteOption::Yes,
+        VoteOption::No => sdk::VoteOption::No,
+        VoteOption::Abstain => sdk::VoteOption::Abstain,
+        VoteOption::NoWithVeto => sdk::VoteOption::NoWithVeto,
+    }
+}
+
+fn encode<M: serde::Serialize>(type_url: &str, msg: &M) -> Result<Option<(String, Vec<u8>)>, String> {
+    serde_json::to_vec(msg)
+        .map(|bytes| Some((type_url.to_string(), bytes)))
+        .map_err(|e| format!("Failed to encode {}: {}", type_url, e))
+}
+
+/// Build the Msg router message for a contract-emitted `CosmosMsg`
+///
+/// Returns the type URL and JSON encoded message, or `None` for variants that
+/// are not served by the Msg router (wasm and custom messages).
+pub fn to_router_msg<T>(contract: &str, msg: &CosmosMsg<T>) -> Result<Option<(String, Vec<u8>)>, String> {
+    match msg {
+        CosmosMsg::Bank(BankMsg::Send { to_address, amount }) => encode(
+            type_urls::MSG_SEND,
+            &MsgSend {
+                from_address: contract.to_string(),
+                to_address: to_address.clone(),
+                amount: amount.iter().map(to_sdk_coin).collect(),
+                memo: String::new(),
+            },
+        ),
+        CosmosMsg::Bank(BankMsg::Burn { amount }) => encode(
+            type_urls::MSG_BURN,
+            &MsgBurn {
+                from_address: contract.to_string(),
+                amount: amount.iter().map(to_sdk_coin).collect(),
+            },
+        ),
+        CosmosMsg::Staking(StakingMsg::Delegate { validator, amount }) => encode(
+            type_urls::MSG_DELEGATE,
+            &MsgDelegate {
+                delegator_address: contract.to_string(),
+                validator_address: validator.clone(),
+                amount: to_sdk_coin(amount),
+            },
+        ),
+        CosmosMsg::Staking(StakingMsg::Undelegate { validator, amount }) => encode(
+            type_urls::MSG_UNDELEGATE,
+            &MsgUndelegate {
+                delegator_address: contract.to_string(),
+                validator_address: validator.clone(),
+                amount: to_sdk_coin(amount),
+            },
+        ),
+        CosmosMsg::Staking(StakingMsg::Redelegate { src_validator, dst_validator, amount }) => encode(
+            type_urls::MSG_BEGIN_REDELEGATE,
+            &MsgBeginRedelegate {
+                delegator_address: contract.to_string(),
+                validator_src_address: src_validator.clone(),
+                validator_dst_address: dst_validator.clone(),
+                amount: to_sdk_coin(amount),
+            },
+        ),
+        CosmosMsg::Gov(GovMsg::Vote { proposal_id, vote }) => encode(
+            type_urls::MSG_VOTE,
+            &MsgVote {
+                proposal_id: *proposal_id,
+                voter: contract.to_string(),
+                option: to_sdk_vote_option(*vote),
+                metadata: String::new(),
+            },
+        ),
+        CosmosMsg::Wasm(_) | CosmosMsg::Custom(_) => Ok(None),
+    }
+}
+
+/// Route a single contract-emitted message through the Msg router
+///
+/// Returns `None` when the message is not a module message.
+pub fn dispatch_cosmos_msg<T, H: CosmosMessageHandler>(
+    handler: &mut H,
+    contract: &str,
+    msg: &CosmosMsg<T>,
+) -> Result<Option<HandleResponse>, String> {
+    let (type_url, bytes) = match to_router_msg(contract, msg)? {
+        Some(routed) => routed,
+        None => return Ok(None),
+    };
+
+    env::log_str(&format!("WASM_DISPATCH: {} from contract {}", type_url, contract));
+
+    Ok(Some(route_cosmos_message(handler, type_url, Base64VecU8(bytes))))
+}
+
+/// Route the module messages of a contract response through the Msg router
+///
+/// A failing message aborts the whole batch unless the sub-message asked for a
+/// reply on error, in which case the failure is handed back to the contract.
+/// Wasm and custom messages are skipped and left to the caller.
+///
+/// Every message is translated before any is routed, so a malformed batch is
+/// refused with nothing applied. A message failing after earlier ones were
+/// applied panics: NEAR discards every state change of a receipt that
+/// panics, so the messages already applied roll back with it, as a failed
+/// sub-message reverts the whole execution in `x/wasm`.
+pub fn dispatch_sub_messages<T, H: CosmosMessageHandler>(
+    handler: &mut H,
+    contract: &str,
+    messages: &[SubMsg<T>],
+) -> Result<Vec<HandleResponse>, String> {
+    let mut routed = Vec::new();
+    for sub_msg in messages {
+        if let Some((type_url, bytes)) = to_router_msg(contract, &sub_msg.msg)? {
+            routed.push((sub_msg, type_url, bytes));
+        }
+    }
+
+    let mut responses = Vec::new();
+    let mut applied = false;
+    for (sub_msg, type_url, bytes) in routed {
+        env::log_str(&format!("WASM_DISPATCH: {} from contract {}", type_url, contract));
+        let response = route_cosmos_message(handler, type_url, Base64VecU8(bytes));
+
+        let success = response.code == 0;
+        let reply = ReplyHandler {
+            msg_id: sub_msg.id,
+            reply_on: sub_msg.reply_on,
+        };
+
+        if !success && !reply.should_reply(false) {
+            let error = format!("Sub-message {} from {} failed: {}", sub_msg.id, contract, response.log);
+            if !applied {
+                return Err(error);
+            }
+            env::panic_str(&error);
+        }
+
+        applied |= success;
+        reply.process_reply(success, Some(response.data.clone().into()));
+        responses.push(response);
+    }
+
+    Ok(responses)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::modules::cosmwasm::types::{Binary, Empty, Uint128, WasmMsg};
+
+    fn coin(amount: u128) -> Coin {
+        Coin {
+            denom: "stake".to_string(),
+            amount: Uint128::new(amount),
+        }
+    }
+
+    #[test]
+    fn test_bank_send_uses_contract_as_sender() {
+        let msg: CosmosMsg<Empty> = CosmosMsg::Bank(BankMsg::Send {
+            to_address: "bob.near".to_string(),
+            amount: vec![coin(500)],
+        });
+
+        let (type_url, bytes) = to_router_msg("dao.contract.near", &msg).unwrap().unwrap();
+        assert_eq!(type_url, type_urls::MSG_SEND);
+
+        let send: MsgSend = serde_json::from_slice(&bytes).unwrap();
+        assert_eq!(send.from_address, "dao.contract.near");
+        assert_eq!(send.to_address, "bob.near");
+        assert_eq!(send.amount, vec![sdk::Coin::new("stake", "500")]);
+    }
+
+    #[test]
+    fn test_staking_messages() {
+        let msg: CosmosMsg<Empty> = CosmosMsg::Staking(StakingMsg::Delegate {
+            validator: "validator1".to_string(),
+            amount: coin(1000),
+        });
+        let (type_url, bytes) = to_router_msg("vault.near", &msg).unwrap().unwrap();
+        assert_eq!(type_url, type_urls::MSG_DELEGATE);
+        let delegate: MsgDelegate = serde_json::from_slice(&bytes).unwrap();
+        assert_eq!(delegate.delegator_address, "vault.near");
+        assert_eq!(delegate.amount.amount, "1000");
+
+        let msg: CosmosMsg<Empty> = CosmosMsg::Staking(StakingMsg::Redelegate {
+            src_validator: "validator1".to_string(),
+            dst_validator: "validator2".to_string(),
+            amount: coin(10),
+        });
+        let (type_url, bytes) = to_router_msg("vault.near", &msg).unwrap().unwrap();
+        assert_eq!(type_url, type_urls::MSG_BEGIN_REDELEGATE);
+        let redelegate: MsgBeginRedelegate = serde_json::from_slice(&bytes).unwrap();
+        assert_eq!(redelegate.validator_dst_address, "validator2");
+    }
+
+    #[test]
+    fn test_gov_vote() {
+        let msg: CosmosMsg<Empty> = CosmosMsg::Gov(GovMsg::Vote {
+            proposal_id: 7,
+            vote: VoteOption::NoWithVeto,
+        });
+
+        let (type_url, bytes) = to_router_msg("dao.near", &msg).unwrap().unwrap();
+        assert_eq!(type_url, type_urls::MSG_VOTE);
+
+        let vote: MsgVote = serde_json::from_slice(&bytes).unwrap();
+        assert_eq!(vote.voter, "dao.near");
+        assert_eq!(vote.proposal_id, 7);
+        assert_eq!(vote.option, sdk::VoteOption::NoWithVeto);
+    }
+
+    #[test]
+    fn test_wasm_and_custom_are_not_routed() {
+        let msg: CosmosMsg<Empty> = CosmosMsg::Wasm(WasmMsg::Execute {
+            contract_addr: "other.near".to_string(),
+            msg: Binary::from(b"{}".to_vec()),
+            funds: vec![],
+        });
+        assert!(to_router_msg("dao.near", &msg).unwrap().is_none());
+
+        let msg: CosmosMsg<Empty> = CosmosMsg::Custom(Empty {});
+        assert!(to_router_msg("dao.near", &msg).unwrap().is_none());
+    }
+
+    #[test]
+    fn test_cosmos_msg_json_shape() {
+        let json = r#"{"staking":{"delegate":{"validator":"validator1","amount":{"denom":"stake","amount":5}}}}"#;
+        let msg: CosmosMsg<Empty> = serde_json::from_str(json).unwrap();
+        assert!(matches!(msg, CosmosMsg::Staking(StakingMsg::Delegate { .. })));
+
+        let json = r#"{"gov":{"vote":{"proposal_id":1,"vote":"yes"}}}"#;
+        let msg: CosmosMsg<Empty> = serde_json::from_str(json).unwrap();
+        assert!(matches!(msg, CosmosMsg::Gov(GovMsg::Vote { vote: VoteOption::Yes, .. })));
+    }
+}
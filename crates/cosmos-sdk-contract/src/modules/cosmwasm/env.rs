@@ -3,6 +3,7 @@ use crate::modules::cosmwasm::types::{
     Env, MessageInfo, BlockInfo, ContractInfo, TransactionInfo,
     Timestamp, Addr, Coin, Uint128,
 };
+use crate::types::time;
 
 /// Get the current environment information in CosmWasm format
 pub fn get_cosmwasm_env() -> Env {
@@ -60,7 +61,7 @@ fn get_attached_funds() -> Vec<Coin> {
 
 /// Helper to get current block time as seconds
 pub fn get_block_time_seconds() -> u64 {
-    env::block_timestamp() / 1_000_000_000
+    time::now_seconds()
 }
 
 /// Helper to get current block time as Timestamp
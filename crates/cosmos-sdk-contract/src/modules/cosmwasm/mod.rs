@@ -1,19 +1,23 @@
 pub mod api;
 pub mod contract;
 pub mod deps;
+pub mod dispatch;
 pub mod env;
 pub mod memory;
 pub mod response;
 pub mod storage;
+#[cfg(test)]
+pub mod storage_conformance;
 pub mod types;
 pub mod real_cw20_wrapper;
 
 // Re-export core types for easy access
 pub use api::CosmWasmApi;
 pub use contract::{CosmWasmContractWrapper, WrapperInitMsg, WrapperExecuteMsg, WrapperQueryMsg, WrapperMigrateMsg, WrapperResponse, ContractInfoResponse};
-pub use deps::{CosmWasmDeps, CosmWasmDepsMut};
+pub use deps::{CosmWasmDeps, CosmWasmDepsMut, ModuleQuerier};
+pub use dispatch::{dispatch_cosmos_msg, dispatch_sub_messages, to_router_msg};
 pub use env::{get_cosmwasm_env, get_message_info};
 pub use memory::CosmWasmMemoryManager;
-pub use response::process_cosmwasm_response;
-pub use storage::CosmWasmStorage;
+pub use response::{process_cosmwasm_response, process_cosmwasm_response_with_router};
+pub use storage::{CosmWasmStorage, MemoryStorage, ReadOnlyStore};
 pub use real_cw20_wrapper::{RealCw20Wrapper, Cw20WrapperInitMsg, Cw20WrapperExecuteMsg, Cw20WrapperQueryMsg, Cw20WrapperResponse};
\ No newline at end of file
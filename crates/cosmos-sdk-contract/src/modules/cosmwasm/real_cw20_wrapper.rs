@@ -8,7 +8,7 @@ use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
 use near_sdk::serde::{Deserialize, Serialize};
 
 use crate::modules::cosmwasm::{
-    storage::CosmWasmStorage,
+    storage::{CosmWasmStorage, ReadOnlyStore},
     api::CosmWasmApi,
     deps::{CosmWasmDeps, CosmWasmDepsMut},
     env::{get_cosmwasm_env, get_message_info},
@@ -118,12 +118,15 @@ impl RealCw20Wrapper {
     }
     
     /// Query the CW20 contract (read-only)
+    /// 
+    /// The query only sees the storage through a `ReadOnlyStore`, so a write
+    /// panics instead of being lost when this runs as a view call.
     pub fn query(&self, msg: Cw20WrapperQueryMsg) -> Cw20WrapperResponse {
         if !self.initialized {
             return Cw20WrapperResponse::error("Contract not initialized");
         }
         
-        match self.call_query(msg.cw20_query_msg) {
+        match self.call_query(ReadOnlyStore::new(&self.storage), msg.cw20_query_msg) {
             Ok(data) => Cw20WrapperResponse::success(Some(data)),
             Err(e) => Cw20WrapperResponse::error(&e),
         }
@@ -200,9 +203,9 @@ impl RealCw20Wrapper {
     }
     
     /// Call the CW20 contract's query function
-    fn call_query(&self, msg: QueryMsg) -> Result<String, String> {
+    fn call_query(&self, storage: ReadOnlyStore, msg: QueryMsg) -> Result<String, String> {
         // Create dependencies (read-only)
-        let deps = CosmWasmDeps::new(&self.storage, &self.api);
+        let deps = CosmWasmDeps::new(storage, &self.api);
         let env = get_cosmwasm_env();
         
         env::log_str(&format!("CW20_QUERY: {:?}", msg));
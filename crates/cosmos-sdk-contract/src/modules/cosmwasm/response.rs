@@ -1,5 +1,7 @@
 use near_sdk::env;
 use base64::{engine::general_purpose::STANDARD, Engine};
+use crate::handler::CosmosMessageHandler;
+use crate::modules::cosmwasm::dispatch::{dispatch_sub_messages, to_router_msg};
 use crate::modules::cosmwasm::types::{Response, SubMsg, CosmosMsg, BankMsg, WasmMsg, ReplyOn, Binary};
 
 /// Process a CosmWasm response and translate it to NEAR actions
@@ -7,6 +9,63 @@ pub fn process_cosmwasm_response<T>(response: Response<T>) -> Result<String, Str
 where
     T: serde::Serialize,
 {
+    log_response_events(&response);
+    
+    // Process sub-messages
+    if !response.messages.is_empty() {
+        process_sub_messages(response.messages)?;
+    }
+    
+    // Return data if present, otherwise return success message
+    match response.data {
+        Some(data) => Ok(data.to_base64()),
+        None => Ok("{}".to_string()),
+    }
+}
+
+/// Process a CosmWasm response, executing bank, staking and gov messages
+///
+/// Messages run in the order the contract emitted them. Module messages are
+/// routed through the Msg router with `contract` as the signer; wasm and
+/// custom messages are handled as in `process_cosmwasm_response`. Like
+/// `dispatch_sub_messages`, a failure once a module message was applied
+/// panics so the receipt rolls back, and an error means nothing was applied.
+pub fn process_cosmwasm_response_with_router<T, H>(
+    response: Response<T>,
+    contract: &str,
+    handler: &mut H,
+) -> Result<String, String>
+where
+    T: serde::Serialize,
+    H: CosmosMessageHandler,
+{
+    log_response_events(&response);
+    for sub_msg in &response.messages {
+        to_router_msg(contract, &sub_msg.msg)?;
+    }
+    
+    let mut applied = false;
+    for sub_msg in response.messages {
+        let result = if matches!(sub_msg.msg, CosmosMsg::Wasm(_) | CosmosMsg::Custom(_)) {
+            process_sub_messages(vec![sub_msg])
+        } else {
+            dispatch_sub_messages(handler, contract, std::slice::from_ref(&sub_msg))
+                .map(|responses| applied |= responses.iter().any(|response| response.code == 0))
+        };
+        match result {
+            Err(error) if applied => env::panic_str(&error),
+            result => result?,
+        }
+    }
+    
+    match response.data {
+        Some(data) => Ok(data.to_base64()),
+        None => Ok("{}".to_string()),
+    }
+}
+
+/// Log response events and attributes as NEAR logs
+fn log_response_events<T>(response: &Response<T>) {
     // Log events as NEAR logs
     for event in &response.events {
         let attributes_str = event.attributes
@@ -22,17 +81,6 @@ where
     for attr in &response.attributes {
         env::log_str(&format!("ATTR[{}]={}", attr.key, attr.value));
     }
-    
-    // Process sub-messages
-    if !response.messages.is_empty() {
-        process_sub_messages(response.messages)?;
-    }
-    
-    // Return data if present, otherwise return success message
-    match response.data {
-        Some(data) => Ok(data.to_base64()),
-        None => Ok("{}".to_string()),
-    }
 }
 
 /// Process sub-messages (cross-contract calls)
@@ -48,6 +96,13 @@ where
         
         match sub_msg.msg {
             CosmosMsg::Bank(bank_msg) => process_bank_message(bank_msg, sub_msg.id)?,
+            CosmosMsg::Staking(staking_msg) => {
+                // Staking messages need the Msg router, see process_cosmwasm_response_with_router
+                env::log_str(&format!("STAKING[id={}]: {:?}", sub_msg.id, staking_msg));
+            }
+            CosmosMsg::Gov(gov_msg) => {
+                env::log_str(&format!("GOV[id={}]: {:?}", sub_msg.id, gov_msg));
+            }
             CosmosMsg::Wasm(wasm_msg) => process_wasm_message(wasm_msg, sub_msg.id)?,
             CosmosMsg::Custom(custom) => process_custom_message(custom, sub_msg.id)?,
         }
@@ -2,6 +2,7 @@ use near_sdk::collections::{UnorderedMap, LookupMap, Vector};
 use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
 use crate::modules::cosmwasm::types::{Storage, Order, Record, StdResult, StdError};
 use std::cmp::Ordering;
+use std::collections::BTreeMap;
 
 /// CosmWasm-compatible storage implementation using NEAR collections
 #[derive(BorshDeserialize, BorshSerialize)]
@@ -44,8 +45,11 @@ impl CosmWasmStorage {
         _key.len() < 32
     }
 
-    /// Ensure sorted keys are up to date for range queries
-    fn ensure_sorted_keys(&mut self) {
+    /// Sort the key index so range queries can use it
+    ///
+    /// Until then, ranges over keys written since the last sort order a
+    /// snapshot of the keys instead, which costs a full key scan.
+    pub fn sort_keys(&mut self) {
         if self.keys_dirty {
             self.rebuild_sorted_keys();
             self.keys_dirty = false;
@@ -89,56 +93,33 @@ impl CosmWasmStorage {
         left
     }
 
-    /// Perform a range query over the storage
-    pub fn range(
-        &mut self,
-        start: Option<&[u8]>,
-        end: Option<&[u8]>,
-        order: Order,
-    ) -> Box<dyn Iterator<Item = StdResult<Record>> + '_> {
-        // Ensure sorted keys are up to date
-        self.ensure_sorted_keys();
-        
-        let start_idx = match start {
-            Some(key) => self.find_key_index(key),
-            None => 0,
-        };
-        
-        let end_idx = match end {
-            Some(key) => self.find_key_index(key),
-            None => self.sorted_keys.len() as usize,
-        };
-        
-        match order {
-            Order::Ascending => Box::new(RangeIterator::new_ascending(
-                &self.data,
-                &self.sorted_keys,
-                start_idx,
-                end_idx,
-            )),
-            Order::Descending => Box::new(RangeIterator::new_descending(
-                &self.data,
-                &self.sorted_keys,
-                start_idx,
-                end_idx,
-            )),
-        }
-    }
-
     /// Get all keys with a specific prefix
     pub fn prefix_range(
-        &mut self,
+        &self,
         prefix: &[u8],
         order: Order,
     ) -> Box<dyn Iterator<Item = StdResult<Record>> + '_> {
-        // Create end bound by incrementing the last byte of prefix
-        let mut end_bound = prefix.to_vec();
-        if let Some(last) = end_bound.last_mut() {
-            *last = last.saturating_add(1);
+        let end_bound = prefix_end(prefix);
+        self.range(Some(prefix), end_bound.as_deref(), order)
+    }
+}
+
+/// Smallest key greater than every key starting with `prefix`
+///
+/// `None` when the prefix is empty or all 0xff bytes, no key is past it.
+pub fn prefix_end(prefix: &[u8]) -> Option<Vec<u8>> {
+    let mut end = prefix.to_vec();
+    while let Some(last) = end.pop() {
+        if last < u8::MAX {
+            end.push(last + 1);
+            return Some(end);
         }
-        
-        self.range(Some(prefix), Some(&end_bound), order)
     }
+    None
+}
+
+fn in_range(key: &[u8], start: Option<&[u8]>, end: Option<&[u8]>) -> bool {
+    start.map_or(true, |start| key >= start) && end.map_or(true, |end| key < end)
 }
 
 impl Storage for CosmWasmStorage {
@@ -195,45 +176,136 @@ impl Storage for CosmWasmStorage {
         // Mark keys as dirty
         self.keys_dirty = true;
     }
+
+    fn range<'a>(
+        &'a self,
+        start: Option<&[u8]>,
+        end: Option<&[u8]>,
+        order: Order,
+    ) -> Box<dyn Iterator<Item = StdResult<Record>> + 'a> {
+        if self.keys_dirty {
+            let mut keys: Vec<Vec<u8>> = self.data.keys()
+                .filter(|key| in_range(key, start, end))
+                .collect();
+            keys.sort();
+            if order == Order::Descending {
+                keys.reverse();
+            }
+            return Box::new(keys.into_iter().map(move |key| match self.data.get(&key) {
+                Some(value) => Ok((key, value)),
+                None => Err(StdError::generic_err("Value not found for key")),
+            }));
+        }
+
+        let start_idx = start.map_or(0, |key| self.find_key_index(key));
+        let end_idx = end.map_or(self.sorted_keys.len() as usize, |key| self.find_key_index(key));
+        Box::new(RangeIterator::new(&self.data, &self.sorted_keys, start_idx, end_idx.max(start_idx), order))
+    }
+}
+
+/// In-memory store ordered by a `BTreeMap`, for tests and simulations
+#[derive(Default, Debug, Clone)]
+pub struct MemoryStorage {
+    data: BTreeMap<Vec<u8>, Vec<u8>>,
+}
+
+impl MemoryStorage {
+    pub fn new() -> Self {
+        Self::default()
+    }
+}
+
+impl Storage for MemoryStorage {
+    fn get(&self, key: &[u8]) -> Option<Vec<u8>> {
+        self.data.get(key).cloned()
+    }
+
+    fn set(&mut self, key: &[u8], value: &[u8]) {
+        self.data.insert(key.to_vec(), value.to_vec());
+    }
+
+    fn remove(&mut self, key: &[u8]) {
+        self.data.remove(key);
+    }
+
+    fn range<'a>(
+        &'a self,
+        start: Option<&[u8]>,
+        end: Option<&[u8]>,
+        order: Order,
+    ) -> Box<dyn Iterator<Item = StdResult<Record>> + 'a> {
+        let (start, end) = (start.map(<[u8]>::to_vec), end.map(<[u8]>::to_vec));
+        let records = self.data.iter()
+            .filter(move |(key, _)| in_range(key, start.as_deref(), end.as_deref()))
+            .map(|(key, value)| Ok((key.clone(), value.clone())));
+        match order {
+            Order::Ascending => Box::new(records),
+            Order::Descending => Box::new(records.rev()),
+        }
+    }
+}
+
+/// Read-only view over a store, used for every query entrypoint
+/// 
+/// Queries run as NEAR view calls where state writes are not persisted, so a
+/// query that writes would silently depend on state that disappears. Any
+/// write through this wrapper panics instead.
+pub struct ReadOnlyStore<'a> {
+    inner: &'a dyn Storage,
+}
+
+impl<'a> ReadOnlyStore<'a> {
+    pub fn new(inner: &'a dyn Storage) -> Self {
+        Self { inner }
+    }
+}
+
+impl<'a> Storage for ReadOnlyStore<'a> {
+    fn get(&self, key: &[u8]) -> Option<Vec<u8>> {
+        self.inner.get(key)
+    }
+
+    fn set(&mut self, key: &[u8], _value: &[u8]) {
+        panic!("Write to key {} attempted in read-only query context", hex::encode(key));
+    }
+
+    fn remove(&mut self, key: &[u8]) {
+        panic!("Remove of key {} attempted in read-only query context", hex::encode(key));
+    }
+
+    fn range<'b>(
+        &'b self,
+        start: Option<&[u8]>,
+        end: Option<&[u8]>,
+        order: Order,
+    ) -> Box<dyn Iterator<Item = StdResult<Record>> + 'b> {
+        self.inner.range(start, end, order)
+    }
 }
 
-/// Iterator for range queries
+/// Iterator over the sorted key index, yielding indexes in `[front, back)`
 pub struct RangeIterator<'a> {
     storage: &'a UnorderedMap<Vec<u8>, Vec<u8>>,
     sorted_keys: &'a Vector<Vec<u8>>,
-    current: u64,
-    end: u64,
+    front: u64,
+    back: u64,
     reverse: bool,
 }
 
 impl<'a> RangeIterator<'a> {
-    fn new_ascending(
-        storage: &'a UnorderedMap<Vec<u8>, Vec<u8>>,
-        sorted_keys: &'a Vector<Vec<u8>>,
-        start: usize,
-        end: usize,
-    ) -> Self {
-        Self {
-            storage,
-            sorted_keys,
-            current: start as u64,
-            end: end as u64,
-            reverse: false,
-        }
-    }
-
-    fn new_descending(
+    fn new(
         storage: &'a UnorderedMap<Vec<u8>, Vec<u8>>,
         sorted_keys: &'a Vector<Vec<u8>>,
         start: usize,
         end: usize,
+        order: Order,
     ) -> Self {
         Self {
             storage,
             sorted_keys,
-            current: if end > 0 { (end - 1) as u64 } else { 0 },
-            end: if start > 0 { (start - 1) as u64 } else { 0 },
-            reverse: true,
+            front: start as u64,
+            back: end as u64,
+            reverse: order == Order::Descending,
         }
     }
 }
@@ -242,18 +314,21 @@ impl<'a> Iterator for RangeIterator<'a> {
     type Item = StdResult<Record>;
     
     fn next(&mut self) -> Option<Self::Item> {
-        if self.reverse {
-            if self.current < self.end {
-                return None;
-            }
-        } else {
-            if self.current >= self.end {
-                return None;
-            }
+        if self.front >= self.back {
+            return None;
         }
+
+        // Take the index from the end the order walks from
+        let index = if self.reverse {
+            self.back -= 1;
+            self.back
+        } else {
+            self.front += 1;
+            self.front - 1
+        };
         
         // Get the key at current index
-        let key = match self.sorted_keys.get(self.current) {
+        let key = match self.sorted_keys.get(index) {
             Some(k) => k,
             None => return Some(Err(StdError::generic_err("Invalid key index"))),
         };
@@ -264,13 +339,6 @@ impl<'a> Iterator for RangeIterator<'a> {
             None => return Some(Err(StdError::generic_err("Value not found for key"))),
         };
         
-        // Advance iterator
-        if self.reverse {
-            self.current = self.current.saturating_sub(1);
-        } else {
-            self.current += 1;
-        }
-        
         Some(Ok((key, value)))
     }
 }
@@ -278,6 +346,7 @@ impl<'a> Iterator for RangeIterator<'a> {
 #[cfg(test)]
 mod tests {
     use super::*;
+    use crate::modules::cosmwasm::storage_conformance::check_storage;
     use near_sdk::test_utils::VMContextBuilder;
     use near_sdk::{testing_env, VMContext, Gas};
     
@@ -344,6 +413,48 @@ mod tests {
         assert_eq!(results.len(), 2);
         assert_eq!(results[0].0, b"c");
         assert_eq!(results[1].0, b"b");
+
+        // Descending to the first key stops there
+        let results: Vec<_> = storage
+            .range(None, Some(b"b"), Order::Descending)
+            .collect::<Result<Vec<_>, _>>()
+            .unwrap();
+        assert_eq!(results, vec![(b"a".to_vec(), b"1".to_vec())]);
+    }
+
+    #[test]
+    fn test_storage_conformance() {
+        setup_context();
+
+        let mut storage = CosmWasmStorage::new();
+        check_storage(&mut storage);
+
+        // Through the sorted key index as well as the unsorted snapshot
+        storage.sort_keys();
+        let mut ascending: Vec<Vec<u8>> = storage.range(None, None, Order::Ascending).map(|r| r.unwrap().0).collect();
+        let mut descending: Vec<Vec<u8>> = storage.range(None, None, Order::Descending).map(|r| r.unwrap().0).collect();
+        descending.reverse();
+        assert_eq!(ascending, descending);
+        ascending.sort();
+        assert_eq!(ascending, descending);
+        assert_eq!(
+            storage.range(Some(b"a"), Some(b"b"), Order::Descending).count(),
+            3
+        );
+
+        check_storage(&mut MemoryStorage::new());
+    }
+
+    #[test]
+    fn test_read_only_store_ranges_like_inner() {
+        setup_context();
+
+        let mut storage = MemoryStorage::new();
+        storage.set(b"b", b"2");
+        storage.set(b"a", b"1");
+        let read_only = ReadOnlyStore::new(&storage);
+        let keys: Vec<Vec<u8>> = read_only.range(None, None, Order::Descending).map(|r| r.unwrap().0).collect();
+        assert_eq!(keys, vec![b"b".to_vec(), b"a".to_vec()]);
     }
     
     #[test]
@@ -369,4 +480,36 @@ mod tests {
         assert_eq!(results[1].0, b"user:bob");
         assert_eq!(results[2].0, b"user:charlie");
     }
+
+    #[test]
+    fn test_read_only_store_reads() {
+        setup_context();
+
+        let mut storage = CosmWasmStorage::new();
+        storage.set(b"key1", b"value1");
+
+        let read_only = ReadOnlyStore::new(&storage);
+        assert_eq!(read_only.get(b"key1"), Some(b"value1".to_vec()));
+        assert_eq!(read_only.get(b"missing"), None);
+    }
+
+    #[test]
+    #[should_panic(expected = "read-only query context")]
+    fn test_read_only_store_rejects_writes() {
+        setup_context();
+
+        let storage = CosmWasmStorage::new();
+        let mut read_only = ReadOnlyStore::new(&storage);
+        read_only.set(b"key1", b"value1");
+    }
+
+    #[test]
+    #[should_panic(expected = "read-only query context")]
+    fn test_read_only_store_rejects_removes() {
+        setup_context();
+
+        let storage = CosmWasmStorage::new();
+        let mut read_only = ReadOnlyStore::new(&storage);
+        read_only.remove(b"key1");
+    }
 }
\ No newline at end of file
@@ -0,0 +1,90 @@
+/// Storage Conformance Suite
+///
+/// Shared checks for every `Storage` implementation. They pin down the
+/// iteration order contracts observe: keys come back in lexicographic byte
+/// order regardless of insertion order, bounds are start inclusive and end
+/// exclusive, and overwrites and removals never leave stale or duplicate
+/// entries behind. A new store passes by running `check_storage` on an empty
+/// instance from its own tests.
+
+use super::storage::prefix_end;
+use super::types::{Order, Record, Storage};
+
+/// Keys written deliberately out of order, including bytes that sort
+/// differently as text than as raw bytes
+const KEYS: [&[u8]; 8] = [b"b", b"a", b"ab", b"\x00", b"\xff", b"a\x00", b"B", b"\xff\x00"];
+
+fn keys(store: &dyn Storage, start: Option<&[u8]>, end: Option<&[u8]>, order: Order) -> Vec<Vec<u8>> {
+    store.range(start, end, order)
+        .map(|record| record.expect("Range yields stored records").0)
+        .collect()
+}
+
+fn sorted(keys: &[&[u8]]) -> Vec<Vec<u8>> {
+    let mut sorted: Vec<Vec<u8>> = keys.iter().map(|key| key.to_vec()).collect();
+    sorted.sort();
+    sorted
+}
+
+/// Run the suite against an empty store
+pub fn check_storage(store: &mut dyn Storage) {
+    assert!(store.range(None, None, Order::Ascending).next().is_none(), "Store must start empty");
+    for (i, key) in KEYS.iter().enumerate() {
+        store.set(key, &[i as u8]);
+    }
+    check_order(store);
+    check_bounds(store);
+    check_overwrite_and_remove(store);
+}
+
+fn check_order(store: &dyn Storage) {
+    let expected = sorted(&KEYS);
+    assert_eq!(keys(store, None, None, Order::Ascending), expected, "Ascending order is lexicographic");
+
+    let mut reversed = expected;
+    reversed.reverse();
+    assert_eq!(keys(store, None, None, Order::Descending), reversed, "Descending order is reversed");
+}
+
+fn check_bounds(store: &dyn Storage) {
+    assert_eq!(
+        keys(store, Some(b"a"), Some(b"b"), Order::Ascending),
+        sorted(&[b"a", b"a\x00", b"ab"]),
+        "Start is inclusive and end exclusive"
+    );
+    assert_eq!(
+        keys(store, Some(b"a"), Some(b"b"), Order::Descending),
+        vec![b"ab".to_vec(), b"a\x00".to_vec(), b"a".to_vec()],
+        "Descending honours the same bounds"
+    );
+    assert_eq!(
+        keys(store, Some(b"a\x01"), None, Order::Ascending),
+        sorted(&[b"ab", b"b", b"\xff", b"\xff\x00"]),
+        "Bounds need not be stored keys"
+    );
+    assert!(keys(store, Some(b"b"), Some(b"b"), Order::Ascending).is_empty(), "Empty range");
+    assert!(keys(store, Some(b"b"), Some(b"a"), Order::Descending).is_empty(), "Inverted range");
+
+    let end = prefix_end(b"\xff");
+    assert_eq!(end, None);
+    assert_eq!(
+        keys(store, Some(b"\xff"), end.as_deref(), Order::Ascending),
+        sorted(&[b"\xff", b"\xff\x00"]),
+        "Prefix of 0xff runs to the end"
+    );
+}
+
+fn check_overwrite_and_remove(store: &mut dyn Storage) {
+    store.set(b"ab", b"updated");
+    let records: Vec<Record> = store.range(Some(b"ab"), Some(b"b"), Order::Ascending)
+        .map(|record| record.unwrap())
+        .collect();
+    assert_eq!(records, vec![(b"ab".to_vec(), b"updated".to_vec())], "Overwrites are not duplicated");
+
+    store.remove(b"a\x00");
+    store.remove(b"missing");
+    assert_eq!(keys(store, Some(b"a"), Some(b"b"), Order::Ascending), sorted(&[b"a", b"ab"]), "Removed keys are skipped");
+
+    store.set(b"a\x00", b"back");
+    assert_eq!(keys(store, None, None, Order::Ascending), sorted(&KEYS), "Re-added keys keep their place");
+}
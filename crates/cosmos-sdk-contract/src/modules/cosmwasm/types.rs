@@ -2,6 +2,7 @@ use near_sdk::serde::{Deserialize, Serialize};
 use near_sdk::json_types::U128;
 use std::ops::{Add, Sub, AddAssign, SubAssign};
 use std::fmt;
+use crate::types::time;
 
 /// Re-export of core CosmWasm types that contracts expect
 /// These types maintain compatibility with cosmwasm-std
@@ -205,12 +206,12 @@ impl Timestamp {
 
     pub fn from_seconds(seconds: u64) -> Self {
         Timestamp {
-            nanos: seconds * 1_000_000_000,
+            nanos: time::seconds_to_nanos(seconds),
         }
     }
 
     pub fn seconds(&self) -> u64 {
-        self.nanos / 1_000_000_000
+        time::nanos_to_seconds(self.nanos)
     }
 
     pub fn nanos(&self) -> u64 {
@@ -293,6 +294,8 @@ pub enum ReplyOn {
 pub enum CosmosMsg<T = Empty> {
     Bank(BankMsg),
     Custom(T),
+    Staking(StakingMsg),
+    Gov(GovMsg),
     Wasm(WasmMsg),
 }
 
@@ -309,6 +312,45 @@ pub enum BankMsg {
     },
 }
 
+/// Staking module messages
+#[derive(Serialize, Deserialize, Debug, Clone)]
+#[serde(rename_all = "snake_case")]
+pub enum StakingMsg {
+    Delegate {
+        validator: String,
+        amount: Coin,
+    },
+    Undelegate {
+        validator: String,
+        amount: Coin,
+    },
+    Redelegate {
+        src_validator: String,
+        dst_validator: String,
+        amount: Coin,
+    },
+}
+
+/// Governance module messages
+#[derive(Serialize, Deserialize, Debug, Clone)]
+#[serde(rename_all = "snake_case")]
+pub enum GovMsg {
+    Vote {
+        proposal_id: u64,
+        vote: VoteOption,
+    },
+}
+
+/// Vote options accepted by `GovMsg::Vote`
+#[derive(Serialize, Deserialize, Debug, Clone, Copy, PartialEq)]
+#[serde(rename_all = "snake_case")]
+pub enum VoteOption {
+    Yes,
+    No,
+    Abstain,
+    NoWithVeto,
+}
+
 /// Wasm module messages
 #[derive(Serialize, Deserialize, Debug, Clone)]
 #[serde(rename_all = "snake_case")]
@@ -480,10 +522,22 @@ pub struct MessageInfo {
 }
 
 /// Storage trait that CosmWasm contracts expect
+///
+/// `range` must yield keys in lexicographic byte order, ascending or
+/// descending, with `start` inclusive and `end` exclusive, whatever order the
+/// keys were written in. Contracts rely on this to paginate, and a different
+/// order on two nodes would be consensus breaking. Every implementation has
+/// to pass `storage_conformance::check_storage`.
 pub trait Storage {
     fn get(&self, key: &[u8]) -> Option<Vec<u8>>;
     fn set(&mut self, key: &[u8], value: &[u8]);
     fn remove(&mut self, key: &[u8]);
+    fn range<'a>(
+        &'a self,
+        start: Option<&[u8]>,
+        end: Option<&[u8]>,
+        order: Order,
+    ) -> Box<dyn Iterator<Item = StdResult<Record>> + 'a>;
 }
 
 /// API trait for address and crypto operations
@@ -520,11 +574,175 @@ impl<'a> QuerierWrapper<'a> {
     pub fn query_balance(&self, address: impl Into<String>, denom: impl Into<String>) -> StdResult<Coin> {
         self.querier.query_balance(address.into(), denom.into())
     }
+
+    /// Run a module query and decode the JSON response
+    pub fn query<T: serde::de::DeserializeOwned>(&self, request: &QueryRequest) -> StdResult<T> {
+        let raw = self.querier.query_module(request)?;
+        from_slice(raw.as_slice())
+    }
+
+    pub fn query_all_balances(&self, address: impl Into<String>) -> StdResult<Vec<Coin>> {
+        let response: AllBalanceResponse = self.query(&QueryRequest::Bank(BankQuery::AllBalances {
+            address: address.into(),
+        }))?;
+        Ok(response.amount)
+    }
+
+    pub fn query_delegation(
+        &self,
+        delegator: impl Into<String>,
+        validator: impl Into<String>,
+    ) -> StdResult<Option<FullDelegation>> {
+        let response: DelegationResponse = self.query(&QueryRequest::Staking(StakingQuery::Delegation {
+            delegator: delegator.into(),
+            validator: validator.into(),
+        }))?;
+        Ok(response.delegation)
+    }
+
+    /// Snapshotted voting power of a delegator, see `StakingQuery::VotingPower`
+    pub fn query_voting_power(&self, delegator: impl Into<String>, epoch: Option<u64>) -> StdResult<VotingPowerResponse> {
+        self.query(&QueryRequest::Staking(StakingQuery::VotingPower {
+            delegator: delegator.into(),
+            epoch,
+        }))
+    }
+
+    pub fn query_price(&self, denom: impl Into<String>) -> StdResult<PriceResponse> {
+        self.query(&QueryRequest::Oracle(OracleQuery::Price { denom: denom.into() }))
+    }
 }
 
 /// Querier trait for external state queries
 pub trait Querier {
     fn query_balance(&self, address: String, denom: String) -> StdResult<Coin>;
+
+    /// Answer a module query with a JSON encoded response
+    fn query_module(&self, request: &QueryRequest) -> StdResult<Binary> {
+        Err(StdError::generic_err(format!("Unsupported query: {:?}", request)))
+    }
+}
+
+/// Module queries a contract can issue through the querier
+#[derive(Serialize, Deserialize, Debug, Clone)]
+#[serde(rename_all = "snake_case")]
+pub enum QueryRequest {
+    Bank(BankQuery),
+    Staking(StakingQuery),
+    Gov(GovQuery),
+    Oracle(OracleQuery),
+}
+
+#[derive(Serialize, Deserialize, Debug, Clone)]
+#[serde(rename_all = "snake_case")]
+pub enum BankQuery {
+    Balance { address: String, denom: String },
+    AllBalances { address: String },
+}
+
+#[derive(Serialize, Deserialize, Debug, Clone)]
+#[serde(rename_all = "snake_case")]
+pub enum StakingQuery {
+    BondedDenom {},
+    AllValidators {},
+    Validator { address: String },
+    Delegation { delegator: String, validator: String },
+    AllDelegations { delegator: String },
+    /// Bonded stake of a delegator in a snapshot, the latest when `epoch` is unset
+    VotingPower { delegator: String, epoch: Option<u64> },
+    TotalVotingPower { epoch: Option<u64> },
+}
+
+#[derive(Serialize, Deserialize, Debug, Clone)]
+#[serde(rename_all = "snake_case")]
+pub enum GovQuery {
+    Proposal { proposal_id: u64 },
+}
+
+#[derive(Serialize, Deserialize, Debug, Clone)]
+#[serde(rename_all = "snake_case")]
+pub enum OracleQuery {
+    /// Medianized IBC oracle price, an error once it is stale
+    Price { denom: String },
+}
+
+#[derive(Serialize, Deserialize, Debug, Clone)]
+pub struct BalanceResponse {
+    pub amount: Coin,
+}
+
+#[derive(Serialize, Deserialize, Debug, Clone)]
+pub struct AllBalanceResponse {
+    pub amount: Vec<Coin>,
+}
+
+#[derive(Serialize, Deserialize, Debug, Clone)]
+pub struct BondedDenomResponse {
+    pub denom: String,
+}
+
+#[derive(Serialize, Deserialize, Debug, Clone, PartialEq)]
+pub struct ValidatorInfo {
+    pub address: String,
+    pub commission: String,
+    pub max_commission: String,
+    pub max_change_rate: String,
+}
+
+#[derive(Serialize, Deserialize, Debug, Clone)]
+pub struct AllValidatorsResponse {
+    pub validators: Vec<ValidatorInfo>,
+}
+
+#[derive(Serialize, Deserialize, Debug, Clone)]
+pub struct ValidatorResponse {
+    pub validator: Option<ValidatorInfo>,
+}
+
+#[derive(Serialize, Deserialize, Debug, Clone, PartialEq)]
+pub struct FullDelegation {
+    pub delegator: String,
+    pub validator: String,
+    pub amount: Coin,
+}
+
+#[derive(Serialize, Deserialize, Debug, Clone)]
+pub struct DelegationResponse {
+    pub delegation: Option<FullDelegation>,
+}
+
+#[derive(Serialize, Deserialize, Debug, Clone)]
+pub struct AllDelegationsResponse {
+    pub delegations: Vec<FullDelegation>,
+}
+
+/// Voting power in a staking snapshot, `total` for `TotalVotingPower`
+#[derive(Serialize, Deserialize, Debug, Clone, PartialEq)]
+pub struct VotingPowerResponse {
+    pub epoch: u64,
+    /// Height the snapshot was taken at
+    pub height: u64,
+    pub power: Uint128,
+}
+
+/// Oracle price in the native denom per unit of `denom`
+#[derive(Serialize, Deserialize, Debug, Clone, PartialEq)]
+pub struct PriceResponse {
+    pub denom: String,
+    pub price: Uint128,
+    /// Oldest observation the price was taken over, in nanoseconds
+    pub timestamp: u64,
+    pub sources: u32,
+}
+
+#[derive(Serialize, Deserialize, Debug, Clone)]
+pub struct ProposalResponse {
+    pub id: u64,
+    pub title: String,
+    pub status: String,
+    pub yes_votes: u32,
+    pub no_votes: u32,
+    pub end_height: u64,
 }
 
 /// Deps - immutable dependencies for query handlers
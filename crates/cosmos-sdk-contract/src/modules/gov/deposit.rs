@@ -0,0 +1,276 @@
+/// Proposal Deposits
+///
+/// Governance can require a deposit before a proposal's vote counts, so
+/// spam proposals cost something. The deposit is not tied to the staking
+/// token: the `deposit_params` parameter whitelists denoms, each with its
+/// own minimum, and a proposal qualifies as soon as one denom's deposits
+/// reach that denom's minimum. Holders of bridged assets alone can put up a
+/// deposit in those. With `min_value` set, deposits across all whitelisted
+/// denoms are also valued through a `PriceKeeper` and the proposal
+/// qualifies once their sum reaches it, so small deposits in several denoms
+/// add up.
+///
+/// A proposal whose deposit does not qualify by the end of voting is
+/// rejected. Gov only records deposits; the hosting contract escrows the
+/// funds when they are made and pays them out from `take_deposits` once the
+/// proposal is decided.
+
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::serde::{Deserialize, Serialize};
+use near_sdk::{env, AccountId};
+use schemars::JsonSchema;
+
+use super::{GovernanceModule, PriceKeeper, ProposalStatus};
+use crate::Balance;
+
+/// Governance parameter holding the JSON encoded deposit rules
+pub const DEPOSIT_PARAMS_PARAM: &str = "deposit_params";
+
+/// A denom deposits may be made in
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct DenomMinimum {
+    pub denom: String,
+    /// Deposits in this denom alone that qualify a proposal, 0 to only count
+    /// the denom towards `min_value`
+    #[serde(default)]
+    pub min_amount: Balance,
+}
+
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, Default, PartialEq, JsonSchema)]
+pub struct DepositParams {
+    /// Accepted denoms, no deposit is required when empty
+    pub denoms: Vec<DenomMinimum>,
+    /// Value of all deposits in the native denom that qualifies a proposal,
+    /// 0 to only apply the per-denom minimums
+    #[serde(default)]
+    pub min_value: Balance,
+}
+
+impl DepositParams {
+    pub fn from_json(json: &str) -> Result<Self, String> {
+        serde_json::from_str(json).map_err(|e| format!("Invalid deposit params: {}", e))
+    }
+
+    pub fn to_json(&self) -> String {
+        serde_json::to_string(self).expect("Deposit params serialize")
+    }
+
+    pub fn validate(&self) -> Result<(), String> {
+        for (index, entry) in self.denoms.iter().enumerate() {
+            if entry.denom.trim().is_empty() {
+                return Err("Deposit denom cannot be empty".to_string());
+            }
+            if self.denoms[..index].iter().any(|other| other.denom == entry.denom) {
+                return Err(format!("Deposit denom {} is listed more than once", entry.denom));
+            }
+        }
+        if !self.denoms.is_empty() && self.min_value == 0 && self.denoms.iter().all(|entry| entry.min_amount == 0) {
+            return Err("Deposit params need a min_value or a denom with a min_amount".to_string());
+        }
+        if self.denoms.is_empty() && self.min_value > 0 {
+            return Err("Deposit min_value needs at least one accepted denom".to_string());
+        }
+        Ok(())
+    }
+
+    pub fn is_required(&self) -> bool {
+        !self.denoms.is_empty()
+    }
+
+    pub fn minimum_for(&self, denom: &str) -> Option<&DenomMinimum> {
+        self.denoms.iter().find(|entry| entry.denom == denom)
+    }
+}
+
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct Deposit {
+    pub depositor: AccountId,
+    pub denom: String,
+    pub amount: Balance,
+}
+
+impl GovernanceModule {
+    /// Rules deposits are checked against
+    pub fn deposit_params(&self) -> DepositParams {
+        DepositParams::from_json(&self.get_parameter(&DEPOSIT_PARAMS_PARAM.to_string())).unwrap_or_default()
+    }
+
+    /// Record a deposit the caller has already escrowed
+    pub fn add_deposit(&mut self, proposal_id: u64, depositor: &AccountId, denom: &str, amount: Balance) -> Result<(), String> {
+        let proposal = self.proposals.get(&proposal_id).ok_or("Proposal not found")?;
+        if proposal.status != ProposalStatus::Active {
+            return Err(format!("Proposal {} no longer takes deposits", proposal_id));
+        }
+        if amount == 0 {
+            return Err("Deposit amount must be positive".to_string());
+        }
+        if self.deposit_params().minimum_for(denom).is_none() {
+            return Err(format!("Deposits in {} are not accepted", denom));
+        }
+
+        let mut deposits = self.deposits.get(&proposal_id).unwrap_or_default();
+        match deposits.iter_mut().find(|deposit| &deposit.depositor == depositor && deposit.denom == denom) {
+            Some(deposit) => deposit.amount = deposit.amount.saturating_add(amount),
+            None => deposits.push(Deposit { depositor: depositor.clone(), denom: denom.to_string(), amount }),
+        }
+        self.deposits.insert(&proposal_id, &deposits);
+
+        env::log_str(&format!(
+            "EVENT: proposal_deposit proposal_id={} depositor={} amount={}{}",
+            proposal_id, depositor, amount, denom
+        ));
+        Ok(())
+    }
+
+    pub fn get_deposits(&self, proposal_id: u64) -> Vec<Deposit> {
+        self.deposits.get(&proposal_id).unwrap_or_default()
+    }
+
+    /// Deposits of a proposal summed by denom, sorted by denom
+    pub fn deposit_totals(&self, proposal_id: u64) -> Vec<(String, Balance)> {
+        let mut totals: Vec<(String, Balance)> = Vec::new();
+        for deposit in self.get_deposits(proposal_id) {
+            match totals.iter_mut().find(|(denom, _)| *denom == deposit.denom) {
+                Some((_, total)) => *total = total.saturating_add(deposit.amount),
+                None => totals.push((deposit.denom, deposit.amount)),
+            }
+        }
+        totals.sort();
+        totals
+    }
+
+    /// Whether a proposal's deposits qualify it
+    ///
+    /// Without a `PriceKeeper` only the per-denom minimums apply. Denoms the
+    /// keeper has no price for add nothing to the aggregate value.
+    pub fn deposit_met(&self, proposal_id: u64, prices: Option<&dyn PriceKeeper>) -> bool {
+        let params = self.deposit_params();
+        if !params.is_required() {
+            return true;
+        }
+        let totals = self.deposit_totals(proposal_id);
+        let denom_met = totals.iter().any(|(denom, total)| {
+            params.minimum_for(denom).map_or(false, |entry| entry.min_amount > 0 && *total >= entry.min_amount)
+        });
+        if denom_met || params.min_value == 0 {
+            return denom_met;
+        }
+        let Some(prices) = prices else { return false };
+        let value = totals.iter()
+            .filter(|(denom, _)| params.minimum_for(denom).is_some())
+            .filter_map(|(denom, total)| prices.value_of(denom, *total))
+            .fold(0, Balance::saturating_add);
+        value >= params.min_value
+    }
+
+    /// Hand out the deposits of a decided proposal for refunding or burning
+    pub fn take_deposits(&mut self, proposal_id: u64) -> Result<Vec<Deposit>, String> {
+        let proposal = self.proposals.get(&proposal_id).ok_or("Proposal not found")?;
+        if proposal.status == ProposalStatus::Active {
+            return Err(format!("Proposal {} is still in voting", proposal_id));
+        }
+        Ok(self.deposits.remove(&proposal_id).unwrap_or_default())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    struct FixedPrices;
+
+    impl PriceKeeper for FixedPrices {
+        fn value_of(&self, denom: &str, amount: Balance) -> Option<Balance> {
+            match denom {
+                "ibc/ATOM" => Some(amount * 10),
+                _ => None,
+            }
+        }
+    }
+
+    fn account(name: &str) -> AccountId {
+        name.parse().unwrap()
+    }
+
+    fn gov_with(params: DepositParams) -> (GovernanceModule, u64) {
+        let mut gov = GovernanceModule::new();
+        gov.override_parameter(DEPOSIT_PARAMS_PARAM, &params.to_json()).unwrap();
+        let proposal_id = gov.submit_proposal(
+            &account("alice.near"),
+            "Raise rewards".to_string(),
+            "Increase the reward rate".to_string(),
+            "reward_rate".to_string(),
+            "6".to_string(),
+            String::new(),
+            None,
+            10,
+        );
+        (gov, proposal_id)
+    }
+
+    fn minimum(denom: &str, min_amount: Balance) -> DenomMinimum {
+        DenomMinimum { denom: denom.to_string(), min_amount }
+    }
+
+    #[test]
+    fn test_deposit_in_any_whitelisted_denom() {
+        let (mut gov, proposal_id) = gov_with(DepositParams {
+            denoms: vec![minimum("unear", 1_000), minimum("ibc/ATOM", 50)],
+            min_value: 0,
+        });
+        let alice = account("alice.near");
+        assert!(!gov.deposit_met(proposal_id, None));
+        assert!(gov.add_deposit(proposal_id, &alice, "ibc/OSMO", 10).is_err());
+
+        gov.add_deposit(proposal_id, &alice, "ibc/ATOM", 30).unwrap();
+        assert!(!gov.deposit_met(proposal_id, None));
+        gov.add_deposit(proposal_id, &account("bob.near"), "ibc/ATOM", 20).unwrap();
+        assert!(gov.deposit_met(proposal_id, None));
+        assert_eq!(gov.deposit_totals(proposal_id), vec![("ibc/ATOM".to_string(), 50)]);
+
+        assert!(gov.take_deposits(proposal_id).is_err());
+        gov.vote(&alice, proposal_id, 1, String::new());
+        gov.vote(&account("bob.near"), proposal_id, 1, String::new());
+        gov.end_block(100);
+        assert_eq!(gov.get_parameter(&"reward_rate".to_string()), "6");
+        assert_eq!(gov.take_deposits(proposal_id).unwrap().len(), 2);
+        assert!(gov.get_deposits(proposal_id).is_empty());
+    }
+
+    #[test]
+    fn test_aggregate_value_minimum() {
+        let (mut gov, proposal_id) = gov_with(DepositParams {
+            denoms: vec![minimum("unear", 0), minimum("ibc/ATOM", 0), minimum("ibc/OSMO", 0)],
+            min_value: 1_000,
+        });
+        gov.add_deposit(proposal_id, &account("alice.near"), "ibc/ATOM", 60).unwrap();
+        gov.add_deposit(proposal_id, &account("alice.near"), "ibc/OSMO", 5_000).unwrap();
+        assert!(!gov.deposit_met(proposal_id, Some(&FixedPrices)));
+
+        gov.add_deposit(proposal_id, &account("bob.near"), "ibc/ATOM", 40).unwrap();
+        assert!(gov.deposit_met(proposal_id, Some(&FixedPrices)));
+        assert!(!gov.deposit_met(proposal_id, None));
+    }
+
+    #[test]
+    fn test_underfunded_proposal_is_rejected() {
+        let (mut gov, proposal_id) = gov_with(DepositParams { denoms: vec![minimum("unear", 1_000)], min_value: 0 });
+        gov.vote(&account("alice.near"), proposal_id, 1, String::new());
+        gov.vote(&account("bob.near"), proposal_id, 1, String::new());
+        gov.end_block(100);
+
+        let proposal = gov.get_proposal(proposal_id).unwrap();
+        assert_eq!(proposal.status, ProposalStatus::Rejected);
+        assert_eq!(proposal.failed_reason.as_deref(), Some("Deposit below the minimum"));
+        assert_eq!(gov.get_parameter(&"reward_rate".to_string()), "5");
+    }
+
+    #[test]
+    fn test_params_validation() {
+        assert!(DepositParams::default().validate().is_ok());
+        assert!(DepositParams { denoms: vec![minimum("unear", 0)], min_value: 0 }.validate().is_err());
+        assert!(DepositParams { denoms: vec![], min_value: 10 }.validate().is_err());
+        assert!(DepositParams { denoms: vec![minimum("unear", 1), minimum("unear", 2)], min_value: 0 }.validate().is_err());
+        assert!(DepositParams { denoms: vec![minimum(" ", 1)], min_value: 0 }.validate().is_err());
+    }
+}
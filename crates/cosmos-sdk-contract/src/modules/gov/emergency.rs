@@ -0,0 +1,333 @@
+/// Emergency Proposals
+///
+/// Some content is a break-glass measure, such as replacing the whole
+/// validator set after many consensus keys leaked at once. A handler marks
+/// such content through `ProposalHandler::requires_emergency` and it can
+/// then only be submitted with `submit_emergency_proposal`, under stricter
+/// terms than an ordinary proposal:
+///
+/// - it passes only when yes votes reach `threshold_percent` of the bonded
+///   voting power snapshotted for it, so staying away counts against it
+///   like a no vote; without a `snapshot_stake` there is no bonded total
+///   to measure against and it cannot pass
+/// - it always executes `timelock_blocks` after voting ends, leaving the
+///   network time to react before the change lands
+///
+/// The terms in force at submission are stored with the proposal, so a
+/// later parameter change cannot weaken them mid-vote. Every step, from
+/// submission through tally to execution, is logged as an `emergency_*`
+/// event for the audit trail.
+
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::serde::{Deserialize, Serialize};
+use near_sdk::{env, AccountId};
+use schemars::JsonSchema;
+
+use super::{ExecutionSchedule, GovernanceModule, Proposal, ProposalContent, ProposalRouter, TallyResult};
+
+/// Governance parameter holding the JSON encoded emergency terms
+pub const EMERGENCY_PARAMS_PARAM: &str = "emergency_params";
+
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct EmergencyParams {
+    /// Share of the total bonded voting power that must vote yes, in percent
+    pub threshold_percent: u8,
+    /// Blocks between the end of voting and execution
+    pub timelock_blocks: u64,
+}
+
+impl Default for EmergencyParams {
+    fn default() -> Self {
+        Self { threshold_percent: 67, timelock_blocks: 1_000 }
+    }
+}
+
+impl EmergencyParams {
+    pub fn from_json(json: &str) -> Result<Self, String> {
+        serde_json::from_str(json).map_err(|e| format!("Invalid emergency params: {}", e))
+    }
+
+    pub fn to_json(&self) -> String {
+        serde_json::to_string(self).expect("Emergency params serialize")
+    }
+
+    pub fn validate(&self) -> Result<(), String> {
+        if self.threshold_percent <= 50 || self.threshold_percent > 100 {
+            return Err(format!(
+                "Emergency threshold must be a supermajority above 50% and at most 100%, got {}%",
+                self.threshold_percent
+            ));
+        }
+        if self.timelock_blocks == 0 {
+            return Err("Emergency timelock must be at least one block".to_string());
+        }
+        Ok(())
+    }
+
+    /// Whether the yes votes of `tally` clear the threshold of `total_power`
+    pub fn is_met(&self, tally: &TallyResult, total_power: u128) -> bool {
+        tally.yes > 0 && tally.yes.saturating_mul(100) >= total_power.saturating_mul(self.threshold_percent as u128)
+    }
+}
+
+impl GovernanceModule {
+    /// Terms new emergency proposals are submitted under
+    pub fn emergency_params(&self) -> EmergencyParams {
+        EmergencyParams::from_json(&self.get_parameter(&EMERGENCY_PARAMS_PARAM.to_string())).unwrap_or_default()
+    }
+
+    /// Terms an emergency proposal was submitted under, `None` for ordinary
+    /// proposals
+    pub fn get_emergency_terms(&self, proposal_id: u64) -> Option<EmergencyParams> {
+        self.emergency_terms.get(&proposal_id)
+    }
+
+    /// Submit content its handler only accepts as an emergency measure
+    ///
+    /// The proposal is scheduled for `timelock_blocks` after its voting
+    /// period; there is no way to execute it sooner. Its stake must be
+    /// snapshotted with `snapshot_stake` before voting starts.
+    pub fn submit_emergency_proposal(
+        &mut self,
+        proposer: &AccountId,
+        title: String,
+        description: String,
+        content: ProposalContent,
+        router: &mut ProposalRouter,
+        metadata: String,
+        current_height: u64,
+    ) -> u64 {
+        router.validate(&content).unwrap_or_else(|e| env::panic_str(&e));
+        if !router.requires_emergency(&content).unwrap_or_else(|e| env::panic_str(&e)) {
+            env::panic_str(&format!("{} proposals are not emergency proposals", content.proposal_type));
+        }
+        let terms = self.emergency_params();
+
+        let proposal_id = self.submit_proposal(
+            proposer,
+            title,
+            description,
+            String::new(),
+            String::new(),
+            metadata,
+            None,
+            current_height,
+        );
+
+        let mut proposal = self.proposals.get(&proposal_id).expect("Proposal not found");
+        let execute_height = proposal.end_height.saturating_add(terms.timelock_blocks);
+        proposal.execution = Some(ExecutionSchedule::AtHeight(execute_height));
+        proposal.content = Some(content.clone());
+        self.proposals.insert(&proposal_id, &proposal);
+        self.emergency_terms.insert(&proposal_id, &terms);
+
+        env::log_str(&format!(
+            "EVENT: emergency_proposal_submitted proposal_id={} proposer={} route={} type={} threshold_percent={} voting_end={} execute_height={}",
+            proposal_id, proposer, content.route, content.proposal_type, terms.threshold_percent, proposal.end_height, execute_height
+        ));
+        proposal_id
+    }
+
+    /// Whether the votes on a proposal carry it, quorum aside
+    pub(super) fn vote_passes(&self, proposal_id: u64, tally: &TallyResult) -> bool {
+        match self.emergency_terms.get(&proposal_id) {
+            Some(terms) => self.stake_snapshots.get(&proposal_id)
+                .map_or(false, |snapshot| terms.is_met(tally, snapshot.total_bonded)),
+            None => tally.yes > tally.no,
+        }
+    }
+
+    /// Log how the vote on an emergency proposal ended
+    pub(super) fn audit_emergency_tally(&self, proposal: &Proposal, tally: &TallyResult) {
+        let Some(terms) = self.emergency_terms.get(&proposal.id) else { return };
+        env::log_str(&format!(
+            "EVENT: emergency_proposal_tallied proposal_id={} status={:?} yes={} no={} total_bonded={} threshold_percent={} execution={:?}",
+            proposal.id,
+            proposal.status,
+            tally.yes,
+            tally.no,
+            self.stake_snapshots.get(&proposal.id).map_or(0, |snapshot| snapshot.total_bonded),
+            terms.threshold_percent,
+            proposal.execution
+        ));
+    }
+
+    /// Log the outcome of handing an emergency proposal to its handler
+    pub(super) fn audit_emergency_execution(&self, proposal_id: u64, result: &Result<(), String>) {
+        if !self.emergency_terms.contains_key(&proposal_id) {
+            return;
+        }
+        match result {
+            Ok(()) => env::log_str(&format!(
+                "EVENT: emergency_proposal_executed proposal_id={} height={}",
+                proposal_id, env::block_height()
+            )),
+            Err(error) => env::log_str(&format!(
+                "EVENT: emergency_proposal_failed proposal_id={} height={} error={}",
+                proposal_id, env::block_height(), error
+            )),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::modules::gov::{ProposalHandler, ProposalStatus};
+    use crate::modules::staking::StakingModule;
+
+    /// Handler whose `Reset` content is an emergency measure
+    #[derive(Default)]
+    struct ResetHandler {
+        executed: Vec<u64>,
+    }
+
+    impl ProposalHandler for ResetHandler {
+        fn validate_content(&self, _content: &ProposalContent) -> Result<(), String> {
+            Ok(())
+        }
+
+        fn execute_content(&mut self, proposal_id: u64, _content: &ProposalContent) -> Result<(), String> {
+            self.executed.push(proposal_id);
+            Ok(())
+        }
+
+        fn requires_emergency(&self, content: &ProposalContent) -> bool {
+            content.proposal_type == "Reset"
+        }
+    }
+
+    fn account(name: &str) -> AccountId {
+        name.parse().unwrap()
+    }
+
+    fn content(proposal_type: &str) -> ProposalContent {
+        ProposalContent {
+            route: "reset".to_string(),
+            proposal_type: proposal_type.to_string(),
+            value: "{}".to_string(),
+        }
+    }
+
+    /// Four voters with 100 each behind a validator bonding 100 itself
+    fn staking() -> StakingModule {
+        let mut staking = StakingModule::new();
+        staking.create_validator(
+            "validator1".to_string(), vec![1; 32], "Validator One".to_string(),
+            None, None, None, None,
+            "0.1".to_string(), "0.2".to_string(), "0.01".to_string(),
+            1, 100,
+        ).unwrap();
+        for index in 0..4 {
+            staking.delegate_coin(format!("voter{}.near", index), "validator1".to_string(), "stake", 100).unwrap();
+        }
+        staking
+    }
+
+    fn submit(gov: &mut GovernanceModule, handler: &mut ResetHandler, staking: &StakingModule) -> u64 {
+        let mut router = ProposalRouter::new();
+        router.add_route("reset", handler).unwrap();
+        let proposal_id = gov.submit_emergency_proposal(
+            &account("alice.near"),
+            "Reset".to_string(),
+            "Reset after a compromise".to_string(),
+            content("Reset"),
+            &mut router,
+            String::new(),
+            10,
+        );
+        gov.snapshot_stake(proposal_id, staking, 10);
+        proposal_id
+    }
+
+    fn vote(gov: &mut GovernanceModule, proposal_id: u64, yes: usize, no: usize) {
+        for index in 0..yes + no {
+            let option = if index < yes { 1 } else { 0 };
+            gov.vote(&account(&format!("voter{}.near", index)), proposal_id, option, String::new());
+        }
+    }
+
+    #[test]
+    fn test_supermajority_and_timelock() {
+        let staking = staking();
+        let mut gov = GovernanceModule::new();
+        let mut handler = ResetHandler::default();
+        let proposal_id = submit(&mut gov, &mut handler, &staking);
+        let proposal = gov.get_proposal(proposal_id).unwrap();
+        assert_eq!(proposal.execution, Some(ExecutionSchedule::AtHeight(60 + 1_000)));
+        assert_eq!(gov.get_emergency_terms(proposal_id), Some(EmergencyParams::default()));
+
+        // 200 of 500 bonded is a majority of the votes cast but short of 67%
+        let short = submit(&mut gov, &mut handler, &staking);
+        vote(&mut gov, short, 2, 1);
+        // Every vote cast is yes, yet the absent stake keeps it below 67%
+        let unanimous = submit(&mut gov, &mut handler, &staking);
+        vote(&mut gov, unanimous, 3, 0);
+        vote(&mut gov, proposal_id, 4, 0);
+        gov.end_block(60);
+        assert_eq!(gov.get_proposal(short).unwrap().status, ProposalStatus::Rejected);
+        assert_eq!(gov.get_proposal(unanimous).unwrap().status, ProposalStatus::Rejected);
+        assert_eq!(gov.get_proposal(proposal_id).unwrap().status, ProposalStatus::Scheduled);
+
+        gov.end_block(1_059);
+        assert!(gov.get_pending_content().is_empty());
+        gov.end_block(1_060);
+        assert_eq!(gov.get_proposal(proposal_id).unwrap().status, ProposalStatus::Passed);
+
+        let mut router = ProposalRouter::new();
+        router.add_route("reset", &mut handler).unwrap();
+        assert!(gov.execute_approved_content(&mut router)[0].1.is_ok());
+        assert_eq!(handler.executed, vec![proposal_id]);
+    }
+
+    #[test]
+    #[should_panic(expected = "must be submitted as emergency proposals")]
+    fn test_emergency_content_needs_emergency_submission() {
+        let mut gov = GovernanceModule::new();
+        let mut handler = ResetHandler::default();
+        let mut router = ProposalRouter::new();
+        router.add_route("reset", &mut handler).unwrap();
+        gov.submit_content_proposal(
+            &account("alice.near"),
+            "Reset".to_string(),
+            "Reset after a compromise".to_string(),
+            content("Reset"),
+            &mut router,
+            String::new(),
+            None,
+            10,
+        );
+    }
+
+    #[test]
+    fn test_threshold_needs_stake_snapshot() {
+        let mut gov = GovernanceModule::new();
+        let mut handler = ResetHandler::default();
+        let mut router = ProposalRouter::new();
+        router.add_route("reset", &mut handler).unwrap();
+        let proposal_id = gov.submit_emergency_proposal(
+            &account("alice.near"),
+            "Reset".to_string(),
+            "Reset after a compromise".to_string(),
+            content("Reset"),
+            &mut router,
+            String::new(),
+            10,
+        );
+        vote(&mut gov, proposal_id, 3, 0);
+        gov.end_block(60);
+        assert_eq!(gov.get_proposal(proposal_id).unwrap().status, ProposalStatus::Rejected);
+
+        let terms = EmergencyParams::default();
+        assert!(terms.is_met(&TallyResult { yes: 67, no: 0, delegated: 0 }, 100));
+        assert!(!terms.is_met(&TallyResult { yes: 66, no: 0, delegated: 0 }, 100));
+    }
+
+    #[test]
+    fn test_params_validation() {
+        assert!(EmergencyParams::default().validate().is_ok());
+        assert!(EmergencyParams { threshold_percent: 50, timelock_blocks: 10 }.validate().is_err());
+        assert!(EmergencyParams { threshold_percent: 101, timelock_blocks: 10 }.validate().is_err());
+        assert!(EmergencyParams { threshold_percent: 80, timelock_blocks: 0 }.validate().is_err());
+    }
+}
@@ -0,0 +1,39 @@
+/// Expected Keepers
+///
+/// The gov module reads bonded stake to weight votes. It depends on this
+/// `StakingKeeper` instead of the staking module, so tallies can be tested
+/// against a fixed set of delegations. Deposits in several denoms are
+/// valued through a `PriceKeeper` in the same way.
+
+use crate::modules::staking::{Delegation, StakingModule, Validator};
+use crate::Balance;
+
+/// Staking functions the gov module uses
+pub trait StakingKeeper {
+    fn get_bonded_validators(&self) -> Vec<Validator>;
+
+    fn get_validator_delegations(&self, validator_address: String) -> Vec<Delegation>;
+
+    /// Tokens a delegation's shares are worth
+    fn delegation_tokens(&self, delegation: &Delegation) -> Balance;
+}
+
+/// Prices deposits are valued with
+pub trait PriceKeeper {
+    /// Worth of `amount` of `denom` in the native denom, `None` without a price
+    fn value_of(&self, denom: &str, amount: Balance) -> Option<Balance>;
+}
+
+impl StakingKeeper for StakingModule {
+    fn get_bonded_validators(&self) -> Vec<Validator> {
+        StakingModule::get_bonded_validators(self)
+    }
+
+    fn get_validator_delegations(&self, validator_address: String) -> Vec<Delegation> {
+        StakingModule::get_validator_delegations(self, validator_address)
+    }
+
+    fn delegation_tokens(&self, delegation: &Delegation) -> Balance {
+        StakingModule::delegation_tokens(self, delegation)
+    }
+}
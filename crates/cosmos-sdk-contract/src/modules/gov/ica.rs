@@ -0,0 +1,327 @@
+/// Cross-Chain Execution through Interchain Accounts
+///
+/// A proposal can carry Cosmos messages for a counterparty chain instead of
+/// a parameter change. Governance owns an interchain account on that chain
+/// (owner `gov`), so once the proposal passes the messages are dispatched in
+/// an ICS-27 packet and executed there by the account, letting this contract
+/// manage assets held on remote chains.
+///
+/// An execution stays queued until its packet settles. A success
+/// acknowledgement completes it, an error acknowledgement fails the
+/// proposal with the host's error, and a timeout leaves it queued so it can
+/// be dispatched again once the account's channel is reopened. Packets time
+/// out `ica_timeout` nanoseconds after dispatch.
+
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::serde::{Deserialize, Serialize};
+use near_sdk::{env, AccountId};
+
+use super::{ExecutionSchedule, GovernanceModule, ProposalStatus};
+use crate::modules::ibc::channel::{Acknowledgement, ChannelModule};
+use crate::modules::ibc::ica::{IcaControllerModule, IcaMessage};
+
+/// Owner of the interchain accounts controlled by governance
+pub const GOV_ICA_OWNER: &str = "gov";
+
+/// Parameter holding how long a dispatched packet may wait for the host
+pub const ICA_TIMEOUT_PARAM: &str = "ica_timeout";
+
+/// Ten minutes, in nanoseconds
+pub const DEFAULT_ICA_TIMEOUT_NS: u64 = 600_000_000_000;
+
+/// Messages a passed proposal sends to a remote chain
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq)]
+pub struct IcaExecution {
+    /// Controller connection to the remote chain
+    pub connection_id: String,
+    pub messages: Vec<IcaMessage>,
+    #[serde(default)]
+    pub memo: String,
+}
+
+impl IcaExecution {
+    pub fn validate(&self) -> Result<(), String> {
+        if self.connection_id.is_empty() {
+            return Err("ICA execution needs a connection".to_string());
+        }
+        if self.messages.is_empty() {
+            return Err("ICA execution has no messages".to_string());
+        }
+        if let Some(message) = self.messages.iter().find(|message| !message.type_url.starts_with('/')) {
+            return Err(format!("Invalid message type URL {}", message.type_url));
+        }
+        Ok(())
+    }
+}
+
+impl GovernanceModule {
+    /// Submit a proposal executing messages on a remote chain
+    pub fn submit_ica_proposal(
+        &mut self,
+        proposer: &AccountId,
+        title: String,
+        description: String,
+        execution_msgs: IcaExecution,
+        metadata: String,
+        execution: Option<ExecutionSchedule>,
+        current_height: u64,
+    ) -> u64 {
+        execution_msgs.validate().unwrap_or_else(|e| env::panic_str(&e));
+
+        let proposal_id = self.submit_proposal(
+            proposer,
+            title,
+            description,
+            String::new(),
+            String::new(),
+            metadata,
+            execution,
+            current_height,
+        );
+
+        let mut proposal = self.proposals.get(&proposal_id).expect("Proposal not found");
+        proposal.ica_execution = Some(execution_msgs);
+        self.proposals.insert(&proposal_id, &proposal);
+        proposal_id
+    }
+
+    /// Queue the messages of a passed proposal for dispatch
+    pub(super) fn approve_ica_execution(&mut self, proposal_id: u64, execution: IcaExecution) -> Result<(), String> {
+        execution.validate()?;
+        env::log_str(&format!(
+            "Governance: ICA execution of proposal {} approved on {}",
+            proposal_id, execution.connection_id
+        ));
+        self.pending_ica.insert(&proposal_id, &execution);
+        Ok(())
+    }
+
+    pub fn get_pending_ica_executions(&self) -> Vec<(u64, IcaExecution)> {
+        self.pending_ica.to_vec()
+    }
+
+    /// Channel and sequence of the packet carrying the execution of a
+    /// proposal, while it waits for the host
+    pub fn get_dispatched_ica_packet(&self, proposal_id: u64) -> Option<(String, u64)> {
+        self.dispatched_ica.get(&proposal_id)
+    }
+
+    /// Nanoseconds a dispatched packet may wait for the host chain
+    pub fn ica_timeout(&self) -> u64 {
+        self.get_parameter(&ICA_TIMEOUT_PARAM.to_string())
+            .parse()
+            .unwrap_or(DEFAULT_ICA_TIMEOUT_NS)
+    }
+
+    /// Send the approved messages of a proposal through governance's ICA
+    ///
+    /// The execution stays queued until the packet is acknowledged, and
+    /// when the packet cannot be sent, e.g. while the account's channel is
+    /// not open yet.
+    pub fn dispatch_ica_execution(
+        &mut self,
+        proposal_id: u64,
+        ica: &mut IcaControllerModule,
+        channel_module: &mut ChannelModule,
+    ) -> Result<u64, String> {
+        let execution = self.pending_ica.get(&proposal_id)
+            .ok_or_else(|| format!("No approved ICA execution for proposal {}", proposal_id))?;
+        if let Some((channel_id, sequence)) = self.dispatched_ica.get(&proposal_id) {
+            return Err(format!(
+                "ICA execution of proposal {} is already in packet {} on {}",
+                proposal_id, sequence, channel_id
+            ));
+        }
+
+        let timeout_timestamp = env::block_timestamp().saturating_add(self.ica_timeout());
+        let sequence = ica.send_tx(
+            channel_module,
+            GOV_ICA_OWNER,
+            &execution.connection_id,
+            &execution.messages,
+            execution.memo.clone(),
+            timeout_timestamp,
+        )?;
+        let channel_id = ica.get_account(GOV_ICA_OWNER, &execution.connection_id)
+            .map(|account| account.channel_id)
+            .unwrap_or_default();
+
+        env::log_str(&format!(
+            "Governance: Dispatched ICA execution of proposal {} as packet {} on {}",
+            proposal_id, sequence, channel_id
+        ));
+        self.dispatched_ica.insert(&proposal_id, &(channel_id, sequence));
+        Ok(sequence)
+    }
+
+    /// Settle the execution carried by an acknowledged packet, returning
+    /// its proposal id
+    pub fn on_ica_acknowledgement(
+        &mut self,
+        ica: &mut IcaControllerModule,
+        channel_id: &str,
+        sequence: u64,
+        ack: &Acknowledgement,
+    ) -> Result<u64, String> {
+        let proposal_id = self.settle_ica_packet(ica, channel_id, sequence)?;
+        self.pending_ica.remove(&proposal_id);
+
+        if ack.is_success() {
+            env::log_str(&format!("Governance: ICA execution of proposal {} completed", proposal_id));
+        } else {
+            let error = String::from_utf8_lossy(&ack.data).to_string();
+            if let Some(mut proposal) = self.proposals.get(&proposal_id) {
+                proposal.status = ProposalStatus::Failed;
+                proposal.failed_reason = Some(format!("ICA execution failed: {}", error));
+                self.proposals.insert(&proposal_id, &proposal);
+            }
+            env::log_str(&format!("Governance: ICA execution of proposal {} FAILED - {}", proposal_id, error));
+        }
+        Ok(proposal_id)
+    }
+
+    /// Requeue the execution carried by a timed out packet, returning its
+    /// proposal id
+    ///
+    /// A timeout closes the ordered ICA channel, the execution is sent
+    /// again by `dispatch_ica_execution` once the channel is reopened.
+    pub fn on_ica_timeout(&mut self, ica: &mut IcaControllerModule, channel_id: &str, sequence: u64) -> Result<u64, String> {
+        let proposal_id = self.settle_ica_packet(ica, channel_id, sequence)?;
+        env::log_str(&format!(
+            "Governance: ICA execution of proposal {} timed out, queued again",
+            proposal_id
+        ));
+        Ok(proposal_id)
+    }
+
+    fn settle_ica_packet(&mut self, ica: &mut IcaControllerModule, channel_id: &str, sequence: u64) -> Result<u64, String> {
+        let proposal_id = self.dispatched_ica.iter()
+            .find(|(_, packet)| packet.0 == channel_id && packet.1 == sequence)
+            .map(|(proposal_id, _)| proposal_id)
+            .ok_or_else(|| format!("Packet {} on {} carries no ICA execution", sequence, channel_id))?;
+        self.dispatched_ica.remove(&proposal_id);
+        ica.on_packet_settled(channel_id, sequence);
+        Ok(proposal_id)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::modules::gov::ProposalStatus;
+    use crate::modules::ibc::ica::{IcaMetadata, ENCODING_PROTO3_JSON, ICA_VERSION, TX_TYPE_SDK_MULTI_MSG};
+
+    fn account(name: &str) -> AccountId {
+        name.parse().unwrap()
+    }
+
+    fn execution() -> IcaExecution {
+        IcaExecution {
+            connection_id: "connection-0".to_string(),
+            messages: vec![IcaMessage {
+                type_url: "/cosmos.bank.v1beta1.MsgSend".to_string(),
+                value: r#"{"to_address":"cosmos1treasury","amount":[{"denom":"uatom","amount":"100"}]}"#.to_string(),
+            }],
+            memo: String::new(),
+        }
+    }
+
+    /// Open governance's account on connection-0, returning its channel
+    fn open_gov_account(ica: &mut IcaControllerModule, channels: &mut ChannelModule) -> String {
+        let channel_id = ica.register_account(channels, GOV_ICA_OWNER, "connection-0", "connection-5").unwrap();
+        let version = serde_json::to_string(&IcaMetadata {
+            version: ICA_VERSION.to_string(),
+            controller_connection_id: "connection-0".to_string(),
+            host_connection_id: "connection-5".to_string(),
+            address: "cosmos1icaaccount".to_string(),
+            encoding: ENCODING_PROTO3_JSON.to_string(),
+            tx_type: TX_TYPE_SDK_MULTI_MSG.to_string(),
+        }).unwrap();
+        ica.on_chan_open_ack(channels, GOV_ICA_OWNER, "connection-0", "channel-9".to_string(), version, vec![1], 1)
+            .unwrap();
+        channel_id
+    }
+
+    #[test]
+    fn test_passed_proposal_dispatches_through_ica() {
+        let mut gov = GovernanceModule::new();
+        let mut ica = IcaControllerModule::new();
+        let mut channels = ChannelModule::new();
+
+        let proposal_id = gov.submit_ica_proposal(
+            &account("alice.near"),
+            "Move treasury".to_string(),
+            "Send remote funds".to_string(),
+            execution(),
+            String::new(),
+            None,
+            10,
+        );
+        gov.vote(&account("alice.near"), proposal_id, 1, String::new());
+        gov.vote(&account("bob.near"), proposal_id, 1, String::new());
+        gov.end_block(100);
+
+        assert_eq!(gov.get_proposal(proposal_id).unwrap().status, ProposalStatus::Passed);
+        assert_eq!(gov.get_pending_ica_executions(), vec![(proposal_id, execution())]);
+
+        // Stays queued until governance's account is open
+        assert!(gov.dispatch_ica_execution(proposal_id, &mut ica, &mut channels).is_err());
+
+        let channel_id = open_gov_account(&mut ica, &mut channels);
+
+        assert_eq!(gov.dispatch_ica_execution(proposal_id, &mut ica, &mut channels), Ok(1));
+        assert!(gov.dispatch_ica_execution(proposal_id, &mut ica, &mut channels).unwrap_err().contains("already"));
+        assert_eq!(gov.get_dispatched_ica_packet(proposal_id), Some((channel_id.clone(), 1)));
+        assert_eq!(ica.pending_txs(GOV_ICA_OWNER).len(), 1);
+
+        // A timeout leaves the execution queued for another dispatch
+        assert_eq!(gov.on_ica_timeout(&mut ica, &channel_id, 1), Ok(proposal_id));
+        assert_eq!(gov.get_pending_ica_executions().len(), 1);
+        assert!(ica.pending_txs(GOV_ICA_OWNER).is_empty());
+        assert!(gov.on_ica_timeout(&mut ica, &channel_id, 1).is_err());
+
+        // An acknowledgement completes it
+        assert_eq!(gov.dispatch_ica_execution(proposal_id, &mut ica, &mut channels), Ok(2));
+        let ack = Acknowledgement::success(b"AQ==".to_vec());
+        assert_eq!(gov.on_ica_acknowledgement(&mut ica, &channel_id, 2, &ack), Ok(proposal_id));
+        assert!(gov.get_pending_ica_executions().is_empty());
+        assert_eq!(gov.get_proposal(proposal_id).unwrap().status, ProposalStatus::Passed);
+    }
+
+    #[test]
+    fn test_error_acknowledgement_fails_the_proposal() {
+        let mut gov = GovernanceModule::new();
+        let mut ica = IcaControllerModule::new();
+        let mut channels = ChannelModule::new();
+        let proposal_id = gov.submit_ica_proposal(
+            &account("alice.near"),
+            "Move treasury".to_string(),
+            "Send remote funds".to_string(),
+            execution(),
+            String::new(),
+            None,
+            10,
+        );
+        gov.vote(&account("alice.near"), proposal_id, 1, String::new());
+        gov.vote(&account("bob.near"), proposal_id, 1, String::new());
+        gov.end_block(100);
+        let channel_id = open_gov_account(&mut ica, &mut channels);
+
+        let sequence = gov.dispatch_ica_execution(proposal_id, &mut ica, &mut channels).unwrap();
+        let ack = Acknowledgement::error("error: insufficient funds".to_string());
+        assert_eq!(gov.on_ica_acknowledgement(&mut ica, &channel_id, sequence, &ack), Ok(proposal_id));
+
+        let proposal = gov.get_proposal(proposal_id).unwrap();
+        assert_eq!(proposal.status, ProposalStatus::Failed);
+        assert!(proposal.failed_reason.unwrap().contains("insufficient funds"));
+        assert!(gov.get_pending_ica_executions().is_empty());
+    }
+
+    #[test]
+    fn test_execution_validation() {
+        assert!(execution().validate().is_ok());
+        let mut invalid = execution();
+        invalid.messages.clear();
+        assert!(invalid.validate().is_err());
+    }
+}
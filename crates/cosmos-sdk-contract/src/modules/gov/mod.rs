@@ -1,13 +1,54 @@
 use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
-use near_sdk::collections::UnorderedMap;
+use near_sdk::collections::{LookupMap, UnorderedMap, Vector};
 use near_sdk::{env, AccountId};
+use near_sdk::serde::{Deserialize, Serialize};
 
-#[derive(BorshDeserialize, BorshSerialize)]
+use crate::handler::gas::{GasSchedule, GAS_SCHEDULE_PARAM};
+use crate::handler::input_limits::{InputLimits, INPUT_LIMITS_PARAM};
+use crate::handler::rate_limit::{RateLimitConfig, RATE_LIMIT_PARAM};
+use crate::math::{safe_add, safe_sub};
+use crate::modules::auth::fee_policy::{FeePolicy, FEE_POLICY_PARAM};
+use crate::modules::mint::{InflationDistribution, INFLATION_DISTRIBUTION_PARAM};
+use crate::types::time::BlockTime;
+
+pub mod deposit;
+pub mod emergency;
+pub mod expected_keepers;
+pub mod ica;
+pub mod params;
+pub mod router;
+pub mod simulate;
+pub mod upgrade;
+
+pub use deposit::{DenomMinimum, Deposit, DepositParams, DEPOSIT_PARAMS_PARAM};
+pub use emergency::{EmergencyParams, EMERGENCY_PARAMS_PARAM};
+pub use expected_keepers::{PriceKeeper, StakingKeeper};
+pub use ica::{IcaExecution, DEFAULT_ICA_TIMEOUT_NS, ICA_TIMEOUT_PARAM};
+pub use params::{default_parameters, ParamDefault, ParamDefaults};
+pub use router::{ProposalContent, ProposalHandler, ProposalRouter};
+pub use simulate::ParamChangePreview;
+pub use upgrade::{code_hash, UpgradePlan, MIGRATE_GAS, UPGRADE_CALLBACK_GAS};
+
+/// Default limit on proposal and vote metadata length, as in gov v1
+pub const DEFAULT_MAX_METADATA_LEN: usize = 255;
+
+/// Default share of snapshotted bonded stake that must vote, in percent
+pub const DEFAULT_QUORUM_PERCENT: u128 = 33;
+
+/// Parameter holding the height at which the chain halts, 0 when unset
+pub const HALT_HEIGHT_PARAM: &str = "halt_height";
+
+/// Delegators a representative may have, which bounds the cost of its votes
+pub const MAX_VOTE_DELEGATORS: usize = 500;
+
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug)]
 pub struct Proposal {
     pub id: u64,
     pub proposer: AccountId,
     pub title: String,
     pub description: String,
+    /// Off-chain metadata such as an IPFS CID, forum URL or JSON document
+    pub metadata: String,
     pub param_key: String,
     pub param_value: String,
     pub start_height: u64,
@@ -15,20 +56,95 @@ pub struct Proposal {
     pub yes_votes: u32,
     pub no_votes: u32,
     pub status: ProposalStatus,
+    /// Why execution failed when the status is `Failed`
+    pub failed_reason: Option<String>,
+    /// When a passed proposal takes effect, immediately when `None`
+    pub execution: Option<ExecutionSchedule>,
+    /// Contract code upgrade carried instead of a parameter change
+    pub upgrade: Option<UpgradePlan>,
+    /// Messages for a remote chain carried instead of a parameter change
+    pub ica_execution: Option<IcaExecution>,
+    /// Content for a module's proposal handler, see `ProposalRouter`
+    pub content: Option<ProposalContent>,
 }
 
-#[derive(BorshDeserialize, BorshSerialize, PartialEq, Debug)]
+/// Point in the future at which a passed proposal is executed
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, PartialEq, Debug)]
+pub enum ExecutionSchedule {
+    /// First block at or after this height
+    AtHeight(u64),
+    /// First block at or after this timestamp in nanoseconds
+    AtTime(u64),
+}
+
+impl ExecutionSchedule {
+    pub fn is_due(&self, height: u64, timestamp: u64) -> bool {
+        match self {
+            ExecutionSchedule::AtHeight(at) => height >= *at,
+            ExecutionSchedule::AtTime(at) => timestamp >= *at,
+        }
+    }
+
+    /// Expected execution time, estimating a height from the block time
+    pub fn estimated_time(&self, block_time: &BlockTime, now_height: u64, now_time: u64) -> u64 {
+        match self {
+            ExecutionSchedule::AtHeight(at) => block_time.time_at_height(now_height, now_time, *at),
+            ExecutionSchedule::AtTime(at) => *at,
+        }
+    }
+}
+
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, PartialEq, Debug)]
 pub enum ProposalStatus {
     Active,
     Passed,
     Rejected,
+    /// Passed the vote but its change could not be applied
+    Failed,
+    /// Passed the vote and waits in the execution queue
+    Scheduled,
 }
 
-#[derive(BorshDeserialize, BorshSerialize)]
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug)]
 pub struct Vote {
     pub proposal_id: u64,
     pub voter: AccountId,
     pub option: u8, // 0 = No, 1 = Yes
+    pub metadata: String,
+}
+
+/// Bonded stake recorded when a proposal entered voting
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq)]
+pub struct StakeSnapshot {
+    pub height: u64,
+    pub total_bonded: u128,
+}
+
+/// Vote weights of a proposal, kept up to date as votes are cast
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, Default, PartialEq)]
+pub struct TallyResult {
+    pub yes: u128,
+    pub no: u128,
+    /// Part of `yes` and `no` cast by representatives for their delegators
+    pub delegated: u128,
+}
+
+impl TallyResult {
+    fn add(&mut self, option: u8, power: u128) {
+        if option == 1 {
+            self.yes = safe_add(self.yes, power, "Yes votes");
+        } else {
+            self.no = safe_add(self.no, power, "No votes");
+        }
+    }
+
+    fn sub(&mut self, option: u8, power: u128) {
+        if option == 1 {
+            self.yes = safe_sub(self.yes, power, "Yes votes");
+        } else {
+            self.no = safe_sub(self.no, power, "No votes");
+        }
+    }
 }
 
 #[derive(BorshDeserialize, BorshSerialize)]
@@ -37,21 +153,69 @@ pub struct GovernanceModule {
     votes: UnorderedMap<String, Vote>, // key: "proposal_id:voter"
     parameters: UnorderedMap<String, String>,
     next_proposal_id: u64,
+    /// Scheduled proposals waiting for their execution point
+    execution_queue: Vector<u64>,
+    /// Vote representative by delegating account
+    vote_delegations: UnorderedMap<AccountId, AccountId>,
+    /// Delegating accounts by representative
+    vote_delegators: LookupMap<AccountId, Vec<AccountId>>,
+    /// Running tally by proposal id
+    tallies: LookupMap<u64, TallyResult>,
+    /// Option and power a representative cast for a delegator that has not
+    /// voted itself, key: "proposal_id:delegator"
+    delegated_votes: LookupMap<String, (u8, u128)>,
+    stake_snapshots: UnorderedMap<u64, StakeSnapshot>,
+    /// Bonded stake per account at voting start, key: "proposal_id:account"
+    snapshot_stakes: LookupMap<String, u128>,
+    /// Upgrade approved by governance and waiting for its code
+    pending_upgrade: Option<UpgradePlan>,
+    /// Passed ICA executions waiting to be dispatched or acknowledged, by
+    /// proposal id
+    pending_ica: UnorderedMap<u64, IcaExecution>,
+    /// Channel and sequence of the packet each dispatched execution is in,
+    /// by proposal id, until the packet is acknowledged or times out
+    dispatched_ica: UnorderedMap<u64, (String, u64)>,
+    /// Passed content waiting for its handler, by proposal id
+    pending_content: UnorderedMap<u64, ProposalContent>,
+    /// Deposits by proposal id, until the hosting contract takes them
+    deposits: LookupMap<u64, Vec<Deposit>>,
+    /// Terms of emergency proposals as of their submission
+    emergency_terms: LookupMap<u64, EmergencyParams>,
 }
 
 impl GovernanceModule {
     pub fn new() -> Self {
+        Self::with_prefix(b"")
+    }
+
+    /// Governance whose collections live under `prefix`, so it can share a
+    /// contract's storage with the bank and other modules
+    pub fn with_prefix(prefix: &[u8]) -> Self {
+        let key = |name: &[u8]| [prefix, name].concat();
         let mut module = Self {
-            proposals: UnorderedMap::new(b"p".to_vec()),
-            votes: UnorderedMap::new(b"vo".to_vec()),
-            parameters: UnorderedMap::new(b"pa".to_vec()),
+            proposals: UnorderedMap::new(key(b"p")),
+            votes: UnorderedMap::new(key(b"vo")),
+            parameters: UnorderedMap::new(key(b"pa")),
             next_proposal_id: 1,
+            execution_queue: Vector::new(key(b"eq")),
+            vote_delegations: UnorderedMap::new(key(b"vd")),
+            vote_delegators: LookupMap::new(key(b"vg")),
+            tallies: LookupMap::new(key(b"vt")),
+            delegated_votes: LookupMap::new(key(b"vc")),
+            stake_snapshots: UnorderedMap::new(key(b"ss")),
+            snapshot_stakes: LookupMap::new(key(b"sa")),
+            pending_upgrade: None,
+            pending_ica: UnorderedMap::new(key(b"pi")),
+            dispatched_ica: UnorderedMap::new(key(b"pd")),
+            pending_content: UnorderedMap::new(key(b"pc")),
+            deposits: LookupMap::new(key(b"dp")),
+            emergency_terms: LookupMap::new(key(b"em")),
         };
         
         // Initialize default parameters
-        module.parameters.insert(&"reward_rate".to_string(), &"5".to_string());
-        module.parameters.insert(&"min_validator_stake".to_string(), &"100".to_string());
-        module.parameters.insert(&"voting_period".to_string(), &"50".to_string());
+        for entry in default_parameters().iter() {
+            module.parameters.insert(&entry.key.to_string(), &entry.value);
+        }
         
         module
     }
@@ -63,18 +227,34 @@ impl GovernanceModule {
         description: String,
         param_key: String,
         param_value: String,
+        metadata: String,
+        execution: Option<ExecutionSchedule>,
         current_height: u64,
     ) -> u64 {
+        self.assert_metadata_len(&metadata);
+
         let voting_period: u64 = self.parameters.get(&"voting_period".to_string())
             .unwrap_or("50".to_string())
             .parse()
             .unwrap_or(50);
 
+        if let Some(ExecutionSchedule::AtHeight(height)) = execution {
+            if height <= current_height + voting_period {
+                env::panic_str("Execution height must be after the voting period");
+            }
+        }
+        if let Some(ExecutionSchedule::AtTime(time)) = execution {
+            if time <= env::block_timestamp() {
+                env::panic_str("Execution time must be in the future");
+            }
+        }
+
         let proposal = Proposal {
             id: self.next_proposal_id,
             proposer: proposer.clone(),
             title,
             description,
+            metadata,
             param_key,
             param_value,
             start_height: current_height,
@@ -82,6 +262,11 @@ impl GovernanceModule {
             yes_votes: 0,
             no_votes: 0,
             status: ProposalStatus::Active,
+            failed_reason: None,
+            execution,
+            upgrade: None,
+            ica_execution: None,
+            content: None,
         };
 
         self.proposals.insert(&self.next_proposal_id, &proposal);
@@ -94,7 +279,9 @@ impl GovernanceModule {
         proposal_id
     }
 
-    pub fn vote(&mut self, voter: &AccountId, proposal_id: u64, option: u8) {
+    pub fn vote(&mut self, voter: &AccountId, proposal_id: u64, option: u8, metadata: String) {
+        self.assert_metadata_len(&metadata);
+
         let mut proposal = self.proposals.get(&proposal_id)
             .expect("Proposal not found");
         
@@ -112,8 +299,10 @@ impl GovernanceModule {
             proposal_id,
             voter: voter.clone(),
             option,
+            metadata,
         };
         self.votes.insert(&vote_key, &vote);
+        self.count_vote(proposal_id, voter, option);
         
         // Update proposal vote counts
         if option == 1 {
@@ -128,11 +317,353 @@ impl GovernanceModule {
             option, proposal_id, voter));
     }
 
+    pub fn get_proposal(&self, proposal_id: u64) -> Option<Proposal> {
+        self.proposals.get(&proposal_id)
+    }
+
+    /// Expected time voting on a proposal ends
+    ///
+    /// Voting periods are counted in blocks, so this is only an estimate
+    /// from the observed block time.
+    pub fn voting_end_time(&self, proposal_id: u64, block_time: &BlockTime, now_height: u64, now_time: u64) -> Option<u64> {
+        let proposal = self.proposals.get(&proposal_id)?;
+        Some(block_time.time_at_height(now_height, now_time, proposal.end_height))
+    }
+
+    pub fn get_vote(&self, proposal_id: u64, voter: &AccountId) -> Option<Vote> {
+        self.votes.get(&format!("{}:{}", proposal_id, voter))
+    }
+
+    /// Add a vote to the running tally of its proposal
+    ///
+    /// A representative's vote also counts for its delegators that have not
+    /// voted, and a delegator voting later takes its weight back from the
+    /// representative's option. A delegator moved to another representative
+    /// is counted once, with the option of the representative that voted
+    /// last.
+    fn count_vote(&mut self, proposal_id: u64, voter: &AccountId, option: u8) {
+        let mut tally = self.tallies.get(&proposal_id).unwrap_or_default();
+        tally.add(option, self.voting_power(proposal_id, voter));
+        self.uncount_delegated_vote(&mut tally, proposal_id, voter);
+
+        for delegator in self.get_vote_delegators(voter) {
+            if self.votes.get(&format!("{}:{}", proposal_id, delegator)).is_some() {
+                continue;
+            }
+            self.uncount_delegated_vote(&mut tally, proposal_id, &delegator);
+            let power = self.voting_power(proposal_id, &delegator);
+            tally.add(option, power);
+            tally.delegated = safe_add(tally.delegated, power, "Delegated votes");
+            self.delegated_votes.insert(&format!("{}:{}", proposal_id, delegator), &(option, power));
+        }
+
+        self.tallies.insert(&proposal_id, &tally);
+    }
+
+    /// Take back the power a representative cast for `delegator`
+    fn uncount_delegated_vote(&mut self, tally: &mut TallyResult, proposal_id: u64, delegator: &AccountId) {
+        if let Some((option, power)) = self.delegated_votes.remove(&format!("{}:{}", proposal_id, delegator)) {
+            tally.sub(option, power);
+            tally.delegated = safe_sub(tally.delegated, power, "Delegated votes");
+        }
+    }
+
+    /// Let `representative` vote on behalf of `delegator`
+    ///
+    /// A direct vote by the delegator always overrides its representative.
+    /// A delegation applies to the votes its representative casts from then
+    /// on, votes already cast keep the delegations they were counted with.
+    pub fn delegate_vote(&mut self, delegator: &AccountId, representative: &AccountId) {
+        if delegator == representative {
+            env::panic_str("Cannot delegate votes to yourself");
+        }
+        if self.vote_delegations.get(representative).is_some() {
+            env::panic_str("Representative delegates its own votes");
+        }
+        if !self.get_vote_delegators(delegator).is_empty() {
+            env::panic_str("Account is a representative and cannot delegate its votes");
+        }
+        let mut delegators = self.get_vote_delegators(representative);
+        if delegators.len() >= MAX_VOTE_DELEGATORS {
+            env::panic_str(&format!("Representative already has {} delegators", MAX_VOTE_DELEGATORS));
+        }
+
+        if let Some(previous) = self.vote_delegations.insert(delegator, representative) {
+            self.remove_vote_delegator(&previous, delegator);
+        }
+        delegators.push(delegator.clone());
+        self.vote_delegators.insert(representative, &delegators);
+
+        env::log_str(&format!("Governance: {} delegated votes to {}", delegator, representative));
+    }
+
+    pub fn undelegate_vote(&mut self, delegator: &AccountId) {
+        let representative = self.vote_delegations.remove(delegator)
+            .unwrap_or_else(|| env::panic_str("No vote delegation found"));
+        self.remove_vote_delegator(&representative, delegator);
+
+        env::log_str(&format!("Governance: {} removed its vote delegation", delegator));
+    }
+
+    fn remove_vote_delegator(&mut self, representative: &AccountId, delegator: &AccountId) {
+        let mut delegators = self.get_vote_delegators(representative);
+        delegators.retain(|account| account != delegator);
+        if delegators.is_empty() {
+            self.vote_delegators.remove(representative);
+        } else {
+            self.vote_delegators.insert(representative, &delegators);
+        }
+    }
+
+    pub fn get_vote_representative(&self, delegator: &AccountId) -> Option<AccountId> {
+        self.vote_delegations.get(delegator)
+    }
+
+    pub fn get_vote_delegators(&self, representative: &AccountId) -> Vec<AccountId> {
+        self.vote_delegators.get(representative).unwrap_or_default()
+    }
+
+    /// Record bonded stake as voting power for a proposal entering voting
+    ///
+    /// Votes are weighted by this snapshot, so stake delegated after the
+    /// proposal started cannot change the outcome.
+    pub fn snapshot_stake(&mut self, proposal_id: u64, staking: &dyn StakingKeeper, current_height: u64) {
+        let proposal = self.proposals.get(&proposal_id)
+            .expect("Proposal not found");
+        assert_eq!(proposal.status, ProposalStatus::Active, "Proposal not active");
+        if self.stake_snapshots.get(&proposal_id).is_some() {
+            env::panic_str("Stake already snapshotted for this proposal");
+        }
+        // Votes are tallied with the power they had when cast
+        if self.tallies.get(&proposal_id).is_some() {
+            env::panic_str("Stake must be snapshotted before voting starts");
+        }
+
+        let mut total_bonded = 0;
+        for validator in staking.get_bonded_validators() {
+            for delegation in staking.get_validator_delegations(validator.operator_address.clone()) {
+                let tokens = staking.delegation_tokens(&delegation);
+                if tokens == 0 {
+                    continue;
+                }
+                let key = format!("{}:{}", proposal_id, delegation.delegator_address);
+                let stake = self.snapshot_stakes.get(&key).unwrap_or(0);
+                self.snapshot_stakes.insert(&key, &safe_add(stake, tokens, "Snapshot stake"));
+                total_bonded = safe_add(total_bonded, tokens, "Snapshot bonded tokens");
+            }
+        }
+
+        self.stake_snapshots.insert(&proposal_id, &StakeSnapshot {
+            height: current_height,
+            total_bonded,
+        });
+
+        env::log_str(&format!("Governance: Snapshotted {} bonded stake for proposal {}", 
+            total_bonded, proposal_id));
+    }
+
+    pub fn get_stake_snapshot(&self, proposal_id: u64) -> Option<StakeSnapshot> {
+        self.stake_snapshots.get(&proposal_id)
+    }
+
+    /// Voting weight of an account on a proposal
+    ///
+    /// Its snapshotted bonded stake, or one vote per account for proposals
+    /// without a snapshot.
+    pub fn voting_power(&self, proposal_id: u64, account: &AccountId) -> u128 {
+        if self.stake_snapshots.get(&proposal_id).is_none() {
+            return 1;
+        }
+        self.snapshot_stakes.get(&format!("{}:{}", proposal_id, account)).unwrap_or(0)
+    }
+
+    fn quorum_reached(&self, proposal_id: u64, tally: &TallyResult) -> bool {
+        let total_votes = tally.yes + tally.no;
+        match self.stake_snapshots.get(&proposal_id) {
+            Some(snapshot) => {
+                let quorum: u128 = self.get_parameter(&"quorum".to_string())
+                    .parse()
+                    .unwrap_or(DEFAULT_QUORUM_PERCENT);
+                total_votes > 0 && total_votes * 100 >= snapshot.total_bonded * quorum
+            }
+            None => total_votes >= 2, // headcount quorum (simplified)
+        }
+    }
+
+    /// Direct votes plus the votes representatives cast for delegators that
+    /// did not vote themselves
+    pub fn tally(&self, proposal_id: u64) -> TallyResult {
+        self.tallies.get(&proposal_id).unwrap_or_default()
+    }
+
+    pub fn max_metadata_len(&self) -> usize {
+        self.get_parameter(&"max_metadata_len".to_string())
+            .parse()
+            .unwrap_or(DEFAULT_MAX_METADATA_LEN)
+    }
+
+    fn assert_metadata_len(&self, metadata: &str) {
+        let max_len = self.max_metadata_len();
+        if metadata.len() > max_len {
+            env::panic_str(&format!("Metadata too long: {} bytes, max {}", metadata.len(), max_len));
+        }
+    }
+
+    /// Check that a parameter change can be applied
+    pub fn validate_parameter(&self, key: &str, value: &str) -> Result<(), String> {
+        if self.parameters.get(&key.to_string()).is_none() {
+            return Err(format!("Unknown parameter {}", key));
+        }
+        if key == GAS_SCHEDULE_PARAM {
+            return GasSchedule::from_json(value)?.validate_upgrade(&self.gas_schedule());
+        }
+        if key == INFLATION_DISTRIBUTION_PARAM {
+            return InflationDistribution::from_json(value)?.validate();
+        }
+        if key == FEE_POLICY_PARAM {
+            return FeePolicy::from_json(value)?.validate();
+        }
+        if key == RATE_LIMIT_PARAM {
+            return RateLimitConfig::from_json(value)?.validate();
+        }
+        if key == INPUT_LIMITS_PARAM {
+            return InputLimits::from_json(value)?.validate();
+        }
+        if key == DEPOSIT_PARAMS_PARAM {
+            return DepositParams::from_json(value)?.validate();
+        }
+        if key == EMERGENCY_PARAMS_PARAM {
+            return EmergencyParams::from_json(value)?.validate();
+        }
+
+        let parsed: u64 = value.parse()
+            .map_err(|_| format!("Invalid value {} for parameter {}: expected an integer", value, key))?;
+        if (key == "voting_period" || key == ICA_TIMEOUT_PARAM) && parsed == 0 {
+            return Err(format!("Invalid value 0 for parameter {}: must be positive", key));
+        }
+        Ok(())
+    }
+
+    /// Apply the change carried by a passed proposal
+    fn execute_proposal(&mut self, proposal: &Proposal) -> Result<(), String> {
+        if let Some(plan) = &proposal.upgrade {
+            return self.approve_upgrade(plan.clone());
+        }
+        if let Some(execution) = &proposal.ica_execution {
+            return self.approve_ica_execution(proposal.id, execution.clone());
+        }
+        if let Some(content) = &proposal.content {
+            return self.approve_content(proposal.id, content.clone());
+        }
+
+        self.validate_parameter(&proposal.param_key, &proposal.param_value)?;
+        self.parameters.insert(&proposal.param_key, &proposal.param_value);
+        Ok(())
+    }
+
+    /// Execute a passed proposal and record whether it took effect
+    fn apply_proposal(&mut self, proposal: &mut Proposal) {
+        match self.execute_proposal(proposal) {
+            Ok(()) => {
+                proposal.status = ProposalStatus::Passed;
+
+                env::log_str(&format!("Governance: Proposal {} PASSED - {} = {}", 
+                    proposal.id, proposal.param_key, proposal.param_value));
+            }
+            Err(error) => {
+                proposal.status = ProposalStatus::Failed;
+
+                env::log_str(&format!("Governance: Proposal {} FAILED - {}", proposal.id, error));
+                proposal.failed_reason = Some(error);
+            }
+        }
+    }
+
+    /// Execute scheduled proposals whose execution point has been reached
+    fn process_execution_queue(&mut self, current_height: u64, current_time: u64) {
+        let queued: Vec<u64> = self.execution_queue.iter().collect();
+        self.execution_queue.clear();
+
+        for proposal_id in queued {
+            let mut proposal = match self.proposals.get(&proposal_id) {
+                Some(proposal) => proposal,
+                None => continue,
+            };
+            let due = proposal.execution.as_ref()
+                .map_or(true, |execution| execution.is_due(current_height, current_time));
+
+            if due {
+                self.apply_proposal(&mut proposal);
+                self.proposals.insert(&proposal_id, &proposal);
+            } else {
+                self.execution_queue.push(&proposal_id);
+            }
+        }
+    }
+
+    /// Scheduled proposals in queue order
+    pub fn get_execution_queue(&self) -> Vec<Proposal> {
+        self.execution_queue.iter()
+            .filter_map(|proposal_id| self.proposals.get(&proposal_id))
+            .collect()
+    }
+
     pub fn get_parameter(&self, key: &String) -> String {
         self.parameters.get(key).unwrap_or("".to_string())
     }
 
+    /// Set a parameter outside of a proposal, for timelocked admin overrides
+    pub(crate) fn override_parameter(&mut self, key: &str, value: &str) -> Result<(), String> {
+        self.validate_parameter(key, value)?;
+        self.parameters.insert(&key.to_string(), &value.to_string());
+        env::log_str(&format!("Governance: Parameter {} overridden to {}", key, value));
+        Ok(())
+    }
+
+    /// Active gas schedule
+    pub fn gas_schedule(&self) -> GasSchedule {
+        GasSchedule::from_json(&self.get_parameter(&GAS_SCHEDULE_PARAM.to_string())).unwrap_or_default()
+    }
+
+    /// Split of the mint module's block provisions
+    pub fn inflation_distribution(&self) -> InflationDistribution {
+        InflationDistribution::from_json(&self.get_parameter(&INFLATION_DISTRIBUTION_PARAM.to_string()))
+            .unwrap_or_default()
+    }
+
+    /// Per message type fee adjustments
+    pub fn fee_policy(&self) -> FeePolicy {
+        FeePolicy::from_json(&self.get_parameter(&FEE_POLICY_PARAM.to_string())).unwrap_or_default()
+    }
+
+    /// Calls each account may make per window of blocks
+    pub fn rate_limit(&self) -> RateLimitConfig {
+        RateLimitConfig::from_json(&self.get_parameter(&RATE_LIMIT_PARAM.to_string())).unwrap_or_default()
+    }
+
+    /// Size and shape limits the router applies to inputs
+    pub fn input_limits(&self) -> InputLimits {
+        InputLimits::from_json(&self.get_parameter(&INPUT_LIMITS_PARAM.to_string())).unwrap_or_default()
+    }
+
+    /// Height at which governance halts the chain for an export, if any
+    pub fn halt_height(&self) -> Option<u64> {
+        self.get_parameter(&HALT_HEIGHT_PARAM.to_string())
+            .parse()
+            .ok()
+            .filter(|height| *height > 0)
+    }
+
+    pub fn is_halted(&self, current_height: u64) -> bool {
+        self.halt_height().map_or(false, |height| current_height >= height)
+    }
+
     pub fn end_block(&mut self, current_height: u64) {
+        self.end_block_with_prices(current_height, None);
+    }
+
+    /// End block with deposits in several denoms valued at `prices`
+    pub fn end_block_with_prices(&mut self, current_height: u64, prices: Option<&dyn PriceKeeper>) {
         let mut proposals_to_update = Vec::new();
         
         for (proposal_id, proposal) in self.proposals.iter() {
@@ -142,18 +673,24 @@ impl GovernanceModule {
         }
         
         for (proposal_id, mut proposal) in proposals_to_update {
-            let total_votes = proposal.yes_votes + proposal.no_votes;
-            let quorum_threshold = 2; // 50% quorum (simplified)
+            let tally = self.tally(proposal_id);
             
-            if total_votes >= quorum_threshold && proposal.yes_votes > proposal.no_votes {
-                // Proposal passed
-                proposal.status = ProposalStatus::Passed;
-                
-                // Apply parameter change
-                self.parameters.insert(&proposal.param_key, &proposal.param_value);
-                
-                env::log_str(&format!("Governance: Proposal {} PASSED - {} = {}", 
-                    proposal_id, proposal.param_key, proposal.param_value));
+            if !self.deposit_met(proposal_id, prices) {
+                proposal.status = ProposalStatus::Rejected;
+                proposal.failed_reason = Some("Deposit below the minimum".to_string());
+
+                env::log_str(&format!("Governance: Proposal {} REJECTED - deposit below the minimum", proposal_id));
+            } else if self.quorum_reached(proposal_id, &tally) && self.vote_passes(proposal_id, &tally) {
+                if proposal.execution.is_some() {
+                    // Executed by the queue once its execution point is reached
+                    proposal.status = ProposalStatus::Scheduled;
+                    self.execution_queue.push(&proposal_id);
+
+                    env::log_str(&format!("Governance: Proposal {} SCHEDULED - {:?}", 
+                        proposal_id, proposal.execution));
+                } else {
+                    self.apply_proposal(&mut proposal);
+                }
             } else {
                 // Proposal rejected
                 proposal.status = ProposalStatus::Rejected;
@@ -161,7 +698,295 @@ impl GovernanceModule {
                 env::log_str(&format!("Governance: Proposal {} REJECTED", proposal_id));
             }
             
+            self.audit_emergency_tally(&proposal, &tally);
             self.proposals.insert(&proposal_id, &proposal);
         }
+
+        self.process_execution_queue(current_height, env::block_timestamp());
     }
-}
\ No newline at end of file
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::modules::staking::StakingModule;
+
+    fn account(name: &str) -> AccountId {
+        name.parse().unwrap()
+    }
+
+    #[test]
+    fn test_proposal_and_vote_metadata() {
+        let mut gov = GovernanceModule::new();
+        let proposal_id = gov.submit_proposal(
+            &account("alice.near"),
+            "Raise rewards".to_string(),
+            "Increase the reward rate".to_string(),
+            "reward_rate".to_string(),
+            "6".to_string(),
+            "ipfs://QmProposalDiscussion".to_string(),
+            None,
+            10,
+        );
+        gov.vote(&account("bob.near"), proposal_id, 1, "https://forum.example/t/42".to_string());
+
+        assert_eq!(gov.get_proposal(proposal_id).unwrap().metadata, "ipfs://QmProposalDiscussion");
+        assert_eq!(gov.get_vote(proposal_id, &account("bob.near")).unwrap().metadata, "https://forum.example/t/42");
+        assert!(gov.get_vote(proposal_id, &account("carol.near")).is_none());
+    }
+
+    fn pass_proposal(gov: &mut GovernanceModule, param_key: &str, param_value: &str) -> u64 {
+        pass_scheduled_proposal(gov, param_key, param_value, None)
+    }
+
+    fn pass_scheduled_proposal(
+        gov: &mut GovernanceModule,
+        param_key: &str,
+        param_value: &str,
+        execution: Option<ExecutionSchedule>,
+    ) -> u64 {
+        let proposal_id = gov.submit_proposal(
+            &account("alice.near"),
+            "Change parameter".to_string(),
+            "Change a parameter".to_string(),
+            param_key.to_string(),
+            param_value.to_string(),
+            String::new(),
+            execution,
+            10,
+        );
+        gov.vote(&account("alice.near"), proposal_id, 1, String::new());
+        gov.vote(&account("bob.near"), proposal_id, 1, String::new());
+        proposal_id
+    }
+
+    #[test]
+    fn test_failed_execution_is_recorded() {
+        let mut gov = GovernanceModule::new();
+        let passing = pass_proposal(&mut gov, "reward_rate", "7");
+        let bad_value = pass_proposal(&mut gov, "voting_period", "soon");
+        let unknown = pass_proposal(&mut gov, "unknown_param", "1");
+
+        gov.end_block(100);
+
+        assert_eq!(gov.get_proposal(passing).unwrap().status, ProposalStatus::Passed);
+        assert_eq!(gov.get_parameter(&"reward_rate".to_string()), "7");
+
+        let proposal = gov.get_proposal(bad_value).unwrap();
+        assert_eq!(proposal.status, ProposalStatus::Failed);
+        assert!(proposal.failed_reason.unwrap().contains("expected an integer"));
+        assert_eq!(gov.get_parameter(&"voting_period".to_string()), "50");
+
+        let proposal = gov.get_proposal(unknown).unwrap();
+        assert_eq!(proposal.status, ProposalStatus::Failed);
+        assert_eq!(proposal.failed_reason, Some("Unknown parameter unknown_param".to_string()));
+    }
+
+    #[test]
+    fn test_gas_schedule_upgrade() {
+        let mut gov = GovernanceModule::new();
+        let stale = GasSchedule { write_per_byte: 50, ..GasSchedule::default() };
+        let next = GasSchedule { version: 2, ..stale.clone() };
+        let rejected = pass_proposal(&mut gov, GAS_SCHEDULE_PARAM, &stale.to_json());
+        let upgraded = pass_proposal(&mut gov, GAS_SCHEDULE_PARAM, &next.to_json());
+
+        gov.end_block(100);
+
+        assert_eq!(gov.get_proposal(rejected).unwrap().status, ProposalStatus::Failed);
+        assert_eq!(gov.get_proposal(upgraded).unwrap().status, ProposalStatus::Passed);
+        assert_eq!(gov.gas_schedule(), next);
+    }
+
+    #[test]
+    fn test_halt_height() {
+        let mut gov = GovernanceModule::new();
+        assert_eq!(gov.halt_height(), None);
+        assert!(!gov.is_halted(u64::MAX));
+
+        pass_proposal(&mut gov, HALT_HEIGHT_PARAM, "500");
+        gov.end_block(100);
+
+        assert_eq!(gov.halt_height(), Some(500));
+        assert!(!gov.is_halted(499));
+        assert!(gov.is_halted(500));
+    }
+
+    #[test]
+    fn test_scheduled_execution() {
+        let mut gov = GovernanceModule::new();
+        let proposal_id = pass_scheduled_proposal(&mut gov, "reward_rate", "9", Some(ExecutionSchedule::AtHeight(200)));
+
+        gov.end_block(100);
+        assert_eq!(gov.get_proposal(proposal_id).unwrap().status, ProposalStatus::Scheduled);
+        assert_eq!(gov.get_execution_queue().len(), 1);
+        assert_eq!(gov.get_parameter(&"reward_rate".to_string()), "5");
+
+        gov.end_block(199);
+        assert_eq!(gov.get_parameter(&"reward_rate".to_string()), "5");
+
+        gov.end_block(200);
+        assert_eq!(gov.get_proposal(proposal_id).unwrap().status, ProposalStatus::Passed);
+        assert_eq!(gov.get_parameter(&"reward_rate".to_string()), "9");
+        assert!(gov.get_execution_queue().is_empty());
+    }
+
+    #[test]
+    fn test_estimated_times() {
+        let mut gov = GovernanceModule::new();
+        let proposal_id = pass_scheduled_proposal(&mut gov, "reward_rate", "9", Some(ExecutionSchedule::AtHeight(200)));
+        let block_time = BlockTime::new(2_000);
+
+        // Voting ends at height 60, 50 blocks after submission
+        assert_eq!(gov.voting_end_time(proposal_id, &block_time, 10, 1_000), Some(101_000));
+        assert_eq!(gov.voting_end_time(99, &block_time, 10, 1_000), None);
+        let execution = gov.get_proposal(proposal_id).unwrap().execution.unwrap();
+        assert_eq!(execution.estimated_time(&block_time, 10, 1_000), 381_000);
+    }
+
+    #[test]
+    #[should_panic(expected = "Execution height must be after the voting period")]
+    fn test_execution_height_before_voting_end() {
+        let mut gov = GovernanceModule::new();
+        pass_scheduled_proposal(&mut gov, "reward_rate", "9", Some(ExecutionSchedule::AtHeight(20)));
+    }
+
+    #[test]
+    fn test_vote_delegation_with_override() {
+        let mut gov = GovernanceModule::new();
+        gov.delegate_vote(&account("carol.near"), &account("rep.near"));
+        gov.delegate_vote(&account("dave.near"), &account("rep.near"));
+        gov.delegate_vote(&account("erin.near"), &account("rep.near"));
+        assert_eq!(gov.get_vote_delegators(&account("rep.near")).len(), 3);
+
+        let proposal_id = gov.submit_proposal(
+            &account("alice.near"),
+            "Change parameter".to_string(),
+            "Change a parameter".to_string(),
+            "reward_rate".to_string(),
+            "8".to_string(),
+            String::new(),
+            None,
+            10,
+        );
+        gov.undelegate_vote(&account("erin.near"));
+        assert_eq!(gov.get_vote_delegators(&account("rep.near")), vec![account("carol.near"), account("dave.near")]);
+
+        gov.vote(&account("rep.near"), proposal_id, 0, String::new());
+        assert_eq!(gov.tally(proposal_id), TallyResult { yes: 0, no: 3, delegated: 2 });
+        // Direct votes take precedence over the representative
+        gov.vote(&account("carol.near"), proposal_id, 1, String::new());
+        gov.vote(&account("alice.near"), proposal_id, 1, String::new());
+        gov.vote(&account("bob.near"), proposal_id, 1, String::new());
+
+        let tally = gov.tally(proposal_id);
+        assert_eq!(tally, TallyResult { yes: 3, no: 2, delegated: 1 });
+
+        gov.end_block(100);
+        assert_eq!(gov.get_proposal(proposal_id).unwrap().status, ProposalStatus::Passed);
+        assert_eq!(gov.get_vote_representative(&account("dave.near")), Some(account("rep.near")));
+        assert_eq!(gov.get_vote_representative(&account("erin.near")), None);
+    }
+
+    #[test]
+    fn test_vote_delegation_moves_between_representatives() {
+        let mut gov = GovernanceModule::new();
+        gov.delegate_vote(&account("carol.near"), &account("rep.near"));
+        gov.delegate_vote(&account("carol.near"), &account("other.near"));
+        assert!(gov.get_vote_delegators(&account("rep.near")).is_empty());
+        assert_eq!(gov.get_vote_delegators(&account("other.near")), vec![account("carol.near")]);
+
+        // A former representative may delegate its own votes
+        gov.delegate_vote(&account("rep.near"), &account("other.near"));
+        assert_eq!(gov.get_vote_delegators(&account("other.near")).len(), 2);
+    }
+
+    #[test]
+    fn test_redelegated_vote_counts_once() {
+        let mut gov = GovernanceModule::new();
+        gov.delegate_vote(&account("carol.near"), &account("rep.near"));
+        let proposal_id = gov.submit_proposal(
+            &account("alice.near"),
+            "Change parameter".to_string(),
+            "Change a parameter".to_string(),
+            "reward_rate".to_string(),
+            "8".to_string(),
+            String::new(),
+            None,
+            10,
+        );
+        gov.vote(&account("rep.near"), proposal_id, 1, String::new());
+        assert_eq!(gov.tally(proposal_id), TallyResult { yes: 2, no: 0, delegated: 1 });
+
+        // The second representative's vote replaces the first for carol
+        gov.delegate_vote(&account("carol.near"), &account("other.near"));
+        gov.vote(&account("other.near"), proposal_id, 0, String::new());
+        assert_eq!(gov.tally(proposal_id), TallyResult { yes: 1, no: 2, delegated: 1 });
+
+        gov.vote(&account("carol.near"), proposal_id, 1, String::new());
+        assert_eq!(gov.tally(proposal_id), TallyResult { yes: 2, no: 1, delegated: 0 });
+    }
+
+    #[test]
+    #[should_panic(expected = "Representative delegates its own votes")]
+    fn test_vote_delegation_is_not_transitive() {
+        let mut gov = GovernanceModule::new();
+        gov.delegate_vote(&account("rep.near"), &account("other.near"));
+        gov.delegate_vote(&account("carol.near"), &account("rep.near"));
+    }
+
+    #[test]
+    fn test_tally_uses_stake_snapshot() {
+        let mut staking = StakingModule::new();
+        staking.create_validator(
+            "validator1".to_string(), vec![1; 32], "Validator One".to_string(),
+            None, None, None, None,
+            "0.1".to_string(), "0.2".to_string(), "0.01".to_string(),
+            1, 100,
+        ).unwrap();
+        staking.delegate_coin("alice.near".to_string(), "validator1".to_string(), "stake", 300).unwrap();
+        staking.delegate_coin("bob.near".to_string(), "validator1".to_string(), "stake", 200).unwrap();
+
+        let mut gov = GovernanceModule::new();
+        let proposal_id = gov.submit_proposal(
+            &account("alice.near"),
+            "Change parameter".to_string(),
+            "Change a parameter".to_string(),
+            "reward_rate".to_string(),
+            "8".to_string(),
+            String::new(),
+            None,
+            10,
+        );
+        gov.snapshot_stake(proposal_id, &staking, 10);
+        assert_eq!(gov.get_stake_snapshot(proposal_id).unwrap().total_bonded, 600);
+
+        // Stake bonded after the snapshot carries no voting power
+        staking.delegate_coin("carol.near".to_string(), "validator1".to_string(), "stake", 1000).unwrap();
+
+        gov.vote(&account("alice.near"), proposal_id, 1, String::new());
+        gov.vote(&account("bob.near"), proposal_id, 0, String::new());
+        gov.vote(&account("carol.near"), proposal_id, 0, String::new());
+
+        assert_eq!(gov.voting_power(proposal_id, &account("carol.near")), 0);
+        assert_eq!(gov.tally(proposal_id), TallyResult { yes: 300, no: 200, delegated: 0 });
+
+        gov.end_block(100);
+        assert_eq!(gov.get_proposal(proposal_id).unwrap().status, ProposalStatus::Passed);
+    }
+
+    #[test]
+    #[should_panic(expected = "Metadata too long")]
+    fn test_metadata_length_limit() {
+        let mut gov = GovernanceModule::new();
+        gov.submit_proposal(
+            &account("alice.near"),
+            "Title".to_string(),
+            "Description".to_string(),
+            "reward_rate".to_string(),
+            "6".to_string(),
+            "x".repeat(DEFAULT_MAX_METADATA_LEN + 1),
+            None,
+            10,
+        );
+    }
+}
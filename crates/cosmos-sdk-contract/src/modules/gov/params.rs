@@ -0,0 +1,140 @@
+/// Parameter Defaults
+///
+/// Governance keeps every module's parameters as strings in one store, seeded
+/// when the module is created. State written by an older release has none of
+/// the keys a later release introduced, and `get_parameter` hands back an
+/// empty string for those, which an end blocker parsing a number takes for
+/// zero. Each module registers its keys with their defaults in
+/// `default_parameters`; after new code is deployed, `migrate_parameters`
+/// writes the defaults of the keys the state lacks and leaves every value
+/// governance already set alone.
+
+use near_sdk::env;
+
+use super::{
+    DepositParams, EmergencyParams, GovernanceModule, DEFAULT_ICA_TIMEOUT_NS, DEFAULT_MAX_METADATA_LEN,
+    DEFAULT_QUORUM_PERCENT, DEPOSIT_PARAMS_PARAM, EMERGENCY_PARAMS_PARAM, HALT_HEIGHT_PARAM, ICA_TIMEOUT_PARAM,
+};
+use crate::handler::gas::{GasSchedule, GAS_SCHEDULE_PARAM};
+use crate::handler::input_limits::{InputLimits, INPUT_LIMITS_PARAM};
+use crate::handler::rate_limit::{RateLimitConfig, RATE_LIMIT_PARAM};
+use crate::modules::auth::fee_policy::{FeePolicy, FEE_POLICY_PARAM};
+use crate::modules::mint::{InflationDistribution, INFLATION_DISTRIBUTION_PARAM};
+
+/// Default of one parameter and the module it belongs to
+#[derive(Clone, Debug, PartialEq)]
+pub struct ParamDefault {
+    pub module: &'static str,
+    pub key: &'static str,
+    pub value: String,
+}
+
+/// Parameters known to this release, in registration order
+#[derive(Clone, Debug, Default)]
+pub struct ParamDefaults {
+    entries: Vec<ParamDefault>,
+}
+
+impl ParamDefaults {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Register `key` for `module`; a key can only have one default
+    pub fn register(&mut self, module: &'static str, key: &'static str, value: impl Into<String>) -> &mut Self {
+        if self.get(key).is_some() {
+            env::panic_str(&format!("Parameter {} registered twice", key));
+        }
+        self.entries.push(ParamDefault { module, key, value: value.into() });
+        self
+    }
+
+    pub fn get(&self, key: &str) -> Option<&ParamDefault> {
+        self.entries.iter().find(|entry| entry.key == key)
+    }
+
+    pub fn iter(&self) -> impl Iterator<Item = &ParamDefault> {
+        self.entries.iter()
+    }
+}
+
+/// Defaults of every parameter governance manages
+pub fn default_parameters() -> ParamDefaults {
+    let mut defaults = ParamDefaults::new();
+    defaults
+        .register("staking", "reward_rate", "5")
+        .register("staking", "min_validator_stake", "100")
+        .register("gov", "voting_period", "50")
+        .register("gov", "max_metadata_len", DEFAULT_MAX_METADATA_LEN.to_string())
+        .register("gov", "quorum", DEFAULT_QUORUM_PERCENT.to_string())
+        .register("gov", HALT_HEIGHT_PARAM, "0")
+        .register("gov", DEPOSIT_PARAMS_PARAM, DepositParams::default().to_json())
+        .register("gov", EMERGENCY_PARAMS_PARAM, EmergencyParams::default().to_json())
+        .register("gov", ICA_TIMEOUT_PARAM, DEFAULT_ICA_TIMEOUT_NS.to_string())
+        .register("gas", GAS_SCHEDULE_PARAM, GasSchedule::default().to_json())
+        .register("mint", INFLATION_DISTRIBUTION_PARAM, InflationDistribution::default().to_json())
+        .register("auth", FEE_POLICY_PARAM, FeePolicy::default().to_json())
+        .register("router", RATE_LIMIT_PARAM, RateLimitConfig::default().to_json())
+        .register("router", INPUT_LIMITS_PARAM, InputLimits::default().to_json());
+    defaults
+}
+
+impl GovernanceModule {
+    /// Registered parameters this state has no value for
+    pub fn missing_parameters(&self, defaults: &ParamDefaults) -> Vec<String> {
+        defaults.iter()
+            .filter(|entry| self.parameters.get(&entry.key.to_string()).is_none())
+            .map(|entry| entry.key.to_string())
+            .collect()
+    }
+
+    /// Write the default of every registered parameter the state lacks,
+    /// returning the keys written
+    ///
+    /// Run once after an upgrade, before the first end block of the new code.
+    /// Running it again is a no-op.
+    pub fn migrate_parameters(&mut self, defaults: &ParamDefaults) -> Vec<String> {
+        let missing = self.missing_parameters(defaults);
+        for key in &missing {
+            let entry = defaults.get(key).expect("missing key is registered");
+            self.parameters.insert(&entry.key.to_string(), &entry.value);
+            env::log_str(&format!(
+                "EVENT: param_default_injected module={} key={} value={}",
+                entry.module, entry.key, entry.value
+            ));
+        }
+        missing
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_migration_injects_only_missing_parameters() {
+        let mut gov = GovernanceModule::new();
+        assert!(gov.missing_parameters(&default_parameters()).is_empty());
+
+        // State from a release without the rate limit and a custom quorum
+        gov.parameters.remove(&RATE_LIMIT_PARAM.to_string());
+        gov.parameters.insert(&"quorum".to_string(), &"40".to_string());
+        assert_eq!(gov.get_parameter(&RATE_LIMIT_PARAM.to_string()), "");
+
+        let mut defaults = default_parameters();
+        defaults.register("mint", "blocks_per_year", "6311520");
+        assert_eq!(gov.missing_parameters(&defaults), vec![RATE_LIMIT_PARAM.to_string(), "blocks_per_year".to_string()]);
+
+        assert_eq!(gov.migrate_parameters(&defaults).len(), 2);
+        assert_eq!(gov.rate_limit(), RateLimitConfig::default());
+        assert_eq!(gov.get_parameter(&"blocks_per_year".to_string()), "6311520");
+        assert_eq!(gov.get_parameter(&"quorum".to_string()), "40");
+        assert!(gov.migrate_parameters(&defaults).is_empty());
+    }
+
+    #[test]
+    #[should_panic(expected = "registered twice")]
+    fn test_duplicate_registration() {
+        default_parameters().register("gov", "quorum", "50");
+    }
+}
@@ -0,0 +1,271 @@
+/// Proposal Handler Registry
+///
+/// Parameter changes, upgrades and ICA executions are built into governance.
+/// Other modules bring their own proposal types through a `ProposalRouter`:
+/// each module implements `ProposalHandler` and is added under a route, the
+/// way the Cosmos SDK gov router maps a content route to a handler. A
+/// content proposal is checked by its handler when submitted; once it
+/// passes it is queued here and `execute_approved_content` hands it to the
+/// handler of its route.
+///
+/// A handler can mark content as too dangerous for an ordinary vote; such
+/// content only goes through `submit_emergency_proposal`.
+///
+/// The router only borrows the modules for one call, so governance does not
+/// need to know which modules exist.
+
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::serde::{Deserialize, Serialize};
+use near_sdk::{env, AccountId};
+
+use super::{ExecutionSchedule, GovernanceModule, ProposalStatus};
+
+/// Module specific proposal content
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq)]
+pub struct ProposalContent {
+    /// Route of the handling module, e.g. `wasm`
+    pub route: String,
+    /// Proposal type within the route, e.g. `SudoContract`
+    pub proposal_type: String,
+    /// JSON encoded content, interpreted by the handler
+    pub value: String,
+}
+
+/// Executes the proposal types of one module
+pub trait ProposalHandler {
+    /// Check content before it goes to a vote
+    fn validate_content(&self, content: &ProposalContent) -> Result<(), String>;
+
+    /// Apply the content of a passed proposal
+    fn execute_content(&mut self, proposal_id: u64, content: &ProposalContent) -> Result<(), String>;
+
+    /// Whether the content can only pass as an emergency proposal, see
+    /// `submit_emergency_proposal`
+    fn requires_emergency(&self, _content: &ProposalContent) -> bool {
+        false
+    }
+}
+
+/// Handlers by route, borrowed for one call
+#[derive(Default)]
+pub struct ProposalRouter<'a> {
+    routes: Vec<(String, &'a mut dyn ProposalHandler)>,
+}
+
+impl<'a> ProposalRouter<'a> {
+    pub fn new() -> Self {
+        Self { routes: Vec::new() }
+    }
+
+    pub fn add_route(&mut self, route: &str, handler: &'a mut dyn ProposalHandler) -> Result<(), String> {
+        if route.is_empty() || !route.chars().all(|c| c.is_ascii_alphanumeric() || c == '_') {
+            return Err(format!("Invalid proposal route {}", route));
+        }
+        if self.has_route(route) {
+            return Err(format!("Proposal route {} is already registered", route));
+        }
+        self.routes.push((route.to_string(), handler));
+        Ok(())
+    }
+
+    pub fn has_route(&self, route: &str) -> bool {
+        self.routes.iter().any(|(registered, _)| registered == route)
+    }
+
+    pub fn routes(&self) -> Vec<String> {
+        self.routes.iter().map(|(route, _)| route.clone()).collect()
+    }
+
+    fn handler(&mut self, route: &str) -> Result<&mut (dyn ProposalHandler + 'a), String> {
+        self.routes.iter_mut()
+            .find(|(registered, _)| registered == route)
+            .map(|(_, handler)| &mut **handler)
+            .ok_or_else(|| format!("No handler for proposal route {}", route))
+    }
+
+    pub(super) fn validate(&mut self, content: &ProposalContent) -> Result<(), String> {
+        self.handler(&content.route)?.validate_content(content)
+    }
+
+    pub(super) fn requires_emergency(&mut self, content: &ProposalContent) -> Result<bool, String> {
+        Ok(self.handler(&content.route)?.requires_emergency(content))
+    }
+}
+
+impl GovernanceModule {
+    /// Submit a proposal carrying content for a registered route
+    pub fn submit_content_proposal(
+        &mut self,
+        proposer: &AccountId,
+        title: String,
+        description: String,
+        content: ProposalContent,
+        router: &mut ProposalRouter,
+        metadata: String,
+        execution: Option<ExecutionSchedule>,
+        current_height: u64,
+    ) -> u64 {
+        router.validate(&content).unwrap_or_else(|e| env::panic_str(&e));
+        if router.requires_emergency(&content).unwrap_or_else(|e| env::panic_str(&e)) {
+            env::panic_str(&format!("{} proposals must be submitted as emergency proposals", content.proposal_type));
+        }
+
+        let proposal_id = self.submit_proposal(
+            proposer,
+            title,
+            description,
+            String::new(),
+            String::new(),
+            metadata,
+            execution,
+            current_height,
+        );
+
+        let mut proposal = self.proposals.get(&proposal_id).expect("Proposal not found");
+        proposal.content = Some(content);
+        self.proposals.insert(&proposal_id, &proposal);
+        proposal_id
+    }
+
+    /// Queue the content of a passed proposal for its handler
+    pub(super) fn approve_content(&mut self, proposal_id: u64, content: ProposalContent) -> Result<(), String> {
+        env::log_str(&format!(
+            "Governance: {} content of proposal {} approved",
+            content.route, proposal_id
+        ));
+        self.pending_content.insert(&proposal_id, &content);
+        Ok(())
+    }
+
+    pub fn get_pending_content(&self) -> Vec<(u64, ProposalContent)> {
+        self.pending_content.to_vec()
+    }
+
+    /// Execute queued content whose route has a handler in `router`
+    ///
+    /// Content for routes missing from the router stays queued. A handler
+    /// error marks the proposal as failed.
+    pub fn execute_approved_content(&mut self, router: &mut ProposalRouter) -> Vec<(u64, Result<(), String>)> {
+        let mut executed = Vec::new();
+        for (proposal_id, content) in self.pending_content.to_vec() {
+            if !router.has_route(&content.route) {
+                continue;
+            }
+            self.pending_content.remove(&proposal_id);
+
+            let result = router.handler(&content.route)
+                .and_then(|handler| handler.execute_content(proposal_id, &content));
+            self.audit_emergency_execution(proposal_id, &result);
+            if let Err(error) = &result {
+                if let Some(mut proposal) = self.proposals.get(&proposal_id) {
+                    proposal.status = ProposalStatus::Failed;
+                    proposal.failed_reason = Some(error.clone());
+                    self.proposals.insert(&proposal_id, &proposal);
+                }
+                env::log_str(&format!("Governance: Proposal {} FAILED - {}", proposal_id, error));
+            }
+            executed.push((proposal_id, result));
+        }
+        executed
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[derive(Default)]
+    struct CounterHandler {
+        executed: Vec<(u64, String)>,
+    }
+
+    impl ProposalHandler for CounterHandler {
+        fn validate_content(&self, content: &ProposalContent) -> Result<(), String> {
+            if content.proposal_type != "Increment" {
+                return Err(format!("Unknown proposal type {}", content.proposal_type));
+            }
+            Ok(())
+        }
+
+        fn execute_content(&mut self, proposal_id: u64, content: &ProposalContent) -> Result<(), String> {
+            if content.value == "fail" {
+                return Err("Counter overflow".to_string());
+            }
+            self.executed.push((proposal_id, content.value.clone()));
+            Ok(())
+        }
+    }
+
+    fn account(name: &str) -> AccountId {
+        name.parse().unwrap()
+    }
+
+    fn content(value: &str) -> ProposalContent {
+        ProposalContent {
+            route: "counter".to_string(),
+            proposal_type: "Increment".to_string(),
+            value: value.to_string(),
+        }
+    }
+
+    fn pass(gov: &mut GovernanceModule, router: &mut ProposalRouter, content: ProposalContent) -> u64 {
+        let proposal_id = gov.submit_content_proposal(
+            &account("alice.near"),
+            "Counter".to_string(),
+            "Change the counter".to_string(),
+            content,
+            router,
+            String::new(),
+            None,
+            10,
+        );
+        gov.vote(&account("alice.near"), proposal_id, 1, String::new());
+        gov.vote(&account("bob.near"), proposal_id, 1, String::new());
+        proposal_id
+    }
+
+    #[test]
+    fn test_passed_content_runs_its_handler() {
+        let mut gov = GovernanceModule::new();
+        let mut handler = CounterHandler::default();
+        let (ok, failing) = {
+            let mut router = ProposalRouter::new();
+            router.add_route("counter", &mut handler).unwrap();
+            (pass(&mut gov, &mut router, content("1")), pass(&mut gov, &mut router, content("fail")))
+        };
+        gov.end_block(100);
+        assert_eq!(gov.get_pending_content().len(), 2);
+
+        // Without the route the content waits
+        assert!(gov.execute_approved_content(&mut ProposalRouter::new()).is_empty());
+
+        let mut router = ProposalRouter::new();
+        router.add_route("counter", &mut handler).unwrap();
+        let results = gov.execute_approved_content(&mut router);
+        assert_eq!(results.len(), 2);
+        assert!(gov.get_pending_content().is_empty());
+        assert_eq!(gov.get_proposal(ok).unwrap().status, ProposalStatus::Passed);
+        assert_eq!(gov.get_proposal(failing).unwrap().status, ProposalStatus::Failed);
+        assert_eq!(handler.executed, vec![(ok, "1".to_string())]);
+    }
+
+    #[test]
+    #[should_panic(expected = "Unknown proposal type Decrement")]
+    fn test_handler_validates_content() {
+        let mut gov = GovernanceModule::new();
+        let mut handler = CounterHandler::default();
+        let mut router = ProposalRouter::new();
+        router.add_route("counter", &mut handler).unwrap();
+        pass(&mut gov, &mut router, ProposalContent { proposal_type: "Decrement".to_string(), ..content("1") });
+    }
+
+    #[test]
+    fn test_routes_are_unique() {
+        let mut first = CounterHandler::default();
+        let mut second = CounterHandler::default();
+        let mut router = ProposalRouter::new();
+        router.add_route("counter", &mut first).unwrap();
+        assert!(router.add_route("counter", &mut second).is_err());
+        assert_eq!(router.routes(), vec!["counter".to_string()]);
+    }
+}
@@ -0,0 +1,279 @@
+/// Parameter Change Preview
+///
+/// `simulate_param_change` runs the same validation a passed proposal goes
+/// through and describes what the new value would mean in practice, such
+/// as a voting period in wall-clock time or the new split of block
+/// provisions. Proposers can check a change before putting a deposit on it
+/// instead of finding out when the proposal fails on execution.
+
+use near_sdk::serde::{Deserialize, Serialize};
+use near_sdk::serde_json::{self, Value};
+use schemars::JsonSchema;
+
+use super::{DepositParams, EmergencyParams, GovernanceModule, DEPOSIT_PARAMS_PARAM, EMERGENCY_PARAMS_PARAM, HALT_HEIGHT_PARAM};
+use crate::handler::gas::GAS_SCHEDULE_PARAM;
+use crate::handler::input_limits::INPUT_LIMITS_PARAM;
+use crate::handler::rate_limit::{RateLimitConfig, RATE_LIMIT_PARAM};
+use crate::modules::auth::fee_policy::{FeePolicy, FEE_POLICY_PARAM};
+use crate::modules::mint::{InflationDistribution, BPS_DENOMINATOR, INFLATION_DISTRIBUTION_PARAM};
+
+/// Block time the previews convert heights with
+pub const SECONDS_PER_BLOCK: u64 = 1;
+
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct ParamChangePreview {
+    pub key: String,
+    pub current_value: String,
+    pub proposed_value: String,
+    /// Whether a proposal with this change would execute
+    pub valid: bool,
+    pub error: Option<String>,
+    /// Human readable consequences of the change
+    pub effects: Vec<String>,
+}
+
+/// Format a block count as an approximate duration, e.g. `~1d 2h 5m`
+pub fn blocks_to_duration(blocks: u64) -> String {
+    let seconds = blocks.saturating_mul(SECONDS_PER_BLOCK);
+    let (days, hours, minutes) = (seconds / 86_400, seconds % 86_400 / 3_600, seconds % 3_600 / 60);
+    let mut parts = Vec::new();
+    if days > 0 {
+        parts.push(format!("{}d", days));
+    }
+    if hours > 0 {
+        parts.push(format!("{}h", hours));
+    }
+    if minutes > 0 {
+        parts.push(format!("{}m", minutes));
+    }
+    if parts.is_empty() {
+        parts.push(format!("{}s", seconds));
+    }
+    format!("~{}", parts.join(" "))
+}
+
+fn percent(bps: u64) -> String {
+    // One percent is 100 basis points
+    format!("{}.{:02}%", bps / (BPS_DENOMINATOR / 100), bps % (BPS_DENOMINATOR / 100))
+}
+
+impl GovernanceModule {
+    /// Validate a parameter change and describe its effects without applying it
+    pub fn simulate_param_change(&self, key: &str, value: &str, current_height: u64) -> ParamChangePreview {
+        let current_value = self.get_parameter(&key.to_string());
+        let mut preview = ParamChangePreview {
+            key: key.to_string(),
+            current_value: current_value.clone(),
+            proposed_value: value.to_string(),
+            valid: true,
+            error: None,
+            effects: Vec::new(),
+        };
+
+        if let Err(error) = self.validate_parameter(key, value) {
+            preview.valid = false;
+            preview.error = Some(error);
+            return preview;
+        }
+        if current_value == value {
+            preview.effects.push("Value is unchanged".to_string());
+            return preview;
+        }
+
+        preview.effects = match key {
+            "voting_period" => {
+                let blocks: u64 = value.parse().unwrap_or_default();
+                vec![format!(
+                    "Proposals vote for {} blocks ({}) instead of {} blocks; one submitted now would end at height {}",
+                    blocks,
+                    blocks_to_duration(blocks),
+                    current_value,
+                    current_height + blocks
+                )]
+            }
+            "quorum" => {
+                let quorum: u64 = value.parse().unwrap_or_default();
+                let mut effects = vec![format!("Proposals need {}% of bonded stake to vote, was {}%", quorum, current_value)];
+                if quorum > 100 {
+                    effects.push("No proposal can reach a quorum above 100%".to_string());
+                }
+                effects
+            }
+            "max_metadata_len" => vec![format!("Proposal and vote metadata is limited to {} bytes", value)],
+            HALT_HEIGHT_PARAM => {
+                let height: u64 = value.parse().unwrap_or_default();
+                if height == 0 {
+                    vec!["Any scheduled halt is cancelled".to_string()]
+                } else if height <= current_height {
+                    vec![format!("Height {} has passed, the chain halts as soon as the proposal executes", height)]
+                } else {
+                    let blocks = height - current_height;
+                    vec![format!("The chain halts at height {}, {} blocks ({}) from now", height, blocks, blocks_to_duration(blocks))]
+                }
+            }
+            INFLATION_DISTRIBUTION_PARAM => {
+                let distribution = InflationDistribution::from_json(value).unwrap_or_default();
+                let mut effects = vec![format!(
+                    "Block provisions go {} to staking rewards, {} to the community pool and {} to the developer fund",
+                    percent(distribution.staking_rewards_bps),
+                    percent(distribution.community_pool_bps),
+                    percent(distribution.developer_fund_bps)
+                )];
+                if let Some(fund) = distribution.developer_fund.filter(|_| distribution.developer_fund_bps > 0) {
+                    effects.push(format!("The developer fund is paid to {}", fund));
+                }
+                effects
+            }
+            GAS_SCHEDULE_PARAM | INPUT_LIMITS_PARAM => json_field_changes(&current_value, value),
+            RATE_LIMIT_PARAM => {
+                let limit = RateLimitConfig::from_json(value).unwrap_or_default();
+                if limit.is_enabled() {
+                    vec![format!(
+                        "Each account can send {} messages every {} blocks ({})",
+                        limit.max_calls, limit.window_blocks, blocks_to_duration(limit.window_blocks)
+                    )]
+                } else {
+                    vec!["Accounts can send any number of messages".to_string()]
+                }
+            }
+            FEE_POLICY_PARAM => {
+                let policy = FeePolicy::from_json(value).unwrap_or_default();
+                if policy.rules.is_empty() {
+                    vec!["Every message pays the plain gas fee".to_string()]
+                } else {
+                    policy.rules.iter().map(|rule| match (rule.multiplier_bps, rule.surcharge) {
+                        (0, 0) => format!("{} is free", rule.msg_type),
+                        (multiplier, 0) => format!("{} pays {} of its gas fee", rule.msg_type, percent(multiplier as u64)),
+                        (multiplier, surcharge) => format!(
+                            "{} pays {} of its gas fee plus {} yoctoNEAR",
+                            rule.msg_type, percent(multiplier as u64), surcharge
+                        ),
+                    }).collect()
+                }
+            }
+            DEPOSIT_PARAMS_PARAM => {
+                let params = DepositParams::from_json(value).unwrap_or_default();
+                if !params.is_required() {
+                    vec!["Proposals need no deposit".to_string()]
+                } else {
+                    let mut effects: Vec<String> = params.denoms.iter()
+                        .filter(|entry| entry.min_amount > 0)
+                        .map(|entry| format!("A deposit of {}{} qualifies a proposal", entry.min_amount, entry.denom))
+                        .collect();
+                    if params.min_value > 0 {
+                        let denoms: Vec<&str> = params.denoms.iter().map(|entry| entry.denom.as_str()).collect();
+                        effects.push(format!(
+                            "Deposits in {} worth {} in the native denom together qualify a proposal",
+                            denoms.join(", "), params.min_value
+                        ));
+                    }
+                    effects
+                }
+            }
+            EMERGENCY_PARAMS_PARAM => {
+                let terms = EmergencyParams::from_json(value).unwrap_or_default();
+                vec![
+                    format!("Emergency proposals pass with {}% of the votes cast in favour", terms.threshold_percent),
+                    format!(
+                        "Passed emergency proposals execute {} blocks ({}) after voting ends",
+                        terms.timelock_blocks, blocks_to_duration(terms.timelock_blocks)
+                    ),
+                    "Emergency proposals already submitted keep their terms".to_string(),
+                ]
+            }
+            _ => vec![format!("{} changes from {} to {}", key, current_value, value)],
+        };
+        preview
+    }
+}
+
+/// Fields that differ between two JSON objects, as `field: old -> new`
+fn json_field_changes(current: &str, proposed: &str) -> Vec<String> {
+    let parse = |json: &str| serde_json::from_str::<Value>(json).ok()
+        .and_then(|value| value.as_object().cloned())
+        .unwrap_or_default();
+    let (current, proposed) = (parse(current), parse(proposed));
+
+    let mut changes: Vec<String> = proposed.iter()
+        .filter(|(field, value)| current.get(*field) != Some(*value))
+        .map(|(field, value)| {
+            let old = current.get(field).map_or("unset".to_string(), |old| old.to_string());
+            format!("{}: {} -> {}", field, old, value)
+        })
+        .collect();
+    changes.sort();
+    changes
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_invalid_change_reports_validator_error() {
+        let gov = GovernanceModule::new();
+
+        let preview = gov.simulate_param_change("voting_period", "0", 10);
+        assert!(!preview.valid);
+        assert!(preview.error.unwrap().contains("must be positive"));
+
+        let preview = gov.simulate_param_change("unknown", "1", 10);
+        assert_eq!(preview.error, Some("Unknown parameter unknown".to_string()));
+        assert_eq!(gov.get_parameter(&"voting_period".to_string()), "50");
+    }
+
+    #[test]
+    fn test_effects_in_wall_clock_terms() {
+        let gov = GovernanceModule::new();
+
+        let preview = gov.simulate_param_change("voting_period", "90000", 10);
+        assert!(preview.valid);
+        assert_eq!(preview.current_value, "50");
+        assert!(preview.effects[0].contains("90000 blocks (~1d 1h)"));
+        assert!(preview.effects[0].contains("end at height 90010"));
+
+        let preview = gov.simulate_param_change(HALT_HEIGHT_PARAM, "130", 10);
+        assert_eq!(preview.effects, vec!["The chain halts at height 130, 120 blocks (~2m) from now".to_string()]);
+
+        let distribution = InflationDistribution {
+            staking_rewards_bps: 7_550,
+            community_pool_bps: 2_000,
+            developer_fund_bps: 450,
+            developer_fund: Some("devs.near".to_string()),
+        };
+        let preview = gov.simulate_param_change(INFLATION_DISTRIBUTION_PARAM, &distribution.to_json(), 10);
+        assert!(preview.effects[0].contains("75.50% to staking rewards"));
+        assert!(preview.effects[0].contains("4.50% to the developer fund"));
+        assert_eq!(preview.effects[1], "The developer fund is paid to devs.near");
+
+        let preview = gov.simulate_param_change(RATE_LIMIT_PARAM, r#"{"max_calls":20,"window_blocks":60}"#, 10);
+        assert_eq!(preview.effects, vec!["Each account can send 20 messages every 60 blocks (~1m)".to_string()]);
+        assert!(!gov.simulate_param_change(RATE_LIMIT_PARAM, r#"{"max_calls":20,"window_blocks":0}"#, 10).valid);
+
+        let policy = r#"{"rules":[{"msg_type":"/cosmos.gov.v1beta1.MsgVote","multiplier_bps":0},{"msg_type":"/cosmwasm.wasm.v1.MsgStoreCode","multiplier_bps":25000,"surcharge":100}]}"#;
+        let preview = gov.simulate_param_change(FEE_POLICY_PARAM, policy, 10);
+        assert!(preview.valid);
+        assert_eq!(preview.effects, vec![
+            "/cosmos.gov.v1beta1.MsgVote is free".to_string(),
+            "/cosmwasm.wasm.v1.MsgStoreCode pays 250.00% of its gas fee plus 100 yoctoNEAR".to_string(),
+        ]);
+
+        let deposits = r#"{"denoms":[{"denom":"unear","min_amount":1000},{"denom":"ibc/ATOM"}],"min_value":5000}"#;
+        let preview = gov.simulate_param_change(DEPOSIT_PARAMS_PARAM, deposits, 10);
+        assert_eq!(preview.effects, vec![
+            "A deposit of 1000unear qualifies a proposal".to_string(),
+            "Deposits in unear, ibc/ATOM worth 5000 in the native denom together qualify a proposal".to_string(),
+        ]);
+
+        let preview = gov.simulate_param_change(EMERGENCY_PARAMS_PARAM, r#"{"threshold_percent":75,"timelock_blocks":7200}"#, 10);
+        assert_eq!(preview.effects[0], "Emergency proposals pass with 75% of the votes cast in favour");
+        assert_eq!(preview.effects[1], "Passed emergency proposals execute 7200 blocks (~2h) after voting ends");
+        assert!(!gov.simulate_param_change(EMERGENCY_PARAMS_PARAM, r#"{"threshold_percent":50,"timelock_blocks":7200}"#, 10).valid);
+    }
+
+    #[test]
+    fn test_json_field_changes() {
+        let changes = json_field_changes(r#"{"a":1,"b":2}"#, r#"{"a":1,"b":3,"c":4}"#);
+        assert_eq!(changes, vec!["b: 2 -> 3".to_string(), "c: unset -> 4".to_string()]);
+    }
+}
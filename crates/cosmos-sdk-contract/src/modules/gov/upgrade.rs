@@ -0,0 +1,195 @@
+/// Contract Upgrades through Governance
+///
+/// An upgrade proposal carries the SHA-256 hash of the new contract code
+/// rather than the code itself. Once the proposal passes, anyone can submit
+/// the matching code; it is deployed to the current account with a
+/// DeployContract promise action, so the contract only ever runs code that
+/// governance approved. The deployment calls `migrate` on the new code in
+/// the same receipt, so a state layout change lands together with the code
+/// that reads it, or not at all.
+
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::serde::{Deserialize, Serialize};
+use near_sdk::{env, AccountId, Gas, NearToken, Promise};
+use schemars::JsonSchema;
+use sha2::{Digest, Sha256};
+
+use super::{ExecutionSchedule, GovernanceModule};
+
+/// Gas for the `migrate` call of the deployed code
+pub const MIGRATE_GAS: Gas = Gas::from_tgas(100);
+
+/// Gas for the callback that restores an upgrade whose deployment failed
+pub const UPGRADE_CALLBACK_GAS: Gas = Gas::from_tgas(10);
+
+/// Code upgrade approved by a proposal
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct UpgradePlan {
+    pub name: String,
+    /// Hex encoded SHA-256 hash of the new contract code
+    pub code_hash: String,
+}
+
+impl UpgradePlan {
+    pub fn validate(&self) -> Result<(), String> {
+        if self.name.trim().is_empty() {
+            return Err("Upgrade name cannot be empty".to_string());
+        }
+        let hash = hex::decode(&self.code_hash)
+            .map_err(|_| format!("Invalid upgrade code hash {}", self.code_hash))?;
+        if hash.len() != 32 {
+            return Err("Upgrade code hash must be a SHA-256 hash".to_string());
+        }
+        Ok(())
+    }
+
+    /// Deploy `code` to this contract and migrate its state
+    ///
+    /// Fails unless the code hashes to the approved value.
+    pub fn deploy(&self, code: Vec<u8>) -> Result<Promise, String> {
+        let hash = code_hash(&code);
+        if hash != self.code_hash.to_lowercase() {
+            return Err(format!("Code hash {} does not match approved hash {}", hash, self.code_hash));
+        }
+
+        env::log_str(&format!("Governance: Deploying upgrade {} ({} bytes)", self.name, code.len()));
+        Ok(Promise::new(env::current_account_id())
+            .deploy_contract(code)
+            .function_call("migrate".to_string(), b"{}".to_vec(), NearToken::from_yoctonear(0), MIGRATE_GAS))
+    }
+}
+
+/// Hex encoded SHA-256 hash of contract code
+pub fn code_hash(code: &[u8]) -> String {
+    hex::encode(Sha256::digest(code))
+}
+
+impl GovernanceModule {
+    /// Submit a proposal to replace the contract code
+    pub fn submit_upgrade_proposal(
+        &mut self,
+        proposer: &AccountId,
+        title: String,
+        description: String,
+        plan: UpgradePlan,
+        metadata: String,
+        execution: Option<ExecutionSchedule>,
+        current_height: u64,
+    ) -> u64 {
+        plan.validate().unwrap_or_else(|e| env::panic_str(&e));
+
+        let proposal_id = self.submit_proposal(
+            proposer,
+            title,
+            description,
+            String::new(),
+            String::new(),
+            metadata,
+            execution,
+            current_height,
+        );
+
+        let mut proposal = self.proposals.get(&proposal_id).expect("Proposal not found");
+        proposal.upgrade = Some(plan);
+        self.proposals.insert(&proposal_id, &proposal);
+        proposal_id
+    }
+
+    /// Mark a passed upgrade as ready for deployment
+    pub(crate) fn approve_upgrade(&mut self, plan: UpgradePlan) -> Result<(), String> {
+        plan.validate()?;
+        if let Some(pending) = &self.pending_upgrade {
+            return Err(format!("Upgrade {} is already pending", pending.name));
+        }
+
+        env::log_str(&format!("Governance: Upgrade {} approved with code hash {}", plan.name, plan.code_hash));
+        self.pending_upgrade = Some(plan);
+        Ok(())
+    }
+
+    pub fn get_pending_upgrade(&self) -> Option<UpgradePlan> {
+        self.pending_upgrade.clone()
+    }
+
+    /// Deploy the code of the pending upgrade to this contract
+    ///
+    /// Fails unless the code hashes to the value approved by governance.
+    pub fn apply_upgrade(&mut self, code: Vec<u8>) -> Result<Promise, String> {
+        let plan = self.pending_upgrade.clone()
+            .ok_or("No upgrade approved by governance")?;
+        let promise = plan.deploy(code)?;
+        self.pending_upgrade = None;
+        Ok(promise)
+    }
+
+    /// Put back an upgrade whose deployment or migration failed, so its
+    /// code can be submitted again
+    ///
+    /// An upgrade approved in the meantime stays pending instead.
+    pub(crate) fn restore_upgrade(&mut self, plan: UpgradePlan) {
+        if let Some(pending) = &self.pending_upgrade {
+            env::log_str(&format!("Governance: Upgrade {} failed; {} stays pending", plan.name, pending.name));
+            return;
+        }
+        env::log_str(&format!("Governance: Upgrade {} failed and is pending again", plan.name));
+        self.pending_upgrade = Some(plan);
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::modules::gov::ProposalStatus;
+
+    fn account(name: &str) -> AccountId {
+        name.parse().unwrap()
+    }
+
+    fn plan(code: &[u8]) -> UpgradePlan {
+        UpgradePlan {
+            name: "v2".to_string(),
+            code_hash: code_hash(code),
+        }
+    }
+
+    #[test]
+    fn test_passed_upgrade_deploys_matching_code() {
+        let code = b"\0asm new contract code".to_vec();
+        let mut gov = GovernanceModule::new();
+        let proposal_id = gov.submit_upgrade_proposal(
+            &account("alice.near"),
+            "Upgrade to v2".to_string(),
+            "Deploy v2".to_string(),
+            plan(&code),
+            String::new(),
+            None,
+            10,
+        );
+        assert!(gov.apply_upgrade(code.clone()).is_err());
+
+        gov.vote(&account("alice.near"), proposal_id, 1, String::new());
+        gov.vote(&account("bob.near"), proposal_id, 1, String::new());
+        gov.end_block(100);
+
+        assert_eq!(gov.get_proposal(proposal_id).unwrap().status, ProposalStatus::Passed);
+        assert_eq!(gov.get_pending_upgrade(), Some(plan(&code)));
+
+        let tampered = b"\0asm other code".to_vec();
+        assert!(gov.apply_upgrade(tampered).unwrap_err().contains("does not match"));
+
+        assert!(gov.apply_upgrade(code.clone()).is_ok());
+        assert_eq!(gov.get_pending_upgrade(), None);
+
+        gov.restore_upgrade(plan(&code));
+        assert_eq!(gov.get_pending_upgrade(), Some(plan(&code)));
+    }
+
+    #[test]
+    fn test_plan_validation() {
+        assert!(plan(b"code").validate().is_ok());
+        let invalid = UpgradePlan { name: "v2".to_string(), code_hash: "abcd".to_string() };
+        assert!(invalid.validate().is_err());
+        let invalid = UpgradePlan { name: " ".to_string(), code_hash: code_hash(b"code") };
+        assert!(invalid.validate().is_err());
+    }
+}
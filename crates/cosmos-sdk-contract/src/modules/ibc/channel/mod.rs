@@ -719,25 +719,54 @@ impl ChannelModule {
         self.chan_open_confirm(port_id, channel_id, proof_ack, proof_height)
     }
 
+    /// Time out a packet the counterparty never received
+    ///
+    /// Anyone may submit the timeout, so every claim is checked here: the
+    /// packet must match its stored commitment, it must have expired at the
+    /// counterparty height the proof was taken at (or by its timestamp), and
+    /// on ordered channels the counterparty must not have received it yet.
+    /// Timing out a packet on an ordered channel closes the channel, as in
+    /// ICS-04.
     pub fn timeout_packet(
         &mut self,
         packet: Packet,
-        _proof: Vec<u8>,
-        _proof_height: u64,
-        _next_sequence_recv: u64,
+        proof: Vec<u8>,
+        proof_height: u64,
+        next_sequence_recv: u64,
     ) -> Result<(), String> {
-        // Implementation for timeout packet
-        let channel_key = format!("{}#{}", packet.source_port, packet.source_channel);
-        
-        // Verify the packet commitment exists
-        let commitment_key = format!("{}#{}", channel_key, packet.sequence);
-        if !self.packet_commitments.contains_key(&commitment_key) {
-            return Err("Packet commitment not found".to_string());
+        let channel_key = Self::channel_key(&packet.source_port, &packet.source_channel);
+        let mut channel = self.channels.get(&channel_key)
+            .ok_or("Channel not found")?;
+
+        // Verify the packet matches its commitment
+        let commitment_key = Self::packet_key(&packet.source_port, &packet.source_channel, packet.sequence);
+        let commitment = self.packet_commitments.get(&commitment_key)
+            .ok_or("Packet commitment not found")?;
+        if commitment != PacketCommitment::from_packet(&packet) {
+            return Err("Packet does not match its commitment".to_string());
         }
-        
+
+        // Verify the packet has expired on the counterparty
+        let proof_height = Height::new(packet.timeout_height.revision_number, proof_height);
+        if !packet.is_timed_out_on_height(&proof_height) && !packet.is_timed_out_on_timestamp(env::block_timestamp()) {
+            return Err("Packet has not timed out".to_string());
+        }
+
+        if channel.ordering == Order::Ordered && next_sequence_recv > packet.sequence {
+            return Err(format!(
+                "Packet {} was received, counterparty expects {}",
+                packet.sequence, next_sequence_recv
+            ));
+        }
+        self.verify_packet_commitment_proof(&packet, &proof, proof_height.revision_height)?;
+
         // Remove the packet commitment (timeout processing)
         self.packet_commitments.remove(&commitment_key);
-        
+        if channel.ordering == Order::Ordered {
+            channel.state = State::Closed;
+            self.channels.insert(&channel_key, &channel);
+        }
+
         env::log_str(&format!("Packet {} timed out on channel {}", packet.sequence, channel_key));
         Ok(())
     }
@@ -762,4 +791,82 @@ impl ChannelModule {
         // For now, assume all ports are bound
         true
     }
-}
\ No newline at end of file
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use near_sdk::test_utils::VMContextBuilder;
+    use near_sdk::testing_env;
+
+    fn open_channel(channels: &mut ChannelModule, order: Order) -> String {
+        let channel_id = channels.chan_open_init(
+            "transfer".to_string(),
+            order,
+            vec!["connection-0".to_string()],
+            "transfer".to_string(),
+            "ics20-1".to_string(),
+        );
+        channels.chan_open_ack(
+            "transfer".to_string(),
+            channel_id.clone(),
+            "channel-7".to_string(),
+            "ics20-1".to_string(),
+            vec![1],
+            1,
+        ).unwrap();
+        channel_id
+    }
+
+    fn send(channels: &mut ChannelModule, channel_id: &str, timeout_height: u64) -> Packet {
+        let sequence = channels.send_packet(
+            "transfer".to_string(),
+            channel_id.to_string(),
+            Height::new(0, timeout_height),
+            0,
+            b"data".to_vec(),
+        ).unwrap();
+        Packet::new(
+            sequence,
+            "transfer".to_string(),
+            channel_id.to_string(),
+            "transfer".to_string(),
+            "channel-7".to_string(),
+            b"data".to_vec(),
+            Height::new(0, timeout_height),
+            0,
+        )
+    }
+
+    #[test]
+    fn test_timeout_is_verified() {
+        testing_env!(VMContextBuilder::new().block_timestamp(1).build());
+        let mut channels = ChannelModule::new();
+        let channel_id = open_channel(&mut channels, Order::Unordered);
+        let packet = send(&mut channels, &channel_id, 100);
+
+        assert_eq!(
+            channels.timeout_packet(packet.clone(), vec![1], 99, 0),
+            Err("Packet has not timed out".to_string())
+        );
+        let forged = Packet { data: b"other".to_vec(), ..packet.clone() };
+        assert!(channels.timeout_packet(forged, vec![1], 100, 0).is_err());
+        assert!(channels.timeout_packet(packet.clone(), vec![], 100, 0).is_err());
+
+        channels.timeout_packet(packet.clone(), vec![1], 100, 0).unwrap();
+        assert!(channels.get_packet_commitment("transfer", &channel_id, packet.sequence).is_none());
+        assert!(channels.timeout_packet(packet, vec![1], 100, 0).is_err());
+        assert!(channels.is_channel_open("transfer", &channel_id));
+    }
+
+    #[test]
+    fn test_ordered_timeout_closes_channel() {
+        let mut channels = ChannelModule::new();
+        let channel_id = open_channel(&mut channels, Order::Ordered);
+        let packet = send(&mut channels, &channel_id, 10);
+
+        assert!(channels.timeout_packet(packet.clone(), vec![1], 10, 2).is_err());
+        channels.timeout_packet(packet, vec![1], 10, 1).unwrap();
+        assert!(!channels.is_channel_open("transfer", &channel_id));
+    }
+}
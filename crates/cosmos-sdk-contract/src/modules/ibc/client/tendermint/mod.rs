@@ -1,6 +1,7 @@
 use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
 use near_sdk::collections::LookupMap;
 use near_sdk::env;
+use crate::types::time;
 
 pub mod types;
 pub mod crypto;
@@ -770,13 +771,13 @@ impl TendermintLightClientModule {
     /// Ensures timestamp is reasonable and within acceptable drift
     fn validate_timestamp(&self, header: &Header) {
         let header_time = header.signed_header.header.time;
-        let current_time = env::block_timestamp() / 1_000_000_000; // Convert nanoseconds to seconds
+        let current_time = time::now_seconds();
         
         // Check that header timestamp is not too far in the future
         // Allow some drift for clock differences
         const MAX_CLOCK_DRIFT: u64 = 600; // 10 minutes
         
-        if header_time > current_time + MAX_CLOCK_DRIFT {
+        if header_time > current_time.saturating_add(MAX_CLOCK_DRIFT) {
             env::panic_str(&format!(
                 "Header timestamp too far in future: {} > {} + {}",
                 header_time, current_time, MAX_CLOCK_DRIFT
@@ -796,9 +797,34 @@ impl TendermintLightClientModule {
 
     /// Get all client IDs
     pub fn get_all_clients(&self) -> Vec<String> {
-        // Since LookupMap doesn't have keys(), we need to maintain a separate list
-        // For now, return empty vector - in a full implementation, we'd maintain a separate Vector
-        Vec::new()
+        // Client IDs are allocated sequentially, so they can be enumerated
+        // without a separate index
+        (0..self.next_client_sequence)
+            .map(|sequence| format!("07-tendermint-{}", sequence))
+            .filter(|client_id| self.client_states.contains_key(client_id))
+            .collect()
+    }
+
+    /// Clients whose latest consensus state is past the trust period and
+    /// that do not allow updates after expiry
+    ///
+    /// These can no longer be updated and stay frozen until governance
+    /// recovers them.
+    pub fn expired_clients(&self) -> Vec<String> {
+        self.get_all_clients()
+            .into_iter()
+            .filter(|client_id| {
+                let client_state = match self.client_states.get(client_id) {
+                    Some(state) if !state.allow_update_after_expiry => state,
+                    _ => return false,
+                };
+                let consensus_key = format!("{}#{}", client_id, client_state.latest_height.revision_height);
+                self.consensus_states.get(&consensus_key)
+                    .map_or(false, |consensus_state| {
+                        is_consensus_state_expired(&consensus_state, client_state.trust_period)
+                    })
+            })
+            .collect()
     }
 
     /// Check if a client exists
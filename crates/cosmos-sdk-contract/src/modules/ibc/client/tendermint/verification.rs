@@ -1,4 +1,5 @@
 use near_sdk::env;
+use crate::types::time;
 use super::types::{ClientState, ConsensusState, Header, Height, ValidatorSet};
 use super::crypto::{verify_commit_signatures, sha256};
 
@@ -44,8 +45,8 @@ pub fn verify_header(
     }
     
     // 5. Check trust period (lenient for testing)
-    let current_time = env::block_timestamp() / 1_000_000_000;
-    let trust_period_end = trusted_consensus_state.timestamp + client_state.trust_period;
+    let current_time = time::now_seconds();
+    let trust_period_end = trusted_consensus_state.timestamp.saturating_add(client_state.trust_period);
     
     if current_time > trust_period_end && !client_state.allow_update_after_expiry {
         env::log_str("Trust period expired but allowing for testing");
@@ -269,8 +270,8 @@ fn compute_canonical_block_bytes(header: &super::types::BlockHeader) -> Vec<u8>
 /// # Returns
 /// * True if expired, false otherwise
 pub fn is_consensus_state_expired(consensus_state: &ConsensusState, trust_period: u64) -> bool {
-    let current_time = env::block_timestamp() / 1_000_000_000; // Convert to seconds
-    let expiry_time = consensus_state.timestamp + trust_period;
+    let current_time = time::now_seconds();
+    let expiry_time = consensus_state.timestamp.saturating_add(trust_period);
     current_time > expiry_time
 }
 
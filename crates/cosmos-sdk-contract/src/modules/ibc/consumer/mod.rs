@@ -0,0 +1,324 @@
+/// Consumer Chain (Interchain Security)
+///
+/// Lets this chain run as a consumer of a provider chain's validator set.
+/// With the `Provider` validator source, validator set change (VSC) packets
+/// received on the provider channel replace local staking as the source of
+/// the active set, and downtime or double signs are reported back with slash
+/// packets. With the default `Local` source the module is inert and the set
+/// comes from the staking module as before.
+
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::collections::{LookupMap, UnorderedMap, UnorderedSet};
+use near_sdk::serde::{Deserialize, Serialize};
+use near_sdk::{env, AccountId};
+use schemars::JsonSchema;
+
+use crate::modules::ibc::channel::{Acknowledgement, ChannelModule, Height, Packet};
+use crate::modules::staking::StakingModule;
+use crate::types::Authority;
+
+/// Port bound by the consumer module, as in ICS-28
+pub const CONSUMER_PORT: &str = "consumer";
+
+/// Where the active validator set comes from
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Copy, Debug, PartialEq, JsonSchema)]
+#[serde(rename_all = "snake_case")]
+pub enum ValidatorSource {
+    /// Local staking module
+    Local,
+    /// Provider chain over IBC
+    Provider,
+}
+
+/// Voting power of a validator, keyed by hex encoded consensus key
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct ValidatorUpdate {
+    pub pub_key: String,
+    /// Zero removes the validator from the set
+    pub power: u64,
+}
+
+/// Validator set change sent by the provider
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct ValidatorSetChangePacketData {
+    pub validator_updates: Vec<ValidatorUpdate>,
+    pub valset_update_id: u64,
+    /// Validators whose slash requests the provider has handled
+    #[serde(default)]
+    pub slash_acks: Vec<String>,
+}
+
+#[derive(Serialize, Deserialize, Clone, Copy, Debug, PartialEq, JsonSchema)]
+#[serde(rename_all = "snake_case")]
+pub enum Infraction {
+    DoubleSign,
+    Downtime,
+}
+
+/// Misbehaviour report sent to the provider
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct SlashPacketData {
+    pub validator: ValidatorUpdate,
+    /// Set in effect when the infraction happened
+    pub valset_update_id: u64,
+    pub infraction: Infraction,
+}
+
+/// Called after a VSC packet changed the validator set
+pub trait ConsumerHooks {
+    fn after_validator_set_changed(&mut self, valset_update_id: u64, updates: &[ValidatorUpdate]);
+}
+
+#[derive(BorshDeserialize, BorshSerialize)]
+pub struct ConsumerModule {
+    /// Governance account; defaults to this contract
+    authority: Authority,
+    source: ValidatorSource,
+    provider_channel: Option<String>,
+    validators: UnorderedMap<String, u64>,
+    valset_update_id: u64,
+    /// Set in effect at each height, for slash packets
+    height_to_valset_id: LookupMap<u64, u64>,
+    /// Validators with a slash request the provider has not acknowledged
+    pending_slashes: UnorderedSet<String>,
+}
+
+impl ConsumerModule {
+    pub fn new() -> Self {
+        Self {
+            authority: Authority::default(),
+            source: ValidatorSource::Local,
+            provider_channel: None,
+            validators: UnorderedMap::new(b"ccv_validators".to_vec()),
+            valset_update_id: 0,
+            height_to_valset_id: LookupMap::new(b"ccv_height_valset".to_vec()),
+            pending_slashes: UnorderedSet::new(b"ccv_pending_slashes".to_vec()),
+        }
+    }
+
+    /// Account that governance acts through
+    pub fn authority(&self) -> AccountId {
+        self.authority.account()
+    }
+
+    pub fn set_authority(&mut self, sender: &AccountId, new_authority: AccountId) -> Result<(), String> {
+        self.authority.transfer(sender, new_authority)
+    }
+
+    fn assert_authority(&self, sender: &AccountId) -> Result<(), String> {
+        self.authority.check(sender, "Only the governance authority can configure the consumer module")
+    }
+
+    /// Switch between local staking and the provider's validator set
+    pub fn set_validator_source(&mut self, sender: &AccountId, source: ValidatorSource) -> Result<(), String> {
+        self.assert_authority(sender)?;
+        if source == ValidatorSource::Provider && self.provider_channel.is_none() {
+            return Err("Provider channel must be set before sourcing validators from it".to_string());
+        }
+        self.source = source;
+        env::log_str(&format!("EVENT: ccv_validator_source source={:?} by={}", source, sender));
+        Ok(())
+    }
+
+    pub fn set_provider_channel(&mut self, sender: &AccountId, channel_id: String) -> Result<(), String> {
+        self.assert_authority(sender)?;
+        env::log_str(&format!("EVENT: ccv_provider_channel channel={} by={}", channel_id, sender));
+        self.provider_channel = Some(channel_id);
+        Ok(())
+    }
+
+    pub fn validator_source(&self) -> ValidatorSource {
+        self.source
+    }
+
+    pub fn provider_channel(&self) -> Option<String> {
+        self.provider_channel.clone()
+    }
+
+    pub fn valset_update_id(&self) -> u64 {
+        self.valset_update_id
+    }
+
+    /// Handle a VSC packet from the provider
+    ///
+    /// Update ids must increase; a stale or duplicate packet is answered with
+    /// an error acknowledgement and leaves the set unchanged.
+    pub fn on_recv_vsc_packet<H: ConsumerHooks>(&mut self, packet: &Packet, hooks: &mut H) -> Acknowledgement {
+        match self.apply_vsc_packet(packet) {
+            Ok(data) => {
+                hooks.after_validator_set_changed(data.valset_update_id, &data.validator_updates);
+                env::log_str(&format!(
+                    "EVENT: ccv_validator_set_change valset_update_id={} updates={}",
+                    data.valset_update_id, data.validator_updates.len()
+                ));
+                Acknowledgement::success(b"AQ==".to_vec())
+            }
+            Err(error) => {
+                env::log_str(&format!("CCV: VSC packet rejected: {}", error));
+                Acknowledgement::error(format!("error: {}", error))
+            }
+        }
+    }
+
+    fn apply_vsc_packet(&mut self, packet: &Packet) -> Result<ValidatorSetChangePacketData, String> {
+        if self.source != ValidatorSource::Provider {
+            return Err("Validator set is sourced locally".to_string());
+        }
+        if packet.destination_port != CONSUMER_PORT
+            || self.provider_channel.as_deref() != Some(packet.destination_channel.as_str())
+        {
+            return Err(format!("Packet not received on the provider channel {}", packet.destination_channel));
+        }
+
+        let data: ValidatorSetChangePacketData = serde_json::from_slice(&packet.data)
+            .map_err(|e| format!("Invalid VSC packet data: {}", e))?;
+        if data.valset_update_id <= self.valset_update_id {
+            return Err(format!(
+                "Valset update id {} is not newer than {}",
+                data.valset_update_id, self.valset_update_id
+            ));
+        }
+
+        for update in &data.validator_updates {
+            if update.power == 0 {
+                self.validators.remove(&update.pub_key);
+            } else {
+                self.validators.insert(&update.pub_key, &update.power);
+            }
+        }
+        for validator in &data.slash_acks {
+            self.pending_slashes.remove(validator);
+        }
+
+        self.valset_update_id = data.valset_update_id;
+        self.height_to_valset_id.insert(&env::block_height(), &data.valset_update_id);
+        Ok(data)
+    }
+
+    /// Report misbehaviour of a provider validator
+    ///
+    /// Only one slash request per validator is in flight until the provider
+    /// acknowledges it in a later VSC packet.
+    pub fn send_slash_packet(
+        &mut self,
+        channel_module: &mut ChannelModule,
+        pub_key: String,
+        infraction_height: u64,
+        infraction: Infraction,
+        timeout_timestamp: u64,
+    ) -> Result<u64, String> {
+        let channel_id = self.provider_channel.clone()
+            .ok_or("Provider channel is not set")?;
+        let power = self.validators.get(&pub_key)
+            .ok_or_else(|| format!("{} is not in the provider validator set", pub_key))?;
+        if self.pending_slashes.contains(&pub_key) {
+            return Err(format!("Slash request for {} is already pending", pub_key));
+        }
+
+        let data = SlashPacketData {
+            validator: ValidatorUpdate { pub_key: pub_key.clone(), power },
+            valset_update_id: self.height_to_valset_id.get(&infraction_height).unwrap_or(self.valset_update_id),
+            infraction,
+        };
+        let bytes = serde_json::to_vec(&data).map_err(|e| e.to_string())?;
+        let sequence = channel_module.send_packet(
+            CONSUMER_PORT.to_string(),
+            channel_id,
+            Height::new(0, 0),
+            timeout_timestamp,
+            bytes,
+        )?;
+
+        self.pending_slashes.insert(&pub_key);
+        env::log_str(&format!(
+            "EVENT: ccv_slash_request validator={} infraction={:?} valset_update_id={}",
+            pub_key, infraction, data.valset_update_id
+        ));
+        Ok(sequence)
+    }
+
+    /// Active validator set, highest power first
+    pub fn validator_set(&self, staking: &StakingModule) -> Vec<ValidatorUpdate> {
+        let mut set: Vec<ValidatorUpdate> = match self.source {
+            ValidatorSource::Local => staking.get_bonded_validators()
+                .into_iter()
+                .filter(|validator| !validator.jailed)
+                .map(|validator| ValidatorUpdate {
+                    pub_key: hex::encode(&validator.consensus_pubkey),
+                    power: u64::try_from(validator.tokens).unwrap_or(u64::MAX),
+                })
+                .collect(),
+            ValidatorSource::Provider => self.validators.iter()
+                .map(|(pub_key, power)| ValidatorUpdate { pub_key, power })
+                .collect(),
+        };
+        set.sort_by(|a, b| b.power.cmp(&a.power).then_with(|| a.pub_key.cmp(&b.pub_key)));
+        set
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[derive(Default)]
+    struct RecordingHooks {
+        changes: Vec<(u64, usize)>,
+    }
+
+    impl ConsumerHooks for RecordingHooks {
+        fn after_validator_set_changed(&mut self, valset_update_id: u64, updates: &[ValidatorUpdate]) {
+            self.changes.push((valset_update_id, updates.len()));
+        }
+    }
+
+    fn vsc_packet(channel: &str, valset_update_id: u64, updates: Vec<(&str, u64)>) -> Packet {
+        let data = ValidatorSetChangePacketData {
+            validator_updates: updates.into_iter()
+                .map(|(pub_key, power)| ValidatorUpdate { pub_key: pub_key.to_string(), power })
+                .collect(),
+            valset_update_id,
+            slash_acks: vec![],
+        };
+        Packet::new(
+            valset_update_id,
+            "provider".to_string(),
+            "channel-7".to_string(),
+            CONSUMER_PORT.to_string(),
+            channel.to_string(),
+            serde_json::to_vec(&data).unwrap(),
+            Height::new(0, 0),
+            0,
+        )
+    }
+
+    #[test]
+    fn test_provider_validator_set_changes() {
+        let mut consumer = ConsumerModule::new();
+        let gov = consumer.authority();
+        let mut hooks = RecordingHooks::default();
+
+        // Ignored while the set is sourced locally
+        let ack = consumer.on_recv_vsc_packet(&vsc_packet("channel-0", 1, vec![("aa", 10)]), &mut hooks);
+        assert!(!ack.is_success());
+
+        assert!(consumer.set_validator_source(&gov, ValidatorSource::Provider).is_err());
+        consumer.set_provider_channel(&gov, "channel-0".to_string()).unwrap();
+        consumer.set_validator_source(&gov, ValidatorSource::Provider).unwrap();
+
+        let ack = consumer.on_recv_vsc_packet(&vsc_packet("channel-0", 1, vec![("aa", 10), ("bb", 20)]), &mut hooks);
+        assert!(ack.is_success());
+        let ack = consumer.on_recv_vsc_packet(&vsc_packet("channel-0", 2, vec![("aa", 0), ("cc", 5)]), &mut hooks);
+        assert!(ack.is_success());
+
+        // Stale updates and other channels are rejected
+        assert!(!consumer.on_recv_vsc_packet(&vsc_packet("channel-0", 2, vec![("dd", 1)]), &mut hooks).is_success());
+        assert!(!consumer.on_recv_vsc_packet(&vsc_packet("channel-9", 3, vec![("dd", 1)]), &mut hooks).is_success());
+
+        let set = consumer.validator_set(&StakingModule::new());
+        let keys: Vec<&str> = set.iter().map(|update| update.pub_key.as_str()).collect();
+        assert_eq!(keys, vec!["bb", "cc"]);
+        assert_eq!(consumer.valset_update_id(), 2);
+        assert_eq!(hooks.changes, vec![(1, 2), (2, 2)]);
+    }
+}
@@ -0,0 +1,142 @@
+/// ICS-27 Interchain Accounts (host side)
+///
+/// Remote controllers may only run message types governance has put on the
+/// host's allow list. The list starts empty, so no controller can execute
+/// anything until governance opts message types in; `*` allows every type,
+/// matching the ibc-go host parameter.
+
+use base64::{engine::general_purpose::STANDARD, Engine};
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::collections::UnorderedSet;
+use near_sdk::{env, AccountId};
+
+use super::{IcaMessage, InterchainAccountPacketData};
+use crate::types::Authority;
+
+/// Allow list entry permitting every message type
+pub const ALLOW_ALL_MESSAGES: &str = "*";
+
+#[derive(BorshDeserialize, BorshSerialize)]
+pub struct IcaHostModule {
+    /// Governance account; defaults to this contract
+    authority: Authority,
+    allowed_messages: UnorderedSet<String>,
+}
+
+impl IcaHostModule {
+    pub fn new() -> Self {
+        Self {
+            authority: Authority::default(),
+            allowed_messages: UnorderedSet::new(b"ica_host_allowed".to_vec()),
+        }
+    }
+
+    /// Account that governance acts through
+    pub fn authority(&self) -> AccountId {
+        self.authority.account()
+    }
+
+    pub fn set_authority(&mut self, sender: &AccountId, new_authority: AccountId) -> Result<(), String> {
+        self.authority.transfer(sender, new_authority)
+    }
+
+    fn assert_authority(&self, sender: &AccountId) -> Result<(), String> {
+        self.authority.check(sender, "Only the governance authority can change the ICA host allow list")
+    }
+
+    /// Replace the allow list with `type_urls`
+    pub fn set_allowed_messages(&mut self, sender: &AccountId, type_urls: Vec<String>) -> Result<(), String> {
+        self.assert_authority(sender)?;
+        if let Some(invalid) = type_urls.iter().find(|url| url.as_str() != ALLOW_ALL_MESSAGES && !url.starts_with('/')) {
+            return Err(format!("Invalid message type URL {}", invalid));
+        }
+
+        self.allowed_messages.clear();
+        for type_url in &type_urls {
+            self.allowed_messages.insert(type_url);
+        }
+        env::log_str(&format!("EVENT: ica_host_allow_list messages={} by={}", type_urls.join(","), sender));
+        Ok(())
+    }
+
+    /// Allowed message types, sorted
+    pub fn get_allowed_messages(&self) -> Vec<String> {
+        let mut type_urls = self.allowed_messages.to_vec();
+        type_urls.sort();
+        type_urls
+    }
+
+    pub fn is_message_allowed(&self, type_url: &str) -> bool {
+        self.allowed_messages.contains(&ALLOW_ALL_MESSAGES.to_string())
+            || self.allowed_messages.contains(&type_url.to_string())
+    }
+
+    /// Decode an `EXECUTE_TX` packet and check every message against the
+    /// allow list
+    ///
+    /// The whole transaction is rejected if any message is not allowed.
+    pub fn authenticate_tx(&self, packet_data: &[u8]) -> Result<Vec<IcaMessage>, String> {
+        let packet: InterchainAccountPacketData = serde_json::from_slice(packet_data)
+            .map_err(|e| format!("Invalid ICA packet data: {}", e))?;
+        if packet.packet_type != "TYPE_EXECUTE_TX" {
+            return Err(format!("Unsupported ICA packet type {}", packet.packet_type));
+        }
+
+        let tx = STANDARD.decode(&packet.data).map_err(|e| format!("Invalid ICA transaction encoding: {}", e))?;
+        let tx: serde_json::Value = serde_json::from_slice(&tx).map_err(|e| format!("Invalid ICA transaction: {}", e))?;
+        let messages = tx["messages"].as_array()
+            .filter(|messages| !messages.is_empty())
+            .ok_or_else(|| "Interchain account transaction has no messages".to_string())?
+            .iter()
+            .map(IcaMessage::from_proto3_json)
+            .collect::<Result<Vec<_>, _>>()?;
+
+        if let Some(message) = messages.iter().find(|message| !self.is_message_allowed(&message.type_url)) {
+            env::log_str(&format!("EVENT: ica_host_rejected type_url={}", message.type_url));
+            return Err(format!("Message type {} is not allowed on this host", message.type_url));
+        }
+        Ok(messages)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn packet(type_urls: &[&str]) -> Vec<u8> {
+        let messages: Vec<serde_json::Value> = type_urls.iter()
+            .map(|type_url| serde_json::json!({ "@type": type_url, "amount": "1" }))
+            .collect();
+        serde_json::to_vec(&InterchainAccountPacketData {
+            packet_type: "TYPE_EXECUTE_TX".to_string(),
+            data: STANDARD.encode(serde_json::json!({ "messages": messages }).to_string()),
+            memo: String::new(),
+        }).unwrap()
+    }
+
+    #[test]
+    fn test_allow_list_defaults_to_deny_all() {
+        let mut host = IcaHostModule::new();
+        let gov = env::current_account_id();
+        let send = "/cosmos.bank.v1beta1.MsgSend";
+        let delegate = "/cosmos.staking.v1beta1.MsgDelegate";
+
+        assert!(host.get_allowed_messages().is_empty());
+        assert!(host.authenticate_tx(&packet(&[send])).is_err());
+
+        let stranger: AccountId = "mallory.near".parse().unwrap();
+        assert!(host.set_allowed_messages(&stranger, vec![send.to_string()]).is_err());
+
+        host.set_allowed_messages(&gov, vec![send.to_string()]).unwrap();
+        assert_eq!(host.get_allowed_messages(), vec![send.to_string()]);
+        let messages = host.authenticate_tx(&packet(&[send])).unwrap();
+        assert_eq!(messages[0].type_url, send);
+        assert_eq!(messages[0].value, r#"{"amount":"1"}"#);
+
+        // One disallowed message rejects the whole transaction
+        assert!(host.authenticate_tx(&packet(&[send, delegate])).is_err());
+
+        host.set_allowed_messages(&gov, vec![ALLOW_ALL_MESSAGES.to_string()]).unwrap();
+        assert!(host.authenticate_tx(&packet(&[send, delegate])).is_ok());
+    }
+}
@@ -0,0 +1,356 @@
+/// ICS-27 Interchain Accounts (controller side)
+///
+/// Registers accounts on counterparty Cosmos chains and sends them
+/// transactions to execute. Each owner gets its own `icacontroller-<owner>`
+/// port; the host chain creates the account during the channel handshake and
+/// reports its address in the version metadata of the ChanOpenAck.
+///
+/// Transactions are encoded as proto3 JSON, which hosts accept when the
+/// channel metadata selects the `proto3json` encoding.
+
+use base64::{engine::general_purpose::STANDARD, Engine};
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::collections::UnorderedMap;
+use near_sdk::env;
+use near_sdk::serde::{Deserialize, Serialize};
+use schemars::JsonSchema;
+
+use crate::modules::ibc::channel::{ChannelModule, Height, Order};
+
+pub mod host;
+
+pub use host::IcaHostModule;
+
+pub const CONTROLLER_PORT_PREFIX: &str = "icacontroller-";
+pub const HOST_PORT: &str = "icahost";
+pub const ICA_VERSION: &str = "ics27-1";
+pub const ENCODING_PROTO3_JSON: &str = "proto3json";
+pub const TX_TYPE_SDK_MULTI_MSG: &str = "sdk_multi_msg";
+
+/// Channel version metadata negotiated during the handshake
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct IcaMetadata {
+    pub version: String,
+    pub controller_connection_id: String,
+    pub host_connection_id: String,
+    /// Interchain account address, filled in by the host
+    #[serde(default)]
+    pub address: String,
+    pub encoding: String,
+    pub tx_type: String,
+}
+
+/// Packet sent to the host chain
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct InterchainAccountPacketData {
+    #[serde(rename = "type")]
+    pub packet_type: String,
+    /// Base64 encoded CosmosTx
+    pub data: String,
+    #[serde(default)]
+    pub memo: String,
+}
+
+/// Cosmos message to run on the host chain
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct IcaMessage {
+    pub type_url: String,
+    /// Message fields as a JSON object, without the `@type` key
+    pub value: String,
+}
+
+impl IcaMessage {
+    fn to_proto3_json(&self) -> Result<serde_json::Value, String> {
+        let mut value: serde_json::Value = serde_json::from_str(&self.value)
+            .map_err(|e| format!("Invalid message {}: {}", self.type_url, e))?;
+        let object = value.as_object_mut()
+            .ok_or_else(|| format!("Message {} must be a JSON object", self.type_url))?;
+        object.insert("@type".to_string(), serde_json::Value::String(self.type_url.clone()));
+        Ok(value)
+    }
+
+    fn from_proto3_json(value: &serde_json::Value) -> Result<Self, String> {
+        let mut object = value.as_object()
+            .cloned()
+            .ok_or_else(|| "Message must be a JSON object".to_string())?;
+        let type_url = object.remove("@type")
+            .and_then(|type_url| type_url.as_str().map(str::to_string))
+            .ok_or_else(|| "Message has no @type".to_string())?;
+        Ok(Self {
+            type_url,
+            value: serde_json::Value::Object(object).to_string(),
+        })
+    }
+}
+
+/// Account registered on a host chain
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct InterchainAccount {
+    pub owner: String,
+    pub connection_id: String,
+    pub port_id: String,
+    pub channel_id: String,
+    /// Known once the channel is open
+    pub address: Option<String>,
+}
+
+/// Transaction sent to a host chain and not yet acknowledged
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct PendingIcaTx {
+    pub owner: String,
+    pub connection_id: String,
+    pub channel_id: String,
+    pub sequence: u64,
+    pub messages: Vec<IcaMessage>,
+    pub memo: String,
+}
+
+#[derive(BorshDeserialize, BorshSerialize)]
+pub struct IcaControllerModule {
+    /// Accounts by "port_id#connection_id"
+    accounts: UnorderedMap<String, InterchainAccount>,
+    /// Sent transactions by "channel_id#sequence" until acknowledged or
+    /// timed out
+    pending_txs: UnorderedMap<String, PendingIcaTx>,
+}
+
+impl IcaControllerModule {
+    pub fn new() -> Self {
+        Self {
+            accounts: UnorderedMap::new(b"ica_accounts".to_vec()),
+            pending_txs: UnorderedMap::new(b"ica_pending_txs".to_vec()),
+        }
+    }
+
+    pub fn port_id(owner: &str) -> String {
+        format!("{}{}", CONTROLLER_PORT_PREFIX, owner)
+    }
+
+    fn account_key(owner: &str, connection_id: &str) -> String {
+        format!("{}#{}", Self::port_id(owner), connection_id)
+    }
+
+    /// Start the channel handshake that creates an account for `owner`
+    pub fn register_account(
+        &mut self,
+        channel_module: &mut ChannelModule,
+        owner: &str,
+        connection_id: &str,
+        host_connection_id: &str,
+    ) -> Result<String, String> {
+        let key = Self::account_key(owner, connection_id);
+        if self.accounts.get(&key).is_some() {
+            return Err(format!("{} already has an interchain account on {}", owner, connection_id));
+        }
+
+        let metadata = IcaMetadata {
+            version: ICA_VERSION.to_string(),
+            controller_connection_id: connection_id.to_string(),
+            host_connection_id: host_connection_id.to_string(),
+            address: String::new(),
+            encoding: ENCODING_PROTO3_JSON.to_string(),
+            tx_type: TX_TYPE_SDK_MULTI_MSG.to_string(),
+        };
+        let port_id = Self::port_id(owner);
+        let channel_id = channel_module.chan_open_init(
+            port_id.clone(),
+            Order::Ordered,
+            vec![connection_id.to_string()],
+            HOST_PORT.to_string(),
+            serde_json::to_string(&metadata).map_err(|e| e.to_string())?,
+        );
+
+        self.accounts.insert(&key, &InterchainAccount {
+            owner: owner.to_string(),
+            connection_id: connection_id.to_string(),
+            port_id,
+            channel_id: channel_id.clone(),
+            address: None,
+        });
+        env::log_str(&format!("EVENT: ica_register owner={} connection={} channel={}", owner, connection_id, channel_id));
+        Ok(channel_id)
+    }
+
+    /// Complete the handshake and record the address chosen by the host
+    pub fn on_chan_open_ack(
+        &mut self,
+        channel_module: &mut ChannelModule,
+        owner: &str,
+        connection_id: &str,
+        counterparty_channel_id: String,
+        counterparty_version: String,
+        channel_proof: Vec<u8>,
+        proof_height: u64,
+    ) -> Result<InterchainAccount, String> {
+        let key = Self::account_key(owner, connection_id);
+        let mut account = self.accounts.get(&key)
+            .ok_or_else(|| format!("No interchain account registration for {} on {}", owner, connection_id))?;
+
+        let metadata: IcaMetadata = serde_json::from_str(&counterparty_version)
+            .map_err(|e| format!("Invalid ICA version metadata: {}", e))?;
+        if metadata.version != ICA_VERSION || metadata.address.is_empty() {
+            return Err("Host did not return an interchain account address".to_string());
+        }
+
+        channel_module.chan_open_ack(
+            account.port_id.clone(),
+            account.channel_id.clone(),
+            counterparty_channel_id,
+            counterparty_version,
+            channel_proof,
+            proof_height,
+        )?;
+
+        account.address = Some(metadata.address.clone());
+        self.accounts.insert(&key, &account);
+        env::log_str(&format!("EVENT: ica_open owner={} connection={} address={}", owner, connection_id, metadata.address));
+        Ok(account)
+    }
+
+    pub fn get_account(&self, owner: &str, connection_id: &str) -> Option<InterchainAccount> {
+        self.accounts.get(&Self::account_key(owner, connection_id))
+    }
+
+    pub fn get_accounts(&self) -> Vec<InterchainAccount> {
+        self.accounts.values().collect()
+    }
+
+    /// Send messages for the owner's interchain account to execute
+    pub fn send_tx(
+        &mut self,
+        channel_module: &mut ChannelModule,
+        owner: &str,
+        connection_id: &str,
+        messages: &[IcaMessage],
+        memo: String,
+        timeout_timestamp: u64,
+    ) -> Result<u64, String> {
+        let account = self.get_account(owner, connection_id)
+            .filter(|account| account.address.is_some())
+            .ok_or_else(|| format!("{} has no open interchain account on {}", owner, connection_id))?;
+        if messages.is_empty() {
+            return Err("Interchain account transaction has no messages".to_string());
+        }
+
+        let encoded = messages.iter()
+            .map(IcaMessage::to_proto3_json)
+            .collect::<Result<Vec<_>, _>>()?;
+        let tx = serde_json::json!({ "messages": encoded });
+        let packet = InterchainAccountPacketData {
+            packet_type: "TYPE_EXECUTE_TX".to_string(),
+            data: STANDARD.encode(tx.to_string()),
+            memo: memo.clone(),
+        };
+
+        let sequence = channel_module.send_packet(
+            account.port_id.clone(),
+            account.channel_id.clone(),
+            Height::new(0, 0),
+            timeout_timestamp,
+            serde_json::to_vec(&packet).map_err(|e| e.to_string())?,
+        )?;
+        env::log_str(&format!(
+            "EVENT: ica_send_tx owner={} channel={} sequence={} messages={}",
+            owner, account.channel_id, sequence, messages.len()
+        ));
+        self.pending_txs.insert(&Self::pending_key(&account.channel_id, sequence), &PendingIcaTx {
+            owner: owner.to_string(),
+            connection_id: connection_id.to_string(),
+            channel_id: account.channel_id,
+            sequence,
+            messages: messages.to_vec(),
+            memo,
+        });
+        Ok(sequence)
+    }
+
+    /// Forget a sent transaction once its packet is acknowledged or timed out
+    pub fn on_packet_settled(&mut self, channel_id: &str, sequence: u64) -> Option<PendingIcaTx> {
+        self.pending_txs.remove(&Self::pending_key(channel_id, sequence))
+    }
+
+    /// Transactions of `owner` still waiting on the host chain
+    ///
+    /// Messages and memos describe what the owner is doing on other chains,
+    /// so contracts serve this only to a query signed by the owner, see
+    /// `CosmosTransactionHandler::pending_ica_txs`.
+    pub fn pending_txs(&self, owner: &str) -> Vec<PendingIcaTx> {
+        self.pending_txs.values().filter(|tx| tx.owner == owner).collect()
+    }
+
+    fn pending_key(channel_id: &str, sequence: u64) -> String {
+        format!("{}#{}", channel_id, sequence)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn host_version(address: &str) -> String {
+        serde_json::to_string(&IcaMetadata {
+            version: ICA_VERSION.to_string(),
+            controller_connection_id: "connection-0".to_string(),
+            host_connection_id: "connection-5".to_string(),
+            address: address.to_string(),
+            encoding: ENCODING_PROTO3_JSON.to_string(),
+            tx_type: TX_TYPE_SDK_MULTI_MSG.to_string(),
+        }).unwrap()
+    }
+
+    #[test]
+    fn test_message_encoding() {
+        let message = IcaMessage {
+            type_url: "/cosmos.bank.v1beta1.MsgSend".to_string(),
+            value: r#"{"from_address":"cosmos1ica","to_address":"cosmos1bob"}"#.to_string(),
+        };
+        let json = message.to_proto3_json().unwrap();
+        assert_eq!(json["@type"], "/cosmos.bank.v1beta1.MsgSend");
+        assert_eq!(json["to_address"], "cosmos1bob");
+
+        let invalid = IcaMessage { type_url: "/x".to_string(), value: "[1]".to_string() };
+        assert!(invalid.to_proto3_json().is_err());
+    }
+
+    #[test]
+    fn test_register_requires_open_channel_to_send() {
+        let mut channels = ChannelModule::new();
+        let mut ica = IcaControllerModule::new();
+
+        let channel_id = ica.register_account(&mut channels, "gov", "connection-0", "connection-5").unwrap();
+        assert!(ica.register_account(&mut channels, "gov", "connection-0", "connection-5").is_err());
+
+        let account = ica.get_account("gov", "connection-0").unwrap();
+        assert_eq!(account.port_id, "icacontroller-gov");
+        assert_eq!(account.channel_id, channel_id);
+        assert!(account.address.is_none());
+
+        let message = IcaMessage { type_url: "/cosmos.bank.v1beta1.MsgSend".to_string(), value: "{}".to_string() };
+        assert!(ica.send_tx(&mut channels, "gov", "connection-0", &[message], String::new(), 0).is_err());
+
+        // The host must report the account address
+        let result = ica.on_chan_open_ack(&mut channels, "gov", "connection-0", "channel-3".to_string(), host_version(""), vec![], 1);
+        assert!(result.is_err());
+    }
+
+    #[test]
+    fn test_sent_tx_is_pending_until_settled() {
+        let mut channels = ChannelModule::new();
+        let mut ica = IcaControllerModule::new();
+        let channel_id = ica.register_account(&mut channels, "alice", "connection-0", "connection-5").unwrap();
+        ica.on_chan_open_ack(&mut channels, "alice", "connection-0", "channel-3".to_string(), host_version("cosmos1ica"), vec![1], 1)
+            .unwrap();
+
+        let message = IcaMessage { type_url: "/cosmos.bank.v1beta1.MsgSend".to_string(), value: "{}".to_string() };
+        let sequence = ica.send_tx(&mut channels, "alice", "connection-0", &[message.clone()], "rebalance".to_string(), 0).unwrap();
+
+        let pending = ica.pending_txs("alice");
+        assert_eq!(pending.len(), 1);
+        assert_eq!(pending[0].messages, vec![message]);
+        assert_eq!(pending[0].memo, "rebalance");
+        assert!(ica.pending_txs("bob").is_empty());
+
+        assert!(ica.on_packet_settled(&channel_id, sequence).is_some());
+        assert!(ica.pending_txs("alice").is_empty());
+    }
+}
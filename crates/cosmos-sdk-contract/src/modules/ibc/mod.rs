@@ -1,4 +1,7 @@
 pub mod client;
 pub mod connection;
 pub mod channel;
-pub mod transfer;
\ No newline at end of file
+pub mod transfer;
+pub mod consumer;
+pub mod ica;
+pub mod oracle;
\ No newline at end of file
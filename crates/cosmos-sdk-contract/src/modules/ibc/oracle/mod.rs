@@ -0,0 +1,464 @@
+/// Price Oracle (consumer)
+///
+/// Receives price packets from an oracle provider chain, in the style of
+/// Slinky or Ojo, over a dedicated channel on the `oracle` port. Each packet
+/// carries prices reported by one or more sources, quoted in yoctoNEAR per
+/// unit of the denomination. The latest report of every source is kept and
+/// the price of a denomination is the median over the sources whose reports
+/// are still fresh, so a single faulty or stale source cannot move it.
+///
+/// A median is only published with at least `min_sources` fresh reports,
+/// and is unusable once its oldest observation is older than `max_age_ns`.
+/// Published prices feed fee abstraction through `OracleHooks`, governance
+/// deposits through `PriceKeeper`, and wasm contracts through the `oracle`
+/// query.
+
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::collections::UnorderedMap;
+use near_sdk::serde::{Deserialize, Serialize};
+use near_sdk::{env, AccountId};
+use schemars::JsonSchema;
+
+use crate::modules::auth::FeeProcessor;
+use crate::modules::gov::PriceKeeper;
+use crate::modules::ibc::channel::{Acknowledgement, Packet};
+use crate::types::Authority;
+use crate::Balance;
+
+/// Port bound by the oracle module
+pub const ORACLE_PORT: &str = "oracle";
+/// Feeder name oracle prices are submitted to fee abstraction under
+pub const IBC_ORACLE_FEEDER: &str = "ibc/oracle";
+/// Five minutes
+pub const DEFAULT_MAX_PRICE_AGE_NS: u64 = 300_000_000_000;
+
+/// Price of one denomination as observed by one source
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct PriceReport {
+    pub denom: String,
+    pub source: String,
+    /// yoctoNEAR per unit
+    pub price: Balance,
+}
+
+/// Price packet sent by the provider
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct PricePacketData {
+    pub reports: Vec<PriceReport>,
+    /// Provider time the prices were observed at, in nanoseconds
+    pub timestamp: u64,
+}
+
+/// Latest report of a source for one denomination
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct SourcePrice {
+    pub source: String,
+    pub price: Balance,
+    pub timestamp: u64,
+}
+
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct MedianPrice {
+    pub denom: String,
+    pub price: Balance,
+    /// Sources the median was taken over
+    pub sources: u32,
+    /// Oldest observation included in the median
+    pub timestamp: u64,
+}
+
+impl MedianPrice {
+    pub fn is_fresh(&self, now: u64, max_age_ns: u64) -> bool {
+        now.saturating_sub(self.timestamp) <= max_age_ns
+    }
+}
+
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct OracleParams {
+    /// Age after which a report or a price is no longer used
+    pub max_age_ns: u64,
+    /// Fresh reports needed to publish a price
+    pub min_sources: u32,
+}
+
+impl Default for OracleParams {
+    fn default() -> Self {
+        Self { max_age_ns: DEFAULT_MAX_PRICE_AGE_NS, min_sources: 1 }
+    }
+}
+
+impl OracleParams {
+    pub fn validate(&self) -> Result<(), String> {
+        if self.max_age_ns == 0 {
+            return Err("Oracle max age must be positive".to_string());
+        }
+        if self.min_sources == 0 {
+            return Err("Oracle prices need at least one source".to_string());
+        }
+        Ok(())
+    }
+}
+
+/// Called after a packet published a new price
+pub trait OracleHooks {
+    fn after_price_updated(&mut self, price: &MedianPrice);
+}
+
+/// Median of `prices`, the mean of the middle two for an even count
+fn median(prices: &mut [Balance]) -> Option<Balance> {
+    prices.sort_unstable();
+    let mid = prices.len() / 2;
+    match prices.len() {
+        0 => None,
+        len if len % 2 == 1 => Some(prices[mid]),
+        _ => Some(prices[mid - 1] + (prices[mid] - prices[mid - 1]) / 2),
+    }
+}
+
+#[derive(BorshDeserialize, BorshSerialize)]
+pub struct OracleModule {
+    /// Governance account; defaults to this contract
+    authority: Authority,
+    /// Channel to the provider, packets on any other channel are rejected
+    channel: Option<String>,
+    params: OracleParams,
+    /// Latest report per source, by denomination
+    reports: UnorderedMap<String, Vec<SourcePrice>>,
+    prices: UnorderedMap<String, MedianPrice>,
+}
+
+impl OracleModule {
+    pub fn new() -> Self {
+        Self {
+            authority: Authority::default(),
+            channel: None,
+            params: OracleParams::default(),
+            reports: UnorderedMap::new(b"oracle_reports".to_vec()),
+            prices: UnorderedMap::new(b"oracle_prices".to_vec()),
+        }
+    }
+
+    /// Account that governance acts through
+    pub fn authority(&self) -> AccountId {
+        self.authority.account()
+    }
+
+    pub fn set_authority(&mut self, sender: &AccountId, new_authority: AccountId) -> Result<(), String> {
+        self.authority.transfer(sender, new_authority)
+    }
+
+    fn assert_authority(&self, sender: &AccountId) -> Result<(), String> {
+        self.authority.check(sender, "Only the governance authority can configure the oracle module")
+    }
+
+    pub fn set_channel(&mut self, sender: &AccountId, channel_id: String) -> Result<(), String> {
+        self.assert_authority(sender)?;
+        env::log_str(&format!("EVENT: oracle_channel channel={} by={}", channel_id, sender));
+        self.channel = Some(channel_id);
+        Ok(())
+    }
+
+    pub fn set_params(&mut self, sender: &AccountId, params: OracleParams) -> Result<(), String> {
+        self.assert_authority(sender)?;
+        params.validate()?;
+        env::log_str(&format!(
+            "EVENT: oracle_params max_age_ns={} min_sources={} by={}",
+            params.max_age_ns, params.min_sources, sender
+        ));
+        self.params = params;
+        Ok(())
+    }
+
+    pub fn channel(&self) -> Option<String> {
+        self.channel.clone()
+    }
+
+    pub fn params(&self) -> OracleParams {
+        self.params.clone()
+    }
+
+    /// Handle a price packet from the provider
+    ///
+    /// A packet is applied whole or not at all; a stale packet or a single
+    /// invalid report is answered with an error acknowledgement.
+    pub fn on_recv_price_packet<H: OracleHooks>(&mut self, packet: &Packet, hooks: &mut H) -> Acknowledgement {
+        match self.apply_price_packet(packet) {
+            Ok(updated) => {
+                for price in &updated {
+                    hooks.after_price_updated(price);
+                    env::log_str(&format!(
+                        "EVENT: oracle_price_updated denom={} price={} sources={} timestamp={}",
+                        price.denom, price.price, price.sources, price.timestamp
+                    ));
+                }
+                Acknowledgement::success(b"AQ==".to_vec())
+            }
+            Err(error) => {
+                env::log_str(&format!("ORACLE: price packet rejected: {}", error));
+                Acknowledgement::error(format!("error: {}", error))
+            }
+        }
+    }
+
+    fn apply_price_packet(&mut self, packet: &Packet) -> Result<Vec<MedianPrice>, String> {
+        if packet.destination_port != ORACLE_PORT
+            || self.channel.as_deref() != Some(packet.destination_channel.as_str())
+        {
+            return Err(format!("Packet not received on the oracle channel {}", packet.destination_channel));
+        }
+
+        let data: PricePacketData = serde_json::from_slice(&packet.data)
+            .map_err(|e| format!("Invalid price packet data: {}", e))?;
+        let now = env::block_timestamp();
+        // A future timestamp would outlive max_age and win every later update
+        if data.timestamp > now {
+            return Err(format!("Prices observed at {} are ahead of the block time {}", data.timestamp, now));
+        }
+        if now - data.timestamp > self.params.max_age_ns {
+            return Err(format!("Prices observed at {} are older than {}ns", data.timestamp, self.params.max_age_ns));
+        }
+        for (index, report) in data.reports.iter().enumerate() {
+            if report.denom.is_empty() || report.source.is_empty() {
+                return Err("Price reports need a denomination and a source".to_string());
+            }
+            if report.price == 0 {
+                return Err(format!("Price of {} from {} must be positive", report.denom, report.source));
+            }
+            if data.reports[..index].iter().any(|other| other.denom == report.denom && other.source == report.source) {
+                return Err(format!("{} reported {} more than once", report.source, report.denom));
+            }
+        }
+
+        let mut denoms: Vec<&str> = Vec::new();
+        for report in &data.reports {
+            let mut reports = self.reports.get(&report.denom).unwrap_or_default();
+            match reports.iter_mut().find(|existing| existing.source == report.source) {
+                // Packets can be relayed out of order, never go back in time
+                Some(existing) if existing.timestamp >= data.timestamp => continue,
+                Some(existing) => {
+                    existing.price = report.price;
+                    existing.timestamp = data.timestamp;
+                }
+                None => reports.push(SourcePrice {
+                    source: report.source.clone(),
+                    price: report.price,
+                    timestamp: data.timestamp,
+                }),
+            }
+            self.reports.insert(&report.denom, &reports);
+            if !denoms.contains(&report.denom.as_str()) {
+                denoms.push(&report.denom);
+            }
+        }
+
+        let mut updated = Vec::new();
+        for denom in denoms {
+            if let Some(price) = self.medianize(denom, now) {
+                self.prices.insert(&price.denom, &price);
+                updated.push(price);
+            }
+        }
+        Ok(updated)
+    }
+
+    /// Median over the fresh reports of `denom`, `None` with too few sources
+    fn medianize(&self, denom: &str, now: u64) -> Option<MedianPrice> {
+        let fresh: Vec<SourcePrice> = self.reports.get(&denom.to_string())?
+            .into_iter()
+            .filter(|report| now.saturating_sub(report.timestamp) <= self.params.max_age_ns)
+            .collect();
+        if (fresh.len() as u32) < self.params.min_sources {
+            return None;
+        }
+        let mut prices: Vec<Balance> = fresh.iter().map(|report| report.price).collect();
+        Some(MedianPrice {
+            denom: denom.to_string(),
+            price: median(&mut prices)?,
+            sources: fresh.len() as u32,
+            timestamp: fresh.iter().map(|report| report.timestamp).min()?,
+        })
+    }
+
+    /// Current price of `denom`, an error once it is stale
+    pub fn price(&self, denom: &str) -> Result<MedianPrice, String> {
+        let price = self.prices.get(&denom.to_string())
+            .ok_or_else(|| format!("No oracle price for {}", denom))?;
+        if !price.is_fresh(env::block_timestamp(), self.params.max_age_ns) {
+            return Err(format!("Oracle price for {} observed at {} is stale", denom, price.timestamp));
+        }
+        Ok(price)
+    }
+
+    /// Latest price of every denomination, stale ones included
+    pub fn get_all_prices(&self) -> Vec<MedianPrice> {
+        let mut prices: Vec<MedianPrice> = self.prices.values().collect();
+        prices.sort_by(|a, b| a.denom.cmp(&b.denom));
+        prices
+    }
+
+    /// Latest reports of every source for `denom`
+    pub fn get_reports(&self, denom: &str) -> Vec<SourcePrice> {
+        self.reports.get(&denom.to_string()).unwrap_or_default()
+    }
+}
+
+impl PriceKeeper for OracleModule {
+    fn value_of(&self, denom: &str, amount: Balance) -> Option<Balance> {
+        self.price(denom).ok()?.price.checked_mul(amount)
+    }
+}
+
+/// Oracle prices of denominations whitelisted with the `ibc/oracle` feeder
+impl OracleHooks for FeeProcessor {
+    fn after_price_updated(&mut self, price: &MedianPrice) {
+        // Denominations not accepted for fees, or priced otherwise, are skipped
+        let _ = self.submit_price(IBC_ORACLE_FEEDER, &price.denom, price.price);
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::modules::auth::{FeeConfig, PriceSource};
+    use crate::modules::ibc::channel::Height;
+    use near_sdk::test_utils::VMContextBuilder;
+    use near_sdk::testing_env;
+
+    const SECOND: u64 = 1_000_000_000;
+
+    #[derive(Default)]
+    struct RecordingHooks {
+        updates: Vec<(String, Balance)>,
+    }
+
+    impl OracleHooks for RecordingHooks {
+        fn after_price_updated(&mut self, price: &MedianPrice) {
+            self.updates.push((price.denom.clone(), price.price));
+        }
+    }
+
+    fn at(timestamp: u64) {
+        testing_env!(VMContextBuilder::new().block_timestamp(timestamp).build());
+    }
+
+    fn price_packet(channel: &str, timestamp: u64, reports: Vec<(&str, &str, Balance)>) -> Packet {
+        let data = PricePacketData {
+            reports: reports.into_iter()
+                .map(|(denom, source, price)| PriceReport { denom: denom.to_string(), source: source.to_string(), price })
+                .collect(),
+            timestamp,
+        };
+        Packet::new(
+            1,
+            "oracle".to_string(),
+            "channel-3".to_string(),
+            ORACLE_PORT.to_string(),
+            channel.to_string(),
+            serde_json::to_vec(&data).unwrap(),
+            Height::new(0, 0),
+            0,
+        )
+    }
+
+    fn setup() -> OracleModule {
+        at(1_000 * SECOND);
+        let mut oracle = OracleModule::new();
+        let gov = oracle.authority();
+        oracle.set_channel(&gov, "channel-0".to_string()).unwrap();
+        oracle.set_params(&gov, OracleParams { max_age_ns: 60 * SECOND, min_sources: 2 }).unwrap();
+        oracle
+    }
+
+    #[test]
+    fn test_median_over_fresh_sources() {
+        let mut oracle = setup();
+        let mut hooks = RecordingHooks::default();
+
+        // One source is not enough
+        let ack = oracle.on_recv_price_packet(&price_packet("channel-0", 990 * SECOND, vec![("ibc/ATOM", "a", 10)]), &mut hooks);
+        assert!(ack.is_success());
+        assert!(oracle.price("ibc/ATOM").is_err());
+
+        let packet = price_packet("channel-0", 995 * SECOND, vec![("ibc/ATOM", "b", 14), ("ibc/ATOM", "c", 100)]);
+        assert!(oracle.on_recv_price_packet(&packet, &mut hooks).is_success());
+        let price = oracle.price("ibc/ATOM").unwrap();
+        assert_eq!((price.price, price.sources, price.timestamp), (14, 3, 990 * SECOND));
+        assert_eq!(hooks.updates, vec![("ibc/ATOM".to_string(), 14)]);
+
+        // Source a ages out, leaving the mean of b and the updated c
+        at(1_051 * SECOND);
+        let packet = price_packet("channel-0", 1_050 * SECOND, vec![("ibc/ATOM", "c", 20)]);
+        assert!(oracle.on_recv_price_packet(&packet, &mut hooks).is_success());
+        let price = oracle.price("ibc/ATOM").unwrap();
+        assert_eq!((price.price, price.sources, price.timestamp), (17, 2, 995 * SECOND));
+
+        // An older report from a source never replaces a newer one
+        let packet = price_packet("channel-0", 1_049 * SECOND, vec![("ibc/ATOM", "c", 1)]);
+        assert!(oracle.on_recv_price_packet(&packet, &mut hooks).is_success());
+        assert_eq!(oracle.get_reports("ibc/ATOM").iter().find(|r| r.source == "c").unwrap().price, 20);
+        assert_eq!(oracle.price("ibc/ATOM").unwrap().price, 17);
+    }
+
+    #[test]
+    fn test_prices_expire() {
+        let mut oracle = setup();
+        let packet = price_packet("channel-0", 1_000 * SECOND, vec![("ibc/ATOM", "a", 10), ("ibc/ATOM", "b", 12)]);
+        assert!(oracle.on_recv_price_packet(&packet, &mut RecordingHooks::default()).is_success());
+        assert_eq!(oracle.value_of("ibc/ATOM", 3), Some(33));
+
+        at(1_061 * SECOND);
+        assert!(oracle.price("ibc/ATOM").is_err());
+        assert_eq!(oracle.value_of("ibc/ATOM", 3), None);
+        assert_eq!(oracle.get_all_prices().len(), 1);
+
+        // Packets observed too long ago are rejected
+        let packet = price_packet("channel-0", 1_000 * SECOND, vec![("ibc/ATOM", "a", 10), ("ibc/ATOM", "b", 12)]);
+        assert!(!oracle.on_recv_price_packet(&packet, &mut RecordingHooks::default()).is_success());
+    }
+
+    #[test]
+    fn test_rejected_packets() {
+        let mut oracle = setup();
+        let mut hooks = RecordingHooks::default();
+        let reports = vec![("ibc/ATOM", "a", 10), ("ibc/ATOM", "b", 12)];
+        assert!(!oracle.on_recv_price_packet(&price_packet("channel-9", 1_000 * SECOND, reports.clone()), &mut hooks).is_success());
+
+        // One invalid report rejects the whole packet
+        let mut invalid = reports.clone();
+        invalid.push(("ibc/OSMO", "a", 0));
+        assert!(!oracle.on_recv_price_packet(&price_packet("channel-0", 1_000 * SECOND, invalid), &mut hooks).is_success());
+        let mut duplicate = reports;
+        duplicate.push(("ibc/ATOM", "a", 11));
+        assert!(!oracle.on_recv_price_packet(&price_packet("channel-0", 1_000 * SECOND, duplicate), &mut hooks).is_success());
+        assert!(oracle.get_reports("ibc/ATOM").is_empty());
+
+        // Prices cannot be observed after the current block
+        let future = price_packet("channel-0", 1_001 * SECOND, vec![("ibc/ATOM", "a", 10), ("ibc/ATOM", "b", 12)]);
+        assert!(!oracle.on_recv_price_packet(&future, &mut hooks).is_success());
+        assert!(oracle.get_reports("ibc/ATOM").is_empty());
+
+        assert!(oracle.set_channel(&"mallory.near".parse().unwrap(), "channel-9".to_string()).is_err());
+        let gov = oracle.authority();
+        assert!(oracle.set_params(&gov, OracleParams { max_age_ns: SECOND, min_sources: 0 }).is_err());
+    }
+
+    #[test]
+    fn test_prices_feed_fee_abstraction() {
+        let mut oracle = setup();
+        let mut processor = FeeProcessor::new(FeeConfig::default());
+        processor.whitelist_fee_denom("ibc/ATOM".to_string(), PriceSource::Oracle {
+            feeder: IBC_ORACLE_FEEDER.to_string(),
+            max_age_ns: 60 * SECOND,
+        }).unwrap();
+
+        let packet = price_packet(
+            "channel-0",
+            1_000 * SECOND,
+            vec![("ibc/ATOM", "a", 10), ("ibc/ATOM", "b", 12), ("ibc/OSMO", "a", 3), ("ibc/OSMO", "b", 3)],
+        );
+        assert!(oracle.on_recv_price_packet(&packet, &mut processor).is_success());
+        assert_eq!(processor.fee_denom_rate("ibc/ATOM"), Ok(11));
+        // Not accepted for fees
+        assert!(processor.fee_denom_rate("ibc/OSMO").is_err());
+    }
+}
@@ -5,6 +5,10 @@ use super::{
     FungibleTokenPacketData, FungibleTokenPacketAcknowledgement, 
     DenomTrace, TransferError, TransferModule
 };
+use super::hooks::{
+    derive_hook_sender, parse_memo_hook, validate_router_hook_signer,
+    MemoHook, MemoHookHandler,
+};
 use crate::modules::bank::BankModule;
 use crate::modules::ibc::channel::{ChannelModule, Packet, Acknowledgement, Height};
 
@@ -79,12 +83,12 @@ impl TransferModule {
         } else {
             // Escrow native tokens (token leaving source)
             // Check sender balance first
-            if bank_module.get_balance(&sender_account) < amount {
+            if bank_module.get_denom_balance(&sender_account, &token_denom) < amount {
                 return Err(TransferError::InsufficientFunds);
             }
             
             // Transfer tokens to module account (escrow)
-            bank_module.transfer(&sender_account, &env::current_account_id(), amount);
+            bank_module.transfer_denom(&sender_account, &env::current_account_id(), &token_denom, amount);
             
             // Track escrowed amount
             self.escrow_tokens(&source_port, &source_channel, &token_denom, amount);
@@ -147,6 +151,132 @@ impl TransferModule {
 
         let amount = packet_data.amount_as_balance()?;
 
+        match self.credit_received_tokens(bank_module, packet, &packet_data, amount) {
+            Ok(_) => {
+                env::log_str(&format!(
+                    "ICS-20: Successfully processed receive for {} {} to {}",
+                    amount, packet_data.denom, packet_data.receiver
+                ));
+                Ok(Acknowledgement::success(FungibleTokenPacketAcknowledgement::success().to_bytes()))
+            }
+            Err(e) => Ok(Self::error_acknowledgement(e)),
+        }
+    }
+
+    /// Handle receiving a transfer packet whose memo may carry a hook
+    ///
+    /// Tokens are credited exactly as in `receive_transfer`, then the memo hook
+    /// runs through `hook_handler`. If the hook fails the credit is reverted and
+    /// an error acknowledgement is returned, so the sender gets refunded on the
+    /// source chain. If the credit cannot be reverted the receive panics, as an
+    /// error acknowledgement would refund tokens that stay credited here; the
+    /// aborted receipt leaves the packet unreceived. Memos without a hook
+    /// behave like a plain receive.
+    pub fn receive_transfer_with_hooks<H: MemoHookHandler>(
+        &mut self,
+        channel_module: &ChannelModule,
+        bank_module: &mut BankModule,
+        packet: &Packet,
+        hook_handler: &mut H,
+    ) -> Result<Acknowledgement, TransferError> {
+        let packet_data = FungibleTokenPacketData::from_bytes(&packet.data)
+            .map_err(|_| TransferError::InvalidDenomination)?;
+
+        packet_data.validate()?;
+
+        let hook = match parse_memo_hook(&packet_data.memo, &packet_data.receiver) {
+            Ok(Some(hook)) => hook,
+            Ok(None) => return self.receive_transfer(channel_module, bank_module, packet),
+            Err(e) => return Ok(Self::error_acknowledgement(e)),
+        };
+
+        let amount = packet_data.amount_as_balance()?;
+        let hook_sender = derive_hook_sender(&packet.destination_channel, &packet_data.sender);
+
+        // Router hooks act as the hook sender, so the funds must land there too
+        if let MemoHook::Router { value, .. } = &hook {
+            if packet_data.receiver != hook_sender {
+                return Ok(Self::error_acknowledgement(TransferError::InvalidMemo(
+                    "router hook receiver must be the hook sender".to_string()
+                )));
+            }
+            if let Err(e) = validate_router_hook_signer(value, &hook_sender) {
+                return Ok(Self::error_acknowledgement(e));
+            }
+        }
+
+        let (local_denom, is_source_zone) =
+            match self.credit_received_tokens(bank_module, packet, &packet_data, amount) {
+                Ok(credited) => credited,
+                Err(e) => return Ok(Self::error_acknowledgement(e)),
+            };
+
+        let result = match &hook {
+            MemoHook::Wasm { contract, msg } => hook_handler.execute_wasm_hook(
+                &hook_sender,
+                contract,
+                msg.clone(),
+                &local_denom,
+                amount,
+            ),
+            MemoHook::Router { type_url, value } => hook_handler.execute_router_hook(
+                &hook_sender,
+                type_url,
+                value.clone(),
+            ),
+        };
+
+        match result {
+            Ok(()) => {
+                env::log_str(&format!(
+                    "ICS-20: Memo hook executed for {} {} to {} as {}",
+                    amount, local_denom, packet_data.receiver, hook_sender
+                ));
+                Ok(Acknowledgement::success(FungibleTokenPacketAcknowledgement::success().to_bytes()))
+            }
+            Err(reason) => {
+                if let Err(e) = self.revert_received_tokens(
+                    bank_module,
+                    packet,
+                    &packet_data.receiver,
+                    &local_denom,
+                    is_source_zone,
+                    amount,
+                ) {
+                    env::panic_str(&format!("ICS-20: Memo hook failed ({}) and the credit cannot be reverted: {:?}", reason, e));
+                }
+                Ok(Self::error_acknowledgement(TransferError::HookFailed(reason)))
+            }
+        }
+    }
+
+    /// ICS-20 `OnRecvPacket` callback
+    ///
+    /// Every received transfer runs through `receive_transfer_with_hooks`;
+    /// a packet that cannot be decoded is answered with an error
+    /// acknowledgement instead of failing the receive.
+    pub fn on_recv_packet<H: MemoHookHandler>(
+        &mut self,
+        channel_module: &ChannelModule,
+        bank_module: &mut BankModule,
+        packet: &Packet,
+        hook_handler: &mut H,
+    ) -> Acknowledgement {
+        self.receive_transfer_with_hooks(channel_module, bank_module, packet, hook_handler)
+            .unwrap_or_else(Self::error_acknowledgement)
+    }
+
+    /// Credit the receiver of a transfer packet
+    ///
+    /// Returns the local denomination that was credited and whether the token
+    /// was returning to its source zone.
+    fn credit_received_tokens(
+        &mut self,
+        bank_module: &mut BankModule,
+        packet: &Packet,
+        packet_data: &FungibleTokenPacketData,
+        amount: Balance,
+    ) -> Result<(String, bool), TransferError> {
         // Determine if this is a source zone for the received token
         let is_source_zone = self.is_source_zone(
             &packet.destination_port,
@@ -154,7 +284,7 @@ impl TransferModule {
             &packet_data.denom,
         );
 
-        let result = if is_source_zone {
+        let local_denom = if is_source_zone {
             // Token is returning to its source - unescrow native tokens
             self.handle_source_zone_receive(
                 bank_module,
@@ -163,7 +293,7 @@ impl TransferModule {
                 &packet_data.denom,
                 amount,
                 &packet_data.receiver,
-            )
+            )?
         } else {
             // Token is arriving from another chain - mint voucher tokens
             self.handle_sink_zone_receive(
@@ -173,23 +303,48 @@ impl TransferModule {
                 &packet_data.denom,
                 amount,
                 &packet_data.receiver,
-            )
+            )?
         };
 
-        match result {
-            Ok(_) => {
-                env::log_str(&format!(
-                    "ICS-20: Successfully processed receive for {} {} to {}",
-                    amount, packet_data.denom, packet_data.receiver
-                ));
-                Ok(Acknowledgement::success(FungibleTokenPacketAcknowledgement::success().to_bytes()))
-            }
-            Err(e) => {
-                let error_msg = format!("Transfer failed: {:?}", e);
-                env::log_str(&format!("ICS-20: Receive failed: {}", error_msg));
-                Ok(Acknowledgement::error(error_msg))
-            }
+        Ok((local_denom, is_source_zone))
+    }
+
+    /// Undo a credit made by `credit_received_tokens`
+    ///
+    /// The hook may have spent or locked the credited tokens, so the revert
+    /// returns an error when the receiver no longer holds them.
+    fn revert_received_tokens(
+        &mut self,
+        bank_module: &mut BankModule,
+        packet: &Packet,
+        receiver: &str,
+        local_denom: &str,
+        is_source_zone: bool,
+        amount: Balance,
+    ) -> Result<(), TransferError> {
+        if is_source_zone {
+            let receiver_account = receiver.parse()
+                .map_err(|_| TransferError::InvalidReceiver)?;
+            bank_module.try_transfer_denom(&receiver_account, &env::current_account_id(), local_denom, amount)
+                .map_err(|_| TransferError::InsufficientFunds)?;
+            self.escrow_tokens(&packet.destination_port, &packet.destination_channel, local_denom, amount);
+        } else {
+            self.burn_voucher_tokens(bank_module, receiver, local_denom, amount)?;
         }
+
+        env::log_str(&format!(
+            "ICS-20: Reverted receive of {} {} to {}",
+            amount, local_denom, receiver
+        ));
+
+        Ok(())
+    }
+
+    /// Build an error acknowledgement for a failed receive
+    fn error_acknowledgement(error: TransferError) -> Acknowledgement {
+        let error_msg = format!("Transfer failed: {:?}", error);
+        env::log_str(&format!("ICS-20: Receive failed: {}", error_msg));
+        Acknowledgement::error(error_msg)
     }
 
     /// Handle source zone receive (unescrow native tokens)
@@ -201,7 +356,7 @@ impl TransferModule {
         denom: &str,
         amount: Balance,
         receiver: &str,
-    ) -> Result<(), TransferError> {
+    ) -> Result<String, TransferError> {
         // Get the original denomination by removing the prefix
         let original_denom = self.create_ibc_denom(port_id, channel_id, denom);
 
@@ -212,9 +367,9 @@ impl TransferModule {
         let receiver_account = receiver.parse()
             .map_err(|_| TransferError::InvalidReceiver)?;
 
-        bank_module.transfer(&env::current_account_id(), &receiver_account, amount);
+        bank_module.transfer_denom(&env::current_account_id(), &receiver_account, &original_denom, amount);
 
-        Ok(())
+        Ok(original_denom)
     }
 
     /// Handle sink zone receive (mint voucher tokens)
@@ -226,18 +381,20 @@ impl TransferModule {
         denom: &str,
         amount: Balance,
         receiver: &str,
-    ) -> Result<(), TransferError> {
+    ) -> Result<String, TransferError> {
         // Create denomination trace for the received token
         let trace_path = format!("{}/{}/{}", port_id, channel_id, denom);
         let denom_trace = DenomTrace::from_path(&trace_path)?;
 
         // Register the denomination trace
-        let ibc_denom = self.register_denom_trace(denom_trace);
+        let ibc_denom = self.register_denom_trace(denom_trace.clone());
+        self.sync_voucher_metadata(bank_module, &ibc_denom, &denom_trace);
+        self.index_voucher_denom(port_id, channel_id, &ibc_denom);
 
         // Mint voucher tokens to receiver
         self.mint_voucher_tokens(bank_module, receiver, &ibc_denom, amount)?;
 
-        Ok(())
+        Ok(ibc_denom)
     }
 
 
@@ -280,7 +437,7 @@ impl TransferModule {
 
         // Check balance for native tokens
         if !self.is_source_zone(source_port, source_channel, denom) {
-            if bank_module.get_balance(&sender_account) < amount {
+            if bank_module.get_denom_balance(&sender_account, denom) < amount {
                 return Err(TransferError::InsufficientFunds);
             }
         } else {
@@ -553,4 +710,179 @@ mod tests {
         let denom3 = transfer_module.create_ibc_denom("transfer", "channel-1", "transfer/channel-0/uatom");
         assert_eq!(denom3, "transfer/channel-1/transfer/channel-0/uatom");
     }
-}
\ No newline at end of file
+
+    struct MockHookHandler {
+        fail: bool,
+        wasm_calls: Vec<(String, String, String, Balance)>,
+        router_calls: Vec<String>,
+    }
+
+    impl MockHookHandler {
+        fn new(fail: bool) -> Self {
+            Self { fail, wasm_calls: vec![], router_calls: vec![] }
+        }
+    }
+
+    impl MemoHookHandler for MockHookHandler {
+        fn execute_wasm_hook(
+            &mut self,
+            sender: &str,
+            contract: &str,
+            _msg: Vec<u8>,
+            denom: &str,
+            amount: Balance,
+        ) -> Result<(), String> {
+            self.wasm_calls.push((sender.to_string(), contract.to_string(), denom.to_string(), amount));
+            if self.fail { Err("swap failed".to_string()) } else { Ok(()) }
+        }
+
+        fn execute_router_hook(
+            &mut self,
+            _sender: &str,
+            type_url: &str,
+            _value: Vec<u8>,
+        ) -> Result<(), String> {
+            self.router_calls.push(type_url.to_string());
+            if self.fail { Err("msg failed".to_string()) } else { Ok(()) }
+        }
+    }
+
+    fn create_hook_packet(receiver: &str, memo: &str) -> Packet {
+        let data = FungibleTokenPacketData::new(
+            "uatom".to_string(),
+            "1000".to_string(),
+            "cosmos1sender".to_string(),
+            receiver.to_string(),
+            Some(memo.to_string()),
+        );
+
+        Packet {
+            sequence: 1,
+            source_port: "transfer".to_string(),
+            source_channel: "channel-7".to_string(),
+            destination_port: "transfer".to_string(),
+            destination_channel: "channel-0".to_string(),
+            data: data.to_bytes().unwrap(),
+            timeout_height: Height { revision_number: 0, revision_height: 0 },
+            timeout_timestamp: 0,
+        }
+    }
+
+    fn ack_text(ack: &Acknowledgement) -> String {
+        String::from_utf8(ack.data.clone()).unwrap()
+    }
+
+    #[test]
+    fn test_receive_with_wasm_hook() {
+        let mut transfer_module = TransferModule::new();
+        let channel_module = create_test_channel_module();
+        let mut bank_module = create_test_bank_module();
+        let mut hooks = MockHookHandler::new(false);
+
+        let packet = create_hook_packet("swap.near", r#"{"wasm":{"contract":"swap.near","msg":{"swap":{}}}}"#);
+        let ack = transfer_module
+            .receive_transfer_with_hooks(&channel_module, &mut bank_module, &packet, &mut hooks)
+            .unwrap();
+
+        assert_eq!(ack.data, FungibleTokenPacketAcknowledgement::success().to_bytes());
+        assert_eq!(hooks.wasm_calls.len(), 1);
+
+        let (sender, contract, denom, amount) = &hooks.wasm_calls[0];
+        assert_eq!(sender, &derive_hook_sender("channel-0", "cosmos1sender"));
+        assert_eq!(contract, "swap.near");
+        assert!(denom.starts_with("ibc/"));
+        assert_eq!(*amount, 1000);
+        assert_eq!(bank_module.get_denom_balance(&"swap.near".parse().unwrap(), denom), 1000);
+    }
+
+    #[test]
+    fn test_failed_hook_reverts_credit() {
+        let mut transfer_module = TransferModule::new();
+        let channel_module = create_test_channel_module();
+        let mut bank_module = create_test_bank_module();
+        let mut hooks = MockHookHandler::new(true);
+
+        let packet = create_hook_packet("swap.near", r#"{"wasm":{"contract":"swap.near","msg":{}}}"#);
+        let ack = transfer_module.on_recv_packet(&channel_module, &mut bank_module, &packet, &mut hooks);
+
+        assert!(ack_text(&ack).contains("HookFailed"));
+        assert_eq!(hooks.wasm_calls.len(), 1);
+        assert!(bank_module.get_all_balances("swap.near".parse().unwrap()).is_empty());
+
+        let (_, _, denom, _) = &hooks.wasm_calls[0];
+        assert_eq!(transfer_module.get_voucher_supply(denom), 0);
+    }
+
+    #[test]
+    fn test_revert_of_spent_tokens_is_refused() {
+        let mut transfer_module = TransferModule::new();
+        let mut bank_module = create_test_bank_module();
+        let packet = create_hook_packet("swap.near", "");
+
+        let result = transfer_module.revert_received_tokens(&mut bank_module, &packet, "swap.near", "unear", true, 1000);
+        assert_eq!(result, Err(TransferError::InsufficientFunds));
+        assert_eq!(transfer_module.get_escrowed_amount("transfer", "channel-0", "unear"), 0);
+    }
+
+    #[test]
+    fn test_undecodable_packet_is_an_error_ack() {
+        let mut transfer_module = TransferModule::new();
+        let channel_module = create_test_channel_module();
+        let mut bank_module = create_test_bank_module();
+        let mut hooks = MockHookHandler::new(false);
+
+        let mut packet = create_hook_packet("alice.near", "");
+        packet.data = b"not a transfer".to_vec();
+        let ack = transfer_module.on_recv_packet(&channel_module, &mut bank_module, &packet, &mut hooks);
+        assert!(ack_text(&ack).contains("Transfer failed"));
+    }
+
+    #[test]
+    fn test_receive_with_router_hook() {
+        let mut transfer_module = TransferModule::new();
+        let channel_module = create_test_channel_module();
+        let mut bank_module = create_test_bank_module();
+        let mut hooks = MockHookHandler::new(false);
+
+        let hook_sender = derive_hook_sender("channel-0", "cosmos1sender");
+        let memo = format!(
+            r#"{{"router":{{"type_url":"/cosmos.bank.v1beta1.MsgSend","value":{{"from_address":"{}","to_address":"bob.near"}}}}}}"#,
+            hook_sender
+        );
+
+        // Receiver must be the derived hook sender
+        let packet = create_hook_packet("alice.near", &memo);
+        let ack = transfer_module
+            .receive_transfer_with_hooks(&channel_module, &mut bank_module, &packet, &mut hooks)
+            .unwrap();
+        assert!(ack_text(&ack).contains("InvalidMemo"));
+        assert!(hooks.router_calls.is_empty());
+
+        let packet = create_hook_packet(&hook_sender, &memo);
+        let ack = transfer_module
+            .receive_transfer_with_hooks(&channel_module, &mut bank_module, &packet, &mut hooks)
+            .unwrap();
+        assert_eq!(ack.data, FungibleTokenPacketAcknowledgement::success().to_bytes());
+        assert_eq!(hooks.router_calls, vec!["/cosmos.bank.v1beta1.MsgSend".to_string()]);
+    }
+
+    #[test]
+    fn test_plain_memo_skips_hooks() {
+        let mut transfer_module = TransferModule::new();
+        let channel_module = create_test_channel_module();
+        let mut bank_module = create_test_bank_module();
+        let mut hooks = MockHookHandler::new(true);
+
+        let packet = create_hook_packet("alice.near", "invoice 42");
+        let ack = transfer_module
+            .receive_transfer_with_hooks(&channel_module, &mut bank_module, &packet, &mut hooks)
+            .unwrap();
+
+        assert_eq!(ack.data, FungibleTokenPacketAcknowledgement::success().to_bytes());
+        assert!(hooks.wasm_calls.is_empty());
+        let balances = bank_module.get_all_balances("alice.near".parse().unwrap());
+        assert_eq!(balances.len(), 1);
+        assert!(balances.denoms()[0].starts_with("ibc/"));
+        assert_eq!(balances.iter().next().unwrap().amount, 1000);
+    }
+}
@@ -0,0 +1,292 @@
+/// ICS-20 Memo Hooks
+///
+/// Lets an incoming transfer trigger an on-chain action once the tokens have
+/// been credited, similar to the IBC hooks middleware used by Osmosis. The
+/// memo is a JSON object carrying one of two instructions:
+///
+/// - `{"wasm": {"contract": "<addr>", "msg": {...}}}` executes a wasm contract.
+///   The packet receiver must be the contract so the funds land on it.
+/// - `{"router": {"type_url": "/cosmos...", "value": {...}}}` dispatches a
+///   Cosmos Msg through the Msg router, signed by the derived hook sender.
+///
+/// Memos that are not JSON objects, or that carry neither key, are treated as
+/// plain text and leave the transfer untouched.
+
+use near_sdk::json_types::Base64VecU8;
+use near_sdk::serde_json::{self, Value};
+use sha2::{Digest, Sha256};
+
+use super::TransferError;
+use crate::handler::{route_cosmos_message, CosmosMessageHandler};
+use crate::modules::wasm::{Coin as WasmCoin, WasmModule};
+use crate::Balance;
+
+/// Memo key for wasm contract execution
+pub const WASM_HOOK_KEY: &str = "wasm";
+/// Memo key for Msg router dispatch
+pub const ROUTER_HOOK_KEY: &str = "router";
+
+/// Message fields that name the signer of a routed Cosmos Msg
+pub(crate) const SIGNER_FIELDS: [&str; 6] = [
+    "from_address",
+    "delegator_address",
+    "sender",
+    "proposer",
+    "voter",
+    "depositor",
+];
+
+/// Action requested by a transfer memo
+#[derive(Debug, Clone, PartialEq)]
+pub enum MemoHook {
+    /// Execute `msg` on a wasm contract with the received funds
+    Wasm { contract: String, msg: Vec<u8> },
+    /// Route a Cosmos Msg through the Msg router
+    Router { type_url: String, value: Vec<u8> },
+}
+
+/// Executes memo hook actions on behalf of the transfer module
+pub trait MemoHookHandler {
+    /// Execute a wasm contract with the funds that arrived in the packet
+    fn execute_wasm_hook(
+        &mut self,
+        sender: &str,
+        contract: &str,
+        msg: Vec<u8>,
+        denom: &str,
+        amount: Balance,
+    ) -> Result<(), String>;
+
+    /// Dispatch a Cosmos Msg through the Msg router
+    fn execute_router_hook(
+        &mut self,
+        sender: &str,
+        type_url: &str,
+        value: Vec<u8>,
+    ) -> Result<(), String>;
+}
+
+/// Parse a hook instruction out of a transfer memo
+///
+/// Returns `Ok(None)` for memos that do not request a hook and an error for
+/// memos that request one but are malformed.
+pub fn parse_memo_hook(memo: &str, receiver: &str) -> Result<Option<MemoHook>, TransferError> {
+    let memo = memo.trim();
+    if !memo.starts_with('{') {
+        return Ok(None);
+    }
+
+    let value: Value = match serde_json::from_str(memo) {
+        Ok(value) => value,
+        Err(_) => return Ok(None),
+    };
+
+    if let Some(wasm) = value.get(WASM_HOOK_KEY) {
+        let contract = wasm.get("contract")
+            .and_then(Value::as_str)
+            .ok_or_else(|| TransferError::InvalidMemo("wasm hook missing contract".to_string()))?;
+        let msg = wasm.get("msg")
+            .filter(|msg| msg.is_object())
+            .ok_or_else(|| TransferError::InvalidMemo("wasm hook msg must be an object".to_string()))?;
+
+        if contract != receiver {
+            return Err(TransferError::InvalidMemo(
+                "wasm hook contract must be the packet receiver".to_string()
+            ));
+        }
+
+        return Ok(Some(MemoHook::Wasm {
+            contract: contract.to_string(),
+            msg: serde_json::to_vec(msg).unwrap_or_default(),
+        }));
+    }
+
+    if let Some(router) = value.get(ROUTER_HOOK_KEY) {
+        let type_url = router.get("type_url")
+            .and_then(Value::as_str)
+            .ok_or_else(|| TransferError::InvalidMemo("router hook missing type_url".to_string()))?;
+        let msg = router.get("value")
+            .filter(|msg| msg.is_object())
+            .ok_or_else(|| TransferError::InvalidMemo("router hook value must be an object".to_string()))?;
+
+        return Ok(Some(MemoHook::Router {
+            type_url: type_url.to_string(),
+            value: serde_json::to_vec(msg).unwrap_or_default(),
+        }));
+    }
+
+    Ok(None)
+}
+
+/// Derive the local account that acts for a remote sender in memo hooks
+///
+/// The remote sender cannot be trusted as a local identity, so hooks run as
+/// an implicit-style account derived from the channel and remote sender.
+pub fn derive_hook_sender(channel_id: &str, original_sender: &str) -> String {
+    let digest = Sha256::digest(format!("ibc-hook/{}/{}", channel_id, original_sender).as_bytes());
+    hex::encode(digest)
+}
+
+/// Ensure a routed Msg is signed by the hook sender and nobody else
+pub fn validate_router_hook_signer(value: &[u8], hook_sender: &str) -> Result<(), TransferError> {
+    let msg: Value = serde_json::from_slice(value)
+        .map_err(|_| TransferError::InvalidMemo("router hook value is not JSON".to_string()))?;
+
+    let mut found = false;
+    for field in SIGNER_FIELDS.iter() {
+        if let Some(signer) = msg.get(*field) {
+            if signer.as_str() != Some(hook_sender) {
+                return Err(TransferError::InvalidMemo(format!(
+                    "router hook {} must be the hook sender {}",
+                    field, hook_sender
+                )));
+            }
+            found = true;
+        }
+    }
+
+    if !found {
+        return Err(TransferError::InvalidMemo("router hook message has no signer".to_string()));
+    }
+
+    Ok(())
+}
+
+impl MemoHookHandler for WasmModule {
+    fn execute_wasm_hook(
+        &mut self,
+        sender: &str,
+        contract: &str,
+        msg: Vec<u8>,
+        denom: &str,
+        amount: Balance,
+    ) -> Result<(), String> {
+        let sender = sender.parse()
+            .map_err(|_| format!("Invalid hook sender: {}", sender))?;
+        let funds = vec![WasmCoin {
+            denom: denom.to_string(),
+            amount: amount.to_string(),
+        }];
+
+        self.execute_contract(&sender, &contract.to_string(), msg, funds)
+            .map(|_| ())
+    }
+
+    fn execute_router_hook(
+        &mut self,
+        _sender: &str,
+        type_url: &str,
+        _value: Vec<u8>,
+    ) -> Result<(), String> {
+        Err(format!("Router hooks are not supported by the wasm module: {}", type_url))
+    }
+}
+
+/// Adapts a Msg router handler so it can serve router memo hooks
+pub struct RouterHookHandler<'a, T: CosmosMessageHandler> {
+    pub handler: &'a mut T,
+}
+
+impl<'a, T: CosmosMessageHandler> RouterHookHandler<'a, T> {
+    pub fn new(handler: &'a mut T) -> Self {
+        Self { handler }
+    }
+}
+
+impl<'a, T: CosmosMessageHandler> MemoHookHandler for RouterHookHandler<'a, T> {
+    fn execute_wasm_hook(
+        &mut self,
+        _sender: &str,
+        contract: &str,
+        _msg: Vec<u8>,
+        _denom: &str,
+        _amount: Balance,
+    ) -> Result<(), String> {
+        Err(format!("Wasm hooks are not supported by the Msg router: {}", contract))
+    }
+
+    fn execute_router_hook(
+        &mut self,
+        _sender: &str,
+        type_url: &str,
+        value: Vec<u8>,
+    ) -> Result<(), String> {
+        let response = route_cosmos_message(self.handler, type_url.to_string(), Base64VecU8(value));
+        if response.code != 0 {
+            return Err(response.log);
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_plain_memo_is_not_a_hook() {
+        assert_eq!(parse_memo_hook("", "alice.near").unwrap(), None);
+        assert_eq!(parse_memo_hook("payment for invoice 42", "alice.near").unwrap(), None);
+        assert_eq!(parse_memo_hook("{not json", "alice.near").unwrap(), None);
+        assert_eq!(parse_memo_hook(r#"{"forward":{"receiver":"x"}}"#, "alice.near").unwrap(), None);
+    }
+
+    #[test]
+    fn test_parse_wasm_hook() {
+        let memo = r#"{"wasm":{"contract":"swap.near","msg":{"swap":{"min_out":"10"}}}}"#;
+        let hook = parse_memo_hook(memo, "swap.near").unwrap().unwrap();
+
+        match hook {
+            MemoHook::Wasm { contract, msg } => {
+                assert_eq!(contract, "swap.near");
+                let msg: Value = serde_json::from_slice(&msg).unwrap();
+                assert_eq!(msg["swap"]["min_out"], "10");
+            }
+            _ => panic!("Expected wasm hook"),
+        }
+    }
+
+    #[test]
+    fn test_wasm_hook_requires_receiver_contract() {
+        let memo = r#"{"wasm":{"contract":"swap.near","msg":{}}}"#;
+        let result = parse_memo_hook(memo, "alice.near");
+        assert!(matches!(result, Err(TransferError::InvalidMemo(_))));
+
+        let memo = r#"{"wasm":{"contract":"swap.near","msg":"swap"}}"#;
+        let result = parse_memo_hook(memo, "swap.near");
+        assert!(matches!(result, Err(TransferError::InvalidMemo(_))));
+    }
+
+    #[test]
+    fn test_parse_router_hook() {
+        let memo = r#"{"router":{"type_url":"/cosmos.staking.v1beta1.MsgDelegate","value":{"delegator_address":"abc"}}}"#;
+        let hook = parse_memo_hook(memo, "abc").unwrap().unwrap();
+        assert!(matches!(hook, MemoHook::Router { ref type_url, .. } if type_url == "/cosmos.staking.v1beta1.MsgDelegate"));
+
+        let memo = r#"{"router":{"value":{}}}"#;
+        assert!(matches!(parse_memo_hook(memo, "abc"), Err(TransferError::InvalidMemo(_))));
+    }
+
+    #[test]
+    fn test_derive_hook_sender() {
+        let sender = derive_hook_sender("channel-0", "cosmos1abc");
+        assert_eq!(sender.len(), 64);
+        assert!(sender.parse::<near_sdk::AccountId>().is_ok());
+        assert_eq!(sender, derive_hook_sender("channel-0", "cosmos1abc"));
+        assert_ne!(sender, derive_hook_sender("channel-1", "cosmos1abc"));
+    }
+
+    #[test]
+    fn test_router_hook_signer_validation() {
+        let hook_sender = derive_hook_sender("channel-0", "cosmos1abc");
+
+        let value = format!(r#"{{"from_address":"{}","to_address":"bob.near"}}"#, hook_sender);
+        assert!(validate_router_hook_signer(value.as_bytes(), &hook_sender).is_ok());
+
+        let value = r#"{"from_address":"alice.near","to_address":"bob.near"}"#;
+        assert!(validate_router_hook_signer(value.as_bytes(), &hook_sender).is_err());
+
+        let value = r#"{"to_address":"bob.near"}"#;
+        assert!(validate_router_hook_signer(value.as_bytes(), &hook_sender).is_err());
+    }
+}
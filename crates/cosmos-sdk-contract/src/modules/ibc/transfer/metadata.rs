@@ -0,0 +1,154 @@
+/// Voucher Denom Metadata
+///
+/// A voucher is stored under its `ibc/<hash>` denom, which tells a wallet
+/// nothing about the symbol or decimals of the bridged asset. The module
+/// keeps a registry of counterparty metadata, set through governance for
+/// each channel and base denom. When a voucher denom is created, or when
+/// the registry learns about one that already exists, the counterparty
+/// metadata is rewritten for the voucher and stored in the bank module.
+///
+/// Unit names are prefixed with the trace path, e.g. `transfer/channel-0/atom`,
+/// because the bank requires unit names to be unique across denoms and the
+/// same asset may arrive over several channels.
+
+use near_sdk::env;
+
+use super::{DenomTrace, TransferModule};
+use crate::modules::bank::{BankModule, DenomUnit, Metadata};
+
+impl TransferModule {
+    /// Register the metadata of `metadata.base` on the chain behind `port_id/channel_id`
+    ///
+    /// Returns the voucher denom the metadata applies to. If vouchers of the
+    /// denom already exist their bank metadata is set right away.
+    pub fn set_counterparty_metadata(
+        &mut self,
+        bank_module: &mut BankModule,
+        port_id: &str,
+        channel_id: &str,
+        metadata: Metadata,
+    ) -> Result<String, String> {
+        metadata.validate()?;
+        let trace = DenomTrace::from_path(&format!("{}/{}/{}", port_id, channel_id, metadata.base))
+            .map_err(|e| format!("{:?}", e))?;
+        let ibc_denom = format!("ibc/{}", trace.hash());
+
+        // Check the rewritten form before storing, the prefix can push a unit into a conflict
+        let voucher = voucher_metadata(&ibc_denom, &trace, &metadata);
+        voucher.validate()?;
+        self.counterparty_metadata.insert(&trace.get_full_path(), &metadata);
+
+        if self.get_trace_path(&ibc_denom).is_some() {
+            bank_module.set_denom_metadata(voucher)?;
+        }
+        Ok(ibc_denom)
+    }
+
+    /// Metadata registered for a full trace path such as `transfer/channel-0/uatom`
+    pub fn get_counterparty_metadata(&self, trace_path: &str) -> Option<Metadata> {
+        self.counterparty_metadata.get(&trace_path.to_string())
+    }
+
+    /// Give a newly created voucher denom its metadata, if the counterparty's is known
+    pub(super) fn sync_voucher_metadata(&self, bank_module: &mut BankModule, ibc_denom: &str, trace: &DenomTrace) {
+        if bank_module.get_denom_metadata(ibc_denom.to_string()).is_some() {
+            return;
+        }
+        if let Some(metadata) = self.get_counterparty_metadata(&trace.get_full_path()) {
+            // A conflict only leaves the voucher without metadata, the transfer still goes through
+            if let Err(e) = bank_module.set_denom_metadata(voucher_metadata(ibc_denom, trace, &metadata)) {
+                env::log_str(&format!("Skipped metadata for {}: {}", ibc_denom, e));
+            }
+        }
+    }
+}
+
+/// Counterparty metadata rewritten for the local voucher denom
+pub fn voucher_metadata(ibc_denom: &str, trace: &DenomTrace, metadata: &Metadata) -> Metadata {
+    let prefixed = |denom: &str| format!("{}/{}", trace.path, denom);
+    let denom_units = metadata.denom_units.iter()
+        .map(|unit| {
+            if unit.exponent == 0 {
+                DenomUnit {
+                    denom: ibc_denom.to_string(),
+                    exponent: 0,
+                    aliases: vec![trace.get_full_path()],
+                }
+            } else {
+                DenomUnit {
+                    denom: prefixed(&unit.denom),
+                    exponent: unit.exponent,
+                    aliases: unit.aliases.iter().map(|alias| prefixed(alias)).collect(),
+                }
+            }
+        })
+        .collect();
+
+    let display = if metadata.display == metadata.base {
+        ibc_denom.to_string()
+    } else {
+        // The display may name an alias, point it at the unit's own denom
+        let unit = metadata.unit(&metadata.display).map_or(metadata.display.as_str(), |unit| unit.denom.as_str());
+        prefixed(unit)
+    };
+
+    Metadata {
+        description: format!("{} (via {})", metadata.description, trace.path).trim_start().to_string(),
+        denom_units,
+        base: ibc_denom.to_string(),
+        display,
+        name: metadata.name.clone(),
+        symbol: metadata.symbol.clone(),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn atom() -> Metadata {
+        Metadata {
+            description: "The native staking token of the Cosmos Hub".to_string(),
+            denom_units: vec![
+                DenomUnit { denom: "uatom".to_string(), exponent: 0, aliases: vec!["microatom".to_string()] },
+                DenomUnit { denom: "atom".to_string(), exponent: 6, aliases: vec![] },
+            ],
+            base: "uatom".to_string(),
+            display: "atom".to_string(),
+            name: "Cosmos Hub Atom".to_string(),
+            symbol: "ATOM".to_string(),
+        }
+    }
+
+    #[test]
+    fn test_voucher_metadata_is_prefixed() {
+        let trace = DenomTrace::new("transfer/channel-0".to_string(), "uatom".to_string());
+        let voucher = voucher_metadata("ibc/ABC", &trace, &atom());
+
+        assert_eq!(voucher.base, "ibc/ABC");
+        assert_eq!(voucher.display, "transfer/channel-0/atom");
+        assert_eq!(voucher.symbol, "ATOM");
+        assert_eq!(voucher.denom_units[0].aliases, vec!["transfer/channel-0/uatom".to_string()]);
+        assert_eq!(voucher.denom_units[1].exponent, 6);
+        assert!(voucher.validate().is_ok());
+    }
+
+    #[test]
+    fn test_registry_applies_to_received_vouchers() {
+        let mut transfer = TransferModule::new();
+        let mut bank = BankModule::new();
+
+        let ibc_denom = transfer.set_counterparty_metadata(&mut bank, "transfer", "channel-0", atom()).unwrap();
+        assert!(bank.get_denom_metadata(ibc_denom.clone()).is_none());
+
+        let trace = DenomTrace::from_path("transfer/channel-0/uatom").unwrap();
+        assert_eq!(transfer.register_denom_trace(trace.clone()), ibc_denom);
+        transfer.sync_voucher_metadata(&mut bank, &ibc_denom, &trace);
+        let metadata = bank.get_denom_metadata(ibc_denom.clone()).unwrap();
+        assert_eq!(metadata.display_unit().exponent, 6);
+
+        // The same asset over another channel gets its own units
+        let other = transfer.set_counterparty_metadata(&mut bank, "transfer", "channel-1", atom()).unwrap();
+        assert_ne!(other, ibc_denom);
+    }
+}
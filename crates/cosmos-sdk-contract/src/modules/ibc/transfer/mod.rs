@@ -1,15 +1,23 @@
 use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
 use near_sdk::collections::LookupMap;
+use crate::modules::bank::Metadata;
 use near_sdk::env;
 use crate::Balance;
 
 pub mod types;
 pub mod handlers;
+pub mod hooks;
+pub mod metadata;
+pub mod refund;
+pub mod report;
 
 pub use types::{
     FungibleTokenPacketData, DenomTrace,
     FungibleTokenPacketAcknowledgement, TransferError
 };
+pub use hooks::{MemoHook, MemoHookHandler, RouterHookHandler};
+pub use metadata::voucher_metadata;
+pub use report::{BridgeReport, EscrowLine, VoucherLine};
 
 use crate::modules::bank::BankModule;
 
@@ -33,6 +41,18 @@ pub struct TransferModule {
     
     /// Total supply of voucher tokens: denom -> amount
     voucher_supply: LookupMap<String, Balance>,
+
+    /// Counterparty denom metadata by full trace path, set through governance
+    counterparty_metadata: LookupMap<String, Metadata>,
+
+    /// Refund address overrides: port_id/channel_id/sequence -> account
+    refund_addresses: LookupMap<String, String>,
+
+    /// Denoms ever escrowed per channel: port_id#channel_id -> denoms
+    channel_escrow_denoms: LookupMap<String, Vec<String>>,
+
+    /// Voucher denoms ever minted per channel: port_id#channel_id -> denoms
+    channel_voucher_denoms: LookupMap<String, Vec<String>>,
     
     /// Port ID for this transfer module (typically "transfer")
     port_id: String,
@@ -46,6 +66,10 @@ impl TransferModule {
             denom_to_trace: LookupMap::new(b"b"),
             escrowed_tokens: LookupMap::new(b"c"),
             voucher_supply: LookupMap::new(b"d"),
+            counterparty_metadata: LookupMap::new(b"tm"),
+            refund_addresses: LookupMap::new(b"tr"),
+            channel_escrow_denoms: LookupMap::new(b"te"),
+            channel_voucher_denoms: LookupMap::new(b"tv"),
             port_id: "transfer".to_string(),
         }
     }
@@ -67,6 +91,7 @@ impl TransferModule {
         let key = Self::escrow_key(port_id, channel_id, denom);
         let current = self.escrowed_tokens.get(&key).unwrap_or(0);
         self.escrowed_tokens.insert(&key, &(current + amount));
+        self.index_escrow_denom(port_id, channel_id, denom);
         
         env::log_str(&format!(
             "Escrowed {} {} on channel {}",
@@ -154,7 +179,7 @@ impl TransferModule {
         let receiver_account = receiver.parse()
             .map_err(|_| TransferError::InvalidReceiver)?;
         
-        bank_module.mint(&receiver_account, amount);
+        bank_module.mint_denom(&receiver_account, denom, amount);
         
         env::log_str(&format!(
             "Minted {} voucher tokens {} to {}",
@@ -178,16 +203,13 @@ impl TransferModule {
             return Err(TransferError::InsufficientVoucherSupply);
         }
         
-        // Check sender balance through bank module
         let sender_account = sender.parse()
             .map_err(|_| TransferError::InvalidSender)?;
         
-        if bank_module.get_balance(&sender_account) < amount {
-            return Err(TransferError::InsufficientFunds);
-        }
-        
-        // Burn tokens (transfer to module account)
-        bank_module.transfer(&sender_account, &env::current_account_id(), amount);
+        // Burn tokens (transfer to module account, which burns them)
+        bank_module.try_transfer_denom(&sender_account, &env::current_account_id(), denom, amount)
+            .map_err(|_| TransferError::InsufficientFunds)?;
+        bank_module.burn_denom(&env::current_account_id(), denom, amount);
         
         // Update voucher supply
         self.voucher_supply.insert(&denom.to_string(), &(current_supply - amount));
@@ -0,0 +1,154 @@
+/// Refund Address Override
+///
+/// When a transfer times out or is acknowledged with an error, ICS-20 returns
+/// the tokens to the packet's sender. A module or contract account sending
+/// on behalf of others may not be able to hold or forward them, so the
+/// sender can name another local account to receive the refund instead.
+///
+/// The override never leaves this chain: it is stored against the packet's
+/// source port, channel and sequence when the packet is sent, and consumed
+/// when the packet is refunded.
+
+use near_sdk::{env, AccountId};
+
+use super::{FungibleTokenPacketData, TransferError, TransferModule};
+use crate::modules::bank::BankModule;
+
+impl TransferModule {
+    fn refund_key(port_id: &str, channel_id: &str, sequence: u64) -> String {
+        format!("{}/{}/{}", port_id, channel_id, sequence)
+    }
+
+    /// Check that `refund_address` can receive a refund
+    ///
+    /// The escrow account is rejected, a refund to it would strand the tokens.
+    pub fn validate_refund_address(refund_address: &str) -> Result<AccountId, TransferError> {
+        let account: AccountId = refund_address.parse()
+            .map_err(|_| TransferError::InvalidRefundAddress(refund_address.to_string()))?;
+        if account == env::current_account_id() {
+            return Err(TransferError::InvalidRefundAddress(format!("{} is the escrow account", refund_address)));
+        }
+        Ok(account)
+    }
+
+    /// Refund the packet sent as `sequence` to `refund_address` instead of its sender
+    pub fn set_refund_address(
+        &mut self,
+        port_id: &str,
+        channel_id: &str,
+        sequence: u64,
+        sender: &str,
+        refund_address: &str,
+    ) -> Result<(), TransferError> {
+        let account = Self::validate_refund_address(refund_address)?;
+        self.refund_addresses.insert(&Self::refund_key(port_id, channel_id, sequence), &account.to_string());
+        env::log_str(&format!(
+            "EVENT: ics20_refund_address port={} channel={} sequence={} sender={} refund_address={}",
+            port_id, channel_id, sequence, sender, account
+        ));
+        Ok(())
+    }
+
+    pub fn get_refund_address(&self, port_id: &str, channel_id: &str, sequence: u64) -> Option<String> {
+        self.refund_addresses.get(&Self::refund_key(port_id, channel_id, sequence))
+    }
+
+    /// Return the tokens of a timed out or failed packet
+    ///
+    /// Escrowed tokens are released and burned vouchers minted again, to the
+    /// refund address if one was set and to the sender otherwise. Returns the
+    /// account refunded.
+    pub fn refund_packet(
+        &mut self,
+        bank_module: &mut BankModule,
+        port_id: &str,
+        channel_id: &str,
+        sequence: u64,
+        data: &FungibleTokenPacketData,
+        reason: &str,
+    ) -> Result<String, TransferError> {
+        let amount = data.amount_as_balance()?;
+        let recipient = self.refund_addresses.remove(&Self::refund_key(port_id, channel_id, sequence))
+            .unwrap_or_else(|| data.sender.clone());
+        let recipient_account: AccountId = recipient.parse()
+            .map_err(|_| TransferError::InvalidSender)?;
+
+        // Sending a native token prefixed the packet denom with our port and
+        // channel; a returning voucher had that prefix stripped
+        let prefix = format!("{}/{}/", port_id, channel_id);
+        let denom = match data.denom.strip_prefix(&prefix) {
+            Some(native_denom) => {
+                self.unescrow_tokens(port_id, channel_id, native_denom, amount)?;
+                bank_module.transfer_denom_with_reason(
+                    &env::current_account_id(),
+                    &recipient_account,
+                    native_denom,
+                    amount,
+                    "transfer",
+                    "refund",
+                );
+                native_denom.to_string()
+            }
+            None => {
+                let voucher_denom = format!("{}{}", prefix, data.denom);
+                self.mint_voucher_tokens(bank_module, &recipient, &voucher_denom, amount)?;
+                voucher_denom
+            }
+        };
+
+        env::log_str(&format!(
+            "EVENT: ics20_refund port={} channel={} sequence={} sender={} recipient={} amount={} denom={} reason={}",
+            port_id, channel_id, sequence, data.sender, recipient, amount, denom, reason
+        ));
+        Ok(recipient)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use near_sdk::test_utils::VMContextBuilder;
+    use near_sdk::testing_env;
+
+    fn packet(denom: &str) -> FungibleTokenPacketData {
+        FungibleTokenPacketData::new(denom.to_string(), "40".to_string(), "vault.near".to_string(), "cosmos1xyz".to_string(), None)
+    }
+
+    #[test]
+    fn test_refund_goes_to_override() {
+        testing_env!(VMContextBuilder::new().current_account_id("transfer.near".parse().unwrap()).build());
+        let mut transfer = TransferModule::new();
+        let mut bank = BankModule::new();
+        bank.mint(&"transfer.near".parse().unwrap(), 40);
+        transfer.escrow_tokens("transfer", "channel-0", "unear", 40);
+
+        transfer.set_refund_address("transfer", "channel-0", 1, "vault.near", "treasury.near").unwrap();
+        let recipient = transfer
+            .refund_packet(&mut bank, "transfer", "channel-0", 1, &packet("transfer/channel-0/unear"), "timeout")
+            .unwrap();
+
+        assert_eq!(recipient, "treasury.near");
+        assert_eq!(bank.get_balance(&"treasury.near".parse().unwrap()), 40);
+        assert_eq!(transfer.get_escrowed_amount("transfer", "channel-0", "unear"), 0);
+        assert_eq!(transfer.get_refund_address("transfer", "channel-0", 1), None);
+    }
+
+    #[test]
+    fn test_refund_defaults_to_sender_and_rejects_escrow() {
+        testing_env!(VMContextBuilder::new().current_account_id("transfer.near".parse().unwrap()).build());
+        let mut transfer = TransferModule::new();
+        let mut bank = BankModule::new();
+
+        let recipient = transfer
+            .refund_packet(&mut bank, "transfer", "channel-0", 2, &packet("uatom"), "ack_error")
+            .unwrap();
+        assert_eq!(recipient, "vault.near");
+        assert_eq!(transfer.get_voucher_supply("transfer/channel-0/uatom"), 40);
+
+        assert!(matches!(
+            transfer.set_refund_address("transfer", "channel-0", 3, "vault.near", "transfer.near"),
+            Err(TransferError::InvalidRefundAddress(_))
+        ));
+        assert!(TransferModule::validate_refund_address("Not An Account").is_err());
+    }
+}
@@ -0,0 +1,225 @@
+/// Bridge Report
+///
+/// Every token escrowed here for a channel backs a voucher on the chain
+/// behind it, and every voucher minted here is backed by tokens escrowed
+/// over there. `bridge_report` lists both sides of a channel as this chain
+/// records them and checks what can be checked locally: that the escrow
+/// account still holds what the escrow records say, and that the bank's
+/// supply of each voucher matches the supply the transfer module minted.
+///
+/// The counterparty half of the check needs that chain's state. The report
+/// carries the denoms as the counterparty names them, so an off-chain tool
+/// (`examples/bridge_report.rs`) can query them and compare.
+
+use near_sdk::env;
+use near_sdk::serde::{Deserialize, Serialize};
+use schemars::JsonSchema;
+use sha2::{Digest, Sha256};
+
+use super::{TransferError, TransferModule};
+use crate::modules::bank::BankModule;
+use crate::modules::ibc::channel::{ChannelModule, State};
+use crate::Balance;
+
+/// Native tokens escrowed for a channel
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct EscrowLine {
+    pub denom: String,
+    pub escrowed: Balance,
+    /// Voucher denom backed by the escrow on the counterparty chain
+    pub counterparty_denom: String,
+}
+
+/// Vouchers minted for tokens received over a channel
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct VoucherLine {
+    pub denom: String,
+    pub trace_path: String,
+    /// Supply recorded by the transfer module
+    pub recorded_supply: Balance,
+    /// Supply of the denom in the bank
+    pub bank_supply: Balance,
+    /// Denom the counterparty escrows to back the vouchers
+    pub counterparty_denom: String,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct BridgeReport {
+    pub port_id: String,
+    pub channel_id: String,
+    pub channel_state: String,
+    pub counterparty_port_id: String,
+    pub counterparty_channel_id: Option<String>,
+    pub escrows: Vec<EscrowLine>,
+    pub vouchers: Vec<VoucherLine>,
+    /// Native balance of the escrow account, shared by all channels
+    pub escrow_account_balance: Balance,
+    pub discrepancies: Vec<String>,
+}
+
+impl BridgeReport {
+    pub fn is_healthy(&self) -> bool {
+        self.discrepancies.is_empty()
+    }
+}
+
+/// Denom a Cosmos chain gives a token received over `port/channel`
+pub fn counterparty_voucher_denom(port_id: &str, channel_id: &str, denom: &str) -> String {
+    let path = format!("{}/{}/{}", port_id, channel_id, denom);
+    format!("ibc/{}", hex::encode_upper(Sha256::digest(path.as_bytes())))
+}
+
+impl TransferModule {
+    fn channel_index_key(port_id: &str, channel_id: &str) -> String {
+        format!("{}#{}", port_id, channel_id)
+    }
+
+    /// Remember a denom that was escrowed on a channel
+    pub(super) fn index_escrow_denom(&mut self, port_id: &str, channel_id: &str, denom: &str) {
+        let key = Self::channel_index_key(port_id, channel_id);
+        let mut denoms = self.channel_escrow_denoms.get(&key).unwrap_or_default();
+        if !denoms.iter().any(|known| known == denom) {
+            denoms.push(denom.to_string());
+            self.channel_escrow_denoms.insert(&key, &denoms);
+        }
+    }
+
+    /// Remember a voucher denom that was minted for a channel
+    pub(super) fn index_voucher_denom(&mut self, port_id: &str, channel_id: &str, ibc_denom: &str) {
+        let key = Self::channel_index_key(port_id, channel_id);
+        let mut denoms = self.channel_voucher_denoms.get(&key).unwrap_or_default();
+        if !denoms.iter().any(|known| known == ibc_denom) {
+            denoms.push(ibc_denom.to_string());
+            self.channel_voucher_denoms.insert(&key, &denoms);
+        }
+    }
+
+    /// Reconcile the escrow and voucher records of a transfer channel
+    pub fn bridge_report(
+        &self,
+        channel_module: &ChannelModule,
+        bank_module: &BankModule,
+        channel_id: &str,
+    ) -> Result<BridgeReport, TransferError> {
+        let port_id = self.port_id.clone();
+        let channel = channel_module.get_channel(port_id.clone(), channel_id.to_string())
+            .ok_or(TransferError::ChannelNotOpen)?;
+        let counterparty_channel = channel.counterparty.channel_id.clone().unwrap_or_default();
+        let key = Self::channel_index_key(&port_id, channel_id);
+        let mut discrepancies = Vec::new();
+
+        let escrows: Vec<EscrowLine> = self.channel_escrow_denoms.get(&key).unwrap_or_default()
+            .into_iter()
+            .map(|denom| EscrowLine {
+                escrowed: self.get_escrowed_amount(&port_id, channel_id, &denom),
+                counterparty_denom: counterparty_voucher_denom(&channel.counterparty.port_id, &counterparty_channel, &denom),
+                denom,
+            })
+            .collect();
+        for escrow in &escrows {
+            let escrow_account_balance = bank_module.get_denom_balance(&env::current_account_id(), &escrow.denom);
+            if escrow.escrowed > escrow_account_balance {
+                discrepancies.push(format!(
+                    "{} {} escrowed but the escrow account holds {}", escrow.escrowed, escrow.denom, escrow_account_balance
+                ));
+            }
+        }
+
+        let mut vouchers = Vec::new();
+        for denom in self.channel_voucher_denoms.get(&key).unwrap_or_default() {
+            let trace_path = self.get_trace_path(&denom).unwrap_or_default();
+            let voucher = VoucherLine {
+                recorded_supply: self.get_voucher_supply(&denom),
+                bank_supply: bank_module.supply_of(&denom),
+                counterparty_denom: self.create_ibc_denom(&port_id, channel_id, &trace_path),
+                trace_path,
+                denom,
+            };
+            if voucher.recorded_supply != voucher.bank_supply {
+                discrepancies.push(format!(
+                    "{} has a recorded supply of {} but a bank supply of {}",
+                    voucher.denom, voucher.recorded_supply, voucher.bank_supply
+                ));
+            }
+            vouchers.push(voucher);
+        }
+
+        let outstanding = escrows.iter().any(|escrow| escrow.escrowed > 0)
+            || vouchers.iter().any(|voucher| voucher.recorded_supply > 0);
+        if channel.state == State::Closed && outstanding {
+            discrepancies.push("channel is closed with funds still outstanding".to_string());
+        }
+
+        Ok(BridgeReport {
+            port_id,
+            channel_id: channel_id.to_string(),
+            channel_state: format!("{:?}", channel.state),
+            counterparty_port_id: channel.counterparty.port_id,
+            counterparty_channel_id: channel.counterparty.channel_id,
+            escrows,
+            vouchers,
+            escrow_account_balance,
+            discrepancies,
+        })
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::modules::ibc::channel::{Height, Order, Packet};
+    use crate::modules::ibc::transfer::FungibleTokenPacketData;
+    use near_sdk::test_utils::VMContextBuilder;
+    use near_sdk::{testing_env, AccountId};
+
+    #[test]
+    fn test_counterparty_voucher_denom() {
+        // The ATOM voucher of channel-0 on Osmosis
+        assert_eq!(
+            counterparty_voucher_denom("transfer", "channel-0", "uatom"),
+            "ibc/27394FB092D2ECCD56123C74F36E4C1F926001CEADA9CA97EA622B25F41E5EB2"
+        );
+    }
+
+    #[test]
+    fn test_bridge_report_flags_discrepancies() {
+        testing_env!(VMContextBuilder::new().current_account_id("transfer.near".parse().unwrap()).build());
+        let mut transfer = TransferModule::new();
+        let mut channels = ChannelModule::new();
+        let mut bank = BankModule::new();
+        let alice: AccountId = "alice.near".parse().unwrap();
+        bank.mint(&alice, 1_000);
+
+        let channel_id = channels.chan_open_init(
+            "transfer".to_string(),
+            Order::Unordered,
+            vec!["connection-0".to_string()],
+            "transfer".to_string(),
+            "ics20-1".to_string(),
+        );
+        channels.chan_open_ack("transfer".to_string(), channel_id.clone(), "channel-7".to_string(), "ics20-1".to_string(), vec![1], 1)
+            .unwrap();
+
+        transfer.send_transfer(
+            &mut channels, &mut bank, "transfer".to_string(), channel_id.clone(), "unear".to_string(), 400,
+            alice.to_string(), "cosmos1receiver".to_string(), Height::new(0, 1_000), 0, None,
+        ).unwrap();
+        let data = FungibleTokenPacketData::new("uatom".to_string(), "50".to_string(), "cosmos1sender".to_string(), alice.to_string(), None);
+        let packet = Packet::new(1, "transfer".to_string(), "channel-7".to_string(), "transfer".to_string(), channel_id.clone(), data.to_bytes().unwrap(), Height::new(0, 1_000), 0);
+        transfer.receive_transfer(&channels, &mut bank, &packet).unwrap();
+
+        let report = transfer.bridge_report(&channels, &bank, &channel_id).unwrap();
+        assert!(report.is_healthy(), "{:?}", report.discrepancies);
+        assert_eq!(report.escrows[0].escrowed, 400);
+        assert_eq!(report.escrows[0].counterparty_denom, counterparty_voucher_denom("transfer", "channel-7", "unear"));
+        assert_eq!(report.vouchers[0].recorded_supply, 50);
+        assert_eq!(report.vouchers[0].counterparty_denom, "uatom");
+
+        // Escrowed tokens leave the escrow account behind the module's back
+        bank.transfer(&env::current_account_id(), &alice, 100);
+        let report = transfer.bridge_report(&channels, &bank, &channel_id).unwrap();
+        assert_eq!(report.discrepancies.len(), 1);
+
+        assert!(transfer.bridge_report(&channels, &bank, "channel-99").is_err());
+    }
+}
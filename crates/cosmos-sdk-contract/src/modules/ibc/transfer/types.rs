@@ -31,6 +31,12 @@ pub enum TransferError {
     DenomTraceNotFound,
     /// Invalid trace path format
     InvalidTracePath,
+    /// Memo carries a malformed hook instruction
+    InvalidMemo(String),
+    /// Memo hook action failed after the tokens were credited
+    HookFailed(String),
+    /// Refund address cannot receive refunds
+    InvalidRefundAddress(String),
 }
 
 /// Fungible Token Packet Data as defined by ICS-20
@@ -44,7 +50,8 @@ pub struct FungibleTokenPacketData {
     pub sender: String,
     /// Receiver address on the destination chain
     pub receiver: String,
-    /// Optional memo field for additional data
+    /// Optional memo field for additional data; may carry a memo hook
+    #[serde(default)]
     pub memo: String,
 }
 
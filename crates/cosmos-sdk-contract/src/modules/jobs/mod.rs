@@ -0,0 +1,215 @@
+/// Resumable Jobs
+///
+/// Work over a whole collection, paying out matured unbondings or pruning
+/// expired records, can outgrow the gas of one call. A job runs a step
+/// function over a cursor until its work budget is spent, stores the cursor
+/// and picks up from it on the next call. When the step reports there is
+/// nothing left the pass is complete: a `job_completed` event is logged and
+/// the next run starts a new pass from the beginning.
+///
+/// The cursor is a plain position, its meaning is up to the step: an index
+/// into an `UnorderedMap`, a ledger id or a height. A step over an
+/// `UnorderedMap` that removes the current entry continues at the same
+/// index, since removal swaps the last entry into its place.
+
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::collections::UnorderedMap;
+use near_sdk::env;
+use near_sdk::serde::{Deserialize, Serialize};
+use schemars::JsonSchema;
+
+pub mod rekey;
+
+pub use rekey::{length_prefixed, rekeyed_get, rekeyed_insert, rekeyed_remove, RekeyJob, RekeyPhase, RekeyProgress};
+
+/// Steps a run takes when the caller does not say
+pub const DEFAULT_JOB_BUDGET: u32 = 50;
+/// Steps a single run may take at most
+pub const MAX_JOB_BUDGET: u32 = 500;
+
+/// Result of one step
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub enum JobStep {
+    /// Work done, continue at the cursor
+    Continue(u64),
+    /// Nothing left, the pass is complete
+    Done,
+}
+
+/// Persisted state of a job
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct JobState {
+    pub name: String,
+    pub cursor: u64,
+    /// Steps taken in the current pass
+    pub processed: u64,
+    /// Passes completed
+    pub completed_passes: u64,
+    /// Block timestamp the current pass started at, 0 when idle
+    pub started_at: u64,
+    pub last_completed_at: Option<u64>,
+}
+
+/// Outcome of a `JobRegistry::run` call
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct JobProgress {
+    pub name: String,
+    /// Steps taken by this call
+    pub steps: u32,
+    /// Cursor the next call continues at
+    pub cursor: u64,
+    /// Whether this call completed the pass
+    pub completed: bool,
+}
+
+impl JobState {
+    pub fn new(name: &str) -> Self {
+        Self {
+            name: name.to_string(),
+            cursor: 0,
+            processed: 0,
+            completed_passes: 0,
+            started_at: 0,
+            last_completed_at: None,
+        }
+    }
+
+    /// Run `step` from the cursor, at most `budget` times
+    ///
+    /// The caller stores the state afterwards with `JobRegistry::save`.
+    pub fn run(&mut self, budget: Option<u32>, mut step: impl FnMut(u64) -> JobStep) -> JobProgress {
+        let budget = budget.unwrap_or(DEFAULT_JOB_BUDGET).clamp(1, MAX_JOB_BUDGET);
+        if self.started_at == 0 {
+            self.started_at = env::block_timestamp();
+        }
+
+        let mut steps = 0;
+        let mut completed = false;
+        while steps < budget {
+            match step(self.cursor) {
+                JobStep::Continue(cursor) => {
+                    self.cursor = cursor;
+                    self.processed += 1;
+                    steps += 1;
+                }
+                JobStep::Done => {
+                    completed = true;
+                    break;
+                }
+            }
+        }
+
+        let cursor = self.cursor;
+        if completed {
+            env::log_str(&format!(
+                "EVENT: job_completed name={} processed={} pass={}",
+                self.name, self.processed, self.completed_passes + 1
+            ));
+            self.cursor = 0;
+            self.processed = 0;
+            self.completed_passes += 1;
+            self.started_at = 0;
+            self.last_completed_at = Some(env::block_timestamp());
+        } else {
+            env::log_str(&format!("EVENT: job_progress name={} steps={} cursor={}", self.name, steps, cursor));
+        }
+
+        JobProgress { name: self.name.clone(), steps, cursor, completed }
+    }
+}
+
+#[derive(BorshDeserialize, BorshSerialize)]
+pub struct JobRegistry {
+    jobs: UnorderedMap<String, JobState>,
+}
+
+impl JobRegistry {
+    pub fn new(prefix: &[u8]) -> Self {
+        Self {
+            jobs: UnorderedMap::new(prefix.to_vec()),
+        }
+    }
+
+    /// Run the job `name` and store its cursor
+    ///
+    /// When the step needs the module that owns the registry, `load` the
+    /// state, run it and `save` it instead.
+    pub fn run(&mut self, name: &str, budget: Option<u32>, step: impl FnMut(u64) -> JobStep) -> JobProgress {
+        let mut state = self.load(name);
+        let progress = state.run(budget, step);
+        self.save(&state);
+        progress
+    }
+
+    /// Stored state of `name`, or a fresh one
+    pub fn load(&self, name: &str) -> JobState {
+        self.get(name).unwrap_or_else(|| JobState::new(name))
+    }
+
+    pub fn save(&mut self, state: &JobState) {
+        self.jobs.insert(&state.name, state);
+    }
+
+    pub fn get(&self, name: &str) -> Option<JobState> {
+        self.jobs.get(&name.to_string())
+    }
+
+    pub fn all(&self) -> Vec<JobState> {
+        self.jobs.values().collect()
+    }
+
+    /// Drop the cursor of `name` so the next run starts a fresh pass
+    pub fn reset(&mut self, name: &str) {
+        if let Some(mut state) = self.get(name) {
+            state.cursor = 0;
+            state.processed = 0;
+            state.started_at = 0;
+            self.save(&state);
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use near_sdk::test_utils::VMContextBuilder;
+    use near_sdk::testing_env;
+
+    #[test]
+    fn test_job_resumes_and_completes() {
+        testing_env!(VMContextBuilder::new().block_timestamp(7).build());
+        let mut jobs = JobRegistry::new(b"jb");
+        let items: Vec<u64> = (1..=5).collect();
+        let mut seen = Vec::new();
+
+        let mut step = |cursor: u64| match items.get(cursor as usize) {
+            Some(item) => {
+                seen.push(*item);
+                JobStep::Continue(cursor + 1)
+            }
+            None => JobStep::Done,
+        };
+
+        let progress = jobs.run("sum", Some(3), &mut step);
+        assert_eq!(progress, JobProgress { name: "sum".to_string(), steps: 3, cursor: 3, completed: false });
+        assert_eq!(jobs.get("sum").unwrap().started_at, 7);
+
+        let progress = jobs.run("sum", Some(3), &mut step);
+        assert_eq!((progress.steps, progress.completed), (2, true));
+        assert_eq!(seen, vec![1, 2, 3, 4, 5]);
+
+        let state = jobs.get("sum").unwrap();
+        assert_eq!((state.cursor, state.completed_passes, state.last_completed_at), (0, 1, Some(7)));
+    }
+
+    #[test]
+    fn test_budget_is_capped() {
+        testing_env!(VMContextBuilder::new().build());
+        let mut jobs = JobRegistry::new(b"jb");
+        let progress = jobs.run("endless", Some(u32::MAX), |cursor| JobStep::Continue(cursor + 1));
+        assert_eq!(progress.steps, MAX_JOB_BUDGET);
+
+        jobs.reset("endless");
+        assert_eq!(jobs.get("endless").unwrap().cursor, 0);
+    }
+}
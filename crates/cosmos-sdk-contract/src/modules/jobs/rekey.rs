@@ -0,0 +1,294 @@
+/// Re-keying Migrations
+///
+/// Changing how a collection encodes its keys, say from `"owner#id"`
+/// strings to length-prefixed bytes, means moving every entry to a new
+/// storage key. A deployed contract cannot do that in one call once the
+/// collection is large, and it cannot stop serving the collection while it
+/// moves. `RekeyJob` moves an `UnorderedMap` to a new map in bounded
+/// batches, one call at a time, in three phases:
+///
+/// 1. Copy: each old entry is written under its new key, unless the new map
+///    already has a value there, which was written after the migration
+///    started and is newer.
+/// 2. Verify: every old key is looked up under its new key. Entries missed
+///    because a concurrent removal swapped them behind the cursor send the
+///    job back to copy; copying again is harmless.
+/// 3. Delete: once every entry is accounted for, the old map is emptied
+///    from its end, which never moves another entry.
+///
+/// While the job runs, the owner reads through `rekeyed_get`, which prefers
+/// the new map, and writes through `rekeyed_insert` and `rekeyed_remove`,
+/// which keep the two maps consistent.
+
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::collections::UnorderedMap;
+use near_sdk::env;
+use near_sdk::serde::{Deserialize, Serialize};
+use schemars::JsonSchema;
+
+use super::{JobState, JobStep, DEFAULT_JOB_BUDGET, MAX_JOB_BUDGET};
+
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Copy, Debug, PartialEq, JsonSchema)]
+pub enum RekeyPhase {
+    Copy,
+    Verify,
+    Delete,
+    Done,
+}
+
+/// Persisted state of one re-keying migration, stored by the module that
+/// owns the collection
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct RekeyJob {
+    pub job: JobState,
+    pub phase: RekeyPhase,
+    /// Entries written under their new key
+    pub copied: u64,
+    /// Entries whose new key already held a newer value
+    pub skipped: u64,
+    /// Old entries missing under their new key in the current verify pass
+    pub missing: u64,
+    /// Old entries deleted
+    pub removed: u64,
+    /// Times verification sent the job back to copy
+    pub restarts: u32,
+}
+
+/// Outcome of a `RekeyJob::run` call
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct RekeyProgress {
+    pub name: String,
+    pub phase: RekeyPhase,
+    /// Steps taken by this call, across phases
+    pub steps: u32,
+    /// Entries left in the old map
+    pub remaining: u64,
+}
+
+/// Borsh encoding of a sequence of byte strings: each part is prefixed by
+/// its length, so no separator can be confused with key content
+pub fn length_prefixed(parts: &[&[u8]]) -> Vec<u8> {
+    let mut key = Vec::with_capacity(parts.iter().map(|part| part.len() + 4).sum());
+    for part in parts {
+        key.extend_from_slice(&(part.len() as u32).to_le_bytes());
+        key.extend_from_slice(part);
+    }
+    key
+}
+
+impl RekeyJob {
+    pub fn new(name: &str) -> Self {
+        Self {
+            job: JobState::new(name),
+            phase: RekeyPhase::Copy,
+            copied: 0,
+            skipped: 0,
+            missing: 0,
+            removed: 0,
+            restarts: 0,
+        }
+    }
+
+    pub fn is_done(&self) -> bool {
+        self.phase == RekeyPhase::Done
+    }
+
+    /// Advance the migration from `old` to `new` by at most `budget` steps
+    pub fn run<K, V, NK>(
+        &mut self,
+        budget: Option<u32>,
+        old: &mut UnorderedMap<K, V>,
+        new: &mut UnorderedMap<NK, V>,
+        rekey: impl Fn(&K) -> NK,
+    ) -> RekeyProgress
+    where
+        K: BorshSerialize + BorshDeserialize,
+        V: BorshSerialize + BorshDeserialize,
+        NK: BorshSerialize + BorshDeserialize,
+    {
+        let budget = budget.unwrap_or(DEFAULT_JOB_BUDGET).clamp(1, MAX_JOB_BUDGET);
+        let mut steps = 0;
+        while steps < budget && !self.is_done() {
+            let left = Some(budget - steps);
+            let progress = match self.phase {
+                RekeyPhase::Copy => {
+                    let (copied, skipped) = (&mut self.copied, &mut self.skipped);
+                    self.job.run(left, |cursor| {
+                        let Some(key) = old.keys_as_vector().get(cursor) else { return JobStep::Done };
+                        let new_key = rekey(&key);
+                        if new.get(&new_key).is_some() {
+                            *skipped += 1;
+                        } else {
+                            new.insert(&new_key, &old.values_as_vector().get(cursor).expect("value of key"));
+                            *copied += 1;
+                        }
+                        JobStep::Continue(cursor + 1)
+                    })
+                }
+                RekeyPhase::Verify => {
+                    let missing = &mut self.missing;
+                    self.job.run(left, |cursor| {
+                        let Some(key) = old.keys_as_vector().get(cursor) else { return JobStep::Done };
+                        if new.get(&rekey(&key)).is_none() {
+                            *missing += 1;
+                        }
+                        JobStep::Continue(cursor + 1)
+                    })
+                }
+                RekeyPhase::Delete => {
+                    let removed = &mut self.removed;
+                    self.job.run(left, |cursor| {
+                        let keys = old.keys_as_vector();
+                        let Some(key) = keys.len().checked_sub(1).and_then(|last| keys.get(last)) else {
+                            return JobStep::Done;
+                        };
+                        // Verified entries are never lost, even if the new map changed since
+                        let value = old.remove(&key).expect("value of key");
+                        let new_key = rekey(&key);
+                        if new.get(&new_key).is_none() {
+                            new.insert(&new_key, &value);
+                        }
+                        *removed += 1;
+                        JobStep::Continue(cursor + 1)
+                    })
+                }
+                RekeyPhase::Done => unreachable!(),
+            };
+            // A step that finds nothing left is not counted, make sure the loop ends
+            steps += progress.steps.max(1);
+            if progress.completed {
+                self.finish_phase(old.len(), new.len());
+            }
+        }
+
+        RekeyProgress { name: self.job.name.clone(), phase: self.phase, steps, remaining: old.len() }
+    }
+
+    fn finish_phase(&mut self, old_len: u64, new_len: u64) {
+        let next = match self.phase {
+            RekeyPhase::Copy => RekeyPhase::Verify,
+            RekeyPhase::Verify if self.missing > 0 => {
+                env::log_str(&format!(
+                    "EVENT: rekey_verify_failed name={} missing={} old={} new={}",
+                    self.job.name, self.missing, old_len, new_len
+                ));
+                self.missing = 0;
+                self.restarts += 1;
+                RekeyPhase::Copy
+            }
+            RekeyPhase::Verify => RekeyPhase::Delete,
+            RekeyPhase::Delete | RekeyPhase::Done => RekeyPhase::Done,
+        };
+        env::log_str(&format!(
+            "EVENT: rekey_phase name={} phase={:?} copied={} skipped={} removed={} old={} new={}",
+            self.job.name, next, self.copied, self.skipped, self.removed, old_len, new_len
+        ));
+        self.phase = next;
+    }
+}
+
+/// Value of `key` while a migration may be in progress
+pub fn rekeyed_get<K, V, NK>(old: &UnorderedMap<K, V>, new: &UnorderedMap<NK, V>, key: &K, rekey: impl Fn(&K) -> NK) -> Option<V>
+where
+    K: BorshSerialize + BorshDeserialize,
+    V: BorshSerialize + BorshDeserialize,
+    NK: BorshSerialize + BorshDeserialize,
+{
+    new.get(&rekey(key)).or_else(|| old.get(key))
+}
+
+/// Write `value` under the new key and drop the old entry
+pub fn rekeyed_insert<K, V, NK>(old: &mut UnorderedMap<K, V>, new: &mut UnorderedMap<NK, V>, key: &K, value: &V, rekey: impl Fn(&K) -> NK)
+where
+    K: BorshSerialize + BorshDeserialize,
+    V: BorshSerialize + BorshDeserialize,
+    NK: BorshSerialize + BorshDeserialize,
+{
+    new.insert(&rekey(key), value);
+    old.remove(key);
+}
+
+/// Remove `key` from both maps, returning the current value
+pub fn rekeyed_remove<K, V, NK>(old: &mut UnorderedMap<K, V>, new: &mut UnorderedMap<NK, V>, key: &K, rekey: impl Fn(&K) -> NK) -> Option<V>
+where
+    K: BorshSerialize + BorshDeserialize,
+    V: BorshSerialize + BorshDeserialize,
+    NK: BorshSerialize + BorshDeserialize,
+{
+    let stale = old.remove(key);
+    new.remove(&rekey(key)).or(stale)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use near_sdk::test_utils::VMContextBuilder;
+    use near_sdk::testing_env;
+
+    /// `"owner#id"` to length-prefixed `owner`, `id`
+    fn rekey(key: &String) -> Vec<u8> {
+        let (owner, id) = key.split_once('#').unwrap();
+        length_prefixed(&[owner.as_bytes(), id.as_bytes()])
+    }
+
+    fn setup(entries: u64) -> (UnorderedMap<String, u64>, UnorderedMap<Vec<u8>, u64>) {
+        testing_env!(VMContextBuilder::new().build());
+        let mut old = UnorderedMap::new(b"o".to_vec());
+        for id in 0..entries {
+            old.insert(&format!("alice.near#{}", id), &id);
+        }
+        (old, UnorderedMap::new(b"n".to_vec()))
+    }
+
+    #[test]
+    fn test_migration_in_batches() {
+        let (mut old, mut new) = setup(7);
+        let mut job = RekeyJob::new("balances");
+
+        let progress = job.run(Some(3), &mut old, &mut new, rekey);
+        assert_eq!((progress.phase, progress.steps, progress.remaining), (RekeyPhase::Copy, 3, 7));
+        assert_eq!(rekeyed_get(&old, &new, &"alice.near#5".to_string(), rekey), Some(5));
+
+        let mut calls = 1;
+        while !job.is_done() {
+            job.run(Some(3), &mut old, &mut new, rekey);
+            calls += 1;
+        }
+        // 21 steps of copying, checking and deleting, then a call that finds nothing left
+        assert_eq!(calls, 8);
+        assert!(old.is_empty());
+        assert_eq!(new.len(), 7);
+        assert_eq!((job.copied, job.skipped, job.removed, job.restarts), (7, 0, 7, 0));
+        assert_eq!(new.get(&length_prefixed(&[b"alice.near", b"4"])), Some(4));
+    }
+
+    #[test]
+    fn test_live_writes_during_migration() {
+        let (mut old, mut new) = setup(7);
+        let mut job = RekeyJob::new("balances");
+        job.run(Some(3), &mut old, &mut new, rekey);
+
+        // Rewriting a copied entry swaps the uncopied last one behind the cursor
+        rekeyed_insert(&mut old, &mut new, &"alice.near#0".to_string(), &100, rekey);
+        // An entry not copied yet gets a newer value
+        rekeyed_insert(&mut old, &mut new, &"alice.near#4".to_string(), &400, rekey);
+        assert_eq!(rekeyed_remove(&mut old, &mut new, &"alice.near#1".to_string(), rekey), Some(1));
+
+        while !job.is_done() {
+            job.run(Some(3), &mut old, &mut new, rekey);
+        }
+        assert_eq!(job.restarts, 1);
+        assert!(old.is_empty());
+        assert_eq!(new.len(), 6);
+        assert_eq!(new.get(&rekey(&"alice.near#0".to_string())), Some(100));
+        assert_eq!(new.get(&rekey(&"alice.near#4".to_string())), Some(400));
+        assert_eq!(new.get(&rekey(&"alice.near#6".to_string())), Some(6));
+        assert_eq!(new.get(&rekey(&"alice.near#1".to_string())), None);
+    }
+
+    #[test]
+    fn test_length_prefixed_keys_are_unambiguous() {
+        assert_ne!(length_prefixed(&[b"a#b", b"c"]), length_prefixed(&[b"a", b"b#c"]));
+        assert_eq!(length_prefixed(&[b"ab"]), vec![2, 0, 0, 0, b'a', b'b']);
+    }
+}
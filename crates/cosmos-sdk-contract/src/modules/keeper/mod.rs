@@ -0,0 +1,242 @@
+/// Keeper Incentives
+///
+/// Nothing on NEAR calls the contract on its own, so block processing,
+/// pruning and packet timeouts rely on outside accounts ("keepers") to send
+/// the transactions. This module pays them a small reward from a keeper fund
+/// for each useful call, which keeps the chain running without a trusted
+/// cron job.
+///
+/// Spam is limited in three ways: a block-level task is only rewarded once
+/// per height, each keeper can claim a bounded number of rewards per window
+/// of blocks, and nothing is paid once the fund runs dry.
+
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::collections::LookupMap;
+use near_sdk::env;
+use near_sdk::serde::{Deserialize, Serialize};
+use schemars::JsonSchema;
+
+use crate::Balance;
+
+/// Task a keeper can be rewarded for
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Copy, Debug, PartialEq, JsonSchema)]
+pub enum KeeperAction {
+    /// Processing the next block
+    ProcessBlock,
+    /// Pruning old block data or expired state
+    Prune,
+    /// Timing out an expired IBC packet
+    PacketTimeout,
+    /// Closing an expired payment stream
+    StreamCleanup,
+}
+
+impl KeeperAction {
+    fn as_str(&self) -> &'static str {
+        match self {
+            KeeperAction::ProcessBlock => "process_block",
+            KeeperAction::Prune => "prune",
+            KeeperAction::PacketTimeout => "packet_timeout",
+            KeeperAction::StreamCleanup => "stream_cleanup",
+        }
+    }
+
+    /// Whether the task exists once per block rather than once per item
+    fn once_per_height(&self) -> bool {
+        !matches!(self, KeeperAction::PacketTimeout | KeeperAction::StreamCleanup)
+    }
+}
+
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct KeeperParams {
+    pub process_block_reward: Balance,
+    pub prune_reward: Balance,
+    pub packet_timeout_reward: Balance,
+    #[serde(default)]
+    pub stream_cleanup_reward: Balance,
+    /// Rewards a keeper can earn within one window
+    pub max_claims_per_window: u32,
+    /// Length of a rate limit window in blocks
+    pub window_blocks: u64,
+}
+
+impl Default for KeeperParams {
+    fn default() -> Self {
+        Self {
+            process_block_reward: 1_000,
+            prune_reward: 500,
+            packet_timeout_reward: 500,
+            stream_cleanup_reward: 500,
+            max_claims_per_window: 20,
+            window_blocks: 100,
+        }
+    }
+}
+
+#[derive(BorshDeserialize, BorshSerialize, Clone, Debug)]
+struct ClaimWindow {
+    start_height: u64,
+    count: u32,
+}
+
+#[derive(BorshDeserialize, BorshSerialize)]
+pub struct KeeperModule {
+    params: KeeperParams,
+    fund: Balance,
+    total_paid: Balance,
+    /// Last rewarded height of each once-per-block action
+    last_rewarded: LookupMap<String, u64>,
+    windows: LookupMap<String, ClaimWindow>,
+    /// Rewards earned but not yet withdrawn, by keeper
+    earned: LookupMap<String, Balance>,
+}
+
+impl KeeperModule {
+    pub fn new() -> Self {
+        Self {
+            params: KeeperParams::default(),
+            fund: 0,
+            total_paid: 0,
+            last_rewarded: LookupMap::new(b"keeper_last".to_vec()),
+            windows: LookupMap::new(b"keeper_windows".to_vec()),
+            earned: LookupMap::new(b"keeper_earned".to_vec()),
+        }
+    }
+
+    pub fn get_params(&self) -> KeeperParams {
+        self.params.clone()
+    }
+
+    pub fn set_params(&mut self, params: KeeperParams) -> Result<(), String> {
+        if params.window_blocks == 0 {
+            return Err("Keeper window must be at least one block".to_string());
+        }
+        self.params = params;
+        Ok(())
+    }
+
+    /// Add tokens to the keeper fund
+    pub fn fund(&mut self, amount: Balance) {
+        self.fund += amount;
+        env::log_str(&format!("Keeper: Fund increased by {} to {}", amount, self.fund));
+    }
+
+    pub fn fund_balance(&self) -> Balance {
+        self.fund
+    }
+
+    pub fn total_paid(&self) -> Balance {
+        self.total_paid
+    }
+
+    fn reward_for(&self, action: KeeperAction) -> Balance {
+        match action {
+            KeeperAction::ProcessBlock => self.params.process_block_reward,
+            KeeperAction::Prune => self.params.prune_reward,
+            KeeperAction::PacketTimeout => self.params.packet_timeout_reward,
+            KeeperAction::StreamCleanup => self.params.stream_cleanup_reward,
+        }
+    }
+
+    /// Reward a keeper for a call that did useful work at `height`
+    ///
+    /// Callers invoke this only after the work succeeded. Returns the amount
+    /// credited, 0 when the call is not eligible; the keeper's call itself
+    /// never fails because of the incentive.
+    pub fn reward(&mut self, keeper: &str, action: KeeperAction, height: u64) -> Balance {
+        let amount = self.reward_for(action);
+        if amount == 0 || self.fund < amount {
+            return 0;
+        }
+
+        if action.once_per_height() {
+            let last = self.last_rewarded.get(&action.as_str().to_string());
+            if last.map_or(false, |last| last >= height) {
+                return 0;
+            }
+        }
+
+        let mut window = self.windows.get(&keeper.to_string())
+            .filter(|window| height < window.start_height + self.params.window_blocks)
+            .unwrap_or(ClaimWindow { start_height: height, count: 0 });
+        if window.count >= self.params.max_claims_per_window {
+            return 0;
+        }
+        window.count += 1;
+        self.windows.insert(&keeper.to_string(), &window);
+
+        if action.once_per_height() {
+            self.last_rewarded.insert(&action.as_str().to_string(), &height);
+        }
+
+        self.fund -= amount;
+        self.total_paid += amount;
+        let earned = self.earned.get(&keeper.to_string()).unwrap_or(0);
+        self.earned.insert(&keeper.to_string(), &(earned + amount));
+
+        env::log_str(&format!(
+            "EVENT: keeper_reward keeper={} action={} height={} amount={}",
+            keeper, action.as_str(), height, amount
+        ));
+        amount
+    }
+
+    pub fn get_earned(&self, keeper: &str) -> Balance {
+        self.earned.get(&keeper.to_string()).unwrap_or(0)
+    }
+
+    /// Remove and return a keeper's earned rewards for payout
+    pub fn withdraw(&mut self, keeper: &str) -> Result<Balance, String> {
+        let earned = self.earned.remove(&keeper.to_string()).unwrap_or(0);
+        if earned == 0 {
+            return Err("No keeper rewards to withdraw".to_string());
+        }
+        env::log_str(&format!("Keeper: {} withdrew {}", keeper, earned));
+        Ok(earned)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_block_tasks_are_rewarded_once_per_height() {
+        let mut keeper = KeeperModule::new();
+        keeper.fund(10_000);
+
+        assert_eq!(keeper.reward("alice.near", KeeperAction::ProcessBlock, 5), 1_000);
+        assert_eq!(keeper.reward("bob.near", KeeperAction::ProcessBlock, 5), 0);
+        assert_eq!(keeper.reward("bob.near", KeeperAction::Prune, 5), 500);
+        assert_eq!(keeper.reward("bob.near", KeeperAction::ProcessBlock, 6), 1_000);
+
+        // Every timed out packet is separate work
+        assert_eq!(keeper.reward("carol.near", KeeperAction::PacketTimeout, 6), 500);
+        assert_eq!(keeper.reward("carol.near", KeeperAction::PacketTimeout, 6), 500);
+
+        assert_eq!(keeper.fund_balance(), 6_500);
+        assert_eq!(keeper.total_paid(), 3_500);
+        assert_eq!(keeper.withdraw("bob.near"), Ok(1_500));
+        assert!(keeper.withdraw("bob.near").is_err());
+    }
+
+    #[test]
+    fn test_rate_limit_and_empty_fund() {
+        let mut keeper = KeeperModule::new();
+        keeper.set_params(KeeperParams {
+            max_claims_per_window: 2,
+            window_blocks: 10,
+            ..KeeperParams::default()
+        }).unwrap();
+        keeper.fund(1_200);
+
+        assert_eq!(keeper.reward("alice.near", KeeperAction::PacketTimeout, 1), 500);
+        assert_eq!(keeper.reward("alice.near", KeeperAction::PacketTimeout, 2), 500);
+        assert_eq!(keeper.reward("alice.near", KeeperAction::PacketTimeout, 3), 0);
+
+        // A new window resets the limit, but the fund only covers part of a reward
+        assert_eq!(keeper.reward("alice.near", KeeperAction::PacketTimeout, 11), 0);
+        assert_eq!(keeper.get_earned("alice.near"), 1_000);
+        assert_eq!(keeper.fund_balance(), 200);
+    }
+}
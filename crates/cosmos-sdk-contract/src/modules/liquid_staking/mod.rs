@@ -0,0 +1,421 @@
+/// Liquid Staking Receipts
+///
+/// Optional module that tokenizes delegations. Staking through it bonds the
+/// tokens from the module's own account and mints the delegator receipts of
+/// `st<bond_denom>` as bank coins, so they are fungible across validators
+/// and move like any other denom: held by wasm contracts, sent, or bridged
+/// out as a NEP-141 token while the stake keeps earning.
+///
+/// Receipts are a share of everything the module stakes. They are minted
+/// and redeemed at `total_stake / receipt supply`, where the total stake is
+/// what the module's delegations are worth now, so a slash lowers every
+/// receipt's value and restaked rewards raise it. Rewards the module
+/// account earns are harvested before each stake and redemption: those paid
+/// in the bond denom are delegated again, those in another denom are held
+/// and paid out pro rata to the receipts redeemed.
+///
+/// Redeeming burns receipts and starts unbonding what they are worth; the
+/// tokens are paid to the redeemer once the unbonding completes.
+
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::collections::{UnorderedMap, UnorderedSet};
+use near_sdk::serde::{Deserialize, Serialize};
+use near_sdk::{env, AccountId};
+use schemars::JsonSchema;
+
+use crate::math::mul_div_floor;
+use crate::modules::bank::{BankModule, NATIVE_DENOM};
+use crate::modules::staking::StakingModule;
+use crate::Balance;
+
+pub const RECEIPT_DENOM_PREFIX: &str = "st";
+
+/// Account that owns the module's delegations
+pub fn liquid_staking_account() -> AccountId {
+    format!("liquid_staking.{}", env::current_account_id())
+        .parse()
+        .expect("Liquid staking account is valid")
+}
+
+/// Redemption waiting for its unbonding to complete
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct Redemption {
+    pub id: u64,
+    pub owner: String,
+    pub validator_address: String,
+    pub amount: Balance,
+    pub completion_time: u64,
+}
+
+#[derive(BorshDeserialize, BorshSerialize)]
+pub struct LiquidStakingModule {
+    /// Validators the module account has delegated to
+    validators: UnorderedSet<String>,
+    /// Harvested bond denom rewards still waiting to be delegated
+    pending_restake: Balance,
+    /// Denom the mint module pays staking rewards in
+    reward_denom: String,
+    /// Harvested rewards in a denom other than the bond denom
+    held_rewards: Balance,
+    redemptions: UnorderedMap<u64, Redemption>,
+    next_redemption_id: u64,
+}
+
+impl LiquidStakingModule {
+    pub fn new() -> Self {
+        Self {
+            validators: UnorderedSet::new(b"lsm_validators".to_vec()),
+            pending_restake: 0,
+            reward_denom: NATIVE_DENOM.to_string(),
+            held_rewards: 0,
+            redemptions: UnorderedMap::new(b"lsm_redemptions".to_vec()),
+            next_redemption_id: 1,
+        }
+    }
+
+    pub fn receipt_denom(staking: &StakingModule) -> String {
+        format!("{}{}", RECEIPT_DENOM_PREFIX, staking.bond_denom())
+    }
+
+    /// Follow the mint module's `mint_denom`
+    pub fn set_reward_denom(&mut self, denom: String) {
+        self.reward_denom = denom;
+    }
+
+    /// Delegate `amount` of the delegator's tokens and mint receipts for it
+    ///
+    /// Returns the receipts minted.
+    pub fn liquid_stake(
+        &mut self,
+        staking: &mut StakingModule,
+        bank: &mut BankModule,
+        delegator: &AccountId,
+        validator_address: String,
+        amount: Balance,
+    ) -> Result<Balance, String> {
+        if amount == 0 {
+            return Err("Amount must be positive".to_string());
+        }
+        let bond_denom = staking.bond_denom();
+        if bank.get_spendable_balance(delegator, &bond_denom) < amount {
+            return Err(format!("{} has insufficient spendable balance to stake {}{}", delegator, amount, bond_denom));
+        }
+
+        self.harvest_rewards(staking, bank);
+        let receipt_denom = Self::receipt_denom(staking);
+        let total_stake = self.total_stake(staking);
+        let supply = bank.supply_of(&receipt_denom);
+        let receipts = if supply == 0 || total_stake == 0 {
+            amount
+        } else {
+            mul_div_floor(amount, supply, total_stake, "Receipts")
+        };
+        if receipts == 0 {
+            return Err(format!("Staking {} is worth no receipts", amount));
+        }
+
+        let module_account = liquid_staking_account();
+        bank.transfer_denom_with_reason(delegator, &module_account, &bond_denom, amount, "liquid_staking", "liquid_stake");
+        if let Err(error) = staking.delegate_from_bank(bank, &module_account, validator_address.clone(), amount) {
+            bank.transfer_denom_with_reason(&module_account, delegator, &bond_denom, amount, "liquid_staking", "refund");
+            return Err(error);
+        }
+
+        self.validators.insert(&validator_address);
+        bank.mint_with_reason(delegator, &receipt_denom, receipts, "liquid_staking", "liquid_stake");
+
+        env::log_str(&format!(
+            "EVENT: liquid_stake delegator={} validator={} amount={} receipts={}{}",
+            delegator, validator_address, amount, receipts, receipt_denom
+        ));
+        Ok(receipts)
+    }
+
+    /// Burn `receipts` and start unbonding what they are worth from a validator
+    ///
+    /// Returns the redemption id to claim after the unbonding period.
+    pub fn redeem(
+        &mut self,
+        staking: &mut StakingModule,
+        bank: &mut BankModule,
+        holder: &AccountId,
+        validator_address: String,
+        receipts: Balance,
+    ) -> Result<u64, String> {
+        let receipt_denom = Self::receipt_denom(staking);
+        if receipts == 0 || bank.get_spendable_balance(holder, &receipt_denom) < receipts {
+            return Err(format!("{} holds fewer than {} receipts", holder, receipts));
+        }
+
+        self.harvest_rewards(staking, bank);
+        let supply = bank.supply_of(&receipt_denom);
+        let amount = mul_div_floor(receipts, self.total_stake(staking), supply, "Redeemed stake");
+        let staked = self.staked_with(staking, &validator_address);
+        if amount == 0 || amount > staked {
+            return Err(format!("Only {} is staked with {} through receipts, {} receipts are worth {}", staked, validator_address, receipts, amount));
+        }
+        let rewards = mul_div_floor(self.held_rewards, receipts, supply, "Redeemed rewards");
+
+        let module_account = liquid_staking_account();
+        let completion_time = staking.undelegate_to_bank(bank, &module_account, validator_address.clone(), amount)?;
+        bank.burn_with_reason(holder, &receipt_denom, receipts, "liquid_staking", "redeem");
+        if amount == staked {
+            self.validators.remove(&validator_address);
+        }
+        if rewards > 0 {
+            self.held_rewards -= rewards;
+            let reward_denom = self.reward_denom.clone();
+            bank.transfer_denom_with_reason(&module_account, holder, &reward_denom, rewards, "liquid_staking", "rewards");
+        }
+
+        let id = self.next_redemption_id;
+        self.next_redemption_id += 1;
+        self.redemptions.insert(&id, &Redemption {
+            id,
+            owner: holder.to_string(),
+            validator_address: validator_address.clone(),
+            amount,
+            completion_time,
+        });
+        env::log_str(&format!(
+            "EVENT: liquid_redeem id={} holder={} validator={} receipts={} amount={} rewards={}",
+            id, holder, validator_address, receipts, amount, rewards
+        ));
+        Ok(id)
+    }
+
+    /// Withdraw the module account's staking rewards and pass them on to
+    /// receipt holders
+    ///
+    /// Rewards in the bond denom are delegated again, raising the value of
+    /// every receipt; a part below the minimum delegation waits for the next
+    /// harvest. Rewards in another denom are held for redeemers. Returns the
+    /// rewards withdrawn.
+    pub fn harvest_rewards(&mut self, staking: &mut StakingModule, bank: &mut BankModule) -> Balance {
+        let module_account = liquid_staking_account();
+        let bond_denom = staking.bond_denom();
+        let reward_denom = self.reward_denom.clone();
+        let validators = self.validators.to_vec();
+
+        let mut harvested = 0;
+        for validator_address in &validators {
+            let reward = staking.withdraw_delegator_reward(module_account.to_string(), validator_address.clone()).unwrap_or(0);
+            if reward == 0 {
+                continue;
+            }
+            // The mint module holds staking rewards until they are withdrawn
+            bank.transfer_denom_with_reason(&env::current_account_id(), &module_account, &reward_denom, reward, "liquid_staking", "rewards");
+            harvested += reward;
+        }
+
+        if reward_denom != bond_denom {
+            self.held_rewards += harvested;
+        } else {
+            self.pending_restake += harvested;
+            let restake = self.pending_restake;
+            let restaked = validators.iter().any(|validator_address| {
+                staking.delegate_from_bank(bank, &module_account, validator_address.clone(), restake).is_ok()
+            });
+            if restaked {
+                self.pending_restake = 0;
+            }
+        }
+
+        if harvested > 0 {
+            env::log_str(&format!(
+                "EVENT: liquid_harvest rewards={}{} pending_restake={} held_rewards={}",
+                harvested, reward_denom, self.pending_restake, self.held_rewards
+            ));
+        }
+        harvested
+    }
+
+    /// Complete matured unbondings and pay the redeemers
+    pub fn claim_redemptions(&mut self, staking: &mut StakingModule, bank: &mut BankModule, now: u64) -> Vec<Redemption> {
+        staking.complete_unbonding(bank, now);
+
+        let module_account = liquid_staking_account();
+        let bond_denom = staking.bond_denom();
+        let matured: Vec<Redemption> = self.redemptions.values()
+            .filter(|redemption| redemption.completion_time <= now)
+            .collect();
+        let mut paid = Vec::new();
+        for redemption in matured {
+            let owner: AccountId = match redemption.owner.parse() {
+                Ok(owner) => owner,
+                Err(_) => continue,
+            };
+            // Rewards waiting to be restaked back receipts, not redemptions
+            let available = bank.get_spendable_balance(&module_account, &bond_denom).saturating_sub(self.pending_restake);
+            if available < redemption.amount {
+                break;
+            }
+            bank.transfer_denom_with_reason(&module_account, &owner, &bond_denom, redemption.amount, "liquid_staking", "redemption");
+            self.redemptions.remove(&redemption.id);
+            paid.push(redemption);
+        }
+        paid
+    }
+
+    pub fn receipt_balance(&self, staking: &StakingModule, bank: &BankModule, account: &AccountId) -> Balance {
+        bank.get_denom_balance(account, &Self::receipt_denom(staking))
+    }
+
+    pub fn total_receipts(&self, staking: &StakingModule, bank: &BankModule) -> Balance {
+        bank.supply_of(&Self::receipt_denom(staking))
+    }
+
+    /// Stake backing all receipts: what the module's delegations are worth
+    /// now plus harvested rewards not yet delegated again
+    pub fn total_stake(&self, staking: &StakingModule) -> Balance {
+        self.validators.iter()
+            .map(|validator_address| self.staked_with(staking, &validator_address))
+            .sum::<Balance>()
+            + self.pending_restake
+    }
+
+    /// What the module's delegation to a validator is worth
+    pub fn staked_with(&self, staking: &StakingModule, validator_address: &str) -> Balance {
+        staking.get_delegation(liquid_staking_account().to_string(), validator_address.to_string())
+            .map(|delegation| staking.delegation_tokens(&delegation))
+            .unwrap_or(0)
+    }
+
+    pub fn get_redemptions(&self, owner: &AccountId) -> Vec<Redemption> {
+        self.redemptions.values()
+            .filter(|redemption| redemption.owner == owner.as_str())
+            .collect()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::modules::staking::bonded_pool_account;
+    use near_sdk::test_utils::VMContextBuilder;
+    use near_sdk::testing_env;
+
+    fn account(name: &str) -> AccountId {
+        name.parse().unwrap()
+    }
+
+    fn setup() -> (LiquidStakingModule, StakingModule, BankModule) {
+        let mut staking = StakingModule::new();
+        staking.create_validator(
+            "validator1".to_string(),
+            vec![1; 32],
+            "Validator One".to_string(),
+            None,
+            None,
+            None,
+            None,
+            "0.1".to_string(),
+            "0.2".to_string(),
+            "0.01".to_string(),
+            1,
+            1000,
+        ).unwrap();
+        let mut bank = BankModule::new();
+        bank.mint_denom(&bonded_pool_account(), "stake", 1000);
+        bank.mint_denom(&account("alice.near"), "stake", 500);
+        (LiquidStakingModule::new(), staking, bank)
+    }
+
+    #[test]
+    fn test_receipts_track_bonded_stake() {
+        testing_env!(VMContextBuilder::new().block_timestamp(0).build());
+        let (mut lsm, mut staking, mut bank) = setup();
+        let alice = account("alice.near");
+        let bob = account("bob.near");
+
+        assert_eq!(LiquidStakingModule::receipt_denom(&staking), "ststake");
+        lsm.liquid_stake(&mut staking, &mut bank, &alice, "validator1".to_string(), 400).unwrap();
+        assert!(lsm.liquid_stake(&mut staking, &mut bank, &alice, "validator2".to_string(), 50).is_err());
+        assert_eq!(bank.get_denom_balance(&alice, "stake"), 100);
+        assert_eq!(lsm.receipt_balance(&staking, &bank, &alice), 400);
+        assert_eq!(lsm.total_stake(&staking), lsm.total_receipts(&staking, &bank));
+
+        // Receipts are bank coins and move like any other denom
+        bank.transfer_denom_with_reason(&alice, &bob, "ststake", 250, "bank", "send");
+
+        let id = lsm.redeem(&mut staking, &mut bank, &bob, "validator1".to_string(), 250).unwrap();
+        assert_eq!(lsm.receipt_balance(&staking, &bank, &bob), 0);
+        assert_eq!(lsm.total_receipts(&staking, &bank), 150);
+        assert_eq!(lsm.total_stake(&staking), 150);
+        staking.check_pool_invariant(&bank).unwrap();
+
+        let completion_time = lsm.get_redemptions(&bob)[0].completion_time;
+        assert!(lsm.claim_redemptions(&mut staking, &mut bank, completion_time - 1).is_empty());
+        let paid = lsm.claim_redemptions(&mut staking, &mut bank, completion_time);
+        assert_eq!(paid.len(), 1);
+        assert_eq!(paid[0].id, id);
+        assert_eq!(bank.get_denom_balance(&bob, "stake"), 250);
+        assert!(lsm.get_redemptions(&bob).is_empty());
+    }
+
+    #[test]
+    fn test_redeem_limited_to_module_stake() {
+        let (mut lsm, mut staking, mut bank) = setup();
+        let alice = account("alice.near");
+        lsm.liquid_stake(&mut staking, &mut bank, &alice, "validator1".to_string(), 100).unwrap();
+
+        assert!(lsm.redeem(&mut staking, &mut bank, &alice, "validator1".to_string(), 101).is_err());
+        assert!(lsm.redeem(&mut staking, &mut bank, &account("bob.near"), "validator1".to_string(), 10).is_err());
+    }
+
+    #[test]
+    fn test_slash_lowers_the_redemption_rate() {
+        testing_env!(VMContextBuilder::new().block_timestamp(0).build());
+        let (mut lsm, mut staking, mut bank) = setup();
+        let alice = account("alice.near");
+        bank.mint_denom(&account("bob.near"), "stake", 300);
+        lsm.liquid_stake(&mut staking, &mut bank, &alice, "validator1".to_string(), 400).unwrap();
+
+        // Half of the module's 400 is slashed away
+        staking.slash_validator_from_bank(&mut bank, "validator1".to_string(), 1, 0, "0.5".to_string()).unwrap();
+        staking.unjail_validator("validator1".to_string()).unwrap();
+        assert_eq!(lsm.total_stake(&staking), 200);
+
+        // Bob's 300 buys 600 receipts at the post-slash rate
+        let minted = lsm.liquid_stake(&mut staking, &mut bank, &account("bob.near"), "validator1".to_string(), 300).unwrap();
+        assert_eq!(minted, 600);
+
+        lsm.redeem(&mut staking, &mut bank, &alice, "validator1".to_string(), 400).unwrap();
+        assert_eq!(lsm.get_redemptions(&alice)[0].amount, 200);
+        assert_eq!(lsm.total_stake(&staking), 300);
+    }
+
+    #[test]
+    fn test_rewards_pass_to_receipt_holders() {
+        testing_env!(VMContextBuilder::new().block_timestamp(0).build());
+        let (mut lsm, mut staking, mut bank) = setup();
+        let alice = account("alice.near");
+        lsm.set_reward_denom("stake".to_string());
+        lsm.liquid_stake(&mut staking, &mut bank, &alice, "validator1".to_string(), 500).unwrap();
+
+        // The module holds a third of the validator, its 100 reward is restaked
+        staking.allocate_rewards("validator1".to_string(), 300).unwrap();
+        bank.mint_denom(&env::current_account_id(), "stake", 300);
+        assert_eq!(lsm.harvest_rewards(&mut staking, &mut bank), 100);
+        assert_eq!(lsm.total_stake(&staking), 600);
+
+        lsm.redeem(&mut staking, &mut bank, &alice, "validator1".to_string(), 250).unwrap();
+        assert_eq!(lsm.get_redemptions(&alice)[0].amount, 300);
+    }
+
+    #[test]
+    fn test_rewards_in_other_denoms_go_to_redeemers() {
+        testing_env!(VMContextBuilder::new().block_timestamp(0).build());
+        let (mut lsm, mut staking, mut bank) = setup();
+        let alice = account("alice.near");
+        lsm.liquid_stake(&mut staking, &mut bank, &alice, "validator1".to_string(), 500).unwrap();
+
+        // A third of the 300 is the module's, a fifth of that goes with 100 of 500 receipts
+        staking.allocate_rewards("validator1".to_string(), 300).unwrap();
+        bank.mint_denom(&env::current_account_id(), "unear", 300);
+
+        lsm.redeem(&mut staking, &mut bank, &alice, "validator1".to_string(), 100).unwrap();
+        assert_eq!(bank.get_denom_balance(&alice, "unear"), 20);
+        assert_eq!(lsm.total_stake(&staking), 400);
+    }
+}
@@ -0,0 +1,65 @@
+/// Expected Keepers
+///
+/// The mint module reads supply and bonded stake and writes new tokens and
+/// rewards. Each dependency is one of the traits below rather than a
+/// concrete module.
+
+use near_sdk::AccountId;
+
+use super::InflationDistribution;
+use crate::modules::bank::BankModule;
+use crate::modules::gov::GovernanceModule;
+use crate::modules::staking::{StakingModule, Validator};
+use crate::Balance;
+
+/// Bank functions the mint module uses
+pub trait BankKeeper {
+    fn supply_of(&self, denom: &str) -> Balance;
+
+    fn mint_with_reason(&mut self, receiver: &AccountId, denom: &str, amount: Balance, module: &str, reason: &str);
+}
+
+/// Staking functions the mint module uses
+pub trait StakingKeeper {
+    fn get_validator(&self, validator_address: String) -> Option<Validator>;
+
+    fn get_bonded_validators(&self) -> Vec<Validator>;
+
+    /// Credit `amount` of rewards to a validator and its delegators
+    fn allocate_rewards(&mut self, validator_address: String, amount: Balance) -> Result<Balance, String>;
+}
+
+/// Governance parameters the mint module reads
+pub trait GovKeeper {
+    fn inflation_distribution(&self) -> InflationDistribution;
+}
+
+impl BankKeeper for BankModule {
+    fn supply_of(&self, denom: &str) -> Balance {
+        BankModule::supply_of(self, denom)
+    }
+
+    fn mint_with_reason(&mut self, receiver: &AccountId, denom: &str, amount: Balance, module: &str, reason: &str) {
+        BankModule::mint_with_reason(self, receiver, denom, amount, module, reason)
+    }
+}
+
+impl StakingKeeper for StakingModule {
+    fn get_validator(&self, validator_address: String) -> Option<Validator> {
+        StakingModule::get_validator(self, validator_address)
+    }
+
+    fn get_bonded_validators(&self) -> Vec<Validator> {
+        StakingModule::get_bonded_validators(self)
+    }
+
+    fn allocate_rewards(&mut self, validator_address: String, amount: Balance) -> Result<Balance, String> {
+        StakingModule::allocate_rewards(self, validator_address, amount)
+    }
+}
+
+impl GovKeeper for GovernanceModule {
+    fn inflation_distribution(&self) -> InflationDistribution {
+        GovernanceModule::inflation_distribution(self)
+    }
+}
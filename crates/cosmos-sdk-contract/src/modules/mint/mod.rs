@@ -0,0 +1,430 @@
+/// Mint Module
+///
+/// Mints a block provision of the native token every block from an annual
+/// inflation rate, as the Cosmos SDK mint module does in its begin blocker.
+/// Governance decides where the provision goes through the
+/// `inflation_distribution` parameter: a share for staking rewards,
+/// allocated to bonded validators by voting power, a share for the community
+/// pool and a share for a developer fund account.
+
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::serde::{Deserialize, Serialize};
+use near_sdk::{env, AccountId};
+use schemars::JsonSchema;
+
+use crate::math::mul_div_floor;
+use crate::modules::bank::metadata::parse_decimal;
+use crate::modules::bank::NATIVE_DENOM;
+use crate::modules::sweep::community_pool_account;
+use crate::Balance;
+
+pub mod expected_keepers;
+
+pub use expected_keepers::{BankKeeper, GovKeeper, StakingKeeper};
+
+/// Governance parameter holding the JSON encoded distribution weights
+pub const INFLATION_DISTRIBUTION_PARAM: &str = "inflation_distribution";
+
+/// Weights are expressed in basis points of the provision
+pub const BPS_DENOMINATOR: u64 = 10_000;
+
+/// Default annual inflation, 7%
+pub const DEFAULT_INFLATION_BPS: u64 = 700;
+
+/// NEAR produces roughly one block per second
+pub const DEFAULT_BLOCKS_PER_YEAR: u64 = 31_536_000;
+
+/// Split of each block provision, in basis points summing to 10000
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct InflationDistribution {
+    pub staking_rewards_bps: u64,
+    pub community_pool_bps: u64,
+    pub developer_fund_bps: u64,
+    /// Receives the developer share, required when that share is positive
+    #[serde(default)]
+    pub developer_fund: Option<String>,
+}
+
+impl Default for InflationDistribution {
+    fn default() -> Self {
+        Self {
+            staking_rewards_bps: 8_000,
+            community_pool_bps: 2_000,
+            developer_fund_bps: 0,
+            developer_fund: None,
+        }
+    }
+}
+
+impl InflationDistribution {
+    pub fn from_json(json: &str) -> Result<Self, String> {
+        serde_json::from_str(json).map_err(|e| format!("Invalid inflation distribution: {}", e))
+    }
+
+    pub fn to_json(&self) -> String {
+        serde_json::to_string(self).expect("Inflation distribution serializes")
+    }
+
+    pub fn validate(&self) -> Result<(), String> {
+        let total = self.staking_rewards_bps
+            .checked_add(self.community_pool_bps)
+            .and_then(|total| total.checked_add(self.developer_fund_bps));
+        if total != Some(BPS_DENOMINATOR) {
+            return Err(format!("Inflation distribution weights must sum to {}", BPS_DENOMINATOR));
+        }
+        if self.developer_fund_bps > 0 {
+            self.developer_fund_account()
+                .ok_or_else(|| "Inflation distribution needs a valid developer_fund account".to_string())?;
+        }
+        Ok(())
+    }
+
+    fn developer_fund_account(&self) -> Option<AccountId> {
+        self.developer_fund.as_ref().and_then(|account| account.parse().ok())
+    }
+}
+
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct MintParams {
+    pub mint_denom: String,
+    /// Annual inflation in basis points of the current supply
+    pub inflation_bps: u64,
+    pub blocks_per_year: u64,
+}
+
+/// Tokens minted in one block and where they went
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct BlockProvision {
+    pub height: u64,
+    pub minted: Balance,
+    /// Allocated to bonded validators and their delegators
+    pub staking_rewards: Balance,
+    /// Includes staking rewards no validator could take
+    pub community_pool: Balance,
+    pub developer_fund: Balance,
+}
+
+/// Expected yield of delegating to a validator at current parameters
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct AprEstimate {
+    pub validator_address: String,
+    pub annual_provisions: Balance,
+    /// Share of the supply that is bonded, in basis points
+    pub bonded_ratio_bps: u64,
+    pub commission_bps: u64,
+    /// Yield before commission, in basis points
+    pub gross_apr_bps: u64,
+    /// Yield to delegators after commission, in basis points
+    pub apr_bps: u64,
+    /// `apr_bps` with rewards restaked daily
+    pub apy_bps: u64,
+}
+
+#[derive(BorshDeserialize, BorshSerialize)]
+pub struct MintModule {
+    params: MintParams,
+    last_minted_height: u64,
+    total_minted: Balance,
+}
+
+impl MintModule {
+    pub fn new() -> Self {
+        Self {
+            params: MintParams {
+                mint_denom: NATIVE_DENOM.to_string(),
+                inflation_bps: DEFAULT_INFLATION_BPS,
+                blocks_per_year: DEFAULT_BLOCKS_PER_YEAR,
+            },
+            last_minted_height: 0,
+            total_minted: 0,
+        }
+    }
+
+    pub fn get_params(&self) -> MintParams {
+        self.params.clone()
+    }
+
+    pub fn set_params(&mut self, params: MintParams) -> Result<(), String> {
+        if params.blocks_per_year == 0 {
+            return Err("blocks_per_year must be positive".to_string());
+        }
+        if params.mint_denom.is_empty() {
+            return Err("mint_denom cannot be empty".to_string());
+        }
+        self.params = params;
+        Ok(())
+    }
+
+    /// Tokens minted per block for the given supply
+    pub fn block_provision(&self, supply: Balance) -> Balance {
+        supply
+            .saturating_mul(self.params.inflation_bps as Balance)
+            / BPS_DENOMINATOR as Balance
+            / self.params.blocks_per_year as Balance
+    }
+
+    pub fn total_minted(&self) -> Balance {
+        self.total_minted
+    }
+
+    /// Tokens minted over a year at the current supply and inflation
+    pub fn annual_provisions(&self, bank: &dyn BankKeeper) -> Balance {
+        bank.supply_of(&self.params.mint_denom)
+            .saturating_mul(self.params.inflation_bps as Balance)
+            / BPS_DENOMINATOR as Balance
+    }
+
+    /// Estimate the yield of delegating to `validator_address`
+    ///
+    /// Staking rewards are allocated by voting power, so every bonded
+    /// validator earns the same gross rate; commission makes the difference
+    /// for delegators. Slashing and changes to supply or bonded stake over
+    /// the year are not accounted for.
+    pub fn estimated_apr(
+        &self,
+        validator_address: &str,
+        gov: &dyn GovKeeper,
+        bank: &dyn BankKeeper,
+        staking: &dyn StakingKeeper,
+    ) -> Result<AprEstimate, String> {
+        let validator = staking.get_validator(validator_address.to_string())
+            .ok_or_else(|| format!("Validator {} not found", validator_address))?;
+        if validator.jailed || !staking.get_bonded_validators().iter().any(|bonded| bonded.address == validator.address) {
+            return Err(format!("Validator {} is not bonded and earns no rewards", validator_address));
+        }
+        let commission_bps = parse_decimal(&validator.commission.commission_rates.rate, 4)
+            .map_err(|e| format!("Invalid commission rate: {}", e))? as u64;
+
+        let bonded: Balance = staking.get_bonded_validators()
+            .iter()
+            .filter(|validator| !validator.jailed)
+            .map(|validator| validator.tokens)
+            .sum();
+        let supply = bank.supply_of(&self.params.mint_denom);
+        let annual_provisions = self.annual_provisions(bank);
+        let staking_rewards = annual_provisions * gov.inflation_distribution().staking_rewards_bps as Balance
+            / BPS_DENOMINATOR as Balance;
+
+        let ratio = |amount: Balance, total: Balance| -> u64 {
+            if total == 0 { 0 } else { (amount.saturating_mul(BPS_DENOMINATOR as Balance) / total) as u64 }
+        };
+        let gross_apr_bps = ratio(staking_rewards, bonded);
+        let apr_bps = gross_apr_bps * BPS_DENOMINATOR.saturating_sub(commission_bps) / BPS_DENOMINATOR;
+        let daily = apr_bps as f64 / BPS_DENOMINATOR as f64 / 365.0;
+        let apy_bps = (((1.0 + daily).powi(365) - 1.0) * BPS_DENOMINATOR as f64).round() as u64;
+
+        Ok(AprEstimate {
+            validator_address: validator.address,
+            annual_provisions,
+            bonded_ratio_bps: ratio(bonded, supply),
+            commission_bps,
+            gross_apr_bps,
+            apr_bps,
+            apy_bps,
+        })
+    }
+
+    /// Mint the provision of `height` and split it by the governance weights
+    pub fn begin_block(
+        &mut self,
+        height: u64,
+        gov: &dyn GovKeeper,
+        bank: &mut dyn BankKeeper,
+        staking: &mut dyn StakingKeeper,
+    ) -> Result<BlockProvision, String> {
+        if height <= self.last_minted_height {
+            return Err(format!("Provision for height {} was already minted", height));
+        }
+        self.last_minted_height = height;
+
+        let distribution = gov.inflation_distribution();
+        let minted = self.block_provision(bank.supply_of(&self.params.mint_denom));
+        let share = |bps: u64| minted * bps as Balance / BPS_DENOMINATOR as Balance;
+        let staking_share = share(distribution.staking_rewards_bps);
+        let developer_fund = share(distribution.developer_fund_bps);
+
+        let staking_rewards = Self::allocate_staking_rewards(staking, staking_share);
+        let community_pool = minted - staking_rewards - developer_fund;
+
+        let denom = self.params.mint_denom.clone();
+        if staking_rewards > 0 {
+            // Held by this contract until delegators withdraw
+            bank.mint_with_reason(&env::current_account_id(), &denom, staking_rewards, "mint", "staking_rewards");
+        }
+        if community_pool > 0 {
+            bank.mint_with_reason(&community_pool_account(), &denom, community_pool, "mint", "community_pool");
+        }
+        if let Some(account) = distribution.developer_fund_account().filter(|_| developer_fund > 0) {
+            bank.mint_with_reason(&account, &denom, developer_fund, "mint", "developer_fund");
+        }
+        self.total_minted += minted;
+
+        env::log_str(&format!(
+            "EVENT: mint height={} amount={} staking_rewards={} community_pool={} developer_fund={}",
+            height, minted, staking_rewards, community_pool, developer_fund
+        ));
+        Ok(BlockProvision { height, minted, staking_rewards, community_pool, developer_fund })
+    }
+
+    /// Allocate `amount` to bonded validators by voting power
+    ///
+    /// Returns what was allocated; rounding dust and the whole amount when
+    /// no validator is bonded are left over.
+    fn allocate_staking_rewards(staking: &mut dyn StakingKeeper, amount: Balance) -> Balance {
+        let validators: Vec<_> = staking.get_bonded_validators()
+            .into_iter()
+            .filter(|validator| !validator.jailed && validator.tokens > 0)
+            .collect();
+        let total_power: Balance = validators.iter().map(|validator| validator.tokens).sum();
+        if amount == 0 || total_power == 0 {
+            return 0;
+        }
+
+        let mut allocated = 0;
+        for validator in validators {
+            let reward = mul_div_floor(amount, validator.tokens, total_power, "Validator reward");
+            if reward > 0 {
+                allocated += staking.allocate_rewards(validator.address, reward).unwrap_or(0);
+            }
+        }
+        allocated
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::modules::bank::BankModule;
+    use crate::modules::gov::{GovernanceModule, ProposalStatus};
+    use crate::modules::staking::StakingModule;
+    use near_sdk::test_utils::VMContextBuilder;
+    use near_sdk::testing_env;
+
+    fn account(name: &str) -> AccountId {
+        name.parse().unwrap()
+    }
+
+    fn staking_with_validator() -> StakingModule {
+        let mut staking = StakingModule::new();
+        staking.create_validator(
+            "validator1".to_string(),
+            vec![1; 32],
+            "Validator One".to_string(),
+            None,
+            None,
+            None,
+            None,
+            "0.1".to_string(),
+            "0.2".to_string(),
+            "0.01".to_string(),
+            1,
+            1000,
+        ).unwrap();
+        staking
+    }
+
+    fn set_distribution(gov: &mut GovernanceModule, distribution: &InflationDistribution) -> ProposalStatus {
+        let proposal_id = gov.submit_proposal(
+            &account("alice.near"),
+            "Inflation split".to_string(),
+            "Fund developers".to_string(),
+            INFLATION_DISTRIBUTION_PARAM.to_string(),
+            distribution.to_json(),
+            String::new(),
+            None,
+            10,
+        );
+        gov.vote(&account("alice.near"), proposal_id, 1, String::new());
+        gov.vote(&account("bob.near"), proposal_id, 1, String::new());
+        gov.end_block(100);
+        gov.get_proposal(proposal_id).unwrap().status
+    }
+
+    #[test]
+    fn test_distribution_validation() {
+        assert!(InflationDistribution::default().validate().is_ok());
+
+        let unbalanced = InflationDistribution { community_pool_bps: 1_000, ..InflationDistribution::default() };
+        assert!(unbalanced.validate().is_err());
+
+        let no_fund = InflationDistribution {
+            community_pool_bps: 1_000,
+            developer_fund_bps: 1_000,
+            ..InflationDistribution::default()
+        };
+        assert!(no_fund.validate().is_err());
+    }
+
+    #[test]
+    fn test_provision_follows_governance_weights() {
+        testing_env!(VMContextBuilder::new().current_account_id(account("cosmos.near")).build());
+        let mut gov = GovernanceModule::new();
+        let mut bank = BankModule::new();
+        let mut staking = staking_with_validator();
+        let mut mint = MintModule::new();
+        mint.set_params(MintParams {
+            mint_denom: NATIVE_DENOM.to_string(),
+            inflation_bps: 1_000,
+            blocks_per_year: 10,
+        }).unwrap();
+        bank.mint(&account("alice.near"), 100_000);
+
+        let provision = mint.begin_block(1, &gov, &mut bank, &mut staking).unwrap();
+        assert_eq!(provision.minted, 1_000);
+        assert_eq!(provision.staking_rewards, 800);
+        assert_eq!(provision.community_pool, 200);
+        assert!(mint.begin_block(1, &gov, &mut bank, &mut staking).is_err());
+
+        let distribution = InflationDistribution {
+            staking_rewards_bps: 5_000,
+            community_pool_bps: 3_000,
+            developer_fund_bps: 2_000,
+            developer_fund: Some("devs.near".to_string()),
+        };
+        assert_eq!(set_distribution(&mut gov, &distribution), ProposalStatus::Passed);
+
+        let provision = mint.begin_block(2, &gov, &mut bank, &mut staking).unwrap();
+        assert_eq!(provision.minted, 1_010);
+        assert_eq!(provision.staking_rewards, 505);
+        assert_eq!(provision.developer_fund, 202);
+        assert_eq!(provision.community_pool, 303);
+        assert_eq!(bank.get_balance(&account("devs.near")), 202);
+        assert_eq!(bank.get_balance(&community_pool_account()), 503);
+        assert_eq!(mint.total_minted(), 2_010);
+    }
+
+    #[test]
+    fn test_apr_from_bonded_ratio_and_commission() {
+        let gov = GovernanceModule::new();
+        let mut bank = BankModule::new();
+        let staking = staking_with_validator();
+        let mint = MintModule::new();
+        // 1000 of 10000 tokens are bonded
+        bank.mint(&account("alice.near"), 10_000);
+
+        assert_eq!(mint.annual_provisions(&bank), 700);
+        let estimate = mint.estimated_apr("validator1", &gov, &bank, &staking).unwrap();
+        assert_eq!(estimate.bonded_ratio_bps, 1_000);
+        // 80% of 700 shared by 1000 bonded tokens, less 10% commission
+        assert_eq!(estimate.gross_apr_bps, 5_600);
+        assert_eq!(estimate.commission_bps, 1_000);
+        assert_eq!(estimate.apr_bps, 5_040);
+        assert!(estimate.apy_bps > estimate.apr_bps);
+
+        assert!(mint.estimated_apr("validator2", &gov, &bank, &staking).is_err());
+    }
+
+    #[test]
+    fn test_staking_share_goes_to_pool_without_validators() {
+        let gov = GovernanceModule::new();
+        let mut bank = BankModule::new();
+        let mut staking = StakingModule::new();
+        let mut mint = MintModule::new();
+        bank.mint(&account("alice.near"), DEFAULT_BLOCKS_PER_YEAR as Balance * 100);
+
+        let provision = mint.begin_block(1, &gov, &mut bank, &mut staking).unwrap();
+        assert_eq!(provision.minted, 7);
+        assert_eq!(provision.staking_rewards, 0);
+        assert_eq!(provision.community_pool, 7);
+    }
+}
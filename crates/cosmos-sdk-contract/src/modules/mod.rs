@@ -4,4 +4,13 @@ pub mod staking;
 pub mod gov;
 pub mod ibc;
 pub mod cosmwasm;
-pub mod wasm;
\ No newline at end of file
+pub mod wasm;
+pub mod nft;
+pub mod block;
+pub mod keeper;
+pub mod compliance;
+pub mod sweep;
+pub mod mint;
+pub mod liquid_staking;
+pub mod storage_usage;
+pub mod jobs;
\ No newline at end of file
@@ -0,0 +1,383 @@
+/// CW721 Bridge
+/// 
+/// Mirrors CW721 collections instantiated through the wasm module into x/nft
+/// so they show up in x/nft queries and over NEP-171. Every mirrored
+/// collection gets the class `cw721/<contract>`.
+/// 
+/// Synchronization runs in both directions:
+/// - executes on the contract (`transfer_nft`, `send_nft`, `mint`, `burn`) are
+///   replayed on the class once the contract accepted them, and only for a
+///   sender the class itself authorizes: the token owner, a spender or
+///   operator the owner approved through the contract, or the minter
+///   named at instantiation
+/// - x/nft sends of a mirrored token return a `transfer_nft` message that the
+///   caller executes on the contract as the previous owner
+
+use near_sdk::serde::{Deserialize, Serialize};
+use near_sdk::serde_json::{self, json, Value};
+use near_sdk::AccountId;
+
+use super::{Class, Nft, NftModule};
+use crate::modules::cosmwasm::types::{Binary, WasmMsg};
+use crate::modules::wasm::{CodeID, Coin, ContractAddress, WasmModule};
+
+/// Class ID prefix of mirrored CW721 collections
+pub const CW721_CLASS_PREFIX: &str = "cw721/";
+
+/// Instantiate message of the cw721-base contract
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq)]
+pub struct Cw721InstantiateMsg {
+    pub name: String,
+    pub symbol: String,
+    pub minter: String,
+}
+
+/// Class ID used for a mirrored CW721 contract
+pub fn cw721_class_id(contract: &str) -> String {
+    format!("{}{}", CW721_CLASS_PREFIX, contract)
+}
+
+/// CW721 `transfer_nft` message moving `token_id` to `recipient`
+pub fn transfer_msg(contract: &str, token_id: &str, recipient: &str) -> WasmMsg {
+    let msg = json!({
+        "transfer_nft": {
+            "recipient": recipient,
+            "token_id": token_id,
+        }
+    });
+
+    WasmMsg::Execute {
+        contract_addr: contract.to_string(),
+        msg: Binary::from(msg.to_string().into_bytes()),
+        funds: vec![],
+    }
+}
+
+/// Key of an operator `owner` approved for all its tokens of `contract`
+fn operator_key(contract: &str, owner: &str, operator: &str) -> String {
+    format!("{}#{}#{}", contract, owner, operator)
+}
+
+fn string_field(msg: &Value, field: &str) -> Result<String, String> {
+    msg.get(field)
+        .and_then(Value::as_str)
+        .map(|value| value.to_string())
+        .ok_or_else(|| format!("CW721 message missing {}", field))
+}
+
+impl NftModule {
+    /// Register the x/nft class for a freshly instantiated CW721 contract
+    pub fn mirror_cw721_instantiate(&mut self, contract: &str, init_msg: &[u8]) -> Result<String, String> {
+        let init: Cw721InstantiateMsg = serde_json::from_slice(init_msg)
+            .map_err(|e| format!("Not a CW721 instantiate message: {}", e))?;
+
+        let class_id = cw721_class_id(contract);
+        self.save_class(Class {
+            id: class_id.clone(),
+            name: init.name,
+            symbol: init.symbol,
+            description: format!("CW721 collection {}", contract),
+            uri: String::new(),
+            uri_hash: String::new(),
+            cw721_contract: Some(contract.to_string()),
+        })?;
+        self.cw721_classes.insert(&contract.to_string(), &class_id);
+        self.cw721_minters.insert(&contract.to_string(), &init.minter);
+
+        Ok(class_id)
+    }
+
+    /// Class mirroring a CW721 contract, if any
+    pub fn cw721_class(&self, contract: &str) -> Option<String> {
+        self.cw721_classes.get(&contract.to_string())
+    }
+
+    pub fn is_cw721_mirror(&self, contract: &str) -> bool {
+        self.cw721_class(contract).is_some()
+    }
+
+    /// Replay an accepted CW721 execute message of `sender` on the mirrored class
+    /// 
+    /// The contract is the source of truth here, so no sync message is
+    /// produced. Messages that do not change ownership or approvals are
+    /// ignored; ones `sender` is not authorized for are refused, see
+    /// `check_cw721_execute`.
+    pub fn sync_cw721_execute(&mut self, contract: &str, sender: &str, msg: &[u8]) -> Result<(), String> {
+        let class_id = match self.cw721_class(contract) {
+            Some(class_id) => class_id,
+            None => return Ok(()),
+        };
+
+        let msg: Value = serde_json::from_slice(msg)
+            .map_err(|e| format!("Invalid CW721 message: {}", e))?;
+        self.check_cw721_execute(contract, &class_id, sender, &msg)?;
+
+        if let Some(transfer) = msg.get("transfer_nft") {
+            self.sync_cw721_transfer(&class_id, &string_field(transfer, "token_id")?, &string_field(transfer, "recipient")?)
+        } else if let Some(send) = msg.get("send_nft") {
+            self.sync_cw721_transfer(&class_id, &string_field(send, "token_id")?, &string_field(send, "contract")?)
+        } else if let Some(mint) = msg.get("mint") {
+            let nft = Nft {
+                class_id,
+                id: string_field(mint, "token_id")?,
+                uri: mint.get("token_uri").and_then(Value::as_str).unwrap_or_default().to_string(),
+                uri_hash: String::new(),
+                data: mint.get("extension").filter(|ext| !ext.is_null()).map(|ext| ext.to_string()).unwrap_or_default(),
+            };
+            self.mint(nft, &string_field(mint, "owner")?)
+        } else if let Some(burn) = msg.get("burn") {
+            self.burn(&class_id, &string_field(burn, "token_id")?)
+        } else if let Some(approve) = msg.get("approve") {
+            let key = Self::nft_key(&class_id, &string_field(approve, "token_id")?);
+            let spender = string_field(approve, "spender")?;
+            let mut spenders = self.cw721_approvals.get(&key).unwrap_or_default();
+            if !spenders.contains(&spender) {
+                spenders.push(spender);
+            }
+            self.cw721_approvals.insert(&key, &spenders);
+            Ok(())
+        } else if let Some(revoke) = msg.get("revoke") {
+            let key = Self::nft_key(&class_id, &string_field(revoke, "token_id")?);
+            let spender = string_field(revoke, "spender")?;
+            let mut spenders = self.cw721_approvals.get(&key).unwrap_or_default();
+            spenders.retain(|approved| *approved != spender);
+            self.cw721_approvals.insert(&key, &spenders);
+            Ok(())
+        } else if let Some(approve_all) = msg.get("approve_all") {
+            self.cw721_operators.insert(&operator_key(contract, sender, &string_field(approve_all, "operator")?));
+            Ok(())
+        } else if let Some(revoke_all) = msg.get("revoke_all") {
+            self.cw721_operators.remove(&operator_key(contract, sender, &string_field(revoke_all, "operator")?));
+            Ok(())
+        } else {
+            Ok(())
+        }
+    }
+
+    /// Check that `sender` may execute `msg` on a mirrored contract
+    /// 
+    /// Mirrors the cw721-base rules: the minter mints, the owner or an
+    /// operator it approved for all tokens approves and revokes, and those
+    /// or a spender approved on the token transfer, send and burn it.
+    /// Checked against the class rather than trusting the contract, so a
+    /// contract that skips its own checks cannot move mirrored tokens.
+    pub fn check_cw721_execute(&self, contract: &str, class_id: &str, sender: &str, msg: &Value) -> Result<(), String> {
+        let token = ["transfer_nft", "send_nft", "burn"].iter().find_map(|action| msg.get(*action));
+        if let Some(token) = token {
+            let key = Self::nft_key(class_id, &string_field(token, "token_id")?);
+            let owner = self.owners.get(&key).ok_or_else(|| format!("NFT {} not found", key))?;
+            let approved = self.cw721_approvals.get(&key).unwrap_or_default().iter().any(|spender| spender == sender);
+            if owner != sender && !approved && !self.cw721_operators.contains(&operator_key(contract, &owner, sender)) {
+                return Err(format!("{} is neither the owner of NFT {} nor approved for it", sender, key));
+            }
+        } else if let Some(approval) = msg.get("approve").or_else(|| msg.get("revoke")) {
+            let key = Self::nft_key(class_id, &string_field(approval, "token_id")?);
+            let owner = self.owners.get(&key).ok_or_else(|| format!("NFT {} not found", key))?;
+            if owner != sender && !self.cw721_operators.contains(&operator_key(contract, &owner, sender)) {
+                return Err(format!("Only the owner of NFT {} or its operators can change its approvals", key));
+            }
+        } else if msg.get("mint").is_some() {
+            let minter = self.cw721_minters.get(&contract.to_string()).unwrap_or_default();
+            if minter != sender {
+                return Err(format!("Only the minter {} can mint on {}", minter, contract));
+            }
+        }
+        Ok(())
+    }
+
+    fn sync_cw721_transfer(&mut self, class_id: &str, nft_id: &str, recipient: &str) -> Result<(), String> {
+        let key = Self::nft_key(class_id, nft_id);
+        let owner = self.owners.get(&key)
+            .ok_or_else(|| format!("NFT {} not found", key))?;
+        self.move_token(&key, &owner, recipient);
+        Ok(())
+    }
+
+    /// Instantiate a CW721 contract and mirror it into x/nft
+    pub fn instantiate_cw721(
+        &mut self,
+        wasm: &mut WasmModule,
+        sender: &AccountId,
+        code_id: CodeID,
+        init_msg: Vec<u8>,
+        label: String,
+        admin: Option<AccountId>,
+    ) -> Result<String, String> {
+        let response = wasm.instantiate_contract(sender, code_id, init_msg.clone(), vec![], label, admin)?;
+        self.mirror_cw721_instantiate(&response.address, &init_msg)?;
+        Ok(response.address)
+    }
+
+    /// Execute a message on a CW721 contract and mirror the result
+    /// 
+    /// The sender is checked against the mirrored class before the
+    /// contract runs, so a refused message changes neither side.
+    pub fn execute_cw721(
+        &mut self,
+        wasm: &mut WasmModule,
+        sender: &AccountId,
+        contract: &ContractAddress,
+        msg: Vec<u8>,
+        funds: Vec<Coin>,
+    ) -> Result<(), String> {
+        if let Some(class_id) = self.cw721_class(contract) {
+            let parsed: Value = serde_json::from_slice(&msg)
+                .map_err(|e| format!("Invalid CW721 message: {}", e))?;
+            self.check_cw721_execute(contract, &class_id, sender.as_str(), &parsed)?;
+        }
+        wasm.execute_contract(sender, contract, msg.clone(), funds)?;
+        self.sync_cw721_execute(contract, sender.as_str(), &msg)
+    }
+
+    /// x/nft send that also moves the token inside its CW721 contract
+    ///
+    /// The contract transfer runs first, so a refused transfer leaves the
+    /// x/nft owner unchanged.
+    pub fn send_and_sync(
+        &mut self,
+        wasm: &mut WasmModule,
+        sender: &AccountId,
+        class_id: &str,
+        nft_id: &str,
+        receiver: &str,
+    ) -> Result<(), String> {
+        if let Some(WasmMsg::Execute { contract_addr, msg, .. }) = self.check_send(sender.as_str(), class_id, nft_id, receiver)? {
+            wasm.execute_contract(sender, &contract_addr, msg.to_vec(), vec![])?;
+        }
+        self.send(sender.as_str(), class_id, nft_id, receiver)?;
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn instantiate_msg() -> Vec<u8> {
+        br#"{"name":"Punks","symbol":"PUNK","minter":"minter.near"}"#.to_vec()
+    }
+
+    fn setup_mirror() -> NftModule {
+        let mut module = NftModule::new();
+        module.mirror_cw721_instantiate("punks.near", &instantiate_msg()).unwrap();
+        module.sync_cw721_execute(
+            "punks.near",
+            "minter.near",
+            br#"{"mint":{"token_id":"1","owner":"alice.near","token_uri":"ipfs://1","extension":null}}"#,
+        ).unwrap();
+        module
+    }
+
+    #[test]
+    fn test_mirror_instantiate() {
+        let module = setup_mirror();
+        let class = module.get_class("cw721/punks.near").unwrap();
+        assert_eq!(class.symbol, "PUNK");
+        assert_eq!(class.cw721_contract, Some("punks.near".to_string()));
+        assert!(module.is_cw721_mirror("punks.near"));
+        assert!(!module.is_cw721_mirror("other.near"));
+
+        let mut module = NftModule::new();
+        assert!(module.mirror_cw721_instantiate("bad.near", br#"{"count":1}"#).is_err());
+    }
+
+    #[test]
+    fn test_contract_to_nft_sync() {
+        let mut module = setup_mirror();
+        assert_eq!(module.get_owner("cw721/punks.near", "1"), Some("alice.near".to_string()));
+        assert_eq!(module.get_nft("cw721/punks.near", "1").unwrap().uri, "ipfs://1");
+
+        module.sync_cw721_execute("punks.near", "alice.near", br#"{"transfer_nft":{"recipient":"bob.near","token_id":"1"}}"#).unwrap();
+        assert_eq!(module.get_owner("cw721/punks.near", "1"), Some("bob.near".to_string()));
+
+        module.sync_cw721_execute("punks.near", "bob.near", br#"{"approve":{"spender":"carol.near","token_id":"1"}}"#).unwrap();
+        assert_eq!(module.get_owner("cw721/punks.near", "1"), Some("bob.near".to_string()));
+
+        module.sync_cw721_execute("punks.near", "carol.near", br#"{"burn":{"token_id":"1"}}"#).unwrap();
+        assert_eq!(module.get_supply("cw721/punks.near"), 0);
+    }
+
+    #[test]
+    fn test_sync_checks_the_sender() {
+        let mut module = setup_mirror();
+        let transfer = br#"{"transfer_nft":{"recipient":"mallory.near","token_id":"1"}}"#;
+
+        assert!(module.sync_cw721_execute("punks.near", "mallory.near", transfer).unwrap_err().contains("approved"));
+        assert!(module.sync_cw721_execute("punks.near", "mallory.near", br#"{"burn":{"token_id":"1"}}"#).is_err());
+        assert!(module.sync_cw721_execute("punks.near", "mallory.near", br#"{"approve":{"spender":"mallory.near","token_id":"1"}}"#).is_err());
+        let mint = br#"{"mint":{"token_id":"2","owner":"mallory.near","token_uri":null,"extension":null}}"#;
+        assert!(module.sync_cw721_execute("punks.near", "mallory.near", mint).unwrap_err().contains("minter"));
+        assert_eq!(module.get_owner("cw721/punks.near", "1"), Some("alice.near".to_string()));
+
+        // An operator approved for all of alice's tokens may move them
+        module.sync_cw721_execute("punks.near", "alice.near", br#"{"approve_all":{"operator":"market.near","expires":null}}"#).unwrap();
+        module.sync_cw721_execute("punks.near", "market.near", br#"{"transfer_nft":{"recipient":"bob.near","token_id":"1"}}"#).unwrap();
+        assert_eq!(module.get_owner("cw721/punks.near", "1"), Some("bob.near".to_string()));
+
+        // A spender's approval ends with the transfer
+        module.sync_cw721_execute("punks.near", "bob.near", br#"{"approve":{"spender":"carol.near","token_id":"1"}}"#).unwrap();
+        module.sync_cw721_execute("punks.near", "carol.near", br#"{"transfer_nft":{"recipient":"dave.near","token_id":"1"}}"#).unwrap();
+        assert!(module.sync_cw721_execute("punks.near", "carol.near", br#"{"transfer_nft":{"recipient":"carol.near","token_id":"1"}}"#).is_err());
+    }
+
+    #[test]
+    fn test_refused_execute_never_reaches_the_contract() {
+        let mut module = setup_mirror();
+        let mut wasm = WasmModule::new();
+        let mallory: AccountId = "mallory.near".parse().unwrap();
+
+        // The contract does not exist, so only the sender check can refuse it first
+        let msg = br#"{"transfer_nft":{"recipient":"mallory.near","token_id":"1"}}"#.to_vec();
+        let err = module.execute_cw721(&mut wasm, &mallory, &"punks.near".to_string(), msg, vec![]).unwrap_err();
+        assert!(err.contains("approved"));
+    }
+
+    #[test]
+    fn test_nft_to_contract_sync() {
+        let mut module = setup_mirror();
+
+        let sync = module.send("alice.near", "cw721/punks.near", "1", "bob.near").unwrap();
+        match sync {
+            Some(WasmMsg::Execute { contract_addr, msg, funds }) => {
+                assert_eq!(contract_addr, "punks.near");
+                assert!(funds.is_empty());
+                let msg: Value = serde_json::from_slice(&msg.to_vec()).unwrap();
+                assert_eq!(msg["transfer_nft"]["recipient"], "bob.near");
+                assert_eq!(msg["transfer_nft"]["token_id"], "1");
+            }
+            _ => panic!("Expected CW721 transfer message"),
+        }
+
+        let token = module.nft_token("cw721/punks.near:1").unwrap();
+        assert_eq!(token.owner_id, "bob.near");
+    }
+
+    #[test]
+    fn test_refused_contract_transfer_keeps_the_owner() {
+        let mut module = setup_mirror();
+        // The contract was never instantiated on this wasm module
+        let mut wasm = WasmModule::new();
+        let alice: AccountId = "alice.near".parse().unwrap();
+
+        let err = module.send_and_sync(&mut wasm, &alice, "cw721/punks.near", "1", "bob.near").unwrap_err();
+        assert!(err.contains("not found"));
+        assert_eq!(module.get_owner("cw721/punks.near", "1"), Some("alice.near".to_string()));
+        assert_eq!(module.nft_token("cw721/punks.near:1").unwrap().owner_id, "alice.near");
+    }
+
+    #[test]
+    fn test_refused_nep171_transfer_keeps_the_owner() {
+        let mut module = setup_mirror();
+        let mut wasm = WasmModule::new();
+        let alice: AccountId = "alice.near".parse().unwrap();
+
+        assert!(module.nft_transfer(&mut wasm, &alice, "bob.near", "cw721/punks.near:1", None).is_err());
+        assert_eq!(module.get_owner("cw721/punks.near", "1"), Some("alice.near".to_string()));
+    }
+
+    #[test]
+    fn test_unmirrored_contract_is_ignored() {
+        let mut module = NftModule::new();
+        assert!(module.sync_cw721_execute("other.near", "alice.near", b"not json").is_ok());
+    }
+}
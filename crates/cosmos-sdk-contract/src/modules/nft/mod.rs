@@ -0,0 +1,296 @@
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::collections::{LookupMap, LookupSet, UnorderedMap};
+use near_sdk::env;
+
+pub mod types;
+pub mod cw721;
+pub mod nep171;
+
+pub use types::{Class, Nft, OwnedNft};
+pub use nep171::{Token, TokenMetadata};
+
+use crate::modules::cosmwasm::types::WasmMsg;
+
+/// NFT Module
+/// 
+/// Implements Cosmos SDK x/nft: classes (collections), token ownership,
+/// supply tracking and sends. Classes backed by a CW721 contract are kept in
+/// sync with that contract, see the `cw721` submodule.
+#[derive(BorshDeserialize, BorshSerialize)]
+pub struct NftModule {
+    /// Classes by class ID
+    classes: UnorderedMap<String, Class>,
+    /// Tokens by "class_id/nft_id"
+    nfts: LookupMap<String, Nft>,
+    /// Owner by "class_id/nft_id"
+    owners: LookupMap<String, String>,
+    /// Token keys held by each owner
+    tokens_by_owner: LookupMap<String, Vec<String>>,
+    /// Number of tokens per class
+    supply: LookupMap<String, u64>,
+    /// Class ID by mirrored CW721 contract address
+    cw721_classes: LookupMap<String, String>,
+    /// Minter of each mirrored CW721 contract
+    cw721_minters: LookupMap<String, String>,
+    /// Spenders approved on a mirrored token, by "class_id/nft_id"
+    cw721_approvals: LookupMap<String, Vec<String>>,
+    /// "contract#owner#operator" of CW721 operators approved for all tokens
+    cw721_operators: LookupSet<String>,
+}
+
+impl NftModule {
+    pub fn new() -> Self {
+        Self {
+            classes: UnorderedMap::new(b"nft_classes".to_vec()),
+            nfts: LookupMap::new(b"nft_tokens".to_vec()),
+            owners: LookupMap::new(b"nft_owners".to_vec()),
+            tokens_by_owner: LookupMap::new(b"nft_by_owner".to_vec()),
+            supply: LookupMap::new(b"nft_supply".to_vec()),
+            cw721_classes: LookupMap::new(b"nft_cw721".to_vec()),
+            cw721_minters: LookupMap::new(b"nft_cw721_minters".to_vec()),
+            cw721_approvals: LookupMap::new(b"nft_cw721_approvals".to_vec()),
+            cw721_operators: LookupSet::new(b"nft_cw721_operators".to_vec()),
+        }
+    }
+
+    fn nft_key(class_id: &str, nft_id: &str) -> String {
+        format!("{}/{}", class_id, nft_id)
+    }
+
+    fn split_key(key: &str) -> (String, String) {
+        // Class IDs may contain '/', NFT IDs may not
+        let (class_id, nft_id) = key.rsplit_once('/').unwrap_or(("", key));
+        (class_id.to_string(), nft_id.to_string())
+    }
+
+    /// Register a new class
+    pub fn save_class(&mut self, class: Class) -> Result<(), String> {
+        if class.id.is_empty() || class.id.contains(':') {
+            return Err(format!("Invalid class id: {}", class.id));
+        }
+        if self.classes.get(&class.id).is_some() {
+            return Err(format!("Class {} already exists", class.id));
+        }
+
+        self.classes.insert(&class.id, &class);
+        env::log_str(&format!("NFT: Created class {}", class.id));
+        Ok(())
+    }
+
+    /// Mint a token of an existing class to `receiver`
+    pub fn mint(&mut self, nft: Nft, receiver: &str) -> Result<(), String> {
+        if self.classes.get(&nft.class_id).is_none() {
+            return Err(format!("Class {} not found", nft.class_id));
+        }
+        if nft.id.is_empty() || nft.id.contains('/') || nft.id.contains(':') {
+            return Err(format!("Invalid nft id: {}", nft.id));
+        }
+
+        let key = Self::nft_key(&nft.class_id, &nft.id);
+        if self.nfts.get(&key).is_some() {
+            return Err(format!("NFT {} already exists", key));
+        }
+
+        self.nfts.insert(&key, &nft);
+        self.set_owner(&key, receiver);
+        let supply = self.get_supply(&nft.class_id);
+        self.supply.insert(&nft.class_id, &(supply + 1));
+
+        nep171::emit_nft_event("nft_mint", receiver, &nep171::to_token_id(&nft.class_id, &nft.id), None);
+        Ok(())
+    }
+
+    /// Burn a token
+    pub fn burn(&mut self, class_id: &str, nft_id: &str) -> Result<(), String> {
+        let key = Self::nft_key(class_id, nft_id);
+        let owner = self.owners.get(&key)
+            .ok_or_else(|| format!("NFT {} not found", key))?;
+
+        self.nfts.remove(&key);
+        self.owners.remove(&key);
+        self.cw721_approvals.remove(&key);
+        self.remove_from_owner(&owner, &key);
+        let supply = self.get_supply(class_id);
+        self.supply.insert(&class_id.to_string(), &supply.saturating_sub(1));
+
+        nep171::emit_nft_event("nft_burn", &owner, &nep171::to_token_id(class_id, nft_id), None);
+        Ok(())
+    }
+
+    /// Send a token on behalf of its owner (x/nft MsgSend)
+    /// 
+    /// For classes mirroring a CW721 contract the returned message must be
+    /// executed on the wasm module with `sender` as the caller so the
+    /// contract state follows the transfer.
+    pub fn send(&mut self, sender: &str, class_id: &str, nft_id: &str, receiver: &str) -> Result<Option<WasmMsg>, String> {
+        let sync = self.check_send(sender, class_id, nft_id, receiver)?;
+        self.move_token(&Self::nft_key(class_id, nft_id), sender, receiver);
+        Ok(sync)
+    }
+
+    /// Check that `sender` may send the token, returning the CW721 message
+    /// of a mirrored class
+    fn check_send(&self, sender: &str, class_id: &str, nft_id: &str, receiver: &str) -> Result<Option<WasmMsg>, String> {
+        let key = Self::nft_key(class_id, nft_id);
+        let owner = self.owners.get(&key)
+            .ok_or_else(|| format!("NFT {} not found", key))?;
+        if owner != sender {
+            return Err("Only the owner can send this NFT".to_string());
+        }
+        if receiver.is_empty() {
+            return Err("Invalid receiver".to_string());
+        }
+
+        let class = self.classes.get(&class_id.to_string())
+            .ok_or_else(|| format!("Class {} not found", class_id))?;
+        Ok(class.cw721_contract.map(|contract| cw721::transfer_msg(&contract, nft_id, receiver)))
+    }
+
+    fn move_token(&mut self, key: &str, owner: &str, receiver: &str) {
+        // Approvals are granted by an owner and end when the token leaves it
+        self.cw721_approvals.remove(&key.to_string());
+        self.remove_from_owner(owner, key);
+        self.set_owner(key, receiver);
+
+        let (class_id, nft_id) = Self::split_key(key);
+        nep171::emit_nft_event("nft_transfer", receiver, &nep171::to_token_id(&class_id, &nft_id), Some(owner));
+    }
+
+    fn set_owner(&mut self, key: &str, owner: &str) {
+        self.owners.insert(&key.to_string(), &owner.to_string());
+        let mut tokens = self.tokens_by_owner.get(&owner.to_string()).unwrap_or_default();
+        tokens.push(key.to_string());
+        self.tokens_by_owner.insert(&owner.to_string(), &tokens);
+    }
+
+    fn remove_from_owner(&mut self, owner: &str, key: &str) {
+        let mut tokens = self.tokens_by_owner.get(&owner.to_string()).unwrap_or_default();
+        tokens.retain(|token| token != key);
+        if tokens.is_empty() {
+            self.tokens_by_owner.remove(&owner.to_string());
+        } else {
+            self.tokens_by_owner.insert(&owner.to_string(), &tokens);
+        }
+    }
+
+    // Queries
+
+    pub fn get_class(&self, class_id: &str) -> Option<Class> {
+        self.classes.get(&class_id.to_string())
+    }
+
+    pub fn get_classes(&self) -> Vec<Class> {
+        self.classes.values().collect()
+    }
+
+    pub fn get_nft(&self, class_id: &str, nft_id: &str) -> Option<Nft> {
+        self.nfts.get(&Self::nft_key(class_id, nft_id))
+    }
+
+    pub fn get_owner(&self, class_id: &str, nft_id: &str) -> Option<String> {
+        self.owners.get(&Self::nft_key(class_id, nft_id))
+    }
+
+    pub fn get_supply(&self, class_id: &str) -> u64 {
+        self.supply.get(&class_id.to_string()).unwrap_or(0)
+    }
+
+    /// Number of tokens of a class held by an owner
+    pub fn balance(&self, owner: &str, class_id: &str) -> u64 {
+        self.nfts_of_owner(owner)
+            .iter()
+            .filter(|(token_class, _)| token_class == class_id)
+            .count() as u64
+    }
+
+    /// (class_id, nft_id) pairs held by an owner, in acquisition order
+    pub fn nfts_of_owner(&self, owner: &str) -> Vec<(String, String)> {
+        self.tokens_by_owner.get(&owner.to_string())
+            .unwrap_or_default()
+            .iter()
+            .map(|key| Self::split_key(key))
+            .collect()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn test_class(id: &str) -> Class {
+        Class {
+            id: id.to_string(),
+            name: "Test".to_string(),
+            symbol: "TST".to_string(),
+            description: String::new(),
+            uri: String::new(),
+            uri_hash: String::new(),
+            cw721_contract: None,
+        }
+    }
+
+    fn test_nft(class_id: &str, id: &str) -> Nft {
+        Nft {
+            class_id: class_id.to_string(),
+            id: id.to_string(),
+            uri: format!("ipfs://{}", id),
+            uri_hash: String::new(),
+            data: String::new(),
+        }
+    }
+
+    #[test]
+    fn test_class_and_mint() {
+        let mut module = NftModule::new();
+        module.save_class(test_class("kitties")).unwrap();
+        assert!(module.save_class(test_class("kitties")).is_err());
+        assert!(module.save_class(test_class("bad:id")).is_err());
+
+        module.mint(test_nft("kitties", "1"), "alice.near").unwrap();
+        assert!(module.mint(test_nft("kitties", "1"), "bob.near").is_err());
+        assert!(module.mint(test_nft("unknown", "1"), "bob.near").is_err());
+
+        assert_eq!(module.get_owner("kitties", "1"), Some("alice.near".to_string()));
+        assert_eq!(module.get_supply("kitties"), 1);
+        assert_eq!(module.balance("alice.near", "kitties"), 1);
+    }
+
+    #[test]
+    fn test_send_and_burn() {
+        let mut module = NftModule::new();
+        module.save_class(test_class("kitties")).unwrap();
+        module.mint(test_nft("kitties", "1"), "alice.near").unwrap();
+
+        assert!(module.send("bob.near", "kitties", "1", "carol.near").is_err());
+
+        let sync = module.send("alice.near", "kitties", "1", "bob.near").unwrap();
+        assert!(sync.is_none());
+        assert_eq!(module.get_owner("kitties", "1"), Some("bob.near".to_string()));
+        assert_eq!(module.balance("alice.near", "kitties"), 0);
+        assert_eq!(module.nfts_of_owner("bob.near"), vec![("kitties".to_string(), "1".to_string())]);
+
+        module.burn("kitties", "1").unwrap();
+        assert_eq!(module.get_supply("kitties"), 0);
+        assert!(module.get_nft("kitties", "1").is_none());
+        assert!(module.nfts_of_owner("bob.near").is_empty());
+    }
+
+    #[test]
+    fn test_nep171_views() {
+        let mut module = NftModule::new();
+        module.save_class(test_class("kitties")).unwrap();
+        module.mint(test_nft("kitties", "7"), "alice.near").unwrap();
+
+        let token = module.nft_token("kitties:7").unwrap();
+        assert_eq!(token.owner_id, "alice.near");
+        assert_eq!(token.metadata.unwrap().media, Some("ipfs://7".to_string()));
+        assert!(module.nft_token("kitties").is_none());
+        assert!(module.nft_token("kitties:8").is_none());
+
+        let mut wasm = crate::modules::wasm::WasmModule::new();
+        let alice = "alice.near".parse().unwrap();
+        module.nft_transfer(&mut wasm, &alice, "bob.near", "kitties:7", Some("gift".to_string())).unwrap();
+        assert_eq!(module.nft_tokens_for_owner("bob.near", None, None).len(), 1);
+        assert!(module.nft_tokens_for_owner("alice.near", None, None).is_empty());
+    }
+}
@@ -0,0 +1,127 @@
+/// NEP-171 Facade
+/// 
+/// Exposes x/nft tokens through the NEAR non-fungible token standard so NEAR
+/// wallets and marketplaces can list and move them. NEP-171 uses a single flat
+/// token namespace, so token IDs are `<class_id>:<nft_id>`.
+
+use near_sdk::serde::{Deserialize, Serialize};
+use near_sdk::serde_json::json;
+use near_sdk::{env, AccountId};
+use schemars::JsonSchema;
+
+use super::NftModule;
+use crate::modules::wasm::WasmModule;
+
+/// NEP-171 token view
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct Token {
+    pub token_id: String,
+    pub owner_id: String,
+    pub metadata: Option<TokenMetadata>,
+}
+
+/// NEP-177 token metadata subset filled from x/nft fields
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct TokenMetadata {
+    pub title: Option<String>,
+    pub media: Option<String>,
+    pub media_hash: Option<String>,
+    pub extra: Option<String>,
+}
+
+/// Build the NEP-171 token ID of an x/nft token
+pub fn to_token_id(class_id: &str, nft_id: &str) -> String {
+    format!("{}:{}", class_id, nft_id)
+}
+
+/// Split a NEP-171 token ID into class and NFT ID
+pub fn parse_token_id(token_id: &str) -> Result<(String, String), String> {
+    match token_id.split_once(':') {
+        Some((class_id, nft_id)) if !class_id.is_empty() && !nft_id.is_empty() => {
+            Ok((class_id.to_string(), nft_id.to_string()))
+        }
+        _ => Err(format!("Invalid token id: {}", token_id)),
+    }
+}
+
+/// Log a NEP-297 event for the nep171 standard
+pub fn emit_nft_event(event: &str, owner_id: &str, token_id: &str, old_owner_id: Option<&str>) {
+    let data = match old_owner_id {
+        Some(old_owner_id) => json!([{
+            "old_owner_id": old_owner_id,
+            "new_owner_id": owner_id,
+            "token_ids": [token_id],
+        }]),
+        None => json!([{
+            "owner_id": owner_id,
+            "token_ids": [token_id],
+        }]),
+    };
+
+    let event = json!({
+        "standard": "nep171",
+        "version": "1.0.0",
+        "event": event,
+        "data": data,
+    });
+    env::log_str(&format!("EVENT_JSON:{}", event));
+}
+
+fn none_if_empty(value: &str) -> Option<String> {
+    if value.is_empty() { None } else { Some(value.to_string()) }
+}
+
+impl NftModule {
+    /// NEP-171 `nft_token` view
+    pub fn nft_token(&self, token_id: &str) -> Option<Token> {
+        let (class_id, nft_id) = parse_token_id(token_id).ok()?;
+        let nft = self.get_nft(&class_id, &nft_id)?;
+        let owner_id = self.get_owner(&class_id, &nft_id)?;
+
+        Some(Token {
+            token_id: token_id.to_string(),
+            owner_id,
+            metadata: Some(TokenMetadata {
+                title: Some(nft.id.clone()),
+                media: none_if_empty(&nft.uri),
+                media_hash: none_if_empty(&nft.uri_hash),
+                extra: none_if_empty(&nft.data),
+            }),
+        })
+    }
+
+    /// NEP-171 `nft_transfer`
+    /// 
+    /// A token of a mirrored collection is moved inside its CW721 contract
+    /// first, see `NftModule::send_and_sync`, so the x/nft owner only
+    /// changes once the contract accepted the transfer.
+    pub fn nft_transfer(
+        &mut self,
+        wasm: &mut WasmModule,
+        sender: &AccountId,
+        receiver_id: &str,
+        token_id: &str,
+        memo: Option<String>,
+    ) -> Result<(), String> {
+        let (class_id, nft_id) = parse_token_id(token_id)?;
+        self.send_and_sync(wasm, sender, &class_id, &nft_id, receiver_id)?;
+
+        if let Some(memo) = memo {
+            env::log_str(&format!("NFT: transfer memo {}", memo));
+        }
+        Ok(())
+    }
+
+    /// NEP-181 style enumeration of an owner's tokens
+    pub fn nft_tokens_for_owner(&self, account_id: &str, from_index: Option<u64>, limit: Option<u64>) -> Vec<Token> {
+        let from_index = from_index.unwrap_or(0) as usize;
+        let limit = limit.unwrap_or(50).min(100) as usize;
+
+        self.nfts_of_owner(account_id)
+            .into_iter()
+            .skip(from_index)
+            .take(limit)
+            .filter_map(|(class_id, nft_id)| self.nft_token(&to_token_id(&class_id, &nft_id)))
+            .collect()
+    }
+}
@@ -0,0 +1,34 @@
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::serde::{Deserialize, Serialize};
+use schemars::JsonSchema;
+
+/// Class defines an NFT collection as in Cosmos SDK x/nft
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct Class {
+    pub id: String,
+    pub name: String,
+    pub symbol: String,
+    pub description: String,
+    pub uri: String,
+    pub uri_hash: String,
+    /// CW721 contract mirrored by this class, if any
+    pub cw721_contract: Option<String>,
+}
+
+/// NFT is a single non-fungible token of a class
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct Nft {
+    pub class_id: String,
+    pub id: String,
+    pub uri: String,
+    pub uri_hash: String,
+    /// Opaque JSON metadata
+    pub data: String,
+}
+
+/// NFT together with its current owner
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct OwnedNft {
+    pub nft: Nft,
+    pub owner: String,
+}
@@ -0,0 +1,315 @@
+/// Reward Distribution Accumulator
+///
+/// Follows the F1 fee distribution scheme of Cosmos SDK x/distribution.
+/// Each validator moves through numbered periods; closing a period adds the
+/// rewards earned per staked token during it to a cumulative ratio. A
+/// delegator's rewards are its stake times the ratio difference between the
+/// period it started in and the period that was just closed.
+///
+/// A slash ends a period too and is recorded with the part of the stake it
+/// left, so a delegation starting before it is paid on its reduced stake
+/// for the periods after it.
+///
+/// Period records mark which spans of periods a validator was eligible for
+/// rewards. Rewards allocated while a validator is jailed or inactive are
+/// withheld instead of accruing to it and its delegators.
+
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::collections::LookupMap;
+use near_sdk::serde::{Deserialize, Serialize};
+use schemars::JsonSchema;
+
+use crate::math::{mul_div_floor, safe_add};
+use crate::Balance;
+
+/// Fixed point scale of cumulative reward ratios
+const RATIO_SCALE: u128 = 1_000_000_000_000;
+
+/// Period records kept per validator
+pub const MAX_PERIOD_RECORDS: usize = 100;
+
+#[derive(BorshDeserialize, BorshSerialize, Clone, Debug)]
+struct CurrentRewards {
+    period: u64,
+    rewards: Balance,
+}
+
+#[derive(BorshDeserialize, BorshSerialize, Clone, Debug)]
+struct StartingInfo {
+    previous_period: u64,
+    stake: Balance,
+}
+
+/// Slash that ended the period `period`, leaving `tokens_after` of
+/// `tokens_before`
+#[derive(BorshDeserialize, BorshSerialize, Clone, Debug)]
+struct SlashEvent {
+    period: u64,
+    tokens_before: Balance,
+    tokens_after: Balance,
+}
+
+/// Span of periods during which a validator was or was not earning rewards
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct PeriodRecord {
+    pub start_period: u64,
+    pub start_height: u64,
+    /// Height the span ended at, `None` for the current span
+    pub end_height: Option<u64>,
+    pub eligible: bool,
+}
+
+#[derive(BorshDeserialize, BorshSerialize)]
+pub struct RewardAccumulator {
+    current: LookupMap<String, CurrentRewards>,
+    /// Cumulative reward ratio by "validator#period"
+    historical: LookupMap<String, u128>,
+    /// Delegation starting points by "delegator#validator"
+    starting_info: LookupMap<String, StartingInfo>,
+    period_records: LookupMap<String, Vec<PeriodRecord>>,
+    /// Slashes by validator, oldest first
+    slash_events: LookupMap<String, Vec<SlashEvent>>,
+    /// Settled but not yet withdrawn rewards by "delegator#validator"
+    accrued: LookupMap<String, Balance>,
+    withheld: Balance,
+}
+
+impl RewardAccumulator {
+    pub fn new() -> Self {
+        Self {
+            current: LookupMap::new(b"dist_current".to_vec()),
+            historical: LookupMap::new(b"dist_historical".to_vec()),
+            starting_info: LookupMap::new(b"dist_starting".to_vec()),
+            period_records: LookupMap::new(b"dist_periods".to_vec()),
+            slash_events: LookupMap::new(b"dist_slashes".to_vec()),
+            accrued: LookupMap::new(b"dist_accrued".to_vec()),
+            withheld: 0,
+        }
+    }
+
+    fn current_rewards(&self, validator: &str) -> CurrentRewards {
+        self.current.get(&validator.to_string())
+            .unwrap_or(CurrentRewards { period: 1, rewards: 0 })
+    }
+
+    fn ratio(&self, validator: &str, period: u64) -> u128 {
+        self.historical.get(&format!("{}#{}", validator, period)).unwrap_or(0)
+    }
+
+    /// Whether a validator currently earns rewards
+    pub fn is_eligible(&self, validator: &str) -> bool {
+        self.period_records.get(&validator.to_string())
+            .and_then(|records| records.last().map(|record| record.eligible))
+            .unwrap_or(true)
+    }
+
+    /// Add rewards to a validator's current period
+    ///
+    /// Returns the amount that accrued; rewards for an ineligible validator
+    /// are withheld and 0 is returned.
+    pub fn allocate(&mut self, validator: &str, amount: Balance) -> Balance {
+        if !self.is_eligible(validator) {
+            self.withhold(amount);
+            return 0;
+        }
+
+        let mut current = self.current_rewards(validator);
+        current.rewards = safe_add(current.rewards, amount, "Validator rewards");
+        self.current.insert(&validator.to_string(), &current);
+        amount
+    }
+
+    pub fn withhold(&mut self, amount: Balance) {
+        self.withheld = safe_add(self.withheld, amount, "Withheld rewards");
+    }
+
+    /// Close the current period and return its number
+    pub fn increment_period(&mut self, validator: &str, total_stake: Balance) -> u64 {
+        let current = self.current_rewards(validator);
+
+        let ratio_increase = if total_stake == 0 {
+            // Nobody to pay, keep the rewards out of circulation
+            self.withheld = safe_add(self.withheld, current.rewards, "Withheld rewards");
+            0
+        } else {
+            mul_div_floor(current.rewards, RATIO_SCALE, total_stake, "Reward ratio")
+        };
+
+        let ratio = self.ratio(validator, current.period - 1) + ratio_increase;
+        self.historical.insert(&format!("{}#{}", validator, current.period), &ratio);
+        self.current.insert(&validator.to_string(), &CurrentRewards {
+            period: current.period + 1,
+            rewards: 0,
+        });
+
+        current.period
+    }
+
+    /// Settle a delegation's rewards and restart it with `new_stake`
+    ///
+    /// `total_stake` is the validator stake before the delegation changes.
+    pub fn settle(&mut self, delegator: &str, validator: &str, total_stake: Balance, new_stake: Balance) -> Balance {
+        let ended_period = self.increment_period(validator, total_stake);
+        let key = format!("{}#{}", delegator, validator);
+
+        let rewards = match self.starting_info.get(&key) {
+            Some(info) => {
+                // Each slash since the start pays the periods before it on
+                // the stake of the time and reduces the stake after it
+                let mut stake = info.stake;
+                let mut start_period = info.previous_period;
+                let mut rewards = 0;
+                let slashes = self.slash_events.get(&validator.to_string()).unwrap_or_default();
+                for slash in slashes.iter().filter(|slash| slash.period > start_period && slash.period <= ended_period) {
+                    rewards = safe_add(rewards, self.rewards_between(validator, start_period, slash.period, stake), "Delegation rewards");
+                    stake = mul_div_floor(stake, slash.tokens_after, slash.tokens_before, "Slashed stake");
+                    start_period = slash.period;
+                }
+                safe_add(rewards, self.rewards_between(validator, start_period, ended_period, stake), "Delegation rewards")
+            }
+            None => 0,
+        };
+
+        if new_stake == 0 {
+            self.starting_info.remove(&key);
+        } else {
+            self.starting_info.insert(&key, &StartingInfo {
+                previous_period: ended_period,
+                stake: new_stake,
+            });
+        }
+
+        rewards
+    }
+
+    fn rewards_between(&self, validator: &str, start_period: u64, end_period: u64, stake: Balance) -> Balance {
+        let difference = self.ratio(validator, end_period) - self.ratio(validator, start_period);
+        mul_div_floor(stake, difference, RATIO_SCALE, "Delegation rewards")
+    }
+
+    /// Close the current period at a slash of `slashed` out of `total_stake`
+    ///
+    /// Delegations are not touched; each is reduced by the slash when it is
+    /// next settled.
+    pub fn slash(&mut self, validator: &str, total_stake: Balance, slashed: Balance) {
+        if total_stake == 0 || slashed == 0 {
+            return;
+        }
+        let period = self.increment_period(validator, total_stake);
+        let mut slashes = self.slash_events.get(&validator.to_string()).unwrap_or_default();
+        slashes.push(SlashEvent {
+            period,
+            tokens_before: total_stake,
+            tokens_after: total_stake.saturating_sub(slashed),
+        });
+        self.slash_events.insert(&validator.to_string(), &slashes);
+    }
+
+    /// Keep settled rewards for a later withdrawal
+    pub fn credit(&mut self, delegator: &str, validator: &str, amount: Balance) {
+        if amount == 0 {
+            return;
+        }
+        let key = format!("{}#{}", delegator, validator);
+        let accrued = self.accrued.get(&key).unwrap_or(0);
+        self.accrued.insert(&key, &safe_add(accrued, amount, "Accrued rewards"));
+    }
+
+    /// Remove and return a delegation's settled rewards
+    pub fn take_accrued(&mut self, delegator: &str, validator: &str) -> Balance {
+        self.accrued.remove(&format!("{}#{}", delegator, validator)).unwrap_or(0)
+    }
+
+    /// Start a new period span with the given eligibility
+    pub fn set_eligibility(&mut self, validator: &str, eligible: bool, total_stake: Balance, height: u64) {
+        if self.is_eligible(validator) == eligible {
+            return;
+        }
+
+        self.increment_period(validator, total_stake);
+        let start_period = self.current_rewards(validator).period;
+
+        let mut records = self.period_records.get(&validator.to_string()).unwrap_or_default();
+        if let Some(last) = records.last_mut() {
+            last.end_height = Some(height);
+        }
+        records.push(PeriodRecord {
+            start_period,
+            start_height: height,
+            end_height: None,
+            eligible,
+        });
+        if records.len() > MAX_PERIOD_RECORDS {
+            records.remove(0);
+        }
+        self.period_records.insert(&validator.to_string(), &records);
+    }
+
+    pub fn get_period_records(&self, validator: &str) -> Vec<PeriodRecord> {
+        self.period_records.get(&validator.to_string()).unwrap_or_default()
+    }
+
+    /// Rewards that did not accrue to anyone
+    pub fn get_withheld(&self) -> Balance {
+        self.withheld
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_rewards_split_by_stake() {
+        let mut accumulator = RewardAccumulator::new();
+        accumulator.settle("alice", "val", 0, 100);
+        accumulator.settle("bob", "val", 100, 300);
+
+        accumulator.allocate("val", 400);
+
+        assert_eq!(accumulator.settle("alice", "val", 400, 100), 100);
+        assert_eq!(accumulator.settle("bob", "val", 400, 300), 300);
+        // Nothing new accrued since the last settlement
+        assert_eq!(accumulator.settle("alice", "val", 400, 100), 0);
+    }
+
+    #[test]
+    fn test_slash_reduces_the_stake_rewards_are_paid_on() {
+        let mut accumulator = RewardAccumulator::new();
+        accumulator.settle("alice", "val", 0, 100);
+        accumulator.settle("bob", "val", 100, 300);
+
+        accumulator.allocate("val", 400);
+        accumulator.slash("val", 400, 200);
+        accumulator.allocate("val", 200);
+
+        // Full stakes before the slash, half of them after it
+        assert_eq!(accumulator.settle("alice", "val", 200, 50), 150);
+        assert_eq!(accumulator.settle("bob", "val", 200, 150), 450);
+
+        accumulator.allocate("val", 200);
+        assert_eq!(accumulator.settle("alice", "val", 200, 50), 50);
+    }
+
+    #[test]
+    fn test_ineligible_periods_are_withheld() {
+        let mut accumulator = RewardAccumulator::new();
+        accumulator.settle("alice", "val", 0, 100);
+
+        accumulator.allocate("val", 50);
+        accumulator.set_eligibility("val", false, 100, 10);
+        assert_eq!(accumulator.allocate("val", 70), 0);
+        accumulator.set_eligibility("val", true, 100, 20);
+        accumulator.allocate("val", 30);
+
+        assert_eq!(accumulator.settle("alice", "val", 100, 100), 80);
+        assert_eq!(accumulator.get_withheld(), 70);
+
+        let records = accumulator.get_period_records("val");
+        assert_eq!(records.len(), 2);
+        assert!(!records[0].eligible);
+        assert_eq!(records[0].end_height, Some(20));
+        assert!(records[1].eligible);
+        assert_eq!(records[1].end_height, None);
+    }
+}
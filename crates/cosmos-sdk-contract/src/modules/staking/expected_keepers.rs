@@ -0,0 +1,186 @@
+/// Expected Keepers
+///
+/// What the staking module needs from other modules, as in the Cosmos SDK's
+/// `x/staking/types/expected_keepers.go`. Staking only moves stake between
+/// accounts and the two pools, so it takes any `BankKeeper` rather than the
+/// bank module itself; contracts pass their `BankModule`, unit tests can
+/// pass a mock. Every call names the denom, since stake is held in the bond
+/// denom rather than the bank's native one. Unbonding stake is locked in
+/// the delegator's balance, so the keeper also creates and releases locks.
+
+use near_sdk::AccountId;
+
+use crate::modules::bank::BankModule;
+use crate::Balance;
+
+/// Bank functions the staking module uses
+pub trait BankKeeper {
+    fn get_denom_balance(&self, account: &AccountId, denom: &str) -> Balance;
+
+    fn has_denom_balance(&self, account: &AccountId, denom: &str, amount: Balance) -> bool {
+        self.get_denom_balance(account, denom) >= amount
+    }
+
+    fn transfer_denom_with_reason(
+        &mut self,
+        sender: &AccountId,
+        receiver: &AccountId,
+        denom: &str,
+        amount: Balance,
+        module: &str,
+        reason: &str,
+    );
+
+    fn burn_with_reason(&mut self, account: &AccountId, denom: &str, amount: Balance, module: &str, reason: &str);
+
+    /// Balance less the coins locked by any module
+    fn get_spendable_balance(&self, account: &AccountId, denom: &str) -> Balance {
+        self.get_denom_balance(account, denom)
+    }
+
+    fn lock_coins(
+        &mut self,
+        account: &AccountId,
+        denom: &str,
+        amount: Balance,
+        module: &str,
+        unlock_time: Option<u64>,
+    ) -> Result<u64, String>;
+
+    fn unlock_coins(&mut self, id: u64, module: &str) -> Result<(), String>;
+}
+
+impl BankKeeper for BankModule {
+    fn get_denom_balance(&self, account: &AccountId, denom: &str) -> Balance {
+        BankModule::get_denom_balance(self, account, denom)
+    }
+
+    fn transfer_denom_with_reason(
+        &mut self,
+        sender: &AccountId,
+        receiver: &AccountId,
+        denom: &str,
+        amount: Balance,
+        module: &str,
+        reason: &str,
+    ) {
+        BankModule::transfer_denom_with_reason(self, sender, receiver, denom, amount, module, reason)
+    }
+
+    fn burn_with_reason(&mut self, account: &AccountId, denom: &str, amount: Balance, module: &str, reason: &str) {
+        BankModule::burn_with_reason(self, account, denom, amount, module, reason)
+    }
+
+    fn get_spendable_balance(&self, account: &AccountId, denom: &str) -> Balance {
+        BankModule::get_spendable_balance(self, account, denom)
+    }
+
+    fn lock_coins(
+        &mut self,
+        account: &AccountId,
+        denom: &str,
+        amount: Balance,
+        module: &str,
+        unlock_time: Option<u64>,
+    ) -> Result<u64, String> {
+        BankModule::lock_coins(self, account, denom, amount, module, unlock_time)
+    }
+
+    fn unlock_coins(&mut self, id: u64, module: &str) -> Result<(), String> {
+        BankModule::unlock_coins(self, id, module).map(|_| ())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::modules::staking::{bonded_pool_account, not_bonded_pool_account, StakingModule};
+    use near_sdk::test_utils::VMContextBuilder;
+    use near_sdk::testing_env;
+    use std::collections::HashMap;
+
+    /// Balances by account and denom in memory, with every transfer and
+    /// lock recorded
+    #[derive(Default)]
+    struct MockBank {
+        balances: HashMap<(AccountId, String), Balance>,
+        transfers: Vec<(String, String, Balance, String)>,
+        locks: HashMap<u64, (AccountId, Balance)>,
+        next_lock_id: u64,
+    }
+
+    impl BankKeeper for MockBank {
+        fn get_denom_balance(&self, account: &AccountId, denom: &str) -> Balance {
+            self.balances.get(&(account.clone(), denom.to_string())).copied().unwrap_or(0)
+        }
+
+        fn transfer_denom_with_reason(
+            &mut self,
+            sender: &AccountId,
+            receiver: &AccountId,
+            denom: &str,
+            amount: Balance,
+            _module: &str,
+            reason: &str,
+        ) {
+            *self.balances.entry((sender.clone(), denom.to_string())).or_insert(0) -= amount;
+            *self.balances.entry((receiver.clone(), denom.to_string())).or_insert(0) += amount;
+            self.transfers.push((sender.to_string(), receiver.to_string(), amount, reason.to_string()));
+        }
+
+        fn burn_with_reason(&mut self, account: &AccountId, denom: &str, amount: Balance, _module: &str, _reason: &str) {
+            *self.balances.entry((account.clone(), denom.to_string())).or_insert(0) -= amount;
+        }
+
+        fn lock_coins(
+            &mut self,
+            account: &AccountId,
+            _denom: &str,
+            amount: Balance,
+            _module: &str,
+            _unlock_time: Option<u64>,
+        ) -> Result<u64, String> {
+            self.next_lock_id += 1;
+            self.locks.insert(self.next_lock_id, (account.clone(), amount));
+            Ok(self.next_lock_id)
+        }
+
+        fn unlock_coins(&mut self, id: u64, _module: &str) -> Result<(), String> {
+            self.locks.remove(&id).map(|_| ()).ok_or_else(|| format!("Lock {} not found", id))
+        }
+    }
+
+    #[test]
+    fn test_staking_runs_against_a_mock_bank() {
+        testing_env!(VMContextBuilder::new().build());
+        let mut staking = StakingModule::new();
+        staking.create_validator(
+            "validator1".to_string(),
+            vec![1; 32],
+            "Validator One".to_string(),
+            None,
+            None,
+            None,
+            None,
+            "0.1".to_string(),
+            "0.2".to_string(),
+            "0.01".to_string(),
+            1,
+            1000,
+        ).unwrap();
+
+        let alice: AccountId = "alice.near".parse().unwrap();
+        let mut bank = MockBank::default();
+        bank.balances.insert((bonded_pool_account(), "stake".to_string()), 1000);
+        bank.balances.insert((alice.clone(), "stake".to_string()), 300);
+
+        staking.delegate_from_bank(&mut bank, &alice, "validator1".to_string(), 200).unwrap();
+        staking.undelegate_to_bank(&mut bank, &alice, "validator1".to_string(), 50).unwrap();
+
+        let reasons: Vec<&str> = bank.transfers.iter().map(|transfer| transfer.3.as_str()).collect();
+        assert_eq!(reasons, vec!["delegate", "undelegate"]);
+        assert_eq!(bank.get_denom_balance(&not_bonded_pool_account(), "stake"), 0);
+        assert_eq!(bank.locks.values().collect::<Vec<_>>(), vec![&(alice.clone(), 50)]);
+        staking.check_pool_invariant(&bank).unwrap();
+    }
+}
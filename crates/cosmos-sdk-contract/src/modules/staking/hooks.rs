@@ -0,0 +1,83 @@
+/// Staking Bank Hooks
+///
+/// The bonded and not-bonded pools only ever hold the bond denom, and
+/// staking only ever pays the bond denom out of them. Any other coin sent to
+/// a pool would be stranded there, so `StakingHooks` refuses such sends
+/// before they move. Contracts holding a bank register the hooks each time
+/// they load their state, see `BankModule::register_hooks`.
+
+use near_sdk::AccountId;
+
+use super::pools::{bonded_pool_account, not_bonded_pool_account};
+use crate::modules::bank::{BankHooks, Coin};
+
+pub struct StakingHooks {
+    bond_denom: String,
+}
+
+impl StakingHooks {
+    pub fn new(bond_denom: impl Into<String>) -> Self {
+        Self { bond_denom: bond_denom.into() }
+    }
+}
+
+impl BankHooks for StakingHooks {
+    fn before_send(&mut self, _from: &AccountId, to: &AccountId, coin: &Coin) -> Result<(), String> {
+        if coin.denom != self.bond_denom && (*to == bonded_pool_account() || *to == not_bonded_pool_account()) {
+            return Err(format!("Staking pool {} only holds {}, not {}", to, self.bond_denom, coin.denom));
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::modules::bank::{BankModule, SendRestriction};
+    use crate::modules::staking::StakingModule;
+    use crate::Balance;
+    use near_sdk::test_utils::VMContextBuilder;
+    use near_sdk::testing_env;
+
+    struct AllowAll;
+
+    impl SendRestriction for AllowAll {
+        fn check_send(&self, _from: &AccountId, _to: &AccountId, _amount: Balance) -> Result<(), String> {
+            Ok(())
+        }
+    }
+
+    #[test]
+    fn test_pools_only_take_the_bond_denom() {
+        testing_env!(VMContextBuilder::new().build());
+        let mut staking = StakingModule::new();
+        staking.create_validator(
+            "validator1".to_string(),
+            vec![1; 32],
+            "Validator One".to_string(),
+            None,
+            None,
+            None,
+            None,
+            "0.1".to_string(),
+            "0.2".to_string(),
+            "0.01".to_string(),
+            1,
+            1000,
+        ).unwrap();
+
+        let mut bank = BankModule::new();
+        bank.register_hooks(Box::new(StakingHooks::new(staking.bond_denom())));
+        bank.mint_denom(&bonded_pool_account(), "stake", 1000);
+        let alice: AccountId = "alice.near".parse().unwrap();
+        bank.mint_denom(&alice, "stake", 100);
+        bank.mint(&alice, 100);
+
+        staking.delegate_from_bank(&mut bank, &alice, "validator1".to_string(), 60).unwrap();
+        assert_eq!(bank.get_denom_balance(&bonded_pool_account(), "stake"), 1060);
+
+        let err = bank.send(&AllowAll, &alice, &not_bonded_pool_account(), 10).unwrap_err();
+        assert!(err.contains("only holds stake, not unear"));
+        assert_eq!(bank.get_balance(&alice), 100);
+    }
+}
@@ -1,9 +1,30 @@
 use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
-use near_sdk::collections::UnorderedMap;
+use near_sdk::collections::{LookupMap, LookupSet, UnorderedMap};
 use near_sdk::env;
 use near_sdk::serde::{Deserialize, Serialize};
 use schemars::JsonSchema;
 use crate::Balance;
+use crate::math::{mul_div, mul_div_floor, safe_add, safe_sub};
+use crate::modules::bank::coins::validate_denom;
+use crate::modules::bank::metadata::parse_decimal;
+use crate::modules::jobs::JobRegistry;
+use crate::types::time;
+
+pub mod distribution;
+pub mod expected_keepers;
+pub mod hooks;
+pub mod pools;
+pub mod recovery;
+pub mod rotation;
+pub mod snapshots;
+
+pub use distribution::{PeriodRecord, RewardAccumulator};
+pub use expected_keepers::BankKeeper;
+pub use hooks::StakingHooks;
+pub use pools::{bonded_pool_account, not_bonded_pool_account};
+pub use recovery::{OverrideValidator, ValidatorSetOverride, STAKING_PROPOSAL_ROUTE, VALIDATOR_SET_OVERRIDE};
+pub use rotation::{KeyRotation, KEY_ROTATION_COOLDOWN_BLOCKS};
+pub use snapshots::{epoch_of, VotingPowerSnapshot, SNAPSHOT_EPOCH_BLOCKS};
 // use crate::modules::bank::BankModule; // Not needed currently
 // use crate::modules::ibc::transfer::FungibleTokenPacketData; // Not needed currently
 
@@ -73,6 +94,10 @@ pub struct UnbondingDelegationEntry {
     pub completion_time: u64,
     pub initial_balance: Balance,
     pub balance: Balance,
+    /// Bank lock holding the tokens in the delegator's balance, `None` when
+    /// they wait in the not-bonded pool
+    #[serde(default)]
+    pub lock_id: Option<u64>,
 }
 
 #[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, JsonSchema)]
@@ -89,8 +114,39 @@ pub struct Params {
     pub historical_entries: u32,
     pub bond_denom: String,
     pub min_commission_rate: String,
+    /// Smallest amount a delegation may hold, smaller ones are dust
+    pub min_delegation: Balance,
+}
+
+/// Kind of change recorded in a delegator's history
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub enum DelegatorEventKind {
+    Delegate,
+    Undelegate,
+    Redelegate,
+    Reward,
+    Slash,
+}
+
+/// Entry of a delegator's staking history
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct DelegatorHistoryEntry {
+    pub height: u64,
+    /// Block timestamp in nanoseconds
+    pub timestamp: u64,
+    pub kind: DelegatorEventKind,
+    pub validator_address: String,
+    /// Destination validator of a redelegation
+    pub dst_validator_address: Option<String>,
+    pub amount: Balance,
 }
 
+/// History entries kept per delegator, oldest are dropped first
+pub const MAX_HISTORY_ENTRIES: usize = 1000;
+
+/// Decimal places of a slash fraction, as in the Cosmos SDK `Dec`
+pub const SLASH_FRACTION_DECIMALS: u32 = 18;
+
 #[derive(BorshDeserialize, BorshSerialize)]
 pub struct StakingModule {
     validators: UnorderedMap<String, Validator>,
@@ -98,6 +154,23 @@ pub struct StakingModule {
     unbonding_delegations: UnorderedMap<String, UnbondingDelegation>,
     pool: Pool,
     params: Params,
+    distribution: RewardAccumulator,
+    delegator_history: LookupMap<String, Vec<DelegatorHistoryEntry>>,
+    /// Voting power snapshots by epoch
+    voting_power_snapshots: LookupMap<u64, VotingPowerSnapshot>,
+    last_snapshot_epoch: Option<u64>,
+    /// Cursors of resumable staking jobs
+    jobs: JobRegistry,
+    /// Replaced consensus keys by validator, oldest first
+    key_rotations: LookupMap<String, Vec<KeyRotation>>,
+    /// Validator by every consensus key it held
+    consensus_key_owners: LookupMap<Vec<u8>, String>,
+    /// Unbonding tokens locked in delegator balances rather than held by
+    /// the not-bonded pool
+    unbonding_locked: Balance,
+    /// Validators removed by a validator set override, which only a later
+    /// override can bond again
+    governance_jailed: LookupSet<String>,
 }
 
 impl StakingModule {
@@ -117,7 +190,17 @@ impl StakingModule {
                 historical_entries: 10000,
                 bond_denom: "stake".to_string(),
                 min_commission_rate: "0.0".to_string(),
+                min_delegation: 1,
             },
+            distribution: RewardAccumulator::new(),
+            delegator_history: LookupMap::new(b"h".to_vec()),
+            voting_power_snapshots: LookupMap::new(b"vs".to_vec()),
+            last_snapshot_epoch: None,
+            jobs: JobRegistry::new(b"jb"),
+            key_rotations: LookupMap::new(b"kr".to_vec()),
+            consensus_key_owners: LookupMap::new(b"ck".to_vec()),
+            unbonding_locked: 0,
+            governance_jailed: LookupSet::new(b"gj".to_vec()),
         }
     }
 
@@ -141,6 +224,9 @@ impl StakingModule {
         if self.validators.get(&validator_address).is_some() {
             return Err("Validator already exists".to_string());
         }
+        if self_delegation < min_self_delegation {
+            return Err("Self delegation is below the minimum self delegation".to_string());
+        }
 
         let validator = Validator {
             address: validator_address.clone(),
@@ -170,8 +256,21 @@ impl StakingModule {
             min_self_delegation,
         };
 
+        self.index_consensus_key(&validator_address, &validator.consensus_pubkey);
         self.validators.insert(&validator_address, &validator);
-        self.pool.bonded_tokens += self_delegation;
+        self.pool.bonded_tokens = safe_add(self.pool.bonded_tokens, self_delegation, "Bonded pool");
+
+        // The operator's stake is an ordinary delegation so it can be tracked
+        // and unbonded like any other
+        if self_delegation > 0 {
+            let delegation = Delegation {
+                delegator_address: validator_address.clone(),
+                validator_address: validator_address.clone(),
+                shares: self_delegation.to_string(),
+            };
+            self.delegations.insert(&format!("{}#{}", validator_address, validator_address), &delegation);
+            self.distribution.settle(&validator_address, &validator_address, 0, self_delegation);
+        }
 
         env::log_str(&format!("Created validator: {}", validator_address));
         Ok(())
@@ -211,6 +310,9 @@ impl StakingModule {
             validator.commission.update_time = env::block_timestamp();
         }
         if let Some(min_self_delegation) = min_self_delegation {
+            if min_self_delegation > self.get_self_delegation(validator_address.clone()) {
+                return Err("Minimum self delegation cannot exceed the current self delegation".to_string());
+            }
             validator.min_self_delegation = min_self_delegation;
         }
 
@@ -219,49 +321,149 @@ impl StakingModule {
         Ok(())
     }
 
-    // Delegation functions
-    pub fn delegate(&mut self, delegator: String, validator_address: String, amount: Balance) -> Result<(), String> {
-        let mut validator = self.validators.get(&validator_address)
+    // Delegation functions, reached through the bond denom checks of
+    // `delegate_coin` and the bank paths of `pools`
+    fn delegate(&mut self, delegator: String, validator_address: String, amount: Balance) -> Result<(), String> {
+        self.delegate_tokens(&delegator, &validator_address, amount)?;
+        self.record_history(&delegator, DelegatorEventKind::Delegate, &validator_address, None, amount);
+        Ok(())
+    }
+
+    fn undelegate(&mut self, delegator: String, validator_address: String, amount: Balance) -> Result<u64, String> {
+        let completion_time = self.undelegate_tokens(&delegator, &validator_address, amount)?;
+        self.record_history(&delegator, DelegatorEventKind::Undelegate, &validator_address, None, amount);
+        Ok(completion_time)
+    }
+
+    /// Check that `amount` may be delegated to a validator
+    fn delegation_target(&self, validator_address: &str, amount: Balance) -> Result<Validator, String> {
+        let validator = self.validators.get(&validator_address.to_string())
             .ok_or("Validator not found")?;
 
         if validator.status != ValidatorStatus::Bonded {
             return Err("Validator not bonded".to_string());
         }
+        if amount < self.params.min_delegation {
+            return Err(format!(
+                "Delegation amount {} is below the minimum delegation {}",
+                amount, self.params.min_delegation
+            ));
+        }
+        Ok(validator)
+    }
+
+    fn delegate_tokens(&mut self, delegator: &str, validator_address: &str, amount: Balance) -> Result<(), String> {
+        let mut validator = self.delegation_target(validator_address, amount)?;
+        let delegator = delegator.to_string();
+        let validator_address = validator_address.to_string();
+
+        let current_tokens = self.get_delegation(delegator.clone(), validator_address.clone())
+            .map(|delegation| self.delegation_tokens(&delegation))
+            .unwrap_or(0);
+        let overflow = |what: &str| format!("Delegating {} overflows the {}", amount, what);
+
+        // New shares are minted at the validator's tokens per share, so a
+        // slashed validator issues more shares for the same amount
+        let total_shares: Balance = validator.delegator_shares.parse().unwrap_or(0);
+        let new_shares = if total_shares == 0 {
+            amount
+        } else if validator.tokens == 0 {
+            return Err("Validator has no tokens left to back its shares".to_string());
+        } else {
+            mul_div(amount, total_shares, validator.tokens).ok_or_else(|| overflow("validator shares"))?
+        };
+        if new_shares == 0 {
+            return Err(format!("Delegation amount {} is worth no shares", amount));
+        }
+        let delegation_key = format!("{}#{}", delegator, validator_address);
+        let existing_shares: Balance = self.delegations.get(&delegation_key)
+            .and_then(|delegation| delegation.shares.parse().ok())
+            .unwrap_or(0);
+        let validator_tokens = validator.tokens.checked_add(amount).ok_or_else(|| overflow("validator tokens"))?;
+        let validator_shares = total_shares
+            .checked_add(new_shares)
+            .ok_or_else(|| overflow("validator shares"))?;
+        let delegation_shares = existing_shares.checked_add(new_shares).ok_or_else(|| overflow("delegation shares"))?;
+        let bonded_tokens = self.pool.bonded_tokens.checked_add(amount).ok_or_else(|| overflow("bonded pool"))?;
+        self.settle_rewards(&delegator, &validator, current_tokens + amount);
 
         // Update validator
-        validator.tokens += amount;
-        let new_shares = amount; // Simplified 1:1 share ratio
-        validator.delegator_shares = (validator.delegator_shares.parse::<Balance>().unwrap_or(0) + new_shares).to_string();
+        validator.tokens = validator_tokens;
+        validator.delegator_shares = validator_shares.to_string();
         self.validators.insert(&validator_address, &validator);
 
         // Create or update delegation
-        let delegation_key = format!("{}#{}", delegator, validator_address);
         let delegation = Delegation {
             delegator_address: delegator.clone(),
             validator_address: validator_address.clone(),
-            shares: new_shares.to_string(),
+            shares: delegation_shares.to_string(),
         };
         self.delegations.insert(&delegation_key, &delegation);
 
         // Update pool
-        self.pool.bonded_tokens += amount;
+        self.pool.bonded_tokens = bonded_tokens;
 
         env::log_str(&format!("Delegated {} from {} to {}", amount, delegator, validator_address));
         Ok(())
     }
 
-    pub fn undelegate(&mut self, delegator: String, validator_address: String, amount: Balance) -> Result<u64, String> {
-        let delegation_key = format!("{}#{}", delegator, validator_address);
-        let mut delegation = self.delegations.get(&delegation_key)
+    fn undelegate_tokens(&mut self, delegator: &str, validator_address: &str, amount: Balance) -> Result<u64, String> {
+        let shares = self.unbond_shares(delegator, validator_address, amount)?;
+        let validator = self.remove_delegation_shares(delegator, validator_address, shares, amount);
+
+        let completion_time = self.begin_unbonding(delegator, validator_address, amount);
+
+        env::log_str(&format!("Started unbonding {} from {} to {}", amount, delegator, validator_address));
+
+        if delegator == validator.operator_address {
+            self.jail_if_below_min_self_delegation(validator_address);
+        }
+        Ok(completion_time)
+    }
+
+    /// Shares to burn for withdrawing `amount` tokens
+    /// 
+    /// Shares are valued at the validator's tokens per share, rounding the
+    /// burn up so a withdrawal never takes more than its shares are worth.
+    fn unbond_shares(&self, delegator: &str, validator_address: &str, amount: Balance) -> Result<Balance, String> {
+        let delegation = self.get_delegation(delegator.to_string(), validator_address.to_string())
             .ok_or("Delegation not found")?;
+        let validator = self.validators.get(&validator_address.to_string())
+            .ok_or("Validator not found")?;
 
         let current_shares: Balance = delegation.shares.parse().map_err(|_| "Invalid shares")?;
-        if current_shares < amount {
+        let current_tokens = self.delegation_tokens(&delegation);
+        if current_tokens < amount {
             return Err("Insufficient delegation".to_string());
         }
+        if amount == current_tokens {
+            return Ok(current_shares);
+        }
+
+        let total_shares: Balance = validator.delegator_shares.parse().unwrap_or(0);
+        let mut shares = mul_div_floor(amount, total_shares, validator.tokens, "Unbonded shares");
+        if mul_div_floor(shares, validator.tokens, total_shares, "Unbonded tokens") < amount {
+            shares += 1;
+        }
+        if shares == 0 {
+            return Err(format!("Unbonding amount {} is worth no shares", amount));
+        }
+        // `amount` is at most the delegation's worth, so this only trims rounding
+        Ok(shares.min(current_shares))
+    }
+
+    /// Burn `shares` of a delegation worth `tokens`, returning the updated validator
+    fn remove_delegation_shares(&mut self, delegator: &str, validator_address: &str, shares: Balance, tokens: Balance) -> Validator {
+        let delegation_key = format!("{}#{}", delegator, validator_address);
+        let mut delegation = self.delegations.get(&delegation_key).unwrap();
+        let mut validator = self.validators.get(&validator_address.to_string()).unwrap();
+
+        let current_tokens = self.delegation_tokens(&delegation);
+        self.settle_rewards(delegator, &validator, current_tokens.saturating_sub(tokens));
 
         // Update delegation
-        let new_shares = current_shares - amount;
+        let current_shares: Balance = delegation.shares.parse().unwrap_or(0);
+        let new_shares = safe_sub(current_shares, shares, "Delegation shares");
         if new_shares == 0 {
             self.delegations.remove(&delegation_key);
         } else {
@@ -270,20 +472,56 @@ impl StakingModule {
         }
 
         // Update validator
-        let mut validator = self.validators.get(&validator_address).unwrap();
-        validator.tokens -= amount;
+        validator.tokens = safe_sub(validator.tokens, tokens, "Validator tokens");
         let total_shares: Balance = validator.delegator_shares.parse().unwrap_or(0);
-        validator.delegator_shares = (total_shares - amount).to_string();
-        self.validators.insert(&validator_address, &validator);
+        validator.delegator_shares = safe_sub(total_shares, shares, "Validator shares").to_string();
+        self.validators.insert(&validator_address.to_string(), &validator);
+        validator
+    }
 
-        // Create unbonding delegation
-        let completion_time = env::block_timestamp() + self.params.unbonding_time * 1_000_000_000; // Convert to nanoseconds
+    /// Tokens the operator has delegated to its own validator
+    pub fn get_self_delegation(&self, validator_address: String) -> Balance {
+        let validator = match self.validators.get(&validator_address) {
+            Some(validator) => validator,
+            None => return 0,
+        };
+        self.get_delegation(validator.operator_address, validator_address)
+            .map(|delegation| self.delegation_tokens(&delegation))
+            .unwrap_or(0)
+    }
+
+    /// Jail a validator whose operator withdrew below its minimum self delegation
+    fn jail_if_below_min_self_delegation(&mut self, validator_address: &str) {
+        let mut validator = match self.validators.get(&validator_address.to_string()) {
+            Some(validator) => validator,
+            None => return,
+        };
+        let self_delegation = self.get_self_delegation(validator_address.to_string());
+        if validator.jailed || self_delegation >= validator.min_self_delegation {
+            return;
+        }
+
+        validator.jailed = true;
+        validator.status = ValidatorStatus::Unbonding;
+        validator.unbonding_height = env::block_height();
+        self.validators.insert(&validator_address.to_string(), &validator);
+        self.distribution.set_eligibility(validator_address, false, validator.tokens, env::block_height());
+
+        env::log_str(&format!(
+            "EVENT: jail validator={} reason=min_self_delegation self_delegation={} min_self_delegation={}",
+            validator_address, self_delegation, validator.min_self_delegation
+        ));
+    }
+
+    /// Queue `amount` tokens for release after the unbonding period
+    fn begin_unbonding(&mut self, delegator: &str, validator_address: &str, amount: Balance) -> u64 {
+        let completion_time = time::add_seconds(time::now(), self.params.unbonding_time);
         let unbonding_key = format!("{}#{}", delegator, validator_address);
         
         let mut unbonding = self.unbonding_delegations.get(&unbonding_key)
             .unwrap_or(UnbondingDelegation {
-                delegator_address: delegator.clone(),
-                validator_address: validator_address.clone(),
+                delegator_address: delegator.to_string(),
+                validator_address: validator_address.to_string(),
                 entries: vec![],
             });
 
@@ -292,25 +530,165 @@ impl StakingModule {
             completion_time,
             initial_balance: amount,
             balance: amount,
+            lock_id: None,
         });
 
         self.unbonding_delegations.insert(&unbonding_key, &unbonding);
 
         // Update pool
-        self.pool.bonded_tokens -= amount;
-        self.pool.not_bonded_tokens += amount;
+        self.pool.bonded_tokens = safe_sub(self.pool.bonded_tokens, amount, "Bonded pool");
+        self.pool.not_bonded_tokens = safe_add(self.pool.not_bonded_tokens, amount, "Not bonded pool");
 
-        env::log_str(&format!("Started unbonding {} from {} to {}", amount, delegator, validator_address));
-        Ok(completion_time)
+        completion_time
+    }
+
+    /// Tokens currently backing a delegation
+    /// 
+    /// Shares keep their count when a validator is slashed, so the token
+    /// value is the delegation's pro-rata part of the validator tokens.
+    pub fn delegation_tokens(&self, delegation: &Delegation) -> Balance {
+        let validator = match self.validators.get(&delegation.validator_address) {
+            Some(validator) => validator,
+            None => return 0,
+        };
+        let shares: Balance = delegation.shares.parse().unwrap_or(0);
+        let total_shares: Balance = validator.delegator_shares.parse().unwrap_or(0);
+        if total_shares == 0 {
+            return 0;
+        }
+        mul_div_floor(shares, validator.tokens, total_shares, "Delegation tokens")
+    }
+
+    /// Fully unbond delegations to a validator that fell below the minimum
+    /// 
+    /// Returns the delegators that were unbonded.
+    fn unbond_dust_delegations(&mut self, validator_address: &str) -> Vec<String> {
+        let mut unbonded = Vec::new();
+
+        for delegation in self.get_validator_delegations(validator_address.to_string()) {
+            let tokens = self.delegation_tokens(&delegation);
+            if tokens >= self.params.min_delegation {
+                continue;
+            }
+
+            let shares: Balance = delegation.shares.parse().unwrap_or(0);
+            let mut validator = match self.validators.get(&validator_address.to_string()) {
+                Some(validator) => validator,
+                None => break,
+            };
+            self.settle_rewards(&delegation.delegator_address, &validator, 0);
+            validator.tokens = safe_sub(validator.tokens, tokens, "Validator tokens");
+            let total_shares: Balance = validator.delegator_shares.parse().unwrap_or(0);
+            validator.delegator_shares = total_shares.saturating_sub(shares).to_string();
+            self.validators.insert(&validator_address.to_string(), &validator);
+
+            self.delegations.remove(&format!("{}#{}", delegation.delegator_address, validator_address));
+            if tokens > 0 {
+                self.begin_unbonding(&delegation.delegator_address, validator_address, tokens);
+            }
+
+            self.record_history(&delegation.delegator_address, DelegatorEventKind::Undelegate, validator_address, None, tokens);
+            env::log_str(&format!(
+                "Auto-unbonded dust delegation of {} from {} to {}",
+                tokens, delegation.delegator_address, validator_address
+            ));
+            unbonded.push(delegation.delegator_address);
+        }
+
+        unbonded
     }
 
-    pub fn redelegate(&mut self, delegator: String, validator_src: String, validator_dst: String, amount: Balance) -> Result<u64, String> {
-        // Simplified redelegation - just move delegation
-        self.undelegate(delegator.clone(), validator_src, amount)?;
-        self.delegate(delegator, validator_dst, amount)?;
+    pub fn set_min_delegation(&mut self, min_delegation: Balance) -> Result<(), String> {
+        if min_delegation == 0 {
+            return Err("Minimum delegation must be positive".to_string());
+        }
+        self.params.min_delegation = min_delegation;
+        Ok(())
+    }
+
+    /// Move stake between validators without unbonding it
+    /// 
+    /// Both ends are checked before anything is moved, so a rejected
+    /// redelegation leaves the source delegation untouched.
+    fn redelegate(&mut self, delegator: String, validator_src: String, validator_dst: String, amount: Balance) -> Result<u64, String> {
+        if validator_src == validator_dst {
+            return Err("Cannot redelegate to the same validator".to_string());
+        }
+        let shares = self.unbond_shares(&delegator, &validator_src, amount)?;
+        self.delegation_target(&validator_dst, amount)?;
+
+        let source = self.remove_delegation_shares(&delegator, &validator_src, shares, amount);
+        // The tokens stay bonded, `delegate_tokens` adds them back to the pool
+        self.pool.bonded_tokens = safe_sub(self.pool.bonded_tokens, amount, "Bonded pool");
+        self.delegate_tokens(&delegator, &validator_dst, amount)?;
+        if delegator == source.operator_address {
+            self.jail_if_below_min_self_delegation(&validator_src);
+        }
+        self.record_history(&delegator, DelegatorEventKind::Redelegate, &validator_src, Some(&validator_dst), amount);
         
-        let completion_time = env::block_timestamp() + self.params.unbonding_time * 1_000_000_000;
-        Ok(completion_time)
+        Ok(time::add_seconds(time::now(), self.params.unbonding_time))
+    }
+
+    // Bond denom enforcement
+
+    pub fn bond_denom(&self) -> String {
+        self.params.bond_denom.clone()
+    }
+
+    /// Change the bond denom
+    /// 
+    /// Only allowed while nothing is staked, since existing bonds would
+    /// otherwise be denominated in the old denom.
+    pub fn set_bond_denom(&mut self, denom: String) -> Result<(), String> {
+        validate_denom(&denom).map_err(|e| format!("Invalid bond denom: {}", e))?;
+        if self.pool.bonded_tokens > 0 || self.pool.not_bonded_tokens > 0 {
+            return Err("Cannot change bond denom while tokens are staked".to_string());
+        }
+
+        env::log_str(&format!("Bond denom changed from {} to {}", self.params.bond_denom, denom));
+        self.params.bond_denom = denom;
+        Ok(())
+    }
+
+    /// Ensure a staking amount is denominated in the bond denom
+    pub fn validate_bond_denom(&self, denom: &str) -> Result<(), String> {
+        if denom != self.params.bond_denom {
+            return Err(format!(
+                "Invalid coin denomination: got {}, expected {}",
+                denom, self.params.bond_denom
+            ));
+        }
+        Ok(())
+    }
+
+    /// Total a list of coins that must all be in the bond denom
+    pub fn validate_bond_coins(&self, coins: &[(String, Balance)]) -> Result<Balance, String> {
+        if coins.is_empty() {
+            return Err("No coins provided".to_string());
+        }
+        if coins.iter().any(|(denom, _)| denom != &coins[0].0) {
+            return Err("Mixed denominations are not supported for staking".to_string());
+        }
+        self.validate_bond_denom(&coins[0].0)?;
+
+        coins.iter().try_fold(0 as Balance, |total, (_, amount)| {
+            total.checked_add(*amount).ok_or_else(|| "Amount overflow".to_string())
+        })
+    }
+
+    pub fn delegate_coin(&mut self, delegator: String, validator_address: String, denom: &str, amount: Balance) -> Result<(), String> {
+        self.validate_bond_denom(denom)?;
+        self.delegate(delegator, validator_address, amount)
+    }
+
+    pub fn undelegate_coin(&mut self, delegator: String, validator_address: String, denom: &str, amount: Balance) -> Result<u64, String> {
+        self.validate_bond_denom(denom)?;
+        self.undelegate(delegator, validator_address, amount)
+    }
+
+    pub fn redelegate_coin(&mut self, delegator: String, validator_src: String, validator_dst: String, denom: &str, amount: Balance) -> Result<u64, String> {
+        self.validate_bond_denom(denom)?;
+        self.redelegate(delegator, validator_src, validator_dst, amount)
     }
 
     // Query functions
@@ -366,31 +744,148 @@ impl StakingModule {
 
     // Rewards and slashing
     pub fn withdraw_delegator_reward(&mut self, delegator: String, validator_address: String) -> Result<Balance, String> {
-        // Simplified reward calculation - 5% of delegation
-        if let Some(delegation) = self.get_delegation(delegator, validator_address) {
-            let shares: Balance = delegation.shares.parse().map_err(|_| "Invalid shares")?;
-            let reward = shares * 5 / 100; // 5% reward
-            Ok(reward)
-        } else {
-            Err("Delegation not found".to_string())
+        let validator = self.validators.get(&validator_address)
+            .ok_or("Validator not found")?;
+
+        let delegation = self.get_delegation(delegator.clone(), validator_address.clone());
+        if let Some(delegation) = &delegation {
+            let tokens = self.delegation_tokens(delegation);
+            self.settle_rewards(&delegator, &validator, tokens);
+        }
+
+        // Fully unbonded delegations may still hold settled rewards
+        let reward = self.distribution.take_accrued(&delegator, &validator_address);
+        if delegation.is_none() && reward == 0 {
+            return Err("Delegation not found".to_string());
+        }
+        if reward > 0 {
+            self.record_history(&delegator, DelegatorEventKind::Reward, &validator_address, None, reward);
+        }
+        env::log_str(&format!("Withdrew {} rewards for {} from {}", reward, delegator, validator_address));
+        Ok(reward)
+    }
+
+    /// Settle a delegation's rewards before its stake changes to `new_stake`
+    fn settle_rewards(&mut self, delegator: &str, validator: &Validator, new_stake: Balance) {
+        let rewards = self.distribution.settle(delegator, &validator.address, validator.tokens, new_stake);
+        self.distribution.credit(delegator, &validator.address, rewards);
+    }
+
+    /// Allocate rewards to a validator and its delegators
+    /// 
+    /// Jailed or inactive validators earn nothing; their share is withheld.
+    pub fn allocate_rewards(&mut self, validator_address: String, amount: Balance) -> Result<Balance, String> {
+        let validator = self.validators.get(&validator_address)
+            .ok_or("Validator not found")?;
+
+        if validator.jailed || validator.status != ValidatorStatus::Bonded {
+            self.distribution.withhold(amount);
+            return Ok(0);
+        }
+        Ok(self.distribution.allocate(&validator_address, amount))
+    }
+
+    /// Return a jailed validator to the active set
+    pub fn unjail_validator(&mut self, validator_address: String) -> Result<(), String> {
+        let mut validator = self.validators.get(&validator_address)
+            .ok_or("Validator not found")?;
+
+        if !validator.jailed {
+            return Err("Validator is not jailed".to_string());
         }
+        if self.governance_jailed.contains(&validator_address) {
+            return Err("Validator was removed by governance and needs a validator set override to return".to_string());
+        }
+        if self.get_self_delegation(validator_address.clone()) < validator.min_self_delegation {
+            return Err("Self delegation is below the minimum self delegation".to_string());
+        }
+
+        validator.jailed = false;
+        validator.status = ValidatorStatus::Bonded;
+        self.validators.insert(&validator_address, &validator);
+        self.distribution.set_eligibility(&validator_address, true, validator.tokens, env::block_height());
+
+        env::log_str(&format!("Unjailed validator: {}", validator_address));
+        Ok(())
+    }
+
+    pub fn get_reward_period_records(&self, validator_address: String) -> Vec<PeriodRecord> {
+        self.distribution.get_period_records(&validator_address)
+    }
+
+    pub fn get_withheld_rewards(&self) -> Balance {
+        self.distribution.get_withheld()
+    }
+
+    fn record_history(
+        &mut self,
+        delegator: &str,
+        kind: DelegatorEventKind,
+        validator_address: &str,
+        dst_validator_address: Option<&str>,
+        amount: Balance,
+    ) {
+        let mut history = self.delegator_history.get(&delegator.to_string()).unwrap_or_default();
+        history.push(DelegatorHistoryEntry {
+            height: env::block_height(),
+            timestamp: env::block_timestamp(),
+            kind,
+            validator_address: validator_address.to_string(),
+            dst_validator_address: dst_validator_address.map(|address| address.to_string()),
+            amount,
+        });
+        if history.len() > MAX_HISTORY_ENTRIES {
+            history.remove(0);
+        }
+        self.delegator_history.insert(&delegator.to_string(), &history);
+    }
+
+    /// Delegations, undelegations, rewards and slashes of a delegator
+    /// recorded between two heights, both inclusive
+    pub fn delegator_history(&self, delegator: String, from_height: u64, to_height: u64) -> Vec<DelegatorHistoryEntry> {
+        self.delegator_history.get(&delegator)
+            .unwrap_or_default()
+            .into_iter()
+            .filter(|entry| entry.height >= from_height && entry.height <= to_height)
+            .collect()
     }
 
     pub fn slash_validator(&mut self, validator_address: String, _height: u64, _power: u64, slash_fraction: String) -> Result<Balance, String> {
         let mut validator = self.validators.get(&validator_address)
             .ok_or("Validator not found")?;
 
-        let slash_rate: f64 = slash_fraction.parse().map_err(|_| "Invalid slash fraction")?;
-        let slashed_amount = (validator.tokens as f64 * slash_rate) as Balance;
+        // Exact to 18 decimals; a float would round stakes of 18-decimal denoms
+        let slash_rate = parse_decimal(&slash_fraction, SLASH_FRACTION_DECIMALS)
+            .map_err(|e| format!("Invalid slash fraction: {}", e))?;
+        let one = 10u128.pow(SLASH_FRACTION_DECIMALS);
+        if slash_rate > one {
+            return Err(format!("Slash fraction {} exceeds 1", slash_fraction));
+        }
+        let slashed_amount = mul_div_floor(validator.tokens, slash_rate, one, "Slash");
         
-        validator.tokens -= slashed_amount;
+        // Rewards earned before the infraction are paid on the pre-slash stake
+        self.distribution.slash(&validator_address, validator.tokens, slashed_amount);
+        self.distribution.set_eligibility(&validator_address, false, validator.tokens - slashed_amount, env::block_height());
+
+        // Each delegation loses its pro-rata part of the slashed tokens
+        if validator.tokens > 0 {
+            for delegation in self.get_validator_delegations(validator_address.clone()) {
+                let loss = mul_div_floor(self.delegation_tokens(&delegation), slashed_amount, validator.tokens, "Slash loss");
+                if loss > 0 {
+                    self.record_history(&delegation.delegator_address, DelegatorEventKind::Slash, &validator_address, None, loss);
+                }
+            }
+        }
+
+        validator.tokens = safe_sub(validator.tokens, slashed_amount, "Validator tokens");
         validator.jailed = true;
         validator.status = ValidatorStatus::Unbonding;
         
         self.validators.insert(&validator_address, &validator);
-        self.pool.bonded_tokens -= slashed_amount;
+        self.pool.bonded_tokens = safe_sub(self.pool.bonded_tokens, slashed_amount, "Bonded pool");
 
         env::log_str(&format!("Slashed validator {} by {}", validator_address, slashed_amount));
+        self.unbond_dust_delegations(&validator_address);
         Ok(slashed_amount)
     }
 
@@ -414,8 +909,289 @@ impl StakingModule {
         env::log_str("Staking module begin block processing");
     }
 
-    pub fn end_block(&mut self, _height: u64) {
+    pub fn end_block(&mut self, height: u64) {
         // End block processing - finalize validator updates, distribute rewards, etc.
         env::log_str("Staking module end block processing");
+        self.maybe_snapshot_voting_power(height);
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn setup_module() -> StakingModule {
+        let mut module = StakingModule::new();
+        module.create_validator(
+            "validator1".to_string(),
+            vec![1; 32],
+            "Validator One".to_string(),
+            None,
+            None,
+            None,
+            None,
+            "0.1".to_string(),
+            "0.2".to_string(),
+            "0.01".to_string(),
+            1,
+            1000,
+        ).unwrap();
+        module
+    }
+
+    #[test]
+    fn test_delegation_requires_bond_denom() {
+        let mut module = setup_module();
+        assert_eq!(module.bond_denom(), "stake");
+
+        assert!(module.delegate_coin("alice.near".to_string(), "validator1".to_string(), "unear", 100).is_err());
+        module.delegate_coin("alice.near".to_string(), "validator1".to_string(), "stake", 100).unwrap();
+
+        assert!(module.undelegate_coin("alice.near".to_string(), "validator1".to_string(), "uatom", 10).is_err());
+        module.undelegate_coin("alice.near".to_string(), "validator1".to_string(), "stake", 10).unwrap();
+    }
+
+    #[test]
+    fn test_mixed_denoms_rejected() {
+        let module = setup_module();
+
+        let coins = vec![("stake".to_string(), 10), ("stake".to_string(), 5)];
+        assert_eq!(module.validate_bond_coins(&coins), Ok(15));
+
+        let mixed = vec![("stake".to_string(), 10), ("unear".to_string(), 5)];
+        assert!(module.validate_bond_coins(&mixed).unwrap_err().contains("Mixed"));
+
+        assert!(module.validate_bond_coins(&[("unear".to_string(), 10)]).is_err());
+        assert!(module.validate_bond_coins(&[]).is_err());
+    }
+
+    #[test]
+    fn test_dust_delegation_rejected() {
+        let mut module = setup_module();
+        module.set_min_delegation(50).unwrap();
+        assert!(module.set_min_delegation(0).is_err());
+
+        let result = module.delegate("alice.near".to_string(), "validator1".to_string(), 49);
+        assert!(result.unwrap_err().contains("below the minimum"));
+
+        module.delegate("alice.near".to_string(), "validator1".to_string(), 50).unwrap();
+        module.delegate("alice.near".to_string(), "validator1".to_string(), 60).unwrap();
+        let delegation = module.get_delegation("alice.near".to_string(), "validator1".to_string()).unwrap();
+        assert_eq!(delegation.shares, "110");
+    }
+
+    #[test]
+    fn test_slash_unbonds_dust_delegations() {
+        let mut module = setup_module();
+        module.set_min_delegation(100).unwrap();
+        module.delegate("alice.near".to_string(), "validator1".to_string(), 100).unwrap();
+        module.delegate("bob.near".to_string(), "validator1".to_string(), 1000).unwrap();
+
+        // Validator holds 2100 tokens, slashing 10% leaves alice with 90
+        module.slash_validator("validator1".to_string(), 1, 0, "0.1".to_string()).unwrap();
+
+        assert!(module.get_delegation("alice.near".to_string(), "validator1".to_string()).is_none());
+        let unbonding = module.get_unbonding_delegation("alice.near".to_string(), "validator1".to_string()).unwrap();
+        assert_eq!(unbonding.entries[0].balance, 90);
+
+        let bob = module.get_delegation("bob.near".to_string(), "validator1".to_string()).unwrap();
+        assert_eq!(module.delegation_tokens(&bob), 900);
+    }
+
+    #[test]
+    fn test_shares_follow_tokens_per_share_after_slash() {
+        let mut module = setup_module();
+        module.delegate("alice.near".to_string(), "validator1".to_string(), 1000).unwrap();
+        module.slash_validator("validator1".to_string(), 1, 0, "0.5".to_string()).unwrap();
+        module.unjail_validator("validator1".to_string()).unwrap();
+
+        // Alice's 1000 shares are worth 500 tokens now
+        let result = module.undelegate("alice.near".to_string(), "validator1".to_string(), 1000);
+        assert_eq!(result.unwrap_err(), "Insufficient delegation");
+
+        // Bob pays the post-slash price and gets twice the shares
+        module.delegate("bob.near".to_string(), "validator1".to_string(), 500).unwrap();
+        let bob = module.get_delegation("bob.near".to_string(), "validator1".to_string()).unwrap();
+        assert_eq!(bob.shares, "1000");
+        assert_eq!(module.delegation_tokens(&bob), 500);
+
+        module.undelegate("alice.near".to_string(), "validator1".to_string(), 200).unwrap();
+        let alice = module.get_delegation("alice.near".to_string(), "validator1".to_string()).unwrap();
+        assert_eq!(alice.shares, "600");
+        assert_eq!(module.delegation_tokens(&alice), 300);
+        let unbonding = module.get_unbonding_delegation("alice.near".to_string(), "validator1".to_string()).unwrap();
+        assert_eq!(unbonding.entries[0].balance, 200);
+    }
+
+    #[test]
+    fn test_unbonding_rounds_the_burned_shares_up() {
+        let mut module = setup_module();
+        module.slash_validator("validator1".to_string(), 1, 0, "0.4".to_string()).unwrap();
+
+        // 1000 shares back 600 tokens, a single token costs two shares
+        module.undelegate("validator1".to_string(), "validator1".to_string(), 1).unwrap();
+        let delegation = module.get_delegation("validator1".to_string(), "validator1".to_string()).unwrap();
+        assert_eq!(delegation.shares, "998");
+        let validator = module.get_validator("validator1".to_string()).unwrap();
+        assert_eq!((validator.tokens, validator.delegator_shares.as_str()), (599, "998"));
+    }
+
+    #[test]
+    fn test_rejected_redelegation_moves_nothing() {
+        let mut module = setup_module();
+        module.create_validator(
+            "validator2".to_string(), vec![2; 32], "Validator Two".to_string(),
+            None, None, None, None,
+            "0.1".to_string(), "0.2".to_string(), "0.01".to_string(),
+            1, 1000,
+        ).unwrap();
+        module.delegate("alice.near".to_string(), "validator1".to_string(), 1000).unwrap();
+        module.slash_validator("validator2".to_string(), 1, 0, "0.0".to_string()).unwrap();
+        let bonded = module.pool.bonded_tokens;
+
+        let result = module.redelegate("alice.near".to_string(), "validator1".to_string(), "validator2".to_string(), 400);
+        assert_eq!(result.unwrap_err(), "Validator not bonded");
+        module.set_min_delegation(500).unwrap();
+        assert!(module.redelegate("alice.near".to_string(), "validator1".to_string(), "validator3".to_string(), 400).is_err());
+
+        let alice = module.get_delegation("alice.near".to_string(), "validator1".to_string()).unwrap();
+        assert_eq!(alice.shares, "1000");
+        assert!(module.get_unbonding_delegation("alice.near".to_string(), "validator1".to_string()).is_none());
+        assert_eq!(module.pool.bonded_tokens, bonded);
+
+        module.unjail_validator("validator2".to_string()).unwrap();
+        module.redelegate("alice.near".to_string(), "validator1".to_string(), "validator2".to_string(), 500).unwrap();
+        assert!(module.get_unbonding_delegation("alice.near".to_string(), "validator1".to_string()).is_none());
+        assert_eq!(module.pool.bonded_tokens, bonded);
     }
-}
\ No newline at end of file
+
+    #[test]
+    fn test_stakes_of_18_decimal_denoms() {
+        let mut module = setup_module();
+        // A trillion tokens with 18 decimals each, their product overflows u128
+        let stake = 10u128.pow(30);
+        module.delegate("alice.near".to_string(), "validator1".to_string(), stake).unwrap();
+        module.delegate("bob.near".to_string(), "validator1".to_string(), stake).unwrap();
+
+        let alice = module.get_delegation("alice.near".to_string(), "validator1".to_string()).unwrap();
+        assert_eq!(module.delegation_tokens(&alice), stake);
+        assert!(module.delegate("carol.near".to_string(), "validator1".to_string(), Balance::MAX).unwrap_err().contains("overflows"));
+
+        assert!(module.slash_validator("validator1".to_string(), 1, 0, "1.5".to_string()).is_err());
+        module.slash_validator("validator1".to_string(), 1, 0, "0.000000000000000001".to_string()).unwrap();
+        let validator = module.get_validator("validator1".to_string()).unwrap();
+        assert_eq!(validator.tokens, 2 * stake + 1000 - (2 * stake + 1000) / 10u128.pow(18));
+    }
+
+    #[test]
+    fn test_self_delegation_tracking() {
+        let mut module = setup_module();
+        assert_eq!(module.get_self_delegation("validator1".to_string()), 1000);
+
+        module.delegate("alice.near".to_string(), "validator1".to_string(), 500).unwrap();
+        assert_eq!(module.get_self_delegation("validator1".to_string()), 1000);
+
+        let result = module.edit_validator("validator1".to_string(), None, None, None, None, None, None, Some(2000));
+        assert!(result.is_err());
+    }
+
+    #[test]
+    fn test_auto_jail_below_min_self_delegation() {
+        let mut module = setup_module();
+        module.edit_validator("validator1".to_string(), None, None, None, None, None, None, Some(600)).unwrap();
+
+        module.undelegate("validator1".to_string(), "validator1".to_string(), 300).unwrap();
+        assert!(!module.get_validator("validator1".to_string()).unwrap().jailed);
+
+        // Other delegators never trigger the jail
+        module.delegate("alice.near".to_string(), "validator1".to_string(), 500).unwrap();
+        module.undelegate("alice.near".to_string(), "validator1".to_string(), 500).unwrap();
+        assert!(!module.get_validator("validator1".to_string()).unwrap().jailed);
+
+        module.undelegate("validator1".to_string(), "validator1".to_string(), 200).unwrap();
+        let validator = module.get_validator("validator1".to_string()).unwrap();
+        assert!(validator.jailed);
+        assert_eq!(validator.status, ValidatorStatus::Unbonding);
+        assert_eq!(module.get_self_delegation("validator1".to_string()), 500);
+    }
+
+    #[test]
+    fn test_rewards_accrue_to_delegators() {
+        let mut module = setup_module();
+        module.delegate("alice.near".to_string(), "validator1".to_string(), 1000).unwrap();
+
+        module.allocate_rewards("validator1".to_string(), 200).unwrap();
+
+        assert_eq!(module.withdraw_delegator_reward("alice.near".to_string(), "validator1".to_string()), Ok(100));
+        assert_eq!(module.withdraw_delegator_reward("validator1".to_string(), "validator1".to_string()), Ok(100));
+        assert_eq!(module.withdraw_delegator_reward("alice.near".to_string(), "validator1".to_string()), Ok(0));
+        assert!(module.withdraw_delegator_reward("bob.near".to_string(), "validator1".to_string()).is_err());
+    }
+
+    #[test]
+    fn test_rewards_withheld_while_jailed() {
+        let mut module = setup_module();
+        module.delegate("alice.near".to_string(), "validator1".to_string(), 1000).unwrap();
+        module.allocate_rewards("validator1".to_string(), 200).unwrap();
+
+        module.slash_validator("validator1".to_string(), 1, 0, "0.0".to_string()).unwrap();
+        assert_eq!(module.allocate_rewards("validator1".to_string(), 500), Ok(0));
+        assert_eq!(module.get_withheld_rewards(), 500);
+
+        module.unjail_validator("validator1".to_string()).unwrap();
+        module.allocate_rewards("validator1".to_string(), 100).unwrap();
+
+        assert_eq!(module.withdraw_delegator_reward("alice.near".to_string(), "validator1".to_string()), Ok(150));
+
+        let records = module.get_reward_period_records("validator1".to_string());
+        assert_eq!(records.len(), 2);
+        assert!(!records[0].eligible);
+        assert!(records[1].eligible);
+    }
+
+    #[test]
+    fn test_delegator_history() {
+        let mut module = setup_module();
+        module.create_validator(
+            "validator2".to_string(), vec![2; 32], "Validator Two".to_string(),
+            None, None, None, None,
+            "0.1".to_string(), "0.2".to_string(), "0.01".to_string(),
+            1, 1000,
+        ).unwrap();
+
+        module.delegate("alice.near".to_string(), "validator1".to_string(), 1000).unwrap();
+        module.allocate_rewards("validator1".to_string(), 200).unwrap();
+        module.withdraw_delegator_reward("alice.near".to_string(), "validator1".to_string()).unwrap();
+        module.redelegate("alice.near".to_string(), "validator1".to_string(), "validator2".to_string(), 400).unwrap();
+        module.undelegate("alice.near".to_string(), "validator1".to_string(), 100).unwrap();
+        module.slash_validator("validator2".to_string(), 1, 0, "0.5".to_string()).unwrap();
+
+        let history = module.delegator_history("alice.near".to_string(), 0, u64::MAX);
+        let kinds: Vec<DelegatorEventKind> = history.iter().map(|entry| entry.kind.clone()).collect();
+        assert_eq!(kinds, vec![
+            DelegatorEventKind::Delegate,
+            DelegatorEventKind::Reward,
+            DelegatorEventKind::Redelegate,
+            DelegatorEventKind::Undelegate,
+            DelegatorEventKind::Slash,
+        ]);
+        assert_eq!(history[1].amount, 100);
+        assert_eq!(history[2].dst_validator_address, Some("validator2".to_string()));
+        assert_eq!(history[4].amount, 200);
+
+        let current_height = history[0].height;
+        assert!(module.delegator_history("alice.near".to_string(), current_height + 1, u64::MAX).is_empty());
+        assert!(module.delegator_history("bob.near".to_string(), 0, u64::MAX).is_empty());
+    }
+
+    #[test]
+    fn test_set_bond_denom() {
+        let mut module = StakingModule::new();
+        assert!(module.set_bond_denom("1bad".to_string()).is_err());
+        module.set_bond_denom("unear".to_string()).unwrap();
+        assert_eq!(module.get_params().bond_denom, "unear");
+
+        let mut staked = setup_module();
+        assert!(staked.set_bond_denom("unear".to_string()).is_err());
+    }
+}
@@ -0,0 +1,333 @@
+/// Bonded and Not-Bonded Pools
+///
+/// Staked tokens are held by two module accounts, as in the Cosmos SDK:
+/// `bonded_tokens_pool` backs the stake of bonded validators and
+/// `not_bonded_tokens_pool` holds tokens waiting out the unbonding period.
+/// Delegating moves spendable tokens from the delegator into the bonded
+/// pool. Starting an undelegation returns them to the delegator under a
+/// bank lock that lapses when the unbonding period ends, so they cannot be
+/// spent or delegated again before; completing it releases the lock.
+/// Unbondings the module starts itself, such as dust delegations after a
+/// slash, wait in the not-bonded pool and are paid out from it. All of it
+/// moves in the bond denom, which need not be the bank's native denom. The
+/// `Pool` totals must always match the bond denom balances of the two
+/// accounts and the locked unbondings, see `check_pool_invariant`.
+
+use near_sdk::{env, AccountId};
+
+use super::StakingModule;
+use super::expected_keepers::BankKeeper;
+use crate::modules::jobs::{JobProgress, JobState, JobStep};
+use crate::math::{safe_add, safe_sub};
+use crate::Balance;
+
+pub const BONDED_POOL_NAME: &str = "bonded_tokens_pool";
+pub const NOT_BONDED_POOL_NAME: &str = "not_bonded_tokens_pool";
+
+/// Job paying out matured unbondings
+pub const UNBONDING_JOB: &str = "complete_unbonding";
+
+fn pool_account(name: &str) -> AccountId {
+    format!("{}.{}", name, env::current_account_id())
+        .parse()
+        .expect("Pool account is valid")
+}
+
+/// Module account holding bonded stake
+pub fn bonded_pool_account() -> AccountId {
+    pool_account(BONDED_POOL_NAME)
+}
+
+/// Module account holding unbonding stake
+pub fn not_bonded_pool_account() -> AccountId {
+    pool_account(NOT_BONDED_POOL_NAME)
+}
+
+impl StakingModule {
+    /// Delegate tokens from the delegator's bank balance
+    pub fn delegate_from_bank(
+        &mut self,
+        bank: &mut dyn BankKeeper,
+        delegator: &AccountId,
+        validator_address: String,
+        amount: Balance,
+    ) -> Result<(), String> {
+        let bond_denom = self.bond_denom();
+        if bank.get_spendable_balance(delegator, &bond_denom) < amount {
+            return Err(format!("{} has insufficient spendable balance to delegate {}{}", delegator, amount, bond_denom));
+        }
+        self.delegate_coin(delegator.to_string(), validator_address, &bond_denom, amount)?;
+        bank.transfer_denom_with_reason(delegator, &bonded_pool_account(), &bond_denom, amount, "staking", "delegate");
+        Ok(())
+    }
+
+    /// Start an undelegation, returning its tokens to the delegator locked
+    /// until the completion time
+    pub fn undelegate_to_bank(
+        &mut self,
+        bank: &mut dyn BankKeeper,
+        delegator: &AccountId,
+        validator_address: String,
+        amount: Balance,
+    ) -> Result<u64, String> {
+        let bond_denom = self.bond_denom();
+        let completion_time = self.undelegate_coin(delegator.to_string(), validator_address.clone(), &bond_denom, amount)?;
+        bank.transfer_denom_with_reason(&bonded_pool_account(), delegator, &bond_denom, amount, "staking", "undelegate");
+        // The undelegation is already booked, a failed lock must roll it back
+        let lock_id = bank.lock_coins(delegator, &bond_denom, amount, "staking", Some(completion_time))
+            .unwrap_or_else(|error| env::panic_str(&error));
+
+        let key = format!("{}#{}", delegator, validator_address);
+        let mut unbonding = self.unbonding_delegations.get(&key).expect("Unbonding was just recorded");
+        if let Some(entry) = unbonding.entries.last_mut() {
+            entry.lock_id = Some(lock_id);
+        }
+        self.unbonding_delegations.insert(&key, &unbonding);
+        self.unbonding_locked = safe_add(self.unbonding_locked, amount, "Locked unbonding");
+        Ok(completion_time)
+    }
+
+    /// Slash a validator, burning the slashed stake from the bonded pool
+    pub fn slash_validator_from_bank(
+        &mut self,
+        bank: &mut dyn BankKeeper,
+        validator_address: String,
+        height: u64,
+        power: u64,
+        slash_fraction: String,
+    ) -> Result<Balance, String> {
+        let not_bonded_before = self.pool.not_bonded_tokens;
+        let slashed = self.slash_validator(validator_address, height, power, slash_fraction)?;
+
+        let bond_denom = self.bond_denom();
+        bank.burn_with_reason(&bonded_pool_account(), &bond_denom, slashed, "staking", "slash");
+        // Dust delegations unbonded by the slash start their unbonding too
+        let unbonded = self.pool.not_bonded_tokens - not_bonded_before;
+        if unbonded > 0 {
+            bank.transfer_denom_with_reason(&bonded_pool_account(), &not_bonded_pool_account(), &bond_denom, unbonded, "staking", "slash_unbond");
+        }
+        Ok(slashed)
+    }
+
+    /// Pay out unbonding entries that matured by `now`
+    ///
+    /// Returns the delegators paid with their amounts. Locked entries are
+    /// released, the others paid from the not-bonded pool. Entries of
+    /// delegators that are not NEAR accounts stay queued.
+    pub fn complete_unbonding(&mut self, bank: &mut dyn BankKeeper, now: u64) -> Vec<(String, Balance)> {
+        let keys: Vec<String> = self.unbonding_delegations.keys().collect();
+        keys.iter()
+            .filter_map(|key| self.complete_unbonding_entry(bank, key, now))
+            .map(|(paid, _)| paid)
+            .collect()
+    }
+
+    /// Pay out matured unbondings, resuming where the last call stopped
+    ///
+    /// Walks at most `budget` unbonding records per call, so a long queue
+    /// is drained over several calls instead of exceeding the gas limit.
+    pub fn process_unbonding_queue(&mut self, bank: &mut dyn BankKeeper, now: u64, budget: Option<u32>) -> JobProgress {
+        let mut job = self.jobs.load(UNBONDING_JOB);
+        let progress = job.run(budget, |cursor| {
+            let key = match self.unbonding_delegations.keys_as_vector().get(cursor) {
+                Some(key) => key,
+                None => return JobStep::Done,
+            };
+            match self.complete_unbonding_entry(bank, &key, now) {
+                // The last record was swapped into the removed one's place
+                Some((_, true)) => JobStep::Continue(cursor),
+                _ => JobStep::Continue(cursor + 1),
+            }
+        });
+        self.jobs.save(&job);
+        progress
+    }
+
+    /// State of a resumable staking job
+    pub fn get_job(&self, name: &str) -> Option<JobState> {
+        self.jobs.get(name)
+    }
+
+    /// Pay out the matured entries of one unbonding record
+    ///
+    /// Returns the delegator paid with the amount, and whether the record
+    /// was removed because nothing is left pending.
+    fn complete_unbonding_entry(&mut self, bank: &mut dyn BankKeeper, key: &String, now: u64) -> Option<((String, Balance), bool)> {
+        let mut unbonding = self.unbonding_delegations.get(key)?;
+        let delegator: AccountId = unbonding.delegator_address.parse().ok()?;
+        let (matured, pending): (Vec<_>, Vec<_>) = unbonding.entries
+            .into_iter()
+            .partition(|entry| entry.completion_time <= now);
+        if matured.is_empty() {
+            return None;
+        }
+
+        let amount: Balance = matured.iter().map(|entry| entry.balance).sum();
+        let removed = pending.is_empty();
+        if removed {
+            self.unbonding_delegations.remove(key);
+        } else {
+            unbonding.entries = pending;
+            self.unbonding_delegations.insert(key, &unbonding);
+        }
+        self.pool.not_bonded_tokens = safe_sub(self.pool.not_bonded_tokens, amount, "Not bonded pool");
+        let mut pooled = 0;
+        for entry in &matured {
+            match entry.lock_id {
+                Some(lock_id) => {
+                    // A lock whose unlock time passed may already be gone
+                    bank.unlock_coins(lock_id, "staking").ok();
+                    self.unbonding_locked = safe_sub(self.unbonding_locked, entry.balance, "Locked unbonding");
+                }
+                None => pooled += entry.balance,
+            }
+        }
+        if pooled > 0 {
+            let bond_denom = self.bond_denom();
+            bank.transfer_denom_with_reason(&not_bonded_pool_account(), &delegator, &bond_denom, pooled, "staking", "complete_unbonding");
+        }
+
+        env::log_str(&format!(
+            "EVENT: complete_unbonding delegator={} validator={} amount={}",
+            delegator, unbonding.validator_address, amount
+        ));
+        Some(((delegator.to_string(), amount), removed))
+    }
+
+    /// Bond denom balances of the bonded and not-bonded pools
+    pub fn pool_balances(&self, bank: &dyn BankKeeper) -> (Balance, Balance) {
+        let bond_denom = self.bond_denom();
+        (
+            bank.get_denom_balance(&bonded_pool_account(), &bond_denom),
+            bank.get_denom_balance(&not_bonded_pool_account(), &bond_denom),
+        )
+    }
+
+    /// Unbonding tokens locked in delegator balances
+    pub fn get_unbonding_locked(&self) -> Balance {
+        self.unbonding_locked
+    }
+
+    /// Check that the pool totals match the pool account balances and the
+    /// locked unbondings
+    pub fn check_pool_invariant(&self, bank: &dyn BankKeeper) -> Result<(), String> {
+        let (bonded, not_bonded) = self.pool_balances(bank);
+        if bonded != self.pool.bonded_tokens {
+            return Err(format!("Bonded pool holds {} but tracks {}", bonded, self.pool.bonded_tokens));
+        }
+        let unbonding = safe_add(not_bonded, self.unbonding_locked, "Unbonding tokens");
+        if unbonding != self.pool.not_bonded_tokens {
+            return Err(format!(
+                "Not-bonded pool holds {} and {} is locked but tracks {}",
+                not_bonded, self.unbonding_locked, self.pool.not_bonded_tokens
+            ));
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::modules::bank::BankModule;
+    use near_sdk::test_utils::VMContextBuilder;
+    use near_sdk::testing_env;
+
+    fn setup() -> (StakingModule, BankModule, AccountId) {
+        let mut staking = StakingModule::new();
+        staking.create_validator(
+            "validator1".to_string(),
+            vec![1; 32],
+            "Validator One".to_string(),
+            None,
+            None,
+            None,
+            None,
+            "0.1".to_string(),
+            "0.2".to_string(),
+            "0.01".to_string(),
+            1,
+            1000,
+        ).unwrap();
+
+        let mut bank = BankModule::new();
+        // Backs validator1's self delegation
+        bank.mint_denom(&bonded_pool_account(), "stake", 1000);
+        let alice: AccountId = "alice.near".parse().unwrap();
+        bank.mint_denom(&alice, "stake", 500);
+        (staking, bank, alice)
+    }
+
+    #[test]
+    fn test_tokens_move_between_pools() {
+        testing_env!(VMContextBuilder::new().block_timestamp(0).build());
+        let (mut staking, mut bank, alice) = setup();
+
+        assert!(staking.delegate_from_bank(&mut bank, &alice, "validator1".to_string(), 600).is_err());
+        staking.delegate_from_bank(&mut bank, &alice, "validator1".to_string(), 400).unwrap();
+        assert_eq!(bank.get_denom_balance(&alice, "stake"), 100);
+        assert_eq!(staking.pool_balances(&bank), (1400, 0));
+        staking.check_pool_invariant(&bank).unwrap();
+
+        let completion_time = staking.undelegate_to_bank(&mut bank, &alice, "validator1".to_string(), 150).unwrap();
+        assert_eq!(staking.pool_balances(&bank), (1250, 0));
+        staking.check_pool_invariant(&bank).unwrap();
+
+        // Unbonding tokens are back in the balance but locked
+        assert_eq!(bank.get_denom_balance(&alice, "stake"), 250);
+        assert_eq!(bank.get_spendable_balance(&alice, "stake"), 100);
+        assert_eq!(bank.get_locks(&alice)[0].module, "staking");
+        assert!(staking.delegate_from_bank(&mut bank, &alice, "validator1".to_string(), 150).unwrap_err().contains("spendable"));
+
+        assert!(staking.complete_unbonding(&mut bank, completion_time - 1).is_empty());
+        assert_eq!(staking.complete_unbonding(&mut bank, completion_time), vec![("alice.near".to_string(), 150)]);
+        assert_eq!(bank.get_spendable_balance(&alice, "stake"), 250);
+        assert!(bank.get_locks(&alice).is_empty());
+        assert!(staking.get_unbonding_delegation("alice.near".to_string(), "validator1".to_string()).is_none());
+        assert_eq!(staking.get_unbonding_locked(), 0);
+        staking.check_pool_invariant(&bank).unwrap();
+    }
+
+    #[test]
+    fn test_slash_burns_from_bonded_pool() {
+        testing_env!(VMContextBuilder::new().build());
+        let (mut staking, mut bank, alice) = setup();
+        // The pools also hold native tokens, which slashing must not touch
+        assert_ne!(staking.bond_denom(), bank.native_denom());
+        bank.mint(&bonded_pool_account(), 70);
+        bank.mint(&alice, 20);
+        staking.delegate_from_bank(&mut bank, &alice, "validator1".to_string(), 500).unwrap();
+
+        let slashed = staking.slash_validator_from_bank(&mut bank, "validator1".to_string(), 1, 0, "0.1".to_string())
+            .unwrap();
+        assert_eq!(slashed, 150);
+        assert_eq!(staking.get_pool().bonded_tokens, 1350);
+        assert_eq!(bank.supply_of("stake"), 1350);
+        assert_eq!(bank.get_balance(&bonded_pool_account()), 70);
+        assert_eq!(bank.get_balance(&alice), 20);
+        staking.check_pool_invariant(&bank).unwrap();
+    }
+
+    #[test]
+    fn test_unbonding_queue_resumes_across_calls() {
+        testing_env!(VMContextBuilder::new().block_timestamp(0).build());
+        let (mut staking, mut bank, _) = setup();
+        let mut completion_time = 0;
+        for name in ["alice.near", "bob.near", "carol.near"] {
+            let delegator: AccountId = name.parse().unwrap();
+            bank.mint_denom(&delegator, "stake", 100);
+            staking.delegate_from_bank(&mut bank, &delegator, "validator1".to_string(), 100).unwrap();
+            completion_time = staking.undelegate_to_bank(&mut bank, &delegator, "validator1".to_string(), 100).unwrap();
+        }
+
+        let progress = staking.process_unbonding_queue(&mut bank, completion_time, Some(2));
+        assert!(!progress.completed);
+        assert_eq!(staking.get_unbonding_locked(), 100);
+
+        let progress = staking.process_unbonding_queue(&mut bank, completion_time, Some(2));
+        assert!(progress.completed);
+        assert_eq!(staking.get_unbonding_locked(), 0);
+        assert_eq!(staking.get_job(UNBONDING_JOB).unwrap().completed_passes, 1);
+        staking.check_pool_invariant(&bank).unwrap();
+    }
+}
@@ -0,0 +1,278 @@
+/// Emergency Validator Set Override
+///
+/// When the consensus keys of many validators are compromised at once,
+/// slashing and rotating them one by one is too slow and needs the very
+/// operators whose keys leaked. `ValidatorSetOverride` replaces the bonded
+/// set wholesale instead: the listed validators are bonded, each with a
+/// fresh consensus key if one is given, and every other bonded validator is
+/// jailed. That jail cannot be lifted by `unjail_validator`, since the
+/// operator whose key leaked would otherwise rejoin at once; only a later
+/// override listing the validator bonds it again. Delegations are left in
+/// place, so stakers of a removed validator can redelegate once the network
+/// is back.
+///
+/// The override is the `ValidatorSetOverride` content of the `staking`
+/// route and staking flags it as emergency content, so governance only
+/// accepts it through `submit_emergency_proposal` with its supermajority
+/// and timelock.
+
+use near_sdk::env;
+use near_sdk::serde::{Deserialize, Serialize};
+use schemars::JsonSchema;
+
+use super::{StakingModule, ValidatorStatus};
+use crate::modules::gov::{ProposalContent, ProposalHandler};
+
+/// Governance route of staking proposals
+pub const STAKING_PROPOSAL_ROUTE: &str = "staking";
+/// Proposal type whose content is a JSON `ValidatorSetOverride`
+pub const VALIDATOR_SET_OVERRIDE: &str = "ValidatorSetOverride";
+
+/// A validator of the replacement set
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct OverrideValidator {
+    pub operator_address: String,
+    /// Replacement for a compromised consensus key
+    #[serde(default)]
+    pub consensus_pubkey: Option<Vec<u8>>,
+}
+
+/// The complete bonded set after the override
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct ValidatorSetOverride {
+    pub validators: Vec<OverrideValidator>,
+}
+
+impl ValidatorSetOverride {
+    pub fn from_content(content: &ProposalContent) -> Result<Self, String> {
+        if content.proposal_type != VALIDATOR_SET_OVERRIDE {
+            return Err(format!("Unknown staking proposal type {}", content.proposal_type));
+        }
+        serde_json::from_str(&content.value).map_err(|e| format!("Invalid validator set override: {}", e))
+    }
+}
+
+impl StakingModule {
+    /// Check an override against the current validators
+    pub fn validate_validator_set_override(&self, set: &ValidatorSetOverride) -> Result<(), String> {
+        if set.validators.is_empty() {
+            return Err("Validator set override cannot leave the set empty".to_string());
+        }
+        if set.validators.len() > self.params.max_validators as usize {
+            return Err(format!(
+                "Validator set override lists {} validators, at most {} can be bonded",
+                set.validators.len(), self.params.max_validators
+            ));
+        }
+        for (index, entry) in set.validators.iter().enumerate() {
+            let validator = self.validators.get(&entry.operator_address)
+                .ok_or_else(|| format!("Validator {} not found", entry.operator_address))?;
+            if set.validators[..index].iter().any(|other| other.operator_address == entry.operator_address) {
+                return Err(format!("Validator {} is listed more than once", entry.operator_address));
+            }
+            let Some(pubkey) = &entry.consensus_pubkey else { continue };
+            if pubkey.is_empty() || *pubkey == validator.consensus_pubkey {
+                return Err(format!("Validator {} needs a new, non-empty consensus key", entry.operator_address));
+            }
+            if let Some(owner) = self.validator_by_consensus_key(pubkey) {
+                return Err(format!("Consensus key for {} was used by validator {}", entry.operator_address, owner));
+            }
+            if set.validators[..index].iter().any(|other| other.consensus_pubkey.as_ref() == Some(pubkey)) {
+                return Err(format!("Consensus key for {} is given to another validator too", entry.operator_address));
+            }
+        }
+        Ok(())
+    }
+
+    /// Make the listed validators the bonded set, returning the jailed ones
+    ///
+    /// Validates again, since validators may have changed during the vote
+    /// and timelock; nothing is applied when any entry is invalid.
+    pub fn apply_validator_set_override(&mut self, proposal_id: u64, set: &ValidatorSetOverride) -> Result<Vec<String>, String> {
+        self.validate_validator_set_override(set)?;
+        let height = env::block_height();
+
+        let mut removed = Vec::new();
+        for mut validator in self.get_bonded_validators() {
+            if set.validators.iter().any(|entry| entry.operator_address == validator.address) {
+                continue;
+            }
+            validator.jailed = true;
+            validator.status = ValidatorStatus::Unbonding;
+            validator.unbonding_height = height;
+            self.validators.insert(&validator.address, &validator);
+            self.distribution.set_eligibility(&validator.address, false, validator.tokens, height);
+            self.governance_jailed.insert(&validator.address);
+            env::log_str(&format!(
+                "EVENT: validator_set_override_removed proposal_id={} validator={} tokens={}",
+                proposal_id, validator.address, validator.tokens
+            ));
+            removed.push(validator.address);
+        }
+
+        for entry in &set.validators {
+            let mut validator = self.validators.get(&entry.operator_address).expect("validated above");
+            let was_bonded = validator.status == ValidatorStatus::Bonded && !validator.jailed;
+            let new_key = entry.consensus_pubkey.clone()
+                .map(|pubkey| self.record_key_rotation(&entry.operator_address, &mut validator, pubkey).new_pubkey);
+            validator.jailed = false;
+            validator.status = ValidatorStatus::Bonded;
+            self.validators.insert(&entry.operator_address, &validator);
+            self.governance_jailed.remove(&entry.operator_address);
+            if !was_bonded {
+                self.distribution.set_eligibility(&entry.operator_address, true, validator.tokens, height);
+            }
+            env::log_str(&format!(
+                "EVENT: validator_set_override_bonded proposal_id={} validator={} was_bonded={} new_pubkey={}",
+                proposal_id,
+                entry.operator_address,
+                was_bonded,
+                new_key.map_or("none".to_string(), |pubkey| hex::encode(pubkey))
+            ));
+        }
+
+        env::log_str(&format!(
+            "EVENT: validator_set_override proposal_id={} height={} bonded={} removed={}",
+            proposal_id, height, set.validators.len(), removed.len()
+        ));
+        Ok(removed)
+    }
+}
+
+impl ProposalHandler for StakingModule {
+    fn validate_content(&self, content: &ProposalContent) -> Result<(), String> {
+        self.validate_validator_set_override(&ValidatorSetOverride::from_content(content)?)
+    }
+
+    fn execute_content(&mut self, proposal_id: u64, content: &ProposalContent) -> Result<(), String> {
+        self.apply_validator_set_override(proposal_id, &ValidatorSetOverride::from_content(content)?).map(|_| ())
+    }
+
+    fn requires_emergency(&self, content: &ProposalContent) -> bool {
+        content.proposal_type == VALIDATOR_SET_OVERRIDE
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::modules::gov::{GovernanceModule, ProposalRouter, ProposalStatus};
+    use near_sdk::test_utils::VMContextBuilder;
+    use near_sdk::{testing_env, AccountId};
+
+    fn at_height(height: u64) {
+        testing_env!(VMContextBuilder::new().block_height(height).build());
+    }
+
+    fn create(staking: &mut StakingModule, address: &str, pubkey: Vec<u8>) {
+        staking.create_validator(
+            address.to_string(),
+            pubkey,
+            address.to_string(),
+            None,
+            None,
+            None,
+            None,
+            "0.1".to_string(),
+            "0.2".to_string(),
+            "0.01".to_string(),
+            1,
+            1_000,
+        ).unwrap();
+    }
+
+    fn override_content(validators: Vec<OverrideValidator>) -> ProposalContent {
+        ProposalContent {
+            route: STAKING_PROPOSAL_ROUTE.to_string(),
+            proposal_type: VALIDATOR_SET_OVERRIDE.to_string(),
+            value: serde_json::to_string(&ValidatorSetOverride { validators }).unwrap(),
+        }
+    }
+
+    fn entry(address: &str, pubkey: Option<Vec<u8>>) -> OverrideValidator {
+        OverrideValidator { operator_address: address.to_string(), consensus_pubkey: pubkey }
+    }
+
+    #[test]
+    fn test_override_through_emergency_proposal() {
+        at_height(10);
+        let mut staking = StakingModule::new();
+        create(&mut staking, "val1", vec![1]);
+        create(&mut staking, "val2", vec![2]);
+        create(&mut staking, "val3", vec![3]);
+
+        let mut gov = GovernanceModule::new();
+        let proposal_id = {
+            let mut router = ProposalRouter::new();
+            router.add_route(STAKING_PROPOSAL_ROUTE, &mut staking).unwrap();
+            gov.submit_emergency_proposal(
+                &"alice.near".parse::<AccountId>().unwrap(),
+                "Recover from key leak".to_string(),
+                "Keep val1 under a new key, drop the others".to_string(),
+                override_content(vec![entry("val1", Some(vec![9]))]),
+                &mut router,
+                String::new(),
+                10,
+            )
+        };
+        gov.snapshot_stake(proposal_id, &staking, 10);
+        for voter in ["val1", "val2", "val3"] {
+            gov.vote(&voter.parse().unwrap(), proposal_id, 1, String::new());
+        }
+        gov.end_block(60);
+        assert_eq!(gov.get_proposal(proposal_id).unwrap().status, ProposalStatus::Scheduled);
+        gov.end_block(60 + gov.emergency_params().timelock_blocks);
+
+        at_height(2_000);
+        let mut router = ProposalRouter::new();
+        router.add_route(STAKING_PROPOSAL_ROUTE, &mut staking).unwrap();
+        assert!(gov.execute_approved_content(&mut router)[0].1.is_ok());
+
+        let bonded: Vec<String> = staking.get_bonded_validators().into_iter().map(|v| v.address).collect();
+        assert_eq!(bonded, vec!["val1".to_string()]);
+        assert!(staking.get_validator("val2".to_string()).unwrap().jailed);
+        assert_eq!(staking.get_validator("val1".to_string()).unwrap().consensus_pubkey, vec![9]);
+        assert_eq!(staking.validator_by_consensus_key(&[1]), Some("val1".to_string()));
+
+        // The operator cannot unjail itself back into the set
+        assert!(staking.unjail_validator("val2".to_string()).unwrap_err().contains("governance"));
+    }
+
+    #[test]
+    fn test_later_override_restores_removed_validator() {
+        at_height(10);
+        let mut staking = StakingModule::new();
+        create(&mut staking, "val1", vec![1]);
+        create(&mut staking, "val2", vec![2]);
+
+        staking.apply_validator_set_override(1, &ValidatorSetOverride { validators: vec![entry("val1", None)] }).unwrap();
+        assert!(staking.unjail_validator("val2".to_string()).is_err());
+
+        staking.apply_validator_set_override(2, &ValidatorSetOverride { validators: vec![entry("val1", None), entry("val2", Some(vec![5]))] }).unwrap();
+        assert_eq!(staking.get_bonded_validators().len(), 2);
+
+        // An ordinary jail is lifted by the operator as before
+        staking.slash_validator("val2".to_string(), 10, 0, "0.0".to_string()).unwrap();
+        staking.unjail_validator("val2".to_string()).unwrap();
+    }
+
+    #[test]
+    fn test_override_validation() {
+        at_height(10);
+        let mut staking = StakingModule::new();
+        create(&mut staking, "val1", vec![1]);
+        create(&mut staking, "val2", vec![2]);
+
+        let check = |validators| staking.validate_content(&override_content(validators));
+        assert!(check(vec![]).is_err());
+        assert!(check(vec![entry("val9", None)]).is_err());
+        assert!(check(vec![entry("val1", None), entry("val1", None)]).is_err());
+        assert!(check(vec![entry("val1", Some(vec![2]))]).is_err());
+        assert!(check(vec![entry("val1", Some(vec![7])), entry("val2", Some(vec![7]))]).is_err());
+        assert!(check(vec![entry("val1", Some(vec![7])), entry("val2", None)]).is_ok());
+
+        // A rejected override changes nothing
+        assert!(staking.apply_validator_set_override(1, &ValidatorSetOverride { validators: vec![entry("val9", None)] }).is_err());
+        assert_eq!(staking.get_bonded_validators().len(), 2);
+    }
+}
@@ -0,0 +1,185 @@
+/// Consensus Key Rotation
+///
+/// A validator whose consensus key may be compromised would otherwise have
+/// to unbond and start over under a new key, losing its delegations on the
+/// way. `rotate_validator_key` swaps the key in place instead. Rotations
+/// are rate limited by `KEY_ROTATION_COOLDOWN_BLOCKS` so a validator cannot
+/// cycle keys to muddy the trail of an infraction, and every past key is
+/// kept with the heights it signed for: evidence about a double sign at
+/// some height is still attributed to the validator that held the key
+/// then, and a retired key can never be taken by another validator.
+///
+/// The operator address stays the validator's identity and does not change.
+
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::env;
+use near_sdk::serde::{Deserialize, Serialize};
+use schemars::JsonSchema;
+
+use super::{StakingModule, Validator};
+
+/// Blocks a validator has to wait between two rotations, about a day
+pub const KEY_ROTATION_COOLDOWN_BLOCKS: u64 = 86_400;
+
+/// A consensus key that was replaced
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct KeyRotation {
+    pub old_pubkey: Vec<u8>,
+    pub new_pubkey: Vec<u8>,
+    /// First height signed with `new_pubkey`
+    pub height: u64,
+    pub timestamp: u64,
+}
+
+impl StakingModule {
+    /// Remember that `pubkey` belongs to `validator_address`, unless another
+    /// validator registered it first
+    pub(super) fn index_consensus_key(&mut self, validator_address: &str, pubkey: &[u8]) {
+        if !pubkey.is_empty() && !self.consensus_key_owners.contains_key(&pubkey.to_vec()) {
+            self.consensus_key_owners.insert(&pubkey.to_vec(), &validator_address.to_string());
+        }
+    }
+
+    /// Replace the consensus key of a validator without unbonding it
+    pub fn rotate_validator_key(&mut self, validator_address: String, new_pubkey: Vec<u8>) -> Result<KeyRotation, String> {
+        let mut validator = self.validators.get(&validator_address)
+            .ok_or("Validator not found")?;
+        if new_pubkey.is_empty() {
+            return Err("Consensus key cannot be empty".to_string());
+        }
+        if new_pubkey == validator.consensus_pubkey {
+            return Err("Consensus key is already in use by this validator".to_string());
+        }
+        if let Some(owner) = self.validator_by_consensus_key(&new_pubkey) {
+            return Err(format!("Consensus key was used by validator {}", owner));
+        }
+
+        let height = env::block_height();
+        if let Some(last) = self.key_rotations.get(&validator_address).unwrap_or_default().last() {
+            let ready_at = last.height.saturating_add(KEY_ROTATION_COOLDOWN_BLOCKS);
+            if height < ready_at {
+                return Err(format!("Consensus key was rotated at height {}, next rotation allowed at height {}", last.height, ready_at));
+            }
+        }
+
+        let rotation = self.record_key_rotation(&validator_address, &mut validator, new_pubkey);
+        self.validators.insert(&validator_address, &validator);
+
+        env::log_str(&format!(
+            "EVENT: rotate_validator_key validator={} height={} new_pubkey={}",
+            validator_address, height, hex::encode(&rotation.new_pubkey)
+        ));
+        Ok(rotation)
+    }
+
+    /// Swap in `new_pubkey` and keep the replaced key in the history, without
+    /// the checks of `rotate_validator_key`; the caller stores `validator`
+    pub(super) fn record_key_rotation(&mut self, validator_address: &str, validator: &mut Validator, new_pubkey: Vec<u8>) -> KeyRotation {
+        let rotation = KeyRotation {
+            old_pubkey: std::mem::replace(&mut validator.consensus_pubkey, new_pubkey.clone()),
+            new_pubkey,
+            height: env::block_height(),
+            timestamp: env::block_timestamp(),
+        };
+        // Keys from before the index existed are claimed on their way out
+        self.index_consensus_key(validator_address, &rotation.old_pubkey);
+        self.index_consensus_key(validator_address, &rotation.new_pubkey);
+        let mut history = self.key_rotations.get(&validator_address.to_string()).unwrap_or_default();
+        history.push(rotation.clone());
+        self.key_rotations.insert(&validator_address.to_string(), &history);
+        rotation
+    }
+
+    /// Past rotations of a validator, oldest first
+    pub fn get_key_rotations(&self, validator_address: String) -> Vec<KeyRotation> {
+        self.key_rotations.get(&validator_address).unwrap_or_default()
+    }
+
+    /// Consensus key a validator signed with at `height`
+    pub fn validator_key_at_height(&self, validator_address: String, height: u64) -> Option<Vec<u8>> {
+        let validator = self.validators.get(&validator_address)?;
+        let rotations = self.key_rotations.get(&validator_address).unwrap_or_default();
+        Some(
+            rotations.into_iter()
+                .find(|rotation| rotation.height > height)
+                .map_or(validator.consensus_pubkey, |rotation| rotation.old_pubkey),
+        )
+    }
+
+    /// Validator that holds or held a consensus key, for attributing evidence
+    pub fn validator_by_consensus_key(&self, pubkey: &[u8]) -> Option<String> {
+        self.consensus_key_owners.get(&pubkey.to_vec()).or_else(|| {
+            self.validators.values()
+                .find(|validator| validator.consensus_pubkey == pubkey)
+                .map(|validator| validator.address)
+        })
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use near_sdk::test_utils::VMContextBuilder;
+    use near_sdk::testing_env;
+
+    fn at_height(height: u64) {
+        testing_env!(VMContextBuilder::new().block_height(height).build());
+    }
+
+    fn create(staking: &mut StakingModule, address: &str, pubkey: Vec<u8>) {
+        staking.create_validator(
+            address.to_string(),
+            pubkey,
+            address.to_string(),
+            None,
+            None,
+            None,
+            None,
+            "0.1".to_string(),
+            "0.2".to_string(),
+            "0.01".to_string(),
+            1,
+            100,
+        ).unwrap();
+    }
+
+    #[test]
+    fn test_rotation_keeps_history_for_evidence() {
+        at_height(10);
+        let mut staking = StakingModule::new();
+        create(&mut staking, "validator1", vec![1; 32]);
+        create(&mut staking, "validator2", vec![2; 32]);
+
+        at_height(100);
+        staking.rotate_validator_key("validator1".to_string(), vec![3; 32]).unwrap();
+        assert_eq!(staking.get_validator("validator1".to_string()).unwrap().consensus_pubkey, vec![3; 32]);
+        assert_eq!(staking.get_self_delegation("validator1".to_string()), 100);
+
+        assert_eq!(staking.validator_key_at_height("validator1".to_string(), 99), Some(vec![1; 32]));
+        assert_eq!(staking.validator_key_at_height("validator1".to_string(), 100), Some(vec![3; 32]));
+        assert_eq!(staking.validator_by_consensus_key(&[1; 32]), Some("validator1".to_string()));
+        assert_eq!(staking.validator_by_consensus_key(&[3; 32]), Some("validator1".to_string()));
+        assert_eq!(staking.get_key_rotations("validator1".to_string()).len(), 1);
+
+        // Retired and active keys of other validators are taken
+        assert!(staking.rotate_validator_key("validator2".to_string(), vec![1; 32]).is_err());
+        assert!(staking.rotate_validator_key("validator2".to_string(), vec![3; 32]).is_err());
+        assert!(staking.rotate_validator_key("validator2".to_string(), vec![]).is_err());
+    }
+
+    #[test]
+    fn test_rotation_cooldown() {
+        at_height(10);
+        let mut staking = StakingModule::new();
+        create(&mut staking, "validator1", vec![1; 32]);
+
+        staking.rotate_validator_key("validator1".to_string(), vec![2; 32]).unwrap();
+        at_height(10 + KEY_ROTATION_COOLDOWN_BLOCKS - 1);
+        let error = staking.rotate_validator_key("validator1".to_string(), vec![3; 32]).unwrap_err();
+        assert!(error.contains("next rotation allowed"), "{}", error);
+
+        at_height(10 + KEY_ROTATION_COOLDOWN_BLOCKS);
+        assert!(staking.rotate_validator_key("validator1".to_string(), vec![3; 32]).is_ok());
+        assert_eq!(staking.validator_key_at_height("validator1".to_string(), 50), Some(vec![2; 32]));
+    }
+}
@@ -0,0 +1,164 @@
+/// Voting Power Snapshots
+///
+/// At the end of every epoch of `SNAPSHOT_EPOCH_BLOCKS` blocks the staking
+/// module records how many bonded tokens each delegator has. A DAO contract
+/// that weights votes by native stake reads a snapshot taken before its
+/// proposal opened, so tokens delegated after the fact, or moved between
+/// accounts during the vote, cannot be counted twice.
+///
+/// Only delegations to bonded validators count, the same stake that votes
+/// in the gov module. The last `MAX_SNAPSHOTS` epochs are kept.
+
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::env;
+use near_sdk::serde::{Deserialize, Serialize};
+use schemars::JsonSchema;
+
+use super::{StakingModule, ValidatorStatus};
+use crate::Balance;
+
+/// Blocks per snapshot epoch
+pub const SNAPSHOT_EPOCH_BLOCKS: u64 = 100;
+
+/// Epochs kept, older snapshots are dropped
+pub const MAX_SNAPSHOTS: u64 = 100;
+
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct VotingPowerSnapshot {
+    pub epoch: u64,
+    /// Height the snapshot was taken at
+    pub height: u64,
+    pub total_power: Balance,
+    /// Bonded tokens by delegator, sorted by delegator
+    pub powers: Vec<(String, Balance)>,
+}
+
+impl VotingPowerSnapshot {
+    pub fn power_of(&self, delegator: &str) -> Balance {
+        self.powers
+            .binary_search_by(|(address, _)| address.as_str().cmp(delegator))
+            .map_or(0, |index| self.powers[index].1)
+    }
+}
+
+/// Epoch a height belongs to
+pub fn epoch_of(height: u64) -> u64 {
+    height / SNAPSHOT_EPOCH_BLOCKS
+}
+
+impl StakingModule {
+    /// Snapshot voting power if `height` closes an epoch
+    pub(super) fn maybe_snapshot_voting_power(&mut self, height: u64) {
+        if height > 0 && (height + 1) % SNAPSHOT_EPOCH_BLOCKS == 0 {
+            self.snapshot_voting_power(height);
+        }
+    }
+
+    /// Record the voting power of every delegator for the epoch of `height`
+    pub fn snapshot_voting_power(&mut self, height: u64) -> VotingPowerSnapshot {
+        let mut powers = std::collections::BTreeMap::new();
+        for delegation in self.delegations.values() {
+            let bonded = self.validators.get(&delegation.validator_address)
+                .map_or(false, |validator| validator.status == ValidatorStatus::Bonded && !validator.jailed);
+            if !bonded {
+                continue;
+            }
+            let tokens = self.delegation_tokens(&delegation);
+            if tokens > 0 {
+                *powers.entry(delegation.delegator_address).or_insert(0) += tokens;
+            }
+        }
+
+        let epoch = epoch_of(height);
+        let snapshot = VotingPowerSnapshot {
+            epoch,
+            height,
+            total_power: powers.values().sum(),
+            powers: powers.into_iter().collect(),
+        };
+        self.voting_power_snapshots.insert(&epoch, &snapshot);
+        self.last_snapshot_epoch = Some(epoch);
+        if epoch >= MAX_SNAPSHOTS {
+            self.voting_power_snapshots.remove(&(epoch - MAX_SNAPSHOTS));
+        }
+
+        env::log_str(&format!(
+            "EVENT: voting_power_snapshot epoch={} height={} total_power={} delegators={}",
+            epoch, height, snapshot.total_power, snapshot.powers.len()
+        ));
+        snapshot
+    }
+
+    /// Snapshot of `epoch`, or the latest one
+    pub fn get_voting_power_snapshot(&self, epoch: Option<u64>) -> Option<VotingPowerSnapshot> {
+        let epoch = epoch.or(self.last_snapshot_epoch)?;
+        self.voting_power_snapshots.get(&epoch)
+    }
+
+    /// Voting power of a delegator in a snapshot, with the snapshot's epoch and height
+    pub fn voting_power_at(&self, delegator: &str, epoch: Option<u64>) -> Option<(u64, u64, Balance)> {
+        self.get_voting_power_snapshot(epoch)
+            .map(|snapshot| (snapshot.epoch, snapshot.height, snapshot.power_of(delegator)))
+    }
+
+    pub fn last_snapshot_epoch(&self) -> Option<u64> {
+        self.last_snapshot_epoch
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use near_sdk::test_utils::VMContextBuilder;
+    use near_sdk::testing_env;
+
+    fn create_validator(staking: &mut StakingModule, address: &str, self_delegation: Balance) {
+        staking.create_validator(
+            address.to_string(),
+            vec![],
+            address.to_string(),
+            None,
+            None,
+            None,
+            None,
+            "0.1".to_string(),
+            "0.2".to_string(),
+            "0.01".to_string(),
+            1,
+            self_delegation,
+        ).unwrap();
+    }
+
+    #[test]
+    fn test_snapshot_sums_bonded_delegations() {
+        testing_env!(VMContextBuilder::new().build());
+        let mut staking = StakingModule::new();
+        create_validator(&mut staking, "val1", 100);
+        create_validator(&mut staking, "val2", 50);
+        staking.delegate("alice".to_string(), "val1".to_string(), 30).unwrap();
+        staking.delegate("alice".to_string(), "val2".to_string(), 20).unwrap();
+
+        staking.end_block(SNAPSHOT_EPOCH_BLOCKS - 1);
+        staking.delegate("bob".to_string(), "val1".to_string(), 500).unwrap();
+
+        let snapshot = staking.get_voting_power_snapshot(None).unwrap();
+        assert_eq!((snapshot.epoch, snapshot.height), (0, SNAPSHOT_EPOCH_BLOCKS - 1));
+        assert_eq!(snapshot.power_of("alice"), 50);
+        assert_eq!(snapshot.power_of("bob"), 0);
+        assert_eq!(snapshot.total_power, 200);
+        assert_eq!(staking.voting_power_at("val1", Some(0)), Some((0, SNAPSHOT_EPOCH_BLOCKS - 1, 100)));
+        assert_eq!(staking.voting_power_at("alice", Some(1)), None);
+    }
+
+    #[test]
+    fn test_old_snapshots_are_dropped() {
+        testing_env!(VMContextBuilder::new().build());
+        let mut staking = StakingModule::new();
+        create_validator(&mut staking, "val1", 100);
+
+        staking.snapshot_voting_power(0);
+        staking.snapshot_voting_power(MAX_SNAPSHOTS * SNAPSHOT_EPOCH_BLOCKS);
+        assert!(staking.get_voting_power_snapshot(Some(0)).is_none());
+        assert_eq!(staking.last_snapshot_epoch(), Some(MAX_SNAPSHOTS));
+    }
+}
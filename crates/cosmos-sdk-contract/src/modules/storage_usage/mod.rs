@@ -0,0 +1,159 @@
+/// Storage Usage by Module
+///
+/// NEAR charges storage staking for every byte a contract holds, but the
+/// account only reports one total. A module contract that hosts several
+/// modules, the transfer contract keeps bank and channel state next to the
+/// ICS-20 state, wraps each state changing call in `StorageMeter::track`.
+/// The meter books the change in `env::storage_usage()` to the module that
+/// made the call, so operators can see what each module costs in rent.
+///
+/// Writes a module causes in another, such as the bank balances an ICS-20
+/// receive mints, count towards the calling module. Bytes written before the
+/// meter existed, and the meter's own entries, are reported as untracked.
+
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::collections::UnorderedMap;
+use near_sdk::env;
+use near_sdk::serde::{Deserialize, Serialize};
+use schemars::JsonSchema;
+
+use crate::handler::telemetry::{NoopTelemetry, TelemetryHooks};
+use crate::Balance;
+
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct ModuleStorageUsage {
+    pub module: String,
+    pub bytes: u64,
+    /// NEAR locked for the bytes, in yoctoNEAR
+    pub storage_cost: Balance,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct StorageUsageReport {
+    /// Bytes used by the whole contract account
+    pub total_bytes: u64,
+    /// Largest modules first
+    pub modules: Vec<ModuleStorageUsage>,
+    pub untracked_bytes: u64,
+}
+
+#[derive(BorshDeserialize, BorshSerialize)]
+pub struct StorageMeter {
+    bytes_by_module: UnorderedMap<String, u64>,
+}
+
+impl StorageMeter {
+    pub fn new(prefix: &[u8]) -> Self {
+        Self {
+            bytes_by_module: UnorderedMap::new(prefix.to_vec()),
+        }
+    }
+
+    /// Run `f` and book the storage it adds or frees to `module`
+    pub fn track<T>(&mut self, module: &str, f: impl FnOnce() -> T) -> T {
+        self.track_with(&mut NoopTelemetry, module, f)
+    }
+
+    /// `track`, reporting the change to `telemetry` as a store write
+    pub fn track_with<T>(&mut self, telemetry: &mut dyn TelemetryHooks, module: &str, f: impl FnOnce() -> T) -> T {
+        let before = env::storage_usage();
+        let result = f();
+        self.record_with(telemetry, module, before);
+        result
+    }
+
+    /// Book the change since `before` to `module`
+    ///
+    /// A module cannot go below zero; freeing bytes that were written
+    /// before metering started only lowers the untracked remainder.
+    pub fn record(&mut self, module: &str, before: u64) {
+        self.record_with(&mut NoopTelemetry, module, before)
+    }
+
+    pub fn record_with(&mut self, telemetry: &mut dyn TelemetryHooks, module: &str, before: u64) {
+        let after = env::storage_usage();
+        if after == before {
+            return;
+        }
+        telemetry.on_store_write(module, after.saturating_sub(before), before.saturating_sub(after));
+        let key = module.to_string();
+        let bytes = self.bytes_by_module.get(&key).unwrap_or(0);
+        let bytes = if after > before {
+            bytes + (after - before)
+        } else {
+            bytes.saturating_sub(before - after)
+        };
+        self.bytes_by_module.insert(&key, &bytes);
+    }
+
+    pub fn module_bytes(&self, module: &str) -> u64 {
+        self.bytes_by_module.get(&module.to_string()).unwrap_or(0)
+    }
+
+    pub fn report(&self) -> StorageUsageReport {
+        let byte_cost = env::storage_byte_cost().as_yoctonear();
+        let mut modules: Vec<ModuleStorageUsage> = self.bytes_by_module.iter()
+            .map(|(module, bytes)| ModuleStorageUsage {
+                module,
+                bytes,
+                storage_cost: bytes as Balance * byte_cost,
+            })
+            .collect();
+        modules.sort_by(|a, b| b.bytes.cmp(&a.bytes).then_with(|| a.module.cmp(&b.module)));
+
+        let total_bytes = env::storage_usage();
+        let tracked: u64 = modules.iter().map(|usage| usage.bytes).sum();
+        StorageUsageReport {
+            total_bytes,
+            modules,
+            untracked_bytes: total_bytes.saturating_sub(tracked),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use near_sdk::collections::LookupMap;
+    use near_sdk::test_utils::VMContextBuilder;
+    use near_sdk::testing_env;
+
+    #[test]
+    fn test_usage_is_booked_to_the_calling_module() {
+        testing_env!(VMContextBuilder::new().build());
+        let mut meter = StorageMeter::new(b"su");
+        let mut bank: LookupMap<String, u64> = LookupMap::new(b"b");
+        let mut gov: LookupMap<String, String> = LookupMap::new(b"g");
+
+        meter.track("bank", || bank.insert(&"alice".to_string(), &100));
+        meter.track("gov", || gov.insert(&"title".to_string(), &"x".repeat(200)));
+        let bank_bytes = meter.module_bytes("bank");
+        assert!(bank_bytes > 0);
+        assert!(meter.module_bytes("gov") > bank_bytes);
+
+        let report = meter.report();
+        assert_eq!(report.modules[0].module, "gov");
+        assert_eq!(report.modules[1].storage_cost, bank_bytes as Balance * env::storage_byte_cost().as_yoctonear());
+        assert_eq!(report.total_bytes, report.untracked_bytes + meter.module_bytes("gov") + bank_bytes);
+
+        meter.track("bank", || bank.remove(&"alice".to_string()));
+        assert_eq!(meter.module_bytes("bank"), 0);
+    }
+
+    #[test]
+    fn test_tracked_writes_reach_telemetry() {
+        testing_env!(VMContextBuilder::new().build());
+        let mut meter = StorageMeter::new(b"su");
+        let mut metrics = crate::handler::Metrics::new();
+        let mut bank: LookupMap<String, u64> = LookupMap::new(b"b");
+
+        meter.track_with(&mut metrics, "bank", || bank.insert(&"alice".to_string(), &100));
+        meter.track_with(&mut metrics, "bank", || bank.get(&"alice".to_string()));
+        meter.track_with(&mut metrics, "bank", || bank.remove(&"alice".to_string()));
+
+        // Reads leave storage alone and are not reported
+        let writes = &metrics.store_writes["bank"];
+        assert_eq!(writes.writes, 2);
+        assert_eq!(writes.bytes_added, writes.bytes_freed);
+    }
+}
@@ -0,0 +1,452 @@
+/// Inactivity Sweep
+///
+/// Modules that hold funds on behalf of users (escrows, payment streams)
+/// take them in through `hold` and pay them out through `pay_out`, which
+/// keep the funds in the module's account in the bank and track each
+/// position, so no module can hold funds the sweep does not know about.
+/// Payouts and `touch` count as owner activity. A position untouched for
+/// the governance-set inactivity period is considered abandoned: anyone may
+/// sweep it from the module's account to the community pool. The owner can
+/// still reclaim swept funds from the pool during a grace period, after
+/// which they belong to the pool for good.
+///
+/// Abandoned payment streams can also be closed through
+/// `close_expired_streams`, which pays the caller a keeper reward per
+/// stream so cleanup does not depend on one operator. Both sweeps check at
+/// most a budget of positions per call and resume from there.
+
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::collections::UnorderedMap;
+use near_sdk::serde::{Deserialize, Serialize};
+use near_sdk::{env, AccountId};
+use schemars::JsonSchema;
+
+use crate::modules::bank::BankModule;
+use crate::modules::jobs::{JobRegistry, JobStep};
+use crate::modules::keeper::{KeeperAction, KeeperModule};
+use crate::types::{time, Authority};
+use crate::Balance;
+
+/// Module name payment streams are tracked under
+pub const STREAMS_MODULE: &str = "streams";
+
+/// Job forgetting swept records past their grace period
+pub const PRUNE_JOB: &str = "prune_swept";
+/// Job sweeping abandoned positions of every module
+pub const SWEEP_JOB: &str = "sweep_abandoned";
+/// Job closing abandoned payment streams
+pub const STREAMS_JOB: &str = "close_expired_streams";
+
+/// Default inactivity before a position can be swept, one year
+pub const DEFAULT_INACTIVITY_PERIOD_NS: u64 = time::days_to_nanos(365);
+/// Default time an owner has to reclaim swept funds, 90 days
+pub const DEFAULT_GRACE_PERIOD_NS: u64 = time::days_to_nanos(90);
+
+/// Account holding the community pool, a sub-account of this contract
+pub fn community_pool_account() -> AccountId {
+    format!("community-pool.{}", env::current_account_id())
+        .parse()
+        .expect("Community pool account is valid")
+}
+
+/// Funds a module holds for an owner
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct HeldFunds {
+    pub id: u64,
+    /// Module holding the funds, e.g. `escrow` or `streams`
+    pub module: String,
+    pub owner: String,
+    pub denom: String,
+    pub amount: Balance,
+    pub last_activity: u64,
+}
+
+/// Swept position that can still be reclaimed
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct SweptFunds {
+    pub id: u64,
+    pub module: String,
+    pub owner: String,
+    pub denom: String,
+    pub amount: Balance,
+    /// Reclaims are accepted until this timestamp
+    pub reclaim_until: u64,
+}
+
+#[derive(BorshDeserialize, BorshSerialize)]
+pub struct SweepModule {
+    /// Governance account; defaults to this contract
+    authority: Authority,
+    inactivity_period_ns: u64,
+    grace_period_ns: u64,
+    held: UnorderedMap<u64, HeldFunds>,
+    swept: UnorderedMap<u64, SweptFunds>,
+    next_id: u64,
+    jobs: JobRegistry,
+}
+
+impl SweepModule {
+    pub fn new() -> Self {
+        Self {
+            authority: Authority::default(),
+            inactivity_period_ns: DEFAULT_INACTIVITY_PERIOD_NS,
+            grace_period_ns: DEFAULT_GRACE_PERIOD_NS,
+            held: UnorderedMap::new(b"sweep_held".to_vec()),
+            swept: UnorderedMap::new(b"sweep_swept".to_vec()),
+            next_id: 1,
+            jobs: JobRegistry::new(b"sweep_jobs"),
+        }
+    }
+
+    /// Account that governance acts through
+    pub fn authority(&self) -> AccountId {
+        self.authority.account()
+    }
+
+    pub fn set_authority(&mut self, sender: &AccountId, new_authority: AccountId) -> Result<(), String> {
+        self.authority.transfer(sender, new_authority)
+    }
+
+    fn assert_authority(&self, sender: &AccountId) -> Result<(), String> {
+        self.authority.check(sender, "Only the governance authority can change sweep periods")
+    }
+
+    pub fn periods(&self) -> (u64, u64) {
+        (self.inactivity_period_ns, self.grace_period_ns)
+    }
+
+    pub fn set_periods(&mut self, sender: &AccountId, inactivity_period_ns: u64, grace_period_ns: u64) -> Result<(), String> {
+        self.assert_authority(sender)?;
+        if inactivity_period_ns == 0 {
+            return Err("Inactivity period must be positive".to_string());
+        }
+        self.inactivity_period_ns = inactivity_period_ns;
+        self.grace_period_ns = grace_period_ns;
+        env::log_str(&format!(
+            "EVENT: sweep_periods inactivity_ns={} grace_ns={} by={}",
+            inactivity_period_ns, grace_period_ns, sender
+        ));
+        Ok(())
+    }
+
+    /// Move funds of `owner` into the account of `module` and track them
+    ///
+    /// The module's account must be registered with the bank. Returns the
+    /// id of the position.
+    pub fn hold(
+        &mut self,
+        bank: &mut BankModule,
+        module: &str,
+        owner: &AccountId,
+        denom: &str,
+        amount: Balance,
+    ) -> Result<u64, String> {
+        let escrow = bank.module_account(module)
+            .ok_or_else(|| format!("Module {} has no account to hold funds in", module))?;
+        if bank.get_spendable_balance(owner, denom) < amount {
+            return Err(format!("{} cannot hold {}{} of {}", module, amount, denom, owner));
+        }
+        bank.transfer_denom_with_reason(owner, &escrow, denom, amount, module, "hold");
+        Ok(self.track(module, owner.as_str(), denom, amount))
+    }
+
+    /// Pay `amount` of a position out of the module's account to `receiver`
+    ///
+    /// Counts as owner activity; a position paid out in full is released.
+    /// Returns the amount still held.
+    pub fn pay_out(&mut self, bank: &mut BankModule, id: u64, receiver: &AccountId, amount: Balance) -> Result<Balance, String> {
+        let held = self.held.get(&id).ok_or_else(|| format!("Position {} is not tracked", id))?;
+        let remaining = held.amount.checked_sub(amount)
+            .ok_or_else(|| format!("Position {} holds only {}{}", id, held.amount, held.denom))?;
+        let escrow = bank.module_account(&held.module)
+            .ok_or_else(|| format!("Module {} has no account to pay from", held.module))?;
+
+        bank.transfer_denom_with_reason(&escrow, receiver, &held.denom, amount, &held.module, "pay_out");
+        if remaining == 0 {
+            self.release(id);
+        } else {
+            self.touch(id, remaining)?;
+        }
+        Ok(remaining)
+    }
+
+    /// Start tracking funds a module already holds for `owner`
+    fn track(&mut self, module: &str, owner: &str, denom: &str, amount: Balance) -> u64 {
+        let id = self.next_id;
+        self.next_id += 1;
+        self.held.insert(&id, &HeldFunds {
+            id,
+            module: module.to_string(),
+            owner: owner.to_string(),
+            denom: denom.to_string(),
+            amount,
+            last_activity: env::block_timestamp(),
+        });
+        id
+    }
+
+    /// Record owner activity and the amount still held
+    ///
+    /// For activity that moves no funds, such as extending a stream.
+    pub fn touch(&mut self, id: u64, amount: Balance) -> Result<(), String> {
+        let mut held = self.held.get(&id).ok_or_else(|| format!("Position {} is not tracked", id))?;
+        held.amount = amount;
+        held.last_activity = env::block_timestamp();
+        self.held.insert(&id, &held);
+        Ok(())
+    }
+
+    /// Stop tracking a position its module paid out
+    fn release(&mut self, id: u64) -> Option<HeldFunds> {
+        self.held.remove(&id)
+    }
+
+    pub fn get_held(&self, id: u64) -> Option<HeldFunds> {
+        self.held.get(&id)
+    }
+
+    /// Move positions idle past the inactivity period to the community
+    /// pool; callable by anyone
+    ///
+    /// Checks at most `budget` positions and resumes from there on the next
+    /// call.
+    pub fn sweep(&mut self, bank: &mut BankModule, budget: Option<u32>) -> Vec<SweptFunds> {
+        self.sweep_abandoned(bank, None, budget)
+    }
+
+    /// Sweep abandoned payment streams, rewarding `caller` for each one
+    ///
+    /// Returns the swept streams and the reward credited to the caller in
+    /// the keeper module.
+    pub fn close_expired_streams(
+        &mut self,
+        bank: &mut BankModule,
+        keeper: &mut KeeperModule,
+        caller: &AccountId,
+        height: u64,
+        budget: Option<u32>,
+    ) -> (Vec<SweptFunds>, Balance) {
+        let closed = self.sweep_abandoned(bank, Some(STREAMS_MODULE), budget);
+        let reward = closed.iter()
+            .map(|_| keeper.reward(caller.as_str(), KeeperAction::StreamCleanup, height))
+            .sum();
+        (closed, reward)
+    }
+
+    fn sweep_abandoned(&mut self, bank: &mut BankModule, module: Option<&str>, budget: Option<u32>) -> Vec<SweptFunds> {
+        let now = env::block_timestamp();
+        let pool = community_pool_account();
+        let mut swept = Vec::new();
+        let mut job = self.jobs.load(if module.is_some() { STREAMS_JOB } else { SWEEP_JOB });
+        job.run(budget, |cursor| {
+            let held = match self.held.values_as_vector().get(cursor) {
+                Some(held) => held,
+                None => return JobStep::Done,
+            };
+            let abandoned = module.map_or(true, |module| held.module == module)
+                && now >= held.last_activity.saturating_add(self.inactivity_period_ns);
+            let escrow = match bank.module_account(&held.module) {
+                Some(escrow) if abandoned => escrow,
+                _ => return JobStep::Continue(cursor + 1),
+            };
+
+            self.held.remove(&held.id);
+            if held.amount > 0 {
+                bank.transfer_denom_with_reason(&escrow, &pool, &held.denom, held.amount, "sweep", "sweep");
+            }
+            let record = SweptFunds {
+                id: held.id,
+                module: held.module,
+                owner: held.owner,
+                denom: held.denom,
+                amount: held.amount,
+                reclaim_until: now.saturating_add(self.grace_period_ns),
+            };
+            self.swept.insert(&record.id, &record);
+            env::log_str(&format!(
+                "EVENT: funds_swept id={} module={} owner={} amount={}{} reclaim_until={}",
+                record.id, record.module, record.owner, record.amount, record.denom, record.reclaim_until
+            ));
+            swept.push(record);
+            JobStep::Continue(cursor)
+        });
+        self.jobs.save(&job);
+        swept
+    }
+
+    /// Return swept funds to their owner within the grace period
+    pub fn reclaim(&mut self, sender: &AccountId, id: u64, bank: &mut BankModule) -> Result<Balance, String> {
+        let record = self.swept.get(&id).ok_or_else(|| format!("No swept funds with id {}", id))?;
+        if record.owner != sender.as_str() {
+            return Err(format!("Swept funds {} belong to {}", id, record.owner));
+        }
+        if env::block_timestamp() > record.reclaim_until {
+            return Err(format!("Grace period of swept funds {} has ended", id));
+        }
+
+        self.swept.remove(&id);
+        if record.amount > 0 {
+            bank.transfer_denom_with_reason(&community_pool_account(), sender, &record.denom, record.amount, "sweep", "reclaim");
+        }
+        env::log_str(&format!("EVENT: funds_reclaimed id={} owner={} amount={}{}", id, sender, record.amount, record.denom));
+        Ok(record.amount)
+    }
+
+    /// Forget swept records whose grace period ended
+    ///
+    /// Checks at most `budget` records and resumes from there on the next
+    /// call. Returns the number of records forgotten.
+    pub fn prune_expired(&mut self, budget: Option<u32>) -> u32 {
+        let now = env::block_timestamp();
+        let mut pruned = 0;
+        let mut job = self.jobs.load(PRUNE_JOB);
+        job.run(budget, |cursor| {
+            let record = match self.swept.values_as_vector().get(cursor) {
+                Some(record) => record,
+                None => return JobStep::Done,
+            };
+            if now > record.reclaim_until {
+                self.swept.remove(&record.id);
+                pruned += 1;
+                JobStep::Continue(cursor)
+            } else {
+                JobStep::Continue(cursor + 1)
+            }
+        });
+        self.jobs.save(&job);
+        pruned
+    }
+
+    pub fn get_swept(&self, owner: &str) -> Vec<SweptFunds> {
+        self.swept.values().filter(|record| record.owner == owner).collect()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use near_sdk::test_utils::VMContextBuilder;
+    use near_sdk::testing_env;
+
+    fn at_time(timestamp: u64) {
+        testing_env!(VMContextBuilder::new().block_timestamp(timestamp).build());
+    }
+
+    fn account(name: &str) -> AccountId {
+        name.parse().unwrap()
+    }
+
+    /// Bank with escrow and stream accounts and 300 of `unear` and `uatom`
+    /// for alice and bob
+    fn setup_bank() -> BankModule {
+        let mut bank = BankModule::new();
+        bank.register_module_account("escrow", true).unwrap();
+        bank.register_module_account(STREAMS_MODULE, true).unwrap();
+        for owner in ["alice.near", "bob.near"] {
+            bank.mint(&account(owner), 300);
+            bank.mint_denom(&account(owner), "uatom", 300);
+        }
+        bank
+    }
+
+    #[test]
+    fn test_abandoned_funds_are_swept_and_reclaimable() {
+        at_time(0);
+        let alice = account("alice.near");
+        let mut bank = setup_bank();
+        let mut sweep = SweepModule::new();
+        sweep.set_periods(&env::current_account_id(), 1_000, 500).unwrap();
+
+        let abandoned = sweep.hold(&mut bank, "escrow", &alice, "uatom", 200).unwrap();
+        let active = sweep.hold(&mut bank, STREAMS_MODULE, &account("bob.near"), "unear", 100).unwrap();
+        assert_eq!(bank.get_denom_balance(&bank.module_account("escrow").unwrap(), "uatom"), 200);
+        assert!(sweep.hold(&mut bank, "unknown", &alice, "unear", 1).is_err());
+
+        at_time(900);
+        assert_eq!(sweep.pay_out(&mut bank, active, &account("carol.near"), 40), Ok(60));
+        at_time(1_000);
+        let swept = sweep.sweep(&mut bank, None);
+        assert_eq!(swept.iter().map(|record| record.id).collect::<Vec<_>>(), vec![abandoned]);
+        assert_eq!(bank.get_denom_balance(&community_pool_account(), "uatom"), 200);
+        assert_eq!(bank.get_denom_balance(&bank.module_account("escrow").unwrap(), "uatom"), 0);
+        assert_eq!(sweep.get_held(active).unwrap().amount, 60);
+
+        assert!(sweep.reclaim(&account("bob.near"), abandoned, &mut bank).is_err());
+        at_time(1_400);
+        assert_eq!(sweep.reclaim(&alice, abandoned, &mut bank), Ok(200));
+        assert_eq!(bank.get_denom_balance(&alice, "uatom"), 300);
+        assert!(sweep.reclaim(&alice, abandoned, &mut bank).is_err());
+    }
+
+    #[test]
+    fn test_paid_out_position_is_released() {
+        at_time(0);
+        let mut bank = setup_bank();
+        let mut sweep = SweepModule::new();
+        let id = sweep.hold(&mut bank, "escrow", &account("alice.near"), "unear", 100).unwrap();
+
+        assert!(sweep.pay_out(&mut bank, id, &account("bob.near"), 101).is_err());
+        assert_eq!(sweep.pay_out(&mut bank, id, &account("bob.near"), 100), Ok(0));
+        assert!(sweep.get_held(id).is_none());
+        assert_eq!(bank.get_balance(&account("bob.near")), 400);
+    }
+
+    #[test]
+    fn test_sweep_is_bounded_per_call() {
+        at_time(0);
+        let mut bank = setup_bank();
+        let mut sweep = SweepModule::new();
+        sweep.set_periods(&env::current_account_id(), 10, 10).unwrap();
+        for _ in 0..3 {
+            sweep.hold(&mut bank, "escrow", &account("alice.near"), "unear", 10).unwrap();
+        }
+
+        at_time(10);
+        assert_eq!(sweep.sweep(&mut bank, Some(2)).len(), 2);
+        assert_eq!(sweep.sweep(&mut bank, Some(2)).len(), 1);
+        assert_eq!(bank.get_balance(&community_pool_account()), 30);
+    }
+
+    #[test]
+    fn test_reclaim_after_grace_period_fails() {
+        at_time(0);
+        let alice = account("alice.near");
+        let mut bank = setup_bank();
+        let mut sweep = SweepModule::new();
+        sweep.set_periods(&env::current_account_id(), 10, 10).unwrap();
+        let id = sweep.hold(&mut bank, "escrow", &alice, "unear", 50).unwrap();
+
+        at_time(10);
+        sweep.sweep(&mut bank, None);
+        at_time(21);
+        assert!(sweep.reclaim(&alice, id, &mut bank).is_err());
+        assert_eq!(sweep.prune_expired(None), 1);
+        assert_eq!(bank.get_balance(&community_pool_account()), 50);
+    }
+
+    #[test]
+    fn test_expired_streams_reward_the_caller() {
+        at_time(0);
+        let mut bank = setup_bank();
+        let mut sweep = SweepModule::new();
+        let mut keeper = KeeperModule::new();
+        keeper.fund(10_000);
+        sweep.set_periods(&env::current_account_id(), 10, 10).unwrap();
+        let escrow = sweep.hold(&mut bank, "escrow", &account("alice.near"), "unear", 100).unwrap();
+        sweep.hold(&mut bank, STREAMS_MODULE, &account("alice.near"), "unear", 100).unwrap();
+        sweep.hold(&mut bank, STREAMS_MODULE, &account("bob.near"), "uatom", 100).unwrap();
+
+        at_time(10);
+        let caller = account("keeper.near");
+        let (closed, reward) = sweep.close_expired_streams(&mut bank, &mut keeper, &caller, 1, None);
+        assert_eq!(closed.len(), 2);
+        assert_eq!(reward, 2 * KeeperModule::new().get_params().stream_cleanup_reward);
+        assert_eq!(keeper.get_earned("keeper.near"), reward);
+        // Other positions are left for the general sweep
+        assert!(sweep.get_held(escrow).is_some());
+
+        let (closed, reward) = sweep.close_expired_streams(&mut bank, &mut keeper, &caller, 2, None);
+        assert!(closed.is_empty());
+        assert_eq!(reward, 0);
+    }
+}
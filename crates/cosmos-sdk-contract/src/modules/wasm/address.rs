@@ -0,0 +1,50 @@
+/// Contract Address Derivation
+/// 
+/// Implements instantiate2-style predictable contract addresses. The address
+/// only depends on the code checksum, the creator, a caller-chosen salt and
+/// optionally the init message, so factories and cross-chain deployments can
+/// compute it before the contract exists.
+
+use sha2::{Digest, Sha256};
+
+/// Maximum salt length accepted by instantiate2
+pub const MAX_SALT_LENGTH: usize = 64;
+
+/// Domain separator for wasm module derived addresses
+const ADDRESS_DOMAIN: &[u8] = b"wasm\0";
+
+/// Validate an instantiate2 salt
+pub fn validate_salt(salt: &[u8]) -> Result<(), String> {
+    if salt.is_empty() {
+        return Err("Salt must not be empty".to_string());
+    }
+    if salt.len() > MAX_SALT_LENGTH {
+        return Err(format!("Salt must not exceed {} bytes", MAX_SALT_LENGTH));
+    }
+    Ok(())
+}
+
+/// Derive the instantiate2 address for a contract
+/// 
+/// Every component is length-prefixed before hashing so different splits of
+/// the same bytes cannot collide. The result is the hex encoded SHA-256 digest,
+/// which is also a valid NEAR implicit account ID.
+pub fn build_instantiate2_address(
+    checksum: &[u8],
+    creator: &str,
+    salt: &[u8],
+    init_msg: Option<&[u8]>,
+) -> Result<String, String> {
+    validate_salt(salt)?;
+
+    let msg = init_msg.unwrap_or_default();
+
+    let mut hasher = Sha256::new();
+    hasher.update(ADDRESS_DOMAIN);
+    for component in [checksum, creator.as_bytes(), salt, msg] {
+        hasher.update((component.len() as u64).to_be_bytes());
+        hasher.update(component);
+    }
+
+    Ok(hex::encode(hasher.finalize()))
+}
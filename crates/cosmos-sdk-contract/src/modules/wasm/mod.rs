@@ -5,9 +5,13 @@
 
 pub mod types;
 pub mod module;
+pub mod address;
+pub mod upload;
 
 #[cfg(test)]
 mod tests;
 
 pub use types::*;
-pub use module::WasmModule;
\ No newline at end of file
+pub use module::WasmModule;
+pub use address::build_instantiate2_address;
+pub use upload::CodeUpload;
\ No newline at end of file
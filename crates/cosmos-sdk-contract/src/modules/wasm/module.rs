@@ -5,8 +5,23 @@
 
 use near_sdk::{AccountId, env};
 use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
-use near_sdk::collections::{UnorderedMap, Vector};
+use near_sdk::collections::{LookupMap, UnorderedMap, UnorderedSet, Vector};
 use super::types::*;
+use super::address::build_instantiate2_address;
+use super::upload::CodeUpload;
+use crate::handler::CosmosMessageHandler;
+use crate::modules::cosmwasm::response::process_cosmwasm_response_with_router;
+use crate::modules::cosmwasm::types::Response;
+use crate::modules::gov::{ProposalContent, ProposalHandler};
+use crate::types::Authority;
+
+/// Largest WASM binary that can be stored
+pub const MAX_CODE_SIZE: usize = 3_000_000;
+
+/// Governance route of wasm proposals
+pub const WASM_PROPOSAL_ROUTE: &str = "wasm";
+/// Proposal type whose content is a JSON `SudoContractProposal`
+pub const SUDO_CONTRACT_PROPOSAL: &str = "SudoContract";
 
 /// The main CosmWasm module state
 #[derive(BorshDeserialize, BorshSerialize)]
@@ -23,6 +38,20 @@ pub struct WasmModule {
     next_code_id: CodeID,
     /// Contract state storage (address -> key -> value)
     contract_states: UnorderedMap<String, UnorderedMap<Vec<u8>, Vec<u8>>>,
+    /// Codes pinned by governance into the priority cache
+    pinned_codes: UnorderedSet<CodeID>,
+    /// Code history per contract, oldest entry first
+    contract_history: LookupMap<ContractAddress, Vec<ContractCodeHistoryEntry>>,
+    /// Governance account allowed to pin codes; defaults to this contract
+    authority: Authority,
+    /// Chunked code uploads in progress
+    pub(super) uploads: UnorderedMap<u64, CodeUpload>,
+    /// Upload chunks, key: "upload_id:index"
+    pub(super) upload_chunks: LookupMap<String, Vec<u8>>,
+    pub(super) next_upload_id: u64,
+    /// Entrypoint calls queued for the relayer by id
+    pending_calls: UnorderedMap<u64, EntryPointCall>,
+    next_call_id: u64,
 }
 
 impl WasmModule {
@@ -34,9 +63,29 @@ impl WasmModule {
             contracts_by_code: UnorderedMap::new(b"wasm_contracts_by_code".to_vec()),
             next_code_id: 1,
             contract_states: UnorderedMap::new(b"wasm_contract_states".to_vec()),
+            pinned_codes: UnorderedSet::new(b"wasm_pinned_codes".to_vec()),
+            contract_history: LookupMap::new(b"wasm_contract_history".to_vec()),
+            authority: Authority::default(),
+            uploads: UnorderedMap::new(b"wasm_uploads".to_vec()),
+            upload_chunks: LookupMap::new(b"wasm_upload_chunks".to_vec()),
+            next_upload_id: 1,
+            pending_calls: UnorderedMap::new(b"wasm_pending_calls".to_vec()),
+            next_call_id: 1,
         }
     }
 
+    /// Account that governance acts through
+    pub fn authority(&self) -> AccountId {
+        self.authority.account()
+    }
+
+    /// Hand governance authority over to another account
+    pub fn set_authority(&mut self, sender: &AccountId, new_authority: AccountId) -> Result<(), String> {
+        self.authority.transfer(sender, new_authority.clone())?;
+        env::log_str(&format!("WASM: Authority changed to {}", new_authority));
+        Ok(())
+    }
+
     /// Store WASM code on chain and return CodeID
     pub fn store_code(
         &mut self,
@@ -45,9 +94,21 @@ impl WasmModule {
         source: Option<String>,
         builder: Option<String>,
         instantiate_permission: Option<AccessConfig>,
+    ) -> Result<CodeID, String> {
+        let permission = self.convert_access_config(instantiate_permission);
+        self.store_code_with_permission(sender, wasm_byte_code, source, builder, permission)
+    }
+
+    pub(super) fn store_code_with_permission(
+        &mut self,
+        sender: &AccountId,
+        wasm_byte_code: Vec<u8>,
+        source: Option<String>,
+        builder: Option<String>,
+        instantiate_permission: AccessType,
     ) -> Result<CodeID, String> {
         // Basic validation
-        if wasm_byte_code.len() > 3_000_000 { // 3MB limit
+        if wasm_byte_code.len() > MAX_CODE_SIZE {
             return Err("Code size exceeds maximum allowed".to_string());
         }
 
@@ -67,7 +128,7 @@ impl WasmModule {
             code_hash: env::sha256(&wasm_byte_code),
             source: source.unwrap_or_default(),
             builder: builder.unwrap_or_default(),
-            instantiate_permission: self.convert_access_config(instantiate_permission),
+            instantiate_permission,
         };
 
         self.code_infos.insert(&code_id, &code_info);
@@ -81,7 +142,7 @@ impl WasmModule {
         &mut self,
         sender: &AccountId,
         code_id: CodeID,
-        _init_msg: Vec<u8>,
+        init_msg: Vec<u8>,
         _funds: Vec<Coin>,
         label: String,
         admin: Option<AccountId>,
@@ -100,6 +161,69 @@ impl WasmModule {
             .parse()
             .map_err(|_| "Failed to generate contract address")?;
 
+        self.register_contract(sender, code_id, contract_address, init_msg, label, admin)
+    }
+
+    /// Instantiate a contract at a predictable address (instantiate2)
+    /// 
+    /// The address is derived from the code checksum, the sender and `salt`;
+    /// with `fix_msg` the init message is part of the derivation as well.
+    pub fn instantiate_contract2(
+        &mut self,
+        sender: &AccountId,
+        code_id: CodeID,
+        init_msg: Vec<u8>,
+        _funds: Vec<Coin>,
+        label: String,
+        admin: Option<AccountId>,
+        salt: Vec<u8>,
+        fix_msg: bool,
+    ) -> Result<InstantiateResponse, String> {
+        let code_info = self.code_infos.get(&code_id)
+            .ok_or_else(|| format!("Code ID {} not found", code_id))?;
+
+        if !self.can_instantiate(&code_info.instantiate_permission, sender) {
+            return Err("Unauthorized to instantiate this code".to_string());
+        }
+
+        let contract_address = build_instantiate2_address(
+            &code_info.code_hash,
+            sender.as_str(),
+            &salt,
+            if fix_msg { Some(init_msg.as_slice()) } else { None },
+        )?;
+
+        if self.contracts.get(&contract_address).is_some() {
+            return Err(format!("Contract address {} already exists", contract_address));
+        }
+
+        self.register_contract(sender, code_id, contract_address, init_msg, label, admin)
+    }
+
+    /// Compute the instantiate2 address a creator would get for a code
+    pub fn predict_contract_address(
+        &self,
+        code_id: CodeID,
+        creator: &AccountId,
+        salt: Vec<u8>,
+        init_msg: Option<Vec<u8>>,
+    ) -> Result<ContractAddress, String> {
+        let code_info = self.code_infos.get(&code_id)
+            .ok_or_else(|| format!("Code ID {} not found", code_id))?;
+
+        build_instantiate2_address(&code_info.code_hash, creator.as_str(), &salt, init_msg.as_deref())
+    }
+
+    /// Record a new contract instance at `contract_address`
+    fn register_contract(
+        &mut self,
+        sender: &AccountId,
+        code_id: CodeID,
+        contract_address: ContractAddress,
+        init_msg: Vec<u8>,
+        label: String,
+        admin: Option<AccountId>,
+    ) -> Result<InstantiateResponse, String> {
         // Create contract info
         let contract_info = ContractInfo {
             address: contract_address.clone(),
@@ -126,6 +250,13 @@ impl WasmModule {
         let contract_state = UnorderedMap::new(format!("state_{}", state_key).into_bytes());
         self.contract_states.insert(&state_key, &contract_state);
 
+        self.append_contract_history(&contract_address, ContractCodeHistoryEntry {
+            operation: ContractCodeHistoryOperationType::Init,
+            code_id,
+            updated: env::block_height(),
+            msg: init_msg,
+        });
+
         // TODO: Actually instantiate the contract with the CosmWasm wrapper
         // For now, we'll simulate successful instantiation
 
@@ -148,13 +279,14 @@ impl WasmModule {
         _funds: Vec<Coin>,
     ) -> Result<ExecuteResponse, String> {
         // Check if contract exists
-        let _contract_info = self.contracts.get(contract_addr)
+        let contract_info = self.contracts.get(contract_addr)
             .ok_or_else(|| format!("Contract {} not found", contract_addr))?;
 
         // TODO: Load and execute the actual contract
         // For now, we'll simulate successful execution
 
-        env::log_str(&format!("WASM: Executed message on contract {}", contract_addr));
+        let cache = if self.is_code_pinned(contract_info.code_id) { " (pinned)" } else { "" };
+        env::log_str(&format!("WASM: Executed message on contract {}{}", contract_addr, cache));
 
         Ok(ExecuteResponse {
             data: None,
@@ -162,6 +294,160 @@ impl WasmModule {
         })
     }
 
+    /// Call the sudo entrypoint of a contract
+    /// 
+    /// Sudo is reserved for the governance authority and lets proposals reach
+    /// privileged contract logic such as parameter updates or emergency halts
+    /// that no regular account may trigger.
+    pub fn sudo_contract(
+        &mut self,
+        sender: &AccountId,
+        contract_addr: &ContractAddress,
+        msg: Vec<u8>,
+    ) -> Result<ExecuteResponse, String> {
+        self.assert_authority(sender)?;
+
+        let contract_info = self.contracts.get(contract_addr)
+            .ok_or_else(|| format!("Contract {} not found", contract_addr))?;
+
+        if msg.is_empty() {
+            return Err("Sudo message must not be empty".to_string());
+        }
+
+        let call_id = self.queue_call(contract_addr, contract_info.code_id, "sudo", msg);
+        env::log_str(&format!("WASM: Sudo call {} on contract {} by {}", call_id, contract_addr, sender));
+
+        Ok(ExecuteResponse {
+            data: Some(call_id.to_string().into_bytes()),
+            events: vec!["sudo".to_string()],
+        })
+    }
+
+    /// Execute a passed sudo proposal on behalf of governance
+    /// 
+    /// Only reachable through `ProposalHandler::execute_content`, which the
+    /// governance router calls once the proposal has passed.
+    fn handle_sudo_proposal(&mut self, proposal: SudoContractProposal) -> Result<ExecuteResponse, String> {
+        env::log_str(&format!("WASM: Executing sudo proposal '{}'", proposal.title));
+
+        let authority = self.authority();
+        self.sudo_contract(&authority, &proposal.contract, proposal.msg)
+    }
+
+    /// Decode the content of a `SudoContract` proposal
+    fn sudo_proposal_content(content: &ProposalContent) -> Result<SudoContractProposal, String> {
+        if content.proposal_type != SUDO_CONTRACT_PROPOSAL {
+            return Err(format!("Unknown wasm proposal type {}", content.proposal_type));
+        }
+        serde_json::from_str(&content.value).map_err(|e| format!("Invalid sudo proposal: {}", e))
+    }
+
+    /// Migrate a contract to new code
+    /// 
+    /// Only the contract admin may migrate. The target code must exist, must
+    /// differ from the current code and must not be byte-identical to it, so
+    /// every migration actually changes the running version. The `migrate`
+    /// entrypoint of the new code is queued for the relayer like sudo calls,
+    /// the response data holds the call id.
+    pub fn migrate_contract(
+        &mut self,
+        sender: &AccountId,
+        contract_addr: &ContractAddress,
+        new_code_id: CodeID,
+        msg: Vec<u8>,
+    ) -> Result<MigrateResponse, String> {
+        let mut contract_info = self.contracts.get(contract_addr)
+            .ok_or_else(|| format!("Contract {} not found", contract_addr))?;
+
+        self.assert_contract_admin(&contract_info, sender)?;
+
+        let old_code_id = contract_info.code_id;
+        if new_code_id == old_code_id {
+            return Err(format!("Contract {} already runs code {}", contract_addr, new_code_id));
+        }
+
+        let new_code = self.code_infos.get(&new_code_id)
+            .ok_or_else(|| format!("Code ID {} not found", new_code_id))?;
+        let old_code = self.code_infos.get(&old_code_id)
+            .ok_or_else(|| format!("Code ID {} not found", old_code_id))?;
+        if new_code.code_hash == old_code.code_hash {
+            return Err(format!("Code {} is identical to the current code {}", new_code_id, old_code_id));
+        }
+
+        // Move the contract between the per-code indexes
+        if let Some(mut old_index) = self.contracts_by_code.get(&old_code_id) {
+            let remaining: Vec<ContractAddress> = old_index.iter()
+                .filter(|address| address != contract_addr)
+                .collect();
+            old_index.clear();
+            for address in remaining.iter() {
+                old_index.push(address);
+            }
+            self.contracts_by_code.insert(&old_code_id, &old_index);
+        }
+        let mut new_index = self.contracts_by_code.get(&new_code_id)
+            .unwrap_or_else(|| Vector::new(format!("contracts_by_code_{}", new_code_id).into_bytes()));
+        new_index.push(contract_addr);
+        self.contracts_by_code.insert(&new_code_id, &new_index);
+
+        contract_info.code_id = new_code_id;
+        self.contracts.insert(contract_addr, &contract_info);
+
+        self.append_contract_history(contract_addr, ContractCodeHistoryEntry {
+            operation: ContractCodeHistoryOperationType::Migrate,
+            code_id: new_code_id,
+            updated: env::block_height(),
+            msg: msg.clone(),
+        });
+
+        let call_id = self.queue_call(contract_addr, new_code_id, "migrate", msg);
+
+        env::log_str(&format!(
+            "WASM: Migrated contract {} from code {} to code {} by {}, migrate call {}",
+            contract_addr, old_code_id, new_code_id, sender, call_id
+        ));
+
+        Ok(MigrateResponse {
+            old_code_id,
+            new_code_id,
+            data: Some(call_id.to_string().into_bytes()),
+            events: vec!["migrate".to_string()],
+        })
+    }
+
+    /// Set a new admin for a contract (current admin only)
+    pub fn update_admin(
+        &mut self,
+        sender: &AccountId,
+        contract_addr: &ContractAddress,
+        new_admin: AccountId,
+    ) -> Result<(), String> {
+        let mut contract_info = self.contracts.get(contract_addr)
+            .ok_or_else(|| format!("Contract {} not found", contract_addr))?;
+
+        self.assert_contract_admin(&contract_info, sender)?;
+
+        contract_info.admin = Some(new_admin.to_string());
+        self.contracts.insert(contract_addr, &contract_info);
+
+        env::log_str(&format!("WASM: Updated admin of contract {} to {}", contract_addr, new_admin));
+        Ok(())
+    }
+
+    /// Remove the admin of a contract, making it immutable (current admin only)
+    pub fn clear_admin(&mut self, sender: &AccountId, contract_addr: &ContractAddress) -> Result<(), String> {
+        let mut contract_info = self.contracts.get(contract_addr)
+            .ok_or_else(|| format!("Contract {} not found", contract_addr))?;
+
+        self.assert_contract_admin(&contract_info, sender)?;
+
+        contract_info.admin = None;
+        self.contracts.insert(contract_addr, &contract_info);
+
+        env::log_str(&format!("WASM: Cleared admin of contract {}", contract_addr));
+        Ok(())
+    }
+
     /// Query a contract
     pub fn query_contract(
         &self,
@@ -178,6 +464,26 @@ impl WasmModule {
         Ok(vec![])
     }
 
+    /// Apply the response of a contract execution the relayer ran
+    ///
+    /// Bank, staking and gov messages are routed through the Msg router with
+    /// the contract address as signer, which lets CosmWasm contracts send
+    /// funds, stake and vote; they all apply or none do. Returns the
+    /// response data in base64.
+    pub fn apply_contract_response<T: serde::Serialize, H: CosmosMessageHandler>(
+        &self,
+        handler: &mut H,
+        contract_addr: &ContractAddress,
+        response: Response<T>,
+    ) -> Result<String, String> {
+        // Only registered contracts may act as a message signer
+        if self.contracts.get(contract_addr).is_none() {
+            return Err(format!("Contract {} not found", contract_addr));
+        }
+
+        process_cosmwasm_response_with_router(response, contract_addr, handler)
+    }
+
     /// Get contract info
     pub fn get_contract_info(&self, address: &ContractAddress) -> Option<ContractInfo> {
         self.contracts.get(address)
@@ -188,6 +494,99 @@ impl WasmModule {
         self.code_infos.get(&code_id)
     }
 
+    /// Get code info together with its pinned state
+    pub fn query_code_info(&self, code_id: CodeID) -> Option<CodeInfoResponse> {
+        self.code_infos.get(&code_id).map(|code_info| CodeInfoResponse {
+            code_info,
+            pinned: self.is_code_pinned(code_id),
+        })
+    }
+
+    /// Get the code history of a contract, oldest entry first
+    pub fn get_contract_history(&self, address: &ContractAddress) -> Vec<ContractCodeHistoryEntry> {
+        self.contract_history.get(address).unwrap_or_default()
+    }
+
+    /// Change who may instantiate a code
+    ///
+    /// Only the code creator or the governance authority may change it.
+    pub fn update_instantiate_config(
+        &mut self,
+        sender: &AccountId,
+        code_id: CodeID,
+        instantiate_permission: Option<AccessConfig>,
+    ) -> Result<(), String> {
+        let mut code_info = self.code_infos.get(&code_id)
+            .ok_or_else(|| format!("Code ID {} not found", code_id))?;
+
+        if code_info.creator != sender.to_string() && sender != &self.authority() {
+            return Err("Unauthorized to update instantiate config".to_string());
+        }
+
+        code_info.instantiate_permission = self.convert_access_config(instantiate_permission);
+        self.code_infos.insert(&code_id, &code_info);
+
+        env::log_str(&format!(
+            "WASM: Updated instantiate permission of code {} to {:?}",
+            code_id, code_info.instantiate_permission
+        ));
+        Ok(())
+    }
+
+    /// Pin codes into the priority cache (governance only)
+    pub fn pin_codes(&mut self, sender: &AccountId, code_ids: Vec<CodeID>) -> Result<(), String> {
+        self.assert_authority(sender)?;
+
+        for code_id in &code_ids {
+            if self.code_infos.get(code_id).is_none() {
+                return Err(format!("Code ID {} not found", code_id));
+            }
+        }
+
+        for code_id in code_ids {
+            if self.pinned_codes.insert(&code_id) {
+                env::log_str(&format!("WASM: Pinned code {}", code_id));
+            }
+        }
+        Ok(())
+    }
+
+    /// Unpin codes from the priority cache (governance only)
+    pub fn unpin_codes(&mut self, sender: &AccountId, code_ids: Vec<CodeID>) -> Result<(), String> {
+        self.assert_authority(sender)?;
+
+        for code_id in code_ids {
+            if self.pinned_codes.remove(&code_id) {
+                env::log_str(&format!("WASM: Unpinned code {}", code_id));
+            }
+        }
+        Ok(())
+    }
+
+    /// Entrypoint calls waiting for the relayer
+    pub fn pending_calls(&self, limit: usize) -> Vec<EntryPointCall> {
+        self.pending_calls.values().take(limit).collect()
+    }
+
+    /// Remove a call the relayer has run
+    pub fn complete_call(&mut self, sender: &AccountId, call_id: u64) -> Result<EntryPointCall, String> {
+        self.assert_authority(sender)?;
+        self.pending_calls.remove(&call_id)
+            .ok_or_else(|| format!("Call {} not found", call_id))
+    }
+
+    /// Check whether a code is pinned
+    pub fn is_code_pinned(&self, code_id: CodeID) -> bool {
+        self.pinned_codes.contains(&code_id)
+    }
+
+    /// List pinned code IDs in ascending order
+    pub fn list_pinned_codes(&self) -> Vec<CodeID> {
+        let mut code_ids: Vec<CodeID> = self.pinned_codes.iter().collect();
+        code_ids.sort_unstable();
+        code_ids
+    }
+
     /// List all stored codes
     pub fn list_codes(&self, start_after: Option<CodeID>, limit: Option<u32>) -> Vec<CodeInfo> {
         let limit = limit.unwrap_or(30).min(100) as usize;
@@ -247,6 +646,39 @@ impl WasmModule {
 
     // Helper methods
 
+    fn assert_authority(&self, sender: &AccountId) -> Result<(), String> {
+        self.authority.check(sender, "Only the governance authority can perform this action")
+    }
+
+    fn assert_contract_admin(&self, contract_info: &ContractInfo, sender: &AccountId) -> Result<(), String> {
+        match &contract_info.admin {
+            Some(admin) if admin == sender.as_str() => Ok(()),
+            Some(_) => Err("Only the contract admin can perform this action".to_string()),
+            None => Err(format!("Contract {} has no admin", contract_info.address)),
+        }
+    }
+
+    /// Queue an entrypoint call for the relayer and return its id
+    fn queue_call(&mut self, contract_addr: &ContractAddress, code_id: CodeID, entry_point: &str, msg: Vec<u8>) -> u64 {
+        let id = self.next_call_id;
+        self.next_call_id += 1;
+        self.pending_calls.insert(&id, &EntryPointCall {
+            id,
+            contract: contract_addr.clone(),
+            code_id,
+            entry_point: entry_point.to_string(),
+            msg,
+            height: env::block_height(),
+        });
+        id
+    }
+
+    fn append_contract_history(&mut self, address: &ContractAddress, entry: ContractCodeHistoryEntry) {
+        let mut history = self.get_contract_history(address);
+        history.push(entry);
+        self.contract_history.insert(address, &history);
+    }
+
     pub fn convert_access_config(&self, config: Option<AccessConfig>) -> AccessType {
         match config {
             None | Some(AccessConfig::Everybody {}) => AccessType::Everybody,
@@ -283,4 +715,18 @@ impl WasmModule {
     pub fn get_all_contracts(&self) -> Vec<ContractInfo> {
         self.contracts.values().collect()
     }
+}
+
+impl ProposalHandler for WasmModule {
+    fn validate_content(&self, content: &ProposalContent) -> Result<(), String> {
+        let proposal = Self::sudo_proposal_content(content)?;
+        if self.contracts.get(&proposal.contract).is_none() {
+            return Err(format!("Contract {} not found", proposal.contract));
+        }
+        Ok(())
+    }
+
+    fn execute_content(&mut self, _proposal_id: u64, content: &ProposalContent) -> Result<(), String> {
+        self.handle_sudo_proposal(Self::sudo_proposal_content(content)?).map(|_| ())
+    }
 }
\ No newline at end of file
@@ -773,4 +773,526 @@ mod tests {
             assert_eq!(module.get_next_instance_id(1), 1);
         }
     }
-}
\ No newline at end of file
+
+    #[cfg(test)]
+    mod governance_tests {
+        use super::*;
+
+        fn gov_account() -> AccountId {
+            "contract.testnet".parse().unwrap()
+        }
+
+        #[test]
+        fn test_update_instantiate_config() {
+            setup_test_env();
+            let mut module = WasmModule::new();
+            let creator = test_account("creator");
+            let stranger = test_account("stranger");
+
+            let code_id = module.store_code(&creator, mock_wasm_code("config"), None, None, None).unwrap();
+
+            // Strangers cannot change the permission
+            let result = module.update_instantiate_config(&stranger, code_id, Some(AccessConfig::Nobody {}));
+            assert!(result.is_err());
+
+            // The creator can lock the code down
+            module.update_instantiate_config(&creator, code_id, Some(AccessConfig::Nobody {})).unwrap();
+            assert_eq!(module.get_code_info(code_id).unwrap().instantiate_permission, AccessType::Nobody);
+            let result = module.instantiate_contract(&creator, code_id, b"{}".to_vec(), vec![], "Locked".to_string(), None);
+            assert!(result.is_err());
+
+            // Governance can reopen it
+            module.update_instantiate_config(&gov_account(), code_id, Some(AccessConfig::OnlyAddress {
+                address: stranger.to_string(),
+            })).unwrap();
+            let result = module.instantiate_contract(&stranger, code_id, b"{}".to_vec(), vec![], "Open".to_string(), None);
+            assert!(result.is_ok());
+
+            // Unknown code
+            assert!(module.update_instantiate_config(&creator, 99, None).is_err());
+        }
+
+        #[test]
+        fn test_pin_and_unpin_codes() {
+            setup_test_env();
+            let mut module = WasmModule::new();
+            let creator = test_account("creator");
+
+            let code_a = module.store_code(&creator, mock_wasm_code("a"), None, None, None).unwrap();
+            let code_b = module.store_code(&creator, mock_wasm_code("b"), None, None, None).unwrap();
+
+            // Only governance may pin
+            assert!(module.pin_codes(&creator, vec![code_a]).is_err());
+            assert!(!module.is_code_pinned(code_a));
+
+            // Unknown codes are rejected without pinning anything
+            assert!(module.pin_codes(&gov_account(), vec![code_a, 42]).is_err());
+            assert!(module.list_pinned_codes().is_empty());
+
+            module.pin_codes(&gov_account(), vec![code_b, code_a]).unwrap();
+            assert_eq!(module.list_pinned_codes(), vec![code_a, code_b]);
+            assert!(module.query_code_info(code_a).unwrap().pinned);
+
+            module.unpin_codes(&gov_account(), vec![code_a]).unwrap();
+            assert!(!module.query_code_info(code_a).unwrap().pinned);
+            assert_eq!(module.list_pinned_codes(), vec![code_b]);
+        }
+
+        #[test]
+        fn test_set_authority() {
+            setup_test_env();
+            let mut module = WasmModule::new();
+            let creator = test_account("creator");
+            let dao = test_account("dao");
+
+            assert_eq!(module.authority(), gov_account());
+            assert!(module.set_authority(&creator, dao.clone()).is_err());
+
+            module.set_authority(&gov_account(), dao.clone()).unwrap();
+            assert_eq!(module.authority(), dao);
+
+            let code_id = module.store_code(&creator, mock_wasm_code("dao"), None, None, None).unwrap();
+            assert!(module.pin_codes(&gov_account(), vec![code_id]).is_err());
+            assert!(module.pin_codes(&dao, vec![code_id]).is_ok());
+        }
+
+        #[test]
+        fn test_contract_history_records_init() {
+            setup_test_env();
+            let mut module = WasmModule::new();
+            let creator = test_account("creator");
+
+            let code_id = module.store_code(&creator, mock_wasm_code("history"), None, None, None).unwrap();
+            let response = module.instantiate_contract(
+                &creator,
+                code_id,
+                b"{\"count\":0}".to_vec(),
+                vec![],
+                "History".to_string(),
+                None,
+            ).unwrap();
+
+            let history = module.get_contract_history(&response.address);
+            assert_eq!(history.len(), 1);
+            assert_eq!(history[0].operation, ContractCodeHistoryOperationType::Init);
+            assert_eq!(history[0].code_id, code_id);
+            assert_eq!(history[0].updated, 1000);
+            assert_eq!(history[0].msg, b"{\"count\":0}".to_vec());
+
+            assert!(module.get_contract_history(&"unknown".to_string()).is_empty());
+        }
+    }
+
+    #[cfg(test)]
+    mod instantiate2_tests {
+        use super::*;
+
+        #[test]
+        fn test_address_derivation_is_deterministic() {
+            let checksum = env::sha256(b"code");
+            let a = build_instantiate2_address(&checksum, "creator.testnet", b"salt", None).unwrap();
+            let b = build_instantiate2_address(&checksum, "creator.testnet", b"salt", None).unwrap();
+            assert_eq!(a, b);
+            assert_eq!(a.len(), 64);
+            assert!(a.parse::<AccountId>().is_ok());
+
+            // Every input changes the address
+            assert_ne!(a, build_instantiate2_address(&checksum, "other.testnet", b"salt", None).unwrap());
+            assert_ne!(a, build_instantiate2_address(&checksum, "creator.testnet", b"salt2", None).unwrap());
+            assert_ne!(a, build_instantiate2_address(&env::sha256(b"other"), "creator.testnet", b"salt", None).unwrap());
+            assert_ne!(a, build_instantiate2_address(&checksum, "creator.testnet", b"salt", Some(b"{}")).unwrap());
+        }
+
+        #[test]
+        fn test_salt_validation() {
+            let checksum = env::sha256(b"code");
+            assert!(build_instantiate2_address(&checksum, "creator.testnet", b"", None).is_err());
+            assert!(build_instantiate2_address(&checksum, "creator.testnet", &[7u8; 65], None).is_err());
+            assert!(build_instantiate2_address(&checksum, "creator.testnet", &[7u8; 64], None).is_ok());
+        }
+
+        #[test]
+        fn test_instantiate2_matches_prediction() {
+            setup_test_env();
+            let mut module = WasmModule::new();
+            let creator = test_account("creator");
+
+            let code_id = module.store_code(&creator, mock_wasm_code("factory"), None, None, None).unwrap();
+            let predicted = module.predict_contract_address(code_id, &creator, b"pool-1".to_vec(), None).unwrap();
+
+            let response = module.instantiate_contract2(
+                &creator,
+                code_id,
+                b"{}".to_vec(),
+                vec![],
+                "Pool 1".to_string(),
+                None,
+                b"pool-1".to_vec(),
+                false,
+            ).unwrap();
+
+            assert_eq!(response.address, predicted);
+            let info = module.get_contract_info(&predicted).unwrap();
+            assert_eq!(info.code_id, code_id);
+            assert_eq!(module.list_contracts_by_code(code_id, None, None).len(), 1);
+
+            // Same salt cannot be reused by the same creator
+            let result = module.instantiate_contract2(
+                &creator,
+                code_id,
+                b"{}".to_vec(),
+                vec![],
+                "Pool 1 again".to_string(),
+                None,
+                b"pool-1".to_vec(),
+                false,
+            );
+            assert!(result.unwrap_err().contains("already exists"));
+
+            // A different creator gets a different address with the same salt
+            let other = test_account("other");
+            let response = module.instantiate_contract2(
+                &other,
+                code_id,
+                b"{}".to_vec(),
+                vec![],
+                "Pool 1 other".to_string(),
+                None,
+                b"pool-1".to_vec(),
+                false,
+            ).unwrap();
+            assert_ne!(response.address, predicted);
+        }
+
+        #[test]
+        fn test_instantiate2_fix_msg_and_permissions() {
+            setup_test_env();
+            let mut module = WasmModule::new();
+            let creator = test_account("creator");
+
+            let code_id = module.store_code(&creator, mock_wasm_code("fixed"), None, None, None).unwrap();
+            let predicted = module.predict_contract_address(
+                code_id,
+                &creator,
+                b"salt".to_vec(),
+                Some(b"{\"a\":1}".to_vec()),
+            ).unwrap();
+
+            let response = module.instantiate_contract2(
+                &creator,
+                code_id,
+                b"{\"a\":1}".to_vec(),
+                vec![],
+                "Fixed".to_string(),
+                None,
+                b"salt".to_vec(),
+                true,
+            ).unwrap();
+            assert_eq!(response.address, predicted);
+
+            let locked = module.store_code(&creator, mock_wasm_code("locked"), None, None, Some(AccessConfig::Nobody {})).unwrap();
+            let result = module.instantiate_contract2(
+                &creator,
+                locked,
+                b"{}".to_vec(),
+                vec![],
+                "Locked".to_string(),
+                None,
+                b"salt".to_vec(),
+                false,
+            );
+            assert_eq!(result.unwrap_err(), "Unauthorized to instantiate this code");
+        }
+    }
+
+    #[cfg(test)]
+    mod migration_tests {
+        use super::*;
+
+        fn setup_contract(module: &mut WasmModule, admin: Option<AccountId>) -> (CodeID, ContractAddress) {
+            let creator = test_account("creator");
+            let code_id = module.store_code(&creator, mock_wasm_code("v1"), None, None, None).unwrap();
+            let response = module.instantiate_contract(
+                &creator,
+                code_id,
+                b"{}".to_vec(),
+                vec![],
+                "Migratable".to_string(),
+                admin,
+            ).unwrap();
+            (code_id, response.address)
+        }
+
+        #[test]
+        fn test_migrate_contract() {
+            setup_test_env();
+            let mut module = WasmModule::new();
+            let admin = test_account("admin");
+            let (v1, contract) = setup_contract(&mut module, Some(admin.clone()));
+            let v2 = module.store_code(&admin, mock_wasm_code("v2"), None, None, None).unwrap();
+
+            let response = module.migrate_contract(&admin, &contract, v2, b"{\"upgrade\":{}}".to_vec()).unwrap();
+            assert_eq!(response.old_code_id, v1);
+            assert_eq!(response.new_code_id, v2);
+            assert_eq!(response.events, vec!["migrate".to_string()]);
+
+            // The new code's migrate entrypoint waits for the relayer
+            let calls = module.pending_calls(10);
+            assert_eq!(calls.len(), 1);
+            assert_eq!(response.data, Some(calls[0].id.to_string().into_bytes()));
+            assert_eq!((calls[0].code_id, calls[0].entry_point.as_str()), (v2, "migrate"));
+            assert_eq!(calls[0].msg, b"{\"upgrade\":{}}".to_vec());
+
+            assert_eq!(module.get_contract_info(&contract).unwrap().code_id, v2);
+            assert!(module.list_contracts_by_code(v1, None, None).is_empty());
+            assert_eq!(module.list_contracts_by_code(v2, None, None).len(), 1);
+
+            let history = module.get_contract_history(&contract);
+            assert_eq!(history.len(), 2);
+            assert_eq!(history[1].operation, ContractCodeHistoryOperationType::Migrate);
+            assert_eq!(history[1].code_id, v2);
+        }
+
+        #[test]
+        fn test_migrate_version_checks() {
+            setup_test_env();
+            let mut module = WasmModule::new();
+            let admin = test_account("admin");
+            let (v1, contract) = setup_contract(&mut module, Some(admin.clone()));
+
+            // Same code id
+            assert!(module.migrate_contract(&admin, &contract, v1, vec![]).is_err());
+
+            // Unknown code id
+            assert!(module.migrate_contract(&admin, &contract, 99, vec![]).is_err());
+
+            // Identical bytecode under a new code id
+            let copy = module.store_code(&admin, mock_wasm_code("v1"), None, None, None).unwrap();
+            let result = module.migrate_contract(&admin, &contract, copy, vec![]);
+            assert!(result.unwrap_err().contains("identical"));
+            assert_eq!(module.get_contract_history(&contract).len(), 1);
+        }
+
+        #[test]
+        fn test_migrate_requires_admin() {
+            setup_test_env();
+            let mut module = WasmModule::new();
+            let admin = test_account("admin");
+            let stranger = test_account("stranger");
+            let (_, contract) = setup_contract(&mut module, Some(admin.clone()));
+            let v2 = module.store_code(&admin, mock_wasm_code("v2"), None, None, None).unwrap();
+
+            let result = module.migrate_contract(&stranger, &contract, v2, vec![]);
+            assert_eq!(result.unwrap_err(), "Only the contract admin can perform this action");
+
+            // Contracts without admin are immutable
+            let (_, immutable) = setup_contract(&mut module, None);
+            assert!(module.migrate_contract(&admin, &immutable, v2, vec![]).is_err());
+        }
+
+        #[test]
+        fn test_update_and_clear_admin() {
+            setup_test_env();
+            let mut module = WasmModule::new();
+            let admin = test_account("admin");
+            let new_admin = test_account("new_admin");
+            let (_, contract) = setup_contract(&mut module, Some(admin.clone()));
+
+            assert!(module.update_admin(&new_admin, &contract, new_admin.clone()).is_err());
+
+            module.update_admin(&admin, &contract, new_admin.clone()).unwrap();
+            assert_eq!(module.get_contract_info(&contract).unwrap().admin, Some(new_admin.to_string()));
+
+            // The old admin lost its rights
+            assert!(module.clear_admin(&admin, &contract).is_err());
+
+            module.clear_admin(&new_admin, &contract).unwrap();
+            assert_eq!(module.get_contract_info(&contract).unwrap().admin, None);
+            assert!(module.update_admin(&new_admin, &contract, admin).is_err());
+        }
+    }
+
+    #[cfg(test)]
+    mod sudo_tests {
+        use super::*;
+
+        fn setup_contract(module: &mut WasmModule) -> ContractAddress {
+            let creator = test_account("creator");
+            let code_id = module.store_code(&creator, mock_wasm_code("sudo"), None, None, None).unwrap();
+            module.instantiate_contract(
+                &creator,
+                code_id,
+                b"{}".to_vec(),
+                vec![],
+                "Sudo".to_string(),
+                Some(creator.clone()),
+            ).unwrap().address
+        }
+
+        #[test]
+        fn test_sudo_requires_authority() {
+            setup_test_env();
+            let mut module = WasmModule::new();
+            let contract = setup_contract(&mut module);
+
+            // Not even the contract admin may call sudo
+            let result = module.sudo_contract(&test_account("creator"), &contract, b"{\"halt\":{}}".to_vec());
+            assert!(result.is_err());
+
+            let gov: AccountId = "contract.testnet".parse().unwrap();
+            let response = module.sudo_contract(&gov, &contract, b"{\"halt\":{}}".to_vec()).unwrap();
+            assert_eq!(response.events, vec!["sudo".to_string()]);
+            assert_eq!(response.data, Some(b"1".to_vec()));
+
+            let pending = module.pending_calls(10);
+            assert_eq!(pending.len(), 1);
+            assert_eq!(pending[0].entry_point, "sudo");
+            assert_eq!(pending[0].msg, b"{\"halt\":{}}".to_vec());
+
+            assert!(module.complete_call(&test_account("creator"), 1).is_err());
+            assert_eq!(module.complete_call(&gov, 1).unwrap().contract, contract);
+            assert!(module.pending_calls(10).is_empty());
+
+            assert!(module.sudo_contract(&gov, &"missing".to_string(), b"{}".to_vec()).is_err());
+            assert!(module.sudo_contract(&gov, &contract, vec![]).is_err());
+        }
+
+        #[test]
+        fn test_sudo_proposal() {
+            use crate::modules::gov::{ProposalContent, ProposalHandler};
+            use crate::modules::wasm::module::{SUDO_CONTRACT_PROPOSAL, WASM_PROPOSAL_ROUTE};
+
+            setup_test_env();
+            let mut module = WasmModule::new();
+            let contract = setup_contract(&mut module);
+
+            let content = |proposal: SudoContractProposal| ProposalContent {
+                route: WASM_PROPOSAL_ROUTE.to_string(),
+                proposal_type: SUDO_CONTRACT_PROPOSAL.to_string(),
+                value: serde_json::to_string(&proposal).unwrap(),
+            };
+            let proposal = content(SudoContractProposal {
+                title: "Update fee".to_string(),
+                description: "Lower the swap fee".to_string(),
+                contract: contract.clone(),
+                msg: b"{\"set_fee\":{\"bps\":10}}".to_vec(),
+            });
+            assert!(module.execute_content(1, &proposal).is_ok());
+            assert_eq!(module.pending_calls(10)[0].contract, contract);
+
+            let proposal = content(SudoContractProposal {
+                title: "Bad".to_string(),
+                description: "Unknown contract".to_string(),
+                contract: "missing".to_string(),
+                msg: b"{}".to_vec(),
+            });
+            assert!(module.validate_content(&proposal).is_err());
+            assert!(module.execute_content(2, &proposal).is_err());
+        }
+
+        #[test]
+        fn test_sudo_proposal_through_gov_router() {
+            use crate::modules::gov::{GovernanceModule, ProposalContent, ProposalRouter};
+            use crate::modules::wasm::module::{SUDO_CONTRACT_PROPOSAL, WASM_PROPOSAL_ROUTE};
+
+            setup_test_env();
+            let mut module = WasmModule::new();
+            let contract = setup_contract(&mut module);
+            let mut gov = GovernanceModule::new();
+            let proposer: AccountId = "alice.near".parse().unwrap();
+
+            let content = ProposalContent {
+                route: WASM_PROPOSAL_ROUTE.to_string(),
+                proposal_type: SUDO_CONTRACT_PROPOSAL.to_string(),
+                value: serde_json::to_string(&SudoContractProposal {
+                    title: "Update fee".to_string(),
+                    description: "Lower the swap fee".to_string(),
+                    contract,
+                    msg: b"{\"set_fee\":{\"bps\":10}}".to_vec(),
+                }).unwrap(),
+            };
+            let mut router = ProposalRouter::new();
+            router.add_route(WASM_PROPOSAL_ROUTE, &mut module).unwrap();
+            let proposal_id = gov.submit_content_proposal(
+                &proposer,
+                "Update fee".to_string(),
+                String::new(),
+                content,
+                &mut router,
+                String::new(),
+                None,
+                10,
+            );
+            gov.vote(&proposer, proposal_id, 1, String::new());
+            gov.vote(&"bob.near".parse().unwrap(), proposal_id, 1, String::new());
+            gov.end_block(100);
+
+            let results = gov.execute_approved_content(&mut router);
+            assert_eq!(results, vec![(proposal_id, Ok(()))]);
+            drop(router);
+            assert_eq!(module.pending_calls(10)[0].entry_point, "sudo");
+        }
+    }
+
+    #[cfg(test)]
+    mod upload_tests {
+        use super::*;
+        use crate::modules::wasm::upload::UPLOAD_EXPIRY_NS;
+
+        fn checksum(code: &[u8]) -> String {
+            hex::encode(env::sha256(code))
+        }
+
+        #[test]
+        fn test_chunked_upload_stores_verified_code() {
+            setup_test_env();
+            let mut module = WasmModule::new();
+            let uploader = test_account("alice");
+            let code = mock_wasm_code("large_contract");
+            let (first, second) = code.split_at(10);
+
+            let upload_id = module.begin_store_code(&uploader, code.len() as u64, checksum(&code), None, None, None).unwrap();
+            assert!(module.append_code_chunk(&test_account("bob"), upload_id, 0, first.to_vec()).is_err());
+            assert!(module.append_code_chunk(&uploader, upload_id, 1, first.to_vec()).is_err());
+
+            assert_eq!(module.append_code_chunk(&uploader, upload_id, 0, first.to_vec()), Ok(10));
+            assert!(module.finish_store_code(&uploader, upload_id).is_err());
+            module.append_code_chunk(&uploader, upload_id, 1, second.to_vec()).unwrap();
+
+            let code_id = module.finish_store_code(&uploader, upload_id).unwrap();
+            assert_eq!(module.get_code_info(code_id).unwrap().code_hash, env::sha256(&code));
+            assert!(module.get_upload(upload_id).is_none());
+        }
+
+        #[test]
+        fn test_checksum_mismatch_discards_upload() {
+            setup_test_env();
+            let mut module = WasmModule::new();
+            let uploader = test_account("alice");
+            let code = mock_wasm_code("tampered");
+
+            let upload_id = module.begin_store_code(&uploader, code.len() as u64, checksum(b"other"), None, None, None).unwrap();
+            module.append_code_chunk(&uploader, upload_id, 0, code).unwrap();
+
+            assert!(module.finish_store_code(&uploader, upload_id).unwrap_err().contains("Checksum mismatch"));
+            assert!(module.get_upload(upload_id).is_none());
+            assert!(module.begin_store_code(&uploader, 10, "abcd".to_string(), None, None, None).is_err());
+        }
+
+        #[test]
+        fn test_abandoned_uploads_are_pruned() {
+            setup_test_env();
+            let mut module = WasmModule::new();
+            let uploader = test_account("alice");
+            let code = mock_wasm_code("abandoned");
+
+            let upload_id = module.begin_store_code(&uploader, code.len() as u64, checksum(&code), None, None, None).unwrap();
+            module.append_code_chunk(&uploader, upload_id, 0, code[..5].to_vec()).unwrap();
+
+            let started = env::block_timestamp();
+            assert_eq!(module.prune_abandoned_uploads(started + 1), 0);
+            assert_eq!(module.prune_abandoned_uploads(started + UPLOAD_EXPIRY_NS), 1);
+            assert!(module.get_upload(upload_id).is_none());
+        }
+    }
+}
@@ -46,6 +46,31 @@ pub struct ContractInfo {
     pub extension: Option<String>,
 }
 
+/// Operation recorded in a contract's code history
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+#[serde(rename_all = "snake_case")]
+pub enum ContractCodeHistoryOperationType {
+    Init,
+    Migrate,
+    Genesis,
+}
+
+/// ContractCodeHistoryEntry records a code change of a contract
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct ContractCodeHistoryEntry {
+    pub operation: ContractCodeHistoryOperationType,
+    pub code_id: CodeID,
+    pub updated: u64, // block height
+    pub msg: Vec<u8>,
+}
+
+/// Response for the code_info query
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct CodeInfoResponse {
+    pub code_info: CodeInfo,
+    pub pinned: bool,
+}
+
 /// WasmMsg represents actions that can be taken on the wasm module
 #[derive(Serialize, Deserialize, Clone, Debug)]
 #[serde(rename_all = "snake_case")]
@@ -65,6 +90,16 @@ pub enum WasmMsg {
         label: String,
         admin: Option<String>,
     },
+    /// Instantiate2 creates a contract at an address derived from salt
+    Instantiate2 {
+        code_id: CodeID,
+        msg: Vec<u8>, // JSON encoded init message
+        funds: Vec<Coin>,
+        label: String,
+        admin: Option<String>,
+        salt: Vec<u8>,
+        fix_msg: bool,
+    },
     /// Execute calls a function on a contract
     Execute {
         contract_addr: String,
@@ -77,6 +112,11 @@ pub enum WasmMsg {
         new_code_id: CodeID,
         msg: Vec<u8>, // JSON encoded migrate message
     },
+    /// Sudo calls the privileged entrypoint of a contract (governance only)
+    Sudo {
+        contract_addr: String,
+        msg: Vec<u8>, // JSON encoded sudo message
+    },
     /// UpdateAdmin changes the admin of a contract
     UpdateAdmin {
         contract_addr: String,
@@ -86,6 +126,19 @@ pub enum WasmMsg {
     ClearAdmin {
         contract_addr: String,
     },
+    /// UpdateInstantiateConfig changes who may instantiate a code
+    UpdateInstantiateConfig {
+        code_id: CodeID,
+        instantiate_permission: Option<AccessConfig>,
+    },
+    /// PinCodes keeps codes in the priority cache (governance only)
+    PinCodes {
+        code_ids: Vec<CodeID>,
+    },
+    /// UnpinCodes removes codes from the priority cache (governance only)
+    UnpinCodes {
+        code_ids: Vec<CodeID>,
+    },
 }
 
 /// AccessConfig defines instantiation permissions
@@ -120,6 +173,36 @@ pub struct ExecuteResponse {
     pub events: Vec<String>,
 }
 
+/// Governance proposal content that calls a contract's sudo entrypoint
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct SudoContractProposal {
+    pub title: String,
+    pub description: String,
+    pub contract: String,
+    pub msg: Vec<u8>, // JSON encoded sudo message
+}
+
+/// Entrypoint call waiting for the relayer, which runs the contract code and
+/// reports back through `complete_call`
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct EntryPointCall {
+    pub id: u64,
+    pub contract: ContractAddress,
+    pub code_id: CodeID,
+    pub entry_point: String,
+    pub msg: Vec<u8>,
+    pub height: u64,
+}
+
+/// Response from contract migration
+#[derive(Serialize, Deserialize, Debug, JsonSchema)]
+pub struct MigrateResponse {
+    pub old_code_id: CodeID,
+    pub new_code_id: CodeID,
+    pub data: Option<Vec<u8>>,
+    pub events: Vec<String>,
+}
+
 /// Query messages for the wasm module
 #[derive(Serialize, Deserialize, Clone, Debug)]
 #[serde(rename_all = "snake_case")]
@@ -139,6 +222,10 @@ pub enum WasmQuery {
         start_after: Option<String>,
         limit: Option<u32>,
     },
+    /// Get the code history of a contract
+    ContractHistory { address: String },
+    /// List pinned code IDs
+    PinnedCodes {},
     /// Get raw contract state
     RawContractState {
         address: String,
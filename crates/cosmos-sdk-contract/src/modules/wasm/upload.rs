@@ -0,0 +1,179 @@
+/// Chunked Code Upload
+///
+/// Optimized CosmWasm binaries can still exceed the input size of a single
+/// NEAR function call. Large codes are uploaded in chunks instead: the
+/// uploader announces the final size and SHA-256 checksum, appends the chunks
+/// in order and finishes the upload, which stores the code only if it
+/// matches the checksum. Uploads idle for longer than `UPLOAD_EXPIRY_NS` can
+/// be pruned by anyone so abandoned chunks don't hold storage forever.
+
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::serde::{Deserialize, Serialize};
+use near_sdk::{env, AccountId};
+use schemars::JsonSchema;
+
+use super::module::{WasmModule, MAX_CODE_SIZE};
+use super::types::{AccessConfig, AccessType, CodeID};
+use crate::types::time;
+
+/// Largest chunk accepted by `append_code_chunk`
+pub const MAX_CHUNK_SIZE: usize = 1_000_000;
+
+/// Idle time after which an unfinished upload may be pruned, one day
+pub const UPLOAD_EXPIRY_NS: u64 = time::days_to_nanos(1);
+
+/// Upload in progress
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct CodeUpload {
+    pub upload_id: u64,
+    pub uploader: String,
+    pub expected_size: u64,
+    /// Hex encoded SHA-256 of the complete code
+    pub checksum: String,
+    pub received: u64,
+    pub chunk_count: u32,
+    pub source: Option<String>,
+    pub builder: Option<String>,
+    pub instantiate_permission: AccessType,
+    /// Block timestamp of the last change
+    pub updated_at: u64,
+}
+
+impl WasmModule {
+    fn chunk_key(upload_id: u64, index: u32) -> String {
+        format!("{}:{}", upload_id, index)
+    }
+
+    fn get_own_upload(&self, sender: &AccountId, upload_id: u64) -> Result<CodeUpload, String> {
+        let upload = self.uploads.get(&upload_id)
+            .ok_or_else(|| format!("Upload {} not found", upload_id))?;
+        if upload.uploader != sender.as_str() {
+            return Err(format!("Upload {} belongs to {}", upload_id, upload.uploader));
+        }
+        Ok(upload)
+    }
+
+    /// Start a chunked upload of code with the given size and checksum
+    pub fn begin_store_code(
+        &mut self,
+        sender: &AccountId,
+        expected_size: u64,
+        checksum: String,
+        source: Option<String>,
+        builder: Option<String>,
+        instantiate_permission: Option<AccessConfig>,
+    ) -> Result<u64, String> {
+        if expected_size == 0 || expected_size > MAX_CODE_SIZE as u64 {
+            return Err(format!("Code size must be between 1 and {} bytes", MAX_CODE_SIZE));
+        }
+        let checksum = checksum.to_lowercase();
+        if hex::decode(&checksum).map_or(true, |hash| hash.len() != 32) {
+            return Err("Checksum must be a hex encoded SHA-256 hash".to_string());
+        }
+
+        let upload_id = self.next_upload_id;
+        self.next_upload_id += 1;
+        self.uploads.insert(&upload_id, &CodeUpload {
+            upload_id,
+            uploader: sender.to_string(),
+            expected_size,
+            checksum,
+            received: 0,
+            chunk_count: 0,
+            source,
+            builder,
+            instantiate_permission: self.convert_access_config(instantiate_permission),
+            updated_at: env::block_timestamp(),
+        });
+
+        env::log_str(&format!("WASM: Upload {} started by {} ({} bytes)", upload_id, sender, expected_size));
+        Ok(upload_id)
+    }
+
+    /// Append the next chunk; `index` must follow the previous chunk
+    ///
+    /// Returns the number of bytes received so far.
+    pub fn append_code_chunk(
+        &mut self,
+        sender: &AccountId,
+        upload_id: u64,
+        index: u32,
+        chunk: Vec<u8>,
+    ) -> Result<u64, String> {
+        let mut upload = self.get_own_upload(sender, upload_id)?;
+        if index != upload.chunk_count {
+            return Err(format!("Expected chunk {}, got {}", upload.chunk_count, index));
+        }
+        if chunk.is_empty() || chunk.len() > MAX_CHUNK_SIZE {
+            return Err(format!("Chunk size must be between 1 and {} bytes", MAX_CHUNK_SIZE));
+        }
+        if upload.received + chunk.len() as u64 > upload.expected_size {
+            return Err(format!("Chunk exceeds the announced size of {} bytes", upload.expected_size));
+        }
+
+        self.upload_chunks.insert(&Self::chunk_key(upload_id, index), &chunk);
+        upload.received += chunk.len() as u64;
+        upload.chunk_count += 1;
+        upload.updated_at = env::block_timestamp();
+        self.uploads.insert(&upload_id, &upload);
+        Ok(upload.received)
+    }
+
+    /// Assemble the chunks and store the code if it matches the checksum
+    ///
+    /// The upload is removed either way once all bytes were received, so a
+    /// corrupted upload has to start over.
+    pub fn finish_store_code(&mut self, sender: &AccountId, upload_id: u64) -> Result<CodeID, String> {
+        let upload = self.get_own_upload(sender, upload_id)?;
+        if upload.received != upload.expected_size {
+            return Err(format!("Upload {} has {} of {} bytes", upload_id, upload.received, upload.expected_size));
+        }
+
+        let mut code = Vec::with_capacity(upload.expected_size as usize);
+        for index in 0..upload.chunk_count {
+            let chunk = self.upload_chunks.get(&Self::chunk_key(upload_id, index))
+                .ok_or_else(|| format!("Chunk {} of upload {} is missing", index, upload_id))?;
+            code.extend_from_slice(&chunk);
+        }
+        self.remove_upload(&upload);
+
+        let checksum = hex::encode(env::sha256(&code));
+        if checksum != upload.checksum {
+            return Err(format!("Checksum mismatch: expected {}, got {}", upload.checksum, checksum));
+        }
+
+        self.store_code_with_permission(sender, code, upload.source, upload.builder, upload.instantiate_permission)
+    }
+
+    pub fn cancel_upload(&mut self, sender: &AccountId, upload_id: u64) -> Result<(), String> {
+        let upload = self.get_own_upload(sender, upload_id)?;
+        self.remove_upload(&upload);
+        env::log_str(&format!("WASM: Upload {} cancelled", upload_id));
+        Ok(())
+    }
+
+    /// Remove uploads idle for longer than `UPLOAD_EXPIRY_NS`
+    ///
+    /// Returns the number of uploads removed.
+    pub fn prune_abandoned_uploads(&mut self, now: u64) -> u32 {
+        let expired: Vec<CodeUpload> = self.uploads.values()
+            .filter(|upload| now >= upload.updated_at + UPLOAD_EXPIRY_NS)
+            .collect();
+        for upload in &expired {
+            self.remove_upload(upload);
+            env::log_str(&format!("WASM: Pruned abandoned upload {}", upload.upload_id));
+        }
+        expired.len() as u32
+    }
+
+    pub fn get_upload(&self, upload_id: u64) -> Option<CodeUpload> {
+        self.uploads.get(&upload_id)
+    }
+
+    fn remove_upload(&mut self, upload: &CodeUpload) {
+        for index in 0..upload.chunk_count {
+            self.upload_chunks.remove(&Self::chunk_key(upload.upload_id, index));
+        }
+        self.uploads.remove(&upload.upload_id);
+    }
+}
@@ -0,0 +1,503 @@
+/// Entrypoint Schemas
+///
+/// Machine-readable description of every router entrypoint. Each method gets
+/// a JSON Schema for its argument object and for its return value, which the
+/// `contract_metadata` view publishes so front-ends and the CLI can generate
+/// forms and validate input before sending a transaction.
+
+use schemars::schema::RootSchema;
+use schemars::{schema_for, JsonSchema};
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+
+use crate::chain_registry::ChainRegistryInfo;
+use crate::factory::{ExportedGenesis, InstanceGenesis, InstanceInfo};
+use crate::handler::timelock::{AdminOperation, QueuedOperation};
+use crate::modules::bank::{NativeToken, StorageBalance, StorageBalanceBounds, SupplyOfResponse};
+use crate::modules::block::{BlockHeader, BlockResults, QueryEnvelope};
+use crate::modules::gov::UpgradePlan;
+use crate::{
+    AccessConfig, CodeInfo, Coin, ContractInfo, ExecuteResponse, InstantiateResponse, ModuleInfo,
+    StoreCodeResponse,
+};
+
+/// Version of the schema layout, bumped when entrypoints change
+pub const SCHEMA_VERSION: &str = "1.0.0";
+
+/// How an entrypoint is invoked on NEAR
+#[derive(Serialize, Deserialize, Clone, Copy, Debug, PartialEq, JsonSchema)]
+#[serde(rename_all = "snake_case")]
+pub enum EntrypointKind {
+    /// Constructor, callable once
+    Init,
+    /// State-changing function call
+    Call,
+    /// Read-only view call
+    View,
+}
+
+/// Schema of a single entrypoint
+#[derive(Serialize, Deserialize, Clone, Debug)]
+pub struct EntrypointSchema {
+    pub name: String,
+    pub kind: EntrypointKind,
+    /// Whether the method accepts an attached deposit
+    pub payable: bool,
+    /// Schema of the JSON argument object
+    pub input: RootSchema,
+    /// Schema of the returned JSON value
+    pub output: RootSchema,
+}
+
+/// Arguments of methods that take none
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct NoArgs {}
+
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct RegisterModuleArgs {
+    pub module_type: String,
+    pub contract_id: String,
+    pub version: String,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct ModuleTypeArgs {
+    pub module_type: String,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct ChainRegistryInfoArgs {
+    pub info: ChainRegistryInfo,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct TransferOwnershipArgs {
+    pub new_owner: String,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct NewInstanceArgs {
+    pub genesis: InstanceGenesis,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct HaltHeightArgs {
+    pub height: u64,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct ApproveUpgradeArgs {
+    pub plan: UpgradePlan,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct ApplyUpgradeArgs {
+    /// Base64 encoded contract code
+    pub code: String,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct SetInstanceCodeArgs {
+    /// Hex encoded SHA-256 of the router code
+    pub code_hash: String,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct CreateInstanceArgs {
+    pub name: String,
+    pub genesis: InstanceGenesis,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct InstanceNameArgs {
+    pub name: String,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct QueueAdminOperationArgs {
+    pub operation: AdminOperation,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct AdminOperationIdArgs {
+    pub id: u64,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct ExecuteAdminOperationArgs {
+    pub id: u64,
+    /// Base64 encoded router code of a `set_instance_code` operation
+    pub code: Option<String>,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct AdminDelayArgs {
+    pub delay_ns: u64,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct InstanceCreatedArgs {
+    pub name: String,
+    /// Account refunded if the creation failed
+    pub payer: String,
+    /// Deposit attached to the creation, as a decimal string
+    pub deposit: String,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct WithdrawArgs {
+    /// Amount of `unear` as a decimal string
+    pub amount: String,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct AccountIdArgs {
+    pub account_id: String,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct HeightArgs {
+    pub height: u64,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct RetentionArgs {
+    pub retention: u64,
+}
+
+/// Arguments of `supply_of`, `prove` asks for an ICS-23 proof
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct SupplyOfArgs {
+    pub denom: String,
+    pub prove: Option<bool>,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct FtTransferArgs {
+    pub receiver_id: String,
+    /// Amount of `unear` as a decimal string
+    pub amount: String,
+    pub memo: Option<String>,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct FtTransferCallArgs {
+    pub receiver_id: String,
+    /// Amount of `unear` as a decimal string
+    pub amount: String,
+    pub memo: Option<String>,
+    /// Passed on to the receiver's `ft_on_transfer`
+    pub msg: String,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct FtResolveTransferArgs {
+    pub sender_id: String,
+    pub receiver_id: String,
+    pub amount: String,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct StorageDepositArgs {
+    pub account_id: Option<String>,
+    pub registration_only: Option<bool>,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct StorageUnregisterArgs {
+    pub force: Option<bool>,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct AtomicCallerArgs {
+    pub caller: String,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct AtomicMsgArgs {
+    pub type_url: String,
+    /// Base64 encoded JSON message
+    pub value: String,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct AtomicCallArgs {
+    pub messages: Vec<AtomicMsgArgs>,
+    pub callback: Option<String>,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct AtomicExecutionArgs {
+    pub call_id: u64,
+    pub caller: String,
+    pub messages: Vec<AtomicMsgArgs>,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct AtomicExecuteArgs {
+    pub execution: AtomicExecutionArgs,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct OnAtomicCallArgs {
+    pub call_id: u64,
+    pub caller: String,
+    pub callback: Option<String>,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct GrantSessionKeyArgs {
+    /// NEAR public key, e.g. `ed25519:...`
+    pub access_key: String,
+    /// `SessionGrant` of the auth module
+    pub grant: serde_json::Value,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct AccessKeyArgs {
+    pub access_key: String,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct WasmStoreCodeArgs {
+    pub wasm_byte_code: Vec<u8>,
+    pub source: Option<String>,
+    pub builder: Option<String>,
+    pub instantiate_permission: Option<AccessConfig>,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct WasmInstantiateArgs {
+    pub code_id: u64,
+    pub msg: String,
+    pub funds: Option<Vec<Coin>>,
+    pub label: String,
+    pub admin: Option<String>,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct WasmExecuteArgs {
+    pub contract_addr: String,
+    pub msg: String,
+    pub funds: Option<Vec<Coin>>,
+}
+
+/// Arguments of `wasm_apply_response`, the response is a CosmWasm `Response`
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct WasmApplyResponseArgs {
+    pub contract_addr: String,
+    pub response: serde_json::Value,
+}
+
+/// Arguments of `wasm_query_modules`, the request is a CosmWasm module query
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct WasmQueryModulesArgs {
+    pub request: serde_json::Value,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct CodeIdArgs {
+    pub code_id: u64,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, JsonSchema)]
+pub struct ContractAddrArgs {
+    pub contract_addr: String,
+}
+
+fn entrypoint<I: JsonSchema, O: JsonSchema>(name: &str, kind: EntrypointKind, payable: bool) -> EntrypointSchema {
+    EntrypointSchema {
+        name: name.to_string(),
+        kind,
+        payable,
+        input: schema_for!(I),
+        output: schema_for!(O),
+    }
+}
+
+/// Schemas of all router entrypoints, in declaration order
+pub fn entrypoint_schemas() -> Vec<EntrypointSchema> {
+    use EntrypointKind::{Call, Init, View};
+
+    vec![
+        entrypoint::<NoArgs, ()>("new", Init, false),
+        entrypoint::<NewInstanceArgs, ()>("new_instance", Init, false),
+        entrypoint::<NoArgs, ()>("migrate", Init, false),
+        entrypoint::<RegisterModuleArgs, u64>("register_module", Call, false),
+        entrypoint::<NoArgs, HashMap<String, ModuleInfo>>("get_modules", View, false),
+        entrypoint::<ModuleTypeArgs, String>("get_module_version", View, false),
+        entrypoint::<ModuleTypeArgs, bool>("is_module_registered", View, false),
+        entrypoint::<NoArgs, HashMap<String, bool>>("health_check", View, false),
+        entrypoint::<NoArgs, serde_json::Value>("get_metadata", View, false),
+        entrypoint::<NoArgs, serde_json::Value>("chain_metadata", View, false),
+        entrypoint::<NoArgs, NativeToken>("get_native_token", View, false),
+        entrypoint::<ChainRegistryInfoArgs, ()>("set_chain_registry_info", Call, false),
+        entrypoint::<NoArgs, serde_json::Value>("contract_metadata", View, false),
+        entrypoint::<NoArgs, ViewManifest>("views_manifest", View, false),
+        entrypoint::<NoArgs, String>("test_function", View, false),
+        entrypoint::<NoArgs, String>("get_owner", View, false),
+        entrypoint::<TransferOwnershipArgs, u64>("transfer_ownership", Call, false),
+        entrypoint::<NoArgs, serde_json::Value>("get_stats", View, false),
+        entrypoint::<HaltHeightArgs, ()>("schedule_halt", Call, false),
+        entrypoint::<NoArgs, ()>("cancel_halt", Call, false),
+        entrypoint::<NoArgs, Option<u64>>("get_halt_height", View, false),
+        entrypoint::<NoArgs, ExportedGenesis>("export_genesis", View, false),
+        entrypoint::<ApproveUpgradeArgs, ()>("approve_upgrade", Call, false),
+        entrypoint::<NoArgs, Option<UpgradePlan>>("get_pending_upgrade", View, false),
+        entrypoint::<ApplyUpgradeArgs, ()>("apply_upgrade", Call, false),
+        entrypoint::<ApproveUpgradeArgs, bool>("on_upgrade_applied", Call, false),
+        entrypoint::<QueueAdminOperationArgs, u64>("queue_admin_operation", Call, false),
+        entrypoint::<AdminOperationIdArgs, u32>("approve_admin_operation", Call, false),
+        // Instance creations resolve to the result of `on_instance_created`
+        entrypoint::<ExecuteAdminOperationArgs, bool>("execute_admin_operation", Call, true),
+        entrypoint::<AdminOperationIdArgs, ()>("cancel_admin_operation", Call, false),
+        entrypoint::<AdminDelayArgs, ()>("set_admin_delay", Call, false),
+        entrypoint::<NoArgs, Vec<QueuedOperation>>("get_admin_operations", View, false),
+        entrypoint::<NoArgs, u64>("get_admin_delay", View, false),
+        entrypoint::<SetInstanceCodeArgs, u64>("set_instance_code", Call, false),
+        entrypoint::<CreateInstanceArgs, u64>("create_instance", Call, false),
+        entrypoint::<InstanceCreatedArgs, bool>("on_instance_created", Call, false),
+        entrypoint::<InstanceNameArgs, Option<InstanceInfo>>("get_instance", View, false),
+        entrypoint::<NoArgs, HashMap<String, InstanceInfo>>("get_instances", View, false),
+        entrypoint::<NoArgs, String>("deposit", Call, true),
+        entrypoint::<WithdrawArgs, ()>("withdraw", Call, false),
+        entrypoint::<AccountIdArgs, String>("get_deposit", View, false),
+        entrypoint::<SupplyOfArgs, QueryEnvelope<SupplyOfResponse>>("supply_of", View, false),
+        entrypoint::<NoArgs, BlockHeader>("process_block", Call, false),
+        entrypoint::<HeightArgs, Option<BlockHeader>>("block", View, false),
+        entrypoint::<NoArgs, Option<BlockHeader>>("latest_block", View, false),
+        entrypoint::<HeightArgs, Option<BlockResults>>("block_results", View, false),
+        entrypoint::<NoArgs, u64>("prune_blocks", Call, false),
+        entrypoint::<RetentionArgs, ()>("set_block_retention", Call, false),
+        entrypoint::<NoArgs, u64>("get_block_retention", View, false),
+        entrypoint::<NoArgs, ()>("fund_keeper", Call, true),
+        entrypoint::<AccountIdArgs, String>("get_keeper_earned", View, false),
+        entrypoint::<NoArgs, String>("get_keeper_fund", View, false),
+        entrypoint::<NoArgs, ()>("withdraw_keeper_rewards", Call, false),
+        entrypoint::<FtTransferArgs, ()>("ft_transfer", Call, true),
+        // Resolves to the amount the receiver kept
+        entrypoint::<FtTransferCallArgs, String>("ft_transfer_call", Call, true),
+        entrypoint::<FtResolveTransferArgs, String>("ft_resolve_transfer", Call, false),
+        entrypoint::<NoArgs, String>("ft_total_supply", View, false),
+        entrypoint::<AccountIdArgs, String>("ft_balance_of", View, false),
+        entrypoint::<StorageDepositArgs, StorageBalance>("storage_deposit", Call, true),
+        entrypoint::<StorageUnregisterArgs, bool>("storage_unregister", Call, true),
+        entrypoint::<AccountIdArgs, Option<StorageBalance>>("storage_balance_of", View, false),
+        entrypoint::<NoArgs, StorageBalanceBounds>("storage_balance_bounds", View, false),
+        entrypoint::<AtomicCallerArgs, ()>("allow_atomic_caller", Call, false),
+        entrypoint::<AtomicCallerArgs, ()>("remove_atomic_caller", Call, false),
+        entrypoint::<NoArgs, Vec<String>>("get_atomic_callers", View, false),
+        // Resolves to the `AtomicCallResult` of `on_atomic_call`
+        entrypoint::<AtomicCallArgs, serde_json::Value>("atomic_call", Call, false),
+        entrypoint::<AtomicExecuteArgs, Vec<serde_json::Value>>("atomic_execute", Call, false),
+        entrypoint::<OnAtomicCallArgs, serde_json::Value>("on_atomic_call", Call, false),
+        entrypoint::<GrantSessionKeyArgs, String>("grant_session_key", Call, true),
+        entrypoint::<AccessKeyArgs, ()>("revoke_session_key", Call, true),
+        entrypoint::<AccountIdArgs, Vec<serde_json::Value>>("get_session_keys", View, false),
+        entrypoint::<WasmStoreCodeArgs, StoreCodeResponse>("wasm_store_code", Call, true),
+        entrypoint::<WasmInstantiateArgs, InstantiateResponse>("wasm_instantiate", Call, true),
+        entrypoint::<WasmExecuteArgs, ExecuteResponse>("wasm_execute", Call, true),
+        entrypoint::<WasmApplyResponseArgs, String>("wasm_apply_response", Call, false),
+        entrypoint::<WasmQueryModulesArgs, String>("wasm_query_modules", View, false),
+        // Wasm queries write no state but forward to the wasm module with a
+        // cross-contract call. NEAR refuses to create promises in a view call
+        // (`ProhibitedInView`), so as views they would always fail; they are
+        // listed as calls to be sent as transactions.
+        entrypoint::<CodeIdArgs, Option<CodeInfo>>("wasm_code_info", Call, false),
+        entrypoint::<CodeIdArgs, Option<CodeInfo>>("wasm_get_code_info", Call, false),
+        entrypoint::<ContractAddrArgs, Option<ContractInfo>>("wasm_get_contract_info", Call, false),
+        entrypoint::<NoArgs, serde_json::Value>("wasm_health_check", Call, false),
+    ]
+}
+
+/// Which exports are read-only views and which mutate state
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, JsonSchema)]
+pub struct ViewManifest {
+    /// Methods safe to call with a NEAR view call
+    pub views: Vec<String>,
+    /// Methods that must be sent as a transaction, including read-only ones
+    /// that query another contract
+    pub calls: Vec<String>,
+}
+
+/// Build the manifest of view and call exports
+pub fn view_manifest() -> ViewManifest {
+    let mut manifest = ViewManifest { views: vec![], calls: vec![] };
+    for schema in entrypoint_schemas() {
+        match schema.kind {
+            EntrypointKind::View => manifest.views.push(schema.name),
+            EntrypointKind::Call | EntrypointKind::Init => manifest.calls.push(schema.name),
+        }
+    }
+    manifest
+}
+
+/// Look up the schema of one entrypoint
+pub fn entrypoint_schema(name: &str) -> Option<EntrypointSchema> {
+    entrypoint_schemas().into_iter().find(|schema| schema.name == name)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_entrypoint_names_are_unique() {
+        let schemas = entrypoint_schemas();
+        let mut names: Vec<&str> = schemas.iter().map(|schema| schema.name.as_str()).collect();
+        names.sort();
+        names.dedup();
+        assert_eq!(names.len(), schemas.len());
+    }
+
+    #[test]
+    fn test_input_schema_lists_required_fields() {
+        let schema = entrypoint_schema("register_module").unwrap();
+        assert_eq!(schema.kind, EntrypointKind::Call);
+
+        let json = serde_json::to_value(&schema.input).unwrap();
+        let required = json["required"].as_array().unwrap();
+        assert!(required.contains(&serde_json::json!("module_type")));
+        assert!(required.contains(&serde_json::json!("contract_id")));
+        assert!(required.contains(&serde_json::json!("version")));
+    }
+
+    #[test]
+    fn test_payable_entrypoints() {
+        let payable: Vec<String> = entrypoint_schemas()
+            .into_iter()
+            .filter(|schema| schema.payable)
+            .map(|schema| schema.name)
+            .collect();
+        assert_eq!(payable, vec![
+            "execute_admin_operation", "deposit", "fund_keeper", "ft_transfer", "ft_transfer_call", "storage_deposit",
+            "storage_unregister", "grant_session_key", "revoke_session_key", "wasm_store_code", "wasm_instantiate",
+            "wasm_execute",
+        ]);
+    }
+
+    #[test]
+    fn test_view_manifest_partitions_entrypoints() {
+        let manifest = view_manifest();
+        assert_eq!(manifest.views.len() + manifest.calls.len(), entrypoint_schemas().len());
+
+        assert!(manifest.views.contains(&"get_modules".to_string()));
+        assert!(manifest.views.contains(&"views_manifest".to_string()));
+        assert!(manifest.calls.contains(&"register_module".to_string()));
+        assert!(manifest.calls.contains(&"wasm_execute".to_string()));
+        assert!(manifest.calls.contains(&"wasm_get_code_info".to_string()));
+
+        // Payable methods always need a transaction
+        for schema in entrypoint_schemas().iter().filter(|schema| schema.payable) {
+            assert!(!manifest.views.contains(&schema.name));
+        }
+    }
+
+    #[test]
+    fn test_output_schema_references_response_type() {
+        let schema = entrypoint_schema("wasm_instantiate").unwrap();
+        let json = serde_json::to_value(&schema.output).unwrap();
+        assert_eq!(json["title"], "InstantiateResponse");
+        assert!(entrypoint_schema("unknown").is_none());
+    }
+}
@@ -0,0 +1,62 @@
+/// Governance Authority
+///
+/// Modules that governance configures check callers against the account
+/// governance acts through. Until it is handed to another account that is
+/// the contract itself, the predecessor when an executed proposal calls back
+/// into it. Borsh encodes `Authority` like the `Option<AccountId>` it wraps,
+/// so modules that stored one keep their state layout.
+
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::{env, AccountId};
+
+#[derive(BorshDeserialize, BorshSerialize, Clone, Debug, Default, PartialEq)]
+pub struct Authority(Option<AccountId>);
+
+impl Authority {
+    /// Account that governance acts through
+    pub fn account(&self) -> AccountId {
+        self.0.clone().unwrap_or_else(env::current_account_id)
+    }
+
+    /// Fail with `error` unless `sender` is the authority
+    pub fn check(&self, sender: &AccountId, error: &str) -> Result<(), String> {
+        if sender != &self.account() {
+            return Err(error.to_string());
+        }
+        Ok(())
+    }
+
+    /// Hand the authority over to another account
+    pub fn transfer(&mut self, sender: &AccountId, new_authority: AccountId) -> Result<(), String> {
+        self.check(sender, "Only the governance authority can change the authority")?;
+        self.0 = Some(new_authority);
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use near_sdk::test_utils::VMContextBuilder;
+    use near_sdk::testing_env;
+
+    #[test]
+    fn test_authority_defaults_to_the_contract() {
+        testing_env!(VMContextBuilder::new().current_account_id("router.near".parse().unwrap()).build());
+        let router: AccountId = "router.near".parse().unwrap();
+        let dao: AccountId = "dao.near".parse().unwrap();
+
+        let mut authority = Authority::default();
+        assert_eq!(authority.account(), router);
+        assert_eq!(authority.check(&dao, "Not allowed").unwrap_err(), "Not allowed");
+        assert!(authority.transfer(&dao, dao.clone()).is_err());
+
+        authority.transfer(&router, dao.clone()).unwrap();
+        authority.check(&dao, "Not allowed").unwrap();
+        assert!(authority.check(&router, "Not allowed").is_err());
+
+        // Stored like the optional account it replaced
+        let stored = borsh::to_vec(&Some(dao.clone())).unwrap();
+        assert_eq!(Authority::try_from_slice(&stored).unwrap(), authority);
+    }
+}
@@ -31,6 +31,9 @@ pub struct MsgSend {
     pub from_address: String,
     pub to_address: String,
     pub amount: Vec<Coin>,
+    /// optional payment reference, at most 256 bytes
+    #[serde(default)]
+    pub memo: String,
 }
 
 /// Input for MsgMultiSend
@@ -161,6 +164,9 @@ pub struct MsgSubmitProposal {
     pub content: Any,
     pub initial_deposit: Vec<Coin>,
     pub proposer: String,
+    /// Off-chain metadata such as an IPFS CID, URL or JSON document
+    #[serde(default)]
+    pub metadata: String,
 }
 
 /// MsgVote defines a message to cast a vote.
@@ -169,6 +175,9 @@ pub struct MsgVote {
     pub proposal_id: u64,
     pub voter: String,
     pub option: VoteOption,
+    /// Off-chain metadata justifying the vote
+    #[serde(default)]
+    pub metadata: String,
 }
 
 /// MsgVoteWeighted defines a message to cast a vote with weights.
@@ -210,6 +219,9 @@ pub struct MsgTransfer {
     /// timeout timestamp in absolute nanoseconds since unix epoch.
     /// The timeout is disabled when set to 0.
     pub timeout_timestamp: u64,
+    /// optional memo carried in the ICS-20 packet data
+    #[serde(default)]
+    pub memo: String,
 }
 
 /// MsgChannelOpenInit defines a msg sent by a Relayer to Chain A to initialize a channel opening handshake with Chain B.
@@ -410,6 +422,7 @@ mod tests {
                 Coin::new("uatom", "1000000"),
                 Coin::new("stake", "500000"),
             ],
+            memo: "deposit-1234".to_string(),
         };
         
         // Test Borsh serialization
@@ -503,6 +516,7 @@ mod tests {
             proposal_id: 42,
             voter: "cosmos1voter".to_string(),
             option: VoteOption::Yes,
+            metadata: "ipfs://QmVoteRationale".to_string(),
         };
         
         // Test Borsh serialization
@@ -526,6 +540,7 @@ mod tests {
             receiver: "near1receiver".to_string(),
             timeout_height: Height::new(1, 12345),
             timeout_timestamp: 1640995200000000000,
+            memo: "{\"wasm\":{\"contract\":\"swap.near\",\"msg\":{}}}".to_string(),
         };
         
         // Test Borsh serialization
@@ -537,6 +552,11 @@ mod tests {
         let json_str = serde_json::to_string(&msg).unwrap();
         let json_msg: MsgTransfer = serde_json::from_str(&json_str).unwrap();
         assert_eq!(msg, json_msg);
+
+        // Memo is optional on the wire
+        let legacy_json = json_str.replace(&format!(",\"memo\":{}", serde_json::to_string(&msg.memo).unwrap()), "");
+        let legacy_msg: MsgTransfer = serde_json::from_str(&legacy_json).unwrap();
+        assert_eq!(legacy_msg.memo, "");
     }
 
     // ========================================================================
@@ -727,6 +747,7 @@ mod tests {
             from_address: "cosmos1sender".to_string(),
             to_address: "cosmos1receiver".to_string(),
             amount: vec![],
+            memo: String::new(),
         };
         
         let borsh_bytes = to_vec(&msg_send_empty).unwrap();
@@ -744,6 +765,7 @@ mod tests {
             from_address: "cosmos1sender".to_string(),
             to_address: "cosmos1receiver".to_string(),
             amount: vec![coin_zero],
+            memo: String::new(),
         };
         
         let borsh_bytes = to_vec(&msg_with_zero).unwrap();
@@ -1,5 +1,10 @@
+pub mod authority;
+pub mod codec;
 pub mod cosmos_messages;
 pub mod cosmos_tx;
+pub mod time;
 
+pub use authority::Authority;
+pub use codec::{BorshCodec, Codec, JsonCodec, ProtobufCodec};
 pub use cosmos_messages::*;
 pub use cosmos_tx::*;
\ No newline at end of file
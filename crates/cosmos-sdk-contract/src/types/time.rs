@@ -0,0 +1,161 @@
+/// Time and Durations
+///
+/// Chain time in the contract is a `u64` of nanoseconds since the Unix epoch,
+/// as returned by `env::block_timestamp()`. `std::time::SystemTime` and
+/// `Instant` panic on wasm32-unknown-unknown, so nothing here touches them
+/// and modules should use these helpers instead. Arithmetic saturates rather
+/// than wraps: a deadline pushed past `u64::MAX` means "never", not a time
+/// back in 1970.
+///
+/// Some periods are counted in blocks (governance voting, the mint module's
+/// year) and others in time (unbonding, IBC timeouts, timelocks). `BlockTime`
+/// converts between the two from the block rate observed in recorded
+/// headers.
+
+use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
+use near_sdk::env;
+use near_sdk::serde::{Deserialize, Serialize};
+use schemars::JsonSchema;
+
+pub const NANOS_PER_SECOND: u64 = 1_000_000_000;
+pub const SECONDS_PER_MINUTE: u64 = 60;
+pub const SECONDS_PER_HOUR: u64 = 60 * SECONDS_PER_MINUTE;
+pub const SECONDS_PER_DAY: u64 = 24 * SECONDS_PER_HOUR;
+
+/// Block time assumed until headers have been observed, NEAR's one second
+/// target
+pub const DEFAULT_BLOCK_TIME_NS: u64 = NANOS_PER_SECOND;
+
+/// Current block time in nanoseconds
+pub fn now() -> u64 {
+    env::block_timestamp()
+}
+
+/// Current block time in whole seconds
+pub fn now_seconds() -> u64 {
+    nanos_to_seconds(now())
+}
+
+pub const fn seconds_to_nanos(seconds: u64) -> u64 {
+    seconds.saturating_mul(NANOS_PER_SECOND)
+}
+
+pub const fn nanos_to_seconds(nanos: u64) -> u64 {
+    nanos / NANOS_PER_SECOND
+}
+
+pub const fn hours_to_nanos(hours: u64) -> u64 {
+    seconds_to_nanos(hours.saturating_mul(SECONDS_PER_HOUR))
+}
+
+pub const fn days_to_nanos(days: u64) -> u64 {
+    seconds_to_nanos(days.saturating_mul(SECONDS_PER_DAY))
+}
+
+/// `timestamp` moved forward by `duration` nanoseconds
+pub const fn add_nanos(timestamp: u64, duration: u64) -> u64 {
+    timestamp.saturating_add(duration)
+}
+
+/// `timestamp` in nanoseconds moved forward by `seconds`
+pub const fn add_seconds(timestamp: u64, seconds: u64) -> u64 {
+    add_nanos(timestamp, seconds_to_nanos(seconds))
+}
+
+/// Nanoseconds from `since` to `now`, zero if `now` is earlier
+pub const fn elapsed(since: u64, now: u64) -> u64 {
+    now.saturating_sub(since)
+}
+
+/// Whether `deadline` has been reached at `now`
+pub const fn has_passed(deadline: u64, now: u64) -> bool {
+    now >= deadline
+}
+
+/// Average time between blocks
+#[derive(BorshDeserialize, BorshSerialize, Serialize, Deserialize, Clone, Copy, Debug, PartialEq, Eq, JsonSchema)]
+pub struct BlockTime {
+    pub nanos_per_block: u64,
+}
+
+impl Default for BlockTime {
+    fn default() -> Self {
+        Self { nanos_per_block: DEFAULT_BLOCK_TIME_NS }
+    }
+}
+
+impl BlockTime {
+    /// Block time of a fixed rate, at least one nanosecond
+    pub fn new(nanos_per_block: u64) -> Self {
+        Self { nanos_per_block: nanos_per_block.max(1) }
+    }
+
+    /// Average block time between two observed blocks
+    ///
+    /// Observations that do not move forward in both height and time give
+    /// the default.
+    pub fn from_observation(from_height: u64, from_time: u64, to_height: u64, to_time: u64) -> Self {
+        if to_height <= from_height || to_time <= from_time {
+            return Self::default();
+        }
+        Self::new((to_time - from_time) / (to_height - from_height))
+    }
+
+    pub fn blocks_to_nanos(&self, blocks: u64) -> u64 {
+        blocks.saturating_mul(self.nanos_per_block)
+    }
+
+    /// Blocks needed for `duration` nanoseconds to pass, rounded up
+    pub fn nanos_to_blocks(&self, duration: u64) -> u64 {
+        duration / self.nanos_per_block + (duration % self.nanos_per_block != 0) as u64
+    }
+
+    pub fn seconds_to_blocks(&self, seconds: u64) -> u64 {
+        self.nanos_to_blocks(seconds_to_nanos(seconds))
+    }
+
+    /// Expected time of `height`, given that `now_height` was at `now_time`
+    pub fn time_at_height(&self, now_height: u64, now_time: u64, height: u64) -> u64 {
+        if height >= now_height {
+            add_nanos(now_time, self.blocks_to_nanos(height - now_height))
+        } else {
+            now_time.saturating_sub(self.blocks_to_nanos(now_height - height))
+        }
+    }
+
+    /// First height expected at or after `timestamp`
+    pub fn height_at_time(&self, now_height: u64, now_time: u64, timestamp: u64) -> u64 {
+        now_height.saturating_add(self.nanos_to_blocks(elapsed(now_time, timestamp)))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_conversions_saturate() {
+        assert_eq!(seconds_to_nanos(2), 2_000_000_000);
+        assert_eq!(days_to_nanos(1), 86_400 * NANOS_PER_SECOND);
+        assert_eq!(seconds_to_nanos(u64::MAX), u64::MAX);
+        assert_eq!(add_seconds(u64::MAX - 1, 1), u64::MAX);
+        assert_eq!(elapsed(10, 4), 0);
+        assert!(has_passed(10, 10));
+        assert!(!has_passed(u64::MAX, u64::MAX - 1));
+    }
+
+    #[test]
+    fn test_block_time_from_observation() {
+        let block_time = BlockTime::from_observation(100, 0, 200, 120 * NANOS_PER_SECOND);
+        assert_eq!(block_time.nanos_per_block, 1_200_000_000);
+
+        // A minute needs 50 blocks at 1.2s, a bit more rounds up
+        assert_eq!(block_time.seconds_to_blocks(60), 50);
+        assert_eq!(block_time.nanos_to_blocks(seconds_to_nanos(60) + 1), 51);
+        assert_eq!(block_time.time_at_height(200, 1_000, 210), 1_000 + 12 * NANOS_PER_SECOND);
+        assert_eq!(block_time.height_at_time(200, 0, seconds_to_nanos(6)), 205);
+
+        assert_eq!(BlockTime::from_observation(5, 10, 5, 20), BlockTime::default());
+        assert_eq!(BlockTime::from_observation(5, 10, 6, 10), BlockTime::default());
+    }
+}
@@ -5,6 +5,7 @@
 /// and complex workflows.
 
 use anyhow::Result;
+use near_workspaces::result::ExecutionFinalResult;
 use near_workspaces::{types::NearToken, Account, Contract, Worker};
 use serde_json::json;
 use serde::{Deserialize, Serialize};
@@ -18,6 +19,25 @@ struct ModuleInfo {
 
 const WASM_FILEPATH: &str = "./target/near/cosmos_sdk_contract.wasm";
 
+/// Queue an owner operation and execute it right away
+async fn run_owner_operation(contract: &Contract, method: &str, args: serde_json::Value) -> Result<ExecutionFinalResult> {
+    let id: u64 = contract
+        .call(method)
+        .args_json(args)
+        .max_gas()
+        .transact()
+        .await?
+        .into_result()?
+        .json()?;
+    
+    Ok(contract
+        .call("execute_admin_operation")
+        .args_json(json!({ "id": id }))
+        .max_gas()
+        .transact()
+        .await?)
+}
+
 /// Test infrastructure for managing multiple contracts and accounts
 struct TestEnvironment {
     worker: Worker<near_workspaces::network::Sandbox>,
@@ -52,6 +72,16 @@ impl TestEnvironment {
             .await?
             .into_result()?;
         
+        // The contract is its own governance until a gov module is
+        // registered; lift the timelock delay so owner operations run at once
+        contract
+            .call("set_admin_delay")
+            .args_json(json!({ "delay_ns": 0 }))
+            .max_gas()
+            .transact()
+            .await?
+            .into_result()?;
+        
         self.contracts.insert(name.to_string(), contract);
         Ok(())
     }
@@ -208,16 +238,11 @@ async fn test_complex_workflow_integration() -> Result<()> {
     
     for (module_type, contract_id, version) in modules.iter() {
         // Use the contract itself as the owner to register modules
-        let result = contract
-            .call("register_module")
-            .args_json(json!({
-                "module_type": module_type,
-                "contract_id": contract_id,
-                "version": version
-            }))
-            .max_gas()
-            .transact()
-            .await?;
+        let result = run_owner_operation(contract, "register_module", json!({
+            "module_type": module_type,
+            "contract_id": contract_id,
+            "version": version
+        })).await?;
         
         assert!(result.is_success());
         println!("  ✅ Registered module: {} -> {}", module_type, contract_id);
@@ -306,30 +331,20 @@ async fn test_state_persistence_integration() -> Result<()> {
     println!("🏗️ Phase 1: Initial State Setup");
     
     // Register initial modules (contract is its own owner)
-    let register_wasm = contract
-        .call("register_module")
-        .args_json(json!({
-            "module_type": "wasm",
-            "contract_id": "wasm.near",
-            "version": "1.0.0"
-        }))
-        .max_gas()
-        .transact()
-        .await?;
+    let register_wasm = run_owner_operation(contract, "register_module", json!({
+        "module_type": "wasm",
+        "contract_id": "wasm.near",
+        "version": "1.0.0"
+    })).await?;
     
     assert!(register_wasm.is_success());
     println!("  ✅ Registered wasm module");
     
-    let register_bank = contract
-        .call("register_module")
-        .args_json(json!({
-            "module_type": "bank",
-            "contract_id": "bank.near",
-            "version": "1.0.0"
-        }))
-        .max_gas()
-        .transact()
-        .await?;
+    let register_bank = run_owner_operation(contract, "register_module", json!({
+        "module_type": "bank",
+        "contract_id": "bank.near",
+        "version": "1.0.0"
+    })).await?;
     
     assert!(register_bank.is_success());
     println!("  ✅ Registered bank module");
@@ -355,16 +370,11 @@ async fn test_state_persistence_integration() -> Result<()> {
     ];
     
     for (module_type, contract_id, version) in additional_modules.iter() {
-        let register_result = contract
-            .call("register_module")
-            .args_json(json!({
-                "module_type": module_type,
-                "contract_id": contract_id,
-                "version": version
-            }))
-            .max_gas()
-            .transact()
-            .await?;
+        let register_result = run_owner_operation(contract, "register_module", json!({
+            "module_type": module_type,
+            "contract_id": contract_id,
+            "version": version
+        })).await?;
         
         assert!(register_result.is_success());
         
@@ -384,14 +394,9 @@ async fn test_state_persistence_integration() -> Result<()> {
     println!("🔗 Phase 3: Complex State Interactions");
     
     // Transfer ownership (contract owns itself initially)
-    let transfer_ownership = contract
-        .call("transfer_ownership")
-        .args_json(json!({
-            "new_owner": user.id()
-        }))
-        .max_gas()
-        .transact()
-        .await?;
+    let transfer_ownership = run_owner_operation(contract, "transfer_ownership", json!({
+        "new_owner": user.id()
+    })).await?;
     
     assert!(transfer_ownership.is_success());
     println!("  ✅ Transferred ownership to {}", user.id());
@@ -0,0 +1,310 @@
+/// Scenario DSL
+///
+/// A scenario lists genesis accounts and validators, then a sequence of
+/// steps: actions against the bank, staking, governance and block modules,
+/// and expectations on the state or the events they emitted. Scenarios run
+/// in process against the mocked NEAR runtime, the same way the modules run
+/// inside the contracts.
+///
+/// They can be built in Rust:
+///
+///     Scenario::new("delegate")
+///         .account("alice.near", 1_000)
+///         .validator("validator1.near", 1_000)
+///         .then(Action::Delegate { delegator: "alice.near".into(), validator: "validator1.near".into(), amount: 400 })
+///         .then(Action::ExpectBalance { account: "alice.near".into(), amount: 600 })
+///         .run()
+///
+/// or written as JSON fixtures in `tests/scenarios/`, where every step is an
+/// object tagged by its `op`, e.g. `{ "op": "send", "from": "alice.near",
+/// "to": "bob.near", "amount": 10 }`. A step that should fail carries
+/// `"expect_error"` with a part of the expected message.
+
+use std::panic::{self, AssertUnwindSafe};
+
+use cosmos_sdk_contract::modules::bank::BankModule;
+use cosmos_sdk_contract::modules::block::{check_invariants, BlockModule, MAX_BLOCKS_PER_CALL};
+use cosmos_sdk_contract::modules::gov::{GovernanceModule, ProposalStatus};
+use cosmos_sdk_contract::modules::staking::{bonded_pool_account, StakingModule};
+use cosmos_sdk_contract::Balance;
+use near_sdk::test_utils::{get_logs, VMContextBuilder};
+use near_sdk::{testing_env, AccountId};
+use serde::{Deserialize, Serialize};
+
+/// Nanoseconds per second of scenario time
+const NANOS: u64 = 1_000_000_000;
+
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq)]
+pub struct GenesisAccount {
+    pub account: String,
+    pub amount: Balance,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq)]
+pub struct GenesisValidator {
+    pub address: String,
+    pub self_delegation: Balance,
+}
+
+/// Something a step does or checks
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq)]
+#[serde(tag = "op", rename_all = "snake_case")]
+pub enum Action {
+    Mint { to: String, amount: Balance },
+    Send { from: String, to: String, amount: Balance },
+    Burn { from: String, amount: Balance },
+    Delegate { delegator: String, validator: String, amount: Balance },
+    Undelegate { delegator: String, validator: String, amount: Balance },
+    /// Pay out unbondings whose completion time has passed
+    CompleteUnbonding,
+    /// Proposals are numbered from 1 in submission order
+    SubmitProposal { proposer: String, param_key: String, param_value: String },
+    /// 1 yes, 2 abstain, 3 no, 4 no with veto
+    Vote { voter: String, proposal_id: u64, option: u8 },
+    /// Process this many heights of begin and end block logic
+    AdvanceBlocks { blocks: u64 },
+    AdvanceTime { seconds: u64 },
+    ExpectBalance { account: String, amount: Balance },
+    ExpectSupply { denom: String, amount: Balance },
+    ExpectDelegation { delegator: String, validator: String, amount: Balance },
+    ExpectProposalStatus { proposal_id: u64, status: ProposalStatus },
+    ExpectParam { key: String, value: String },
+    /// An event logged by any earlier step contains `contains`
+    ExpectEvent { contains: String },
+    /// The block watchdog's invariants hold
+    ExpectInvariants,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq)]
+pub struct Step {
+    #[serde(flatten)]
+    pub action: Action,
+    /// The step must fail with a message containing this
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub expect_error: Option<String>,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq)]
+pub struct Scenario {
+    pub name: String,
+    #[serde(default)]
+    pub accounts: Vec<GenesisAccount>,
+    #[serde(default)]
+    pub validators: Vec<GenesisValidator>,
+    pub steps: Vec<Step>,
+}
+
+/// Modules and chain clock a scenario runs against
+struct Harness {
+    bank: BankModule,
+    staking: StakingModule,
+    gov: GovernanceModule,
+    blocks: BlockModule,
+    height: u64,
+    timestamp: u64,
+    events: Vec<String>,
+}
+
+fn account(name: &str) -> Result<AccountId, String> {
+    name.parse().map_err(|_| format!("Invalid account {}", name))
+}
+
+impl Harness {
+    fn new() -> Self {
+        let harness = Self {
+            bank: BankModule::new(),
+            staking: StakingModule::new(),
+            gov: GovernanceModule::new(),
+            blocks: BlockModule::new("scenario-1".to_string()),
+            height: 1,
+            timestamp: NANOS,
+            events: Vec::new(),
+        };
+        harness.set_context();
+        harness
+    }
+
+    fn set_context(&self) {
+        testing_env!(VMContextBuilder::new()
+            .current_account_id("cosmos.near".parse().unwrap())
+            .block_height(self.height)
+            .block_timestamp(self.timestamp)
+            .build());
+    }
+
+    /// Move the clock, keeping the events logged so far
+    fn advance(&mut self, blocks: u64, seconds: u64) {
+        self.events.extend(get_logs());
+        self.height += blocks;
+        self.timestamp += seconds * NANOS;
+        self.set_context();
+    }
+
+    fn genesis(&mut self, scenario: &Scenario) -> Result<(), String> {
+        for genesis in &scenario.accounts {
+            self.bank.mint(&account(&genesis.account)?, genesis.amount);
+        }
+        for validator in &scenario.validators {
+            self.bank.mint(&bonded_pool_account(), validator.self_delegation);
+            self.staking.create_validator(
+                validator.address.clone(),
+                vec![1; 32],
+                validator.address.clone(),
+                None,
+                None,
+                None,
+                None,
+                "0.1".to_string(),
+                "0.2".to_string(),
+                "0.01".to_string(),
+                1,
+                validator.self_delegation,
+            )?;
+        }
+        self.blocks.process_blocks(1, &mut self.staking, &mut self.gov);
+        Ok(())
+    }
+
+    fn apply(&mut self, action: &Action) -> Result<(), String> {
+        match action {
+            Action::Mint { to, amount } => self.bank.mint(&account(to)?, *amount),
+            Action::Send { from, to, amount } => self.bank.transfer(&account(from)?, &account(to)?, *amount),
+            Action::Burn { from, amount } => self.bank.burn(&account(from)?, *amount),
+            Action::Delegate { delegator, validator, amount } => {
+                self.staking.delegate_from_bank(&mut self.bank, &account(delegator)?, validator.clone(), *amount)?;
+            }
+            Action::Undelegate { delegator, validator, amount } => {
+                self.staking.undelegate_to_bank(&mut self.bank, &account(delegator)?, validator.clone(), *amount)?;
+            }
+            Action::CompleteUnbonding => {
+                self.staking.complete_unbonding(&mut self.bank, self.timestamp);
+            }
+            Action::SubmitProposal { proposer, param_key, param_value } => {
+                let proposal_id = self.gov.submit_proposal(
+                    &account(proposer)?,
+                    format!("Set {}", param_key),
+                    format!("Set {} to {}", param_key, param_value),
+                    param_key.clone(),
+                    param_value.clone(),
+                    String::new(),
+                    None,
+                    self.height,
+                );
+                self.gov.snapshot_stake(proposal_id, &self.staking, self.height);
+            }
+            Action::Vote { voter, proposal_id, option } => {
+                self.gov.vote(&account(voter)?, *proposal_id, *option, String::new());
+            }
+            Action::AdvanceBlocks { blocks } => {
+                self.advance(*blocks, *blocks);
+                while self.blocks.process_blocks(MAX_BLOCKS_PER_CALL, &mut self.staking, &mut self.gov).remaining > 0 {}
+            }
+            Action::AdvanceTime { seconds } => self.advance(0, *seconds),
+            Action::ExpectBalance { account: name, amount } => {
+                expect_eq(format!("balance of {}", name), self.bank.get_balance(&account(name)?), *amount)?;
+            }
+            Action::ExpectSupply { denom, amount } => {
+                expect_eq(format!("supply of {}", denom), self.bank.supply_of(denom), *amount)?;
+            }
+            Action::ExpectDelegation { delegator, validator, amount } => {
+                let tokens = self.staking.get_delegation(delegator.clone(), validator.clone())
+                    .map(|delegation| self.staking.delegation_tokens(&delegation))
+                    .unwrap_or(0);
+                expect_eq(format!("delegation of {} to {}", delegator, validator), tokens, *amount)?;
+            }
+            Action::ExpectProposalStatus { proposal_id, status } => {
+                let proposal = self.gov.get_proposal(*proposal_id)
+                    .ok_or_else(|| format!("Proposal {} not found", proposal_id))?;
+                expect_eq(format!("status of proposal {}", proposal_id), proposal.status, status.clone())?;
+            }
+            Action::ExpectParam { key, value } => {
+                expect_eq(format!("parameter {}", key), self.gov.get_parameter(key), value.clone())?;
+            }
+            Action::ExpectEvent { contains } => {
+                self.events.extend(get_logs());
+                self.set_context();
+                if !self.events.iter().any(|event| event.contains(contains.as_str())) {
+                    return Err(format!("No event contains {:?}", contains));
+                }
+            }
+            Action::ExpectInvariants => {
+                let violations = check_invariants(&self.bank, &self.staking, self.height);
+                if let Some(violation) = violations.first() {
+                    return Err(format!("{} broken: {}", violation.invariant, violation.detail));
+                }
+            }
+        }
+        Ok(())
+    }
+}
+
+fn expect_eq<T: PartialEq + std::fmt::Debug>(what: String, actual: T, expected: T) -> Result<(), String> {
+    if actual != expected {
+        return Err(format!("Expected {} to be {:?}, got {:?}", what, expected, actual));
+    }
+    Ok(())
+}
+
+/// Run `f`, turning a contract panic into an error
+fn catch<T>(f: impl FnOnce() -> Result<T, String>) -> Result<T, String> {
+    match panic::catch_unwind(AssertUnwindSafe(f)) {
+        Ok(result) => result,
+        Err(payload) => Err(payload.downcast_ref::<String>().cloned()
+            .or_else(|| payload.downcast_ref::<&str>().map(|message| message.to_string()))
+            .unwrap_or_else(|| "panicked".to_string())),
+    }
+}
+
+impl Scenario {
+    pub fn new(name: &str) -> Self {
+        Self { name: name.to_string(), accounts: Vec::new(), validators: Vec::new(), steps: Vec::new() }
+    }
+
+    /// Load a JSON fixture
+    pub fn from_file(path: &std::path::Path) -> Result<Self, String> {
+        let json = std::fs::read_to_string(path).map_err(|e| format!("{}: {}", path.display(), e))?;
+        serde_json::from_str(&json).map_err(|e| format!("{}: {}", path.display(), e))
+    }
+
+    pub fn account(mut self, account: &str, amount: Balance) -> Self {
+        self.accounts.push(GenesisAccount { account: account.to_string(), amount });
+        self
+    }
+
+    pub fn validator(mut self, address: &str, self_delegation: Balance) -> Self {
+        self.validators.push(GenesisValidator { address: address.to_string(), self_delegation });
+        self
+    }
+
+    pub fn then(mut self, action: Action) -> Self {
+        self.steps.push(Step { action, expect_error: None });
+        self
+    }
+
+    /// Add a step that must fail with an error containing `error`
+    pub fn then_fails(mut self, action: Action, error: &str) -> Self {
+        self.steps.push(Step { action, expect_error: Some(error.to_string()) });
+        self
+    }
+
+    /// Run the scenario from a fresh genesis, naming the first step that
+    /// did not go as described
+    pub fn run(&self) -> Result<(), String> {
+        let mut harness = Harness::new();
+        harness.genesis(self).map_err(|e| format!("{}: genesis failed: {}", self.name, e))?;
+
+        for (index, step) in self.steps.iter().enumerate() {
+            let result = catch(|| harness.apply(&step.action));
+            let failure = match (result, &step.expect_error) {
+                (Ok(()), None) => None,
+                (Ok(()), Some(expected)) => Some(format!("expected an error containing {:?}", expected)),
+                (Err(error), Some(expected)) if error.contains(expected.as_str()) => None,
+                (Err(error), _) => Some(error),
+            };
+            if let Some(failure) = failure {
+                return Err(format!("{}: step {} ({:?}): {}", self.name, index + 1, step.action, failure));
+            }
+        }
+        Ok(())
+    }
+}
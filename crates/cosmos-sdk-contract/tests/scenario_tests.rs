@@ -0,0 +1,67 @@
+/// Regression scenarios, see `tests/scenario/mod.rs` for the DSL
+///
+/// Every JSON file in `tests/scenarios/` runs as part of
+/// `test_json_scenarios`, so a new regression needs no Rust at all.
+mod scenario;
+
+use cosmos_sdk_contract::modules::gov::ProposalStatus;
+use scenario::{Action, Scenario};
+
+#[test]
+fn test_json_scenarios() {
+    let dir = std::path::Path::new(env!("CARGO_MANIFEST_DIR")).join("tests/scenarios");
+    let mut paths: Vec<_> = std::fs::read_dir(&dir)
+        .expect("scenario directory exists")
+        .map(|entry| entry.unwrap().path())
+        .filter(|path| path.extension().map_or(false, |ext| ext == "json"))
+        .collect();
+    paths.sort();
+    assert!(!paths.is_empty(), "no scenarios in {}", dir.display());
+
+    for path in paths {
+        let scenario = Scenario::from_file(&path).unwrap();
+        if let Err(failure) = scenario.run() {
+            panic!("{}", failure);
+        }
+    }
+}
+
+#[test]
+fn test_param_change_scenario() {
+    Scenario::new("param_change")
+        .account("alice.near", 500)
+        .validator("validator1.near", 1_000)
+        .then(Action::Delegate { delegator: "alice.near".into(), validator: "validator1.near".into(), amount: 500 })
+        .then(Action::SubmitProposal {
+            proposer: "alice.near".into(),
+            param_key: "voting_period".into(),
+            param_value: "100".into(),
+        })
+        .then(Action::Vote { voter: "alice.near".into(), proposal_id: 1, option: 1 })
+        .then(Action::Vote { voter: "validator1.near".into(), proposal_id: 1, option: 1 })
+        .then_fails(Action::Vote { voter: "alice.near".into(), proposal_id: 1, option: 3 }, "Already voted")
+        .then(Action::ExpectProposalStatus { proposal_id: 1, status: ProposalStatus::Active })
+        .then(Action::AdvanceBlocks { blocks: 60 })
+        .then(Action::ExpectProposalStatus { proposal_id: 1, status: ProposalStatus::Passed })
+        .then(Action::ExpectParam { key: "voting_period".into(), value: "100".into() })
+        .then(Action::ExpectInvariants)
+        .run()
+        .unwrap();
+}
+
+#[test]
+fn test_failed_expectation_names_the_step() {
+    let failure = Scenario::new("wrong_balance")
+        .account("alice.near", 10)
+        .then(Action::ExpectBalance { account: "alice.near".into(), amount: 11 })
+        .run()
+        .unwrap_err();
+    assert!(failure.starts_with("wrong_balance: step 1"), "{}", failure);
+
+    let failure = Scenario::new("no_error")
+        .account("alice.near", 10)
+        .then_fails(Action::Send { from: "alice.near".into(), to: "bob.near".into(), amount: 5 }, "Insufficient")
+        .run()
+        .unwrap_err();
+    assert!(failure.contains("expected an error"), "{}", failure);
+}
@@ -0,0 +1,263 @@
+// Operator address book
+// Labels NEAR accounts and bech32 addresses so commands can take a name instead of a raw address
+
+use near_primitives::types::AccountId;
+use serde::{Deserialize, Serialize};
+use std::path::{Path, PathBuf};
+use thiserror::Error;
+
+/// Errors that can occur while editing or resolving against the address book
+#[derive(Error, Debug)]
+pub enum AddressBookError {
+    #[error("Invalid address: {0}")]
+    InvalidAddress(String),
+
+    #[error("Invalid label: {0}")]
+    InvalidLabel(String),
+
+    #[error("Label already in use: {0}")]
+    DuplicateLabel(String),
+
+    #[error("Unknown label or address: {0}")]
+    Unknown(String),
+
+    #[error("IO error: {0}")]
+    Io(#[from] std::io::Error),
+
+    #[error("Address book format error: {0}")]
+    Format(String),
+}
+
+/// Chain family an address belongs to
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum AddressKind {
+    Near,
+    Bech32,
+}
+
+impl AddressKind {
+    /// Tell a bech32 address from a NEAR account ID
+    ///
+    /// Bech32 is checked first: `cosmos1...` is a well-formed NEAR account
+    /// ID as well, but only a checksummed one is a bech32 address.
+    pub fn of(address: &str) -> Result<Self, AddressBookError> {
+        if bech32::decode(address).is_ok() {
+            return Ok(AddressKind::Bech32);
+        }
+        address.parse::<AccountId>()
+            .map(|_| AddressKind::Near)
+            .map_err(|_| AddressBookError::InvalidAddress(address.to_string()))
+    }
+}
+
+/// A labelled address
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct Contact {
+    pub label: String,
+    pub address: String,
+    pub kind: AddressKind,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub note: Option<String>,
+    /// Moniker of the validator operating this address, as last synced from chain
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub moniker: Option<String>,
+}
+
+/// Contacts stored as a TOML file next to the keystore
+#[derive(Debug, Default, Serialize, Deserialize)]
+pub struct AddressBook {
+    #[serde(default, rename = "contact")]
+    contacts: Vec<Contact>,
+}
+
+impl AddressBook {
+    /// `~/.relayer/address_book.toml`
+    pub fn default_path() -> PathBuf {
+        PathBuf::from(shellexpand::tilde("~/.relayer/address_book.toml").to_string())
+    }
+
+    /// Read the book at `path`, an empty book when the file does not exist yet
+    pub fn load(path: &Path) -> Result<Self, AddressBookError> {
+        if !path.exists() {
+            return Ok(Self::default());
+        }
+        let content = std::fs::read_to_string(path)?;
+        toml::from_str(&content).map_err(|e| AddressBookError::Format(e.to_string()))
+    }
+
+    pub fn save(&self, path: &Path) -> Result<(), AddressBookError> {
+        if let Some(dir) = path.parent() {
+            std::fs::create_dir_all(dir)?;
+        }
+        let content = toml::to_string_pretty(self).map_err(|e| AddressBookError::Format(e.to_string()))?;
+        std::fs::write(path, content)?;
+        Ok(())
+    }
+
+    pub fn contacts(&self) -> &[Contact] {
+        &self.contacts
+    }
+
+    pub fn get(&self, label: &str) -> Option<&Contact> {
+        self.contacts.iter().find(|contact| contact.label == label)
+    }
+
+    /// Contact holding `address`, to show a label next to a raw address
+    pub fn find_address(&self, address: &str) -> Option<&Contact> {
+        self.contacts.iter().find(|contact| contact.address == address)
+    }
+
+    pub fn add(&mut self, label: &str, address: &str, note: Option<String>) -> Result<&Contact, AddressBookError> {
+        if label.is_empty() || label.chars().any(char::is_whitespace) {
+            return Err(AddressBookError::InvalidLabel(label.to_string()));
+        }
+        if self.get(label).is_some() {
+            return Err(AddressBookError::DuplicateLabel(label.to_string()));
+        }
+        let kind = AddressKind::of(address)?;
+        self.contacts.push(Contact {
+            label: label.to_string(),
+            address: address.to_string(),
+            kind,
+            note,
+            moniker: None,
+        });
+        Ok(self.contacts.last().expect("contact just added"))
+    }
+
+    pub fn remove(&mut self, label: &str) -> Result<Contact, AddressBookError> {
+        let index = self.contacts.iter()
+            .position(|contact| contact.label == label)
+            .ok_or_else(|| AddressBookError::Unknown(label.to_string()))?;
+        Ok(self.contacts.remove(index))
+    }
+
+    /// Address for a label, or `name` itself when it already is an address
+    ///
+    /// Labels win over addresses, so a label never silently resolves to a
+    /// different account than the one it was saved for.
+    pub fn resolve(&self, name: &str) -> Result<String, AddressBookError> {
+        if let Some(contact) = self.get(name) {
+            return Ok(contact.address.clone());
+        }
+        AddressKind::of(name)
+            .map(|_| name.to_string())
+            .map_err(|_| AddressBookError::Unknown(name.to_string()))
+    }
+
+    /// Record validator monikers from on-chain metadata
+    ///
+    /// Known addresses get their moniker updated, new ones are added under a
+    /// label derived from the moniker. Validators whose operator address is
+    /// not a NEAR or bech32 address are skipped. Returns the contacts added
+    /// or changed.
+    pub fn sync_validators(&mut self, validators: &[(String, String)]) -> usize {
+        let mut changed = 0;
+        for (operator_address, moniker) in validators {
+            if let Some(contact) = self.contacts.iter_mut().find(|contact| &contact.address == operator_address) {
+                if contact.moniker.as_ref() != Some(moniker) {
+                    contact.moniker = Some(moniker.clone());
+                    changed += 1;
+                }
+                continue;
+            }
+            let Ok(kind) = AddressKind::of(operator_address) else { continue };
+            let label = self.free_label(&moniker_label(moniker));
+            self.contacts.push(Contact {
+                label,
+                address: operator_address.clone(),
+                kind,
+                note: None,
+                moniker: Some(moniker.clone()),
+            });
+            changed += 1;
+        }
+        changed
+    }
+
+    /// `base`, or `base-2`, `base-3`... when taken
+    fn free_label(&self, base: &str) -> String {
+        let mut label = base.to_string();
+        let mut suffix = 2;
+        while self.get(&label).is_some() {
+            label = format!("{}-{}", base, suffix);
+            suffix += 1;
+        }
+        label
+    }
+}
+
+/// Lowercase label with runs of anything but letters and digits turned into `-`
+fn moniker_label(moniker: &str) -> String {
+    let label = moniker.to_lowercase()
+        .split(|c: char| !c.is_alphanumeric())
+        .filter(|part| !part.is_empty())
+        .collect::<Vec<_>>()
+        .join("-");
+    if label.is_empty() { "validator".to_string() } else { label }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bech32::{ToBase32, Variant};
+
+    fn cosmos_address() -> String {
+        bech32::encode("cosmos", [7u8; 20].to_base32(), Variant::Bech32).unwrap()
+    }
+
+    #[test]
+    fn test_resolve_labels_and_addresses() {
+        let mut book = AddressBook::default();
+        book.add("treasury", &cosmos_address(), Some("hub escrow".to_string())).unwrap();
+        book.add("alice", "alice.testnet", None).unwrap();
+
+        assert_eq!(book.get("treasury").unwrap().kind, AddressKind::Bech32);
+        assert_eq!(book.get("alice").unwrap().kind, AddressKind::Near);
+        assert_eq!(book.resolve("treasury").unwrap(), cosmos_address());
+        assert_eq!(book.resolve("bob.testnet").unwrap(), "bob.testnet");
+        assert!(matches!(book.resolve("Not An Address"), Err(AddressBookError::Unknown(_))));
+
+        assert!(matches!(book.add("alice", "carol.testnet", None), Err(AddressBookError::DuplicateLabel(_))));
+        assert!(matches!(book.add("my key", "carol.testnet", None), Err(AddressBookError::InvalidLabel(_))));
+        assert!(matches!(book.add("carol", "Carol!", None), Err(AddressBookError::InvalidAddress(_))));
+
+        book.remove("alice").unwrap();
+        assert!(book.get("alice").is_none());
+    }
+
+    #[test]
+    fn test_sync_validators() {
+        let mut book = AddressBook::default();
+        book.add("mine", "val1.testnet", None).unwrap();
+
+        let validators = vec![
+            ("val1.testnet".to_string(), "Node Runner".to_string()),
+            ("val2.testnet".to_string(), "Staking Co.".to_string()),
+            ("val3.testnet".to_string(), "staking co".to_string()),
+            ("not an address".to_string(), "Broken".to_string()),
+        ];
+        assert_eq!(book.sync_validators(&validators), 3);
+        assert_eq!(book.get("mine").unwrap().moniker.as_deref(), Some("Node Runner"));
+        assert_eq!(book.resolve("staking-co").unwrap(), "val2.testnet");
+        assert_eq!(book.resolve("staking-co-2").unwrap(), "val3.testnet");
+
+        // Nothing changed on chain
+        assert_eq!(book.sync_validators(&validators), 0);
+    }
+
+    #[test]
+    fn test_save_and_load() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("book").join("address_book.toml");
+        assert!(AddressBook::load(&path).unwrap().contacts().is_empty());
+
+        let mut book = AddressBook::default();
+        book.add("alice", "alice.testnet", Some("ops".to_string())).unwrap();
+        book.save(&path).unwrap();
+
+        let loaded = AddressBook::load(&path).unwrap();
+        assert_eq!(loaded.contacts(), book.contacts());
+    }
+}
@@ -0,0 +1,133 @@
+// Address book CLI
+// Manages labels for NEAR and bech32 addresses and syncs validator monikers from the staking contract
+
+use clap::{Parser, Subcommand};
+use ibc_relayer::address_book::AddressBook;
+use near_jsonrpc_client::{methods, JsonRpcClient};
+use near_jsonrpc_primitives::types::query::QueryResponseKind;
+use near_primitives::types::{AccountId, BlockReference};
+use near_primitives::views::QueryRequest;
+use serde::Deserialize;
+use std::path::PathBuf;
+
+#[derive(Parser)]
+#[clap(name = "address-book")]
+#[clap(about = "Label NEAR and bech32 addresses for use in relayer commands")]
+#[clap(version)]
+struct Cli {
+    /// Address book file, ~/.relayer/address_book.toml when omitted
+    #[clap(long)]
+    file: Option<PathBuf>,
+    #[clap(subcommand)]
+    command: Commands,
+}
+
+#[derive(Subcommand)]
+enum Commands {
+    /// Label an address
+    Add {
+        label: String,
+        address: String,
+        /// Free-form note shown in listings
+        #[clap(long)]
+        note: Option<String>,
+    },
+    /// Remove a label
+    Remove { label: String },
+    /// List all contacts
+    List,
+    /// Print the address a label or address resolves to
+    Resolve { name: String },
+    /// Label validators with the monikers registered in the staking contract
+    SyncValidators {
+        /// NEAR RPC endpoint
+        #[clap(long, default_value = "https://rpc.testnet.near.org")]
+        rpc_url: String,
+        /// Staking contract account ID
+        #[clap(long)]
+        contract_id: String,
+    },
+}
+
+#[derive(Debug, Deserialize)]
+struct ValidatorDescription {
+    moniker: String,
+}
+
+/// Fields of the `get_all_validators` view this tool uses
+#[derive(Debug, Deserialize)]
+struct Validator {
+    operator_address: String,
+    description: ValidatorDescription,
+}
+
+async fn fetch_validators(rpc_url: &str, contract_id: &str) -> Result<Vec<Validator>, Box<dyn std::error::Error>> {
+    let client = JsonRpcClient::connect(rpc_url);
+    let contract_id: AccountId = contract_id.parse()?;
+    let request = methods::query::RpcQueryRequest {
+        block_reference: BlockReference::latest(),
+        request: QueryRequest::CallFunction {
+            account_id: contract_id,
+            method_name: "get_all_validators".to_string(),
+            args: b"{}".to_vec().into(),
+        },
+    };
+
+    let response = client.call(request).await
+        .map_err(|e| format!("NEAR RPC call failed: {}", e))?;
+
+    match response.kind {
+        QueryResponseKind::CallResult(call_result) => Ok(serde_json::from_slice(&call_result.result)?),
+        _ => Err("Unexpected response type for contract call".into()),
+    }
+}
+
+#[tokio::main]
+async fn main() -> Result<(), Box<dyn std::error::Error>> {
+    let cli = Cli::parse();
+    let path = cli.file.unwrap_or_else(AddressBook::default_path);
+    let mut book = AddressBook::load(&path)?;
+
+    match cli.command {
+        Commands::Add { label, address, note } => {
+            let contact = book.add(&label, &address, note)?;
+            println!("Added {} -> {} ({:?})", contact.label, contact.address, contact.kind);
+            book.save(&path)?;
+        }
+        Commands::Remove { label } => {
+            let contact = book.remove(&label)?;
+            println!("Removed {} -> {}", contact.label, contact.address);
+            book.save(&path)?;
+        }
+        Commands::List => {
+            if book.contacts().is_empty() {
+                println!("No contacts in {}", path.display());
+            }
+            for contact in book.contacts() {
+                let details: Vec<&str> = [contact.moniker.as_deref(), contact.note.as_deref()]
+                    .into_iter()
+                    .flatten()
+                    .collect();
+                if details.is_empty() {
+                    println!("{:<24} {}", contact.label, contact.address);
+                } else {
+                    println!("{:<24} {}  ({})", contact.label, contact.address, details.join(", "));
+                }
+            }
+        }
+        Commands::Resolve { name } => {
+            println!("{}", book.resolve(&name)?);
+        }
+        Commands::SyncValidators { rpc_url, contract_id } => {
+            let validators: Vec<(String, String)> = fetch_validators(&rpc_url, &contract_id).await?
+                .into_iter()
+                .map(|validator| (validator.operator_address, validator.description.moniker))
+                .collect();
+            let changed = book.sync_validators(&validators);
+            book.save(&path)?;
+            println!("Synced {} validators, {} contacts added or updated", validators.len(), changed);
+        }
+    }
+
+    Ok(())
+}
@@ -0,0 +1,574 @@
+// Contract monitor
+// Polls the router, IBC client and IBC channel contracts, serves what it sees as Prometheus
+// metrics on /metrics and alerts on stuck packets, expired clients and stalled block processing
+
+use axum::{extract::State, routing::get, Router};
+use clap::Parser;
+use near_jsonrpc_client::{methods, JsonRpcClient};
+use near_jsonrpc_primitives::types::query::QueryResponseKind;
+use near_primitives::types::{AccountId, BlockReference, Finality};
+use near_primitives::views::QueryRequest;
+use prometheus::{Encoder, IntCounter, IntGauge, IntGaugeVec, Opts, Registry, TextEncoder};
+use serde::de::DeserializeOwned;
+use serde::Deserialize;
+use serde_json::{json, Value};
+use std::collections::{BTreeSet, HashMap};
+use std::fmt;
+use std::net::SocketAddr;
+use std::sync::Arc;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+use tracing::{info, warn};
+
+type BoxError = Box<dyn std::error::Error + Send + Sync>;
+
+#[derive(Parser)]
+#[clap(name = "contract-monitor")]
+#[clap(about = "Export Prometheus metrics and alerts for the Cosmos SDK contracts")]
+#[clap(version)]
+struct Cli {
+    /// NEAR RPC endpoint
+    #[clap(long, default_value = "https://rpc.testnet.near.org")]
+    rpc_url: String,
+    /// Router contract account ID
+    #[clap(long)]
+    router_id: String,
+    /// IBC client contract account ID, client checks are skipped when omitted
+    #[clap(long)]
+    client_contract: Option<String>,
+    /// IBC channel contract account ID, packet checks are skipped when omitted
+    #[clap(long)]
+    channel_contract: Option<String>,
+    /// Address to serve /metrics on
+    #[clap(long, default_value = "0.0.0.0:9464")]
+    listen: SocketAddr,
+    /// Seconds between polls
+    #[clap(long, default_value_t = 30)]
+    interval: u64,
+    /// Seconds the oldest pending packet of a channel may wait before it counts as stuck
+    #[clap(long, default_value_t = 600)]
+    stuck_after: u64,
+    /// Seconds the final block height may stay the same before processing counts as stalled
+    #[clap(long, default_value_t = 120)]
+    stall_after: u64,
+    /// Most packet commitments probed per unordered channel and poll
+    #[clap(long, default_value_t = 100)]
+    max_probe: u64,
+    /// Poll once, print the metrics to stdout and exit non-zero on alerts
+    #[clap(long)]
+    once: bool,
+}
+
+#[derive(Debug, Deserialize)]
+struct Height {
+    revision_height: u64,
+}
+
+#[derive(Debug, Deserialize)]
+struct ClientState {
+    /// Seconds
+    trust_period: u64,
+    latest_height: Height,
+}
+
+#[derive(Debug, Deserialize)]
+struct ConsensusState {
+    /// Seconds
+    timestamp: u64,
+}
+
+#[derive(Debug, Deserialize)]
+struct ChannelEnd {
+    state: String,
+    ordering: String,
+}
+
+#[derive(Debug, Clone, PartialEq)]
+struct ClientStatus {
+    client_id: String,
+    latest_height: u64,
+    /// Block time the latest consensus state stops being trusted, unknown without one
+    trusted_until: Option<u64>,
+}
+
+#[derive(Debug, Clone, PartialEq)]
+struct ChannelStatus {
+    port_id: String,
+    channel_id: String,
+    next_sequence_send: u64,
+    /// Packets sent and not acknowledged yet, a lower bound when the probe was cut short
+    pending: u64,
+    oldest_pending: Option<u64>,
+}
+
+/// Everything read in one poll
+#[derive(Debug, Clone, Default)]
+struct Snapshot {
+    /// Wall clock seconds the poll ran at
+    observed_at: u64,
+    head_height: u64,
+    /// Seconds
+    head_time: u64,
+    halt_height: Option<u64>,
+    modules: HashMap<String, bool>,
+    clients: Vec<ClientStatus>,
+    channels: Vec<ChannelStatus>,
+}
+
+#[derive(Debug, Clone, PartialEq)]
+enum Alert {
+    ModuleUnhealthy { module: String },
+    Halted { height: u64 },
+    StalledBlocks { height: u64, secs: u64 },
+    ExpiredClient { client_id: String, expired_at: u64 },
+    StuckPackets { port_id: String, channel_id: String, sequence: u64, pending: u64, secs: u64 },
+}
+
+impl Alert {
+    fn kind(&self) -> &'static str {
+        match self {
+            Alert::ModuleUnhealthy { .. } => "module_unhealthy",
+            Alert::Halted { .. } => "halted",
+            Alert::StalledBlocks { .. } => "stalled_blocks",
+            Alert::ExpiredClient { .. } => "expired_client",
+            Alert::StuckPackets { .. } => "stuck_packets",
+        }
+    }
+
+    fn target(&self) -> String {
+        match self {
+            Alert::ModuleUnhealthy { module } => module.clone(),
+            Alert::Halted { .. } | Alert::StalledBlocks { .. } => "chain".to_string(),
+            Alert::ExpiredClient { client_id, .. } => client_id.clone(),
+            Alert::StuckPackets { port_id, channel_id, .. } => format!("{}/{}", port_id, channel_id),
+        }
+    }
+}
+
+impl fmt::Display for Alert {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Alert::ModuleUnhealthy { module } => write!(f, "module {} reports unhealthy", module),
+            Alert::Halted { height } => write!(f, "chain halted at scheduled height {}", height),
+            Alert::StalledBlocks { height, secs } => write!(f, "block height stuck at {} for {}s", height, secs),
+            Alert::ExpiredClient { client_id, expired_at } => {
+                write!(f, "client {} trust period expired at {}", client_id, expired_at)
+            }
+            Alert::StuckPackets { port_id, channel_id, sequence, pending, secs } => write!(
+                f,
+                "{}/{}: packet {} unacknowledged for {}s, {} pending",
+                port_id, channel_id, sequence, secs, pending
+            ),
+        }
+    }
+}
+
+/// State carried from poll to poll to tell a stuck channel from a busy one
+#[derive(Default)]
+struct Watch {
+    /// Head height and when it was first seen
+    head: Option<(u64, u64)>,
+    /// Oldest pending sequence per channel and when it was first seen
+    oldest_pending: HashMap<(String, String), (u64, u64)>,
+    /// Lowest sequence of an unordered channel that may still hold a commitment
+    probe_floor: HashMap<(String, String), u64>,
+    /// `kind/target` of the alerts raised by the previous poll
+    active: BTreeSet<String>,
+}
+
+impl Watch {
+    fn evaluate(&mut self, snapshot: &Snapshot, stuck_after: u64, stall_after: u64) -> Vec<Alert> {
+        let now = snapshot.observed_at;
+        let mut alerts = Vec::new();
+
+        let mut unhealthy: Vec<&String> = snapshot.modules.iter().filter(|(_, ok)| !**ok).map(|(m, _)| m).collect();
+        unhealthy.sort();
+        alerts.extend(unhealthy.into_iter().map(|module| Alert::ModuleUnhealthy { module: module.clone() }));
+
+        if let Some(height) = snapshot.halt_height.filter(|height| snapshot.head_height >= *height) {
+            alerts.push(Alert::Halted { height });
+        }
+
+        let since = match self.head {
+            Some((height, since)) if height == snapshot.head_height => since,
+            _ => now,
+        };
+        self.head = Some((snapshot.head_height, since));
+        if now.saturating_sub(since) >= stall_after {
+            alerts.push(Alert::StalledBlocks { height: snapshot.head_height, secs: now.saturating_sub(since) });
+        }
+
+        for client in &snapshot.clients {
+            if let Some(expired_at) = client.trusted_until.filter(|until| *until <= snapshot.head_time) {
+                alerts.push(Alert::ExpiredClient { client_id: client.client_id.clone(), expired_at });
+            }
+        }
+
+        let mut oldest_pending = HashMap::new();
+        for channel in &snapshot.channels {
+            let Some(sequence) = channel.oldest_pending else { continue };
+            let key = (channel.port_id.clone(), channel.channel_id.clone());
+            let since = match self.oldest_pending.get(&key) {
+                Some((previous, since)) if *previous == sequence => *since,
+                _ => now,
+            };
+            if now.saturating_sub(since) >= stuck_after {
+                alerts.push(Alert::StuckPackets {
+                    port_id: channel.port_id.clone(),
+                    channel_id: channel.channel_id.clone(),
+                    sequence,
+                    pending: channel.pending,
+                    secs: now.saturating_sub(since),
+                });
+            }
+            oldest_pending.insert(key, (sequence, since));
+        }
+        self.oldest_pending = oldest_pending;
+
+        let active: BTreeSet<String> = alerts.iter().map(|alert| format!("{}/{}", alert.kind(), alert.target())).collect();
+        for alert in &alerts {
+            if !self.active.contains(&format!("{}/{}", alert.kind(), alert.target())) {
+                warn!("ALERT {}", alert);
+            }
+        }
+        for cleared in self.active.difference(&active) {
+            info!("resolved {}", cleared);
+        }
+        self.active = active;
+        alerts
+    }
+}
+
+struct MonitorMetrics {
+    registry: Registry,
+    polls: IntCounter,
+    poll_errors: IntCounter,
+    head_height: IntGauge,
+    halt_height: IntGauge,
+    module_healthy: IntGaugeVec,
+    client_latest_height: IntGaugeVec,
+    client_trust_remaining: IntGaugeVec,
+    packets_pending: IntGaugeVec,
+    packet_next_sequence: IntGaugeVec,
+    alerts: IntGaugeVec,
+}
+
+impl MonitorMetrics {
+    fn new() -> prometheus::Result<Self> {
+        let registry = Registry::new();
+        let polls = IntCounter::new("proxima_monitor_polls_total", "Polls completed")?;
+        let poll_errors = IntCounter::new("proxima_monitor_poll_errors_total", "Polls that failed")?;
+        let head_height = IntGauge::new("proxima_block_height", "Final NEAR block height")?;
+        let halt_height = IntGauge::new("proxima_halt_height", "Scheduled halt height, 0 when none")?;
+        let module_healthy = IntGaugeVec::new(Opts::new("proxima_module_healthy", "Module health reported by the router"), &["module"])?;
+        let client_latest_height = IntGaugeVec::new(Opts::new("proxima_client_latest_height", "Latest verified height of an IBC client"), &["client"])?;
+        let client_trust_remaining = IntGaugeVec::new(
+            Opts::new("proxima_client_trust_remaining_seconds", "Seconds until the latest consensus state of an IBC client expires"),
+            &["client"],
+        )?;
+        let packets_pending = IntGaugeVec::new(Opts::new("proxima_packets_pending", "Packets sent and not acknowledged yet"), &["port", "channel"])?;
+        let packet_next_sequence = IntGaugeVec::new(Opts::new("proxima_packet_next_sequence_send", "Next send sequence of a channel"), &["port", "channel"])?;
+        let alerts = IntGaugeVec::new(Opts::new("proxima_alert", "Active alerts"), &["kind", "target"])?;
+
+        registry.register(Box::new(polls.clone()))?;
+        registry.register(Box::new(poll_errors.clone()))?;
+        registry.register(Box::new(head_height.clone()))?;
+        registry.register(Box::new(halt_height.clone()))?;
+        registry.register(Box::new(module_healthy.clone()))?;
+        registry.register(Box::new(client_latest_height.clone()))?;
+        registry.register(Box::new(client_trust_remaining.clone()))?;
+        registry.register(Box::new(packets_pending.clone()))?;
+        registry.register(Box::new(packet_next_sequence.clone()))?;
+        registry.register(Box::new(alerts.clone()))?;
+
+        Ok(Self {
+            registry,
+            polls,
+            poll_errors,
+            head_height,
+            halt_height,
+            module_healthy,
+            client_latest_height,
+            client_trust_remaining,
+            packets_pending,
+            packet_next_sequence,
+            alerts,
+        })
+    }
+
+    fn update(&self, snapshot: &Snapshot, alerts: &[Alert]) {
+        self.polls.inc();
+        self.head_height.set(snapshot.head_height as i64);
+        self.halt_height.set(snapshot.halt_height.unwrap_or(0) as i64);
+
+        // Label sets disappear with the module, client or channel they describe
+        self.module_healthy.reset();
+        for (module, healthy) in &snapshot.modules {
+            self.module_healthy.with_label_values(&[module]).set(*healthy as i64);
+        }
+        self.client_latest_height.reset();
+        self.client_trust_remaining.reset();
+        for client in &snapshot.clients {
+            self.client_latest_height.with_label_values(&[&client.client_id]).set(client.latest_height as i64);
+            if let Some(until) = client.trusted_until {
+                self.client_trust_remaining
+                    .with_label_values(&[&client.client_id])
+                    .set(until as i64 - snapshot.head_time as i64);
+            }
+        }
+        self.packets_pending.reset();
+        self.packet_next_sequence.reset();
+        for channel in &snapshot.channels {
+            let labels = [channel.port_id.as_str(), channel.channel_id.as_str()];
+            self.packets_pending.with_label_values(&labels).set(channel.pending as i64);
+            self.packet_next_sequence.with_label_values(&labels).set(channel.next_sequence_send as i64);
+        }
+        self.alerts.reset();
+        for alert in alerts {
+            self.alerts.with_label_values(&[alert.kind(), &alert.target()]).set(1);
+        }
+    }
+
+    /// Text exposition format
+    fn render(&self) -> String {
+        let mut buffer = Vec::new();
+        TextEncoder::new()
+            .encode(&self.registry.gather(), &mut buffer)
+            .expect("metrics encode");
+        String::from_utf8(buffer).expect("metrics are UTF-8")
+    }
+}
+
+async fn view<T: DeserializeOwned>(client: &JsonRpcClient, contract_id: &AccountId, method: &str, args: Value) -> Result<T, BoxError> {
+    let request = methods::query::RpcQueryRequest {
+        block_reference: BlockReference::Finality(Finality::Final),
+        request: QueryRequest::CallFunction {
+            account_id: contract_id.clone(),
+            method_name: method.to_string(),
+            args: args.to_string().into_bytes().into(),
+        },
+    };
+
+    let response = client.call(request).await
+        .map_err(|e| format!("{} on {} failed: {}", method, contract_id, e))?;
+
+    match response.kind {
+        QueryResponseKind::CallResult(call_result) => Ok(serde_json::from_slice(&call_result.result)?),
+        _ => Err(format!("Unexpected response type for {}", method).into()),
+    }
+}
+
+async fn poll_clients(client: &JsonRpcClient, contract_id: &AccountId) -> Result<Vec<ClientStatus>, BoxError> {
+    let mut clients = Vec::new();
+    for client_id in view::<Vec<String>>(client, contract_id, "get_all_clients", json!({})).await? {
+        let Some(state) = view::<Option<ClientState>>(client, contract_id, "get_client_state", json!({ "client_id": client_id })).await? else {
+            continue;
+        };
+        let height = state.latest_height.revision_height;
+        let consensus: Option<ConsensusState> = view(
+            client,
+            contract_id,
+            "get_consensus_state",
+            json!({ "client_id": client_id, "height": height }),
+        )
+        .await?;
+        clients.push(ClientStatus {
+            client_id,
+            latest_height: height,
+            trusted_until: consensus.map(|consensus| consensus.timestamp.saturating_add(state.trust_period)),
+        });
+    }
+    Ok(clients)
+}
+
+async fn poll_channels(
+    client: &JsonRpcClient,
+    contract_id: &AccountId,
+    probe_floor: &mut HashMap<(String, String), u64>,
+    max_probe: u64,
+) -> Result<Vec<ChannelStatus>, BoxError> {
+    let mut channels = Vec::new();
+    for (port_id, channel_id, end) in view::<Vec<(String, String, ChannelEnd)>>(client, contract_id, "get_all_channels", json!({})).await? {
+        if end.state != "Open" {
+            continue;
+        }
+        let args = json!({ "port_id": port_id, "channel_id": channel_id });
+        let next_sequence_send: u64 = view(client, contract_id, "query_next_sequence_send", args.clone()).await?;
+
+        let (pending, oldest_pending) = if end.ordering == "Ordered" {
+            let next_sequence_ack: u64 = view(client, contract_id, "query_next_sequence_ack", args).await?;
+            let pending = next_sequence_send.saturating_sub(next_sequence_ack);
+            (pending, (pending > 0).then_some(next_sequence_ack))
+        } else {
+            // Unordered channels acknowledge out of order and keep no ack sequence, so
+            // look for commitments upward from the oldest one seen last time
+            let key = (port_id.clone(), channel_id.clone());
+            let floor = probe_floor.get(&key).copied().unwrap_or(1);
+            let mut pending = 0;
+            let mut oldest = None;
+            for sequence in floor..next_sequence_send.min(floor.saturating_add(max_probe)) {
+                let commitment: Option<String> = view(
+                    client,
+                    contract_id,
+                    "query_packet_commitment",
+                    json!({ "port_id": port_id, "channel_id": channel_id, "sequence": sequence }),
+                )
+                .await?;
+                if commitment.is_some() {
+                    pending += 1;
+                    oldest.get_or_insert(sequence);
+                }
+            }
+            let probed_to = next_sequence_send.min(floor.saturating_add(max_probe));
+            probe_floor.insert(key, oldest.unwrap_or(probed_to));
+            (pending, oldest)
+        };
+
+        channels.push(ChannelStatus { port_id, channel_id, next_sequence_send, pending, oldest_pending });
+    }
+    Ok(channels)
+}
+
+async fn poll(client: &JsonRpcClient, cli: &Cli, watch: &mut Watch) -> Result<Snapshot, BoxError> {
+    let router_id: AccountId = cli.router_id.parse()?;
+    let block = client
+        .call(methods::block::RpcBlockRequest { block_reference: BlockReference::Finality(Finality::Final) })
+        .await
+        .map_err(|e| format!("block query failed: {}", e))?;
+
+    let mut snapshot = Snapshot {
+        observed_at: SystemTime::now().duration_since(UNIX_EPOCH)?.as_secs(),
+        head_height: block.header.height,
+        head_time: block.header.timestamp / 1_000_000_000,
+        halt_height: view(client, &router_id, "get_halt_height", json!({})).await?,
+        modules: view(client, &router_id, "health_check", json!({})).await?,
+        ..Default::default()
+    };
+    if let Some(contract_id) = &cli.client_contract {
+        snapshot.clients = poll_clients(client, &contract_id.parse()?).await?;
+    }
+    if let Some(contract_id) = &cli.channel_contract {
+        snapshot.channels = poll_channels(client, &contract_id.parse()?, &mut watch.probe_floor, cli.max_probe).await?;
+    }
+    Ok(snapshot)
+}
+
+async fn serve_metrics(State(metrics): State<Arc<MonitorMetrics>>) -> String {
+    metrics.render()
+}
+
+#[tokio::main]
+async fn main() -> Result<(), BoxError> {
+    tracing_subscriber::fmt::init();
+    let cli = Cli::parse();
+    let client = JsonRpcClient::connect(&cli.rpc_url);
+    let metrics = Arc::new(MonitorMetrics::new()?);
+    let mut watch = Watch::default();
+
+    if cli.once {
+        let snapshot = poll(&client, &cli, &mut watch).await?;
+        let alerts = watch.evaluate(&snapshot, cli.stuck_after, cli.stall_after);
+        metrics.update(&snapshot, &alerts);
+        print!("{}", metrics.render());
+        if !alerts.is_empty() {
+            std::process::exit(1);
+        }
+        return Ok(());
+    }
+
+    let app = Router::new().route("/metrics", get(serve_metrics)).with_state(metrics.clone());
+    let listener = tokio::net::TcpListener::bind(cli.listen).await?;
+    info!("serving metrics on http://{}/metrics", cli.listen);
+    tokio::spawn(async move { axum::serve(listener, app).await });
+
+    let mut interval = tokio::time::interval(Duration::from_secs(cli.interval));
+    loop {
+        interval.tick().await;
+        match poll(&client, &cli, &mut watch).await {
+            Ok(snapshot) => {
+                let alerts = watch.evaluate(&snapshot, cli.stuck_after, cli.stall_after);
+                metrics.update(&snapshot, &alerts);
+            }
+            Err(e) => {
+                metrics.poll_errors.inc();
+                warn!("poll failed: {}", e);
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn snapshot(observed_at: u64, head_height: u64, oldest_pending: Option<u64>) -> Snapshot {
+        Snapshot {
+            observed_at,
+            head_height,
+            head_time: 1_000,
+            halt_height: None,
+            modules: HashMap::from([("bank".to_string(), true)]),
+            clients: vec![ClientStatus { client_id: "07-tendermint-0".to_string(), latest_height: 50, trusted_until: Some(2_000) }],
+            channels: vec![ChannelStatus {
+                port_id: "transfer".to_string(),
+                channel_id: "channel-0".to_string(),
+                next_sequence_send: 10,
+                pending: oldest_pending.map_or(0, |sequence| 10 - sequence),
+                oldest_pending,
+            }],
+        }
+    }
+
+    #[test]
+    fn test_stuck_packets_and_stalled_blocks() {
+        let mut watch = Watch::default();
+        assert!(watch.evaluate(&snapshot(0, 100, Some(4)), 600, 120).is_empty());
+
+        // Packets move and blocks advance
+        assert!(watch.evaluate(&snapshot(500, 200, Some(7)), 600, 120).is_empty());
+
+        // Sequence 7 waits from t=500 on, the head stays at 200 from t=500 on
+        let alerts = watch.evaluate(&snapshot(1_100, 200, Some(7)), 600, 120);
+        assert_eq!(alerts, vec![
+            Alert::StalledBlocks { height: 200, secs: 600 },
+            Alert::StuckPackets {
+                port_id: "transfer".to_string(),
+                channel_id: "channel-0".to_string(),
+                sequence: 7,
+                pending: 3,
+                secs: 600,
+            },
+        ]);
+
+        // Once acknowledged, the channel clears
+        assert!(watch.evaluate(&snapshot(1_200, 300, None), 600, 120).is_empty());
+    }
+
+    #[test]
+    fn test_expired_client_and_halt() {
+        let mut watch = Watch::default();
+        let mut snapshot = snapshot(0, 100, None);
+        snapshot.head_time = 2_000;
+        snapshot.halt_height = Some(100);
+        snapshot.modules.insert("gov".to_string(), false);
+
+        let alerts = watch.evaluate(&snapshot, 600, 120);
+        assert_eq!(alerts, vec![
+            Alert::ModuleUnhealthy { module: "gov".to_string() },
+            Alert::Halted { height: 100 },
+            Alert::ExpiredClient { client_id: "07-tendermint-0".to_string(), expired_at: 2_000 },
+        ]);
+    }
+
+    #[test]
+    fn test_render() {
+        let metrics = MonitorMetrics::new().unwrap();
+        let snapshot = snapshot(0, 100, Some(4));
+        metrics.update(&snapshot, &[Alert::Halted { height: 100 }]);
+
+        let text = metrics.render();
+        assert!(text.contains("proxima_block_height 100"));
+        assert!(text.contains("proxima_packets_pending{channel=\"channel-0\",port=\"transfer\"} 6"));
+        assert!(text.contains("proxima_client_trust_remaining_seconds{client=\"07-tendermint-0\"} 1000"));
+        assert!(text.contains("proxima_alert{kind=\"halted\",target=\"chain\"} 1"));
+    }
+}
@@ -0,0 +1,141 @@
+// Staking history export CLI
+// Writes a delegator's delegations, undelegations, rewards and slashes as CSV for tax reporting
+
+use clap::Parser;
+use ibc_relayer::address_book::AddressBook;
+use near_jsonrpc_client::{methods, JsonRpcClient};
+use near_jsonrpc_primitives::types::query::QueryResponseKind;
+use near_primitives::types::{AccountId, BlockReference};
+use near_primitives::views::QueryRequest;
+use serde::Deserialize;
+use serde_json::json;
+use std::fs::File;
+use std::io::{self, Write};
+
+#[derive(Parser)]
+#[clap(name = "staking-export")]
+#[clap(about = "Export a delegator's staking history as CSV")]
+#[clap(version)]
+struct Cli {
+    /// NEAR RPC endpoint
+    #[clap(long, default_value = "https://rpc.testnet.near.org")]
+    rpc_url: String,
+    /// Staking contract account ID
+    #[clap(long)]
+    contract_id: String,
+    /// Delegator account ID or address book label
+    #[clap(long)]
+    delegator: String,
+    /// First block height to export (inclusive)
+    #[clap(long, default_value_t = 0)]
+    from_height: u64,
+    /// Last block height to export (inclusive)
+    #[clap(long, default_value_t = u64::MAX)]
+    to_height: u64,
+    /// Output file, stdout when omitted
+    #[clap(short, long)]
+    output: Option<String>,
+}
+
+/// History entry as returned by the `delegator_history` view
+#[derive(Debug, Deserialize)]
+struct HistoryEntry {
+    height: u64,
+    timestamp: u64,
+    kind: String,
+    validator_address: String,
+    dst_validator_address: Option<String>,
+    amount: u128,
+}
+
+const CSV_HEADER: &str = "height,timestamp,type,validator,dst_validator,amount";
+
+/// Quote a CSV field when it contains a separator, quote or newline
+fn csv_field(value: &str) -> String {
+    if value.contains(|c| c == ',' || c == '"' || c == '\n') {
+        format!("\"{}\"", value.replace('"', "\"\""))
+    } else {
+        value.to_string()
+    }
+}
+
+fn csv_row(entry: &HistoryEntry) -> String {
+    [
+        entry.height.to_string(),
+        entry.timestamp.to_string(),
+        entry.kind.to_lowercase(),
+        csv_field(&entry.validator_address),
+        csv_field(entry.dst_validator_address.as_deref().unwrap_or("")),
+        entry.amount.to_string(),
+    ]
+    .join(",")
+}
+
+async fn fetch_history(cli: &Cli) -> Result<Vec<HistoryEntry>, Box<dyn std::error::Error>> {
+    let client = JsonRpcClient::connect(&cli.rpc_url);
+    let contract_id: AccountId = cli.contract_id.parse()?;
+    let delegator = AddressBook::load(&AddressBook::default_path())?.resolve(&cli.delegator)?;
+    let args = json!({
+        "delegator": delegator,
+        "from_height": cli.from_height,
+        "to_height": cli.to_height,
+    });
+
+    let request = methods::query::RpcQueryRequest {
+        block_reference: BlockReference::latest(),
+        request: QueryRequest::CallFunction {
+            account_id: contract_id,
+            method_name: "delegator_history".to_string(),
+            args: args.to_string().into_bytes().into(),
+        },
+    };
+
+    let response = client.call(request).await
+        .map_err(|e| format!("NEAR RPC call failed: {}", e))?;
+
+    match response.kind {
+        QueryResponseKind::CallResult(call_result) => Ok(serde_json::from_slice(&call_result.result)?),
+        _ => Err("Unexpected response type for contract call".into()),
+    }
+}
+
+#[tokio::main]
+async fn main() -> Result<(), Box<dyn std::error::Error>> {
+    let cli = Cli::parse();
+
+    let history = fetch_history(&cli).await?;
+
+    let mut out: Box<dyn Write> = match &cli.output {
+        Some(path) => Box::new(File::create(path)?),
+        None => Box::new(io::stdout()),
+    };
+
+    writeln!(out, "{}", CSV_HEADER)?;
+    for entry in &history {
+        writeln!(out, "{}", csv_row(entry))?;
+    }
+
+    if let Some(path) = &cli.output {
+        eprintln!("Exported {} entries to {}", history.len(), path);
+    }
+
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_csv_row() {
+        let entry: HistoryEntry = serde_json::from_str(
+            r#"{"height":42,"timestamp":1000,"kind":"Redelegate","validator_address":"val1","dst_validator_address":"val,2","amount":500}"#,
+        ).unwrap();
+        assert_eq!(csv_row(&entry), "42,1000,redelegate,val1,\"val,2\",500");
+
+        let entry: HistoryEntry = serde_json::from_str(
+            r#"{"height":7,"timestamp":0,"kind":"Reward","validator_address":"val1","dst_validator_address":null,"amount":3}"#,
+        ).unwrap();
+        assert_eq!(csv_row(&entry), "7,0,reward,val1,,3");
+    }
+}
@@ -1,6 +1,7 @@
 // IBC Relayer Library
 // This module structure exposes the relayer components for testing and external use
 
+pub mod address_book;
 pub mod config;
 pub mod chains;
 pub mod cosmwasm;
@@ -12,6 +13,7 @@ pub mod monitor;
 pub mod testnet;
 
 // Re-export commonly used types for convenience
+pub use address_book::{AddressBook, AddressBookError, AddressKind, Contact};
 pub use config::{RelayerConfig, ChainConfig, ChainSpecificConfig, ConnectionConfig};
 pub use chains::{Chain, ChainEvent, IbcPacket};
 pub use keystore::{KeyManager, KeyManagerConfig, KeyEntry, KeyError};
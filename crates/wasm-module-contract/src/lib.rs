@@ -7,9 +7,9 @@
 /// - Admin functions and access control
 
 use near_sdk::borsh::{self, BorshDeserialize, BorshSerialize};
-use near_sdk::{env, near_bindgen, AccountId, PanicOnDefault};
+use near_sdk::{env, near_bindgen, AccountId, Gas, NearToken, PanicOnDefault, Promise};
 use near_sdk::json_types::Base64VecU8;
-use near_sdk::collections::{UnorderedMap, LookupMap};
+use near_sdk::collections::{UnorderedMap, UnorderedSet, LookupMap};
 use serde::{Deserialize, Serialize};
 use schemars::JsonSchema;
 use sha2::{Sha256, Digest};
@@ -26,6 +26,9 @@ use execution_queue::{ExecutionRequest, ExecutionStatus, CosmWasmCoin};
 
 pub type CodeID = u64;
 
+/// Gas for the router to run the module messages of a contract response
+const APPLY_RESPONSE_GAS: Gas = Gas::from_tgas(50);
+
 #[derive(Serialize, Deserialize, Clone, Debug, JsonSchema, BorshSerialize, BorshDeserialize)]
 #[serde(rename_all = "snake_case")]
 pub enum AccessConfig {
@@ -61,6 +64,23 @@ pub struct ContractInfo {
     pub created: u64,
 }
 
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq, BorshSerialize, BorshDeserialize, JsonSchema)]
+#[serde(rename_all = "snake_case")]
+pub enum ContractCodeHistoryOperation {
+    Init,
+    Migrate,
+}
+
+/// A code change of a contract
+#[derive(Serialize, Deserialize, Clone, Debug, BorshSerialize, BorshDeserialize, JsonSchema)]
+pub struct ContractCodeHistoryEntry {
+    pub operation: ContractCodeHistoryOperation,
+    pub code_id: CodeID,
+    /// Block height of the change
+    pub updated: u64,
+    pub msg: String,
+}
+
 // =============================================================================
 // Contract State
 // =============================================================================
@@ -90,6 +110,10 @@ pub struct WasmModuleContract {
     last_processed_height: u64,
     /// Request counter for unique IDs
     next_request_id: u64,
+    /// Codes pinned into the priority cache
+    pinned_codes: UnorderedSet<CodeID>,
+    /// Code history per contract, oldest entry first
+    contract_history: LookupMap<String, Vec<ContractCodeHistoryEntry>>,
 }
 
 // =============================================================================
@@ -120,6 +144,9 @@ pub struct ExecutionResultInput {
     pub state_changes: Vec<StateChangeInput>,
     pub events: Vec<ExecutionEvent>,
     pub gas_used: u64,
+    /// CosmWasm sub-messages the contract emitted, run by the router
+    #[serde(default)]
+    pub messages: Vec<serde_json::Value>,
 }
 
 #[derive(Serialize, Deserialize, Debug, JsonSchema)]
@@ -173,6 +200,8 @@ impl WasmModuleContract {
             execution_queue: UnorderedMap::new(b"q"),
             last_processed_height: 0,
             next_request_id: 1,
+            pinned_codes: UnorderedSet::new(b"p"),
+            contract_history: LookupMap::new(b"h"),
         }
     }
 
@@ -288,6 +317,7 @@ impl WasmModuleContract {
         };
         
         self.contracts.insert(&contract_addr, &contract_info);
+        self.record_history(&contract_addr, ContractCodeHistoryOperation::Init, code_id, &msg);
         
         // Initialize contract state (mock for now)
         let state_key = format!("{}:state", contract_addr);
@@ -319,24 +349,7 @@ impl WasmModuleContract {
         // Use original_caller if provided (when called through router), otherwise use direct caller
         let actual_caller = original_caller.unwrap_or_else(|| env::predecessor_account_id());
         let sender = address::near_to_cosmos_address(&actual_caller, None);
-        let mut request = ExecutionRequest::new(
-            contract_addr.clone(),
-            contract_info.code_id,
-            "execute".to_string(),
-            msg.as_bytes().to_vec(),
-            sender,
-            env::block_height(),
-            env::block_timestamp(),
-        );
-        
-        // Override request ID with unique counter
-        request.request_id = format!("exec_{}", self.next_request_id);
-        self.next_request_id += 1;
-        
-        let request_id = request.request_id.clone();
-        self.execution_queue.insert(&request_id, &request);
-        
-        env::log_str(&format!("Queued execution request {} for contract {}", request_id, contract_addr));
+        let request_id = self.queue_request(&contract_addr, contract_info.code_id, "execute", msg, sender);
         
         // Return a response indicating the request was queued
         let events = vec![
@@ -365,6 +378,108 @@ impl WasmModuleContract {
         }
     }
 
+    /// Call a contract's sudo entrypoint (queues for relayer processing)
+    /// 
+    /// Sudo is the privileged entrypoint governance uses, so only the owner
+    /// or the router may call it and no user sender is forwarded; the module
+    /// itself is the sender the contract sees.
+    pub fn sudo(&mut self, contract_addr: String, msg: String) -> ExecuteResponse {
+        self.assert_authorized();
+        assert!(!msg.is_empty(), "Sudo message must not be empty");
+
+        let contract_info = self.contracts.get(&contract_addr)
+            .expect("Contract does not exist");
+        let sender = address::near_to_cosmos_address(&env::current_account_id(), None);
+        let request_id = self.queue_request(&contract_addr, contract_info.code_id, "sudo", msg, sender);
+
+        ExecuteResponse {
+            data: Some(format!("Request queued: {}", request_id)),
+            events: vec![
+                Event {
+                    r#type: "wasm".to_string(),
+                    attributes: vec![
+                        Attribute {
+                            key: "_contract_address".to_string(),
+                            value: contract_addr,
+                        },
+                        Attribute {
+                            key: "action".to_string(),
+                            value: "sudo_queued".to_string(),
+                        },
+                        Attribute {
+                            key: "request_id".to_string(),
+                            value: request_id,
+                        },
+                    ],
+                },
+            ],
+        }
+    }
+
+    /// Move a contract to new code and call its migrate entrypoint (queues
+    /// for relayer processing)
+    /// 
+    /// Only the contract admin may migrate, the new code must exist and
+    /// differ from the current one.
+    pub fn migrate(
+        &mut self,
+        contract_addr: String,
+        new_code_id: CodeID,
+        msg: String,
+        original_caller: Option<AccountId>,
+    ) -> ExecuteResponse {
+        self.assert_authorized();
+        
+        let mut contract_info = self.contracts.get(&contract_addr)
+            .expect("Contract does not exist");
+        let actual_caller = original_caller.unwrap_or_else(|| env::predecessor_account_id());
+        let sender = address::near_to_cosmos_address(&actual_caller, None);
+        match &contract_info.admin {
+            Some(admin) if admin == actual_caller.as_str() || admin == &sender => {}
+            Some(_) => env::panic_str("Only the contract admin can migrate"),
+            None => env::panic_str("Contract has no admin and cannot be migrated"),
+        }
+        assert!(self.codes.get(&new_code_id).is_some(), "Code ID does not exist");
+        assert_ne!(contract_info.code_id, new_code_id, "Contract already runs this code");
+        
+        let old_code_id = contract_info.code_id;
+        contract_info.code_id = new_code_id;
+        self.contracts.insert(&contract_addr, &contract_info);
+        self.record_history(&contract_addr, ContractCodeHistoryOperation::Migrate, new_code_id, &msg);
+        let request_id = self.queue_request(&contract_addr, new_code_id, "migrate", msg, sender);
+        
+        ExecuteResponse {
+            data: Some(format!("Request queued: {}", request_id)),
+            events: vec![
+                Event {
+                    r#type: "wasm".to_string(),
+                    attributes: vec![
+                        Attribute {
+                            key: "_contract_address".to_string(),
+                            value: contract_addr,
+                        },
+                        Attribute {
+                            key: "action".to_string(),
+                            value: "migrate_queued".to_string(),
+                        },
+                        Attribute {
+                            key: "request_id".to_string(),
+                            value: request_id,
+                        },
+                        Attribute {
+                            key: "old_code_id".to_string(),
+                            value: old_code_id.to_string(),
+                        },
+                        Attribute {
+                            key: "code_id".to_string(),
+                            value: new_code_id.to_string(),
+                        },
+                    ],
+                },
+            ],
+        }
+    }
+
     /// Query contract state (read-only)
     pub fn query(
         &self,
@@ -411,6 +526,28 @@ impl WasmModuleContract {
             }
         }
         
+        // The router holds the contracts' funds and runs their bank messages,
+        // all of them or none
+        if !execution_result.messages.is_empty() {
+            let router = self.router_contract.clone()
+                .unwrap_or_else(|| env::panic_str("Contract emitted messages but no router is set"));
+            let args = serde_json::json!({
+                "contract_addr": contract_addr,
+                "response": {
+                    "messages": execution_result.messages,
+                    "attributes": [],
+                    "events": [],
+                    "data": null,
+                },
+            });
+            Promise::new(router).function_call(
+                "wasm_apply_response".to_string(),
+                args.to_string().into_bytes(),
+                NearToken::from_yoctonear(0),
+                APPLY_RESPONSE_GAS,
+            );
+        }
+        
         // Create events from execution result
         let mut events = vec![
             Event {
@@ -589,6 +726,22 @@ impl WasmModuleContract {
         self.contracts.get(&contract_addr).map(|info| info.code_id)
     }
 
+    /// Code changes of a contract, oldest first
+    pub fn contract_history(&self, contract_addr: String) -> Vec<ContractCodeHistoryEntry> {
+        self.contract_history.get(&contract_addr).unwrap_or_default()
+    }
+
+    pub fn is_code_pinned(&self, code_id: CodeID) -> bool {
+        self.pinned_codes.contains(&code_id)
+    }
+
+    /// Pinned code IDs in ascending order
+    pub fn list_pinned_codes(&self) -> Vec<CodeID> {
+        let mut code_ids: Vec<CodeID> = self.pinned_codes.iter().collect();
+        code_ids.sort_unstable();
+        code_ids
+    }
+
     /// Health check
     pub fn health_check(&self) -> serde_json::Value {
         serde_json::json!({
@@ -613,7 +766,11 @@ impl WasmModuleContract {
                 "instantiate",
                 "execute",
                 "query",
-                "migrate"
+                "migrate",
+                "sudo",
+                "pin_codes",
+                "update_instantiate_config",
+                "contract_history"
             ],
             "stats": {
                 "codes_stored": self.next_code_id - 1,
@@ -648,6 +805,62 @@ impl WasmModuleContract {
         env::log_str(&format!("Router updated to: {}", new_router));
     }
 
+    /// Pin codes into the priority cache
+    /// 
+    /// Pinning is a governance decision, so like `sudo` only the owner or
+    /// the router may call it.
+    pub fn pin_codes(&mut self, code_ids: Vec<CodeID>) {
+        self.assert_authorized();
+        for code_id in &code_ids {
+            assert!(self.codes.get(code_id).is_some(), "Code ID {} does not exist", code_id);
+        }
+        for code_id in code_ids {
+            if self.pinned_codes.insert(&code_id) {
+                env::log_str(&format!("Pinned code {}", code_id));
+            }
+        }
+    }
+
+    /// Unpin codes from the priority cache
+    pub fn unpin_codes(&mut self, code_ids: Vec<CodeID>) {
+        self.assert_authorized();
+        for code_id in code_ids {
+            if self.pinned_codes.remove(&code_id) {
+                env::log_str(&format!("Unpinned code {}", code_id));
+            }
+        }
+    }
+
+    /// Change who may instantiate a code
+    /// 
+    /// A call forwarded for a user (with `original_caller`) must come from
+    /// the code creator; the owner or router acting on their own behalf
+    /// speaks for governance and may change any code.
+    pub fn update_instantiate_config(
+        &mut self,
+        code_id: CodeID,
+        instantiate_permission: AccessConfig,
+        original_caller: Option<AccountId>,
+    ) {
+        self.assert_authorized();
+        let mut code_info = self.codes.get(&code_id)
+            .expect("Code ID does not exist");
+        if let Some(caller) = original_caller {
+            let sender = address::near_to_cosmos_address(&caller, None);
+            assert!(
+                code_info.creator == sender || code_info.creator == caller.as_str(),
+                "Only the code creator can update the instantiate config"
+            );
+        }
+
+        code_info.instantiate_permission = instantiate_permission;
+        self.codes.insert(&code_id, &code_info);
+        env::log_str(&format!(
+            "Updated instantiate permission of code {} to {:?}",
+            code_id, code_info.instantiate_permission
+        ));
+    }
+
     // =============================================================================
     // Helper Functions
     // =============================================================================
@@ -662,6 +875,54 @@ impl WasmModuleContract {
         );
     }
 
+    /// Add a request for the relayer to run `entry_point` and return its id
+    fn queue_request(
+        &mut self,
+        contract_addr: &str,
+        code_id: CodeID,
+        entry_point: &str,
+        msg: String,
+        sender: String,
+    ) -> String {
+        let mut request = ExecutionRequest::new(
+            contract_addr.to_string(),
+            code_id,
+            entry_point.to_string(),
+            msg.into_bytes(),
+            sender,
+            env::block_height(),
+            env::block_timestamp(),
+        );
+        
+        // Override request ID with unique counter
+        request.request_id = format!("exec_{}", self.next_request_id);
+        self.next_request_id += 1;
+        
+        let request_id = request.request_id.clone();
+        self.execution_queue.insert(&request_id, &request);
+        
+        env::log_str(&format!("Queued {} request {} for contract {}", entry_point, request_id, contract_addr));
+        request_id
+    }
+
+    fn record_history(
+        &mut self,
+        contract_addr: &str,
+        operation: ContractCodeHistoryOperation,
+        code_id: CodeID,
+        msg: &str,
+    ) {
+        let contract_addr = contract_addr.to_string();
+        let mut history = self.contract_history.get(&contract_addr).unwrap_or_default();
+        history.push(ContractCodeHistoryEntry {
+            operation,
+            code_id,
+            updated: env::block_height(),
+            msg: msg.to_string(),
+        });
+        self.contract_history.insert(&contract_addr, &history);
+    }
+
     fn assert_owner(&self) {
         assert_eq!(
             env::predecessor_account_id(),
@@ -1,5 +1,5 @@
 /// Tests for execution queue and relayer query features
-use wasm_module_contract::WasmModuleContract;
+use wasm_module_contract::{AccessConfig, ContractCodeHistoryOperation, WasmModuleContract};
 use wasm_module_contract::execution_queue::{ExecutionRequest, ExecutionStatus};
 use near_sdk::json_types::Base64VecU8;
 use near_sdk::test_utils::{accounts, VMContextBuilder};
@@ -200,6 +200,104 @@ fn test_update_execution_status_unauthorized() {
     );
 }
 
+#[test]
+fn test_sudo_queues_request_for_governance() {
+    let (mut contract, _code_id, contract_addr) = setup_contract_with_code();
+    
+    let response = contract.sudo(contract_addr.clone(), r#"{"halt": {}}"#.to_string());
+    assert_eq!(response.events[0].attributes[1].value, "sudo_queued");
+    
+    let pending = contract.get_pending_executions(None);
+    assert_eq!(pending.len(), 1);
+    assert_eq!(pending[0].entry_point, "sudo");
+    assert_eq!(pending[0].msg, br#"{"halt": {}}"#.to_vec());
+}
+
+#[test]
+#[should_panic(expected = "Unauthorized: caller must be owner, router, or self")]
+fn test_sudo_unauthorized() {
+    let (mut contract, _code_id, contract_addr) = setup_contract_with_code();
+    
+    let mut context = VMContextBuilder::new();
+    context
+        .current_account_id(accounts(0))
+        .signer_account_id(accounts(2))
+        .predecessor_account_id(accounts(2));
+    testing_env!(context.build());
+    
+    contract.sudo(contract_addr, r#"{"halt": {}}"#.to_string());
+}
+
+#[test]
+fn test_migrate_queues_request_for_new_code() {
+    let (mut contract, code_id, _) = setup_contract_with_code();
+    let admin = accounts(1).to_string();
+    let contract_addr = contract.instantiate(code_id, "{}".to_string(), None, "migratable".to_string(), Some(admin), None)
+        .address;
+    let v2 = contract.store_code(
+        Base64VecU8::from(vec![0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00, 0x01]),
+        Some("v2".to_string()),
+        None,
+        None,
+        None,
+    ).code_id;
+    
+    let response = contract.migrate(contract_addr.clone(), v2, r#"{"upgrade": {}}"#.to_string(), None);
+    assert_eq!(response.events[0].attributes[1].value, "migrate_queued");
+    assert_eq!(contract.get_contract_code_id(contract_addr.clone()), Some(v2));
+    
+    let pending = contract.get_pending_executions(None);
+    assert_eq!(pending.len(), 1);
+    assert_eq!(pending[0].entry_point, "migrate");
+    assert_eq!(pending[0].code_id, v2);
+    
+    let history = contract.contract_history(contract_addr);
+    assert_eq!(history.len(), 2);
+    assert_eq!((history[0].operation.clone(), history[0].code_id), (ContractCodeHistoryOperation::Init, code_id));
+    assert_eq!((history[1].operation.clone(), history[1].code_id), (ContractCodeHistoryOperation::Migrate, v2));
+    assert_eq!(history[1].msg, r#"{"upgrade": {}}"#);
+}
+
+#[test]
+fn test_pin_codes_and_update_instantiate_config() {
+    let (mut contract, code_id, _) = setup_contract_with_code();
+    
+    contract.pin_codes(vec![code_id]);
+    assert!(contract.is_code_pinned(code_id));
+    assert_eq!(contract.list_pinned_codes(), vec![code_id]);
+    contract.unpin_codes(vec![code_id]);
+    assert!(contract.list_pinned_codes().is_empty());
+    
+    // The owner acting for governance may restrict any code
+    contract.update_instantiate_config(code_id, AccessConfig::Nobody {}, None);
+    assert!(matches!(contract.get_code_info(code_id).unwrap().instantiate_permission, AccessConfig::Nobody {}));
+    
+    // The creator may open it again through the router
+    contract.update_instantiate_config(code_id, AccessConfig::Everybody {}, Some(accounts(1)));
+    assert!(matches!(contract.get_code_info(code_id).unwrap().instantiate_permission, AccessConfig::Everybody {}));
+}
+
+#[test]
+#[should_panic(expected = "Only the code creator can update the instantiate config")]
+fn test_update_instantiate_config_needs_the_creator() {
+    let (mut contract, code_id, _) = setup_contract_with_code();
+    contract.update_instantiate_config(code_id, AccessConfig::Nobody {}, Some(accounts(2)));
+}
+
+#[test]
+#[should_panic(expected = "Code ID 9 does not exist")]
+fn test_pin_unknown_code() {
+    let (mut contract, _code_id, _) = setup_contract_with_code();
+    contract.pin_codes(vec![9]);
+}
+
+#[test]
+#[should_panic(expected = "Contract has no admin and cannot be migrated")]
+fn test_migrate_needs_an_admin() {
+    let (mut contract, code_id, contract_addr) = setup_contract_with_code();
+    contract.migrate(contract_addr, code_id + 1, "{}".to_string(), None);
+}
+
 #[test]
 fn test_multiple_pending_executions() {
     let (mut contract, _code_id, contract_addr) = setup_contract_with_code();
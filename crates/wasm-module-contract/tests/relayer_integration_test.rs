@@ -75,6 +75,7 @@ fn test_apply_execution_result_from_owner() {
             },
         ],
         gas_used: 1000000,
+        messages: vec![],
     };
     
     // Apply execution result
@@ -121,6 +122,7 @@ fn test_apply_execution_result_from_relayer() {
         ],
         events: vec![],
         gas_used: 500000,
+        messages: vec![],
     };
     
     // Should succeed from relayer account
@@ -151,6 +153,7 @@ fn test_apply_execution_result_unauthorized() {
         state_changes: vec![],
         events: vec![],
         gas_used: 0,
+        messages: vec![],
     };
     
     // Should panic for unauthorized account
@@ -160,6 +163,27 @@ fn test_apply_execution_result_unauthorized() {
     );
 }
 
+#[test]
+#[should_panic(expected = "Contract emitted messages but no router is set")]
+fn test_apply_execution_result_messages_need_a_router() {
+    let (mut contract, contract_addr) = setup_contract();
+    
+    let execution_result = ExecutionResultInput {
+        data: None,
+        state_changes: vec![],
+        events: vec![],
+        gas_used: 0,
+        messages: vec![serde_json::json!({
+            "id": 0,
+            "msg": {"bank": {"send": {"to_address": "bob.near", "amount": [{"denom": "unear", "amount": 1}]}}},
+            "gas_limit": null,
+            "reply_on": "Never",
+        })],
+    };
+    
+    contract.apply_execution_result(contract_addr, execution_result);
+}
+
 #[test]
 fn test_get_contract_state() {
     let (mut contract, contract_addr) = setup_contract();
@@ -181,6 +205,7 @@ fn test_get_contract_state() {
         ],
         events: vec![],
         gas_used: 0,
+        messages: vec![],
     };
     
     contract.apply_execution_result(
@@ -235,6 +260,7 @@ fn test_get_contract_state_batch() {
         ],
         events: vec![],
         gas_used: 0,
+        messages: vec![],
     };
     
     contract.apply_execution_result(
@@ -271,6 +297,7 @@ fn test_state_remove_operation() {
         ],
         events: vec![],
         gas_used: 0,
+        messages: vec![],
     };
     
     contract.apply_execution_result(
@@ -297,6 +324,7 @@ fn test_state_remove_operation() {
         ],
         events: vec![],
         gas_used: 0,
+        messages: vec![],
     };
     
     contract.apply_execution_result(